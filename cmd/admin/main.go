@@ -0,0 +1,313 @@
+// Command admin manages users, permissions and tokens directly in the database, using the same
+// configuration files as the API:
+//
+//	admin [-config-path dir] user activate <email>
+//	admin [-config-path dir] user set-password <email>
+//	admin [-config-path dir] perm grant <email> <code>
+//	admin [-config-path dir] perm revoke <email> <code>
+//	admin [-config-path dir] token purge-expired
+//	admin [-config-path dir] token count <email>
+//	admin [-config-path dir] token purge <email>
+//
+// The result of a command is printed to stdout as a JSON object and errors to stderr as
+// {"error": "..."}. The exit code is 0 on success, 1 on failure, 2 on a usage error and 3 if the
+// user or permission doesn't exist.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/term"
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/breach"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
+)
+
+// Exit codes.
+const (
+    exitFailure  = 1
+    exitUsage    = 2
+    exitNotFound = 3
+)
+
+var (
+    errUsage             = errors.New("usage: admin [-config-path dir] user activate|set-password <email> | perm grant|revoke <email> <code> | token purge-expired | token count|purge <email>")
+    errUnknownPermission = errors.New("unknown permission")
+)
+
+// cli runs the admin commands.
+type cli struct {
+    models       data.Models
+    out          io.Writer
+    readPassword func(prompt string) (string, error)
+}
+
+func main() {
+    var configPath string
+    flag.StringVar(&configPath, "config-path", "config", "The directory that contains configuration files.")
+    flag.Parse()
+
+    // Check the command before connecting to the database.
+    cmd, err := command(flag.Args())
+    if err != nil {
+        exit(err)
+    }
+
+    models, closeDB, err := openModels(configPath)
+    if err != nil {
+        exit(err)
+    }
+
+    c := &cli{models: models, out: os.Stdout, readPassword: readPassword}
+    err = cmd(c, context.Background())
+    closeDB()
+
+    if err != nil {
+        exit(err)
+    }
+}
+
+// exit prints err as JSON to stderr and exits with the matching exit code.
+func exit(err error) {
+    json.NewEncoder(os.Stderr).Encode(map[string]string{"error": err.Error()})
+
+    switch {
+    case errors.Is(err, errUsage):
+        os.Exit(exitUsage)
+    case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, errUnknownPermission):
+        os.Exit(exitNotFound)
+    default:
+        os.Exit(exitFailure)
+    }
+}
+
+// openModels loads dynamic.* and dynamic_db_secret.* from configPath in the same way as the API
+// and connects to the database.
+func openModels(configPath string) (data.Models, func(), error) {
+    var cfgDynamic, cfgDB config.Config
+
+    err := config.LoadConfig(viper.New(), configPath, "", "dynamic", flag.CommandLine, &cfgDynamic)
+    if err != nil {
+        return data.Models{}, nil, err
+    }
+
+    err = config.LoadConfig(viper.New(), configPath, "", "dynamic_db_secret", flag.CommandLine, &cfgDB)
+    if err != nil {
+        return data.Models{}, nil, err
+    }
+
+    errs := slices.Concat(cfgDynamic.ValidateDynamic(), cfgDB.ValidateDB())
+    if len(errs) > 0 {
+        return data.Models{}, nil, fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+    }
+
+    var pw data.PoolWrapper
+
+    err = pw.CreatePool(cfgDB.DBPool())
+    if err != nil {
+        return data.Models{}, nil, err
+    }
+
+    queryTimeouts := data.NewQueryTimeouts(
+        cfgDynamic.DBTimeoutRead, cfgDynamic.DBTimeoutWrite, cfgDynamic.DBTimeoutList, cfgDynamic.DBTimeoutToken,
+    )
+
+    return data.NewModels(&pw, queryTimeouts), pw.Close, nil
+}
+
+// readPassword prompts for a password on stderr and reads it from stdin without echo. If stdin
+// isn't a terminal, e.g. when piped from a script, it reads a line instead.
+func readPassword(prompt string) (string, error) {
+    fd := int(os.Stdin.Fd())
+
+    if !term.IsTerminal(fd) {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && !errors.Is(err, io.EOF) {
+            return "", err
+        }
+        return strings.TrimRight(line, "\r\n"), nil
+    }
+
+    fmt.Fprint(os.Stderr, prompt)
+    b, err := term.ReadPassword(fd)
+    fmt.Fprintln(os.Stderr)
+
+    return string(b), err
+}
+
+// command returns the function running the command in args, or errUsage.
+func command(args []string) (func(c *cli, ctx context.Context) error, error) {
+    switch {
+    case len(args) == 3 && args[0] == "user" && args[1] == "activate":
+        return func(c *cli, ctx context.Context) error { return c.activateUser(ctx, args[2]) }, nil
+    case len(args) == 3 && args[0] == "user" && args[1] == "set-password":
+        return func(c *cli, ctx context.Context) error { return c.setPassword(ctx, args[2]) }, nil
+    case len(args) == 4 && args[0] == "perm" && args[1] == "grant":
+        return func(c *cli, ctx context.Context) error { return c.changePermission(ctx, args[2], args[3], true) }, nil
+    case len(args) == 4 && args[0] == "perm" && args[1] == "revoke":
+        return func(c *cli, ctx context.Context) error { return c.changePermission(ctx, args[2], args[3], false) }, nil
+    case len(args) == 2 && args[0] == "token" && args[1] == "purge-expired":
+        return func(c *cli, ctx context.Context) error { return c.purgeExpiredTokens(ctx) }, nil
+    case len(args) == 3 && args[0] == "token" && args[1] == "count":
+        return func(c *cli, ctx context.Context) error { return c.countTokens(ctx, args[2]) }, nil
+    case len(args) == 3 && args[0] == "token" && args[1] == "purge":
+        return func(c *cli, ctx context.Context) error { return c.purgeTokens(ctx, args[2]) }, nil
+    default:
+        return nil, errUsage
+    }
+}
+
+// run runs the command in args.
+func (c *cli) run(ctx context.Context, args []string) error {
+    cmd, err := command(args)
+    if err != nil {
+        return err
+    }
+
+    return cmd(c, ctx)
+}
+
+// print writes v to the output as JSON.
+func (c *cli) print(v any) error {
+    return json.NewEncoder(c.out).Encode(v)
+}
+
+func (c *cli) activateUser(ctx context.Context, email string) error {
+    user, err := c.models.User.GetByEmail(ctx, data.NormalizeEmail(email))
+    if err != nil {
+        return fmt.Errorf("user %s: %w", email, err)
+    }
+
+    if !user.Activated {
+        user.Activated = true
+
+        err = c.models.User.Update(ctx, user)
+        if err != nil {
+            return err
+        }
+    }
+
+    return c.print(map[string]any{"email": user.Email, "activated": true})
+}
+
+func (c *cli) setPassword(ctx context.Context, email string) error {
+    user, err := c.models.User.GetByEmail(ctx, data.NormalizeEmail(email))
+    if err != nil {
+        return fmt.Errorf("user %s: %w", email, err)
+    }
+
+    password, err := c.readPassword("New password: ")
+    if err != nil {
+        return err
+    }
+
+    v := validator.New()
+    data.ValidatePassword(v, password)
+    if _, ok := v.Errors["password"]; !ok && breach.Common(password) {
+        v.AddError("password", "is too common")
+    }
+
+    if !v.Valid() {
+        return fmt.Errorf("password %s", strings.Join(v.Errors["password"], ", "))
+    }
+
+    err = user.Password.Set(password)
+    if err != nil {
+        return err
+    }
+
+    err = c.models.User.Update(ctx, user)
+    if err != nil {
+        return err
+    }
+
+    return c.print(map[string]any{"email": user.Email, "password_changed": true})
+}
+
+func (c *cli) changePermission(ctx context.Context, email, code string, grant bool) error {
+    codes, err := c.models.Permission.GetAll(ctx)
+    if err != nil {
+        return err
+    }
+    if !codes.Include(code) {
+        return fmt.Errorf("%w %q, must be one of %s", errUnknownPermission, code, strings.Join(codes, ", "))
+    }
+
+    user, err := c.models.User.GetByEmail(ctx, data.NormalizeEmail(email))
+    if err != nil {
+        return fmt.Errorf("user %s: %w", email, err)
+    }
+
+    if grant {
+        err = c.models.Permission.AddForUser(ctx, user.ID, code)
+    } else {
+        err = c.models.Permission.RemoveForUser(ctx, user.ID, code)
+    }
+    if err != nil {
+        return err
+    }
+
+    permissions, err := c.models.Permission.GetAllForUser(ctx, user.ID)
+    if err != nil {
+        return err
+    }
+    if permissions == nil {
+        permissions = data.Permissions{}
+    }
+
+    return c.print(map[string]any{"email": user.Email, "permissions": permissions})
+}
+
+func (c *cli) purgeExpiredTokens(ctx context.Context) error {
+    n, err := c.models.Token.DeleteExpired(ctx)
+    if err != nil {
+        return err
+    }
+
+    return c.print(map[string]any{"deleted": n})
+}
+
+// countTokens prints the number of unexpired tokens of the user by scope.
+func (c *cli) countTokens(ctx context.Context, email string) error {
+    user, err := c.models.User.GetByEmail(ctx, data.NormalizeEmail(email))
+    if err != nil {
+        return fmt.Errorf("user %s: %w", email, err)
+    }
+
+    counts := make(map[string]int, len(data.Scopes))
+
+    for _, scope := range data.Scopes {
+        counts[scope], err = c.models.Token.CountForUser(ctx, user.ID, scope)
+        if err != nil {
+            return err
+        }
+    }
+
+    return c.print(map[string]any{"email": user.Email, "tokens": counts})
+}
+
+// purgeTokens deletes all tokens of the user in every scope.
+func (c *cli) purgeTokens(ctx context.Context, email string) error {
+    user, err := c.models.User.GetByEmail(ctx, data.NormalizeEmail(email))
+    if err != nil {
+        return fmt.Errorf("user %s: %w", email, err)
+    }
+
+    n, err := c.models.Token.DeleteAllForUserAllScopes(ctx, user.ID)
+    if err != nil {
+        return err
+    }
+
+    return c.print(map[string]any{"email": user.Email, "deleted": n})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func newTestCLI(password string) (*cli, *bytes.Buffer) {
+    var out bytes.Buffer
+
+    return &cli{
+        models:       mock.NewModels(),
+        out:          &out,
+        readPassword: func(string) (string, error) { return password, nil },
+    }, &out
+}
+
+func TestRun(t *testing.T) {
+    tests := []struct {
+        name    string
+        args    []string
+        wantErr error
+        want    map[string]any
+    }{
+        {"activate", []string{"user", "activate", mock.InactiveUserEmail}, nil, map[string]any{"email": mock.InactiveUserEmail, "activated": true}},
+        {"activate unknown user", []string{"user", "activate", "nobody@example.com"}, data.ErrRecordNotFound, nil},
+        {"set password", []string{"user", "set-password", mock.ActivatedUserEmail}, nil, map[string]any{"email": mock.ActivatedUserEmail, "password_changed": true}},
+        {"grant", []string{"perm", "grant", mock.ReadOnlyUserEmail, "movie:write"}, nil, map[string]any{"email": mock.ReadOnlyUserEmail, "permissions": []any{"movie:read", "movie:write"}}},
+        {"revoke", []string{"perm", "revoke", mock.ReadOnlyUserEmail, "movie:read"}, nil, map[string]any{"email": mock.ReadOnlyUserEmail, "permissions": []any{}}},
+        {"grant unknown permission", []string{"perm", "grant", mock.ReadOnlyUserEmail, "movie:fly"}, errUnknownPermission, nil},
+        {"purge", []string{"token", "purge-expired"}, nil, map[string]any{"deleted": float64(0)}},
+        {"count", []string{"token", "count", mock.ActivatedUserEmail}, nil, map[string]any{"email": mock.ActivatedUserEmail, "tokens": map[string]any{"activation": 0, "api-key": 0, "authentication": 0, "password-reset": 0}}},
+        {"purge user", []string{"token", "purge", mock.ActivatedUserEmail}, nil, map[string]any{"email": mock.ActivatedUserEmail, "deleted": 0}},
+        {"purge unknown user", []string{"token", "purge", "nobody@example.com"}, data.ErrRecordNotFound, nil},
+        {"no command", nil, errUsage, nil},
+        {"unknown command", []string{"user", "delete", mock.ActivatedUserEmail}, errUsage, nil},
+        {"missing argument", []string{"perm", "grant", mock.ActivatedUserEmail}, errUsage, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c, out := newTestCLI("n3wpassword")
+
+            err := c.run(context.Background(), tt.args)
+            if !errors.Is(err, tt.wantErr) {
+                t.Fatalf("got error %v; want %v", err, tt.wantErr)
+            }
+            if err != nil {
+                return
+            }
+
+            var got map[string]any
+            err = json.Unmarshal(out.Bytes(), &got)
+            if err != nil {
+                t.Fatalf("output %q isn't JSON: %v", out.String(), err)
+            }
+
+            gotJSON, _ := json.Marshal(got)
+            wantJSON, _ := json.Marshal(tt.want)
+            if !bytes.Equal(gotJSON, wantJSON) {
+                t.Errorf("got %s; want %s", gotJSON, wantJSON)
+            }
+        })
+    }
+}
+
+func TestSetPassword(t *testing.T) {
+    ctx := context.Background()
+
+    c, _ := newTestCLI("short")
+
+    err := c.run(ctx, []string{"user", "set-password", mock.ActivatedUserEmail})
+    if err == nil {
+        t.Fatal("got no error for an invalid password")
+    }
+
+    c, _ = newTestCLI("n3wpassword")
+
+    err = c.run(ctx, []string{"user", "set-password", mock.ActivatedUserEmail})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    user, err := c.models.User.GetByEmail(ctx, mock.ActivatedUserEmail)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if match, _ := user.Password.Matches("n3wpassword"); !match {
+        t.Error("password wasn't changed")
+    }
+}
+
+func TestPurgeExpiredTokens(t *testing.T) {
+    ctx := context.Background()
+    c, out := newTestCLI("")
+
+    expired := &data.Token{Hash: []byte("expired"), UserID: mock.ActivatedUserID, Scope: data.ScopeAuthentication}
+    expiry := time.Now().Add(-time.Hour)
+    expired.Expiry = &expiry
+
+    err := c.models.Token.Insert(ctx, expired)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = c.models.Token.New(ctx, mock.ActivatedUserID, time.Hour, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = c.run(ctx, []string{"token", "purge-expired"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if got := out.String(); got != "{\"deleted\":1}\n" {
+        t.Errorf("got %q; want one token deleted", got)
+    }
+}
+
+func TestPurgeTokens(t *testing.T) {
+    ctx := context.Background()
+    c, out := newTestCLI("")
+
+    for _, scope := range []string{data.ScopeActivation, data.ScopeAuthentication, data.ScopeAuthentication} {
+        _, err := c.models.Token.New(ctx, mock.InactiveUserID, time.Hour, scope)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, err := c.models.Token.New(ctx, mock.ActivatedUserID, time.Hour, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = c.run(ctx, []string{"token", "count", mock.InactiveUserEmail})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := out.String(), `{"email":"bob@example.com","tokens":{"activation":1,"api-key":0,"authentication":2,"password-reset":0}}`+"\n"; got != want {
+        t.Errorf("count: got %q; want %q", got, want)
+    }
+
+    out.Reset()
+
+    err = c.run(ctx, []string{"token", "purge", mock.InactiveUserEmail})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := out.String(), `{"deleted":3,"email":"bob@example.com"}`+"\n"; got != want {
+        t.Errorf("purge: got %q; want %q", got, want)
+    }
+
+    // Alice's token is intact.
+    if n, _ := c.models.Token.CountForUser(ctx, mock.ActivatedUserID, data.ScopeAuthentication); n != 1 {
+        t.Errorf("got %d tokens of another user; want 1", n)
+    }
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/tomasen/realip"
+	"greenlight.zzh.net/internal/data"
+)
+
+// audit records a security event about user, which may be nil or the anonymous user. Events are
+// logged in the "audit" group and, with -audit-store=db, also inserted into the audit_log table
+// in background. detail is free text: never put a password or a token in it.
+func (app *application) audit(r *http.Request, event string, user *data.User, email, detail string) {
+    e := &data.AuditEvent{
+        Event:  event,
+        Email:  email,
+        IP:     realip.FromRequest(r),
+        Method: r.Method,
+        Path:   r.URL.Path,
+        Detail: detail,
+    }
+
+    if user != nil && !user.IsAnonymous() {
+        e.UserID = user.ID
+        e.Email = user.Email
+    }
+
+    app.logger.Info("audit event", slog.Group("audit",
+        "event", e.Event,
+        "user_id", e.UserID,
+        "email", e.Email,
+        "ip", e.IP,
+        "method", e.Method,
+        "path", e.Path,
+        "detail", e.Detail,
+    ))
+
+    if app.config.auditStore != "db" {
+        return
+    }
+
+    app.tasks.Submit("store audit event", func() error {
+        err := app.models.Audit.Insert(context.Background(), e)
+        if err != nil {
+            return fmt.Errorf("%s event: %w", e.Event, err)
+        }
+
+        return nil
+    })
+}
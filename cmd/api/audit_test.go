@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestAudit(t *testing.T) {
+    var logs bytes.Buffer
+
+    app := newTestApplication(t)
+    app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+    app.config.auditStore = "db"
+    h := app.routes()
+
+    login := func(email, password string) {
+        do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": email, "password": password})
+    }
+
+    login(mock.ActivatedUserEmail, "wrongpassword")
+    login("nobody@example.com", "secretpassword")
+    login(mock.ActivatedUserEmail, mock.FixturePassword)
+
+    invalidToken := strings.Repeat("X", 26)
+    do(t, h, http.MethodGet, "/v1/movies", invalidToken, nil)
+
+    readerToken := authToken(t, app, mock.ReadOnlyUserID)
+    do(t, h, http.MethodPost, "/v1/movies", readerToken, map[string]any{"title": "Up"})
+
+    app.wg.Wait()
+
+    want := []data.AuditEvent{
+        {Event: data.AuditLoginFailed, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail, Detail: "wrong password"},
+        {Event: data.AuditLoginFailed, Email: "nobody@example.com", Detail: "unknown email"},
+        {Event: data.AuditLoginSucceeded, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail},
+        {Event: data.AuditInvalidToken, Detail: "unknown or expired authentication"},
+        {Event: data.AuditPermissionDenied, UserID: mock.ReadOnlyUserID, Email: mock.ReadOnlyUserEmail},
+    }
+
+    got := app.models.Audit.(*mock.AuditModel).Events()
+    if len(got) != len(want) {
+        t.Fatalf("got %d events; want %d: %+v", len(got), len(want), got)
+    }
+
+    // The events are stored in background, so their order isn't known.
+    for _, w := range want {
+        found := slices.ContainsFunc(got, func(g data.AuditEvent) bool {
+            return g.Event == w.Event && g.UserID == w.UserID && g.Email == w.Email && g.Detail == w.Detail && g.IP != "" && g.Path != ""
+        })
+        if !found {
+            t.Errorf("got no event %+v in %+v", w, got)
+        }
+    }
+
+    if n := strings.Count(logs.String(), `"audit":{`); n != len(want) {
+        t.Errorf("got %d audit log entries; want %d", n, len(want))
+    }
+
+    for _, secret := range []string{"wrongpassword", "secretpassword", mock.FixturePassword, invalidToken, readerToken} {
+        if strings.Contains(logs.String(), secret) {
+            t.Errorf("the log contains the secret %q", secret)
+        }
+    }
+}
+
+func TestAuditLogOnly(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.auditStore = "log"
+    h := app.routes()
+
+    do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": mock.ActivatedUserEmail, "password": mock.FixturePassword})
+    app.wg.Wait()
+
+    if got := app.models.Audit.(*mock.AuditModel).Events(); len(got) != 0 {
+        t.Errorf("got %d events stored with -audit-store=log; want 0", len(got))
+    }
+}
+
+func TestAuditScrubbedOnUserDeletion(t *testing.T) {
+    for _, mode := range []string{"delete", "anonymize"} {
+        t.Run(mode, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.auditStore = "db"
+            app.config.userDeletionMode = mode
+            h := app.routes()
+
+            login := func(email, password string) {
+                do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": email, "password": password})
+            }
+
+            login(mock.ActivatedUserEmail, mock.FixturePassword)
+            login(mock.ReadOnlyUserEmail, mock.FixturePassword)
+            app.wg.Wait()
+
+            rr := do(t, h, http.MethodDelete, "/v1/users/1", authToken(t, app, mock.AdminUserID), nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            // The events are kept, without the email and IP address of the deleted user.
+            events := app.models.Audit.(*mock.AuditModel).Events()
+            if len(events) != 2 {
+                t.Fatalf("got %d events; want 2: %+v", len(events), events)
+            }
+
+            for _, e := range events {
+                switch e.UserID {
+                case mock.ActivatedUserID:
+                    if e.Event != data.AuditLoginSucceeded || e.Email != "" || e.IP != "" {
+                        t.Errorf("got event %+v of the deleted user; want it without email and IP", e)
+                    }
+                default:
+                    if e.Email != mock.ReadOnlyUserEmail || e.IP == "" {
+                        t.Errorf("got event %+v of another user; want it unchanged", e)
+                    }
+                }
+            }
+        })
+    }
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// maxLoggedBodyBytes is how much of a request body logRequestBody keeps.
+const maxLoggedBodyBytes = 4096
+
+// redacted replaces the values of sensitive headers and JSON fields in the log.
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are the request headers whose values are never logged.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// sensitiveKeyParts are matched case-insensitively against JSON keys: the value of a key
+// containing any of them, such as "password" or "new_password", is never logged.
+var sensitiveKeyParts = []string{"password", "token", "secret"}
+
+// bodyRecorder is a request body which keeps a copy of the first bytes read from it. The handler
+// may still be reading the body in the timeout middleware's goroutine when the request is
+// logged, hence the mutex.
+type bodyRecorder struct {
+    io.ReadCloser
+    mu        sync.Mutex
+    buf       bytes.Buffer
+    truncated bool
+}
+
+func (b *bodyRecorder) Read(p []byte) (int, error) {
+    n, err := b.ReadCloser.Read(p)
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    keep := min(n, maxLoggedBodyBytes-b.buf.Len())
+    b.buf.Write(p[:keep])
+    if keep < n {
+        b.truncated = true
+    }
+
+    return n, err
+}
+
+// recorded returns a copy of what has been read from the body, and whether more was read. A
+// UTF-8 character cut by the truncation is dropped.
+func (b *bodyRecorder) recorded() ([]byte, bool) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    body := bytes.Clone(b.buf.Bytes())
+
+    if b.truncated {
+        for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+            body = body[:len(body)-1]
+        }
+    }
+
+    return body, b.truncated
+}
+
+// logRequestBody logs the headers and body of the requests which get a 4xx or 5xx response, so
+// that we can see what a client sent when it reports an unexpected error. It's only enabled in
+// development or with -log-error-bodies. Only the part of the body read by the handler is
+// logged, up to maxLoggedBodyBytes, and credentials are redacted by redactHeaders() and
+// redactBody().
+func (app *application) logRequestBody(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if app.config.env != "development" && !app.config.logErrorBodies {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        // The metrics writer records the status code and passes on Flush, Hijack and ReadFrom.
+        mrw := newMetricsResponseWriter(w)
+
+        body := &bodyRecorder{ReadCloser: r.Body}
+        r.Body = body
+
+        next.ServeHTTP(mrw, r)
+
+        if mrw.statusCode < http.StatusBadRequest {
+            return
+        }
+
+        recorded, truncated := body.recorded()
+
+        app.logger.Info("request failed",
+            "method", r.Method,
+            "uri", r.URL.RequestURI(),
+            "status", mrw.statusCode,
+            "headers", redactHeaders(r.Header),
+            "body", redactBody(recorded),
+            "body_truncated", truncated,
+        )
+    })
+}
+
+// redactHeaders returns a copy of h with the values of the sensitive headers replaced.
+func redactHeaders(h http.Header) http.Header {
+    h = h.Clone()
+
+    for _, name := range sensitiveHeaders {
+        if _, ok := h[name]; ok {
+            h.Set(name, redacted)
+        }
+    }
+
+    return h
+}
+
+// isSensitiveKey reports whether the value of the JSON key mustn't be logged.
+func isSensitiveKey(key string) bool {
+    key = strings.ToLower(key)
+
+    for _, part := range sensitiveKeyParts {
+        if strings.Contains(key, part) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// redactBody returns body with the values of the sensitive JSON keys replaced, at any depth. A
+// binary body isn't logged, and a body which isn't valid JSON, often because it's been truncated
+// or because the client sent invalid JSON, is redacted with redactInvalidJSON().
+func redactBody(body []byte) string {
+    if !utf8.Valid(body) {
+        return fmt.Sprintf("[%d bytes of binary data]", len(body))
+    }
+
+    var v any
+
+    if json.Unmarshal(body, &v) != nil {
+        return redactInvalidJSON(string(body))
+    }
+
+    js, err := json.Marshal(redactValue(v))
+    if err != nil {
+        return redacted
+    }
+
+    return string(js)
+}
+
+func redactValue(v any) any {
+    switch v := v.(type) {
+    case map[string]any:
+        for key, value := range v {
+            if isSensitiveKey(key) {
+                v[key] = redacted
+            } else {
+                v[key] = redactValue(value)
+            }
+        }
+    case []any:
+        for i := range v {
+            v[i] = redactValue(v[i])
+        }
+    }
+
+    return v
+}
+
+// jsonMember matches a JSON key and the start of its value: a whole string, possibly unterminated,
+// or anything up to the next delimiter.
+var jsonMember = regexp.MustCompile(`"((?:[^"\\]|\\.)*)"(\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`)
+
+// redactInvalidJSON replaces the values of the sensitive keys in text which looks like JSON but
+// can't be parsed. Keys with escapes are unquoted before they are checked, and a key which can't
+// be unquoted is treated as sensitive. The end of an object or array value can't be found
+// reliably, so the rest of the body is dropped after a sensitive one.
+func redactInvalidJSON(body string) string {
+    var sb strings.Builder
+
+    last := 0
+
+    for _, m := range jsonMember.FindAllStringSubmatchIndex(body, -1) {
+        rawKey, value := body[m[2]:m[3]], body[m[6]:m[7]]
+
+        var key string
+        if json.Unmarshal([]byte(`"`+rawKey+`"`), &key) == nil && !isSensitiveKey(key) {
+            continue
+        }
+
+        sb.WriteString(body[last:m[6]])
+        sb.WriteString(`"` + redacted + `"`)
+        last = m[7]
+
+        if strings.HasPrefix(value, "{") || strings.HasPrefix(value, "[") {
+            return sb.String()
+        }
+    }
+
+    sb.WriteString(body[last:])
+
+    return sb.String()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestRedactBody(t *testing.T) {
+    tests := []struct {
+        name string
+        body string
+        want string
+    }{
+        {"empty", ``, ``},
+        {"no secrets", `{"title": "Moana", "year": 2016}`, `{"title":"Moana","year":2016}`},
+        {
+            "nested",
+            `{"email": "a@example.com", "Password": "s3cret", "user": {"new_password": 12345}, "items": [{"api_token": ["t1"]}]}`,
+            `{"Password":"[REDACTED]","email":"a@example.com","items":[{"api_token":"[REDACTED]"}],"user":{"new_password":"[REDACTED]"}}`,
+        },
+        {"invalid", `{"email": "a@example.com",, "password": "s3cret"}`, `{"email": "a@example.com",, "password": "[REDACTED]"}`},
+        {"truncated", `{"email": "a@example.com", "password": "s3c`, `{"email": "a@example.com", "password": "[REDACTED]"`},
+        {"escaped key", `{"pass\u0077ord": "s3cret",}`, `{"pass\u0077ord": "[REDACTED]",}`},
+        {"invalid key", `{"bad\x": "s3cret",}`, `{"bad\x": "[REDACTED]",}`},
+        {"composite value", `{"tokens": ["s3cret", "t0p"],}`, `{"tokens": "[REDACTED]"`},
+        {"binary", "\xff\xd8\xff\xe0", "[4 bytes of binary data]"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := redactBody([]byte(tt.body)); got != tt.want {
+                t.Errorf("got %s\nwant %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestLogRequestBody(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    var logs bytes.Buffer
+    app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+    token := authToken(t, app, mock.ActivatedUserID)
+    login := `{"email": "alice@example.com", "password": "wrong-pa55word"}`
+
+    // Disabled outside development without -log-error-bodies.
+    do(t, h, http.MethodPost, "/v1/tokens/authentication", "", login)
+    if strings.Contains(logs.String(), "request failed") {
+        t.Fatalf("got request logged while disabled: %s", logs.String())
+    }
+
+    app.config.logErrorBodies = true
+
+    rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", login)
+    if rr.Code != http.StatusUnauthorized {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, `{"title": "Up", "year": 2009}`)
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    // readJSON still sees the whole body, and successful requests aren't logged.
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, `{"title": "Coco", "year": 2017, "runtime": "105 mins", "genres": ["animation"]}`)
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    out := logs.String()
+
+    for _, want := range []string{`"status":401`, `alice@example.com`, `"status":422`, `\"title\":\"Up\"`, `"Authorization":["[REDACTED]"]`} {
+        if !strings.Contains(out, want) {
+            t.Errorf("log doesn't contain %s: %s", want, out)
+        }
+    }
+    for _, secret := range []string{"wrong-pa55word", token, "Coco"} {
+        if strings.Contains(out, secret) {
+            t.Errorf("log contains %s: %s", secret, out)
+        }
+    }
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+	"greenlight.zzh.net/internal/data"
+)
+
+var totalCoalescedMovieReads = expvar.NewInt("total_coalesced_movie_reads")
+
+// movieReads coalesces the concurrent reads of a movie by showMovieHandler, so that the
+// requests for a movie arriving while it's being read share the result of that query instead of
+// running their own. Unlike movieCache, nothing is kept once the query returns. A nil
+// *movieReads reads the movie for every request.
+type movieReads struct {
+    mu    sync.Mutex
+    group *singleflight.Group // replaced by forgetAll
+}
+
+// newMovieReads returns an empty movieReads.
+func newMovieReads() *movieReads {
+    return &movieReads{group: new(singleflight.Group)}
+}
+
+// get returns the movie with the given id as read by fn, or by the call of fn of a concurrent
+// request for the same movie. The query runs without the cancellation of ctx, so that a client
+// going away doesn't fail the requests sharing its query; it still has the query timeout of the
+// model. Each caller gets its own copy of the movie.
+func (g *movieReads) get(ctx context.Context, id int64, fn func(ctx context.Context, id int64) (*data.Movie, error)) (*data.Movie, error) {
+    if g == nil {
+        return fn(ctx, id)
+    }
+
+    g.mu.Lock()
+    group := g.group
+    g.mu.Unlock()
+
+    v, err, shared := group.Do(strconv.FormatInt(id, 10), func() (any, error) {
+        return fn(context.WithoutCancel(ctx), id)
+    })
+    if shared {
+        totalCoalescedMovieReads.Add(1)
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    movie := *v.(*data.Movie)
+    return &movie, nil
+}
+
+// forget makes the next read of the movie with the given id run a new query rather than share
+// one started before the movie was changed.
+func (g *movieReads) forget(id int64) {
+    if g == nil {
+        return
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.group.Forget(strconv.FormatInt(id, 10))
+}
+
+// forgetAll is forget for every movie. The queries in flight finish for the requests already
+// waiting on them.
+func (g *movieReads) forgetAll() {
+    if g == nil {
+        return
+    }
+
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    g.group = new(singleflight.Group)
+}
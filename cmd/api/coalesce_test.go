@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// countingMovieStore counts the calls of Get, which take delay, standing in for a database
+// query.
+type countingMovieStore struct {
+    data.MovieStore
+    delay   time.Duration
+    queries atomic.Int64
+}
+
+func (s *countingMovieStore) Get(ctx context.Context, id int64) (*data.Movie, error) {
+    s.queries.Add(1)
+    time.Sleep(s.delay)
+    return s.MovieStore.Get(ctx, id)
+}
+
+// showMovieConcurrently sends n concurrent requests for movie 1 with the given headers and
+// returns the number of queries made.
+func showMovieConcurrently(t testing.TB, app *application, n int, header http.Header) int64 {
+    store := &countingMovieStore{MovieStore: app.models.Movie, delay: 50 * time.Millisecond}
+    app.models.Movie = store
+    defer func() { app.models.Movie = store.MovieStore }()
+
+    h := app.routes()
+    token := authToken(t, app, mock.ReadOnlyUserID)
+
+    var wg sync.WaitGroup
+    for range n {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+            r.Header = header.Clone()
+            r.Header.Set("Authorization", "Bearer "+token)
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, r)
+
+            if rr.Code != http.StatusOK && rr.Code != http.StatusNotModified {
+                t.Errorf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+        }()
+    }
+    wg.Wait()
+
+    return store.queries.Load()
+}
+
+func TestShowMovieCoalescing(t *testing.T) {
+    tests := []struct {
+        name        string
+        coalesce    bool
+        header      http.Header
+        wantQueries int64
+    }{
+        {"coalesced", true, http.Header{}, 1},
+        {"disabled", false, http.Header{}, 10},
+        {"If-None-Match", true, http.Header{"If-None-Match": {`W/"1"`}}, 10},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            if !tt.coalesce {
+                app.movieReads = nil
+            }
+
+            if got := showMovieConcurrently(t, app, 10, tt.header); got != tt.wantQueries {
+                t.Errorf("got %d queries; want %d", got, tt.wantQueries)
+            }
+        })
+    }
+}
+
+func TestMovieReadsForget(t *testing.T) {
+    app := newTestApplication(t)
+    reads := app.movieReads
+
+    started := make(chan struct{})
+    release := make(chan struct{})
+
+    // A read which started before the movie changed...
+    go reads.get(context.Background(), 1, func(ctx context.Context, id int64) (*data.Movie, error) {
+        close(started)
+        <-release
+        return &data.Movie{ID: id, Version: 1}, nil
+    })
+    <-started
+
+    reads.forget(1)
+
+    // ...isn't shared with a read after the change.
+    movie, err := reads.get(context.Background(), 1, func(ctx context.Context, id int64) (*data.Movie, error) {
+        return &data.Movie{ID: id, Version: 2}, nil
+    })
+    close(release)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+    if movie.Version != 2 {
+        t.Errorf("got version %d; want 2", movie.Version)
+    }
+}
+
+// BenchmarkShowMovieConcurrent compares the queries made for bursts of 50 concurrent requests
+// for the same movie with and without coalescing, reported as queries/burst.
+func BenchmarkShowMovieConcurrent(b *testing.B) {
+    for _, coalesce := range []bool{true, false} {
+        name := "coalesced"
+        if !coalesce {
+            name = "uncoalesced"
+        }
+
+        b.Run(name, func(b *testing.B) {
+            app := newTestApplication(b)
+            if !coalesce {
+                app.movieReads = nil
+            }
+
+            var queries int64
+            for range b.N {
+                queries += showMovieConcurrently(b, app, 50, http.Header{})
+            }
+
+            b.ReportMetric(float64(queries)/float64(b.N), "queries/burst")
+        })
+    }
+}
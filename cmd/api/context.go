@@ -5,6 +5,7 @@ import (
 	"net/http"
 
 	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/i18n"
 )
 
 type glContextKey string
@@ -14,6 +15,18 @@ type glContextKey string
 // context.
 const userContextKey = glContextKey("user")
 
+// tokenHashContextKey is the key for the hash of the token the request was authenticated with.
+const tokenHashContextKey = glContextKey("tokenHash")
+
+// maxBodyBytesContextKey is the key for a per-route request body size limit.
+const maxBodyBytesContextKey = glContextKey("maxBodyBytes")
+
+// apiVersionContextKey is the key for the API version of the request path.
+const apiVersionContextKey = glContextKey("apiVersion")
+
+// localeContextKey is the key for the locale negotiated from Accept-Language.
+const localeContextKey = glContextKey("locale")
+
 // contextSetUser returns a new copy of the request with the provided User struct added to its 
 // embedded context. 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
@@ -31,4 +44,71 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
     }
 
     return user
-}
\ No newline at end of file
+}
+
+// contextSetTokenHash returns a new copy of the request with the hash of the token the request
+// was authenticated with added to its context.
+func (app *application) contextSetTokenHash(r *http.Request, hash []byte) *http.Request {
+    ctx := context.WithValue(r.Context(), tokenHashContextKey, hash)
+    return r.WithContext(ctx)
+}
+
+// contextGetTokenHash returns the hash of the token the request was authenticated with, or nil
+// for anonymous requests.
+func (app *application) contextGetTokenHash(r *http.Request) []byte {
+    hash, _ := r.Context().Value(tokenHashContextKey).([]byte)
+    return hash
+}
+
+// contextSetMaxBodyBytes returns a new copy of the request with a request body size limit added to
+// its context, overriding the application default for readJSON.
+func (app *application) contextSetMaxBodyBytes(r *http.Request, n int64) *http.Request {
+    ctx := context.WithValue(r.Context(), maxBodyBytesContextKey, n)
+    return r.WithContext(ctx)
+}
+
+// contextGetMaxBodyBytes returns the request body size limit for the request, falling back to the
+// application default if no per-route limit has been set.
+func (app *application) contextGetMaxBodyBytes(r *http.Request) int64 {
+    n, ok := r.Context().Value(maxBodyBytesContextKey).(int64)
+    if !ok {
+        return app.config.maxBodyBytes
+    }
+
+    return n
+}
+// contextSetAPIVersion returns a new copy of the request with its API version added to its
+// context.
+func (app *application) contextSetAPIVersion(r *http.Request, v *apiVersion) *http.Request {
+    ctx := context.WithValue(r.Context(), apiVersionContextKey, v)
+    return r.WithContext(ctx)
+}
+
+// contextGetAPIVersion returns the API version of the request, falling back to the latest version
+// for paths without a version.
+func (app *application) contextGetAPIVersion(r *http.Request) *apiVersion {
+    v, ok := r.Context().Value(apiVersionContextKey).(*apiVersion)
+    if !ok {
+        return latestAPIVersion
+    }
+
+    return v
+}
+
+// contextSetLocale returns a new copy of the request with the locale of its messages added to its
+// context.
+func (app *application) contextSetLocale(r *http.Request, locale string) *http.Request {
+    ctx := context.WithValue(r.Context(), localeContextKey, locale)
+    return r.WithContext(ctx)
+}
+
+// contextGetLocale returns the locale of the messages of the request, falling back to
+// i18n.DefaultLocale.
+func (app *application) contextGetLocale(r *http.Request) string {
+    locale, ok := r.Context().Value(localeContextKey).(string)
+    if !ok {
+        return i18n.DefaultLocale
+    }
+
+    return locale
+}
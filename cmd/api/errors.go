@@ -1,8 +1,19 @@
 package main
 
 import (
-	"fmt"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"maps"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
 )
 
 // logError() is a generic helper for logging an error message along with
@@ -13,17 +24,146 @@ func (app *application) logError(r *http.Request, err error) {
         uri    = r.URL.RequestURI()
     )
 
+    // Within a trace, the trace ID identifies the request, so that its spans can be found from
+    // the log.
+    if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+        app.logger.Error(err.Error(), "method", method, "uri", uri, "trace_id", sc.TraceID().String())
+        return
+    }
+
     app.logger.Error(err.Error(), "method", method, "uri", uri)
 }
 
-// errorResponse() is a generic helper for sending JSON-formatted error messages to the client 
-// with a given status code. Note that we're using the any type for the message parameter, rather 
-// than just a string type, as this gives us more flexibility over the values that we can include 
-// in the response.
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-    data := envelope{"error": message}
+// errorCode identifies the kind of an error response, so that clients can branch on it rather
+// than on the message, which may change. The codes are part of the API: a code is never renamed
+// or reused for a different error.
+type errorCode string
+
+const (
+    codeInternalError          errorCode = "internal_error"               // 500, unexpected server error
+    codeDatabaseTimeout        errorCode = "database_timeout"             // 504, a database query timed out
+    codeRequestTimeout         errorCode = "request_timeout"              // 503, the request took longer than the request timeout
+    codeDatabaseUnavailable    errorCode = "database_unavailable"         // 503, the server hasn't connected to the database yet
+    codeNotFound               errorCode = "not_found"                    // 404
+    codeMethodNotAllowed       errorCode = "method_not_allowed"           // 405
+    codeNotAcceptable          errorCode = "not_acceptable"               // 406, see the supported key of the response
+    codeBadRequest             errorCode = "bad_request"                  // 400, e.g. malformed JSON
+    codeValidationFailed       errorCode = "validation_failed"            // 422, see the fields of the error
+    codeContentTooLarge        errorCode = "content_too_large"            // 413
+    codeUnsupportedMediaType   errorCode = "unsupported_media_type"       // 415
+    codeEditConflict           errorCode = "edit_conflict"                // 409, the record was changed by another request
+    codeMovieReferenced        errorCode = "movie_referenced"             // 409, see the dependents of the error
+    codeDuplicateMovie         errorCode = "duplicate_movie"              // 409, see the duplicates of the error
+    codePreconditionFailed     errorCode = "precondition_failed"          // 412, If-Match or X-Expected-Version doesn't match
+    codeIdempotencyKeyInUse    errorCode = "idempotency_key_in_use"       // 409
+    codeIdempotencyKeyMismatch errorCode = "idempotency_key_mismatch"     // 422
+    codeRateLimited            errorCode = "rate_limited"                 // 429, see the limit, window and retry_after of the error
+    codeAPIKeyLimitExceeded    errorCode = "api_key_limit_exceeded"       // 409
+    codeInvalidCredentials     errorCode = "invalid_credentials"          // 401
+    codeInvalidToken           errorCode = "invalid_authentication_token" // 401
+    codeAuthenticationRequired errorCode = "authentication_required"      // 401
+    codeInactiveAccount        errorCode = "inactive_account"             // 403
+    codePasswordResetRequired  errorCode = "password_reset_required"      // 403, the password must be reset with the emailed token
+    codeNotPermitted           errorCode = "not_permitted"                // 403
+    codeUnsupportedAPIVersion  errorCode = "unsupported_api_version"      // 404, e.g. /v3/movies
+)
+
+// errorCodes lists every error code, in the order above.
+var errorCodes = []errorCode{
+    codeInternalError, codeDatabaseTimeout, codeRequestTimeout, codeDatabaseUnavailable, codeNotFound,
+    codeMethodNotAllowed, codeNotAcceptable, codeBadRequest, codeValidationFailed, codeContentTooLarge,
+    codeUnsupportedMediaType, codeEditConflict, codeMovieReferenced, codeDuplicateMovie, codePreconditionFailed,
+    codeIdempotencyKeyInUse, codeIdempotencyKeyMismatch, codeRateLimited, codeAPIKeyLimitExceeded,
+    codeInvalidCredentials, codeInvalidToken, codeAuthenticationRequired, codeInactiveAccount,
+    codePasswordResetRequired, codeNotPermitted, codeUnsupportedAPIVersion,
+}
 
-    err := app.writeJSON(w, status, data, nil)
+// apiError is the error of every error response since version 2 of the API:
+//
+//     {"error": {"code": "validation_failed", "message": "...", "fields": {"title": ["must be provided"]}}}
+//
+// Fields is only set for validation errors.
+type apiError struct {
+    Code    errorCode   `json:"code" xml:"code"`
+    Message string      `json:"message" xml:"message"`
+    Fields  fieldErrors `json:"fields,omitempty" xml:"fields,omitempty"`
+}
+
+// legacy returns the error as it was sent before error codes: the messages of the fields for a
+// validation error, and the message otherwise.
+func (e apiError) legacy() any {
+    if e.Fields != nil {
+        return e.Fields
+    }
+
+    return e.Message
+}
+
+// fieldErrors are the validation error messages by field name.
+type fieldErrors map[string][]string
+
+// MarshalXML implements xml.Marshaler for fieldErrors, which encoding/xml can't handle on its own
+// because it's a map. Each message becomes an <entry key="..."> element, as in envelope.
+func (f fieldErrors) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+    err := enc.EncodeToken(start)
+    if err != nil {
+        return err
+    }
+
+    for _, key := range slices.Sorted(maps.Keys(f)) {
+        entry := xml.StartElement{
+            Name: xml.Name{Local: "entry"},
+            Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+        }
+
+        err = enc.EncodeElement(f[key], entry)
+        if err != nil {
+            return err
+        }
+    }
+
+    return enc.EncodeToken(start.End())
+}
+
+// shapeError returns e as it's sent in the API version of the request.
+func (app *application) shapeError(r *http.Request, e responseError) any {
+    if shape := app.contextGetAPIVersion(r).shapeError; shape != nil {
+        return shape(e)
+    }
+
+    return e
+}
+
+// errorResponse() is a generic helper for sending error responses to the client with a given
+// status code, error code and message, formatted from format and args in the locale of the
+// request.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code errorCode, format string, args ...any) {
+    app.writeError(w, r, status, apiError{Code: code, Message: app.translate(r, format, args...)})
+}
+
+// translate formats a message in the locale of the request, see i18n.Catalog.Sprintf.
+func (app *application) translate(r *http.Request, format string, args ...any) string {
+    return app.catalog.Sprintf(app.contextGetLocale(r), format, args...)
+}
+
+// writeError() sends the error in the negotiated format, shaped for the API version of the
+// request.
+func (app *application) writeError(w http.ResponseWriter, r *http.Request, status int, e responseError) {
+    data := envelope{"error": app.shapeError(r, e)}
+
+    // Errors are sent in the negotiated format, falling back to JSON if the client doesn't accept
+    // any supported format, so that the original status code is preserved. Their messages are in
+    // the negotiated language.
+    w.Header().Add("Vary", "Accept")
+    w.Header().Add("Vary", "Accept-Language")
+    w.Header().Set("Content-Language", app.contextGetLocale(r))
+
+    contentType, ok := negotiateContentType(r.Header.Get("Accept"))
+    if !ok {
+        contentType = contentTypeJSON
+    }
+
+    err := app.writeAs(w, r, contentType, status, data, nil)
     if err != nil {
         app.logError(r, err)
         w.WriteHeader(http.StatusInternalServerError)
@@ -34,64 +174,333 @@ func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, st
 // runtime. It logs the detailed error messages, then uses the errorResponse() helper to send a 
 // 500 Internal Server Error status code and JSON response (containing a generic error message) 
 // to the client.
+// A database query which exceeded its timeout is reported with gatewayTimeoutResponse() instead,
+// and a sort value a handler didn't validate with invalidSortResponse().
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+    if data.IsQueryTimeout(err) {
+        app.gatewayTimeoutResponse(w, r, err)
+        return
+    }
+
+    if errors.Is(err, data.ErrInvalidSort) {
+        app.invalidSortResponse(w, r, err)
+        return
+    }
+
+    var breakerErr *data.BreakerOpenError
+    if errors.As(err, &breakerErr) {
+        app.databaseDownResponse(w, r, breakerErr.RetryAfter)
+        return
+    }
+
     app.logError(r, err)
+    app.internalErrorResponse(w, r, err, nil)
+}
+
+// panicResponse() logs an error recovered from a panic with the stack trace of the goroutine which
+// panicked, counts it in the total_panics expvar and sends a 500 Internal Server Error like
+// serverErrorResponse().
+func (app *application) panicResponse(w http.ResponseWriter, r *http.Request, err error, stack []byte) {
+    totalPanics.Add(1)
+
+    app.logger.Error("panic: "+err.Error(), "method", r.Method, "uri", r.URL.RequestURI(), "stack", string(stack))
+    app.internalErrorResponse(w, r, err, stack)
+}
+
+// maxErrorStack is the number of bytes of the stack of a panic sent in development.
+const maxErrorStack = 4096
 
+// internalError is the error of a 500 response in development, with the error which caused it
+// and the stack of the goroutine if it panicked.
+type internalError struct {
+    apiError
+    Detail string `json:"detail" xml:"detail"`
+    Stack  string `json:"stack,omitempty" xml:"stack,omitempty"`
+}
+
+// legacy returns the error without its code, with the detail, since a message alone wouldn't
+// help.
+func (e internalError) legacy() any {
+    return struct {
+        Message string `json:"message" xml:"message"`
+        Detail  string `json:"detail" xml:"detail"`
+        Stack   string `json:"stack,omitempty" xml:"stack,omitempty"`
+    }{e.Message, e.Detail, e.Stack}
+}
+
+// internalErrorResponse() sends the 500 Internal Server Error of serverErrorResponse() and
+// panicResponse(), which have logged err. The response only has a generic message, except with
+// -env=development, where it has err and the first maxErrorStack bytes of the stack too. The
+// environment is a flag rather than in dynamic.env, so that a running server can't be switched
+// to sending the errors.
+func (app *application) internalErrorResponse(w http.ResponseWriter, r *http.Request, err error, stack []byte) {
     message := "the server encountered a problem and could not process your request"
-    app.errorResponse(w, r, http.StatusInternalServerError, message)
+
+    if app.config.env != "development" {
+        app.errorResponse(w, r, http.StatusInternalServerError, codeInternalError, message)
+        return
+    }
+
+    if len(stack) > maxErrorStack {
+        stack = stack[:maxErrorStack]
+        if i := bytes.LastIndexByte(stack, '\n'); i > 0 {
+            stack = stack[:i]
+        }
+        stack = append(stack[:len(stack):len(stack)], "\n..."...)
+    }
+
+    app.writeError(w, r, http.StatusInternalServerError, internalError{
+        apiError: apiError{Code: codeInternalError, Message: app.translate(r, message)},
+        Detail:   err.Error(),
+        Stack:    string(stack),
+    })
+}
+
+// gatewayTimeoutResponse() logs the error and sends a 504 Gateway Timeout, which tells the client
+// that an upstream dependency (the database) didn't respond in time.
+func (app *application) gatewayTimeoutResponse(w http.ResponseWriter, r *http.Request, err error) {
+    app.logError(r, err)
+
+    message := "the server timed out waiting for the database, please try again later"
+    app.errorResponse(w, r, http.StatusGatewayTimeout, codeDatabaseTimeout, message)
+}
+
+// timeoutResponse() sends a 503 Service Unavailable when a request took longer than the request
+// timeout to process.
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+    app.logError(r, http.ErrHandlerTimeout)
+
+    message := "the server took too long to process your request, please try again later"
+    app.errorResponse(w, r, http.StatusServiceUnavailable, codeRequestTimeout, message)
+}
+
+// databaseUnavailableResponse() sends a 503 Service Unavailable with Retry-After when the request
+// needs the database and the application hasn't connected to it yet.
+func (app *application) databaseUnavailableResponse(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Retry-After", "5")
+
+    message := "the server is starting up and can't reach the database yet, please try again later"
+    app.errorResponse(w, r, http.StatusServiceUnavailable, codeDatabaseUnavailable, message)
+}
+
+// databaseDownResponse() sends a 503 Service Unavailable with Retry-After when the request failed
+// fast because the circuit breaker of the database pool is open, see data.Breaker. retryAfter is
+// rounded up to whole seconds.
+func (app *application) databaseDownResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+    w.Header().Set("Retry-After", strconv.Itoa(max(1, int((retryAfter+time.Second-1)/time.Second))))
+
+    message := "the server can't reach the database, please try again later"
+    app.errorResponse(w, r, http.StatusServiceUnavailable, codeDatabaseUnavailable, message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
     message := "the requested resource could not be found"
-    app.errorResponse(w, r, http.StatusNotFound, message)
+    app.errorResponse(w, r, http.StatusNotFound, codeNotFound, message)
+}
+
+// unsupportedAPIVersionResponse() sends a 404 Not Found listing the supported API versions.
+func (app *application) unsupportedAPIVersionResponse(w http.ResponseWriter, r *http.Request, number int) {
+    app.errorResponse(w, r, http.StatusNotFound, codeUnsupportedAPIVersion, unsupportedAPIVersionMessage(number))
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-    message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-    app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+    app.errorResponse(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "the %s method is not supported for this resource", r.Method)
+}
+
+// notAcceptableResponse() is used when the Accept header doesn't allow any supported format.
+// The response is sent as JSON and lists the supported content types.
+func (app *application) notAcceptableResponse(w http.ResponseWriter, r *http.Request) {
+    e := apiError{
+        Code:    codeNotAcceptable,
+        Message: app.translate(r, "the requested resource is not available in an acceptable format"),
+    }
+
+    data := envelope{"error": app.shapeError(r, e), "supported": supportedContentTypes}
+
+    err := app.writeJSON(w, r, http.StatusNotAcceptable, data, nil)
+    if err != nil {
+        app.logError(r, err)
+        w.WriteHeader(http.StatusInternalServerError)
+    }
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-    app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+    app.errorResponse(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+}
+
+// failedValidationResponse() sends the errors of v, translated into the locale of the request.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, v *validator.Validator) {
+    translate := func(format string, args ...any) string {
+        return app.translate(r, format, args...)
+    }
+
+    app.writeError(w, r, http.StatusUnprocessableEntity, apiError{
+        Code:    codeValidationFailed,
+        Message: translate("the request contains invalid values, see fields"),
+        Fields:  v.Translate(translate),
+    })
+}
+
+// invalidSortResponse() sends the validation error of data.ValidateFilter for a sort value which
+// reached a model without being validated. The error is logged, as it means that a handler
+// skipped the validation.
+func (app *application) invalidSortResponse(w http.ResponseWriter, r *http.Request, err error) {
+    app.logError(r, err)
+
+    v := validator.New()
+    v.AddError("sort", "invalid sort value")
+    app.failedValidationResponse(w, r, v)
+}
+
+func (app *application) contentTooLargeResponse(w http.ResponseWriter, r *http.Request, limit int64) {
+    app.errorResponse(w, r, http.StatusRequestEntityTooLarge, codeContentTooLarge, "the request body must not be larger than %d bytes", limit)
 }
 
-func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-    app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, supported []string) {
+    app.errorResponse(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "the content type is not supported, it must be one of: %s", strings.Join(supported, ", "))
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
     message := "unable to update the record due to an edit conflict, please try again"
-    app.errorResponse(w, r, http.StatusConflict, message)
+    app.errorResponse(w, r, http.StatusConflict, codeEditConflict, message)
 }
 
-func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request) {
-    message := "rate limit excceded"
-    app.errorResponse(w, r, http.StatusTooManyRequests, message)
+// movieReferencedError is the error of a 409 Conflict response to deleting a movie which other
+// records refer to, with the counts of the records.
+type movieReferencedError struct {
+    apiError
+    Dependents data.MovieDependents `json:"dependents" xml:"dependents"`
+}
+
+// legacy returns the error without its code, which is how it was sent before error codes.
+func (e movieReferencedError) legacy() any {
+    return struct {
+        Message    string               `json:"message" xml:"message"`
+        Dependents data.MovieDependents `json:"dependents" xml:"dependents"`
+    }{e.Message, e.Dependents}
+}
+
+// movieReferencedResponse() sends a 409 Conflict for a movie which wasn't deleted because of the
+// records referring to it, see data.MovieReferencedError.
+func (app *application) movieReferencedResponse(w http.ResponseWriter, r *http.Request, dependents data.MovieDependents) {
+    app.writeError(w, r, http.StatusConflict, movieReferencedError{
+        apiError:   apiError{Code: codeMovieReferenced, Message: app.translate(r, "the movie can't be deleted because other records refer to it, delete them first or retry with force=true")},
+        Dependents: dependents,
+    })
+}
+
+// duplicateMovieError is the error of a 409 Conflict response to creating a movie which may
+// already exist, with the movies it may be.
+type duplicateMovieError struct {
+    apiError
+    Duplicates []data.MovieDuplicate `json:"duplicates" xml:"duplicates>movie"`
+}
+
+// legacy returns the error without its code, which is how it was sent before error codes.
+func (e duplicateMovieError) legacy() any {
+    return struct {
+        Message    string                `json:"message" xml:"message"`
+        Duplicates []data.MovieDuplicate `json:"duplicates" xml:"duplicates>movie"`
+    }{e.Message, e.Duplicates}
+}
+
+// duplicateMovieResponse() sends a 409 Conflict for a movie which wasn't created because of the
+// existing movies it may be, see data.MovieModel.FindPotentialDuplicates.
+func (app *application) duplicateMovieResponse(w http.ResponseWriter, r *http.Request, duplicates []data.MovieDuplicate) {
+    app.writeError(w, r, http.StatusConflict, duplicateMovieError{
+        apiError:   apiError{Code: codeDuplicateMovie, Message: app.translate(r, "a movie of the same year with a similar title already exists, retry with allow_duplicate=true to create it anyway")},
+        Duplicates: duplicates,
+    })
+}
+
+// movieExistsResponse() sends the validation errors of a movie which has the title and year of
+// the movie with the given id, so that the client can link to it, see data.DuplicateMovieError.
+func (app *application) movieExistsResponse(w http.ResponseWriter, r *http.Request, id int64) {
+    v := validator.New()
+    v.AddErrorf("title", "a movie with this title and year already exists, see movie %d", id)
+    v.AddErrorf("year", "a movie with this title and year already exists, see movie %d", id)
+    app.failedValidationResponse(w, r, v)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+    message := "the record has changed since you fetched it, please fetch it again and retry"
+    app.errorResponse(w, r, http.StatusPreconditionFailed, codePreconditionFailed, message)
+}
+
+func (app *application) idempotencyKeyInUseResponse(w http.ResponseWriter, r *http.Request) {
+    message := "a request with this Idempotency-Key is still being processed, please try again"
+    app.errorResponse(w, r, http.StatusConflict, codeIdempotencyKeyInUse, message)
+}
+
+func (app *application) idempotencyKeyMismatchResponse(w http.ResponseWriter, r *http.Request) {
+    message := "this Idempotency-Key has already been used for a different request"
+    app.errorResponse(w, r, http.StatusUnprocessableEntity, codeIdempotencyKeyMismatch, message)
+}
+
+// rateLimitError is the error of a 429 Too Many Requests response, which tells the client how
+// its requests are limited as well as when to try again.
+type rateLimitError struct {
+    apiError
+    Limit      int `json:"limit" xml:"limit"`             // requests which can be made in a burst
+    Window     int `json:"window" xml:"window"`           // seconds it takes to be allowed a full burst again
+    RetryAfter int `json:"retry_after" xml:"retry_after"` // seconds until the next request will be allowed
+}
+
+// legacy returns the error without its code, which is how it was sent before error codes.
+func (e rateLimitError) legacy() any {
+    return struct {
+        Message    string `json:"message" xml:"message"`
+        Limit      int    `json:"limit" xml:"limit"`
+        Window     int    `json:"window" xml:"window"`
+        RetryAfter int    `json:"retry_after" xml:"retry_after"`
+    }{e.Message, e.Limit, e.Window, e.RetryAfter}
+}
+
+// rateLimitExceededResponse() sends a 429 Too Many Requests with the status of the client's
+// limiter. The Retry-After header has been set with the other rate limit headers.
+func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http.Request, status rateLimitStatus) {
+    app.writeError(w, r, http.StatusTooManyRequests, rateLimitError{
+        apiError:   apiError{Code: codeRateLimited, Message: app.translate(r, "rate limit exceeded")},
+        Limit:      status.limit,
+        Window:     status.window,
+        RetryAfter: status.retryAfter,
+    })
+}
+
+func (app *application) apiKeyLimitExceededResponse(w http.ResponseWriter, r *http.Request, limit int) {
+    app.errorResponse(w, r, http.StatusConflict, codeAPIKeyLimitExceeded, "you can't have more than %d API keys, delete an existing key first", limit)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
     message := "invalid authentication credentials"
-    app.errorResponse(w, r, http.StatusUnauthorized, message)
+    app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidCredentials, message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("WWW-Authenticate", "Bearer")
 
     message := "invalid or missing authentication token"
-    app.errorResponse(w, r, http.StatusUnauthorized, message)
+    app.errorResponse(w, r, http.StatusUnauthorized, codeInvalidToken, message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
     message := "you must be authenticated to access this resource"
-    app.errorResponse(w, r, http.StatusUnauthorized, message)
+    app.errorResponse(w, r, http.StatusUnauthorized, codeAuthenticationRequired, message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
     message := "your user account must be activated to access this resource"
-    app.errorResponse(w, r, http.StatusForbidden, message)
+    app.errorResponse(w, r, http.StatusForbidden, codeInactiveAccount, message)
+}
+
+func (app *application) passwordResetRequiredResponse(w http.ResponseWriter, r *http.Request) {
+    message := "your password must be reset before you can log in, please follow the instructions sent to your email address"
+    app.errorResponse(w, r, http.StatusForbidden, codePasswordResetRequired, message)
 }
 
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+    app.audit(r, data.AuditPermissionDenied, app.contextGetUser(r), "", "")
+
     message := "your user account doesn't have the necessary permissions to access this resource"
-    app.errorResponse(w, r, http.StatusForbidden, message)
+    app.errorResponse(w, r, http.StatusForbidden, codeNotPermitted, message)
 }
\ No newline at end of file
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/validator"
+)
+
+func TestServerErrorResponse(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        name           string
+        err            error
+        wantStatus     int
+        wantRetryAfter string
+    }{
+        {"generic error", errors.New("boom"), http.StatusInternalServerError, ""},
+        {"query timeout", fmt.Errorf("select: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, ""},
+        {"unvalidated sort", fmt.Errorf("%w: %q", data.ErrInvalidSort, "foo"), http.StatusUnprocessableEntity, ""},
+        {"circuit breaker open", fmt.Errorf("select: %w", &data.BreakerOpenError{RetryAfter: 1500 * time.Millisecond}), http.StatusServiceUnavailable, "2"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := httptest.NewRecorder()
+            app.serverErrorResponse(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil), tt.err)
+
+            if rr.Code != tt.wantStatus {
+                t.Errorf("got status %d; want %d", rr.Code, tt.wantStatus)
+            }
+            if got := rr.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+                t.Errorf("got Retry-After %q; want %q", got, tt.wantRetryAfter)
+            }
+        })
+    }
+}
+
+func TestInternalErrorDetail(t *testing.T) {
+    const detail = "select password_hash from users: connection refused"
+
+    helpers := []struct {
+        name    string
+        handler func(app *application) http.Handler
+    }{
+        {"server error", func(app *application) http.Handler {
+            return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                app.serverErrorResponse(w, r, errors.New(detail))
+            })
+        }},
+        {"panic", func(app *application) http.Handler {
+            return app.recoverPanic(panickingHandler(errors.New(detail)))
+        }},
+    }
+
+    for _, env := range []string{"development", "staging", "production"} {
+        for _, helper := range helpers {
+            t.Run(env+"/"+helper.name, func(t *testing.T) {
+                app := newTestApplication(t)
+                app.config.env = env
+
+                var buf bytes.Buffer
+                app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+                for _, v := range apiVersions {
+                    buf.Reset()
+
+                    r := httptest.NewRequest(http.MethodGet, v.prefix()+"/movies", nil)
+                    r = app.contextSetAPIVersion(r, v)
+                    rr := httptest.NewRecorder()
+                    helper.handler(app).ServeHTTP(rr, r)
+
+                    if rr.Code != http.StatusInternalServerError {
+                        t.Fatalf("v%d: got status %d; want %d", v.number, rr.Code, http.StatusInternalServerError)
+                    }
+
+                    // The log has the error in every environment, the response only in development.
+                    if !strings.Contains(buf.String(), detail) {
+                        t.Errorf("v%d: the log doesn't have the error: %s", v.number, buf.String())
+                    }
+
+                    body := rr.Body.String()
+                    if got, want := strings.Contains(body, detail), env == "development"; got != want {
+                        t.Errorf("v%d: got the error in the response %t; want %t: %s", v.number, got, want, body)
+                    }
+                    if got, want := strings.Contains(body, "panickingHandler"), env == "development" && helper.name == "panic"; got != want {
+                        t.Errorf("v%d: got the stack in the response %t; want %t: %s", v.number, got, want, body)
+                    }
+                }
+            })
+        }
+    }
+
+    // A long stack is cut at a line boundary.
+    app := newTestApplication(t)
+    app.config.env = "development"
+
+    rr := httptest.NewRecorder()
+    stack := bytes.Repeat([]byte("main.handler()\n\t/src/main.go:1\n"), 1000)
+    app.panicResponse(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil), errors.New(detail), stack)
+
+    var resp struct {
+        Error struct {
+            Stack string `json:"stack"`
+        } `json:"error"`
+    }
+    decode(t, rr, &resp)
+
+    if len(resp.Error.Stack) > maxErrorStack+len("\n...") || !strings.HasSuffix(resp.Error.Stack, "main.go:1\n...") {
+        t.Errorf("got a stack of %d bytes ending with %q; want at most %d bytes ending with the last whole line", len(resp.Error.Stack), resp.Error.Stack[max(0, len(resp.Error.Stack)-20):], maxErrorStack)
+    }
+}
+
+func TestErrorResponses(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        name       string
+        helper     func(w http.ResponseWriter, r *http.Request)
+        wantStatus int
+        wantBody   string // in version 2 of the API
+        wantLegacy string // in version 1
+    }{
+        {
+            name:       "server error",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.serverErrorResponse(w, r, errors.New("boom")) },
+            wantStatus: http.StatusInternalServerError,
+            wantBody:   `{"error":{"code":"internal_error","message":"the server encountered a problem and could not process your request"}}`,
+            wantLegacy: `{"error":"the server encountered a problem and could not process your request"}`,
+        },
+        {
+            name:       "panic",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.panicResponse(w, r, errors.New("boom"), nil) },
+            wantStatus: http.StatusInternalServerError,
+            wantBody:   `{"error":{"code":"internal_error","message":"the server encountered a problem and could not process your request"}}`,
+            wantLegacy: `{"error":"the server encountered a problem and could not process your request"}`,
+        },
+        {
+            name:       "gateway timeout",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.gatewayTimeoutResponse(w, r, context.DeadlineExceeded) },
+            wantStatus: http.StatusGatewayTimeout,
+            wantBody:   `{"error":{"code":"database_timeout","message":"the server timed out waiting for the database, please try again later"}}`,
+            wantLegacy: `{"error":"the server timed out waiting for the database, please try again later"}`,
+        },
+        {
+            name:       "timeout",
+            helper:     app.timeoutResponse,
+            wantStatus: http.StatusServiceUnavailable,
+            wantBody:   `{"error":{"code":"request_timeout","message":"the server took too long to process your request, please try again later"}}`,
+            wantLegacy: `{"error":"the server took too long to process your request, please try again later"}`,
+        },
+        {
+            name:       "database unavailable",
+            helper:     app.databaseUnavailableResponse,
+            wantStatus: http.StatusServiceUnavailable,
+            wantBody:   `{"error":{"code":"database_unavailable","message":"the server is starting up and can't reach the database yet, please try again later"}}`,
+            wantLegacy: `{"error":"the server is starting up and can't reach the database yet, please try again later"}`,
+        },
+        {
+            name:       "not found",
+            helper:     app.notFoundResponse,
+            wantStatus: http.StatusNotFound,
+            wantBody:   `{"error":{"code":"not_found","message":"the requested resource could not be found"}}`,
+            wantLegacy: `{"error":"the requested resource could not be found"}`,
+        },
+        {
+            name:       "method not allowed",
+            helper:     app.methodNotAllowedResponse,
+            wantStatus: http.StatusMethodNotAllowed,
+            wantBody:   `{"error":{"code":"method_not_allowed","message":"the GET method is not supported for this resource"}}`,
+            wantLegacy: `{"error":"the GET method is not supported for this resource"}`,
+        },
+        {
+            name:       "not acceptable",
+            helper:     app.notAcceptableResponse,
+            wantStatus: http.StatusNotAcceptable,
+            wantBody:   `{"error":{"code":"not_acceptable","message":"the requested resource is not available in an acceptable format"},"supported":["application/json","application/xml","application/msgpack"]}`,
+            wantLegacy: `{"error":"the requested resource is not available in an acceptable format","supported":["application/json","application/xml","application/msgpack"]}`,
+        },
+        {
+            name:       "bad request",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.badRequestResponse(w, r, errors.New("body must not be empty")) },
+            wantStatus: http.StatusBadRequest,
+            wantBody:   `{"error":{"code":"bad_request","message":"body must not be empty"}}`,
+            wantLegacy: `{"error":"body must not be empty"}`,
+        },
+        {
+            name: "failed validation",
+            helper: func(w http.ResponseWriter, r *http.Request) {
+                app.failedValidationResponse(w, r, &validator.Validator{Errors: map[string][]string{"title": {"must be provided"}}})
+            },
+            wantStatus: http.StatusUnprocessableEntity,
+            wantBody:   `{"error":{"code":"validation_failed","message":"the request contains invalid values, see fields","fields":{"title":["must be provided"]}}}`,
+            wantLegacy: `{"error":{"title":["must be provided"]}}`,
+        },
+        {
+            name:       "content too large",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.contentTooLargeResponse(w, r, 1024) },
+            wantStatus: http.StatusRequestEntityTooLarge,
+            wantBody:   `{"error":{"code":"content_too_large","message":"the request body must not be larger than 1024 bytes"}}`,
+            wantLegacy: `{"error":"the request body must not be larger than 1024 bytes"}`,
+        },
+        {
+            name:       "unsupported media type",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.unsupportedMediaTypeResponse(w, r, []string{"image/png"}) },
+            wantStatus: http.StatusUnsupportedMediaType,
+            wantBody:   `{"error":{"code":"unsupported_media_type","message":"the content type is not supported, it must be one of: image/png"}}`,
+            wantLegacy: `{"error":"the content type is not supported, it must be one of: image/png"}`,
+        },
+        {
+            name:       "edit conflict",
+            helper:     app.editConflictResponse,
+            wantStatus: http.StatusConflict,
+            wantBody:   `{"error":{"code":"edit_conflict","message":"unable to update the record due to an edit conflict, please try again"}}`,
+            wantLegacy: `{"error":"unable to update the record due to an edit conflict, please try again"}`,
+        },
+        {
+            name:       "precondition failed",
+            helper:     app.preconditionFailedResponse,
+            wantStatus: http.StatusPreconditionFailed,
+            wantBody:   `{"error":{"code":"precondition_failed","message":"the record has changed since you fetched it, please fetch it again and retry"}}`,
+            wantLegacy: `{"error":"the record has changed since you fetched it, please fetch it again and retry"}`,
+        },
+        {
+            name:       "idempotency key in use",
+            helper:     app.idempotencyKeyInUseResponse,
+            wantStatus: http.StatusConflict,
+            wantBody:   `{"error":{"code":"idempotency_key_in_use","message":"a request with this Idempotency-Key is still being processed, please try again"}}`,
+            wantLegacy: `{"error":"a request with this Idempotency-Key is still being processed, please try again"}`,
+        },
+        {
+            name:       "idempotency key mismatch",
+            helper:     app.idempotencyKeyMismatchResponse,
+            wantStatus: http.StatusUnprocessableEntity,
+            wantBody:   `{"error":{"code":"idempotency_key_mismatch","message":"this Idempotency-Key has already been used for a different request"}}`,
+            wantLegacy: `{"error":"this Idempotency-Key has already been used for a different request"}`,
+        },
+        {
+            name: "rate limit exceeded",
+            helper: func(w http.ResponseWriter, r *http.Request) {
+                app.rateLimitExceededResponse(w, r, rateLimitStatus{limit: 4, window: 2, retryAfter: 1})
+            },
+            wantStatus: http.StatusTooManyRequests,
+            wantBody:   `{"error":{"code":"rate_limited","message":"rate limit exceeded","limit":4,"window":2,"retry_after":1}}`,
+            wantLegacy: `{"error":{"message":"rate limit exceeded","limit":4,"window":2,"retry_after":1}}`,
+        },
+        {
+            name: "movie referenced",
+            helper: func(w http.ResponseWriter, r *http.Request) {
+                app.movieReferencedResponse(w, r, data.MovieDependents{Posters: 1})
+            },
+            wantStatus: http.StatusConflict,
+            wantBody:   `{"error":{"code":"movie_referenced","message":"the movie can't be deleted because other records refer to it, delete them first or retry with force=true","dependents":{"posters":1}}}`,
+            wantLegacy: `{"error":{"message":"the movie can't be deleted because other records refer to it, delete them first or retry with force=true","dependents":{"posters":1}}}`,
+        },
+        {
+            name: "duplicate movie",
+            helper: func(w http.ResponseWriter, r *http.Request) {
+                app.duplicateMovieResponse(w, r, []data.MovieDuplicate{{ID: 1, Title: "Moana", Year: 2016, Similarity: 1}})
+            },
+            wantStatus: http.StatusConflict,
+            wantBody:   `{"error":{"code":"duplicate_movie","message":"a movie of the same year with a similar title already exists, retry with allow_duplicate=true to create it anyway","duplicates":[{"id":1,"title":"Moana","year":2016,"similarity":1}]}}`,
+            wantLegacy: `{"error":{"message":"a movie of the same year with a similar title already exists, retry with allow_duplicate=true to create it anyway","duplicates":[{"id":1,"title":"Moana","year":2016,"similarity":1}]}}`,
+        },
+        {
+            name:       "API key limit exceeded",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.apiKeyLimitExceededResponse(w, r, 2) },
+            wantStatus: http.StatusConflict,
+            wantBody:   `{"error":{"code":"api_key_limit_exceeded","message":"you can't have more than 2 API keys, delete an existing key first"}}`,
+            wantLegacy: `{"error":"you can't have more than 2 API keys, delete an existing key first"}`,
+        },
+        {
+            name:       "invalid credentials",
+            helper:     app.invalidCredentialsResponse,
+            wantStatus: http.StatusUnauthorized,
+            wantBody:   `{"error":{"code":"invalid_credentials","message":"invalid authentication credentials"}}`,
+            wantLegacy: `{"error":"invalid authentication credentials"}`,
+        },
+        {
+            name:       "invalid authentication token",
+            helper:     app.invalidAuthenticationTokenResponse,
+            wantStatus: http.StatusUnauthorized,
+            wantBody:   `{"error":{"code":"invalid_authentication_token","message":"invalid or missing authentication token"}}`,
+            wantLegacy: `{"error":"invalid or missing authentication token"}`,
+        },
+        {
+            name:       "authentication required",
+            helper:     app.authenticationRequiredResponse,
+            wantStatus: http.StatusUnauthorized,
+            wantBody:   `{"error":{"code":"authentication_required","message":"you must be authenticated to access this resource"}}`,
+            wantLegacy: `{"error":"you must be authenticated to access this resource"}`,
+        },
+        {
+            name:       "inactive account",
+            helper:     app.inactiveAccountResponse,
+            wantStatus: http.StatusForbidden,
+            wantBody:   `{"error":{"code":"inactive_account","message":"your user account must be activated to access this resource"}}`,
+            wantLegacy: `{"error":"your user account must be activated to access this resource"}`,
+        },
+        {
+            name:       "password reset required",
+            helper:     app.passwordResetRequiredResponse,
+            wantStatus: http.StatusForbidden,
+            wantBody:   `{"error":{"code":"password_reset_required","message":"your password must be reset before you can log in, please follow the instructions sent to your email address"}}`,
+            wantLegacy: `{"error":"your password must be reset before you can log in, please follow the instructions sent to your email address"}`,
+        },
+        {
+            name:       "not permitted",
+            helper:     app.notPermittedResponse,
+            wantStatus: http.StatusForbidden,
+            wantBody:   `{"error":{"code":"not_permitted","message":"your user account doesn't have the necessary permissions to access this resource"}}`,
+            wantLegacy: `{"error":"your user account doesn't have the necessary permissions to access this resource"}`,
+        },
+        {
+            name:       "unsupported API version",
+            helper:     func(w http.ResponseWriter, r *http.Request) { app.unsupportedAPIVersionResponse(w, r, 3) },
+            wantStatus: http.StatusNotFound,
+            wantBody:   `{"error":{"code":"unsupported_api_version","message":"API version v3 is not supported, the supported versions are: v1, v2"}}`,
+            wantLegacy: `{"error":"API version v3 is not supported, the supported versions are: v1, v2"}`,
+        },
+    }
+
+    // Every documented code is sent by one of the helpers.
+    codes := make(map[errorCode]bool)
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            for _, v := range apiVersions {
+                r := httptest.NewRequest(http.MethodGet, v.prefix()+"/movies", nil)
+                r = app.contextSetUser(app.contextSetAPIVersion(r, v), data.AnonymousUser)
+                rr := httptest.NewRecorder()
+                tt.helper(rr, r)
+
+                want := tt.wantBody
+                if v.number == 1 {
+                    want = tt.wantLegacy
+                }
+
+                if rr.Code != tt.wantStatus {
+                    t.Errorf("v%d: got status %d; want %d", v.number, rr.Code, tt.wantStatus)
+                }
+                if got := strings.TrimSuffix(rr.Body.String(), "\n"); got != want {
+                    t.Errorf("v%d: got body %s\nwant %s", v.number, got, want)
+                }
+
+                if v == latestAPIVersion {
+                    var resp struct {
+                        Error apiError `json:"error"`
+                    }
+                    decode(t, rr, &resp)
+                    codes[resp.Error.Code] = true
+                }
+            }
+        })
+    }
+
+    for _, code := range errorCodes {
+        if !codes[code] {
+            t.Errorf("no helper sends code %s", code)
+        }
+    }
+    // Fewer codes sent than listed means that errorCodes has duplicates.
+    if len(codes) != len(errorCodes) {
+        t.Errorf("got %d codes; want the %d in errorCodes", len(codes), len(errorCodes))
+    }
+}
+
+func TestValidationErrorXML(t *testing.T) {
+    app := newTestApplication(t)
+
+    r := httptest.NewRequest(http.MethodPost, "/v1/movies", nil)
+    r.Header.Set("Accept", contentTypeXML)
+    rr := httptest.NewRecorder()
+    app.failedValidationResponse(rr, r, &validator.Validator{Errors: map[string][]string{"year": {"must be provided"}, "title": {"must be provided", "must not be empty"}}})
+
+    want := `<error><code>validation_failed</code><message>the request contains invalid values, see fields</message><fields>` +
+        `<entry key="title">must be provided</entry><entry key="title">must not be empty</entry><entry key="year">must be provided</entry>` +
+        `</fields></error>`
+    if !strings.Contains(rr.Body.String(), want) {
+        t.Errorf("got %s\nwant it to contain %s", rr.Body, want)
+    }
+}
+
+func TestLocalizedErrors(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    invalidMovie := `{"title": "", "year": 2010, "runtime": "148 mins", "genres": ["sci-fi", "sci-fi"]}`
+
+    tests := []struct {
+        name           string
+        method         string
+        target         string
+        body           string
+        acceptLanguage string
+        wantLanguage   string
+        wantMessage    string
+        wantFields     map[string][]string
+    }{
+        {
+            name: "not found in French", method: http.MethodGet, target: "/v2/nothing", acceptLanguage: "fr-FR, en;q=0.5",
+            wantLanguage: "fr", wantMessage: "la ressource demandée est introuvable",
+        },
+        {
+            name: "method not allowed in Spanish", method: http.MethodPut, target: "/v2/movies", acceptLanguage: "es",
+            wantLanguage: "es", wantMessage: "el método PUT no está admitido para este recurso",
+        },
+        {
+            name: "validation in French", method: http.MethodPost, target: "/v2/movies", body: invalidMovie, acceptLanguage: "fr",
+            wantLanguage: "fr", wantMessage: "la requête contient des valeurs invalides, voir fields",
+            wantFields: map[string][]string{"title": {"doit être renseigné"}, "genres": {"ne doit pas contenir de doublons"}},
+        },
+        {
+            name: "unsupported language", method: http.MethodGet, target: "/v2/nothing", acceptLanguage: "de",
+            wantLanguage: "en", wantMessage: "the requested resource could not be found",
+        },
+        {
+            name: "no Accept-Language", method: http.MethodGet, target: "/v2/nothing",
+            wantLanguage: "en", wantMessage: "the requested resource could not be found",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+            r.Header.Set("Authorization", "Bearer "+token)
+            if tt.acceptLanguage != "" {
+                r.Header.Set("Accept-Language", tt.acceptLanguage)
+            }
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, r)
+
+            if got := rr.Header().Get("Content-Language"); got != tt.wantLanguage {
+                t.Errorf("got Content-Language %q; want %q", got, tt.wantLanguage)
+            }
+
+            var body struct {
+                Error apiError `json:"error"`
+            }
+            decode(t, rr, &body)
+
+            if body.Error.Message != tt.wantMessage {
+                t.Errorf("got message %q; want %q", body.Error.Message, tt.wantMessage)
+            }
+            if tt.wantFields != nil && !reflect.DeepEqual(map[string][]string(body.Error.Fields), tt.wantFields) {
+                t.Errorf("got fields %v; want %v", body.Error.Fields, tt.wantFields)
+            }
+        })
+    }
+}
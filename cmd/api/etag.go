@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockSkewTolerance is how far an If-Modified-Since date which the client made up, rather than
+// copied from a Last-Modified header, must be after the last modification for a 304. It keeps a
+// client clock running slightly ahead of the database's from skipping changes.
+const clockSkewTolerance = 2 * time.Second
+
+// versionETag returns the entity tag of a version of a movie or user. It's weak because the JSON,
+// XML and MessagePack representations of the record share it.
+func versionETag(version int64) string {
+    return fmt.Sprintf(`W/"%d"`, version)
+}
+
+// etagListed reports whether the If-Match or If-None-Match header value lists etag or is "*".
+// The comparison is weak, i.e. W/"3" matches "3": strictly If-Match needs a strong match, which
+// would make it useless with our ETags, all of which are weak.
+func etagListed(header, etag string) bool {
+    for _, tag := range strings.Split(header, ",") {
+        tag = strings.TrimSpace(tag)
+        if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+            return true
+        }
+    }
+
+    return false
+}
+
+// notModified sets the ETag header and, if the request's If-None-Match header lists etag, sends
+// a 304 Not Modified response and returns true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+    w.Header().Set("ETag", etag)
+
+    if etagListed(r.Header.Get("If-None-Match"), etag) {
+        w.WriteHeader(http.StatusNotModified)
+        return true
+    }
+
+    return false
+}
+
+// notModifiedSince sets the Last-Modified header to lastModified and, if the request's
+// If-Modified-Since header is lastModified, or a date at least clockSkewTolerance after it, sends
+// a 304 Not Modified response and returns true. A zero lastModified, e.g. of an empty list, sets
+// no header and is always modified.
+func notModifiedSince(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+    if lastModified.IsZero() {
+        return false
+    }
+
+    // HTTP dates have a resolution of a second.
+    lastModified = lastModified.Truncate(time.Second)
+    w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+
+    since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+    if err != nil {
+        return false
+    }
+
+    if since.Equal(lastModified) || !since.Before(lastModified.Add(clockSkewTolerance)) {
+        w.WriteHeader(http.StatusNotModified)
+        return true
+    }
+
+    return false
+}
+
+// preconditionFailed sets the ETag header to the tag of version, the version of the record about
+// to be updated, and checks it against the request's If-Match header and the version in its
+// X-Expected-Version header. Both are optional. If either doesn't match, it sends a 412
+// Precondition Failed response and returns true; an X-Expected-Version which isn't an integer
+// gets a 400 Bad Request.
+//
+// The update itself is still conditional on the version, so a change made between this check and
+// the update gets the usual 409 edit conflict.
+func (app *application) preconditionFailed(w http.ResponseWriter, r *http.Request, version int64) bool {
+    etag := versionETag(version)
+    w.Header().Set("ETag", etag)
+
+    if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !etagListed(ifMatch, etag) {
+        app.preconditionFailedResponse(w, r)
+        return true
+    }
+
+    if expected := r.Header.Get("X-Expected-Version"); expected != "" {
+        n, err := strconv.ParseInt(expected, 10, 64)
+        if err != nil {
+            app.badRequestResponse(w, r, errors.New("X-Expected-Version header must be an integer"))
+            return true
+        }
+
+        if n != version {
+            app.preconditionFailedResponse(w, r)
+            return true
+        }
+    }
+
+    return false
+}
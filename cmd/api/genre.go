@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
+)
+
+// movieGenres returns the genres movie genres are validated against, or nil with
+// -free-text-genres, which lets movies have any genre.
+func (app *application) movieGenres(ctx context.Context) (data.Genres, error) {
+    if app.config.freeTextGenres {
+        return nil, nil
+    }
+
+    return app.models.Genre.GetAll(ctx)
+}
+
+func (app *application) listGenresHandler(w http.ResponseWriter, r *http.Request) {
+    genres, err := app.models.Genre.GetAll(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"genres": genres}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+func (app *application) createGenreHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Name string `json:"name"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    genre := &data.Genre{Name: input.Name}
+
+    v := validator.New()
+
+    if data.ValidateGenre(v, genre); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    err = app.models.Genre.Insert(r.Context(), genre)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrDuplicateGenre):
+            v.AddError("name", "a genre with this name already exists")
+            app.failedValidationResponse(w, r, v)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    headers := make(http.Header)
+    headers.Set("Location", app.externalURL(fmt.Sprintf("%s/genres/%d", app.contextGetAPIVersion(r).prefix(), genre.ID), nil))
+
+    err = app.writeResponse(w, r, http.StatusCreated, envelope{"genre": genre}, headers)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// renameGenreHandler renames a genre, and the genre in all the movies which have it.
+func (app *application) renameGenreHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    var input struct {
+        Name string `json:"name"`
+    }
+
+    err = app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    genre := &data.Genre{ID: id, Name: input.Name}
+
+    v := validator.New()
+
+    if data.ValidateGenre(v, genre); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    updated, err := app.models.Genre.Rename(r.Context(), genre)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        case errors.Is(err, data.ErrDuplicateGenre):
+            v.AddError("name", "a genre with this name already exists")
+            app.failedValidationResponse(w, r, v)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    if updated > 0 {
+        app.movieCache.invalidateAll()
+        app.movieReads.forgetAll()
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"genre": genre, "movies_updated": updated}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestGenreHandlers(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+    writer := authToken(t, app, mock.ActivatedUserID)
+
+    rr := do(t, h, http.MethodGet, "/v1/genres", writer, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("list: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var list struct {
+        Genres []struct {
+            ID   int64  `json:"id"`
+            Name string `json:"name"`
+        } `json:"genres"`
+    }
+    decode(t, rr, &list)
+
+    if len(list.Genres) == 0 || list.Genres[0].Name != "action" {
+        t.Fatalf("got genres %v; want them sorted, starting with action", list.Genres)
+    }
+
+    tests := []struct {
+        name       string
+        token      string
+        method     string
+        target     string
+        body       map[string]any
+        wantStatus int
+    }{
+        {"create", admin, http.MethodPost, "/v1/genres", map[string]any{"name": "Film-Noir"}, http.StatusCreated},
+        {"create duplicate in another case", admin, http.MethodPost, "/v1/genres", map[string]any{"name": "COMEDY"}, http.StatusUnprocessableEntity},
+        {"create with a comma", admin, http.MethodPost, "/v1/genres", map[string]any{"name": "sci-fi, fantasy"}, http.StatusUnprocessableEntity},
+        {"create without permission", writer, http.MethodPost, "/v1/genres", map[string]any{"name": "musical"}, http.StatusForbidden},
+        {"rename to a taken name", admin, http.MethodPatch, "/v1/genres/1", map[string]any{"name": "Comedy"}, http.StatusUnprocessableEntity},
+        {"rename unknown genre", admin, http.MethodPatch, "/v1/genres/999", map[string]any{"name": "musical"}, http.StatusNotFound},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, tt.method, tt.target, tt.token, tt.body)
+            if rr.Code != tt.wantStatus {
+                t.Errorf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+        })
+    }
+}
+
+func TestRenameGenreUpdatesMovies(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+
+    // Genre 2 is adventure, a genre of Moana and Black Panther.
+    rr := do(t, h, http.MethodPatch, "/v1/genres/2", admin, map[string]any{"name": "Adventure"})
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        MoviesUpdated int `json:"movies_updated"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.MoviesUpdated != 2 {
+        t.Errorf("got %d movies updated; want 2", resp.MoviesUpdated)
+    }
+
+    movie, err := app.models.Movie.Get(context.Background(), 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !slices.Equal(movie.Genres, []string{"animation", "Adventure"}) || movie.Version != 2 {
+        t.Errorf("got genres %v, version %d; want [animation Adventure], version 2", movie.Genres, movie.Version)
+    }
+}
+
+func TestMovieGenreValidation(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    body := func(genres ...string) map[string]any {
+        return map[string]any{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": genres}
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/movies", token, body("Animation", "FAMILY"))
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("known genres: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        Movie struct {
+            Genres []string `json:"genres"`
+        } `json:"movie"`
+    }
+    decode(t, rr, &resp)
+
+    if !slices.Equal(resp.Movie.Genres, []string{"animation", "family"}) {
+        t.Errorf("got genres %v; want the canonical [animation family]", resp.Movie.Genres)
+    }
+
+    var errResp struct {
+        Error map[string][]string `json:"error"`
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, body("animation", "space opera"))
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("unknown genre: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+    decode(t, rr, &errResp)
+    if _, ok := errResp.Error["genres[1]"]; !ok {
+        t.Errorf("got errors %v; want one for genres[1]", errResp.Error)
+    }
+
+    // The same genre in two casings is a duplicate.
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, body("comedy", "Comedy"))
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("duplicate genre: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    app.config.freeTextGenres = true
+
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, map[string]any{
+        "title": "Wall-E", "year": 2008, "runtime": "98 mins", "genres": []string{"Space Opera"},
+    })
+    if rr.Code != http.StatusCreated {
+        t.Errorf("free-text genres: got status %d; body: %s", rr.Code, rr.Body)
+    }
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// goldenStep is a request of a golden test, whose response is compared to the golden file
+// named after the step.
+type goldenStep struct {
+    name   string
+    method string
+    target string
+    userID int64 // the user the request is authenticated as; 0 for an anonymous request
+    body   any
+}
+
+// runGolden sends the steps in order through the routes of app, so that each step sees the
+// changes of the previous ones.
+func runGolden(t *testing.T, app *application, steps []goldenStep) {
+    t.Helper()
+
+    h := app.routes()
+
+    for _, step := range steps {
+        var token string
+        if step.userID != 0 {
+            token = authToken(t, app, step.userID)
+        }
+
+        rr := do(t, h, step.method, step.target, token, step.body)
+        assertGolden(t, step.name, rr)
+    }
+}
+
+func TestGoldenMovies(t *testing.T) {
+    app := newTestApplication(t)
+
+    runGolden(t, app, []goldenStep{
+        {"movie_show", http.MethodGet, "/v1/movies/1", mock.ReadOnlyUserID, nil},
+        {"movie_list", http.MethodGet, "/v1/movies?genres=adventure&sort=-year", mock.ReadOnlyUserID, nil},
+        {"movie_create", http.MethodPost, "/v1/movies", mock.ActivatedUserID, map[string]any{
+            "title": "Inception", "year": 2010, "runtime": "148 mins", "genres": []string{"Sci-Fi", "thriller"},
+        }},
+        {"movie_update", http.MethodPatch, "/v1/movies/4", mock.ActivatedUserID, map[string]any{"title": "Inception (2010)"}},
+        {"movie_delete", http.MethodDelete, "/v1/movies/4", mock.ActivatedUserID, nil},
+        {"movie_show_deleted", http.MethodGet, "/v1/movies/4", mock.ReadOnlyUserID, nil},
+    })
+}
+
+func TestGoldenUsers(t *testing.T) {
+    app := newTestApplication(t)
+
+    runGolden(t, app, []goldenStep{
+        {"user_register", http.MethodPost, "/v1/users", 0, map[string]any{
+            "name": "Dave", "email": "dave@example.com", "password": "correct horse battery",
+        }},
+        {"user_register_duplicate", http.MethodPost, "/v1/users", 0, map[string]any{
+            "name": "Dave", "email": "dave@example.com", "password": "correct horse battery",
+        }},
+    })
+
+    // The activation token is only sent by email.
+    app.wg.Wait()
+
+    sender := app.emailSender.(*stubSender)
+    if len(sender.sent) != 1 {
+        t.Fatalf("got %d emails; want the welcome email", len(sender.sent))
+    }
+    token := sender.sent[0].data.(map[string]any)["activationToken"].(string)
+
+    runGolden(t, app, []goldenStep{
+        {"user_activate", http.MethodPut, "/v1/users/activated", 0, map[string]any{"token": token}},
+        {"user_activate_used_token", http.MethodPut, "/v1/users/activated", 0, map[string]any{"token": token}},
+    })
+}
+
+func TestGoldenErrors(t *testing.T) {
+    app := newTestApplication(t)
+
+    runGolden(t, app, []goldenStep{
+        {"error_not_found", http.MethodGet, "/v1/nothing", 0, nil},
+        {"error_method_not_allowed", http.MethodPut, "/v1/movies", mock.ActivatedUserID, nil},
+        {"error_malformed_json", http.MethodPost, "/v1/movies", mock.ActivatedUserID, `{"title": `},
+        {"error_unknown_field", http.MethodPost, "/v1/movies", mock.ActivatedUserID, `{"rating": 5}`},
+        {"error_invalid_runtime", http.MethodPost, "/v1/movies", mock.ActivatedUserID, map[string]any{
+            "title": "Inception", "year": 2010, "runtime": "-1 mins", "genres": []string{"sci-fi"},
+        }},
+        {"error_validation", http.MethodPost, "/v1/movies", mock.ActivatedUserID, map[string]any{
+            "title": "", "year": 1800, "runtime": "148 mins", "genres": []string{"action", "action", "space opera"},
+        }},
+        {"error_authentication_required", http.MethodGet, "/v1/movies", 0, nil},
+        {"error_inactive_account", http.MethodGet, "/v1/movies", mock.InactiveUserID, nil},
+        {"error_permission_denied", http.MethodPost, "/v1/movies", mock.ReadOnlyUserID, map[string]any{
+            "title": "Inception", "year": 2010, "runtime": "148 mins", "genres": []string{"sci-fi"},
+        }},
+        {"error_invalid_credentials", http.MethodPost, "/v1/tokens/authentication", 0, map[string]any{
+            "email": mock.ActivatedUserEmail, "password": "wrong password",
+        }},
+    })
+}
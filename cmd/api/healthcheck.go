@@ -1,19 +1,109 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"time"
+
+	"greenlight.zzh.net/internal/vcs"
 )
 
+// buildInfo describes the running binary and its environment.
+type buildInfo struct {
+    Version     string `json:"version" xml:"version"`
+    Revision    string `json:"revision" xml:"revision"`
+    CommitTime  string `json:"commit_time" xml:"commit_time"`
+    BuildTime   string `json:"build_time,omitempty" xml:"build_time,omitempty"`
+    Dirty       bool   `json:"dirty" xml:"dirty"`
+    GoVersion   string `json:"go_version" xml:"go_version"`
+    Environment string `json:"environment" xml:"environment"`
+    StartTime   string `json:"start_time" xml:"start_time"`
+    Uptime      string `json:"uptime" xml:"uptime"`
+}
+
+// buildInfo returns the build information of the binary together with the environment and the
+// time elapsed since the application started.
+func (app *application) buildInfo() buildInfo {
+    bi := vcs.ReadBuildInfo()
+
+    return buildInfo{
+        Version:     version,
+        Revision:    bi.Revision,
+        CommitTime:  bi.CommitTime,
+        BuildTime:   bi.BuildTime,
+        Dirty:       bi.Modified,
+        GoVersion:   bi.GoVersion,
+        Environment: app.config.env,
+        StartTime:   app.startTime.UTC().Format(time.RFC3339),
+        Uptime:      time.Since(app.startTime).Round(time.Second).String(),
+    }
+}
+
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
     data := envelope{
-        "status": "available",
-        "system_info": map[string]string{
-            "environment": app.config.env,
-            "version":     version,
-        },
+        "status":      "available",
+        "system_info": app.buildInfo(),
+    }
+
+    err := app.writeResponse(w, r, http.StatusOK, data, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// degradedError is returned by a readiness check of a dependency which the application can do
+// without, such as the read replica. It's reported without making the instance unready.
+type degradedError struct {
+    err error
+}
+
+func (e degradedError) Error() string {
+    return e.err.Error()
+}
+
+// readyHandler reports whether the application is ready to serve requests, running each of
+// app.readinessChecks with a short timeout. It responds with 503 Service Unavailable if any of
+// them fails, so that load balancers stop sending traffic to the instance, unless the failure is
+// a degradedError.
+func (app *application) readyHandler(w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+    defer cancel()
+
+    status := http.StatusOK
+    checks := make(map[string]string, len(app.readinessChecks))
+
+    for name, check := range app.readinessChecks {
+        err := check(ctx)
+
+        var degraded degradedError
+        if errors.As(err, &degraded) {
+            checks[name] = "degraded: " + degraded.err.Error()
+            continue
+        }
+
+        if err != nil {
+            status = http.StatusServiceUnavailable
+            checks[name] = err.Error()
+            continue
+        }
+
+        checks[name] = "ok"
     }
 
-    err := app.writeJSON(w, http.StatusOK, data, nil)
+    data := envelope{"status": "ready", "checks": checks}
+    if status != http.StatusOK {
+        data["status"] = "not ready"
+    }
+
+    err := app.writeResponse(w, r, status, data, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+func (app *application) versionHandler(w http.ResponseWriter, r *http.Request) {
+    err := app.writeResponse(w, r, http.StatusOK, envelope{"build_info": app.buildInfo()}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionHandler(t *testing.T) {
+    app := newTestApplication(t)
+    app.startTime = time.Now().Add(-90 * time.Second)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodGet, "/v1/version", "", nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    var resp struct {
+        BuildInfo buildInfo `json:"build_info"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.BuildInfo.GoVersion != runtime.Version() {
+        t.Errorf("got go_version %q; want %q", resp.BuildInfo.GoVersion, runtime.Version())
+    }
+    if resp.BuildInfo.Environment != "testing" {
+        t.Errorf("got environment %q; want %q", resp.BuildInfo.Environment, "testing")
+    }
+    if resp.BuildInfo.Uptime != "1m30s" {
+        t.Errorf("got uptime %q; want %q", resp.BuildInfo.Uptime, "1m30s")
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/healthcheck", "", nil)
+
+    var health struct {
+        Status     string    `json:"status"`
+        SystemInfo buildInfo `json:"system_info"`
+    }
+    decode(t, rr, &health)
+
+    if health.Status != "available" || health.SystemInfo.Version != version {
+        t.Errorf("unexpected healthcheck response %+v", health)
+    }
+}
+
+func TestReadyHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    app.readinessChecks = map[string]func(ctx context.Context) error{
+        "database":       func(ctx context.Context) error { return nil },
+        "mail_templates": func(ctx context.Context) error { return nil },
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    var resp struct {
+        Status string            `json:"status"`
+        Checks map[string]string `json:"checks"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.Status != "ready" || resp.Checks["database"] != "ok" || resp.Checks["mail_templates"] != "ok" {
+        t.Errorf("got %+v; want ready with both checks ok", resp)
+    }
+
+    app.readinessChecks["mail_templates"] = func(ctx context.Context) error {
+        return errors.New("user_welcome.html: map has no entry for key \"nmae\"")
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+    if rr.Code != http.StatusServiceUnavailable {
+        t.Fatalf("failing check: got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+    }
+
+    decode(t, rr, &resp)
+    if resp.Status != "not ready" || resp.Checks["database"] != "ok" || !strings.Contains(resp.Checks["mail_templates"], "nmae") {
+        t.Errorf("failing check: got %+v; want not ready with the template error", resp)
+    }
+
+    // A dependency the application can do without only degrades it.
+    delete(app.readinessChecks, "mail_templates")
+    app.readinessChecks["database_replica"] = func(ctx context.Context) error {
+        return degradedError{errors.New("connection refused")}
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/healthcheck/ready", "", nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("degraded check: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    decode(t, rr, &resp)
+    if resp.Status != "ready" || resp.Checks["database_replica"] != "degraded: connection refused" {
+        t.Errorf("degraded check: got %+v; want ready with the replica degraded", resp)
+    }
+}
@@ -3,23 +3,32 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.zzh.net/internal/data"
 	"greenlight.zzh.net/internal/validator"
 )
 
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+    return app.readInt64Param(r, "id")
+}
+
+// readInt64Param reads the named URL parameter as a positive integer.
+func (app *application) readInt64Param(r *http.Request, name string) (int64, error) {
     params := httprouter.ParamsFromContext(r.Context())
 
-    id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+    id, err := strconv.ParseInt(params.ByName(name), 10, 64)
     if err != nil || id < 1 {
-        return 0, errors.New("invalid id parameter")
+        return 0, fmt.Errorf("invalid %s parameter", name)
     }
 
     return id, nil
@@ -63,40 +72,131 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
     return i
 }
 
-type envelope map[string]any
+// readIntRange reads an integer like readInt, and also adds an error to v if it isn't between min
+// and max inclusive.
+func (app *application) readIntRange(qs url.Values, key string, defaultValue, min, max int, v *validator.Validator) int {
+    i := app.readInt(qs, key, defaultValue, v)
+
+    v.Checkf(i >= min && i <= max, key, "must be between %d and %d", min, max)
+
+    return i
+}
 
-func (app *application) writeJSON(w http.ResponseWriter, status int, data envelope, headers http.Header) error {
-    js, err := json.MarshalIndent(data, "", "    ")
+// readCSVUnique reads a comma separated list like readCSV, and also adds an error to v if a value
+// is listed twice.
+func (app *application) readCSVUnique(qs url.Values, key string, defaultValue []string, v *validator.Validator) []string {
+    values := app.readCSV(qs, key, defaultValue)
+
+    v.Check(validator.Unique(values), key, "must not contain duplicate values")
+
+    return values
+}
+
+// readBool reads an optional boolean, such as include_total=false. It returns nil if the key is
+// missing, or if the value isn't one accepted by strconv.ParseBool, in which case an error is
+// added to v.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+    s := qs.Get(key)
+
+    if s == "" {
+        return nil
+    }
+
+    b, err := strconv.ParseBool(s)
+    if err != nil {
+        v.AddError(key, "must be a boolean value")
+        return nil
+    }
+
+    return &b
+}
+
+// readDate reads an optional time, either an RFC 3339 timestamp or a date such as 2024-01-01,
+// which is midnight UTC, and returns it in UTC. It returns nil if the key is missing, or if the
+// value is in neither format, in which case an error is added to v.
+func (app *application) readDate(qs url.Values, key string, v *validator.Validator) *time.Time {
+    s := qs.Get(key)
+
+    if s == "" {
+        return nil
+    }
+
+    t, err := time.Parse(time.RFC3339, s)
+    if err != nil {
+        t, err = time.Parse(time.DateOnly, s)
+    }
     if err != nil {
-        return err
+        v.AddError(key, "must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+        return nil
+    }
+
+    t = t.UTC()
+
+    return &t
+}
+
+type envelope map[string]any
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows a gzip encoded response,
+// i.e. lists gzip, or else *, without q=0.
+func acceptsGzip(r *http.Request) bool {
+    weights := make(map[string]float64)
+
+    for _, value := range r.Header.Values("Accept-Encoding") {
+        for _, part := range strings.Split(value, ",") {
+            coding, params, _ := strings.Cut(part, ";")
+
+            weight := 1.0
+            if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+                weight, _ = strconv.ParseFloat(q, 64)
+            }
+
+            weights[strings.ToLower(strings.TrimSpace(coding))] = weight
+        }
     }
 
-    // Append a newline to make it easier to view in terminal applications.
-    js = append(js, '\n')
+    if weight, ok := weights["gzip"]; ok {
+        return weight > 0
+    }
 
-    // At this point, we know that we won't encounter any more errors before writing the response, 
-    // so it's safe to add any headers that we want to include. We loop through the header map and 
-    // add each header to the http.ResponseWriter header map. Note that it's OK if the provided 
-    // header map is nil. Go doesn't throw an error if you try to range over a nil map.
+    return weights["*"] > 0
+}
+
+// prettyPrint reports whether a response should be indented: always in development, otherwise
+// only when the client asks for it with ?pretty=true.
+func (app *application) prettyPrint(r *http.Request) bool {
+    return app.config.env == "development" || r.URL.Query().Get("pretty") == "true"
+}
+
+func (app *application) writeJSON(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+    // We loop through the header map and add each header to the http.ResponseWriter header map.
+    // Note that it's OK if the provided header map is nil. Go doesn't throw an error if you try
+    // to range over a nil map.
     for key, value := range headers {
         w.Header()[key] = value  // w.Header().Set(key, value)
     }
     // iterator version
     // maps.Insert(w.Header(), maps.All(headers))
 
-    // Add the "Content-Type: application/json" header, then write the status code and JSON 
-    // response.
+    // Add the "Content-Type: application/json" header, then write the status code and encode
+    // the JSON response directly to the http.ResponseWriter. Indenting is comparatively
+    // expensive for large responses, so it's only done when prettyPrint() says so. Encode()
+    // appends a newline, which makes it easier to view the response in terminal applications.
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(status)
-    w.Write(js)
 
-    return nil
+    enc := json.NewEncoder(w)
+    if app.prettyPrint(r) {
+        enc.SetIndent("", "    ")
+    }
+
+    return enc.Encode(data)
 }
 
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
-    // Use http.MaxBytesReader() to limit the size of the request body to 1MB.
-    maxBytes := 1048576
-    r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+    // Use http.MaxBytesReader() to limit the size of the request body. The limit defaults to
+    // the -max-body-bytes flag but can be overridden per route with the maxBodyBytes() middleware.
+    r.Body = http.MaxBytesReader(w, r.Body, app.contextGetMaxBodyBytes(r))
 
     decoder := json.NewDecoder(r.Body)
     decoder.DisallowUnknownFields()
@@ -158,8 +258,19 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
     return nil
 }
 
-// The background helper accepts an arbitrary function as a parameter.
-func (app *application) background(fn func()) {
+var (
+    totalBackgroundTasksStarted   = expvar.NewMap("total_background_tasks_started")
+    totalBackgroundTasksCompleted = expvar.NewMap("total_background_tasks_completed")
+    totalBackgroundTasksPanicked  = expvar.NewMap("total_background_tasks_panicked")
+)
+
+// background runs fn in a goroutine which the graceful shutdown waits for. The task is counted
+// by name in the total_background_tasks_* expvars. A panic is recovered and logged with the name
+// and stack trace, and a task still running after -background-task-warn-after is logged as slow
+// so that a hung task doesn't go unnoticed.
+func (app *application) background(name string, fn func()) {
+    totalBackgroundTasksStarted.Add(name, 1)
+
     // Increase the WaitGroup counter.
     app.wg.Add(1)
 
@@ -167,14 +278,179 @@ func (app *application) background(fn func()) {
         // Use defer to decrease the WaitGroup counter before the goroutine returns.
         defer app.wg.Done()
 
+        if warnAfter := app.config.tasks.warnAfter; warnAfter > 0 {
+            timer := time.AfterFunc(warnAfter, func() {
+                app.logger.Warn("slow background task", "task", name, "running_for", warnAfter.String())
+            })
+            defer timer.Stop()
+        }
+
         // Recover any panic.
         defer func() {
             if err := recover(); err != nil {
-                app.logger.Error(fmt.Sprintf("%v", err))
+                totalBackgroundTasksPanicked.Add(name, 1)
+                app.logger.Error(fmt.Sprintf("panic: %v", err), "task", name, "stack", string(debug.Stack()))
+                return
             }
+
+            totalBackgroundTasksCompleted.Add(name, 1)
         }()
 
         // Execute the arbitrary function received as the parameter.
         fn()
     }()
-}
\ No newline at end of file
+}
+
+// paginationLinks returns the value of an RFC 8288 Link header pointing to the first, previous,
+// next and last pages of a list, e.g. </v1/movies?page=3&title=up>; rel="next". The links
+// keep every query parameter of u except page. There is no previous link on the first page and
+// no next link on the last one, and no links at all for an empty list. Without the total
+// (metadata.HasMore is set) there is no last link either.
+func (app *application) paginationLinks(u *url.URL, metadata data.Metadata) string {
+    if metadata.HasMore == nil && metadata.TotalRecords == 0 {
+        return ""
+    }
+
+    link := func(page int, rel string) string {
+        return fmt.Sprintf("<%s>; rel=%q", app.pageURL(u, page), rel)
+    }
+
+    links := []string{link(metadata.FirstPage, "first")}
+
+    if prev := prevPage(metadata); prev > 0 {
+        links = append(links, link(prev, "prev"))
+    }
+    if next := nextPage(metadata); next > 0 {
+        links = append(links, link(next, "next"))
+    }
+
+    if metadata.HasMore == nil {
+        links = append(links, link(metadata.LastPage, "last"))
+    }
+
+    return strings.Join(links, ", ")
+}
+
+// metadataLinks returns the URLs of the current, next and previous pages of the list at u, for
+// the metadata of the response.
+func (app *application) metadataLinks(u *url.URL, metadata data.Metadata) *data.PageLinks {
+    links := &data.PageLinks{Self: app.externalURL(u.Path, u.Query())}
+
+    if prev := prevPage(metadata); prev > 0 {
+        links.Prev = app.pageURL(u, prev)
+    }
+    if next := nextPage(metadata); next > 0 {
+        links.Next = app.pageURL(u, next)
+    }
+
+    return links
+}
+
+// prevPage returns the page before the current one, or 0 on the first page. Past the end of
+// the list, it is the last page.
+func prevPage(metadata data.Metadata) int {
+    if metadata.CurrentPage <= metadata.FirstPage {
+        return 0
+    }
+
+    if metadata.HasMore == nil {
+        return min(metadata.CurrentPage-1, metadata.LastPage)
+    }
+
+    return metadata.CurrentPage - 1
+}
+
+// nextPage returns the page after the current one, or 0 on the last page.
+func nextPage(metadata data.Metadata) int {
+    if metadata.HasMore != nil && !*metadata.HasMore || metadata.HasMore == nil && metadata.CurrentPage >= metadata.LastPage {
+        return 0
+    }
+
+    return metadata.CurrentPage + 1
+}
+
+// pageURL returns the URL of the given page of the list at u.
+func (app *application) pageURL(u *url.URL, page int) string {
+    qs := u.Query()
+    qs.Set("page", strconv.Itoa(page))
+
+    return app.externalURL(u.Path, qs)
+}
+
+// externalURL returns the URL clients use to reach path with the query, made absolute with the
+// -external-url base if it is set, e.g. https://example.com/api/greenlight/v1/movies/1.
+// Otherwise it returns the path, under the -url-prefix, and query only.
+func (app *application) externalURL(path string, query url.Values) string {
+    target := &url.URL{Path: app.config.urlPrefix + path}
+    if base := app.config.externalURL; base != nil {
+        target = base.JoinPath(path)
+    }
+
+    target.RawQuery = query.Encode()
+    return target.String()
+}
+
+// frontendLink returns the link of an email to the page at path of the web frontend, with the
+// token in the query, e.g. https://app.example.com/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU.
+// Without a FRONTEND_BASE_URL it returns "", and the emails explain the API request to make
+// with the token instead.
+func (app *application) frontendLink(path, token string) string {
+    base := app.config.frontendURL.Load()
+    if base == nil {
+        return ""
+    }
+
+    target := base.JoinPath(path)
+    target.RawQuery = url.Values{"token": {token}}.Encode()
+    return target.String()
+}
+
+// welcomeEmail is the welcome email of user, with the activation token and a link to the
+// activation page of the web frontend.
+func (app *application) welcomeEmail(user *data.User) *data.TokenEmail {
+    return &data.TokenEmail{
+        Template: "user_welcome.html",
+        Data: func(token *data.Token) map[string]any {
+            return map[string]any{
+                "activationToken": token.Plaintext,
+                "activationURL":   app.frontendLink("/activate", token.Plaintext),
+                "userID":          user.ID,
+            }
+        },
+    }
+}
+
+// activationReminderEmail is the activation reminder email of user, who hasn't activated their
+// account, with a new activation token. deleteAfter is how long after registering the unactivated
+// users are deleted, mentioned in the email unless 0.
+func (app *application) activationReminderEmail(user *data.User, deleteAfter time.Duration) *data.TokenEmail {
+    return &data.TokenEmail{
+        Template: "activation_reminder.html",
+        Data: func(token *data.Token) map[string]any {
+            d := map[string]any{
+                "activationToken": token.Plaintext,
+                "activationURL":   app.frontendLink("/activate", token.Plaintext),
+                "userID":          user.ID,
+            }
+            if days := int(deleteAfter / (24 * time.Hour)); days > 0 {
+                d["deleteAfterDays"] = days
+            }
+            return d
+        },
+    }
+}
+
+// passwordResetEmail is the password reset email of user, with the password reset token and a
+// link to the password reset page of the web frontend.
+func (app *application) passwordResetEmail(user *data.User) *data.TokenEmail {
+    return &data.TokenEmail{
+        Template: "password_reset.html",
+        Data: func(token *data.Token) map[string]any {
+            return map[string]any{
+                "passwordResetToken": token.Plaintext,
+                "passwordResetURL":   app.frontendLink("/reset-password", token.Plaintext),
+                "userID":             user.ID,
+            }
+        },
+    }
+}
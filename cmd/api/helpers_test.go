@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/validator"
+)
+
+func TestReadJSON(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.maxBodyBytes = 64
+
+    type input struct {
+        Title string `json:"title"`
+        Year  int32  `json:"year"`
+    }
+
+    tests := []struct {
+        name    string
+        body    string
+        limit   int64 // per-route override; zero uses the application default
+        wantErr string
+    }{
+        {"valid", `{"title": "Moana", "year": 2016}`, 0, ""},
+        {"empty body", ``, 0, "body must not be empty"},
+        {"syntax error", `{"title": "Moana",, "year": 2016}`, 0, "body contains invalid JSON (at character 19)"},
+        {"unexpected EOF", `{"title": "Moana"`, 0, "body contains invalid JSON"},
+        {"wrong field type", `{"title": "Moana", "year": "2016"}`, 0, "body contains incorrect JSON type for field year"},
+        {"wrong value type", `["Moana"]`, 0, "body contains incorrect JSON type (at character 1)"},
+        {"unknown field", `{"title": "Moana", "rating": 5}`, 0, "body contains unknown key rating"},
+        {"too large", `{"title": "` + strings.Repeat("a", 100) + `"}`, 0, "body must not be larger than 64 bytes"},
+        {"route override", `{"title": "` + strings.Repeat("a", 100) + `"}`, 1024, ""},
+        {"route override too large", `{"title": "` + strings.Repeat("a", 100) + `"}`, 32, "body must not be larger than 32 bytes"},
+        {"multiple values", `{"title": "Moana"}{"title": "Up"}`, 0, "body must only contain a single JSON value"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+            if tt.limit != 0 {
+                r = app.contextSetMaxBodyBytes(r, tt.limit)
+            }
+
+            var dst input
+            err := app.readJSON(httptest.NewRecorder(), r, &dst)
+
+            switch {
+            case tt.wantErr == "" && err != nil:
+                t.Fatalf("unexpected error: %v", err)
+            case tt.wantErr != "" && err == nil:
+                t.Fatalf("expected error %q; got nil", tt.wantErr)
+            case tt.wantErr != "" && err.Error() != tt.wantErr:
+                t.Fatalf("got error %q; want %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestReadIntRange(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        query   string
+        want    int
+        wantErr string
+    }{
+        {"", 10, ""},
+        {"limit=1", 1, ""},
+        {"limit=50", 50, ""},
+        {"limit=0", 0, "must be between 1 and 50"},
+        {"limit=51", 51, "must be between 1 and 50"},
+        {"limit=-3", -3, "must be between 1 and 50"},
+        {"limit=ten", 10, "must be an integer value"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.query, func(t *testing.T) {
+            qs, _ := url.ParseQuery(tt.query)
+            v := validator.New()
+
+            if got := app.readIntRange(qs, "limit", 10, 1, 50, v); got != tt.want {
+                t.Errorf("got %d; want %d", got, tt.want)
+            }
+            if got := v.Errors["limit"]; tt.wantErr == "" && len(got) != 0 || tt.wantErr != "" && !slices.Equal(got, []string{tt.wantErr}) {
+                t.Errorf("got errors %q; want %q", got, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestReadCSVUnique(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        query   string
+        want    []string
+        wantErr bool
+    }{
+        {"", []string{}, false},
+        {"genres=drama", []string{"drama"}, false},
+        {"genres=drama,comedy", []string{"drama", "comedy"}, false},
+        {"genres=drama,comedy,drama", []string{"drama", "comedy", "drama"}, true},
+        {"genres=drama,Drama", []string{"drama", "Drama"}, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.query, func(t *testing.T) {
+            qs, _ := url.ParseQuery(tt.query)
+            v := validator.New()
+
+            if got := app.readCSVUnique(qs, "genres", []string{}, v); !slices.Equal(got, tt.want) {
+                t.Errorf("got %q; want %q", got, tt.want)
+            }
+            if _, got := v.Errors["genres"]; got != tt.wantErr {
+                t.Errorf("got error %v; want %v", v.Errors, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestReadBool(t *testing.T) {
+    app := newTestApplication(t)
+
+    yes, no := true, false
+
+    tests := []struct {
+        query   string
+        want    *bool
+        wantErr bool
+    }{
+        {"", nil, false},
+        {"include_deleted=", nil, false},
+        {"include_deleted=true", &yes, false},
+        {"include_deleted=1", &yes, false},
+        {"include_deleted=false", &no, false},
+        {"include_deleted=F", &no, false},
+        {"include_deleted=maybe", nil, true},
+        {"include_deleted=yes", nil, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.query, func(t *testing.T) {
+            qs, _ := url.ParseQuery(tt.query)
+            v := validator.New()
+
+            got := app.readBool(qs, "include_deleted", v)
+            if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+                t.Errorf("got %v; want %v", got, tt.want)
+            }
+            if _, got := v.Errors["include_deleted"]; got != tt.wantErr {
+                t.Errorf("got error %v; want %v", v.Errors, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestReadDate(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        query   string
+        want    time.Time // zero for nil
+        wantErr bool
+    }{
+        {"", time.Time{}, false},
+        {"created_after=2024-01-01", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), false},
+        {"created_after=2024-01-01T12:30:00Z", time.Date(2024, 1, 1, 12, 30, 0, 0, time.UTC), false},
+        {"created_after=2024-01-01T12:30:00%2B02:00", time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC), false},
+        {"created_after=2024-13-01", time.Time{}, true},
+        {"created_after=01/02/2024", time.Time{}, true},
+        {"created_after=2024-01-01 12:30:00", time.Time{}, true},
+        {"created_after=yesterday", time.Time{}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.query, func(t *testing.T) {
+            qs, _ := url.ParseQuery(tt.query)
+            v := validator.New()
+
+            got := app.readDate(qs, "created_after", v)
+            if (got == nil) != tt.want.IsZero() || got != nil && !got.Equal(tt.want) {
+                t.Errorf("got %v; want %v", got, tt.want)
+            }
+            if got != nil && got.Location() != time.UTC {
+                t.Errorf("got %v; want it in UTC", got)
+            }
+            if _, got := v.Errors["created_after"]; got != tt.wantErr {
+                t.Errorf("got error %v; want %v", v.Errors, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestAcceptsGzip(t *testing.T) {
+    tests := []struct {
+        header string
+        want   bool
+    }{
+        {"", false},
+        {"gzip", true},
+        {"deflate, GZIP;q=0.5", true},
+        {"br", false},
+        {"*", true},
+        {"gzip;q=0", false},
+        {"gzip; q=0, *", false},
+        {"identity;q=1, *;q=0", false},
+    }
+
+    for _, tt := range tests {
+        r := httptest.NewRequest(http.MethodGet, "/", nil)
+        if tt.header != "" {
+            r.Header.Set("Accept-Encoding", tt.header)
+        }
+
+        if got := acceptsGzip(r); got != tt.want {
+            t.Errorf("Accept-Encoding %q: got %t; want %t", tt.header, got, tt.want)
+        }
+    }
+}
+
+func TestPaginationLinks(t *testing.T) {
+    app := newTestApplication(t)
+
+    tests := []struct {
+        name     string
+        target   string
+        metadata data.Metadata
+        want     string
+    }{
+        {
+            name:     "empty list",
+            target:   "/v1/movies",
+            metadata: data.Metadata{},
+            want:     "",
+        },
+        {
+            name:     "single page",
+            target:   "/v1/movies",
+            metadata: data.Metadata{CurrentPage: 1, PageSize: 20, FirstPage: 1, LastPage: 1, TotalRecords: 3},
+            want:     `</v1/movies?page=1>; rel="first", </v1/movies?page=1>; rel="last"`,
+        },
+        {
+            name:     "first page",
+            target:   "/v1/movies?page_size=2",
+            metadata: data.Metadata{CurrentPage: 1, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5},
+            want:     `</v1/movies?page=1&page_size=2>; rel="first", </v1/movies?page=2&page_size=2>; rel="next", </v1/movies?page=3&page_size=2>; rel="last"`,
+        },
+        {
+            name:     "middle page keeps the other parameters",
+            target:   "/v1/movies?title=the+club&genres=drama,comedy&sort=-year&page=2&page_size=2",
+            metadata: data.Metadata{CurrentPage: 2, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5},
+            want: `</v1/movies?genres=drama%2Ccomedy&page=1&page_size=2&sort=-year&title=the+club>; rel="first", ` +
+                `</v1/movies?genres=drama%2Ccomedy&page=1&page_size=2&sort=-year&title=the+club>; rel="prev", ` +
+                `</v1/movies?genres=drama%2Ccomedy&page=3&page_size=2&sort=-year&title=the+club>; rel="next", ` +
+                `</v1/movies?genres=drama%2Ccomedy&page=3&page_size=2&sort=-year&title=the+club>; rel="last"`,
+        },
+        {
+            name:     "last page",
+            target:   "/v1/movies?page=3&page_size=2",
+            metadata: data.Metadata{CurrentPage: 3, PageSize: 2, FirstPage: 1, LastPage: 3, TotalRecords: 5},
+            want:     `</v1/movies?page=1&page_size=2>; rel="first", </v1/movies?page=2&page_size=2>; rel="prev", </v1/movies?page=3&page_size=2>; rel="last"`,
+        },
+        {
+            name:     "without total, more pages",
+            target:   "/v1/movies?include_total=false&page=2&page_size=2",
+            metadata: data.MetadataWithoutTotal(2, 2, true),
+            want: `</v1/movies?include_total=false&page=1&page_size=2>; rel="first", </v1/movies?include_total=false&page=1&page_size=2>; rel="prev", ` +
+                `</v1/movies?include_total=false&page=3&page_size=2>; rel="next"`,
+        },
+        {
+            name:     "without total, no more pages",
+            target:   "/v1/movies?include_total=false",
+            metadata: data.MetadataWithoutTotal(1, 20, false),
+            want:     `</v1/movies?include_total=false&page=1>; rel="first"`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            u, err := url.Parse(tt.target)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if got := app.paginationLinks(u, tt.metadata); got != tt.want {
+                t.Errorf("got %s\nwant %s", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestListMoviesLinkHeader(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodGet, "/v1/movies?page=2&page_size=1&sort=title", authToken(t, app, mock.ActivatedUserID), nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    want := `</v1/movies?page=1&page_size=1&sort=title>; rel="first", </v1/movies?page=1&page_size=1&sort=title>; rel="prev", ` +
+        `</v1/movies?page=3&page_size=1&sort=title>; rel="next", </v1/movies?page=3&page_size=1&sort=title>; rel="last"`
+    if got := rr.Header().Get("Link"); got != want {
+        t.Errorf("got Link %s\nwant %s", got, want)
+    }
+}
+
+func TestListMoviesWithoutTotal(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    tests := []struct {
+        target      string
+        wantMovies  int
+        wantHasMore bool
+    }{
+        {"/v1/movies?include_total=false&page_size=2", 2, true},
+        {"/v1/movies?include_total=false&page=2&page_size=2", 1, false},
+        {"/v1/movies?include_total=false&page=3&page_size=2", 0, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.target, func(t *testing.T) {
+            rr := do(t, h, http.MethodGet, tt.target, token, nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            var resp struct {
+                Movies   []data.Movie   `json:"movies"`
+                Metadata map[string]any `json:"metadata"`
+            }
+            decode(t, rr, &resp)
+
+            if len(resp.Movies) != tt.wantMovies {
+                t.Errorf("got %d movies; want %d", len(resp.Movies), tt.wantMovies)
+            }
+            if _, ok := resp.Metadata["total_records"]; ok {
+                t.Errorf("got total_records in metadata %v", resp.Metadata)
+            }
+            if got := resp.Metadata["has_more"]; got != tt.wantHasMore {
+                t.Errorf("got has_more %v; want %v", got, tt.wantHasMore)
+            }
+        })
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/movies?include_total=maybe", token, nil)
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("invalid include_total: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+}
+
+func TestExternalURL(t *testing.T) {
+    app := newTestApplication(t)
+
+    query := url.Values{"page": {"2"}}
+
+    if got, want := app.externalURL("/v1/movies", query), "/v1/movies?page=2"; got != want {
+        t.Errorf("without base: got %s; want %s", got, want)
+    }
+
+    base, err := url.Parse("https://example.com/api/greenlight")
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.config.externalURL = base
+
+    if got, want := app.externalURL("/v1/movies", query), "https://example.com/api/greenlight/v1/movies?page=2"; got != want {
+        t.Errorf("with base: got %s; want %s", got, want)
+    }
+    if got, want := app.externalURL("/v1/movies/4", nil), "https://example.com/api/greenlight/v1/movies/4"; got != want {
+        t.Errorf("without query: got %s; want %s", got, want)
+    }
+}
+
+func TestListMoviesMetadataLinks(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    base, err := url.Parse("https://example.com/api")
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.config.externalURL = base
+
+    rr := do(t, h, http.MethodGet, "/v1/movies?page=2&page_size=1&sort=title", token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        Metadata data.Metadata `json:"metadata"`
+    }
+    decode(t, rr, &resp)
+
+    want := data.PageLinks{
+        Self: "https://example.com/api/v1/movies?page=2&page_size=1&sort=title",
+        Next: "https://example.com/api/v1/movies?page=3&page_size=1&sort=title",
+        Prev: "https://example.com/api/v1/movies?page=1&page_size=1&sort=title",
+    }
+    if resp.Metadata.Links == nil || *resp.Metadata.Links != want {
+        t.Errorf("got links %+v; want %+v", resp.Metadata.Links, want)
+    }
+
+    // The Location header of a new movie uses the same base.
+    rr = do(t, h, http.MethodPost, "/v1/movies", token, map[string]any{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation"}})
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("create: got status %d; body: %s", rr.Code, rr.Body)
+    }
+    if got, want := rr.Header().Get("Location"), "https://example.com/api/v1/movies/4"; got != want {
+        t.Errorf("got Location %s; want %s", got, want)
+    }
+}
+
+func TestBackground(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.tasks.warnAfter = 10 * time.Millisecond
+
+    var logs safeBuffer
+    app.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+    count := func(m *expvar.Map, name string) int64 {
+        if v, ok := m.Get(name).(*expvar.Int); ok {
+            return v.Value()
+        }
+        return 0
+    }
+
+    started := count(totalBackgroundTasksStarted, "test_task")
+    completed := count(totalBackgroundTasksCompleted, "test_task")
+    panicked := count(totalBackgroundTasksPanicked, "test_panicking_task")
+
+    app.background("test_task", func() { time.Sleep(50 * time.Millisecond) })
+    app.background("test_panicking_task", func() { panic("boom") })
+    app.wg.Wait()
+
+    if got := count(totalBackgroundTasksStarted, "test_task") - started; got != 1 {
+        t.Errorf("got %d started; want 1", got)
+    }
+    if got := count(totalBackgroundTasksCompleted, "test_task") - completed; got != 1 {
+        t.Errorf("got %d completed; want 1", got)
+    }
+    if got := count(totalBackgroundTasksPanicked, "test_panicking_task") - panicked; got != 1 {
+        t.Errorf("got %d panicked; want 1", got)
+    }
+
+    out := logs.String()
+    for _, want := range []string{
+        `"msg":"panic: boom","task":"test_panicking_task","stack":"goroutine`,
+        `"msg":"slow background task","task":"test_task"`,
+    } {
+        if !strings.Contains(out, want) {
+            t.Errorf("got logs %s\nwant them to contain %s", out, want)
+        }
+    }
+    if strings.Contains(out, `"slow background task","task":"test_panicking_task"`) {
+        t.Errorf("got logs %s\nwant no warning for the task which ended at once", out)
+    }
+}
+
+// safeBuffer is a bytes.Buffer which can be written by several goroutines, such as the timer of
+// a slow background task.
+type safeBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// idempotent makes a handler safe to retry with an Idempotency-Key header. The first request
+// with a key is processed and its response stored for data.IdempotencyTTL; a repeated request
+// with the same key and body gets the stored response replayed, with an Idempotent-Replayed
+// header, instead of being processed again. Keys are scoped to the user, so next must be behind
+// requireAuthenticatedUser or requirePermission. Requests without the header are passed through.
+func (app *application) idempotent(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        key := r.Header.Get("Idempotency-Key")
+        if key == "" {
+            next(w, r)
+            return
+        }
+
+        if !data.ValidIdempotencyKey(key) {
+            app.badRequestResponse(w, r, errors.New("the Idempotency-Key header must be 1 to 255 printable ASCII characters"))
+            return
+        }
+
+        user := app.contextGetUser(r)
+
+        // Read the body to hash it, then give the handler a copy.
+        limit := app.contextGetMaxBodyBytes(r)
+
+        body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, limit))
+        if err != nil {
+            var maxBytesError *http.MaxBytesError
+            switch {
+            case errors.As(err, &maxBytesError):
+                app.contentTooLargeResponse(w, r, limit)
+            default:
+                app.badRequestResponse(w, r, err)
+            }
+            return
+        }
+        r.Body = io.NopCloser(bytes.NewReader(body))
+
+        hash := sha256.New()
+        hash.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+        hash.Write(body)
+
+        req := &data.IdempotentRequest{
+            UserID:      user.ID,
+            Key:         key,
+            RequestHash: hash.Sum(nil),
+            Expiry:      time.Now().Add(data.IdempotencyTTL),
+        }
+
+        err = app.models.Idempotency.Insert(r.Context(), req)
+        if err != nil {
+            switch {
+            case errors.Is(err, data.ErrDuplicateIdempotencyKey):
+                app.replayIdempotentRequest(w, r, req)
+            default:
+                app.serverErrorResponse(w, r, err)
+            }
+            return
+        }
+
+        // The key is stored even if the client goes away or the request times out, so the
+        // context of the request isn't used for the database from here on.
+        ctx := context.WithoutCancel(r.Context())
+
+        before := w.Header().Clone()
+        iw := &idempotencyWriter{ResponseWriter: w}
+
+        completed := false
+        defer func() {
+            // Release the key if the handler panicked, so that the request can be retried.
+            if !completed {
+                err := app.models.Idempotency.Delete(ctx, req.UserID, req.Key)
+                if err != nil {
+                    app.logError(r, err)
+                }
+            }
+        }()
+
+        next(iw, r)
+
+        // Server errors are worth retrying, so their responses aren't kept.
+        if iw.statusCode == 0 || iw.statusCode >= http.StatusInternalServerError {
+            return
+        }
+
+        req.StatusCode = iw.statusCode
+        req.Header = handlerHeader(before, w.Header())
+        req.Body = iw.body.Bytes()
+
+        err = app.models.Idempotency.Complete(ctx, req)
+        if err != nil {
+            app.logError(r, err)
+            return
+        }
+        completed = true
+    }
+}
+
+// replayIdempotentRequest sends the stored response of the request with the same key as req,
+// or an error if the stored request had another body or hasn't completed yet.
+func (app *application) replayIdempotentRequest(w http.ResponseWriter, r *http.Request, req *data.IdempotentRequest) {
+    stored, err := app.models.Idempotency.Get(r.Context(), req.UserID, req.Key)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            // The stored request was released or expired in the meantime.
+            app.idempotencyKeyInUseResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    if !bytes.Equal(stored.RequestHash, req.RequestHash) {
+        app.idempotencyKeyMismatchResponse(w, r)
+        return
+    }
+
+    if stored.StatusCode == 0 {
+        app.idempotencyKeyInUseResponse(w, r)
+        return
+    }
+
+    for key, values := range stored.Header {
+        w.Header()[key] = values
+    }
+    w.Header().Set("Idempotent-Replayed", "true")
+
+    w.WriteHeader(stored.StatusCode)
+    w.Write(stored.Body)
+}
+
+// handlerHeader returns the headers in after which aren't in before, i.e. the ones set by the
+// handler rather than by the middleware in front of it.
+func handlerHeader(before, after http.Header) http.Header {
+    header := make(http.Header)
+
+    for key, values := range after {
+        if !slices.Equal(before[key], values) {
+            header[key] = values
+        }
+    }
+
+    return header
+}
+
+// idempotencyWriter passes the response through to the wrapped http.ResponseWriter and keeps a
+// copy of the status code and body.
+type idempotencyWriter struct {
+    http.ResponseWriter
+    statusCode int
+    body       bytes.Buffer
+}
+
+func (iw *idempotencyWriter) WriteHeader(statusCode int) {
+    if iw.statusCode == 0 {
+        iw.statusCode = statusCode
+    }
+
+    iw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+    if iw.statusCode == 0 {
+        iw.statusCode = http.StatusOK
+    }
+
+    iw.body.Write(b)
+
+    return iw.ResponseWriter.Write(b)
+}
+
+// Unwrap returns the wrapped http.ResponseWriter.
+func (iw *idempotencyWriter) Unwrap() http.ResponseWriter {
+    return iw.ResponseWriter
+}
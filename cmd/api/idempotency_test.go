@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestIdempotentCreateMovie(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    post := func(key, body string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader(body))
+        req.Header.Set("Authorization", "Bearer "+token)
+        if key != "" {
+            req.Header.Set("Idempotency-Key", key)
+        }
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        return rr
+    }
+
+    up := `{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": ["animation"]}`
+    coco := `{"title": "Coco", "year": 2017, "runtime": "105 mins", "genres": ["animation"]}`
+
+    first := post("import-1", up)
+    if first.Code != http.StatusCreated {
+        t.Fatalf("first: got status %d; body: %s", first.Code, first.Body)
+    }
+    if first.Header().Get("Idempotent-Replayed") != "" {
+        t.Error("first: got Idempotent-Replayed header")
+    }
+
+    // A retry gets the same response without creating another movie.
+    retry := post("import-1", up)
+    if retry.Code != http.StatusCreated {
+        t.Fatalf("retry: got status %d; body: %s", retry.Code, retry.Body)
+    }
+    if retry.Header().Get("Idempotent-Replayed") != "true" {
+        t.Error("retry: got no Idempotent-Replayed header")
+    }
+    if got, want := retry.Header().Get("Location"), first.Header().Get("Location"); got != want {
+        t.Errorf("retry: got Location %q; want %q", got, want)
+    }
+    if got, want := retry.Header().Get("Content-Type"), first.Header().Get("Content-Type"); got != want {
+        t.Errorf("retry: got Content-Type %q; want %q", got, want)
+    }
+    if !bytes.Equal(retry.Body.Bytes(), first.Body.Bytes()) {
+        t.Errorf("retry: got body %s; want %s", retry.Body, first.Body)
+    }
+
+    // The same key with another body is rejected.
+    rr := post("import-1", coco)
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("other body: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    rr = post("import-2", coco)
+    if rr.Code != http.StatusCreated || rr.Header().Get("Idempotent-Replayed") != "" {
+        t.Errorf("new key: got status %d and replayed %q; want a new movie", rr.Code, rr.Header().Get("Idempotent-Replayed"))
+    }
+
+    rr = post(strings.Repeat("k", 256), up)
+    if rr.Code != http.StatusBadRequest {
+        t.Errorf("long key: got status %d; want %d", rr.Code, http.StatusBadRequest)
+    }
+
+    // Fixtures have three movies, so two were created.
+    _, metadata, err := app.models.Movie.GetAll(context.Background(), data.MovieListParams{}, data.Filter{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if metadata.TotalRecords != 5 {
+        t.Errorf("got %d movies; want 5", metadata.TotalRecords)
+    }
+}
+
+func TestIdempotentInProgressAndServerError(t *testing.T) {
+    app := newTestApplication(t)
+
+    user, err := app.models.User.GetByEmail(context.Background(), mock.ActivatedUserEmail)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    status := http.StatusInternalServerError
+    started := make(chan struct{})
+    release := make(chan struct{})
+    calls := 0
+
+    h := app.idempotent(func(w http.ResponseWriter, r *http.Request) {
+        calls++
+        if calls == 1 {
+            close(started)
+            <-release
+        }
+        w.WriteHeader(status)
+    })
+
+    send := func() *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodPost, "/v1/movies", strings.NewReader("{}"))
+        req.Header.Set("Idempotency-Key", "k")
+        req = app.contextSetUser(req, user)
+        rr := httptest.NewRecorder()
+        h(rr, req)
+        return rr
+    }
+
+    done := make(chan *httptest.ResponseRecorder)
+    go func() { done <- send() }()
+    <-started
+
+    // A request with the key while the first one is being processed is rejected.
+    rr := send()
+    if rr.Code != http.StatusConflict {
+        t.Errorf("in progress: got status %d; want %d", rr.Code, http.StatusConflict)
+    }
+
+    close(release)
+    if rr := <-done; rr.Code != http.StatusInternalServerError {
+        t.Fatalf("first: got status %d; want %d", rr.Code, http.StatusInternalServerError)
+    }
+
+    // The server error wasn't stored, so a retry is processed.
+    status = http.StatusCreated
+
+    rr = send()
+    if rr.Code != http.StatusCreated || calls != 2 {
+        t.Errorf("retry: got status %d after %d calls; want %d after 2", rr.Code, calls, http.StatusCreated)
+    }
+}
+
+func TestPurgeExpiredIdempotencyKeys(t *testing.T) {
+    app := newTestApplication(t)
+    app.dbReady.Store(true)
+    ctx := context.Background()
+
+    for i, expiry := range []time.Time{time.Now().Add(-time.Minute), time.Now().Add(time.Hour)} {
+        err := app.models.Idempotency.Insert(ctx, &data.IdempotentRequest{
+            UserID: mock.ActivatedUserID, Key: string(rune('a' + i)), Expiry: expiry,
+        })
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    stop := make(chan struct{})
+    done := make(chan struct{})
+
+    go func() {
+        app.purgeIdempotencyKeys(stop, 10*time.Millisecond)
+        close(done)
+    }()
+
+    time.Sleep(50 * time.Millisecond)
+    close(stop)
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("purgeIdempotencyKeys didn't return after stop was closed")
+    }
+
+    n, err := app.models.Idempotency.DeleteExpired(ctx)
+    if err != nil || n != 0 {
+        t.Errorf("got %d expired keys left (%v); want 0", n, err)
+    }
+
+    _, err = app.models.Idempotency.Get(ctx, mock.ActivatedUserID, "b")
+    if err != nil {
+        t.Errorf("unexpired key: %v", err)
+    }
+}
@@ -0,0 +1,111 @@
+//go:build integration
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/testdb"
+)
+
+func TestMain(m *testing.M) {
+    os.Exit(testdb.Main(m))
+}
+
+// newIntegrationApplication returns a test application whose models use a database of its own,
+// see the testdb package.
+func newIntegrationApplication(t *testing.T) *application {
+    t.Helper()
+
+    app := newTestApplication(t)
+    app.models, _ = testdb.Models(t)
+
+    return app
+}
+
+func TestIntegrationUserFlow(t *testing.T) {
+    app := newIntegrationApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodPost, "/v1/users", "", map[string]any{
+        "name": "Dave", "email": "dave@example.com", "password": "correct horse battery",
+    })
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("registering: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/users", "", map[string]any{
+        "name": "Dave", "email": "Dave@Example.com", "password": "correct horse battery",
+    })
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("registering again: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    app.wg.Wait()
+
+    sender := app.emailSender.(*stubSender)
+    if len(sender.sent) != 1 {
+        t.Fatalf("got %d emails; want the welcome email", len(sender.sent))
+    }
+    activation := sender.sent[0].data.(map[string]any)["activationToken"].(string)
+
+    rr = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": activation})
+    if rr.Code != http.StatusOK {
+        t.Fatalf("activating: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    login := func(email, password string) string {
+        t.Helper()
+
+        rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": email, "password": password})
+        if rr.Code != http.StatusCreated {
+            t.Fatalf("logging in as %s: got status %d; body: %s", email, rr.Code, rr.Body)
+        }
+
+        var body struct {
+            Token struct {
+                Plaintext string `json:"token"`
+            } `json:"authentication_token"`
+        }
+        decode(t, rr, &body)
+
+        return body.Token.Plaintext
+    }
+
+    dave := login("dave@example.com", "correct horse battery")
+    alice := login(mock.ActivatedUserEmail, mock.FixturePassword)
+
+    // Registered users can read movies but not write them.
+    rr = do(t, h, http.MethodPost, "/v1/movies", dave, map[string]any{
+        "title": "Inception", "year": 2010, "runtime": "148 mins", "genres": []string{"sci-fi"},
+    })
+    if rr.Code != http.StatusForbidden {
+        t.Fatalf("creating a movie as Dave: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies", alice, map[string]any{
+        "title": "Inception", "year": 2010, "runtime": "148 mins", "genres": []string{"sci-fi"},
+    })
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("creating a movie as Alice: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/movies?title=inception", dave, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("listing movies: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var list struct {
+        Movies []struct {
+            Title string `json:"title"`
+        } `json:"movies"`
+    }
+    decode(t, rr, &list)
+
+    if len(list.Movies) != 1 || list.Movies[0].Title != "Inception" {
+        t.Errorf("got movies %+v; want Inception", list.Movies)
+    }
+}
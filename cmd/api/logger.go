@@ -0,0 +1,22 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+)
+
+// logFormats are the valid values of -log-format.
+var logFormats = []string{"text", "json"}
+
+// newLogger returns a logger writing to w in format, json or else text, which logs the records at
+// level or above. The level is read for every record, so changing a slog.LevelVar passed as
+// level, e.g. when LOG_LEVEL is reloaded, takes effect at once.
+func newLogger(w io.Writer, format string, level slog.Leveler) *slog.Logger {
+    opts := &slog.HandlerOptions{Level: level}
+
+    if format == "json" {
+        return slog.New(slog.NewJSONHandler(w, opts))
+    }
+
+    return slog.New(slog.NewTextHandler(w, opts))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/config"
+)
+
+func TestNewLoggerLevelChange(t *testing.T) {
+    var buf bytes.Buffer
+
+    level := new(slog.LevelVar)
+    logger := newLogger(&buf, "json", level)
+
+    logger.Debug("hidden")
+    if buf.Len() != 0 {
+        t.Fatalf("got %q logged at info level; want nothing", buf.String())
+    }
+
+    // As when dynamic.env is reloaded with LOG_LEVEL=debug.
+    level.Set((&config.Config{LogLevel: "debug"}).LogLevelOr(slog.LevelInfo))
+
+    logger.Debug("shown", "id", 1)
+
+    var record struct {
+        Level string `json:"level"`
+        Msg   string `json:"msg"`
+        ID    int    `json:"id"`
+    }
+    err := json.Unmarshal(buf.Bytes(), &record)
+    if err != nil {
+        t.Fatalf("decoding %q: %v", buf.String(), err)
+    }
+    if record.Level != "DEBUG" || record.Msg != "shown" || record.ID != 1 {
+        t.Errorf("got record %+v; want the debug record", record)
+    }
+
+    // Without LOG_LEVEL, the level of -log-level applies again.
+    buf.Reset()
+    level.Set((&config.Config{}).LogLevelOr(slog.LevelWarn))
+
+    logger.Info("hidden")
+    if buf.Len() != 0 {
+        t.Errorf("got %q logged at warn level; want nothing", buf.String())
+    }
+}
+
+func TestNewLoggerTextFormat(t *testing.T) {
+    var buf bytes.Buffer
+
+    newLogger(&buf, "text", slog.LevelInfo).Info("started", "addr", ":4000")
+
+    if got := buf.String(); !strings.Contains(got, `level=INFO msg=started addr=:4000`) {
+        t.Errorf("got %q; want a text record", got)
+    }
+}
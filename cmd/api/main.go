@@ -1,21 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/fsnotify/fsnotify"
-	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+	"greenlight.zzh.net/internal/breach"
 	"greenlight.zzh.net/internal/config"
 	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/i18n"
 	"greenlight.zzh.net/internal/mail"
+	"greenlight.zzh.net/internal/task"
 	"greenlight.zzh.net/internal/vcs"
 )
 
@@ -23,20 +32,88 @@ var version = vcs.Version()
 
 type appConfig struct {
     // Fields read from command line
-    serverAddress string
-    env           string
-    cors          struct {
-        trustedOrigins []string
+    serverAddress  string
+    externalURL    *url.URL // base of the absolute URLs in responses; nil for relative ones
+    urlPrefix      string   // path prefix all routes are served under, e.g. /api/greenlight
+    env            string
+    maxBodyBytes   int64
+    maxListOffset  int      // list pages further than this many records get no rows; 0 is no limit
+    logErrorBodies bool     // log the requests getting a 4xx or 5xx response with their body, as in development
+    bcryptCost     int      // bcrypt cost of new password hashes; lower cost hashes are upgraded on login
+    cors           struct {
+        allowCredentials bool
+        maxAge           time.Duration
+    }
+    poster struct {
+        storage  string
+        dir      string
+        maxBytes int64
+    }
+    freeTextGenres   bool          // accept any movie genre instead of only the ones in the genre table
+    similarCacheTTL  time.Duration // how long the similar movies of a movie are cached; 0 disables the cache
+    statsRefresh     time.Duration // how often the movie_stats view is refreshed; 0 disables the refreshes
+    unactivatedJob   time.Duration // how often the unactivated users are reminded and deleted; 0 disables the job
+    cascadeDeletes   bool          // delete the records referring to a movie with it unless ?force=false
+    titleSimilarity  float64       // title similarity from which a new movie duplicates one of the same year; 0 disables the check
+    coalesceReads    bool          // share one query among concurrent reads of the same movie
+    movieCache       struct {
+        enabled bool
+        size    int
+        ttl     time.Duration
+    }
+    passwords        struct {
+        rejectCommon bool          // reject new passwords in the embedded list of common passwords
+        hibp         bool          // reject new passwords found in breaches by Have I Been Pwned
+        hibpTimeout  time.Duration
+    }
+    authTokens       struct {
+        ttl         time.Duration
+        sliding     bool          // extend the expiry of authentication tokens when they are used
+        maxLifetime time.Duration // sliding expiration never extends a token past this age
+        extendAfter time.Duration // smallest extension written, so that a token isn't written on every request
+    }
+    userDeletionMode string
+    userExportLimit  int           // exports of their data a user can start per hour; 0 is no limit
+    auditStore       string
+    email            struct {
+        delivery     string
+        pollInterval time.Duration
+    }
+    tasks            struct {
+        workers   int
+        queueSize int
+        warnAfter time.Duration // a goroutine started by background is logged as slow after this; 0 never
+    }
+    requestTimeout   struct {
+        standard time.Duration
+        long     time.Duration
+    }
+    db               struct {
+        connectTimeout      time.Duration
+        connectAsync        bool
+        primaryTokenLookups bool // look tokens up on the primary, not the read replica, which may lag behind logins
+        breakerThreshold    int           // consecutive connection failures opening the circuit breaker; 0 disables it
+        breakerCooldown     time.Duration // how long the circuit breaker stays open before probing the database
+    }
+    otel             struct {
+        endpoint    string  // OTLP/HTTP endpoint spans are exported to; empty disables tracing
+        sampleRatio float64 // fraction of the traces started here which are sampled
     }
 
-    // Fields loaded from dynamic.env
-    limiter *config.LimiterConfig
+    // Fields loaded from dynamic.env, replaced when the file is reloaded
+    limiter        *atomic.Pointer[config.LimiterConfig]
+    authLimiter    *atomic.Pointer[config.LimiterConfig]
+    apiKeys        *atomic.Pointer[config.APIKeyConfig]
+    permissions    *atomic.Pointer[config.PermissionConfig]
+    serverTiming   *atomic.Bool
+    trustedOrigins *atomic.Pointer[[]*regexp.Regexp] // compiled CORS_TRUSTED_ORIGINS
+    frontendURL    *atomic.Pointer[url.URL]          // parsed FRONTEND_BASE_URL; nil if not set
+    registration   *atomic.Pointer[config.RegistrationConfig]
+    unactivated    *atomic.Pointer[config.UnactivatedUsersConfig]
+    lists          *atomic.Pointer[config.ListConfig]
 
     // Fields loaded from dynamic_db_secret.env
-    dbConnString string
-
-    // Fields loaded from dynamic_smtp_secret.env
-    smtp *config.SMTPConfig
+    dbPool data.PoolConfig
 }
 
 // application struct holds the dependencies for our HTTP handlers, helpers, and middleware.
@@ -44,25 +121,144 @@ type application struct {
     config      appConfig
     logger      *slog.Logger
     models      data.Models
-    emailSender *mail.EmailSender
+    emailSender mail.Sender
+    catalog     *i18n.Catalog // translations of the error and validation messages
     wg          sync.WaitGroup
+    startTime   time.Time
+    tasks       *task.Runner
+    dbReady     atomic.Bool // false until the database connection pool has been created
+
+    similarMovies   *similarCache                              // nil when -similar-movies-cache-ttl is 0
+    movieCache      *movieCache                                // nil unless -movie-cache is set
+    movieReads      *movieReads                                // nil when -movie-read-coalescing is false
+    breachClient    *breach.Client                             // nil unless -hibp is set
+    tracer          trace.Tracer                               // nil unless -otel-endpoint is set
+    readinessChecks map[string]func(ctx context.Context) error // run by readyHandler, by name
+    configWatchers  []*config.Watcher                          // reloaded on SIGHUP
+
+    *shutdownHooks // stop the subsystems on shutdown, see OnShutdown
 }
 
 func main() {
+    startTime := time.Now()
+
     var cfg appConfig
 
     // Read static configuration from command line.
     flag.StringVar(&cfg.serverAddress, "server-address", ":4000", "The server address of this application.")
+    flag.Func("external-url", "Base URL clients reach the API at, e.g. https://example.com/api/greenlight, for absolute URLs in responses", func(s string) error {
+        u, err := url.Parse(s)
+        if err != nil {
+            return err
+        }
+
+        if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+            return errors.New("must be an absolute http or https URL without a query")
+        }
+
+        u.Path = strings.TrimSuffix(u.Path, "/")
+        cfg.externalURL = u
+        return nil
+    })
+    flag.Func("url-prefix", "Path prefix all routes are served under, e.g. /api/greenlight", func(s string) error {
+        if !strings.HasPrefix(s, "/") || path.Clean(s) != s {
+            return errors.New("must be a clean path starting with /, e.g. /api/greenlight")
+        }
+
+        cfg.urlPrefix = strings.TrimSuffix(s, "/")
+        return nil
+    })
     flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-    flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
-        cfg.cors.trustedOrigins = strings.Fields(s)
+
+    logFormat, logLevel := "text", slog.LevelInfo
+    flag.Func("log-format", "Log format (text|json) (default text)", func(s string) error {
+        if !slices.Contains(logFormats, s) {
+            return errors.New("must be text or json")
+        }
+        logFormat = s
         return nil
     })
+    flag.Func("log-level", "Minimum level of logged records (debug|info|warn|error), overridden by LOG_LEVEL in dynamic.env (default info)", func(s string) error {
+        level, err := config.ParseLogLevel(s)
+        logLevel = level
+        return err
+    })
+
+    flag.Int64Var(&cfg.maxBodyBytes, "max-body-bytes", 1_048_576, "Default maximum size of a JSON request body in bytes")
+    flag.IntVar(&cfg.maxListOffset, "max-list-offset", 100_000, "Number of records after which movie list pages are empty instead of scanned, e.g. 100000 is page 5001 with page_size=20 (0 is no limit)")
+    flag.BoolVar(&cfg.logErrorBodies, "log-error-bodies", false, "Log the headers and body of the requests getting a 4xx or 5xx response, with credentials redacted (always on with -env=development)")
+    flag.IntVar(&cfg.bcryptCost, "bcrypt-cost", data.DefaultPasswordCost, "bcrypt cost of password hashes; hashes with a lower cost are upgraded when their user logs in")
+    flag.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow credentialed CORS requests from trusted origins")
+    flag.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache CORS preflight responses (0 to omit)")
+
+    flag.StringVar(&cfg.poster.storage, "poster-storage", "db", "Storage backend for movie posters (db|fs)")
+    flag.StringVar(&cfg.poster.dir, "poster-dir", "posters", "Directory for movie posters when -poster-storage=fs")
+    flag.Int64Var(&cfg.poster.maxBytes, "poster-max-bytes", 5*1_048_576, "Maximum size of a movie poster in bytes")
+
+    flag.BoolVar(&cfg.freeTextGenres, "free-text-genres", false, "Accept any movie genre instead of only the ones listed at /v1/genres")
+    flag.BoolVar(&cfg.cascadeDeletes, "movie-delete-cascade", true, "Delete the records referring to a movie together with it; without it a movie with such records gets 409 Conflict unless deleted with ?force=true")
+    flag.Float64Var(&cfg.titleSimilarity, "movie-duplicate-threshold", 0.6, "Trigram similarity of the titles, from 0 to 1, from which POST /v1/movies rejects a movie of the same year as an existing one unless sent with ?allow_duplicate=true (0 disables the check)")
+    flag.BoolVar(&cfg.coalesceReads, "movie-read-coalescing", true, "Share one database query among the concurrent requests for the same movie to GET /v1/movies/:id")
+    flag.BoolVar(&cfg.movieCache.enabled, "movie-cache", false, "Cache the responses of GET /v1/movies/:id in memory")
+    flag.IntVar(&cfg.movieCache.size, "movie-cache-size", 1000, "Maximum number of movies in the -movie-cache cache")
+    flag.DurationVar(&cfg.movieCache.ttl, "movie-cache-ttl", time.Minute, "How long a movie is kept in the -movie-cache cache, bounding how stale it is after a change made by another instance")
+    flag.DurationVar(&cfg.similarCacheTTL, "similar-movies-cache-ttl", 10*time.Minute, "How long the similar movies of a movie are cached (0 disables the cache)")
+    flag.DurationVar(&cfg.statsRefresh, "movie-stats-refresh-interval", 5*time.Minute, "How often the statistics of GET /v1/movies/stats are refreshed (0 refreshes them only on POST /v1/movies/stats/refresh)")
+
+    flag.DurationVar(&cfg.unactivatedJob, "unactivated-users-interval", time.Hour, "How often the users who haven't activated their account are sent a reminder after ACTIVATION_REMINDER_AFTER and deleted after UNACTIVATED_USER_TTL (0 disables both)")
+
+    flag.BoolVar(&cfg.passwords.rejectCommon, "reject-common-passwords", true, "Reject new passwords which are in the embedded list of common passwords")
+    flag.BoolVar(&cfg.passwords.hibp, "hibp", false, "Reject new passwords found in breaches by the Have I Been Pwned API, which is sent the first 5 hex digits of their SHA-1 hash only; passwords are accepted when it can't be reached")
+    flag.DurationVar(&cfg.passwords.hibpTimeout, "hibp-timeout", 2*time.Second, "Maximum time of a -hibp lookup")
+    flag.DurationVar(&cfg.authTokens.ttl, "auth-token-ttl", 24*time.Hour, "How long authentication tokens are valid after login, or after their last use with -auth-token-sliding")
+    flag.BoolVar(&cfg.authTokens.sliding, "auth-token-sliding", false, "Extend the expiry of an authentication token to -auth-token-ttl from now when it is used")
+    flag.DurationVar(&cfg.authTokens.maxLifetime, "auth-token-max-lifetime", 7*24*time.Hour, "Age after which an authentication token expires even with -auth-token-sliding")
+    flag.DurationVar(&cfg.authTokens.extendAfter, "auth-token-extend-after", 15*time.Minute, "Smallest extension of an authentication token with -auth-token-sliding; uses extending it less don't write to the database")
+    flag.StringVar(&cfg.otel.endpoint, "otel-endpoint", "", "OTLP/HTTP endpoint OpenTelemetry spans are exported to, e.g. http://localhost:4318 (empty disables tracing)")
+    flag.Float64Var(&cfg.otel.sampleRatio, "otel-sample-ratio", 1, "Fraction of the traces started by the application which are sampled; traces continued from a traceparent header follow the caller's decision")
+
+    flag.StringVar(&cfg.userDeletionMode, "user-deletion-mode", "anonymize", "How deleted user accounts are removed (anonymize|delete)")
+    flag.IntVar(&cfg.userExportLimit, "user-export-limit", 2, "Exports of their data with GET /v1/users/me/export a user can start per hour (0 is no limit)")
+
+    flag.StringVar(&cfg.auditStore, "audit-store", "log", "Where audit events are recorded: log (the application log only) or db (the log and the audit_log table)")
+
+    flag.StringVar(&cfg.email.delivery, "email-delivery", "outbox", "How welcome emails are sent: outbox (queued in the email_outbox table with the user) or direct (from a background task)")
+    flag.DurationVar(&cfg.email.pollInterval, "email-outbox-poll-interval", 5*time.Second, "How often the email outbox is checked for emails to send")
+    flag.IntVar(&cfg.tasks.workers, "task-workers", 8, "Number of workers running background tasks, such as sending emails")
+    flag.IntVar(&cfg.tasks.queueSize, "task-queue-size", 1000, "Number of background tasks which can wait for a worker before submitting blocks")
+    flag.DurationVar(&cfg.tasks.warnAfter, "background-task-warn-after", 30*time.Second, "Log a warning naming a background goroutine, such as recording a login, which is still running after this long (0 never warns)")
+
+    flag.DurationVar(&cfg.requestTimeout.standard, "request-timeout", 8*time.Second, "Maximum time to process a request (0 disables the limit)")
+    flag.DurationVar(&cfg.requestTimeout.long, "long-request-timeout", 2*time.Minute, "Maximum time to process a streaming, upload, import or export request")
+
+    flag.DurationVar(&cfg.db.connectTimeout, "db-connect-timeout", time.Minute, "How long to keep retrying to connect to the database at startup (0 for a single attempt)")
+    flag.BoolVar(&cfg.db.connectAsync, "db-connect-async", false, "Start serving before the database is reachable; requests needing it get 503 Service Unavailable until it is")
+    flag.IntVar(&cfg.db.breakerThreshold, "db-breaker-threshold", 5, "Consecutive database connection failures after which the queries fail fast with 503 Service Unavailable until a ping succeeds (0 disables the circuit breaker)")
+    flag.DurationVar(&cfg.db.breakerCooldown, "db-breaker-cooldown", 10*time.Second, "How long the queries fail fast before the database is pinged again by the -db-breaker-threshold circuit breaker")
+    flag.BoolVar(&cfg.db.primaryTokenLookups, "db-primary-token-lookups", true, "Look up the tokens of authenticated requests on the primary database rather than the read replica")
 
     var configPath string
     // Read the location of config files for dynamic configuration from command line.
     flag.StringVar(&configPath, "config-path", "config", "The directory that contains configuration files.")
 
+    var configReload string
+    flag.StringVar(&configReload, "config-reload", "watch", "How configuration files are reloaded: watch (on file change and SIGHUP) or sighup (on SIGHUP only)")
+
+    // Flags overriding dynamic configuration. Their values are read by config.LoadConfig, and
+    // they take precedence over the GREENLIGHT_* environment variables and the config files.
+    flag.Float64(config.FlagName("LIMITER_RPS"), 2, "Rate limiter maximum requests per second (overrides LIMITER_RPS)")
+    flag.Int(config.FlagName("LIMITER_BURST"), 4, "Rate limiter maximum burst (overrides LIMITER_BURST)")
+    flag.Bool(config.FlagName("LIMITER_ENABLED"), true, "Enable rate limiter (overrides LIMITER_ENABLED)")
+    flag.String(config.FlagName("CORS_TRUSTED_ORIGINS"), "", "Trusted CORS origins (space separated), e.g. https://*.example.com (overrides CORS_TRUSTED_ORIGINS)")
+    flag.String(config.FlagName("MAIL_TRANSPORT"), "smtp", "How emails are delivered: smtp, log or file (overrides MAIL_TRANSPORT)")
+
+    migrateCommand := flag.String("migrate", "", "Run database migrations (up|down|status) and exit")
+    autoMigrateOnStart := flag.Bool("auto-migrate", false, "Apply pending database migrations on start (not allowed with -env=production)")
+
+    seedData := flag.Bool("seed", false, "Insert development data (users and fake movies) and exit")
+    seedMovies := flag.Int("seed-movies", 50, "Number of fake movies inserted by -seed")
+    seedPassword := flag.String("seed-password", "pa55word", "Password of the users created by -seed")
+
     displayVersion := flag.Bool("version", false, "Display version and exit")
 
     // Parse command line parameters.
@@ -73,60 +269,267 @@ func main() {
         os.Exit(0)
     }
 
-    logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+    // The level is a LevelVar so that LOG_LEVEL can change it when dynamic.env is reloaded.
+    level := new(slog.LevelVar)
+    level.Set(logLevel)
 
-    var cfgDynamic config.Config
+    logger := newLogger(os.Stdout, logFormat, level)
 
-    // Load dynamic configuration.
-    viperDynamic := viper.New()
-    err := config.LoadConfig(viperDynamic, configPath, "env", "dynamic", &cfgDynamic)
-    if err != nil {
-        logger.Error(err.Error())
+    if configReload != "watch" && configReload != "sighup" {
+        logger.Error("invalid -config-reload value, must be watch or sighup", "value", configReload)
         os.Exit(1)
     }
 
-    // Load dynamic DB configuration.
-    viperDynamicDB := viper.New()
-    err = config.LoadConfig(viperDynamicDB, configPath, "env", "dynamic_db_secret", &cfgDynamic)
-    if err != nil {
-        logger.Error(err.Error())
+    if cfg.auditStore != "log" && cfg.auditStore != "db" {
+        logger.Error("invalid -audit-store value, must be log or db", "value", cfg.auditStore)
         os.Exit(1)
     }
 
-    // Load dynamic SMTP configuration.
-    viperDynamicSMTP := viper.New()
-    err = config.LoadConfig(viperDynamicSMTP, configPath, "env", "dynamic_smtp_secret", &cfgDynamic)
-    if err != nil {
-        logger.Error(err.Error())
+    if cfg.email.delivery != "outbox" && cfg.email.delivery != "direct" {
+        logger.Error("invalid -email-delivery value, must be outbox or direct", "value", cfg.email.delivery)
         os.Exit(1)
     }
 
-    cfg.limiter = &config.LimiterConfig{
-        Rps:     cfgDynamic.LimiterRps,
-        Burst:   cfgDynamic.LimiterBurst,
-        Enabled: cfgDynamic.LimiterEnabled,
+    if cfg.email.pollInterval <= 0 {
+        logger.Error("-email-outbox-poll-interval must be greater than 0")
+        os.Exit(1)
     }
-    cfg.dbConnString = fmt.Sprintf(
-        "postgres://%s:%s@%s:%d/%s?sslmode=%s&pool_max_conns=%d&pool_max_conn_idle_time=%s",
-        cfgDynamic.DBUsername, cfgDynamic.DBPassword, cfgDynamic.DBServer, cfgDynamic.DBPort, cfgDynamic.DBName,
-        cfgDynamic.DBSSLMode, cfgDynamic.DBPoolMaxConns, cfgDynamic.DBPoolMaxConnIdleTime,
-    )
-    cfg.smtp = &config.SMTPConfig{
-        Username:      cfgDynamic.SMTPUsername,
-        Password:      cfgDynamic.SMTPPassword,
-        AuthAddress:   cfgDynamic.SMTPAuthAddress,
-        ServerAddress: cfgDynamic.SMTPServerAddress,
+
+    if cfg.movieCache.enabled && (cfg.movieCache.size < 1 || cfg.movieCache.ttl <= 0) {
+        logger.Error("-movie-cache-size and -movie-cache-ttl must be greater than 0")
+        os.Exit(1)
     }
 
-    // Create a database connection pool wrapper.
-    var poolWrapper data.PoolWrapper
-    err = poolWrapper.CreatePool(cfg.dbConnString)
-    if err != nil {
-        logger.Error(err.Error())
+    if cfg.maxListOffset < 0 {
+        logger.Error("-max-list-offset must not be negative")
+        os.Exit(1)
+    }
+
+    if err := data.SetPasswordCost(cfg.bcryptCost); err != nil {
+        logger.Error("invalid -bcrypt-cost value", "value", cfg.bcryptCost, "error", err)
+        os.Exit(1)
+    }
+
+    if cfg.similarCacheTTL < 0 {
+        logger.Error("-similar-movies-cache-ttl must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.titleSimilarity < 0 || cfg.titleSimilarity > 1 {
+        logger.Error("-movie-duplicate-threshold must be between 0 and 1")
         os.Exit(1)
     }
-    defer poolWrapper.Pool.Close()
-    logger.Info("database connection pool established")
+
+    if cfg.statsRefresh < 0 {
+        logger.Error("-movie-stats-refresh-interval must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.unactivatedJob < 0 {
+        logger.Error("-unactivated-users-interval must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.passwords.hibp && cfg.passwords.hibpTimeout <= 0 {
+        logger.Error("-hibp-timeout must be greater than 0")
+        os.Exit(1)
+    }
+
+    if cfg.authTokens.ttl <= 0 {
+        logger.Error("-auth-token-ttl must be greater than 0")
+        os.Exit(1)
+    }
+
+    if cfg.authTokens.sliding && (cfg.authTokens.maxLifetime < cfg.authTokens.ttl || cfg.authTokens.extendAfter < 0) {
+        logger.Error("-auth-token-max-lifetime must be at least -auth-token-ttl and -auth-token-extend-after must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.userExportLimit < 0 {
+        logger.Error("-user-export-limit must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.otel.sampleRatio < 0 || cfg.otel.sampleRatio > 1 {
+        logger.Error("-otel-sample-ratio must be between 0 and 1")
+        os.Exit(1)
+    }
+
+    if cfg.db.connectTimeout < 0 {
+        logger.Error("-db-connect-timeout must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.db.breakerThreshold < 0 {
+        logger.Error("-db-breaker-threshold must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.db.breakerThreshold > 0 && cfg.db.breakerCooldown <= 0 {
+        logger.Error("-db-breaker-cooldown must be greater than 0")
+        os.Exit(1)
+    }
+
+    if cfg.tasks.workers < 1 || cfg.tasks.queueSize < 0 {
+        logger.Error("-task-workers must be at least 1 and -task-queue-size must not be negative")
+        os.Exit(1)
+    }
+
+    if cfg.tasks.warnAfter < 0 {
+        logger.Error("-background-task-warn-after must not be negative")
+        os.Exit(1)
+    }
+
+    // Load dynamic configuration. Each file has its own watcher, which validates a changed file
+    // and keeps the current configuration if the file is invalid. All the problems found in all
+    // the files are reported before exiting.
+    dynamicWatcher, dynamicErr := config.NewWatcher(configPath, "", "dynamic", flag.CommandLine, (*config.Config).ValidateDynamic, logger)
+    dbWatcher, dbErr := config.NewWatcher(configPath, "", "dynamic_db_secret", flag.CommandLine, (*config.Config).ValidateDB, logger)
+    smtpWatcher, smtpErr := config.NewWatcher(configPath, "", "dynamic_smtp_secret", flag.CommandLine, (*config.Config).ValidateSMTP, logger)
+
+    if dynamicErr != nil || dbErr != nil || smtpErr != nil {
+        for _, err := range []error{dynamicErr, dbErr, smtpErr} {
+            if err != nil {
+                config.LogError(logger, "invalid configuration", err)
+            }
+        }
+        os.Exit(1)
+    }
+
+    cfgDynamic := dynamicWatcher.Config()
+    cfgDB := dbWatcher.Config()
+
+    level.Set(cfgDynamic.LogLevelOr(logLevel))
+
+    cfg.limiter = new(atomic.Pointer[config.LimiterConfig])
+    cfg.limiter.Store(cfgDynamic.Limiter())
+    cfg.authLimiter = new(atomic.Pointer[config.LimiterConfig])
+    cfg.authLimiter.Store(cfgDynamic.AuthLimiter())
+    cfg.apiKeys = new(atomic.Pointer[config.APIKeyConfig])
+    cfg.apiKeys.Store(&config.APIKeyConfig{MaxPerUser: cfgDynamic.APIKeyMaxPerUser})
+    cfg.permissions = new(atomic.Pointer[config.PermissionConfig])
+    cfg.permissions.Store(&config.PermissionConfig{MovieWriteCanDelete: cfgDynamic.MovieWriteCanDelete})
+    cfg.serverTiming = new(atomic.Bool)
+    cfg.serverTiming.Store(cfgDynamic.ServerTimingEnabled)
+    cfg.trustedOrigins = new(atomic.Pointer[[]*regexp.Regexp])
+    trustedOrigins := cfgDynamic.TrustedOrigins()
+    cfg.trustedOrigins.Store(&trustedOrigins)
+    cfg.frontendURL = new(atomic.Pointer[url.URL])
+    cfg.frontendURL.Store(cfgDynamic.FrontendURL())
+    cfg.registration = new(atomic.Pointer[config.RegistrationConfig])
+    cfg.registration.Store(cfgDynamic.Registration())
+    cfg.unactivated = new(atomic.Pointer[config.UnactivatedUsersConfig])
+    cfg.unactivated.Store(cfgDynamic.UnactivatedUsers())
+    cfg.lists = new(atomic.Pointer[config.ListConfig])
+    cfg.lists.Store(cfgDynamic.Lists())
+    cfg.dbPool = cfgDB.DBPool()
+
+    // Create a database connection pool wrapper. The query tracer is kept on the wrapper so that
+    // it is attached to the new pool when the pool is recreated on DB config reload. The replica
+    // only gets a pool if DB_REPLICA_SERVER is set (see replicaMonitor).
+    queryTracer := data.NewQueryTracer(logger, cfgDB.DBSlowQueryThreshold)
+    poolWrapper := data.PoolWrapper{
+        Tracer:  queryTracer,
+        Replica: &data.PoolWrapper{Tracer: queryTracer},
+    }
+
+    // The subsystems are stopped by hooks on shutdown (see serve), the pool last as it was
+    // registered first.
+    shutdown := &shutdownHooks{}
+    shutdown.OnShutdown("database pool", func(ctx context.Context) error {
+        poolWrapper.Close()
+        return nil
+    })
+
+    // The circuit breaker of the primary makes the requests fail fast while the database is down,
+    // rather than piling up waiting for their timeouts. The reads fall back from the replica.
+    if cfg.db.breakerThreshold > 0 {
+        breaker := data.NewBreaker(cfg.db.breakerThreshold, cfg.db.breakerCooldown)
+        breaker.Probe = poolWrapper.CheckHealth
+        breaker.OnStateChange = func(from, to data.BreakerState, failures int) {
+            level := slog.LevelInfo
+            if to == data.BreakerOpen {
+                level = slog.LevelError
+            }
+            logger.Log(context.Background(), level, "database circuit breaker state changed", "from", from.String(), "to", to.String(), "failures", failures, "cooldown", cfg.db.breakerCooldown.String())
+        }
+        poolWrapper.Breaker = breaker
+    }
+
+    replicas := &replicaMonitor{replica: poolWrapper.Replica, logger: logger}
+
+    // With -otel-endpoint, requests, their database queries and the emails sent get spans. The
+    // spans still buffered are exported on exit.
+    var tracer trace.Tracer
+    if cfg.otel.endpoint != "" {
+        tracerProvider, err := newTracerProvider(context.Background(), cfg.otel.endpoint, cfg.otel.sampleRatio)
+        if err != nil {
+            logger.Error("failed to create the OpenTelemetry exporter", "error", err)
+            os.Exit(1)
+        }
+        shutdown.OnShutdown("tracer provider", tracerProvider.Shutdown)
+
+        tracer = tracerProvider.Tracer(tracerName)
+        poolWrapper.Tracer.EnableSpans(tracer)
+    }
+
+    // connectDB creates the pool, retrying with backoff until -db-connect-timeout has passed if
+    // the database isn't reachable yet, e.g. because it is starting alongside the application.
+    connectDB := func() error {
+        err := poolWrapper.CreatePoolWithRetry(context.Background(), cfg.dbPool, cfg.db.connectTimeout, func(attempt int, err error, wait time.Duration) {
+            logger.Warn("failed to connect to the database, retrying", "attempt", attempt, "retry_in", wait.String(), "error", err.Error())
+        })
+        if err != nil {
+            return err
+        }
+
+        logger.Info("database connection pool established")
+        return nil
+    }
+
+    // With -db-connect-async the pool is created in the background once the server has started,
+    // unless the database is needed first to migrate or seed.
+    connectLater := cfg.db.connectAsync && *migrateCommand == "" && !*seedData
+
+    var err error
+    if !connectLater {
+        err = connectDB()
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+    }
+
+    if *migrateCommand != "" {
+        err = runMigrateCommand(context.Background(), poolWrapper.Pool(), *migrateCommand, os.Stdout)
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+        return
+    }
+
+    if *autoMigrateOnStart && !connectLater {
+        err = autoMigrate(context.Background(), poolWrapper.Pool(), cfg.env, logger)
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+    }
+
+    // Query timeouts are shared by all models and updated when dynamic.env is reloaded.
+    queryTimeouts := data.NewQueryTimeouts(
+        cfgDynamic.DBTimeoutRead, cfgDynamic.DBTimeoutWrite, cfgDynamic.DBTimeoutList, cfgDynamic.DBTimeoutToken,
+    )
+
+    if *seedData {
+        err = seed(context.Background(), data.NewModels(&poolWrapper, queryTimeouts), *seedMovies, *seedPassword, os.Stdout)
+        if err != nil {
+            logger.Error(err.Error())
+            os.Exit(1)
+        }
+        return
+    }
 
     // Publish the version number.
     expvar.NewString("version").Set(version)
@@ -138,7 +541,7 @@ func main() {
 
     // Publish the database connection pool statistics.
     expvar.Publish("database", expvar.Func(func() any {
-        return poolWrapper
+        return &poolWrapper
     }))
 
     // Publish the current Unix timestamp.
@@ -146,87 +549,194 @@ func main() {
         return time.Now().Unix()
     }))
 
+    // Check the email templates now rather than when the first email is sent.
+    err = mail.ValidateTemplates()
+    if err != nil {
+        logger.Error("invalid email templates", "error", err)
+        os.Exit(1)
+    }
+
+    emailSender := mail.NewEmailSender(smtpWatcher.Config().SMTP(), logger)
+
+    // Likewise, check the translations of the API messages before serving.
+    catalog, err := i18n.Load()
+    if err != nil {
+        logger.Error("invalid message catalogs", "error", err)
+        os.Exit(1)
+    }
+
+    // The checks of the readiness endpoint, in addition to the server answering at all.
+    readinessChecks := map[string]func(ctx context.Context) error{
+        "database": func(ctx context.Context) error {
+            if poolWrapper.Pool() == nil {
+                return errors.New("not connected yet")
+            }
+            return poolWrapper.CheckHealth(ctx)
+        },
+        "mail_templates": func(ctx context.Context) error {
+            return mail.TemplatesError()
+        },
+    }
+
+    // The reads fall back to the primary, so a replica which is down only degrades the instance.
+    if cfgDB.DBReplicaServer != "" {
+        readinessChecks["database_replica"] = func(ctx context.Context) error {
+            if poolWrapper.Replica.Pool() == nil {
+                return degradedError{errors.New("not connected")}
+            }
+
+            err := poolWrapper.Replica.CheckHealth(ctx)
+            if err != nil {
+                return degradedError{err}
+            }
+            return nil
+        }
+    }
+
     // Create the application instance.
     app := &application{
-        config:      cfg,
-        logger:      logger,
-        models:      data.NewModels(&poolWrapper),
-        emailSender: &mail.EmailSender{SMTPCfg: cfg.smtp},
-    }
-
-    // Watch and reload dynamic.env config file.
-    go func() {
-        viperDynamic.OnConfigChange(func(in fsnotify.Event) {
-            // A change in the config file can cause two 'write' events.
-            // Only need to respond once. We respond to the first one.
-            if time.Since(cfgDynamic.LoadTime) > time.Duration(100*time.Millisecond) {
-                logger.Info("configuration change detected", "filename", in.Name, "operation", in.Op)
-
-                // Reload the config file if any change is detected.
-                err := config.LoadConfig(viperDynamic, configPath, "env", "dynamic", &cfgDynamic)
-                if err != nil {
-                    logger.Error(err.Error())
-                    os.Exit(1)
-                }
-
-                cfg.limiter.Rps = cfgDynamic.LimiterRps
-                cfg.limiter.Burst = cfgDynamic.LimiterBurst
-                cfg.limiter.Enabled = cfgDynamic.LimiterEnabled
-            }
-        })
-        viperDynamic.WatchConfig()
-    }()
-
-    // Watch and reload dynamic_db_secret.env config file.
-    go func() {
-        viperDynamicDB.OnConfigChange(func(in fsnotify.Event) {
-            if time.Since(cfgDynamic.LoadTime) > time.Duration(100*time.Millisecond) {
-                logger.Info("configuration change detected", "filename", in.Name, "operation", in.Op)
-
-                err := config.LoadConfig(viperDynamicDB, configPath, "env", "dynamic_db_secret", &cfgDynamic)
-                if err != nil {
-                    logger.Error(err.Error())
-                    os.Exit(1)
-                }
-
-                cfg.dbConnString = fmt.Sprintf(
-                    "postgres://%s:%s@%s:%d/%s?sslmode=%s&pool_max_conns=%d&pool_max_conn_idle_time=%s",
-                    cfgDynamic.DBUsername, cfgDynamic.DBPassword, cfgDynamic.DBServer, cfgDynamic.DBPort, cfgDynamic.DBName,
-                    cfgDynamic.DBSSLMode, cfgDynamic.DBPoolMaxConns, cfgDynamic.DBPoolMaxConnIdleTime,
-                )
-
-                // Close the old database connection pool and create a new one.
-                poolWrapper.Pool.Close()
-                err = poolWrapper.CreatePool(cfg.dbConnString)
-                if err != nil {
-                    logger.Error(err.Error())
-                    os.Exit(1)
-                }
+        config:          cfg,
+        logger:          logger,
+        models:          data.NewModels(&poolWrapper, queryTimeouts),
+        emailSender:     emailSender,
+        catalog:         catalog,
+        startTime:       startTime,
+        similarMovies:   newSimilarCache(cfg.similarCacheTTL),
+        tracer:          tracer,
+        readinessChecks: readinessChecks,
+        configWatchers:  []*config.Watcher{dynamicWatcher, dbWatcher, smtpWatcher},
+        shutdownHooks:   shutdown,
+    }
+
+    if cfg.passwords.hibp {
+        app.breachClient = breach.NewClient(breach.DefaultURL, cfg.passwords.hibpTimeout)
+    }
+
+    if cfg.movieCache.enabled {
+        app.movieCache = newMovieCache(cfg.movieCache.size, cfg.movieCache.ttl)
+    }
+
+    if cfg.coalesceReads {
+        app.movieReads = newMovieReads()
+    }
+
+    app.tasks = task.NewRunner(logger, cfg.tasks.workers, cfg.tasks.queueSize, &app.wg)
+
+    // The background goroutines, such as the tasks, may still use the database, so they're
+    // waited for before the pool is closed.
+    app.OnShutdown("background tasks", func(ctx context.Context) error {
+        app.logger.Info("waiting for background tasks to complete")
+        app.wg.Wait()
+        app.tasks.Close()
+        return nil
+    })
+
+    // Connect to the database in the background if it's done after the server has started. The
+    // application exits if the database still isn't reachable after -db-connect-timeout.
+    if connectLater {
+        go func() {
+            err := connectDB()
+            if err == nil && *autoMigrateOnStart {
+                err = autoMigrate(context.Background(), poolWrapper.Pool(), cfg.env, logger)
             }
-        })
-        viperDynamicDB.WatchConfig()
-    }()
-
-    // Watch and reload dynamic_smtp_secret.env config file.
-    go func() {
-        viperDynamicSMTP.OnConfigChange(func(in fsnotify.Event) {
-            if time.Since(cfgDynamic.LoadTime) > time.Duration(100*time.Millisecond) {
-                logger.Info("configuration change detected", "filename", in.Name, "operation", in.Op)
-
-                err := config.LoadConfig(viperDynamicSMTP, configPath, "env", "dynamic_smtp_secret", &cfgDynamic)
-                if err != nil {
-                    logger.Error(err.Error())
-                    os.Exit(1)
-                }
-
-                cfg.smtp.Username = cfgDynamic.SMTPUsername
-                cfg.smtp.Password = cfgDynamic.SMTPPassword
-                cfg.smtp.AuthAddress = cfgDynamic.SMTPAuthAddress
-                cfg.smtp.ServerAddress = cfgDynamic.SMTPServerAddress
+            if err != nil {
+                logger.Error(err.Error())
+                os.Exit(1)
             }
-        })
-        viperDynamicSMTP.WatchConfig()
-    }()
+
+            replicas.sync(dbWatcher.Config())
+            go replicas.run(dbWatcher.Config)
+            app.dbReady.Store(true)
+        }()
+    } else {
+        replicas.sync(cfgDB)
+        go replicas.run(dbWatcher.Config)
+        app.dbReady.Store(true)
+    }
+
+    // Publish the background task counters.
+    expvar.Publish("tasks", expvar.Func(func() any {
+        return app.tasks.Stats()
+    }))
+
+    // Store posters on the filesystem instead of in the database if configured.
+    if cfg.poster.storage == "fs" {
+        app.models.Poster = data.FilesystemPosterStore{Dir: cfg.poster.dir}
+    }
+
+    // Publish the build information, including the uptime, so that dashboards don't need to
+    // parse the healthcheck response.
+    expvar.Publish("build_info", expvar.Func(func() any {
+        return app.buildInfo()
+    }))
+
+    // Apply the configuration reloaded by the watchers, on file change or on SIGHUP (see serve).
+    for _, w := range app.configWatchers {
+        w.NoNotify = configReload == "sighup"
+    }
+
+    err = dynamicWatcher.Start(func(c *config.Config) {
+        cfg.limiter.Store(c.Limiter())
+        cfg.authLimiter.Store(c.AuthLimiter())
+        cfg.apiKeys.Store(&config.APIKeyConfig{MaxPerUser: c.APIKeyMaxPerUser})
+        cfg.permissions.Store(&config.PermissionConfig{MovieWriteCanDelete: c.MovieWriteCanDelete})
+        cfg.serverTiming.Store(c.ServerTimingEnabled)
+        trustedOrigins := c.TrustedOrigins()
+        cfg.trustedOrigins.Store(&trustedOrigins)
+        cfg.frontendURL.Store(c.FrontendURL())
+        cfg.registration.Store(c.Registration())
+        cfg.unactivated.Store(c.UnactivatedUsers())
+        cfg.lists.Store(c.Lists())
+        level.Set(c.LogLevelOr(logLevel))
+        queryTimeouts.Set(c.DBTimeoutRead, c.DBTimeoutWrite, c.DBTimeoutList, c.DBTimeoutToken)
+    })
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    app.OnShutdown("dynamic config watcher", func(ctx context.Context) error {
+        return dynamicWatcher.Stop()
+    })
+
+    err = dbWatcher.Start(func(c *config.Config) {
+        poolWrapper.Tracer.SetSlowThreshold(c.DBSlowQueryThreshold)
+        replicas.sync(c)
+
+        // The pool is only recreated when its settings changed, e.g. not for a new slow query
+        // threshold.
+        pool := c.DBPool()
+        if pool == poolWrapper.Config() {
+            return
+        }
+
+        // Create a new database connection pool and swap it in. The old pool is closed once
+        // in-flight queries have drained. If the new pool can't be created, e.g. because the new
+        // credentials are wrong, we keep using the old one.
+        err := poolWrapper.CreatePool(pool)
+        if err != nil {
+            logger.Error("failed to recreate database connection pool, keeping the old one", "error", err.Error())
+            return
+        }
+        logger.Info("database connection pool recreated")
+    })
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    app.OnShutdown("db config watcher", func(ctx context.Context) error {
+        return dbWatcher.Stop()
+    })
+
+    err = smtpWatcher.Start(func(c *config.Config) {
+        emailSender.SetConfig(c.SMTP())
+    })
+    if err != nil {
+        logger.Error(err.Error())
+        os.Exit(1)
+    }
+    app.OnShutdown("smtp config watcher", func(ctx context.Context) error {
+        return smtpWatcher.Stop()
+    })
 
     err = app.serve()
     if err != nil {
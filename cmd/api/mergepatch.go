@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// contentTypeMergePatch is the media type of a JSON merge patch (RFC 7396).
+const contentTypeMergePatch = "application/merge-patch+json"
+
+// isMergePatch reports whether the body of r is sent as a JSON merge patch rather than plain
+// JSON.
+func isMergePatch(r *http.Request) bool {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return mediaType == contentTypeMergePatch
+}
+
+// movieMergePatch is a JSON merge patch of a movie. A field is nil when its key is absent,
+// "null" when it is null and the raw value otherwise, so that a client can clear a field, which
+// a plain JSON body can't express.
+type movieMergePatch struct {
+    Title   json.RawMessage `json:"title"`
+    Year    json.RawMessage `json:"year"`
+    Runtime json.RawMessage `json:"runtime"`
+    Genres  json.RawMessage `json:"genres"`
+}
+
+// apply merges the patch into movie: an absent key leaves the field alone, null clears it and
+// a value replaces it, a whole array included. Every field of a movie is required, so a cleared
+// field fails ValidateMovie under its own name.
+func (p *movieMergePatch) apply(movie *data.Movie) error {
+    err := mergeField("title", p.Title, &movie.Title)
+    if err != nil {
+        return err
+    }
+
+    err = mergeField("year", p.Year, &movie.Year)
+    if err != nil {
+        return err
+    }
+
+    err = mergeField("runtime", p.Runtime, &movie.Runtime)
+    if err != nil {
+        return err
+    }
+
+    return mergeField("genres", p.Genres, &movie.Genres)
+}
+
+// mergeField sets *dst from raw, the value of the key name in a merge patch: it's left alone
+// when raw is nil, set to the zero value of T when raw is null and decoded from raw otherwise.
+// The errors are worded like those of readJSON.
+func mergeField[T any](name string, raw json.RawMessage, dst *T) error {
+    switch {
+    case raw == nil:
+        return nil
+    case bytes.Equal(raw, []byte("null")):
+        var zero T
+        *dst = zero
+        return nil
+    }
+
+    var value T
+
+    err := json.Unmarshal(raw, &value)
+    if err != nil {
+        var unmarshalTypeError *json.UnmarshalTypeError
+
+        if errors.As(err, &unmarshalTypeError) {
+            return fmt.Errorf("body contains incorrect JSON type for field %s", name)
+        }
+        return err
+    }
+
+    *dst = value
+    return nil
+}
+
+// readMovieMergePatch reads a JSON merge patch from the request body and applies it to movie.
+// The patch must be an object: any other patch would replace the whole movie.
+func (app *application) readMovieMergePatch(w http.ResponseWriter, r *http.Request, movie *data.Movie) error {
+    // A pointer stays nil for a body of null.
+    var patch *movieMergePatch
+
+    err := app.readJSON(w, r, &patch)
+    if err != nil {
+        return err
+    }
+    if patch == nil {
+        return errors.New("body must be a JSON object")
+    }
+
+    return patch.apply(movie)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestUpdateMovieMergePatch(t *testing.T) {
+    // Movie 1 of the fixtures.
+    moana := data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}}
+
+    tests := []struct {
+        name        string
+        contentType string
+        body        string
+        wantStatus  int
+        wantMovie   data.Movie // the fields of the movie afterwards
+        wantError   string     // the field named by the validation error
+    }{
+        {"title absent", contentTypeMergePatch, `{"year": 2017}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Year = 2017 }), ""},
+        {"title null", contentTypeMergePatch, `{"title": null}`, http.StatusUnprocessableEntity, moana, "title"},
+        {"title value", contentTypeMergePatch, `{"title": "Up"}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Title = "Up" }), ""},
+
+        {"year absent", contentTypeMergePatch, `{"title": "Up"}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Title = "Up" }), ""},
+        {"year null", contentTypeMergePatch, `{"year": null}`, http.StatusUnprocessableEntity, moana, "year"},
+        {"year value", contentTypeMergePatch, `{"year": 2017}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Year = 2017 }), ""},
+
+        {"runtime absent", contentTypeMergePatch, `{"title": "Up"}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Title = "Up" }), ""},
+        {"runtime null", contentTypeMergePatch, `{"runtime": null}`, http.StatusUnprocessableEntity, moana, "runtime"},
+        {"runtime value", contentTypeMergePatch, `{"runtime": "96 mins"}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Runtime = 96 }), ""},
+
+        {"genres absent", contentTypeMergePatch, `{"title": "Up"}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Title = "Up" }), ""},
+        {"genres null", contentTypeMergePatch, `{"genres": null}`, http.StatusUnprocessableEntity, moana, "genres"},
+        {"genres value", contentTypeMergePatch, `{"genres": ["comedy"]}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Genres = []string{"comedy"} }), ""},
+
+        {"charset parameter", contentTypeMergePatch + "; charset=utf-8", `{"genres": null}`, http.StatusUnprocessableEntity, moana, "genres"},
+        {"incorrect type", contentTypeMergePatch, `{"year": "2017"}`, http.StatusBadRequest, moana, ""},
+        {"not an object", contentTypeMergePatch, `null`, http.StatusBadRequest, moana, ""},
+        {"unknown key", contentTypeMergePatch, `{"director": null}`, http.StatusBadRequest, moana, ""},
+
+        // In plain JSON null leaves a field alone, as it always has.
+        {"plain JSON null", contentTypeJSON, `{"title": null, "year": null, "runtime": null, "genres": null}`, http.StatusOK, moana, ""},
+        {"plain JSON value", contentTypeJSON, `{"genres": ["comedy"]}`, http.StatusOK, with(moana, func(m *data.Movie) { m.Genres = []string{"comedy"} }), ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            h := app.routes()
+
+            req := httptest.NewRequest(http.MethodPatch, "/v1/movies/1", strings.NewReader(tt.body))
+            req.Header.Set("Authorization", "Bearer "+authToken(t, app, mock.ActivatedUserID))
+            req.Header.Set("Content-Type", tt.contentType)
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, req)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+
+            if tt.wantError != "" {
+                var resp struct {
+                    Error map[string][]string `json:"error"`
+                }
+                decode(t, rr, &resp)
+
+                if _, ok := resp.Error[tt.wantError]; !ok || len(resp.Error) != 1 {
+                    t.Errorf("got errors %v; want one for %s", resp.Error, tt.wantError)
+                }
+            }
+
+            movie, err := app.models.Movie.Get(context.Background(), 1)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            got := data.Movie{Title: movie.Title, Year: movie.Year, Runtime: movie.Runtime, Genres: movie.Genres}
+            if !reflect.DeepEqual(got, tt.wantMovie) {
+                t.Errorf("got movie %+v; want %+v", got, tt.wantMovie)
+            }
+        })
+    }
+}
+
+// with returns a copy of movie changed by fn.
+func with(movie data.Movie, fn func(*data.Movie)) data.Movie {
+    fn(&movie)
+    return movie
+}
@@ -1,35 +1,59 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"expvar"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"runtime/debug"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/julienschmidt/httprouter"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
+	"greenlight.zzh.net/internal/config"
 	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/metrics"
 	"greenlight.zzh.net/internal/validator"
 )
 
+// recoverPanic turns a panic in a handler into a 500 Internal Server Error. The panic is logged
+// with the stack trace, to find the offending line, and counted in the total_panics expvar, to tell
+// panics apart from the other server errors.
 func (app *application) recoverPanic(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         // Create a deferred function which will always be run in the event of a panic
         // as Go unwinds the stack.
         defer func() {
             // Use the builtin recover function to check if there has been a panic or not.
-            if err := recover(); err != nil {
+            if p := recover(); p != nil {
                 // If there was a panic, set a "Connection: close" header on the response.
                 // This acts as a trigger to make Go's HTTP server automatically close the
                 // current connection after a response has been sent.
                 w.Header().Set("Connection", "close")
-                // The value returned by recover() has the type any, so we use fmt.Errorf() to
-                // normalize it into an error and call our serverErrorResponse() helper.
-                app.serverErrorResponse(w, r, fmt.Errorf("%s", err))
+
+                // A panic passed on from another goroutine brings the stack of that goroutine.
+                hp, ok := p.(handlerPanic)
+                if !ok {
+                    hp = handlerPanic{value: p, stack: debug.Stack()}
+                }
+
+                app.panicResponse(w, r, hp.err(), hp.stack)
             }
         }()
 
@@ -37,16 +61,143 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
     })
 }
 
+// handlerPanic is a panic recovered in a goroutine running a handler, with the stack trace of
+// that goroutine. It is panicked again in the goroutine serving the request, so that
+// recoverPanic logs where the handler panicked rather than where it was panicked again.
+type handlerPanic struct {
+    value any
+    stack []byte
+}
+
+// err returns the panic value as an error. An error value is returned as it is, so that it can
+// still be inspected with errors.Is and errors.As.
+func (hp handlerPanic) err() error {
+    if err, ok := hp.value.(error); ok {
+        return err
+    }
+
+    return fmt.Errorf("%v", hp.value)
+}
+
 func (app *application) rateLimit(next http.Handler) http.Handler {
-    type client struct {
-        limiter  *rate.Limiter
-        lastSeen time.Time
+    limiters := newClientLimiters()
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        limiterCfg := app.config.limiter.Load()
+
+        if limiterCfg.Enabled {
+            // Use the realip.FromRequest() function to ge the client's real IP address.
+            ip := realip.FromRequest(r)
+
+            if status, ok := limiters.allow(ip, limiterCfg, w.Header()); !ok {
+                app.rateLimitExceededResponse(w, r, status)
+                return
+            }
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// authRateLimit returns a middleware applying the stricter authentication limiter to the
+// handlers it wraps, on top of the general one applied by rateLimit. The handlers share one set
+// of limiters, keyed by the client's IP address and the email address in the request body, if
+// any, so that guessing passwords is slowed down without locking out everyone behind a NAT.
+func (app *application) authRateLimit() func(next http.HandlerFunc) http.HandlerFunc {
+    limiters := newClientLimiters()
+
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            limiterCfg := app.config.authLimiter.Load()
+
+            if limiterCfg.Enabled {
+                key := realip.FromRequest(r)
+                if email := app.peekEmail(w, r); email != "" {
+                    key += " " + email
+                }
+
+                if status, ok := limiters.allow(key, limiterCfg, w.Header()); !ok {
+                    app.rateLimitExceededResponse(w, r, status)
+                    return
+                }
+            }
+
+            next(w, r)
+        }
     }
+}
+
+// userExportRateLimit returns a middleware limiting each authenticated user to
+// -user-export-limit requests per hour to the handler it wraps, since an export of their data
+// is expensive. It must be wrapped by requireAuthenticatedUser.
+func (app *application) userExportRateLimit() func(next http.HandlerFunc) http.HandlerFunc {
+    limiters := newClientLimiters()
 
-    var (
-        mu      sync.Mutex
-        clients = make(map[string]*client)
-    )
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            if limit := app.config.userExportLimit; limit > 0 {
+                limiterCfg := &config.LimiterConfig{Rps: float64(limit) / 3600, Burst: limit, Enabled: true}
+                key := strconv.FormatInt(app.contextGetUser(r).ID, 10)
+
+                if status, ok := limiters.allow(key, limiterCfg, w.Header()); !ok {
+                    app.rateLimitExceededResponse(w, r, status)
+                    return
+                }
+            }
+
+            next(w, r)
+        }
+    }
+}
+
+// peekEmail returns the normalized "email" field of the JSON request body, or "" if there isn't
+// one, and leaves the body for the handler to read.
+func (app *application) peekEmail(w http.ResponseWriter, r *http.Request) string {
+    body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, app.contextGetMaxBodyBytes(r)))
+    r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+    if err != nil {
+        return ""
+    }
+
+    var input struct {
+        Email string `json:"email"`
+    }
+
+    // Errors are left for the handler to report.
+    if json.Unmarshal(body, &input) != nil {
+        return ""
+    }
+
+    return data.NormalizeEmail(input.Email)
+}
+
+// errReader is an io.Reader which always returns err, or io.EOF if err is nil.
+type errReader struct {
+    err error
+}
+
+func (er errReader) Read(p []byte) (int, error) {
+    if er.err != nil {
+        return 0, er.err
+    }
+
+    return 0, io.EOF
+}
+
+// clientLimiters holds a rate limiter per client. Limiters of clients which haven't made a request
+// for three minutes are removed.
+type clientLimiters struct {
+    mu      sync.Mutex
+    clients map[string]*client
+}
+
+type client struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+func newClientLimiters() *clientLimiters {
+    cl := &clientLimiters{clients: make(map[string]*client)}
 
     // Launch a background goroutine which removes old entries from the clients map
     // once every minute.
@@ -54,44 +205,91 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
         for {
             time.Sleep(time.Minute)
 
-            mu.Lock()
+            cl.mu.Lock()
 
-            for ip, client := range clients {
-                if time.Since(client.lastSeen) > 3*time.Minute {
-                    delete(clients, ip)
+            // A limiter which hasn't refilled yet is kept, so that a slow limiter such as the
+            // one of userExportRateLimit isn't reset by waiting.
+            for key, client := range cl.clients {
+                full := client.limiter.Tokens() >= float64(client.limiter.Burst())
+                if time.Since(client.lastSeen) > 3*time.Minute && full {
+                    delete(cl.clients, key)
                 }
             }
 
-            mu.Unlock()
+            cl.mu.Unlock()
         }
     }()
 
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        if app.config.limiter.Enabled {
-            // Use the realip.FromRequest() function to ge the client's real IP address.
-            ip := realip.FromRequest(r)
+    return cl
+}
 
-            mu.Lock()
+// allow reports whether the client identified by key may make a request now, creating its limiter
+// from limiterCfg on its first request, and sets the rate limit headers in h. The returned
+// status is reported in the body of the response to a rejected request.
+func (cl *clientLimiters) allow(key string, limiterCfg *config.LimiterConfig, h http.Header) (rateLimitStatus, bool) {
+    cl.mu.Lock()
+    defer cl.mu.Unlock()
 
-            if _, found := clients[ip]; !found {
-                clients[ip] = &client{
-                    limiter: rate.NewLimiter(rate.Limit(app.config.limiter.Rps), app.config.limiter.Burst),
-                }
-            }
+    if _, found := cl.clients[key]; !found {
+        cl.clients[key] = &client{
+            limiter: rate.NewLimiter(rate.Limit(limiterCfg.Rps), limiterCfg.Burst),
+        }
+    }
 
-            clients[ip].lastSeen = time.Now()
+    now := time.Now()
+    cl.clients[key].lastSeen = now
 
-            if !clients[ip].limiter.Allow() {
-                mu.Unlock()
-                app.rateLimitExceededResponse(w, r)
-                return
-            }
+    limiter := cl.clients[key].limiter
+    allowed := limiter.AllowN(now, 1)
+
+    status := newRateLimitStatus(limiter, now)
+    setRateLimitHeaders(h, status, allowed)
+
+    return status, allowed
+}
+
+// rateLimitStatus is the state of a client's limiter after a request.
+type rateLimitStatus struct {
+    limit      int // requests which can be made in a burst
+    window     int // seconds it takes the limiter to refill from empty
+    remaining  int // requests which can be made right away
+    reset      int // seconds until the limiter is full again
+    retryAfter int // seconds until the next request will be allowed, at least 1
+}
+
+func newRateLimitStatus(limiter *rate.Limiter, now time.Time) rateLimitStatus {
+    tokens := max(limiter.TokensAt(now), 0)
+    burst := limiter.Burst()
 
-            mu.Unlock()
+    // secondsUntil returns the whole seconds it takes the limiter to refill from have to n tokens.
+    secondsUntil := func(have, n float64) int {
+        if have >= n || limiter.Limit() <= 0 {
+            return 0
         }
+        return int(math.Ceil((n - have) / float64(limiter.Limit())))
+    }
 
-        next.ServeHTTP(w, r)
-    })
+    return rateLimitStatus{
+        limit:      burst,
+        window:     secondsUntil(0, float64(burst)),
+        remaining:  int(tokens),
+        reset:      secondsUntil(tokens, float64(burst)),
+        retryAfter: max(secondsUntil(tokens, 1), 1),
+    }
+}
+
+// setRateLimitHeaders tells the client the status of its limiter: X-RateLimit-Limit is the burst,
+// X-RateLimit-Remaining the number of requests which can be made right away and X-RateLimit-Reset
+// the seconds until the limiter is full again. A rejected request also gets Retry-After, the
+// seconds until the next request will be allowed.
+func setRateLimitHeaders(h http.Header, status rateLimitStatus, allowed bool) {
+    h.Set("X-RateLimit-Limit", strconv.Itoa(status.limit))
+    h.Set("X-RateLimit-Remaining", strconv.Itoa(status.remaining))
+    h.Set("X-RateLimit-Reset", strconv.Itoa(status.reset))
+
+    if !allowed {
+        h.Set("Retry-After", strconv.Itoa(status.retryAfter))
+    }
 }
 
 func (app *application) authenticate(next http.Handler) http.Handler {
@@ -117,6 +315,8 @@ func (app *application) authenticate(next http.Handler) http.Handler {
         // header isn't in the expected format, we return a 401 Unauthorized response.
         headerParts := strings.Split(authorizationHeader, " ")
         if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+            app.audit(r, data.AuditInvalidToken, nil, "", "malformed Authorization header")
+            metrics.AuthFailureInvalidToken.Inc()
             app.invalidAuthenticationTokenResponse(w, r)
             return
         }
@@ -125,15 +325,34 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
         v := validator.New()
 
-        if data.ValidateTokenPlaintext(v, token); !v.Valid() {
+        // API keys are told apart from authentication tokens by their prefix.
+        scope := data.ScopeAuthentication
+        if strings.HasPrefix(token, data.APIKeyPrefix) {
+            scope = data.ScopeAPIKey
+            data.ValidateAPIKeyPlaintext(v, token)
+        } else {
+            data.ValidateTokenPlaintext(v, token)
+        }
+
+        if !v.Valid() {
+            app.audit(r, data.AuditInvalidToken, nil, "", "malformed "+scope)
+            metrics.AuthFailureInvalidToken.Inc()
             app.invalidAuthenticationTokenResponse(w, r)
             return
         }
 
-        user, err := app.models.User.GetForToken(data.ScopeAuthentication, token)
+        // A token created by a login moments ago may not have reached the read replica yet.
+        ctx := r.Context()
+        if app.config.db.primaryTokenLookups {
+            ctx = data.UsePrimary(ctx)
+        }
+
+        user, err := app.models.User.GetForToken(ctx, scope, token)
         if err != nil {
             switch {
             case errors.Is(err, data.ErrRecordNotFound):
+                app.audit(r, data.AuditInvalidToken, nil, "", "unknown or expired "+scope)
+                metrics.AuthFailureInvalidToken.Inc()
                 app.invalidAuthenticationTokenResponse(w, r)
             default:
                 app.serverErrorResponse(w, r, err)
@@ -141,7 +360,46 @@ func (app *application) authenticate(next http.Handler) http.Handler {
             return
         }
 
+        // ForcePasswordReset deletes the user's tokens, so this only catches a token created by a
+        // login which read the user just before the reset.
+        if user.PasswordResetRequired {
+            app.passwordResetRequiredResponse(w, r)
+            return
+        }
+
+        // Keep the hash of the token so that handlers can tell the current session apart.
+        tokenHash := sha256.Sum256([]byte(token))
+
+        // With sliding expiration, a use of an authentication token pushes its expiry back,
+        // within the maximum lifetime of the token.
+        var newExpiry *time.Time
+        if tokens := app.config.authTokens; tokens.sliding && user.TokenExpiry != nil {
+            expiry, ok := data.SlidingExpiry(user.TokenCreatedAt, *user.TokenExpiry, time.Now(), tokens.ttl, tokens.maxLifetime, tokens.extendAfter)
+            if ok {
+                newExpiry = &expiry
+            }
+        }
+
+        // Record the use of the token in background so that it doesn't delay the request. Most
+        // requests of a busy token have nothing to write, and start no goroutine.
+        lastUsedDue := data.LastUsedDue(user.TokenLastUsedAt, time.Now())
+        if lastUsedDue || newExpiry != nil {
+            app.background("update_token_last_used", func() {
+                var err error
+                if lastUsedDue {
+                    err = app.models.Token.UpdateLastUsed(context.Background(), tokenHash[:])
+                }
+                if err == nil && newExpiry != nil {
+                    err = app.models.Token.ExtendExpiry(context.Background(), tokenHash[:], *newExpiry)
+                }
+                if err != nil {
+                    app.logger.Error(err.Error())
+                }
+            })
+        }
+
         r = app.contextSetUser(r, user)
+        r = app.contextSetTokenHash(r, tokenHash[:])
 
         next.ServeHTTP(w, r)
     })
@@ -176,17 +434,43 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
     return app.requireAuthenticatedUser(fn)
 }
 
+// requirePermission checks that the user has the permission code, or one of the codes which
+// grant it (see acceptedPermissions), exactly or through a wildcard (see data.PermissionIndex).
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
+    return app.requirePermissionUnless(code, nil, next)
+}
+
+// requirePermissionOrSelf is requirePermission for routes on a user's data: the permission isn't
+// needed when the idParam URL parameter is the ID of the authenticated user.
+func (app *application) requirePermissionOrSelf(code, idParam string, next http.HandlerFunc) http.HandlerFunc {
+    self := func(r *http.Request) bool {
+        id, err := app.readInt64Param(r, idParam)
+        return err == nil && id == app.contextGetUser(r).ID
+    }
+
+    return app.requirePermissionUnless(code, self, next)
+}
+
+// requirePermissionUnless is requirePermission, except that the activated user doesn't need the
+// permission for the requests exempt returns true for. A nil exempt exempts no request.
+func (app *application) requirePermissionUnless(code string, exempt func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
     fn := func(w http.ResponseWriter, r *http.Request) {
+        if exempt != nil && exempt(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
         user := app.contextGetUser(r)
 
-        permissions, err := app.models.Permission.GetAllForUser(user.ID)
+        permissions, err := app.models.Permission.GetAllForUser(r.Context(), user.ID)
         if err != nil {
             app.serverErrorResponse(w, r, err)
             return
         }
 
-        if !permissions.Include(code) {
+        index := permissions.Index()
+
+        if !slices.ContainsFunc(app.acceptedPermissions(code), index.Match) {
             app.notPermittedResponse(w, r)
             return
         }
@@ -197,34 +481,174 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
     return app.requireActivatedUser(fn)
 }
 
-func (app *application) enableCORS(next http.Handler) http.Handler {
+// acceptedPermissions returns the permission codes any of which grants code. Besides code itself
+// these are the codes which include it, e.g. users:admin grants users:read, and the codes which
+// grant it during a deprecation window, e.g. movie:write grants movie:delete while
+// MOVIE_WRITE_CAN_DELETE is true.
+func (app *application) acceptedPermissions(code string) []string {
+    codes := []string{code}
+
+    if code == "users:read" {
+        codes = append(codes, "users:admin")
+    }
+
+    if code == "movie:delete" && app.config.permissions.Load().MovieWriteCanDelete {
+        codes = append(codes, "movie:write")
+    }
+
+    return codes
+}
+
+// maxBodyBytes overrides the request body size limit enforced by readJSON for a single route,
+// e.g. for bulk or import endpoints which legitimately need larger bodies.
+func (app *application) maxBodyBytes(n int64, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        next.ServeHTTP(w, app.contextSetMaxBodyBytes(r, n))
+    }
+}
+
+// corsMethods are the methods checked against the router to build Access-Control-Allow-Methods.
+var corsMethods = []string{
+    http.MethodGet,
+    http.MethodPost,
+    http.MethodPut,
+    http.MethodPatch,
+    http.MethodDelete,
+}
+
+// allowedMethods returns the methods router has a handler for at path, plus OPTIONS, or nil if
+// there is no route at path.
+func allowedMethods(router *httprouter.Router, path string) []string {
+    var methods []string
+
+    for _, method := range corsMethods {
+        if handle, _, _ := router.Lookup(method, path); handle != nil {
+            methods = append(methods, method)
+        }
+    }
+
+    if len(methods) == 0 {
+        return nil
+    }
+
+    return append(methods, http.MethodOptions)
+}
+
+// stripPrefix serves the requests under the -url-prefix path with the prefix removed from the
+// path, so that the router only knows the unprefixed routes, and responds 404 Not Found to the
+// other requests.
+func (app *application) stripPrefix(next http.Handler) http.Handler {
+    prefix := app.config.urlPrefix
+    if prefix == "" {
+        return next
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rest, found := strings.CutPrefix(r.URL.Path, prefix)
+        if !found || rest != "" && rest[0] != '/' {
+            app.notFoundResponse(w, r)
+            return
+        }
+
+        r2 := new(http.Request)
+        *r2 = *r
+        r2.URL = new(url.URL)
+        *r2.URL = *r.URL
+        r2.URL.Path = cmp.Or(rest, "/")
+        r2.URL.RawPath = ""
+
+        next.ServeHTTP(w, r2)
+    })
+}
+
+// canonicalPath returns p with repeated slashes collapsed, dot segments resolved and any trailing
+// slash removed, e.g. "/v1/movies" for "//v1/movies/".
+func canonicalPath(p string) string {
+    if p == "" {
+        return "/"
+    }
+
+    return path.Clean("/" + p)
+}
+
+// cleanPath redirects requests for non-canonical paths, such as /v1/movies/ or //v1/movies, to
+// the canonical path with 308 Permanent Redirect, which makes clients repeat the request with
+// the same method and body. CORS preflight requests can't follow redirects, so their path is
+// rewritten in place instead.
+func (app *application) cleanPath(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        canonical := canonicalPath(r.URL.Path)
+        if canonical == r.URL.Path {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+            r.URL.Path = canonical
+            r.URL.RawPath = ""
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        target := url.URL{Path: app.config.urlPrefix + canonical, RawQuery: r.URL.RawQuery}
+        http.Redirect(w, r, target.String(), http.StatusPermanentRedirect)
+    })
+}
+
+// negotiateLocale stores the locale the client prefers with Accept-Language in the request
+// context, for the error and validation messages of the response.
+func (app *application) negotiateLocale(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if acceptLanguage := r.Header.Get("Accept-Language"); acceptLanguage != "" {
+            r = app.contextSetLocale(r, app.catalog.Negotiate(acceptLanguage))
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (app *application) enableCORS(router *httprouter.Router, next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         // Add the "Vary: Origin" header.
         w.Header().Add("Vary", "Origin")
 
-        // Add the "Vary: Access-Control-Request-Method" header.
+        // Add the "Vary: Access-Control-Request-Method" and "Vary: Access-Control-Request-Headers"
+        // headers, since preflight responses depend on them.
         w.Header().Add("Vary", "Access-Control-Request-Method")
+        w.Header().Add("Vary", "Access-Control-Request-Headers")
 
         origin := r.Header.Get("Origin")
 
         // Only run this if there's an Origin request header present.
-        if origin != "" {
-            for _, o := range app.config.cors.trustedOrigins {
-                if origin == o {
-                    w.Header().Set("Access-Control-Allow-Origin", origin)
-
-                    // Check if the request has the HTTP method OPTIONS and contains the
-                    // "Access-Control-Request-Method" header. If it does, we treat it as a
-                    // preflight request.
-                    if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
-                        w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-                        w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
-
-                        w.WriteHeader(http.StatusOK)
-                        return
+        if origin != "" && app.trustedOrigin(origin) {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+
+            if app.config.cors.allowCredentials {
+                w.Header().Set("Access-Control-Allow-Credentials", "true")
+            }
+
+            // Check if the request has the HTTP method OPTIONS and contains the
+            // "Access-Control-Request-Method" header. If it does, we treat it as a
+            // preflight request.
+            if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+                // Requests for unknown paths are left to the router to reject.
+                methods := allowedMethods(router, r.URL.Path)
+                if methods != nil {
+                    w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+
+                    // Echo the requested headers, falling back to the ones our API uses.
+                    headers := r.Header.Get("Access-Control-Request-Headers")
+                    if headers == "" {
+                        headers = "Authorization, Content-Type"
+                    }
+                    w.Header().Set("Access-Control-Allow-Headers", headers)
+
+                    if app.config.cors.maxAge > 0 {
+                        w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(app.config.cors.maxAge.Seconds())))
                     }
 
-                    break
+                    w.WriteHeader(http.StatusNoContent)
+                    return
                 }
             }
         }
@@ -233,6 +657,218 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
     })
 }
 
+// trustedOrigin reports whether origin matches one of the trusted CORS origins, as last loaded
+// from CORS_TRUSTED_ORIGINS.
+func (app *application) trustedOrigin(origin string) bool {
+    origins := app.config.trustedOrigins.Load()
+    if origins == nil {
+        return false
+    }
+
+    origin = strings.ToLower(origin)
+
+    for _, rx := range *origins {
+        if rx.MatchString(origin) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// timeout cancels the context of a request once the request timeout has passed, so that the
+// database queries of a stuck handler are cancelled, and sends a 503 if the handler hasn't started
+// its response by then. Long running routes (see longRunning) get the long request timeout and
+// their connection read and write deadlines are extended to match.
+func (app *application) timeout(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        d := app.config.requestTimeout.standard
+
+        if app.longRunning(r) {
+            d = app.config.requestTimeout.long
+
+            // The server's ReadTimeout and WriteTimeout would otherwise cut the request short.
+            // Not every ResponseWriter supports deadlines, e.g. in tests, so errors are ignored.
+            rc := http.NewResponseController(w)
+            _ = rc.SetReadDeadline(time.Now().Add(d))
+            _ = rc.SetWriteDeadline(time.Now().Add(d + time.Second))
+        }
+
+        if d <= 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), d)
+        defer cancel()
+
+        r = r.WithContext(ctx)
+        tw := newTimeoutWriter(ctx, w)
+
+        done := make(chan struct{})
+        panicChan := make(chan any, 1)
+
+        // Run the handler in its own goroutine so that we can respond when the deadline fires even
+        // if the handler is blocked. A panic is passed back to this goroutine to be handled by
+        // recoverPanic, unless we have already responded. Which of the two happens is decided
+        // under tw.mu, like the timeout below, so that a panic at the deadline isn't lost.
+        go func() {
+            defer func() {
+                if p := recover(); p != nil {
+                    hp := handlerPanic{value: p, stack: debug.Stack()}
+
+                    tw.mu.Lock()
+                    defer tw.mu.Unlock()
+
+                    if tw.timedOut {
+                        totalPanics.Add(1)
+                        app.logger.Error("panic after request timeout: "+hp.err().Error(),
+                            "method", r.Method, "uri", r.URL.RequestURI(), "stack", string(hp.stack))
+                        return
+                    }
+                    panicChan <- hp
+                    return
+                }
+                close(done)
+            }()
+
+            next.ServeHTTP(tw, r)
+        }()
+
+        select {
+        case p := <-panicChan:
+            panic(p)
+        case <-done:
+            return
+        case <-ctx.Done():
+        }
+
+        tw.mu.Lock()
+
+        // If the handler has already started its response we can't replace it with an error, so
+        // we wait for the handler, which sees the cancelled context, to finish.
+        if tw.wroteHeader {
+            tw.mu.Unlock()
+
+            select {
+            case p := <-panicChan:
+                panic(p)
+            case <-done:
+            }
+            return
+        }
+
+        // A panic passed back before the timeout is decided is handled like one before the
+        // deadline, and a later one is logged by the handler's goroutine.
+        select {
+        case p := <-panicChan:
+            tw.mu.Unlock()
+            panic(p)
+        default:
+        }
+
+        // From here on the handler's writes are discarded, so only we write to w.
+        tw.timedOut = true
+        tw.mu.Unlock()
+
+        // If the client went away there is nobody to send the error to.
+        if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+            app.timeoutResponse(w, r)
+        }
+    })
+}
+
+// timeoutWriter is the http.ResponseWriter passed to handlers by the timeout middleware. Headers
+// are collected in a separate map and copied to the wrapped ResponseWriter when the response is
+// started, and all writes are discarded once the request has timed out, so that the handler
+// and the middleware never both write a response. A response can't be started once ctx is done,
+// which settles the race between a handler reacting to the cancelled context and the middleware.
+type timeoutWriter struct {
+    ctx         context.Context
+    wrapped     http.ResponseWriter
+    header      http.Header
+    mu          sync.Mutex
+    wroteHeader bool
+    timedOut    bool
+}
+
+func newTimeoutWriter(ctx context.Context, w http.ResponseWriter) *timeoutWriter {
+    return &timeoutWriter{
+        ctx:     ctx,
+        wrapped: w,
+        header:  w.Header().Clone(),
+    }
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+    return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(statusCode int) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+
+    tw.writeHeaderLocked(statusCode)
+}
+
+// writeHeaderLocked copies the headers and starts the response. The caller must hold tw.mu.
+func (tw *timeoutWriter) writeHeaderLocked(statusCode int) {
+    if tw.timedOut || tw.wroteHeader {
+        return
+    }
+
+    if tw.ctx.Err() != nil {
+        tw.timedOut = true
+        return
+    }
+
+    dst := tw.wrapped.Header()
+    for key, values := range tw.header {
+        dst[key] = values
+    }
+
+    tw.wrapped.WriteHeader(statusCode)
+    tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+
+    tw.writeHeaderLocked(http.StatusOK)
+
+    if tw.timedOut {
+        return 0, http.ErrHandlerTimeout
+    }
+
+    return tw.wrapped.Write(b)
+}
+
+// FlushError flushes the wrapped ResponseWriter, so that streaming handlers work through the
+// timeout middleware.
+func (tw *timeoutWriter) FlushError() error {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+
+    tw.writeHeaderLocked(http.StatusOK)
+
+    if tw.timedOut {
+        return http.ErrHandlerTimeout
+    }
+
+    return http.NewResponseController(tw.wrapped).Flush()
+}
+
+// Flush is FlushError for the handlers which type-assert the writer to http.Flusher.
+func (tw *timeoutWriter) Flush() {
+    tw.FlushError()
+}
+
+// Unwrap returns the wrapped http.ResponseWriter.
+func (tw *timeoutWriter) Unwrap() http.ResponseWriter {
+    return tw.wrapped
+}
+
 // The metricsResponseWriter type wraps an existing http.ResponseWriter and also
 // contains a field for recording the response status code, and a boolen flag
 // to indicate whether the response headers have already been written.
@@ -240,6 +876,7 @@ type metricsResponseWriter struct {
     wrapped       http.ResponseWriter
     statusCode    int
     headerWritten bool
+    beforeHeader  func(h http.Header) // if not nil, called once just before the headers are written
 }
 
 func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
@@ -249,6 +886,14 @@ func newMetricsResponseWriter(w http.ResponseWriter) *metricsResponseWriter {
     }
 }
 
+// startResponse calls the beforeHeader hook if the response headers haven't been written yet.
+func (mrw *metricsResponseWriter) startResponse() {
+    if !mrw.headerWritten && mrw.beforeHeader != nil {
+        mrw.beforeHeader(mrw.wrapped.Header())
+        mrw.beforeHeader = nil
+    }
+}
+
 // Header is a simple 'pass through' to the Header() method of the wrapped
 // http.ResponseWriter.
 func (mrw *metricsResponseWriter) Header() http.Header {
@@ -260,6 +905,7 @@ func (mrw *metricsResponseWriter) Header() http.Header {
 // code (if it hasn't already been recorded) and set the headerWritten field to
 // true to indicate that the HTTP response headers have now been written.
 func (mrw *metricsResponseWriter) WriteHeader(statusCode int) {
+    mrw.startResponse()
     mrw.wrapped.WriteHeader(statusCode)
 
     if !mrw.headerWritten {
@@ -272,23 +918,57 @@ func (mrw *metricsResponseWriter) WriteHeader(statusCode int) {
 // Calling this will automatically write any response headers, so we set the
 // headerWritten field to true.
 func (mrw *metricsResponseWriter) Write(b []byte) (int, error) {
+    mrw.startResponse()
     mrw.headerWritten = true
     return mrw.wrapped.Write(b)
 }
 
+// Flush does a 'pass through' to the wrapped http.ResponseWriter if it supports flushing, so
+// that handlers streaming their response can type-assert the writer to http.Flusher. Flushing
+// sends the response headers, so we set the headerWritten field to true.
+func (mrw *metricsResponseWriter) Flush() {
+    mrw.startResponse()
+    mrw.headerWritten = true
+    http.NewResponseController(mrw.wrapped).Flush()
+}
+
+// Hijack does a 'pass through' to the wrapped http.ResponseWriter, returning
+// http.ErrNotSupported if it doesn't implement http.Hijacker.
+func (mrw *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+    return http.NewResponseController(mrw.wrapped).Hijack()
+}
+
+// ReadFrom does a 'pass through' to the ReadFrom() method of the wrapped http.ResponseWriter if
+// it has one, which lets the server send files with sendfile, and copies src otherwise.
+func (mrw *metricsResponseWriter) ReadFrom(src io.Reader) (int64, error) {
+    mrw.startResponse()
+    mrw.headerWritten = true
+
+    if rf, ok := mrw.wrapped.(io.ReaderFrom); ok {
+        return rf.ReadFrom(src)
+    }
+
+    // Only the Write method of the wrapped writer is exposed, so that io.Copy doesn't call
+    // ReadFrom again.
+    return io.Copy(struct{ io.Writer }{mrw.wrapped}, src)
+}
+
 // Unwrap returns the existing wrapped http.ResponseWriter.
 func (mrw *metricsResponseWriter) Unwrap() http.ResponseWriter {
     return mrw.wrapped
 }
 
-func (app *application) metrics(next http.Handler) http.Handler {
-    var (
-        totalRequestsReceived           = expvar.NewInt("total_requests_received")
-        totalResponsesSent              = expvar.NewInt("total_responses_sent")
-        totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
-        totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
-    )
+// The request metrics are published once at package level, because expvar panics if the same
+// name is registered twice (which would happen if routes() were called more than once).
+var (
+    totalRequestsReceived           = expvar.NewInt("total_requests_received")
+    totalResponsesSent              = expvar.NewInt("total_responses_sent")
+    totalProcessingTimeMicroseconds = expvar.NewInt("total_processing_time_μs")
+    totalResponsesSentByStatus      = expvar.NewMap("total_responses_sent_by_status")
+    totalPanics                     = expvar.NewInt("total_panics")
+)
 
+func (app *application) metrics(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         start := time.Now()
 
@@ -296,6 +976,18 @@ func (app *application) metrics(next http.Handler) http.Handler {
 
         mrw := newMetricsResponseWriter(w)
 
+        // With SERVER_TIMING_ENABLED the time spent until the response is started, in total and
+        // in database queries, is sent in the Server-Timing header. Nothing is allocated for it
+        // otherwise.
+        if app.config.serverTiming.Load() {
+            timer := new(data.QueryTimer)
+            r = r.WithContext(data.WithQueryTimer(r.Context(), timer))
+
+            mrw.beforeHeader = func(h http.Header) {
+                setServerTiming(h, timer.Total(), time.Since(start))
+            }
+        }
+
         next.ServeHTTP(mrw, r)
 
         totalResponsesSent.Add(1)
@@ -306,3 +998,51 @@ func (app *application) metrics(next http.Handler) http.Handler {
         totalProcessingTimeMicroseconds.Add(duration)
     })
 }
+
+// setServerTiming sets the Server-Timing header to the time spent in database queries and in
+// total, in milliseconds, e.g. "db;dur=12.3, app;dur=45.6".
+func setServerTiming(h http.Header, db, total time.Duration) {
+    ms := func(d time.Duration) string {
+        return strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', 1, 64)
+    }
+
+    h.Set("Server-Timing", "db;dur="+ms(db)+", app;dur="+ms(total))
+}
+
+// primaryForWrites makes the requests with an unsafe method read from the primary database
+// rather than the read replica, so that what they change isn't read stale, e.g. the version of
+// a movie checked by its update.
+func (app *application) primaryForWrites(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case http.MethodGet, http.MethodHead, http.MethodOptions:
+        default:
+            r = r.WithContext(data.UsePrimary(r.Context()))
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
+
+// requireDB sends 503 Service Unavailable to the requests which need the database until the
+// application has connected to it, which only takes a while with -db-connect-async. The health
+// and metrics endpoints work without the database, so orchestrators can watch the startup.
+func (app *application) requireDB(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !app.dbReady.Load() {
+            path := r.URL.Path
+            if _, rest, ok := splitAPIVersion(path); ok {
+                path = rest
+            }
+
+            switch path {
+            case "/healthcheck", "/healthcheck/ready", "/version", "/debug/vars":
+            default:
+                app.databaseUnavailableResponse(w, r)
+                return
+            }
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
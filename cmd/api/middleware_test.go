@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestTimeout(t *testing.T) {
+    tests := []struct {
+        name       string
+        target     string
+        handler    http.HandlerFunc
+        wantStatus int
+        wantBody   string
+    }{
+        {
+            name:   "fast handler",
+            target: "/v1/movies",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(http.StatusTeapot)
+            },
+            wantStatus: http.StatusTeapot,
+        },
+        {
+            name:   "slow handler",
+            target: "/v1/movies",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                <-r.Context().Done()
+                w.Header().Set("X-Late", "true")
+                w.WriteHeader(http.StatusOK)
+                w.Write([]byte("late"))
+            },
+            wantStatus: http.StatusServiceUnavailable,
+        },
+        {
+            name:   "response started before deadline",
+            target: "/v1/movies",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                w.WriteHeader(http.StatusOK)
+                <-r.Context().Done()
+                w.Write([]byte("partial"))
+            },
+            wantStatus: http.StatusOK,
+            wantBody:   "partial",
+        },
+        {
+            name:   "long running route",
+            target: "/v1/movies?stream=true",
+            handler: func(w http.ResponseWriter, r *http.Request) {
+                time.Sleep(100 * time.Millisecond)
+                w.Write([]byte("done"))
+            },
+            wantStatus: http.StatusOK,
+            wantBody:   "done",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.requestTimeout.standard = 20 * time.Millisecond
+            app.config.requestTimeout.long = time.Second
+
+            rr := httptest.NewRecorder()
+            app.timeout(tt.handler).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+            if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+                t.Errorf("got body %q; want %q", rr.Body, tt.wantBody)
+            }
+            if rr.Code == http.StatusServiceUnavailable {
+                var resp struct {
+                    Error apiError `json:"error"`
+                }
+                decode(t, rr, &resp)
+
+                if resp.Error.Code != codeRequestTimeout || rr.Header().Get("X-Late") != "" {
+                    t.Errorf("got body %q and headers %v; want only the timeout error", rr.Body, rr.Header())
+                }
+            }
+        })
+    }
+}
+
+func TestTimeoutPanic(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.requestTimeout.standard = time.Second
+
+    h := app.recoverPanic(app.timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        panic("boom")
+    })))
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+    if rr.Code != http.StatusInternalServerError {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+    }
+}
+
+func TestTimeoutPanicAtDeadline(t *testing.T) {
+    app := newTestApplication(t)
+    app.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+    app.config.requestTimeout.standard = time.Millisecond
+
+    // The handler panics as soon as the deadline fires, racing the timeout response.
+    h := app.recoverPanic(app.timeout(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        <-r.Context().Done()
+        panic("boom")
+    })))
+
+    const requests = 200
+    before := totalPanics.Value()
+
+    for range requests {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+        if rr.Code != http.StatusInternalServerError && rr.Code != http.StatusServiceUnavailable {
+            t.Fatalf("got status %d; want %d or %d", rr.Code, http.StatusInternalServerError, http.StatusServiceUnavailable)
+        }
+    }
+
+    // Whichever response was sent, every panic is counted, after the 503s by the handlers'
+    // goroutines.
+    deadline := time.Now().Add(time.Second)
+    for totalPanics.Value()-before < requests && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+
+    if got := totalPanics.Value() - before; got != requests {
+        t.Errorf("got %d panics counted; want %d", got, requests)
+    }
+}
+
+// panickingHandler panics with err, so that the test can look for its name in the stack trace.
+func panickingHandler(err error) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        panic(err)
+    })
+}
+
+func TestRecoverPanic(t *testing.T) {
+    for _, withTimeout := range []bool{false, true} {
+        t.Run(fmt.Sprintf("timeout %v", withTimeout), func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.requestTimeout.standard = time.Second
+
+            var buf bytes.Buffer
+            app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+            // The panic value is kept as it is when it's an error.
+            err := fmt.Errorf("loading movie: %w", context.Canceled)
+
+            h := panickingHandler(err)
+            if withTimeout {
+                h = app.timeout(h)
+            }
+            h = app.recoverPanic(h)
+
+            before := totalPanics.Value()
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+            if rr.Code != http.StatusInternalServerError {
+                t.Fatalf("got status %d; want %d", rr.Code, http.StatusInternalServerError)
+            }
+            if got := totalPanics.Value() - before; got != 1 {
+                t.Errorf("got %d more panics; want 1", got)
+            }
+
+            var entry struct {
+                Msg   string `json:"msg"`
+                URI   string `json:"uri"`
+                Stack string `json:"stack"`
+            }
+            if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+                t.Fatalf("decoding log %q: %v", buf.String(), err)
+            }
+
+            if entry.Msg != "panic: loading movie: context canceled" || entry.URI != "/v1/movies" {
+                t.Errorf("got log message %q for %q", entry.Msg, entry.URI)
+            }
+            if !strings.Contains(entry.Stack, "panickingHandler") {
+                t.Errorf("the logged stack doesn't have the panicking handler:\n%s", entry.Stack)
+            }
+        })
+    }
+
+    if err := (handlerPanic{value: context.Canceled}).err(); !errors.Is(err, context.Canceled) {
+        t.Errorf("got error %v; want the panic value", err)
+    }
+    if err := (handlerPanic{value: 42}).err(); err.Error() != "42" {
+        t.Errorf("got error %q; want 42", err)
+    }
+}
+
+func TestFlushThroughMiddleware(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.requestTimeout.standard = 5 * time.Second
+
+    release := make(chan struct{})
+    var finished atomic.Bool
+
+    // The handler flushes the first line by type-asserting the writer, as streaming handlers do,
+    // and only writes the second line once the client has read the first.
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        flusher, ok := w.(http.Flusher)
+        if !ok {
+            t.Errorf("%T isn't an http.Flusher", w)
+            return
+        }
+
+        io.WriteString(w, "first\n")
+        flusher.Flush()
+
+        select {
+        case <-release:
+        case <-time.After(2 * time.Second):
+        }
+        finished.Store(true)
+
+        io.WriteString(w, "second\n")
+    })
+
+    ts := httptest.NewServer(app.metrics(app.recoverPanic(app.timeout(handler))))
+    defer ts.Close()
+
+    resp, err := ts.Client().Get(ts.URL + "/v1/movies")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    br := bufio.NewReader(resp.Body)
+
+    line, err := br.ReadString('\n')
+    if err != nil || line != "first\n" {
+        t.Fatalf("got first line %q, %v", line, err)
+    }
+    if finished.Load() {
+        t.Error("the first line only arrived with the end of the response")
+    }
+    close(release)
+
+    rest, err := io.ReadAll(br)
+    if err != nil || string(rest) != "second\n" {
+        t.Errorf("got rest %q, %v", rest, err)
+    }
+    if got := resp.TransferEncoding; len(got) != 1 || got[0] != "chunked" {
+        t.Errorf("got Transfer-Encoding %v; want chunked", got)
+    }
+}
+
+func TestMetricsResponseWriterPassthrough(t *testing.T) {
+    rr := httptest.NewRecorder()
+    mrw := newMetricsResponseWriter(rr)
+
+    // httptest.ResponseRecorder can't be hijacked.
+    if _, _, err := mrw.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+        t.Errorf("got Hijack error %v; want %v", err, http.ErrNotSupported)
+    }
+
+    n, err := io.Copy(mrw, strings.NewReader("poster bytes"))
+    if err != nil || n != 12 {
+        t.Fatalf("got %d bytes copied, %v", n, err)
+    }
+    if rr.Body.String() != "poster bytes" || !mrw.headerWritten {
+        t.Errorf("got body %q, header written %v", rr.Body, mrw.headerWritten)
+    }
+
+    mrw.Flush()
+    if !rr.Flushed {
+        t.Error("the recorder wasn't flushed")
+    }
+}
+
+func TestServerTiming(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    rr := do(t, h, http.MethodGet, "/v1/movies", token, nil)
+    if got := rr.Header().Get("Server-Timing"); got != "" {
+        t.Errorf("disabled: got Server-Timing %q", got)
+    }
+
+    app.config.serverTiming.Store(true)
+
+    rx := regexp.MustCompile(`^db;dur=\d+\.\d, app;dur=\d+\.\d$`)
+
+    for _, target := range []string{"/v1/movies", "/v1/movies?stream=true", "/v1/movies/99"} {
+        rr := do(t, h, http.MethodGet, target, token, nil)
+        if got := rr.Header().Get("Server-Timing"); !rx.MatchString(got) {
+            t.Errorf("%s: got Server-Timing %q", target, got)
+        }
+    }
+
+    header := make(http.Header)
+    setServerTiming(header, 12345*time.Microsecond, 45600*time.Microsecond)
+    if got, want := header.Get("Server-Timing"), "db;dur=12.3, app;dur=45.6"; got != want {
+        t.Errorf("got Server-Timing %q; want %q", got, want)
+    }
+}
+
+func TestEnableCORS(t *testing.T) {
+    app := newTestApplication(t)
+
+    rx, err := config.CompileOrigin("https://*.example.com")
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.config.trustedOrigins.Store(&[]*regexp.Regexp{rx})
+    app.config.cors.allowCredentials = true
+    app.config.cors.maxAge = 10 * time.Minute
+
+    h := app.routes()
+
+    tests := []struct {
+        name        string
+        method      string
+        target      string
+        origin      string
+        reqHeaders  string
+        wantStatus  int
+        wantOrigin  string
+        wantMethods string
+        wantHeaders string
+    }{
+        {
+            name: "preflight", method: http.MethodOptions, target: "/v1/movies/1", origin: "https://pr-1.example.com",
+            reqHeaders: "Authorization, X-Request-Id", wantStatus: http.StatusNoContent,
+            wantOrigin: "https://pr-1.example.com", wantMethods: "GET, PATCH, DELETE, OPTIONS", wantHeaders: "Authorization, X-Request-Id",
+        },
+        {
+            name: "preflight default headers", method: http.MethodOptions, target: "/v1/tokens/authentication", origin: "https://pr-1.example.com",
+            wantStatus: http.StatusNoContent, wantOrigin: "https://pr-1.example.com", wantMethods: "POST, OPTIONS", wantHeaders: "Authorization, Content-Type",
+        },
+        {
+            name: "preflight with trailing slash", method: http.MethodOptions, target: "/v1/movies/", origin: "https://pr-1.example.com",
+            wantStatus: http.StatusNoContent, wantOrigin: "https://pr-1.example.com", wantMethods: "GET, POST, OPTIONS", wantHeaders: "Authorization, Content-Type",
+        },
+        {
+            name: "untrusted preflight", method: http.MethodOptions, target: "/v1/movies/1", origin: "https://example.org",
+            wantStatus: http.StatusNoContent,
+        },
+        {
+            name: "simple request", method: http.MethodGet, target: "/v1/healthcheck", origin: "https://pr-1.example.com",
+            wantStatus: http.StatusOK, wantOrigin: "https://pr-1.example.com",
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            req := httptest.NewRequest(tt.method, tt.target, nil)
+            req.Header.Set("Origin", tt.origin)
+            if tt.method == http.MethodOptions {
+                req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+            }
+            if tt.reqHeaders != "" {
+                req.Header.Set("Access-Control-Request-Headers", tt.reqHeaders)
+            }
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, req)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+            }
+
+            header := rr.Header()
+            if got := header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+                t.Errorf("got Access-Control-Allow-Origin %q; want %q", got, tt.wantOrigin)
+            }
+            if got := header.Get("Access-Control-Allow-Methods"); got != tt.wantMethods {
+                t.Errorf("got Access-Control-Allow-Methods %q; want %q", got, tt.wantMethods)
+            }
+            if got := header.Get("Access-Control-Allow-Headers"); got != tt.wantHeaders {
+                t.Errorf("got Access-Control-Allow-Headers %q; want %q", got, tt.wantHeaders)
+            }
+
+            if tt.wantOrigin != "" && header.Get("Access-Control-Allow-Credentials") != "true" {
+                t.Errorf("got no Access-Control-Allow-Credentials header")
+            }
+            if tt.wantMethods != "" {
+                if header.Get("Access-Control-Max-Age") != "600" || rr.Body.Len() != 0 {
+                    t.Errorf("got Max-Age %q and body %q; want 600 and no body", header.Get("Access-Control-Max-Age"), rr.Body)
+                }
+            }
+        })
+    }
+}
+
+func TestCleanPath(t *testing.T) {
+    h := newTestApplication(t).routes()
+
+    tests := []struct {
+        name         string
+        method       string
+        target       string
+        wantLocation string
+    }{
+        {"trailing slash", http.MethodGet, "/v1/movies/", "/v1/movies"},
+        {"double slash", http.MethodGet, "//v1//movies", "/v1/movies"},
+        {"dot segments", http.MethodDelete, "/v1/movies/./1/", "/v1/movies/1"},
+        {"query kept", http.MethodGet, "/v1/movies/?page=2&sort=-year", "/v1/movies?page=2&sort=-year"},
+        {"no open redirect", http.MethodGet, "//example.com/", "/example.com"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, tt.method, tt.target, "", nil)
+
+            if rr.Code != http.StatusPermanentRedirect {
+                t.Fatalf("got status %d; want %d", rr.Code, http.StatusPermanentRedirect)
+            }
+            if got := rr.Header().Get("Location"); got != tt.wantLocation {
+                t.Errorf("got Location %q; want %q", got, tt.wantLocation)
+            }
+        })
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/healthcheck", "", nil)
+    if rr.Code != http.StatusOK {
+        t.Errorf("got status %d for a canonical path; want %d", rr.Code, http.StatusOK)
+    }
+}
+
+func TestCleanPathPostBody(t *testing.T) {
+    app := newTestApplication(t)
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    ts := httptest.NewServer(app.routes())
+    defer ts.Close()
+
+    body := `{"title": "Coco", "year": 2017, "runtime": "105 mins", "genres": ["animation", "adventure"]}`
+
+    req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/movies/", strings.NewReader(body))
+    if err != nil {
+        t.Fatal(err)
+    }
+    req.Header.Set("Authorization", "Bearer "+token)
+
+    var redirects []int
+    client := ts.Client()
+    client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+        redirects = append(redirects, req.Response.StatusCode)
+        if req.Method != http.MethodPost {
+            t.Errorf("got method %s after the redirect; want POST", req.Method)
+        }
+        return nil
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+
+    if len(redirects) != 1 || redirects[0] != http.StatusPermanentRedirect {
+        t.Errorf("got redirects %v; want one 308", redirects)
+    }
+    if resp.StatusCode != http.StatusCreated {
+        t.Errorf("got status %d; want %d", resp.StatusCode, http.StatusCreated)
+    }
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.limiter.Store(&config.LimiterConfig{Enabled: true, Rps: 0.5, Burst: 2})
+
+    h := app.rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+    tests := []struct {
+        wantStatus     int
+        wantRemaining  string
+        wantReset      string
+        wantRetryAfter string
+    }{
+        {http.StatusOK, "1", "2", ""},
+        {http.StatusOK, "0", "4", ""},
+        {http.StatusTooManyRequests, "0", "4", "2"},
+    }
+
+    for i, tt := range tests {
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+
+        if rr.Code != tt.wantStatus {
+            t.Errorf("request %d: got status %d; want %d", i+1, rr.Code, tt.wantStatus)
+        }
+
+        want := map[string]string{
+            "X-RateLimit-Limit":     "2",
+            "X-RateLimit-Remaining": tt.wantRemaining,
+            "X-RateLimit-Reset":     tt.wantReset,
+            "Retry-After":           tt.wantRetryAfter,
+        }
+        for key, value := range want {
+            if got := rr.Header().Get(key); got != value {
+                t.Errorf("request %d: got %s %q; want %q", i+1, key, got, value)
+            }
+        }
+    }
+
+    // Without the limiter no headers are set.
+    app.config.limiter.Store(&config.LimiterConfig{Enabled: false})
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/v1/movies", nil))
+    if got := rr.Header().Get("X-RateLimit-Limit"); got != "" {
+        t.Errorf("disabled: got X-RateLimit-Limit %q", got)
+    }
+}
+
+func TestRateLimitExceededBody(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.limiter.Store(&config.LimiterConfig{Enabled: true, Rps: 0.5, Burst: 2})
+    h := app.routes()
+
+    for range 2 {
+        do(t, h, http.MethodGet, "/v1/healthcheck", "", nil)
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/healthcheck", "", nil)
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+    }
+
+    // The error is an object with exactly these fields: 2 requests per 4 seconds, and the next
+    // one in 2 seconds.
+    var resp struct {
+        Error map[string]any `json:"error"`
+    }
+    decode(t, rr, &resp)
+
+    want := map[string]any{"message": "rate limit exceeded", "limit": 2.0, "window": 4.0, "retry_after": 2.0}
+    if !maps.Equal(resp.Error, want) {
+        t.Errorf("got error %v; want %v", resp.Error, want)
+    }
+    if got := rr.Header().Get("Retry-After"); got != "2" {
+        t.Errorf("got Retry-After %q; want 2", got)
+    }
+
+    // The XML representation has the same fields.
+    req := httptest.NewRequest(http.MethodGet, "/v1/healthcheck", nil)
+    req.Header.Set("Accept", "application/xml")
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+
+    wantXML := "<error><message>rate limit exceeded</message><limit>2</limit><window>4</window><retry_after>2</retry_after></error>"
+    if !strings.Contains(rr.Body.String(), wantXML) {
+        t.Errorf("got XML body %s; want it to contain %s", rr.Body, wantXML)
+    }
+}
+
+func TestAuthRateLimit(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.authLimiter.Store(&config.LimiterConfig{Enabled: true, Rps: 0.1, Burst: 2})
+    h := app.routes()
+
+    login := func(email string) *httptest.ResponseRecorder {
+        body := map[string]string{"email": email, "password": mock.FixturePassword}
+        return do(t, h, http.MethodPost, "/v1/tokens/authentication", "", body)
+    }
+
+    // The handler still gets the body read by the limiter.
+    for i := range 2 {
+        if rr := login(mock.ActivatedUserEmail); rr.Code != http.StatusCreated {
+            t.Fatalf("login %d: got status %d; body: %s", i+1, rr.Code, rr.Body)
+        }
+    }
+
+    // The email address is normalized, so changing its case doesn't get another limiter.
+    rr := login(strings.ToUpper(mock.ActivatedUserEmail))
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("third login: got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+    }
+    // The limiter refills a token every 10 seconds, so the client is told to wait up to 10 seconds
+    // depending on how long the logins took, but longer than the second at most the general
+    // limiter would ask for.
+    if got, err := strconv.Atoi(rr.Header().Get("Retry-After")); err != nil || got < 2 || got > 10 {
+        t.Errorf("got Retry-After %q; want between 2 and 10", rr.Header().Get("Retry-After"))
+    }
+
+    // Other email addresses have their own limiter.
+    if rr := login("nobody@example.com"); rr.Code != http.StatusUnauthorized {
+        t.Errorf("other email: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+
+    // Other routes aren't limited.
+    if rr := do(t, h, http.MethodGet, "/v1/healthcheck", "", nil); rr.Code != http.StatusOK {
+        t.Errorf("healthcheck: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+}
+
+func TestStripPrefix(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.urlPrefix = "/api/greenlight"
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    tests := []struct {
+        name         string
+        method       string
+        target       string
+        wantStatus   int
+        wantLocation string
+    }{
+        {"healthcheck", http.MethodGet, "/api/greenlight/v1/healthcheck", http.StatusOK, ""},
+        {"debug vars", http.MethodGet, "/api/greenlight/debug/vars", http.StatusOK, ""},
+        {"unprefixed", http.MethodGet, "/v1/healthcheck", http.StatusNotFound, ""},
+        {"root", http.MethodGet, "/", http.StatusNotFound, ""},
+        {"prefix only", http.MethodGet, "/api/greenlight", http.StatusNotFound, ""},
+        {"longer segment", http.MethodGet, "/api/greenlightx/v1/healthcheck", http.StatusNotFound, ""},
+        {"trailing slash", http.MethodGet, "/api/greenlight/v1/movies/?page=2", http.StatusPermanentRedirect, "/api/greenlight/v1/movies?page=2"},
+        {"create movie", http.MethodPost, "/api/greenlight/v1/movies", http.StatusCreated, "/api/greenlight/v1/movies/4"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            var body any
+            if tt.method == http.MethodPost {
+                body = map[string]any{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation"}}
+            }
+
+            rr := do(t, h, tt.method, tt.target, token, body)
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+            if got := rr.Header().Get("Location"); got != tt.wantLocation {
+                t.Errorf("got Location %q; want %q", got, tt.wantLocation)
+            }
+        })
+    }
+
+    // Pagination links keep the prefix.
+    rr := do(t, h, http.MethodGet, "/api/greenlight/v1/movies?page_size=1", token, nil)
+    if got := rr.Header().Get("Link"); !strings.HasPrefix(got, "</api/greenlight/v1/movies?page=1&page_size=1>") {
+        t.Errorf("got Link %s; want links under the prefix", got)
+    }
+}
+
+func TestRequireDB(t *testing.T) {
+    app := newTestApplication(t)
+    app.readinessChecks = map[string]func(ctx context.Context) error{
+        "database": func(ctx context.Context) error {
+            if !app.dbReady.Load() {
+                return errors.New("not connected yet")
+            }
+            return nil
+        },
+    }
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    app.dbReady.Store(false)
+
+    rr := do(t, h, http.MethodGet, "/v1/movies", token, nil)
+    if rr.Code != http.StatusServiceUnavailable {
+        t.Errorf("before connecting: got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+    }
+    if got := rr.Header().Get("Retry-After"); got != "5" {
+        t.Errorf("got Retry-After %q; want 5", got)
+    }
+
+    if rr := do(t, h, http.MethodGet, "/v1/healthcheck", "", nil); rr.Code != http.StatusOK {
+        t.Errorf("healthcheck before connecting: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+    if rr := do(t, h, http.MethodGet, "/v1/healthcheck/ready", "", nil); rr.Code != http.StatusServiceUnavailable {
+        t.Errorf("readiness before connecting: got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+    }
+
+    app.dbReady.Store(true)
+
+    if rr := do(t, h, http.MethodGet, "/v1/movies", token, nil); rr.Code != http.StatusOK {
+        t.Errorf("after connecting: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+    if rr := do(t, h, http.MethodGet, "/v1/healthcheck/ready", "", nil); rr.Code != http.StatusOK {
+        t.Errorf("readiness after connecting: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+}
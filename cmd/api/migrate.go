@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/migrations"
+)
+
+// runMigrateCommand runs the -migrate command against the database: "up" applies all pending
+// migrations, "down" reverts the latest one and "status" prints the migrations to out.
+func runMigrateCommand(ctx context.Context, pool *pgxpool.Pool, command string, out io.Writer) error {
+    migrator := data.Migrator{Pool: pool, FS: migrations.FS}
+
+    switch command {
+    case "up":
+        applied, err := migrator.Up(ctx)
+        for _, m := range applied {
+            fmt.Fprintf(out, "applied %06d_%s\n", m.Version, m.Name)
+        }
+        if err != nil {
+            return err
+        }
+        if len(applied) == 0 {
+            fmt.Fprintln(out, "no change")
+        }
+
+    case "down":
+        reverted, err := migrator.Down(ctx)
+        if err != nil {
+            return err
+        }
+        if reverted == nil {
+            fmt.Fprintln(out, "no change")
+            return nil
+        }
+        fmt.Fprintf(out, "reverted %06d_%s\n", reverted.Version, reverted.Name)
+
+    case "status":
+        version, all, err := migrator.Status(ctx)
+        if err != nil {
+            return err
+        }
+
+        fmt.Fprintf(out, "version: %d\n\n", version)
+
+        tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+        fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+        for _, m := range all {
+            fmt.Fprintf(tw, "%06d\t%s\t%t\n", m.Version, m.Name, m.Applied)
+        }
+        return tw.Flush()
+
+    default:
+        return fmt.Errorf("invalid -migrate command %q, must be up, down or status", command)
+    }
+
+    return nil
+}
+
+// autoMigrate applies all pending migrations when the application starts. It refuses to run in
+// production, where migrations must be applied deliberately with -migrate=up.
+func autoMigrate(ctx context.Context, pool *pgxpool.Pool, env string, logger *slog.Logger) error {
+    if env == "production" {
+        return fmt.Errorf("-auto-migrate can't be used in the production environment")
+    }
+
+    applied, err := data.Migrator{Pool: pool, FS: migrations.FS}.Up(ctx)
+    for _, m := range applied {
+        logger.Info("migration applied", "version", m.Version, "name", m.Name)
+    }
+
+    return err
+}
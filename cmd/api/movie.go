@@ -1,9 +1,16 @@
 package main
 
 import (
+	"compress/gzip"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"greenlight.zzh.net/internal/data"
 	"greenlight.zzh.net/internal/validator"
@@ -30,16 +37,47 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
         Genres:  input.Genres,
     }
 
+    genres, err := app.movieGenres(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
     v := validator.New()
 
-    if data.ValidateMovie(v, movie); !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+    allowDuplicate := app.readBool(r.URL.Query(), "allow_duplicate", v)
+
+    if data.ValidateMovie(v, movie, genres); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
         return
     }
 
-    err = app.models.Movie.Insert(movie)
+    // A movie of the same year with a similar title is most likely the same movie created
+    // twice, so it's only created once the client confirms it with allow_duplicate=true.
+    if app.config.titleSimilarity > 0 && (allowDuplicate == nil || !*allowDuplicate) {
+        duplicates, err := app.models.Movie.FindPotentialDuplicates(r.Context(), movie.Title, movie.Year, app.config.titleSimilarity)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+            return
+        }
+
+        if len(duplicates) > 0 {
+            app.duplicateMovieResponse(w, r, duplicates)
+            return
+        }
+    }
+
+    // The similarity check leaves exact duplicates to the unique constraint on the title and
+    // year, which also catches the ones created concurrently or with allow_duplicate=true.
+    err = app.models.Movie.Insert(r.Context(), movie)
     if err != nil {
-        app.serverErrorResponse(w, r, err)
+        var duplicate *data.DuplicateMovieError
+        switch {
+        case errors.As(err, &duplicate):
+            app.movieExistsResponse(w, r, duplicate.ID)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
         return
     }
 
@@ -47,14 +85,16 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
     // at which URL they can find the newly-created resource. We make an empty http.Header map and
     // add a new Location header, interpolating the ID for our new movie in the URL.
     headers := make(http.Header)
-    headers.Set("Location", fmt.Sprintf("/v1/movies/%d", movie.ID))
+    headers.Set("Location", app.externalURL(fmt.Sprintf("%s/movies/%d", app.contextGetAPIVersion(r).prefix(), movie.ID), nil))
 
-    err = app.writeJSON(w, http.StatusCreated, envelope{"movie": movie}, headers)
+    err = app.writeResponse(w, r, http.StatusCreated, envelope{"movie": movie}, headers)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
 }
 
+// showMovieHandler sends a movie, from app.movieCache if it's there. The ETag header is the
+// movie's version, so that a client can revalidate its copy with If-None-Match.
 func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request) {
     id, err := app.readIDParam(r)
     if err != nil {
@@ -62,7 +102,27 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
         return
     }
 
-    movie, err := app.models.Movie.Get(id)
+    entry, generation, ok := app.movieCache.get(id)
+    if ok {
+        if notModified(w, r, versionETag(int64(entry.version))) {
+            return
+        }
+
+        err = app.writeCachedMovie(w, r, entry)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    // Concurrent requests for the movie share one query, except conditional ones, which are
+    // cheap once answered with 304 Not Modified.
+    reads := app.movieReads
+    if r.Header.Get("If-None-Match") != "" {
+        reads = nil
+    }
+
+    movie, err := reads.get(r.Context(), id, app.models.Movie.Get)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
@@ -73,7 +133,17 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
         return
     }
 
-    err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
+    err = app.movieCache.set(movie, generation)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    if notModified(w, r, versionETag(int64(movie.Version))) {
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
@@ -86,7 +156,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
-    movie, err := app.models.Movie.Get(id)
+    movie, err := app.models.Movie.Get(r.Context(), id)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
@@ -97,54 +167,172 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
-    var input struct {
-        Title   *string       `json:"title"`
-        Year    *int32        `json:"year"`
-        Runtime *data.Runtime `json:"runtime"`
-        Genres  []string      `json:"genres"`
+    if app.preconditionFailed(w, r, int64(movie.Version)) {
+        return
     }
 
-    err = app.readJSON(w, r, &input)
+    // A JSON merge patch can clear a field with null; in a plain JSON body null or a missing
+    // key both leave the field alone.
+    var update *movieUpdate
+    if isMergePatch(r) {
+        err = app.readMovieMergePatch(w, r, movie)
+    } else {
+        update, err = app.readMovieUpdate(w, r)
+    }
     if err != nil {
         app.badRequestResponse(w, r, err)
         return
     }
 
-    if input.Title != nil {
-        movie.Title = *input.Title
+    genres, err := app.movieGenres(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    // Genre operations change the genres the movie has when it's updated. If another request
+    // changed the movie meanwhile, they're applied again to the movie as it is now rather than
+    // failing with an edit conflict, unless the client made the update conditional on the
+    // version it read.
+    conditional := r.Header.Get("If-Match") != "" || r.Header.Get("X-Expected-Version") != ""
+    retry := update != nil && update.relative() && !conditional
+
+    for attempt := 1; ; attempt++ {
+        v := validator.New()
+
+        if update != nil {
+            update.apply(movie, v)
+        }
+
+        if data.ValidateMovie(v, movie, genres); !v.Valid() {
+            app.failedValidationResponse(w, r, v)
+            return
+        }
+
+        err = app.models.Movie.Update(r.Context(), movie)
+        if errors.Is(err, data.ErrEditConflict) && retry && attempt < movieUpdateAttempts {
+            // Read the movie from the primary, which a replica may not have caught up with yet.
+            movie, err = app.models.Movie.Get(data.UsePrimary(r.Context()), id)
+            if err == nil {
+                continue
+            }
+        }
+        if err != nil {
+            var duplicate *data.DuplicateMovieError
+            switch {
+            case errors.Is(err, data.ErrRecordNotFound):
+                app.notFoundResponse(w, r)
+            case errors.Is(err, data.ErrEditConflict):
+                app.editConflictResponse(w, r)
+            case errors.As(err, &duplicate):
+                app.movieExistsResponse(w, r, duplicate.ID)
+            default:
+                app.serverErrorResponse(w, r, err)
+            }
+            return
+        }
+
+        break
+    }
+
+    app.movieCache.invalidate(id)
+    app.movieReads.forget(id)
+
+    w.Header().Set("ETag", versionETag(int64(movie.Version)))
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"movie": movie}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// movieUpdateAttempts is how many times updateMovieHandler tries to apply genre operations to a
+// movie which other requests keep changing.
+const movieUpdateAttempts = 3
+
+// movieUpdate holds the fields to change of a plain JSON request body. The fields which are
+// missing or null are left alone. GenresAdd and GenresRemove change the genres the movie has,
+// so that an editor adding a genre doesn't have to send every other genre, and doesn't drop a
+// genre another editor has just added.
+type movieUpdate struct {
+    Title        *string       `json:"title"`
+    Year         *int32        `json:"year"`
+    Runtime      *data.Runtime `json:"runtime"`
+    Genres       []string      `json:"genres"`
+    GenresAdd    []string      `json:"genres_add"`
+    GenresRemove []string      `json:"genres_remove"`
+}
+
+// readMovieUpdate reads the fields to change from a plain JSON request body.
+func (app *application) readMovieUpdate(w http.ResponseWriter, r *http.Request) (*movieUpdate, error) {
+    var input movieUpdate
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        return nil, err
+    }
+
+    return &input, nil
+}
+
+// relative reports whether the update has genre operations, which apply to the current genres
+// of the movie rather than replace them.
+func (u *movieUpdate) relative() bool {
+    return u.GenresAdd != nil || u.GenresRemove != nil
+}
+
+// apply sets the fields of the update on movie. The genres of GenresRemove are removed and those
+// of GenresAdd appended, each regardless of case; adding a genre the movie has or removing one
+// it doesn't have changes nothing. The errors of the operations themselves are added to v, and
+// the resulting genres are left to ValidateMovie.
+func (u *movieUpdate) apply(movie *data.Movie, v *validator.Validator) {
+    if u.Title != nil {
+        movie.Title = *u.Title
     }
-    if input.Year != nil {
-        movie.Year = *input.Year
+    if u.Year != nil {
+        movie.Year = *u.Year
     }
-    if input.Runtime != nil {
-        movie.Runtime = *input.Runtime
+    if u.Runtime != nil {
+        movie.Runtime = *u.Runtime
     }
-    if input.Genres != nil {
-        movie.Genres = input.Genres // Note that we don't need to dereference a slice.
+    if u.Genres != nil {
+        movie.Genres = u.Genres // Note that we don't need to dereference a slice.
     }
 
-    v := validator.New()
+    if !u.relative() {
+        return
+    }
 
-    if data.ValidateMovie(v, movie); !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+    if u.Genres != nil {
+        v.AddError("genres", "must not be provided with genres_add or genres_remove")
         return
     }
 
-    err = app.models.Movie.Update(movie)
-    if err != nil {
-        switch {
-        case errors.Is(err, data.ErrEditConflict):
-            app.editConflictResponse(w, r)
-        default:
-            app.serverErrorResponse(w, r, err)
+    for _, genre := range u.GenresRemove {
+        if containsFold(u.GenresAdd, genre) {
+            v.AddErrorf("genres_remove", "must not contain %s, which is in genres_add", genre)
+            return
         }
-        return
     }
 
-    err = app.writeJSON(w, http.StatusOK, envelope{"movie": movie}, nil)
-    if err != nil {
-        app.serverErrorResponse(w, r, err)
+    genres := slices.DeleteFunc(slices.Clone(movie.Genres), func(genre string) bool {
+        return containsFold(u.GenresRemove, genre)
+    })
+
+    for _, genre := range u.GenresAdd {
+        if !containsFold(genres, genre) {
+            genres = append(genres, genre)
+        }
     }
+
+    movie.Genres = genres
+}
+
+// containsFold reports whether s is in list regardless of case.
+func containsFold(list []string, s string) bool {
+    return slices.ContainsFunc(list, func(e string) bool {
+        return strings.EqualFold(e, s)
+    })
 }
 
 func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Request) {
@@ -154,27 +342,58 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
         return
     }
 
-    err = app.models.Movie.Delete(id)
+    // The records referring to the movie are deleted with it as configured, unless the force
+    // query parameter says otherwise.
+    v := validator.New()
+
+    cascade := app.config.cascadeDeletes
+    if force := app.readBool(r.URL.Query(), "force", v); force != nil {
+        cascade = *force
+    }
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    // The movie is dropped from the cache even if it wasn't found, as it may have been deleted
+    // by another instance.
+    err = app.models.Movie.Delete(r.Context(), id, cascade)
+    app.movieCache.invalidate(id)
+    app.movieReads.forget(id)
     if err != nil {
+        var referencedError *data.MovieReferencedError
+
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
             app.notFoundResponse(w, r)
+        case errors.As(err, &referencedError):
+            app.movieReferencedResponse(w, r, referencedError.Dependents)
         default:
             app.serverErrorResponse(w, r, err)
         }
         return
     }
 
-    err = app.writeJSON(w, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
+    // The database poster store removes the poster together with the movie, but other backends
+    // don't, so remove it explicitly. The movie is already gone, so a failure is only logged.
+    err = app.models.Poster.Delete(r.Context(), id)
+    if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+        app.logError(r, err)
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "movie successfully deleted"}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
 }
 
+// movieSortSafeList are the sort values of GET /v1/movies, each column in both directions.
+var movieSortSafeList = []string{"id", "title", "year", "runtime", "created_at", "updated_at", "-id", "-title", "-year", "-runtime", "-created_at", "-updated_at"}
+
 func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request) {
     var input struct {
-        Title  string
-        Genres []string
+        data.MovieListParams
         data.Filter
     }
 
@@ -183,26 +402,258 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
     qs := r.URL.Query()
 
     input.Title = app.readString(qs, "title", "")
-    input.Genres = app.readCSV(qs, "genres", []string{})
+    input.Genres = app.readCSVUnique(qs, "genres", []string{}, v)
+
+    // By default a movie must have all the genres; genres_match=any matches any of them.
+    genresMatch := app.readString(qs, "genres_match", "all")
+    v.Check(validator.PermittedValue(genresMatch, "all", "any"), "genres_match", "must be all or any")
+    input.MatchAnyGenre = genresMatch == "any"
+
+    input.UpdatedSince = app.readDate(qs, "updated_since", v)
+
+    // Date windows include their start and exclude their end, e.g. created_after=2024-01-01 and
+    // created_before=2024-01-02 for the movies added on the 1st of January, UTC.
+    input.CreatedAfter = app.readDate(qs, "created_after", v)
+    input.CreatedBefore = app.readDate(qs, "created_before", v)
+    input.UpdatedAfter = app.readDate(qs, "updated_after", v)
+    input.UpdatedBefore = app.readDate(qs, "updated_before", v)
+    data.ValidateMovieListParams(v, input.MovieListParams)
+
+    // The page sizes are read once, so that a reload can't change them halfway.
+    pageSizes := app.config.lists.Load().Movies
 
     input.Filter.Page = app.readInt(qs, "page", 1, v)
-    input.Filter.PageSize = app.readInt(qs, "page_size", 20, v)
+    input.Filter.DefaultPageSize = pageSizes.Default
+    input.Filter.MaxPageSize = pageSizes.Max
+    input.Filter.PageSize = app.readInt(qs, "page_size", input.Filter.DefaultPageSize, v)
     input.Filter.Sort = app.readString(qs, "sort", "id")
-    input.Filter.SortSafeList = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+    input.Filter.SortSafeList = movieSortSafeList
+    input.Filter.MaxOffset = app.config.maxListOffset
+
+    // Counting every matching movie is the slowest part of the query, so clients which don't
+    // need the total can opt out with include_total=false and get has_more instead.
+    if includeTotal := app.readBool(qs, "include_total", v); includeTotal != nil {
+        input.Filter.SkipTotal = !*includeTotal
+    }
 
     if data.ValidateFilter(v, input.Filter); !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    // The Last-Modified header is the last change to any movie matching the filter, on any
+    // page. Deleting a movie doesn't change it.
+    lastUpdated, err := app.models.Movie.LastUpdated(r.Context(), input.MovieListParams)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    if notModifiedSince(w, r, lastUpdated) {
+        return
+    }
+
+    if qs.Get("stream") == "true" {
+        app.streamMovies(w, r, input.MovieListParams, input.Filter)
         return
     }
 
-    movies, metadata, err := app.models.Movie.GetAll(input.Title, input.Genres, input.Filter)
+    movies, metadata, err := app.models.Movie.GetAll(r.Context(), input.MovieListParams, input.Filter)
     if err != nil {
         app.serverErrorResponse(w, r, err)
         return
     }
 
-    err = app.writeJSON(w, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, nil)
+    headers := make(http.Header)
+    if links := app.paginationLinks(r.URL, metadata); links != "" {
+        headers.Set("Link", links)
+    }
+
+    metadata.Links = app.metadataLinks(r.URL, metadata)
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": movies, "metadata": metadata}, headers)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
 }
+
+
+// streamFlushInterval is the number of movies written between flushes in streamMovies.
+const streamFlushInterval = 50
+
+// streamMovies writes the movies as newline-delimited JSON, one {"movie": ...} object per line,
+// as the rows are scanned from the database, followed by a trailing {"metadata": ...} object.
+// The total number of matching records is also sent in the X-Total-Count header, unless
+// filter.SkipTotal is set.
+func (app *application) streamMovies(w http.ResponseWriter, r *http.Request, params data.MovieListParams, filter data.Filter) {
+    rc := http.NewResponseController(w)
+    enc := json.NewEncoder(w)
+
+    started := false
+    written := 0
+
+    // The response headers can only be sent once we know the total, which is returned with the
+    // first row.
+    start := func(totalRecords int) {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        if totalRecords >= 0 {
+            w.Header().Set("X-Total-Count", strconv.Itoa(totalRecords))
+        }
+        w.WriteHeader(http.StatusOK)
+        started = true
+    }
+
+    metadata, err := app.models.Movie.GetAllIter(r.Context(), params, filter, func(movie *data.Movie, totalRecords int) error {
+        if !started {
+            start(totalRecords)
+        }
+
+        err := enc.Encode(envelope{"movie": movie})
+        if err != nil {
+            return err
+        }
+
+        // Flushing is best-effort; a write error from a disconnected client will surface from
+        // the next Encode() call anyway.
+        written++
+        if written%streamFlushInterval == 0 {
+            rc.Flush()
+        }
+
+        return nil
+    })
+    if err != nil {
+        // Once the status code has been sent we can't send an error response any more, so all
+        // we can do is log the error and stop writing.
+        if started {
+            app.logError(r, err)
+            return
+        }
+
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    if !started {
+        if filter.SkipTotal {
+            start(-1)
+        } else {
+            start(0)
+        }
+    }
+
+    metadata.Links = app.metadataLinks(r.URL, metadata)
+
+    err = enc.Encode(envelope{"metadata": metadata})
+    if err != nil {
+        app.logError(r, err)
+        return
+    }
+
+    rc.Flush()
+}
+// exportMoviesHandler streams every movie as newline-delimited JSON for data pipelines: one
+// {"movie": ...} object per line, in order of updated_at, then a trailing {"export": ...} object
+// with the number of movies and next_since, the since of the next incremental export. since is
+// inclusive because updated_at is only precise to the second, so the movies changed during the
+// second of next_since are exported again; consumers keep the highest version of each id. The
+// response is gzipped if the client accepts it.
+func (app *application) exportMoviesHandler(w http.ResponseWriter, r *http.Request) {
+    var params data.MovieListParams
+
+    v := validator.New()
+
+    params.UpdatedSince = app.readDate(r.URL.Query(), "since", v)
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    rc := http.NewResponseController(w)
+
+    var (
+        out     io.Writer = w
+        gz      *gzip.Writer
+        started bool
+        count   int
+    )
+
+    // The headers are sent with the first movie, so that a query which fails at once still gets
+    // an error response.
+    start := func() {
+        w.Header().Set("Content-Type", "application/x-ndjson")
+        w.Header().Add("Vary", "Accept-Encoding")
+        if acceptsGzip(r) {
+            w.Header().Set("Content-Encoding", "gzip")
+            gz = gzip.NewWriter(w)
+            out = gz
+        }
+        w.WriteHeader(http.StatusOK)
+        started = true
+    }
+
+    // Flushing is best-effort, as in streamMovies. The gzip writer is flushed first so that
+    // what has been compressed so far reaches the client.
+    flush := func() {
+        if gz != nil {
+            gz.Flush()
+        }
+        rc.Flush()
+    }
+
+    nextSince := params.UpdatedSince
+
+    // The query runs with the request context, which is cancelled when the client disconnects,
+    // and a write to a disconnected client fails, so either way the export stops.
+    err := app.models.Movie.ForEach(r.Context(), params, func(movie *data.Movie) error {
+        if !started {
+            start()
+        }
+
+        err := json.NewEncoder(out).Encode(envelope{"movie": movie})
+        if err != nil {
+            return err
+        }
+
+        count++
+        nextSince = &movie.UpdatedAt
+
+        if count%streamFlushInterval == 0 {
+            flush()
+        }
+
+        return nil
+    })
+    if err != nil {
+        switch {
+        case r.Context().Err() != nil:
+            // The client went away or the long request timeout passed; nobody is listening.
+        case started:
+            app.logError(r, err)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    if !started {
+        start()
+    }
+
+    export := map[string]any{"count": count}
+    if nextSince != nil {
+        export["next_since"] = nextSince.Format(time.RFC3339)
+    }
+
+    err = json.NewEncoder(out).Encode(envelope{"export": export})
+    if err == nil && gz != nil {
+        err = gz.Close()
+    }
+    if err != nil {
+        app.logError(r, err)
+        return
+    }
+
+    rc.Flush()
+}
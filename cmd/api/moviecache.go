@@ -0,0 +1,176 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+var (
+    totalMovieCacheHits   = expvar.NewInt("total_movie_cache_hits")
+    totalMovieCacheMisses = expvar.NewInt("total_movie_cache_misses")
+)
+
+// movieCache is a size-bounded LRU cache of the responses of showMovieHandler, keyed by movie
+// ID. It only saves the database query: the route's authentication and permission checks run
+// before the handler as usual. An entry is dropped when its TTL has passed and when the movie is
+// updated or deleted through this process. A nil *movieCache caches nothing.
+type movieCache struct {
+    mu         sync.Mutex
+    size       int
+    ttl        time.Duration
+    entries    map[int64]*list.Element // values are *movieCacheEntry
+    lru        *list.List              // most recently used at the front
+    generation uint64                  // incremented by every invalidation
+}
+
+type movieCacheEntry struct {
+    id      int64
+    body    []byte // the JSON response, envelope{"movie": movie}
+    version int32
+    expires time.Time
+}
+
+// newMovieCache returns a cache holding up to size movies for ttl.
+func newMovieCache(size int, ttl time.Duration) *movieCache {
+    return &movieCache{
+        size:    size,
+        ttl:     ttl,
+        entries: make(map[int64]*list.Element),
+        lru:     list.New(),
+    }
+}
+
+// get returns the cached entry of the movie with the given id, counting the hit or miss. The
+// returned generation is passed to set, so that a movie read before an invalidation isn't cached
+// after it.
+func (c *movieCache) get(id int64) (*movieCacheEntry, uint64, bool) {
+    if c == nil {
+        return nil, 0, false
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    elem, ok := c.entries[id]
+    if ok {
+        entry := elem.Value.(*movieCacheEntry)
+        if time.Now().Before(entry.expires) {
+            c.lru.MoveToFront(elem)
+            totalMovieCacheHits.Add(1)
+            return entry, c.generation, true
+        }
+
+        c.lru.Remove(elem)
+        delete(c.entries, id)
+    }
+
+    totalMovieCacheMisses.Add(1)
+    return nil, c.generation, false
+}
+
+// set caches movie, evicting the least recently used movie if the cache is full. Nothing is
+// cached if there has been an invalidation since the get which returned generation, because
+// movie may predate it.
+func (c *movieCache) set(movie *data.Movie, generation uint64) error {
+    if c == nil {
+        return nil
+    }
+
+    body, err := json.Marshal(envelope{"movie": movie})
+    if err != nil {
+        return err
+    }
+
+    entry := &movieCacheEntry{
+        id:      movie.ID,
+        body:    append(body, '\n'),
+        version: movie.Version,
+        expires: time.Now().Add(c.ttl),
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if generation != c.generation {
+        return nil
+    }
+
+    if elem, ok := c.entries[movie.ID]; ok {
+        elem.Value = entry
+        c.lru.MoveToFront(elem)
+        return nil
+    }
+
+    if c.lru.Len() >= c.size {
+        oldest := c.lru.Back()
+        c.lru.Remove(oldest)
+        delete(c.entries, oldest.Value.(*movieCacheEntry).id)
+    }
+
+    c.entries[movie.ID] = c.lru.PushFront(entry)
+
+    return nil
+}
+
+// invalidate drops the movie with the given id.
+func (c *movieCache) invalidate(id int64) {
+    if c == nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.generation++
+
+    if elem, ok := c.entries[id]; ok {
+        c.lru.Remove(elem)
+        delete(c.entries, id)
+    }
+}
+
+// invalidateAll drops all the movies, for changes affecting many of them such as renaming a
+// genre.
+func (c *movieCache) invalidateAll() {
+    if c == nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.generation++
+    clear(c.entries)
+    c.lru.Init()
+}
+
+// writeCachedMovie sends a movie cached by movieCache. The cached JSON is sent as is when the
+// response is compact JSON which the API version doesn't reshape, and is decoded and sent with
+// writeResponse() otherwise.
+func (app *application) writeCachedMovie(w http.ResponseWriter, r *http.Request, entry *movieCacheEntry) error {
+    contentType, ok := negotiateContentType(r.Header.Get("Accept"))
+    if ok && contentType == contentTypeJSON && !app.prettyPrint(r) && app.contextGetAPIVersion(r).shape == nil {
+        w.Header().Add("Vary", "Accept")
+        w.Header().Set("Content-Type", contentTypeJSON)
+        w.WriteHeader(http.StatusOK)
+        w.Write(entry.body)
+        return nil
+    }
+
+    var cached struct {
+        Movie data.Movie `json:"movie"`
+    }
+
+    err := json.Unmarshal(entry.body, &cached)
+    if err != nil {
+        return err
+    }
+
+    return app.writeResponse(w, r, http.StatusOK, envelope{"movie": &cached.Movie}, nil)
+}
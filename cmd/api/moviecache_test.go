@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestMovieCache(t *testing.T) {
+    c := newMovieCache(2, time.Minute)
+
+    for id := int64(1); id <= 3; id++ {
+        _, generation, _ := c.get(id)
+        if err := c.set(&data.Movie{ID: id, Title: "Movie", Version: 1}, generation); err != nil {
+            t.Fatal(err)
+        }
+        if id == 2 {
+            c.get(1) // makes 2 the least recently used
+        }
+    }
+
+    for id, want := range map[int64]bool{1: true, 2: false, 3: true} {
+        if _, _, ok := c.get(id); ok != want {
+            t.Errorf("movie %d: got cached %v; want %v", id, ok, want)
+        }
+    }
+
+    // A movie read before an invalidation isn't cached after it.
+    _, generation, _ := c.get(4)
+    c.invalidate(1)
+    if err := c.set(&data.Movie{ID: 4, Version: 1}, generation); err != nil {
+        t.Fatal(err)
+    }
+    if _, _, ok := c.get(4); ok {
+        t.Error("got movie 4 cached after an invalidation")
+    }
+    if _, _, ok := c.get(1); ok {
+        t.Error("got movie 1 cached after its invalidation")
+    }
+
+    c.invalidateAll()
+    if _, _, ok := c.get(3); ok {
+        t.Error("got movie 3 cached after invalidating all")
+    }
+
+    expired := newMovieCache(2, time.Nanosecond)
+    _, generation, _ = expired.get(1)
+    if err := expired.set(&data.Movie{ID: 1, Version: 1}, generation); err != nil {
+        t.Fatal(err)
+    }
+    time.Sleep(time.Millisecond)
+    if _, _, ok := expired.get(1); ok {
+        t.Error("got an expired movie")
+    }
+}
+
+func TestShowMovieHandlerCache(t *testing.T) {
+    app := newTestApplication(t)
+    app.movieCache = newMovieCache(10, time.Minute)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    title := func(rr *httptest.ResponseRecorder) string {
+        t.Helper()
+
+        if rr.Code != http.StatusOK {
+            t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+        }
+
+        var resp struct {
+            Movie data.Movie `json:"movie"`
+        }
+        decode(t, rr, &resp)
+
+        return resp.Movie.Title
+    }
+
+    hits, misses := totalMovieCacheHits.Value(), totalMovieCacheMisses.Value()
+
+    first := do(t, h, http.MethodGet, "/v1/movies/1", token, nil)
+    if got := title(first); got != "Moana" {
+        t.Fatalf("got title %q; want Moana", got)
+    }
+
+    // A change which doesn't go through the handlers isn't seen while the movie is cached.
+    movie, err := app.models.Movie.Get(context.Background(), 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    movie.Title = "Vaiana"
+    if err = app.models.Movie.Update(context.Background(), movie); err != nil {
+        t.Fatal(err)
+    }
+
+    second := do(t, h, http.MethodGet, "/v1/movies/1", token, nil)
+    if second.Body.String() != first.Body.String() {
+        t.Errorf("got cached body %s; want %s", second.Body, first.Body)
+    }
+    if got, want := totalMovieCacheHits.Value()-hits, int64(1); got != want {
+        t.Errorf("got %d hits; want %d", got, want)
+    }
+    if got, want := totalMovieCacheMisses.Value()-misses, int64(1); got != want {
+        t.Errorf("got %d misses; want %d", got, want)
+    }
+
+    // Other representations and revalidation are served from the cache too.
+    req := httptest.NewRequest(http.MethodGet, "/v1/movies/1?pretty=true", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("Accept", contentTypeXML)
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    if !strings.Contains(rr.Body.String(), "<title>Moana</title>") {
+        t.Errorf("got XML body %s", rr.Body)
+    }
+
+    req = httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("If-None-Match", first.Header().Get("ETag"))
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    if rr.Code != http.StatusNotModified {
+        t.Errorf("If-None-Match: got status %d; want %d", rr.Code, http.StatusNotModified)
+    }
+
+    // Authorization still runs for cached movies.
+    if rr := do(t, h, http.MethodGet, "/v1/movies/1", "", nil); rr.Code != http.StatusUnauthorized {
+        t.Errorf("anonymous: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+
+    // A PATCH invalidates the movie, so the next GET has the new version.
+    rr = do(t, h, http.MethodPatch, "/v1/movies/1", token, map[string]any{"year": 2017})
+    if rr.Code != http.StatusOK {
+        t.Fatalf("update: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    third := do(t, h, http.MethodGet, "/v1/movies/1", token, nil)
+    if got := title(third); got != "Vaiana" {
+        t.Errorf("after update: got title %q; want Vaiana", got)
+    }
+    if got, want := third.Header().Get("ETag"), versionETag(3); got != want {
+        t.Errorf("after update: got ETag %s; want %s", got, want)
+    }
+
+    rr = do(t, h, http.MethodDelete, "/v1/movies/1", token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("delete: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    if rr := do(t, h, http.MethodGet, "/v1/movies/1", token, nil); rr.Code != http.StatusNotFound {
+        t.Errorf("after delete: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+}
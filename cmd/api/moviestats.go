@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+func (app *application) showMovieStatsHandler(w http.ResponseWriter, r *http.Request) {
+    stats, err := app.models.Stats.Get(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"stats": stats}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// refreshMovieStatsHandler refreshes the movie statistics now rather than at the next
+// -movie-stats-refresh-interval tick, and responds with the refreshed statistics.
+func (app *application) refreshMovieStatsHandler(w http.ResponseWriter, r *http.Request) {
+    err := app.models.Stats.Refresh(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    // Read the statistics from the primary, which a replica may not have caught up with yet.
+    stats, err := app.models.Stats.Get(data.UsePrimary(r.Context()))
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"stats": stats}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// refreshMovieStats refreshes the movie statistics every -movie-stats-refresh-interval until
+// stop is closed. A refresh which fails is logged and retried at the next tick.
+func (app *application) refreshMovieStats(stop <-chan struct{}) {
+    ticker := time.NewTicker(app.config.statsRefresh)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            if !app.dbReady.Load() {
+                continue
+            }
+
+            start := time.Now()
+
+            err := app.models.Stats.Refresh(context.Background())
+            if err != nil {
+                app.logger.Error("failed to refresh the movie statistics", "error", err)
+                continue
+            }
+
+            app.logger.Debug("movie statistics refreshed", "duration", time.Since(start).String())
+        }
+    }
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestMovieStatsHandlers(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+    writer := authToken(t, app, mock.ActivatedUserID)
+
+    stats := func(t *testing.T) data.MovieStats {
+        t.Helper()
+
+        rr := do(t, h, http.MethodGet, "/v1/movies/stats", writer, nil)
+        if rr.Code != http.StatusOK {
+            t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+        }
+
+        var resp struct {
+            Stats data.MovieStats `json:"stats"`
+        }
+        decode(t, rr, &resp)
+
+        return resp.Stats
+    }
+
+    got := stats(t)
+    if got.Total != 3 || got.RefreshedAt.IsZero() {
+        t.Errorf("got total %d refreshed at %v; want 3 and a refresh time", got.Total, got.RefreshedAt)
+    }
+
+    wantGenres := []data.GenreCount{
+        {Genre: "action", Movies: 2},
+        {Genre: "adventure", Movies: 2},
+        {Genre: "animation", Movies: 1},
+        {Genre: "comedy", Movies: 1},
+    }
+    if !reflect.DeepEqual(got.ByGenre, wantGenres) {
+        t.Errorf("got genres %v; want %v", got.ByGenre, wantGenres)
+    }
+    if wantDecades := []data.DecadeCount{{Decade: 2010, Movies: 3}}; !reflect.DeepEqual(got.ByDecade, wantDecades) {
+        t.Errorf("got decades %v; want %v", got.ByDecade, wantDecades)
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/movies", writer, map[string]any{
+        "title": "Casablanca", "year": 1942, "runtime": "102 mins", "genres": []string{"drama"},
+    })
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("create: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    // The statistics only change when they are refreshed.
+    if got := stats(t); got.Total != 3 {
+        t.Errorf("got total %d before the refresh; want 3", got.Total)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies/stats/refresh", writer, nil)
+    if rr.Code != http.StatusForbidden {
+        t.Errorf("refresh without permission: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies/1/refresh", admin, nil)
+    if rr.Code != http.StatusNotFound {
+        t.Errorf("refresh of a movie: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/movies/stats/refresh", admin, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("refresh: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    got = stats(t)
+    if got.Total != 4 || got.ByDecade[0] != (data.DecadeCount{Decade: 1940, Movies: 1}) {
+        t.Errorf("got total %d and decades %v after the refresh; want 4, starting with 1940", got.Total, got.ByDecade)
+    }
+}
+
+func TestRefreshMovieStats(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.statsRefresh = 10 * time.Millisecond
+    app.dbReady.Store(true)
+
+    before, err := app.models.Stats.Get(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    stop := make(chan struct{})
+    done := make(chan struct{})
+
+    go func() {
+        app.refreshMovieStats(stop)
+        close(done)
+    }()
+
+    time.Sleep(50 * time.Millisecond)
+    close(stop)
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("refreshMovieStats didn't return after stop was closed")
+    }
+
+    after, err := app.models.Stats.Get(context.Background())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !after.RefreshedAt.After(before.RefreshedAt) {
+        t.Errorf("got statistics refreshed at %v; want them refreshed after %v", after.RefreshedAt, before.RefreshedAt)
+    }
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+const (
+    // outboxBatchSize is how many emails the dispatcher claims at a time.
+    outboxBatchSize = 20
+    // outboxLease is how long a claimed email is kept from other dispatchers while it is sent.
+    outboxLease = time.Minute
+    // outboxMaxBackoff caps the delay before an email which failed is tried again.
+    outboxMaxBackoff = time.Hour
+)
+
+var (
+    totalOutboxEmailsSent    = expvar.NewInt("total_outbox_emails_sent")
+    totalOutboxEmailsFailed  = expvar.NewInt("total_outbox_emails_failed")
+    totalOutboxEmailsGivenUp = expvar.NewInt("total_outbox_emails_given_up")
+    totalEmailsRetried       = expvar.NewInt("total_emails_retried") // attempts to send an email which failed before
+)
+
+// outboxBackoff returns how long to wait before trying again to send an email which has failed
+// attempts times: 30 seconds after the first failure, doubling up to outboxMaxBackoff.
+func outboxBackoff(attempts int) time.Duration {
+    backoff := 30 * time.Second
+    for range attempts - 1 {
+        backoff *= 2
+        if backoff >= outboxMaxBackoff {
+            return outboxMaxBackoff
+        }
+    }
+
+    return backoff
+}
+
+// pollOutbox dispatches the emails of the outbox every -email-outbox-poll-interval until stop is
+// closed.
+func (app *application) pollOutbox(stop <-chan struct{}) {
+    ticker := time.NewTicker(app.config.email.pollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            if app.dbReady.Load() {
+                app.dispatchOutbox()
+            }
+        }
+    }
+}
+
+// dispatchOutbox sends the emails of the outbox which are due, until there are none left. An
+// email which fails is tried again later with exponential backoff, and given up after
+// data.OutboxMaxAttempts attempts. It returns the number of emails sent.
+func (app *application) dispatchOutbox() int {
+    ctx := context.Background()
+    sent := 0
+
+    for {
+        emails, err := app.models.Outbox.Claim(ctx, outboxBatchSize, outboxLease)
+        if err != nil {
+            app.logger.Error("failed to claim emails from the outbox", "error", err)
+            return sent
+        }
+
+        for _, email := range emails {
+            if email.Attempts > 0 {
+                totalEmailsRetried.Add(1)
+            }
+
+            err := app.sendEmail(ctx, email.Recipient, email.Template, email.Payload)
+            if err == nil {
+                err = app.models.Outbox.MarkSent(ctx, email.ID)
+                if err != nil {
+                    app.logger.Error("failed to mark outbox email sent", "id", email.ID, "error", err)
+                }
+
+                totalOutboxEmailsSent.Add(1)
+                sent++
+                continue
+            }
+
+            attempts := email.Attempts + 1
+            totalOutboxEmailsFailed.Add(1)
+
+            var retryAt *time.Time
+            if attempts < data.OutboxMaxAttempts {
+                t := time.Now().Add(outboxBackoff(attempts))
+                retryAt = &t
+                app.logger.Warn("failed to send outbox email, will retry", "id", email.ID, "template", email.Template,
+                    "attempts", attempts, "retry_at", t, "error", err)
+            } else {
+                totalOutboxEmailsGivenUp.Add(1)
+                app.logger.Error("failed to send outbox email, giving up", "id", email.ID, "template", email.Template,
+                    "attempts", attempts, "error", err)
+            }
+
+            err = app.models.Outbox.MarkFailed(ctx, email.ID, err.Error(), retryAt)
+            if err != nil {
+                app.logger.Error("failed to mark outbox email failed", "id", email.ID, "error", err)
+            }
+        }
+
+        if len(emails) < outboxBatchSize {
+            return sent
+        }
+    }
+}
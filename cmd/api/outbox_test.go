@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// failingSender is a mail.Sender which always fails.
+type failingSender struct{}
+
+func (failingSender) Send(to, templateFile string, data any) error {
+    return errors.New("535 authentication failed")
+}
+
+func TestRegisterWithOutbox(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.email.delivery = "outbox"
+    h := app.routes()
+
+    rr := do(t, h, http.MethodPost, "/v1/users", "", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3"})
+    app.wg.Wait()
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("register: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    // The email is queued, not sent, by the handler.
+    sender := app.emailSender.(*stubSender)
+    if len(sender.sent) != 0 {
+        t.Fatalf("got %d emails sent by the handler; want 0", len(sender.sent))
+    }
+
+    outbox := app.models.Outbox.(*mock.OutboxModel)
+    if pending := outbox.Pending(); len(pending) != 1 || pending[0].Recipient != "dave@example.com" {
+        t.Fatalf("got pending emails %+v; want one to dave@example.com", pending)
+    }
+
+    if n := app.dispatchOutbox(); n != 1 {
+        t.Fatalf("dispatched %d emails; want 1", n)
+    }
+    if n := app.dispatchOutbox(); n != 0 {
+        t.Errorf("dispatched %d emails again; want 0", n)
+    }
+
+    if len(sender.sent) != 1 || sender.sent[0].templateFile != "user_welcome.html" {
+        t.Fatalf("got emails %+v; want the welcome email", sender.sent)
+    }
+    if sent := outbox.Sent(); len(sent) != 1 || len(sent[0].Payload) != 0 {
+        t.Errorf("got sent emails %+v; want one with its payload cleared", sent)
+    }
+
+    // The token in the email activates the user.
+    token, _ := sender.sent[0].data.(map[string]any)["activationToken"].(string)
+
+    rr = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token})
+    if rr.Code != http.StatusOK {
+        t.Errorf("activate: got status %d; body: %s", rr.Code, rr.Body)
+    }
+}
+
+func TestPollOutbox(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.email.pollInterval = 10 * time.Millisecond
+    app.dbReady.Store(true)
+
+    user := &data.User{Name: "Dave", Email: "dave@example.com"}
+    _, err := app.models.User.Register(context.Background(), user, data.Registration{ActivationTTL: time.Hour, Email: app.welcomeEmail(user)})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    stop := make(chan struct{})
+    done := make(chan struct{})
+
+    go func() {
+        app.pollOutbox(stop)
+        close(done)
+    }()
+
+    time.Sleep(50 * time.Millisecond)
+    close(stop)
+
+    select {
+    case <-done:
+    case <-time.After(time.Second):
+        t.Fatal("pollOutbox didn't return after stop was closed")
+    }
+
+    if sent := app.models.Outbox.(*mock.OutboxModel).Sent(); len(sent) != 1 {
+        t.Errorf("got sent emails %+v; want the welcome email", sent)
+    }
+}
+
+func TestDispatchOutboxRetries(t *testing.T) {
+    app := newTestApplication(t)
+    app.emailSender = failingSender{}
+
+    user := &data.User{Name: "Dave", Email: "dave@example.com"}
+    _, err := app.models.User.Register(context.Background(), user, data.Registration{ActivationTTL: time.Hour, Email: app.welcomeEmail(user)})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    failed := totalOutboxEmailsFailed.Value()
+
+    if n := app.dispatchOutbox(); n != 0 {
+        t.Fatalf("dispatched %d emails; want 0", n)
+    }
+    if got := totalOutboxEmailsFailed.Value() - failed; got != 1 {
+        t.Errorf("got %d failures counted; want 1", got)
+    }
+
+    // The email is kept for a retry after the backoff, with the error.
+    outbox := app.models.Outbox.(*mock.OutboxModel)
+
+    pending := outbox.Pending()
+    if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError != "535 authentication failed" {
+        t.Fatalf("got pending emails %+v; want one with 1 attempt and the error", pending)
+    }
+
+    app.dispatchOutbox()
+    if got := totalOutboxEmailsFailed.Value() - failed; got != 1 {
+        t.Errorf("got %d failures counted before the backoff ended; want 1", got)
+    }
+
+    // The last attempt gives the email up.
+    for range data.OutboxMaxAttempts - 2 {
+        err := app.models.Outbox.MarkFailed(context.Background(), pending[0].ID, "", &time.Time{})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    givenUp := totalOutboxEmailsGivenUp.Value()
+
+    app.dispatchOutbox()
+    if got := totalOutboxEmailsGivenUp.Value() - givenUp; got != 1 {
+        t.Errorf("got %d emails given up; want 1", got)
+    }
+    if pending := outbox.Pending(); len(pending) != 0 {
+        t.Errorf("got pending emails %+v after giving up; want none", pending)
+    }
+
+    // The activation token isn't kept in the email given up.
+    if givenUp := outbox.GivenUp(); len(givenUp) != 1 || len(givenUp[0].Payload) != 0 {
+        t.Errorf("got emails given up %+v; want one with its payload cleared", givenUp)
+    }
+}
+
+func TestOutboxBackoff(t *testing.T) {
+    tests := []struct {
+        attempts int
+        want     time.Duration
+    }{
+        {1, 30 * time.Second},
+        {2, time.Minute},
+        {5, 8 * time.Minute},
+        {8, time.Hour},
+        {20, time.Hour},
+    }
+
+    for _, tt := range tests {
+        if got := outboxBackoff(tt.attempts); got != tt.want {
+            t.Errorf("outboxBackoff(%d) = %v; want %v", tt.attempts, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
+)
+
+// exportPermissionsHandler sends the permission codes of every user by email, e.g. to restore
+// them after cloning an environment. The response can be posted to importPermissionsHandler as
+// is.
+func (app *application) exportPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+    grants, err := app.models.Permission.ExportGrants(r.Context())
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"grants": grants}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// importPermissionsHandler grants the permissions of an export to the users with the same
+// emails, in one transaction. Grants which users already have are counted but left alone, so an
+// import can be repeated. The response reports the grants of unknown emails and codes, which
+// are skipped; with create_missing_permissions the unknown codes are created instead.
+func (app *application) importPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Grants                   data.PermissionGrants `json:"grants"`
+        CreateMissingPermissions bool                  `json:"create_missing_permissions"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    v := validator.New()
+
+    v.Check(input.Grants != nil, "grants", "must be provided")
+    for email, codes := range input.Grants {
+        for _, code := range codes {
+            v.Check(code != "", "grants."+email, "must not contain empty permission codes")
+        }
+    }
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    report, err := app.models.Permission.ImportGrants(r.Context(), input.Grants, input.CreateMissingPermissions)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"report": report}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
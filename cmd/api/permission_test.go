@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestExportPermissionsHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodGet, "/v1/permissions/export", authToken(t, app, mock.ActivatedUserID), nil)
+    if rr.Code != http.StatusForbidden {
+        t.Errorf("non-admin: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/permissions/export", authToken(t, app, mock.AdminUserID), nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        Grants data.PermissionGrants `json:"grants"`
+    }
+    decode(t, rr, &resp)
+
+    if got := resp.Grants[mock.ReadOnlyUserEmail]; !slices.Equal(got, data.Permissions{"movie:read"}) {
+        t.Errorf("got grants %v for %s; want [movie:read]", got, mock.ReadOnlyUserEmail)
+    }
+    if _, ok := resp.Grants[mock.InactiveUserEmail]; ok {
+        t.Errorf("got grants for %s, who has no permissions", mock.InactiveUserEmail)
+    }
+}
+
+func TestImportPermissionsHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+
+    input := map[string]any{
+        "grants": map[string][]string{
+            mock.ReadOnlyUserEmail: {"movie:read", "movie:write", "reviews:write"},
+            mock.InactiveUserEmail: {"movie:read"},
+            "nobody@example.com":   {"movie:read"},
+        },
+    }
+
+    type report struct {
+        Added          int      `json:"added"`
+        AlreadyPresent int      `json:"already_present"`
+        Created        []string `json:"created"`
+        UnknownEmails  []string `json:"unknown_emails"`
+        UnknownCodes   []string `json:"unknown_codes"`
+    }
+
+    importGrants := func(t *testing.T) report {
+        t.Helper()
+
+        rr := do(t, h, http.MethodPost, "/v1/permissions/import", admin, input)
+        if rr.Code != http.StatusOK {
+            t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+        }
+
+        var resp struct {
+            Report report `json:"report"`
+        }
+        decode(t, rr, &resp)
+
+        return resp.Report
+    }
+
+    got := importGrants(t)
+    if got.Added != 2 || got.AlreadyPresent != 1 {
+        t.Errorf("first import: got %d added, %d already present; want 2, 1", got.Added, got.AlreadyPresent)
+    }
+    if !slices.Equal(got.UnknownEmails, []string{"nobody@example.com"}) {
+        t.Errorf("got unknown emails %v; want [nobody@example.com]", got.UnknownEmails)
+    }
+    if !slices.Equal(got.UnknownCodes, []string{"reviews:write"}) {
+        t.Errorf("got unknown codes %v; want [reviews:write]", got.UnknownCodes)
+    }
+
+    got = importGrants(t)
+    if got.Added != 0 || got.AlreadyPresent != 3 {
+        t.Errorf("second import: got %d added, %d already present; want 0, 3", got.Added, got.AlreadyPresent)
+    }
+
+    input["create_missing_permissions"] = true
+    got = importGrants(t)
+    if got.Added != 1 || !slices.Equal(got.Created, []string{"reviews:write"}) {
+        t.Errorf("import creating permissions: got %d added, %v created; want 1, [reviews:write]", got.Added, got.Created)
+    }
+
+    perms, err := app.models.Permission.GetAllForUser(context.Background(), mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !perms.Include("reviews:write") || !perms.Include("movie:write") {
+        t.Errorf("got permissions %v for %s; want movie:write and reviews:write", perms, mock.ReadOnlyUserEmail)
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/permissions/import", admin, map[string]any{
+        "grants": map[string][]string{mock.ReadOnlyUserEmail: {""}},
+    })
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("empty code: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/permissions/import", authToken(t, app, mock.ActivatedUserID), input)
+    if rr.Code != http.StatusForbidden {
+        t.Errorf("non-admin: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// errNoPosterPart is returned by readPosterBody when a multipart body has no "poster" file.
+var errNoPosterPart = errors.New(`multipart body must contain a "poster" file`)
+
+// readPosterBody reads the image from the request body, which is either the raw image or a
+// multipart/form-data body with the image in a "poster" field.
+func (app *application) readPosterBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, app.config.poster.maxBytes)
+
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != "multipart/form-data" {
+        return io.ReadAll(r.Body)
+    }
+
+    mr, err := r.MultipartReader()
+    if err != nil {
+        return nil, err
+    }
+
+    for {
+        part, err := mr.NextPart()
+        if err != nil {
+            if errors.Is(err, io.EOF) {
+                return nil, errNoPosterPart
+            }
+            return nil, err
+        }
+
+        if part.FormName() == "poster" {
+            return io.ReadAll(part)
+        }
+    }
+}
+
+func (app *application) uploadMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    _, err = app.models.Movie.Get(r.Context(), id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    body, err := app.readPosterBody(w, r)
+    if err != nil {
+        var maxBytesError *http.MaxBytesError
+
+        switch {
+        case errors.As(err, &maxBytesError):
+            app.contentTooLargeResponse(w, r, maxBytesError.Limit)
+        default:
+            app.badRequestResponse(w, r, err)
+        }
+        return
+    }
+
+    if len(body) == 0 {
+        app.badRequestResponse(w, r, errors.New("body must not be empty"))
+        return
+    }
+
+    // Don't trust the Content-Type sent by the client; sniff the type from the image itself.
+    contentType := http.DetectContentType(body)
+    if !slices.Contains(data.PosterContentTypes, contentType) {
+        app.unsupportedMediaTypeResponse(w, r, data.PosterContentTypes)
+        return
+    }
+
+    poster := data.NewPoster(id, contentType, body)
+
+    err = app.models.Poster.Put(r.Context(), poster)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"poster": poster}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+func (app *application) showMoviePosterHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    poster, err := app.models.Poster.Get(r.Context(), id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    // The poster requires authentication, so it must only be cached privately. Clients have to
+    // revalidate, which is cheap thanks to the ETag: http.ServeContent() handles If-None-Match
+    // (and Range requests) for us.
+    w.Header().Set("Content-Type", poster.ContentType)
+    w.Header().Set("ETag", `"`+poster.Hash+`"`)
+    w.Header().Set("Cache-Control", "private, no-cache")
+
+    http.ServeContent(w, r, "", poster.UpdatedAt, bytes.NewReader(poster.Data))
+}
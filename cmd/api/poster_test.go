@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// pngImage is enough of a PNG file for http.DetectContentType to recognise it.
+var pngImage = append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0}, 32)...)
+
+func TestMoviePosterHandlers(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    upload := func(target, contentType string, body []byte) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodPut, target, bytes.NewReader(body))
+        req.Header.Set("Authorization", "Bearer "+token)
+        req.Header.Set("Content-Type", contentType)
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        return rr
+    }
+
+    var multipartBody bytes.Buffer
+    mw := multipart.NewWriter(&multipartBody)
+    part, _ := mw.CreateFormFile("poster", "poster.png")
+    part.Write(pngImage)
+    mw.Close()
+
+    tests := []struct {
+        name        string
+        target      string
+        contentType string
+        body        []byte
+        wantStatus  int
+    }{
+        {"raw png", "/v1/movies/1/poster", "image/png", pngImage, http.StatusOK},
+        {"multipart png", "/v1/movies/2/poster", mw.FormDataContentType(), multipartBody.Bytes(), http.StatusOK},
+        {"not an image", "/v1/movies/1/poster", "image/png", []byte("hello world"), http.StatusUnsupportedMediaType},
+        {"too large", "/v1/movies/1/poster", "image/png", append(pngImage, make([]byte, 2048)...), http.StatusRequestEntityTooLarge},
+        {"empty", "/v1/movies/1/poster", "image/png", nil, http.StatusBadRequest},
+        {"non-existent movie", "/v1/movies/99/poster", "image/png", pngImage, http.StatusNotFound},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := upload(tt.target, tt.contentType, tt.body)
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+        })
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/movies/1/poster", token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("get: got status %d", rr.Code)
+    }
+    if rr.Header().Get("Content-Type") != "image/png" || !bytes.Equal(rr.Body.Bytes(), pngImage) {
+        t.Fatalf("got content type %q and %d bytes", rr.Header().Get("Content-Type"), rr.Body.Len())
+    }
+
+    etag := rr.Header().Get("ETag")
+    if !strings.HasPrefix(etag, `"`) {
+        t.Fatalf("got ETag %q", etag)
+    }
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/movies/1/poster", nil)
+    req.Header.Set("Authorization", "Bearer "+token)
+    req.Header.Set("If-None-Match", etag)
+    rr = httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+    if rr.Code != http.StatusNotModified {
+        t.Fatalf("conditional get: got status %d; want %d", rr.Code, http.StatusNotModified)
+    }
+
+    // Deleting the movie removes its poster.
+    rr = do(t, h, http.MethodDelete, "/v1/movies/1", token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("delete: got status %d", rr.Code)
+    }
+    if _, err := app.models.Poster.Get(context.Background(), 1); err == nil {
+        t.Fatal("poster still exists after deleting the movie")
+    }
+}
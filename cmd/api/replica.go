@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/data"
+)
+
+// replicaCheckInterval is how often replicaMonitor checks the read replica.
+const replicaCheckInterval = 10 * time.Second
+
+// replicaMonitor keeps the pool of the read replica in line with the DB config. Whatever goes
+// wrong with the replica is logged, and the reads use the primary meanwhile (see
+// data.PoolWrapper.ReadPool).
+type replicaMonitor struct {
+    mu      sync.Mutex // serializes sync, which runs on reload as well as periodically
+    replica *data.PoolWrapper
+    logger  *slog.Logger
+}
+
+// sync creates the replica's pool when the replica is configured and the settings of its pool
+// changed, and closes it when the replica is no longer configured. Otherwise it checks the
+// replica's health, so that the reads stop going to a replica which is down and go back to it
+// once it has recovered.
+func (m *replicaMonitor) sync(c *config.Config) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    pc, ok := c.DBReplicaPool()
+    if !ok {
+        if m.replica.Pool() != nil {
+            m.replica.Close()
+            m.logger.Info("read replica removed, reads use the primary")
+        }
+        return
+    }
+
+    if m.replica.Pool() == nil || pc != m.replica.Config() {
+        err := m.replica.CreatePool(pc)
+        if err != nil {
+            m.logger.Error("failed to create the read replica connection pool", "error", err.Error())
+            return
+        }
+        m.logger.Info("read replica connection pool established")
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    wasHealthy := m.replica.Healthy()
+
+    err := m.replica.CheckHealth(ctx)
+    switch {
+    case err != nil && wasHealthy:
+        m.logger.Warn("read replica is unhealthy, reads use the primary", "error", err.Error())
+    case err == nil && !wasHealthy:
+        m.logger.Info("read replica is healthy again")
+    }
+}
+
+// run calls sync with the current DB config every replicaCheckInterval.
+func (m *replicaMonitor) run(current func() *config.Config) {
+    for {
+        time.Sleep(replicaCheckInterval)
+        m.sync(current())
+    }
+}
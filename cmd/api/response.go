@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+    contentTypeJSON    = "application/json"
+    contentTypeXML     = "application/xml"
+    contentTypeMsgpack = "application/msgpack"
+)
+
+// supportedContentTypes lists the response formats in order of preference.
+var supportedContentTypes = []string{contentTypeJSON, contentTypeXML, contentTypeMsgpack}
+
+// negotiateContentType picks the supported content type which best matches the Accept header.
+// An empty header, or one which allows anything, selects JSON. The second return value is false
+// if the client doesn't accept any of the supported types.
+func negotiateContentType(accept string) (string, bool) {
+    if strings.TrimSpace(accept) == "" {
+        return contentTypeJSON, true
+    }
+
+    best, bestQ := "", 0.0
+
+    for _, mediaRange := range strings.Split(accept, ",") {
+        mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+        if err != nil {
+            continue
+        }
+
+        q := 1.0
+        if s, ok := params["q"]; ok {
+            q, err = strconv.ParseFloat(s, 64)
+            if err != nil {
+                continue
+            }
+        }
+        if q <= bestQ {
+            continue
+        }
+
+        for _, ct := range supportedContentTypes {
+            if mediaRangeMatches(mediaType, ct) {
+                best, bestQ = ct, q
+                break
+            }
+        }
+    }
+
+    return best, best != ""
+}
+
+// mediaRangeMatches reports whether a media range such as "*/*" or "application/*" includes the
+// content type ct.
+func mediaRangeMatches(mediaRange, ct string) bool {
+    if mediaRange == "*/*" || mediaRange == ct {
+        return true
+    }
+
+    typ, _, _ := strings.Cut(ct, "/")
+    return mediaRange == typ+"/*"
+}
+
+// writeResponse sends data in the format selected by the request's Accept header: JSON (the
+// default), XML or MessagePack. If the client accepts none of them, a 406 Not Acceptable
+// response listing the supported types is sent instead. The data is shaped for the API version
+// of the request.
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+    w.Header().Add("Vary", "Accept")
+
+    if shape := app.contextGetAPIVersion(r).shape; shape != nil {
+        data = shape(data)
+    }
+
+    contentType, ok := negotiateContentType(r.Header.Get("Accept"))
+    if !ok {
+        app.notAcceptableResponse(w, r)
+        return nil
+    }
+
+    return app.writeAs(w, r, contentType, status, data, headers)
+}
+
+// writeAs sends data encoded as the given content type.
+func (app *application) writeAs(w http.ResponseWriter, r *http.Request, contentType string, status int, data envelope, headers http.Header) error {
+    var (
+        body []byte
+        err  error
+    )
+
+    switch contentType {
+    case contentTypeXML:
+        if app.prettyPrint(r) {
+            body, err = xml.MarshalIndent(data, "", "    ")
+        } else {
+            body, err = xml.Marshal(data)
+        }
+        if err == nil {
+            body = append([]byte(xml.Header), append(body, '\n')...)
+        }
+    case contentTypeMsgpack:
+        body, err = marshalMsgpack(data)
+    default:
+        return app.writeJSON(w, r, status, data, headers)
+    }
+    if err != nil {
+        return err
+    }
+
+    for key, value := range headers {
+        w.Header()[key] = value
+    }
+
+    w.Header().Set("Content-Type", contentType)
+    w.WriteHeader(status)
+    w.Write(body)
+
+    return nil
+}
+
+// marshalMsgpack encodes v as MessagePack, using the json struct tags so that field names and
+// omitempty behave the same as in JSON responses.
+func marshalMsgpack(v any) ([]byte, error) {
+    var buf strings.Builder
+
+    enc := msgpack.NewEncoder(&buf)
+    enc.SetCustomStructTag("json")
+
+    err := enc.Encode(v)
+    if err != nil {
+        return nil, err
+    }
+
+    return []byte(buf.String()), nil
+}
+
+// MarshalXML implements xml.Marshaler for envelope, which encoding/xml can't handle on its own
+// because it's a map. The envelope becomes a <response> element with one child per key, in
+// sorted order. Slices are wrapped in an element named after the key, and maps are encoded as
+// <entry key="..."> elements.
+func (e envelope) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+    start.Name = xml.Name{Local: "response"}
+
+    err := enc.EncodeToken(start)
+    if err != nil {
+        return err
+    }
+
+    keys := make([]string, 0, len(e))
+    for key := range e {
+        keys = append(keys, key)
+    }
+    slices.Sort(keys)
+
+    for _, key := range keys {
+        err = encodeXMLValue(enc, key, e[key])
+        if err != nil {
+            return err
+        }
+    }
+
+    return enc.EncodeToken(start.End())
+}
+
+func encodeXMLValue(enc *xml.Encoder, name string, value any) error {
+    start := xml.StartElement{Name: xml.Name{Local: name}}
+
+    v := reflect.ValueOf(value)
+
+    switch {
+    case v.Kind() == reflect.Map:
+        err := enc.EncodeToken(start)
+        if err != nil {
+            return err
+        }
+
+        keys := v.MapKeys()
+        slices.SortFunc(keys, func(a, b reflect.Value) int {
+            return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+        })
+
+        for _, k := range keys {
+            entry := xml.StartElement{
+                Name: xml.Name{Local: "entry"},
+                Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: fmt.Sprint(k.Interface())}},
+            }
+
+            err = enc.EncodeElement(v.MapIndex(k).Interface(), entry)
+            if err != nil {
+                return err
+            }
+        }
+
+        return enc.EncodeToken(start.End())
+
+    case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+        err := enc.EncodeToken(start)
+        if err != nil {
+            return err
+        }
+
+        item := xml.StartElement{Name: xml.Name{Local: singular(name)}}
+        for i := range v.Len() {
+            err = enc.EncodeElement(v.Index(i).Interface(), item)
+            if err != nil {
+                return err
+            }
+        }
+
+        return enc.EncodeToken(start.End())
+
+    default:
+        return enc.EncodeElement(value, start)
+    }
+}
+
+// singular derives an element name for the items of a slice from its key, e.g. "movies" gives
+// "movie".
+func singular(name string) string {
+    if s, ok := strings.CutSuffix(name, "s"); ok && s != "" {
+        return s
+    }
+
+    return "item"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+    tests := []struct {
+        accept string
+        want   string
+        wantOK bool
+    }{
+        {"", contentTypeJSON, true},
+        {"*/*", contentTypeJSON, true},
+        {"application/*", contentTypeJSON, true},
+        {"application/xml", contentTypeXML, true},
+        {"application/msgpack", contentTypeMsgpack, true},
+        {"text/html, application/xml;q=0.9, */*;q=0.1", contentTypeXML, true},
+        {"application/json;q=0.5, application/msgpack", contentTypeMsgpack, true},
+        {"application/xml;q=0", "", false},
+        {"text/html", "", false},
+    }
+
+    for _, tt := range tests {
+        got, ok := negotiateContentType(tt.accept)
+        if got != tt.want || ok != tt.wantOK {
+            t.Errorf("negotiateContentType(%q) = %q, %t; want %q, %t", tt.accept, got, ok, tt.want, tt.wantOK)
+        }
+    }
+}
+
+func TestWriteResponseFormats(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    get := func(target, accept string) *httptest.ResponseRecorder {
+        req := httptest.NewRequest(http.MethodGet, target, nil)
+        req.Header.Set("Authorization", "Bearer "+token)
+        req.Header.Set("Accept", accept)
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, req)
+        return rr
+    }
+
+    t.Run("xml", func(t *testing.T) {
+        rr := get("/v1/movies/1", "application/xml")
+
+        if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != contentTypeXML {
+            t.Fatalf("got status %d content type %q", rr.Code, rr.Header().Get("Content-Type"))
+        }
+
+        body := rr.Body.String()
+        for _, want := range []string{
+            "<response>",
+            "<title>Moana</title>",
+            "<runtime>107 mins</runtime>",
+            "<genres>",
+            "<genre>animation</genre>",
+            "<genre>adventure</genre>",
+        } {
+            if !strings.Contains(body, want) {
+                t.Errorf("body does not contain %q:\n%s", want, body)
+            }
+        }
+    })
+
+    t.Run("xml list", func(t *testing.T) {
+        rr := get("/v1/movies?page_size=2", "application/xml")
+
+        body := rr.Body.String()
+        for _, want := range []string{"<movies>", "<movie>", "<metadata>", "<total_records>3</total_records>"} {
+            if !strings.Contains(body, want) {
+                t.Errorf("body does not contain %q:\n%s", want, body)
+            }
+        }
+    })
+
+    t.Run("msgpack", func(t *testing.T) {
+        rr := get("/v1/movies/1", "application/msgpack")
+
+        if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != contentTypeMsgpack {
+            t.Fatalf("got status %d content type %q", rr.Code, rr.Header().Get("Content-Type"))
+        }
+
+        var resp map[string]map[string]any
+        err := msgpack.Unmarshal(rr.Body.Bytes(), &resp)
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if resp["movie"]["runtime"] != "107 mins" || resp["movie"]["title"] != "Moana" {
+            t.Errorf("unexpected movie %v", resp["movie"])
+        }
+    })
+
+    t.Run("not acceptable", func(t *testing.T) {
+        rr := get("/v1/movies/1", "text/html")
+
+        if rr.Code != http.StatusNotAcceptable {
+            t.Fatalf("got status %d; want %d", rr.Code, http.StatusNotAcceptable)
+        }
+
+        var resp struct {
+            Supported []string `json:"supported"`
+        }
+        decode(t, rr, &resp)
+
+        if len(resp.Supported) != len(supportedContentTypes) {
+            t.Errorf("got supported %v", resp.Supported)
+        }
+    })
+
+    t.Run("xml error", func(t *testing.T) {
+        rr := get("/v1/movies/99", "application/xml")
+
+        if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "<error>") {
+            t.Errorf("got status %d body %s", rr.Code, rr.Body)
+        }
+    })
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"expvar"
 	"net/http"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -10,25 +11,159 @@ import (
 func (app *application) routes() http.Handler {
     router := httprouter.New()
 
+    // Trailing slashes and repeated slashes are handled by the cleanPath middleware, which
+    // redirects with 308 for every method.
+    router.RedirectTrailingSlash = false
+
     router.NotFound = http.HandlerFunc(app.notFoundResponse)
-    router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+    router.MethodNotAllowed = allowHeader(router, app.methodNotAllowedResponse)
+    router.GlobalOPTIONS = allowHeader(router, app.optionsHandler)
+
+    // The endpoints taking a password get the stricter authentication limiter as well.
+    authLimit := app.authRateLimit()
+
+    // The export of a user's data is expensive, so it gets a per-user limiter.
+    exportLimit := app.userExportRateLimit()
+
+    // The API routes are registered under the prefix of every version, e.g. /v1/movies and
+    // /v2/movies.
+    handle := versionedRoutes(router)
 
-    router.HandlerFunc(http.MethodGet, "/v1/healthcheck", app.healthcheckHandler)
+    handle(http.MethodGet, "/healthcheck", app.healthcheckHandler)
+    handle(http.MethodGet, "/healthcheck/ready", app.readyHandler)
+    handle(http.MethodGet, "/version", app.versionHandler)
 
-    // Use the requirePermission() middleware on /v1/movies** endpoints.
-    router.HandlerFunc(http.MethodGet, "/v1/movies", app.requirePermission("movie:read", app.listMoviesHandler))
-    router.HandlerFunc(http.MethodPost, "/v1/movies", app.requirePermission("movie:write", app.createMovieHandler))
-    router.HandlerFunc(http.MethodGet, "/v1/movies/:id", app.requirePermission("movie:read", app.showMovieHandler))
-    router.HandlerFunc(http.MethodPatch, "/v1/movies/:id", app.requirePermission("movie:write", app.updateMovieHandler))
-    router.HandlerFunc(http.MethodDelete, "/v1/movies/:id", app.requirePermission("movie:write", app.deleteMovieHandler))
+    // Use the requirePermission() middleware on /movies** endpoints.
+    handle(http.MethodGet, "/movies", app.requirePermission("movie:read", app.listMoviesHandler))
+    handle(http.MethodPost, "/movies", app.requirePermission("movie:write", app.idempotent(app.createMovieHandler)))
+    handle(http.MethodGet, "/movies/:id", app.requirePermission("movie:read",
+        app.segmentRoute("export", app.exportMoviesHandler,
+            app.segmentRoute("stats", app.showMovieStatsHandler, app.showMovieHandler),
+        ),
+    ))
+    handle(http.MethodPatch, "/movies/:id", app.requirePermission("movie:write", app.updateMovieHandler))
+    handle(http.MethodDelete, "/movies/:id", app.requirePermission("movie:delete", app.deleteMovieHandler))
+    handle(http.MethodGet, "/movies/:id/similar", app.requirePermission("movie:read", app.showSimilarMoviesHandler))
+    handle(http.MethodGet, "/movies/:id/poster", app.requirePermission("movie:read", app.showMoviePosterHandler))
+    handle(http.MethodPut, "/movies/:id/poster", app.requirePermission("movie:write", app.uploadMoviePosterHandler))
+    handle(http.MethodPost, "/movies/:id/refresh", app.requirePermission("users:admin",
+        app.segmentRoute("stats", app.refreshMovieStatsHandler, app.notFoundResponse),
+    ))
 
-    router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
-    router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+    handle(http.MethodGet, "/genres", app.requirePermission("movie:read", app.listGenresHandler))
+    handle(http.MethodPost, "/genres", app.requirePermission("genres:write", app.createGenreHandler))
+    handle(http.MethodPatch, "/genres/:id", app.requirePermission("genres:write", app.renameGenreHandler))
 
-    router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+    handle(http.MethodGet, "/users", app.requirePermission("users:read", app.listUsersHandler))
+    handle(http.MethodPost, "/users", authLimit(app.registerUserHandler))
+    handle(http.MethodGet, "/users/:id", app.userRoute(
+        app.requireAuthenticatedUser(app.showCurrentUserHandler),
+        app.requirePermissionOrSelf("users:read", "id", app.showUserHandler),
+    ))
+    handle(http.MethodPatch, "/users/:id", app.userRoute(
+        app.requireActivatedUser(app.updateCurrentUserHandler),
+        app.notFoundResponse,
+    ))
+    handle(http.MethodPut, "/users/:id/password", app.userRoute(
+        app.requireActivatedUser(app.updateCurrentUserPasswordHandler),
+        app.notFoundResponse,
+    ))
+    handle(http.MethodGet, "/users/:id/export", app.userRoute(
+        app.requireAuthenticatedUser(exportLimit(app.exportCurrentUserHandler)),
+        app.notFoundResponse,
+    ))
+    handle(http.MethodPut, "/users/:id", app.segmentRoute("activated", app.activateUserHandler,
+        app.segmentRoute("password", authLimit(app.resetPasswordHandler), app.notFoundResponse),
+    ))
+    handle(http.MethodPost, "/users/:id/force-reset", app.requirePermission("users:admin", app.forcePasswordResetHandler))
+    handle(http.MethodDelete, "/users/:id", app.userRoute(
+        app.requireAuthenticatedUser(app.deleteCurrentUserHandler),
+        app.requirePermission("users:admin", app.deleteUserHandler),
+    ))
+    handle(http.MethodGet, "/users/:id/tokens", app.userRoute(
+        app.requireAuthenticatedUser(app.listCurrentUserTokensHandler),
+        app.requirePermission("users:admin", app.showUserTokenCountsHandler),
+    ))
+    handle(http.MethodDelete, "/users/:id/tokens", app.userRoute(
+        app.requireAuthenticatedUser(app.deleteOtherCurrentUserTokensHandler),
+        app.requirePermission("users:admin", app.deleteUserTokensHandler),
+    ))
+    handle(http.MethodDelete, "/users/:id/tokens/:token_id", app.userRoute(
+        app.requireAuthenticatedUser(app.deleteCurrentUserTokenHandler),
+        app.notFoundResponse,
+    ))
+
+    handle(http.MethodGet, "/permissions/export", app.requirePermission("users:admin", app.exportPermissionsHandler))
+    handle(http.MethodPost, "/permissions/import", app.requirePermission("users:admin", app.importPermissionsHandler))
+
+    handle(http.MethodPost, "/tokens/authentication", authLimit(app.createAuthenticationTokenHandler))
+    handle(http.MethodPost, "/tokens/api-keys", app.requireActivatedUser(app.createAPIKeyHandler))
+    handle(http.MethodGet, "/tokens/api-keys", app.requireActivatedUser(app.listAPIKeysHandler))
+    handle(http.MethodDelete, "/tokens/api-keys/:id", app.requireActivatedUser(app.deleteAPIKeyHandler))
 
     router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
 
     // Wrap the router with middleware.
-    return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+    return app.metrics(app.trace(app.logRequestBody(app.negotiateLocale(app.recoverPanic(app.stripPrefix(app.cleanPath(app.detectAPIVersion(app.enableCORS(router, app.timeout(app.rateLimit(app.requireDB(app.primaryForWrites(app.authenticate(router))))))))))))))
+}
+
+// longRunning reports whether r is for a route which gets the long request timeout because it
+// streams its response or accepts a large upload.
+func (app *application) longRunning(r *http.Request) bool {
+    _, path, _ := splitAPIVersion(r.URL.Path)
+
+    switch {
+    case r.Method == http.MethodGet && path == "/movies" && r.URL.Query().Get("stream") == "true":
+        return true
+    case r.Method == http.MethodGet && path == "/movies/export":
+        return true
+    case r.Method == http.MethodGet && path == "/users/me/export":
+        return true
+    case r.Method == http.MethodPut && strings.HasPrefix(path, "/movies/") && strings.HasSuffix(path, "/poster"):
+        return true
+    default:
+        return false
+    }
+}
+
+// allowHeader sets the Allow header to the methods registered for the request path before
+// calling next. httprouter sets it too, but in alphabetical order; this keeps it in the same
+// order as Access-Control-Allow-Methods.
+func allowHeader(router *httprouter.Router, next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        if methods := allowedMethods(router, r.URL.Path); methods != nil {
+            w.Header().Set("Allow", strings.Join(methods, ", "))
+        }
+
+        next(w, r)
+    }
+}
+
+// optionsHandler answers an OPTIONS request which isn't a CORS preflight. The methods supported
+// by the resource are in the Allow header.
+func (app *application) optionsHandler(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// userRoute dispatches a request on a /v1/users/:id route to self if :id is "me" and to other
+// otherwise. httprouter doesn't allow a static "me" segment next to the :id wildcard, so the
+// self-service routes share the wildcard with the admin routes.
+func (app *application) userRoute(self, other http.HandlerFunc) http.HandlerFunc {
+    return app.segmentRoute("me", self, other)
+}
+
+// segmentRoute dispatches a request on a route with an :id wildcard to match if :id is segment
+// and to other otherwise. It stands in for a static segment next to the wildcard, which
+// httprouter doesn't allow, e.g. PUT /v1/users/activated next to PUT /v1/users/:id/password.
+func (app *application) segmentRoute(segment string, match, other http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        params := httprouter.ParamsFromContext(r.Context())
+
+        if params.ByName("id") == segment {
+            match(w, r)
+            return
+        }
+
+        other(w, r)
+    }
 }
\ No newline at end of file
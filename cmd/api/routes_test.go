@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestAllowHeader(t *testing.T) {
+    h := newTestApplication(t).routes()
+
+    tests := []struct {
+        name       string
+        method     string
+        target     string
+        wantStatus int
+        wantAllow  string
+    }{
+        {"405 on collection", http.MethodPut, "/v1/movies", http.StatusMethodNotAllowed, "GET, POST, OPTIONS"},
+        {"405 on item", http.MethodPost, "/v1/movies/1", http.StatusMethodNotAllowed, "GET, PATCH, DELETE, OPTIONS"},
+        {"OPTIONS on collection", http.MethodOptions, "/v1/movies", http.StatusNoContent, "GET, POST, OPTIONS"},
+        {"OPTIONS on item", http.MethodOptions, "/v1/movies/1", http.StatusNoContent, "GET, PATCH, DELETE, OPTIONS"},
+        {"OPTIONS on unknown path", http.MethodOptions, "/v1/nothing", http.StatusNotFound, ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, tt.method, tt.target, "", nil)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d", rr.Code, tt.wantStatus)
+            }
+            if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+                t.Errorf("got Allow %q; want %q", got, tt.wantAllow)
+            }
+            if tt.wantStatus == http.StatusNoContent && rr.Body.Len() != 0 {
+                t.Errorf("got body %q; want none", rr.Body)
+            }
+        })
+    }
+}
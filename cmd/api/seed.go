@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// Users created by -seed.
+const (
+    seedAdminEmail = "admin@greenlight.local"
+    seedUserEmail  = "user@greenlight.local"
+)
+
+var (
+    seedTitleAdjectives = []string{"Silent", "Broken", "Golden", "Last", "Hidden", "Crimson", "Endless", "Lonely", "Burning", "Frozen"}
+    seedTitleNouns      = []string{"Harbor", "Kingdom", "Letter", "Garden", "Frontier", "Mirror", "Voyage", "Witness", "Orchard", "Signal"}
+    seedGenres          = []string{"action", "adventure", "animation", "comedy", "crime", "drama", "fantasy", "horror", "romance", "sci-fi", "thriller", "western"}
+)
+
+// seedMovie returns the i-th fake movie. Movies are derived from i alone, so seeding again
+// produces the same ones.
+func seedMovie(i int) *data.Movie {
+    title := fmt.Sprintf("The %s %s", seedTitleAdjectives[i%len(seedTitleAdjectives)], seedTitleNouns[i/len(seedTitleAdjectives)%len(seedTitleNouns)])
+    if n := i / (len(seedTitleAdjectives) * len(seedTitleNouns)); n > 0 {
+        title = fmt.Sprintf("%s %d", title, n+1)
+    }
+
+    genres := []string{seedGenres[i%len(seedGenres)]}
+    for j := 1; j <= i%3; j++ {
+        genres = append(genres, seedGenres[(i+j*5)%len(seedGenres)])
+    }
+
+    return &data.Movie{
+        Title:   title,
+        Year:    int32(1950 + i*7%75),
+        Runtime: data.Runtime(80 + i*13%90),
+        Genres:  genres,
+    }
+}
+
+// seed inserts development data: an admin with all permissions, an activated user with
+// movie:read and movie:write, both with password, and movies fake movies. Existing users and
+// movies are left alone, so seeding is idempotent. The credentials are printed to out.
+func seed(ctx context.Context, models data.Models, movies int, password string, out io.Writer) error {
+    codes, err := models.Permission.GetAll(ctx)
+    if err != nil {
+        return err
+    }
+
+    users := []struct {
+        name        string
+        email       string
+        permissions []string
+    }{
+        {"Admin", seedAdminEmail, codes},
+        {"User", seedUserEmail, []string{"movie:read", "movie:write"}},
+    }
+
+    for _, u := range users {
+        user, err := models.User.GetByEmail(ctx, u.email)
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            user = &data.User{Name: u.name, Email: u.email, Activated: true}
+
+            err = user.Password.Set(password)
+            if err != nil {
+                return err
+            }
+
+            err = models.User.Insert(ctx, user)
+            if err != nil {
+                return err
+            }
+
+            fmt.Fprintf(out, "created user %s with password %s\n", u.email, password)
+        case err != nil:
+            return err
+        default:
+            fmt.Fprintf(out, "user %s already exists, password unchanged\n", u.email)
+        }
+
+        err = models.Permission.AddForUser(ctx, user.ID, u.permissions...)
+        if err != nil {
+            return err
+        }
+    }
+
+    created := 0
+
+    for i := range movies {
+        movie := seedMovie(i)
+
+        exists, err := movieExists(ctx, models.Movie, movie.Title)
+        if err != nil {
+            return err
+        }
+        if exists {
+            continue
+        }
+
+        err = models.Movie.Insert(ctx, movie)
+        if err != nil {
+            return err
+        }
+        created++
+    }
+
+    fmt.Fprintf(out, "created %d movies, %d already existed\n", created, movies-created)
+
+    return nil
+}
+
+// movieExists reports whether a movie with exactly the given title exists.
+func movieExists(ctx context.Context, movies data.MovieStore, title string) (bool, error) {
+    filter := data.Filter{Page: 1, PageSize: 100, Sort: "id", SortSafeList: []string{"id"}}
+
+    found, _, err := movies.GetAll(ctx, data.MovieListParams{Title: title}, filter)
+    if err != nil {
+        return false, err
+    }
+
+    for _, movie := range found {
+        if movie.Title == title {
+            return true, nil
+        }
+    }
+
+    return false, nil
+}
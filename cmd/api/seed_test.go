@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/validator"
+)
+
+func TestSeed(t *testing.T) {
+    ctx := context.Background()
+    models := mock.NewModels()
+
+    filter := data.Filter{Page: 1, PageSize: 100, Sort: "id", SortSafeList: []string{"id"}}
+
+    _, before, err := models.Movie.GetAll(ctx, data.MovieListParams{}, filter)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Seeding twice must not fail or duplicate anything.
+    for run := range 2 {
+        var out bytes.Buffer
+
+        err := seed(ctx, models, 20, "s33dpassword", &out)
+        if err != nil {
+            t.Fatalf("run %d: %v", run, err)
+        }
+
+        if run == 0 && !strings.Contains(out.String(), "created user "+seedAdminEmail+" with password s33dpassword") {
+            t.Errorf("got output %q; want the admin credentials", out.String())
+        }
+        if run == 1 && !strings.Contains(out.String(), "created 0 movies, 20 already existed") {
+            t.Errorf("got output %q on the second run; want no movie created", out.String())
+        }
+    }
+
+    _, after, err := models.Movie.GetAll(ctx, data.MovieListParams{}, filter)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if after.TotalRecords != before.TotalRecords+20 {
+        t.Errorf("got %d movies; want %d", after.TotalRecords, before.TotalRecords+20)
+    }
+
+    admin, err := models.User.GetByEmail(ctx, seedAdminEmail)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if match, _ := admin.Password.Matches("s33dpassword"); !match || !admin.Activated {
+        t.Errorf("got admin activated %t, password matching %t; want both", admin.Activated, match)
+    }
+
+    permissions, err := models.Permission.GetAllForUser(ctx, admin.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    all, _ := models.Permission.GetAll(ctx)
+    if len(permissions) != len(all) {
+        t.Errorf("got admin permissions %v; want %v", permissions, all)
+    }
+
+    // The seeded genres are all in the genre table.
+    genres, err := models.Genre.GetAll(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for i := range 250 {
+        movie := seedMovie(i)
+
+        v := validator.New()
+        if data.ValidateMovie(v, movie, genres); !v.Valid() {
+            t.Errorf("seeded movie %+v isn't valid: %v", movie, v.Errors)
+        }
+    }
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
 	"syscall"
 	"time"
+
+	"greenlight.zzh.net/internal/config"
 )
 
 func (app *application) serve() error {
@@ -25,6 +30,10 @@ func (app *application) serve() error {
     // graceful Shutdown() function.
     shutdownError := make(chan error)
 
+    // The stop channel is closed on shutdown to stop the background goroutines which run until
+    // then, such as the refresh of the movie statistics.
+    stop := make(chan struct{})
+
     // Start a background goroutine to catch signals.
     go func() {
         quit := make(chan os.Signal, 1)
@@ -48,17 +57,64 @@ func (app *application) serve() error {
             shutdownError <- err
         }
 
-        // Log a message to say that we're waiting for any background goroutines to complete 
-        // their tasks.
-        app.logger.Info("waiting for background tasks to complete", "addr", srv.Addr)
+        close(stop)
 
-        // Call Wait() to block until the WaitGroup counter is zero -- essentially blocking until 
-        // the background goroutines have finished. Then we return nil on the shutdownError 
-        // channel, to indicate that the shutdown completed without any issues.
-        app.wg.Wait()
+        // Stop the subsystems, which include waiting for the background goroutines (see main),
+        // within what remains of the timeout. Then we return nil on the shutdownError channel,
+        // to indicate that the shutdown completed.
+        app.runShutdownHooks(ctx)
         shutdownError <- nil
     }()
 
+    // Start a background goroutine reloading the configuration files on SIGHUP. It has its own
+    // channel, so it doesn't interfere with the shutdown signals above.
+    go func() {
+        hup := make(chan os.Signal, 1)
+        signal.Notify(hup, syscall.SIGHUP)
+
+        for range hup {
+            app.reloadConfig()
+        }
+    }()
+
+    // Start a background goroutine which deletes expired idempotency keys once an hour, counted
+    // in the WaitGroup like the statistics refresher below.
+    app.wg.Add(1)
+    go func() {
+        defer app.wg.Done()
+        app.purgeIdempotencyKeys(stop, time.Hour)
+    }()
+
+    // Start a background goroutine which sends the emails queued in the outbox, counted in the
+    // WaitGroup so that the shutdown waits for the emails being sent.
+    if app.config.email.delivery == "outbox" {
+        app.wg.Add(1)
+        go func() {
+            defer app.wg.Done()
+            app.pollOutbox(stop)
+        }()
+    }
+
+    // Start a background goroutine which refreshes the movie statistics. It's counted in the
+    // WaitGroup, so that the shutdown waits for a refresh in progress.
+    if app.config.statsRefresh > 0 {
+        app.wg.Add(1)
+        go func() {
+            defer app.wg.Done()
+            app.refreshMovieStats(stop)
+        }()
+    }
+
+    // Start a background goroutine which reminds and deletes the unactivated users, counted in
+    // the WaitGroup like the statistics refresher.
+    if app.config.unactivatedJob > 0 {
+        app.wg.Add(1)
+        go func() {
+            defer app.wg.Done()
+            app.processUnactivatedUsers(stop)
+        }()
+    }
+
     app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
 
     err := srv.ListenAndServe()
@@ -74,4 +130,119 @@ func (app *application) serve() error {
     app.logger.Info("stopped server", "addr", srv.Addr)
 
     return nil
-}
\ No newline at end of file
+}
+
+// shutdownHook is a function registered with OnShutdown.
+type shutdownHook struct {
+    name string
+    fn   func(ctx context.Context) error
+}
+
+// shutdownHooks are the functions stopping the subsystems of the application on shutdown.
+type shutdownHooks struct {
+    mu    sync.Mutex
+    hooks []shutdownHook
+}
+
+// OnShutdown registers fn to stop a subsystem once the server has stopped accepting requests.
+// The hooks are called in reverse order of registration, like deferred calls, so a subsystem is
+// stopped before the ones it depends on, which were registered before it.
+func (h *shutdownHooks) OnShutdown(name string, fn func(ctx context.Context) error) {
+    h.mu.Lock()
+    defer h.mu.Unlock()
+
+    h.hooks = append(h.hooks, shutdownHook{name: name, fn: fn})
+}
+
+// runShutdownHooks calls the hooks registered with OnShutdown one at a time, logging how long
+// each took and its error. A hook still running when ctx is done is abandoned and the next ones
+// are skipped, so that the shutdown doesn't overrun its deadline.
+func (app *application) runShutdownHooks(ctx context.Context) {
+    app.shutdownHooks.mu.Lock()
+    hooks := slices.Clone(app.shutdownHooks.hooks)
+    app.shutdownHooks.mu.Unlock()
+
+    for _, hook := range slices.Backward(hooks) {
+        if err := ctx.Err(); err != nil {
+            app.logger.Error("shutdown hook skipped", "name", hook.name, "error", err)
+            continue
+        }
+
+        start := time.Now()
+
+        done := make(chan error, 1)
+        go func() {
+            done <- hook.fn(ctx)
+        }()
+
+        var err error
+        select {
+        case err = <-done:
+        case <-ctx.Done():
+            // A hook which has returned meanwhile isn't abandoned.
+            select {
+            case err = <-done:
+            default:
+                err = fmt.Errorf("abandoned: %w", ctx.Err())
+            }
+        }
+
+        if err != nil {
+            app.logger.Error("shutdown hook failed", "name", hook.name, "duration", time.Since(start), "error", err)
+            continue
+        }
+
+        app.logger.Info("shutdown hook completed", "name", hook.name, "duration", time.Since(start))
+    }
+}
+
+// reloadConfig re-reads all the configuration files and applies the ones which changed, logging
+// the changed settings. An invalid file is logged and its current configuration kept.
+func (app *application) reloadConfig() {
+    app.logger.Info("reloading configuration")
+
+    for _, w := range app.configWatchers {
+        changes, err := w.Reload()
+        if err != nil {
+            config.LogError(app.logger, "failed to reload configuration, keeping the old one", err)
+            continue
+        }
+
+        if len(changes) == 0 {
+            app.logger.Info("configuration unchanged", "filename", w.Name())
+            continue
+        }
+
+        app.logger.Info("configuration reloaded", "filename", w.Name(), "changes", changes)
+    }
+}
+
+// purgeIdempotencyKeys deletes the expired idempotency keys every interval until stop is closed.
+func (app *application) purgeIdempotencyKeys(stop <-chan struct{}, interval time.Duration) {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            if app.dbReady.Load() {
+                app.purgeExpiredIdempotencyKeys()
+            }
+        }
+    }
+}
+
+// purgeExpiredIdempotencyKeys deletes the idempotency keys whose stored response has expired.
+func (app *application) purgeExpiredIdempotencyKeys() {
+    n, err := app.models.Idempotency.DeleteExpired(context.Background())
+    if err != nil {
+        app.logger.Error("failed to delete expired idempotency keys", "error", err)
+        return
+    }
+
+    if n > 0 {
+        app.logger.Info("deleted expired idempotency keys", "count", n)
+    }
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/config"
+)
+
+func TestReloadConfig(t *testing.T) {
+    app := newTestApplication(t)
+
+    dir := t.TempDir()
+    file := filepath.Join(dir, "dynamic.env")
+
+    write := func(content string) {
+        err := os.WriteFile(file, []byte(content), 0o600)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    write("LIMITER_RPS=2\nLIMITER_BURST=4\nLIMITER_ENABLED=true\n")
+
+    w, err := config.NewWatcher(dir, "", "dynamic", nil, (*config.Config).ValidateDynamic, app.logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.NoNotify = true
+
+    err = w.Start(func(c *config.Config) {
+        app.config.limiter.Store(c.Limiter())
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+
+    app.configWatchers = []*config.Watcher{w}
+
+    // An invalid file is rejected and the current configuration kept.
+    write("LIMITER_RPS=abc\n")
+    app.reloadConfig()
+
+    if got := app.config.limiter.Load(); got.Enabled {
+        t.Fatalf("got limiter %+v after reloading an invalid file; want the test configuration", got)
+    }
+
+    write("LIMITER_RPS=5\nLIMITER_BURST=10\nLIMITER_ENABLED=true\n")
+    app.reloadConfig()
+
+    if got := app.config.limiter.Load(); !got.Enabled || got.Rps != 5 || got.Burst != 10 {
+        t.Errorf("got limiter %+v; want enabled with 5 rps and a burst of 10", got)
+    }
+}
+
+func TestReloadTrustedOrigins(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    dir := t.TempDir()
+    file := filepath.Join(dir, "dynamic.env")
+
+    err := os.WriteFile(file, []byte("CORS_TRUSTED_ORIGINS=https://app.example.com\n"), 0o600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    w, err := config.NewWatcher(dir, "", "dynamic", nil, (*config.Config).ValidateDynamic, app.logger)
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.NoNotify = true
+
+    err = w.Start(func(c *config.Config) {
+        origins := c.TrustedOrigins()
+        app.config.trustedOrigins.Store(&origins)
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+
+    app.configWatchers = []*config.Watcher{w}
+
+    preflight := func() *httptest.ResponseRecorder {
+        r := httptest.NewRequest(http.MethodOptions, "/v1/movies", nil)
+        r.Header.Set("Origin", "https://admin.example.com")
+        r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+
+        rr := httptest.NewRecorder()
+        h.ServeHTTP(rr, r)
+        return rr
+    }
+
+    if got := preflight().Header().Get("Access-Control-Allow-Origin"); got != "" {
+        t.Fatalf("got Access-Control-Allow-Origin %q before the reload; want none", got)
+    }
+
+    err = os.WriteFile(file, []byte("CORS_TRUSTED_ORIGINS=https://app.example.com https://admin.example.com\n"), 0o600)
+    if err != nil {
+        t.Fatal(err)
+    }
+    app.reloadConfig()
+
+    rr := preflight()
+    if rr.Code != http.StatusNoContent {
+        t.Errorf("got status %d; want %d", rr.Code, http.StatusNoContent)
+    }
+    if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://admin.example.com" {
+        t.Errorf("got Access-Control-Allow-Origin %q; want https://admin.example.com", got)
+    }
+}
+
+func TestShutdownHooks(t *testing.T) {
+    app := newTestApplication(t)
+
+    var buf bytes.Buffer
+    app.logger = slog.New(slog.NewJSONHandler(&buf, nil))
+
+    var (
+        mu     sync.Mutex
+        called []string
+    )
+    hook := func(name string, fn func(ctx context.Context) error) {
+        app.OnShutdown(name, func(ctx context.Context) error {
+            mu.Lock()
+            called = append(called, name)
+            mu.Unlock()
+            return fn(ctx)
+        })
+    }
+
+    // The stuck hook ignores its context, so it's still running when the deadline passes, and
+    // the hook registered before it isn't called.
+    release := make(chan struct{})
+    t.Cleanup(func() { close(release) })
+
+    hook("first", func(ctx context.Context) error { return nil })
+    hook("stuck", func(ctx context.Context) error {
+        <-release
+        return nil
+    })
+    hook("failing", func(ctx context.Context) error { return errors.New("boom") })
+    hook("last", func(ctx context.Context) error { return nil })
+
+    ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+    defer cancel()
+
+    start := time.Now()
+    app.runShutdownHooks(ctx)
+
+    if elapsed := time.Since(start); elapsed > time.Second {
+        t.Errorf("the hooks took %s; want them abandoned at the 50ms deadline", elapsed)
+    }
+
+    mu.Lock()
+    defer mu.Unlock()
+    if want := []string{"last", "failing", "stuck"}; !slices.Equal(called, want) {
+        t.Errorf("got hooks called in order %v; want %v", called, want)
+    }
+
+    type logEntry struct {
+        Msg   string `json:"msg"`
+        Name  string `json:"name"`
+        Error string `json:"error"`
+    }
+
+    var entries []logEntry
+    for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+        var entry logEntry
+        if err := json.Unmarshal([]byte(line), &entry); err != nil {
+            t.Fatal(err)
+        }
+        entries = append(entries, entry)
+    }
+
+    want := []string{
+        "shutdown hook completed last ",
+        "shutdown hook failed failing boom",
+        "shutdown hook failed stuck abandoned: context deadline exceeded",
+        "shutdown hook skipped first context deadline exceeded",
+    }
+    if len(entries) != len(want) {
+        t.Fatalf("got log %s; want %d entries", buf.String(), len(want))
+    }
+    for i, entry := range entries {
+        if got := entry.Msg + " " + entry.Name + " " + entry.Error; got != want[i] {
+            t.Errorf("log entry %d: got %q; want %q", i, got, want[i])
+        }
+    }
+}
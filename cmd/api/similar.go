@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
+)
+
+const (
+    maxSimilarMovies       = 50     // largest limit accepted by showSimilarMoviesHandler, and the number cached
+    maxSimilarCacheEntries = 10_000 // movies whose similar movies are cached at once
+)
+
+// similarCache keeps the similar movies of each movie for a fixed time. The catalog changes
+// slowly, so a list a few minutes old is good enough and saves running the overlap query, which
+// scans the movie table, on every request. A nil *similarCache caches nothing.
+type similarCache struct {
+    mu      sync.Mutex
+    ttl     time.Duration
+    entries map[int64]similarCacheEntry
+}
+
+type similarCacheEntry struct {
+    movies  []*data.Movie
+    expires time.Time
+}
+
+// newSimilarCache returns a cache keeping entries for ttl, or nil if ttl is 0.
+func newSimilarCache(ttl time.Duration) *similarCache {
+    if ttl <= 0 {
+        return nil
+    }
+
+    return &similarCache{ttl: ttl, entries: make(map[int64]similarCacheEntry)}
+}
+
+// get returns the cached similar movies of the movie with the given id, if they haven't expired.
+func (c *similarCache) get(id int64) ([]*data.Movie, bool) {
+    if c == nil {
+        return nil, false
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[id]
+    if !ok || time.Now().After(entry.expires) {
+        return nil, false
+    }
+
+    return entry.movies, true
+}
+
+// set caches the similar movies of the movie with the given id. When the cache is full the
+// expired entries are dropped, and all of them if none has expired.
+func (c *similarCache) set(id int64, movies []*data.Movie) {
+    if c == nil {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := time.Now()
+
+    if len(c.entries) >= maxSimilarCacheEntries {
+        for key, entry := range c.entries {
+            if now.After(entry.expires) {
+                delete(c.entries, key)
+            }
+        }
+        if len(c.entries) >= maxSimilarCacheEntries {
+            clear(c.entries)
+        }
+    }
+
+    c.entries[id] = similarCacheEntry{movies: movies, expires: now.Add(c.ttl)}
+}
+
+// showSimilarMoviesHandler lists the movies sharing the most genres with a movie. A movie sharing
+// no genre with any other gets an empty list.
+func (app *application) showSimilarMoviesHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    v := validator.New()
+
+    limit := app.readIntRange(r.URL.Query(), "limit", 10, 1, maxSimilarMovies, v)
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    movies, ok := app.similarMovies.get(id)
+    if !ok {
+        _, err = app.models.Movie.Get(r.Context(), id)
+        if err != nil {
+            switch {
+            case errors.Is(err, data.ErrRecordNotFound):
+                app.notFoundResponse(w, r)
+            default:
+                app.serverErrorResponse(w, r, err)
+            }
+            return
+        }
+
+        movies, err = app.models.Movie.GetSimilar(r.Context(), id, maxSimilarMovies)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+            return
+        }
+
+        app.similarMovies.set(id, movies)
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"movies": movies[:min(limit, len(movies))]}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
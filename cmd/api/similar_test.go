@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// similarTitles requests the similar movies of target and returns their titles.
+func similarTitles(t *testing.T, h http.Handler, token, target string) []string {
+    t.Helper()
+
+    rr := do(t, h, http.MethodGet, target, token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        Movies []data.Movie `json:"movies"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.Movies == nil {
+        t.Fatalf("got null movies; body: %s", rr.Body)
+    }
+
+    titles := []string{}
+    for _, movie := range resp.Movies {
+        titles = append(titles, movie.Title)
+    }
+
+    return titles
+}
+
+func TestShowSimilarMoviesHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    movies := []map[string]any{
+        {"title": "Thor: Ragnarok", "year": 2017, "runtime": "130 mins", "genres": []string{"action", "adventure"}},
+        {"title": "Lady Bird", "year": 2017, "runtime": "94 mins", "genres": []string{"drama"}},
+    }
+    for _, movie := range movies {
+        rr := do(t, h, http.MethodPost, "/v1/movies", token, movie)
+        if rr.Code != http.StatusCreated {
+            t.Fatalf("create: got status %d; body: %s", rr.Code, rr.Body)
+        }
+    }
+
+    tests := []struct {
+        target string
+        want   []string
+    }{
+        // Thor shares both genres; Moana and Deadpool one each and are as far in years.
+        {"/v1/movies/2/similar", []string{"Thor: Ragnarok", "Moana", "Deadpool"}},
+        {"/v1/movies/2/similar?limit=1", []string{"Thor: Ragnarok"}},
+        // Thor and Black Panther share one genre with Moana, Thor is closer in years.
+        {"/v1/movies/1/similar", []string{"Thor: Ragnarok", "Black Panther"}},
+        {"/v1/movies/5/similar", []string{}},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.target, func(t *testing.T) {
+            if got := similarTitles(t, h, token, tt.target); !slices.Equal(got, tt.want) {
+                t.Errorf("got %q; want %q", got, tt.want)
+            }
+        })
+    }
+
+    if rr := do(t, h, http.MethodGet, "/v1/movies/99/similar", token, nil); rr.Code != http.StatusNotFound {
+        t.Errorf("unknown movie: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    for _, limit := range []string{"0", "51", "ten"} {
+        if rr := do(t, h, http.MethodGet, "/v1/movies/1/similar?limit="+limit, token, nil); rr.Code != http.StatusUnprocessableEntity {
+            t.Errorf("limit=%s: got status %d; want %d", limit, rr.Code, http.StatusUnprocessableEntity)
+        }
+    }
+}
+
+func TestShowSimilarMoviesCache(t *testing.T) {
+    app := newTestApplication(t)
+    app.similarMovies = newSimilarCache(time.Minute)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    want := []string{"Black Panther"}
+    if got := similarTitles(t, h, token, "/v1/movies/1/similar"); !slices.Equal(got, want) {
+        t.Fatalf("got %q; want %q", got, want)
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/movies", token, map[string]any{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation", "adventure"}})
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("create: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    // The new movie isn't listed until the cached list expires.
+    if got := similarTitles(t, h, token, "/v1/movies/1/similar"); !slices.Equal(got, want) {
+        t.Errorf("cached: got %q; want %q", got, want)
+    }
+
+    app.similarMovies = newSimilarCache(time.Minute)
+
+    want = []string{"Up", "Black Panther"}
+    if got := similarTitles(t, h, token, "/v1/movies/1/similar"); !slices.Equal(got, want) {
+        t.Errorf("uncached: got %q; want %q", got, want)
+    }
+}
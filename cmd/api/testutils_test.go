@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/i18n"
+	"greenlight.zzh.net/internal/task"
+)
+
+// sentEmail records a single call to stubSender.Send.
+type sentEmail struct {
+    to           string
+    templateFile string
+    data         any
+}
+
+// stubSender is a mail.Sender which records emails instead of sending them.
+type stubSender struct {
+    mu   sync.Mutex
+    sent []sentEmail
+}
+
+func (s *stubSender) Send(to, templateFile string, data any) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.sent = append(s.sent, sentEmail{to: to, templateFile: templateFile, data: data})
+    return nil
+}
+
+// newTestApplication returns an application wired to in-memory models, a stub mail sender and
+// a logger which discards its output.
+func newTestApplication(t testing.TB) *application {
+    t.Helper()
+
+    cfg := appConfig{
+        env:            "testing",
+        maxBodyBytes:   1_048_576,
+        auditStore:     "log",
+        limiter:        new(atomic.Pointer[config.LimiterConfig]),
+        authLimiter:    new(atomic.Pointer[config.LimiterConfig]),
+        apiKeys:        new(atomic.Pointer[config.APIKeyConfig]),
+        permissions:    new(atomic.Pointer[config.PermissionConfig]),
+        serverTiming:   new(atomic.Bool),
+        trustedOrigins: new(atomic.Pointer[[]*regexp.Regexp]),
+        frontendURL:    new(atomic.Pointer[url.URL]),
+        registration:   new(atomic.Pointer[config.RegistrationConfig]),
+        unactivated:    new(atomic.Pointer[config.UnactivatedUsersConfig]),
+        lists:          new(atomic.Pointer[config.ListConfig]),
+    }
+    cfg.limiter.Store(&config.LimiterConfig{Enabled: false})
+    cfg.authLimiter.Store(&config.LimiterConfig{Enabled: false})
+    cfg.apiKeys.Store(&config.APIKeyConfig{MaxPerUser: 2})
+    cfg.permissions.Store(&config.PermissionConfig{MovieWriteCanDelete: true})
+    cfg.registration.Store(&config.RegistrationConfig{Honeypot: true, BlockedDomains: data.DisposableEmailDomains()})
+    cfg.unactivated.Store(&config.UnactivatedUsersConfig{})
+    cfg.lists.Store(&config.ListConfig{
+        Movies: config.PageSizes{Default: 20, Max: 100},
+        Users:  config.PageSizes{Default: 20, Max: 100},
+    })
+    cfg.poster.maxBytes = 1024
+    cfg.cascadeDeletes = true
+    cfg.coalesceReads = true
+    cfg.passwords.rejectCommon = true
+    cfg.email.delivery = "direct"
+    cfg.authTokens.ttl = 24 * time.Hour
+    cfg.authTokens.maxLifetime = 7 * 24 * time.Hour
+    cfg.authTokens.extendAfter = 15 * time.Minute
+
+    catalog, err := i18n.Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    app := &application{
+        config:        cfg,
+        logger:        slog.New(slog.NewTextHandler(io.Discard, nil)),
+        models:        mock.NewModels(),
+        emailSender:   &stubSender{},
+        catalog:       catalog,
+        startTime:     time.Now(),
+        movieReads:    newMovieReads(),
+        shutdownHooks: &shutdownHooks{},
+    }
+
+    app.dbReady.Store(true)
+
+    app.tasks = task.NewRunner(app.logger, 2, 10, &app.wg)
+    t.Cleanup(app.tasks.Close)
+
+    return app
+}
+
+// authToken creates an authentication token for the given user and returns its plaintext.
+func authToken(t testing.TB, app *application, userID int64) string {
+    t.Helper()
+
+    token, err := app.models.Token.New(context.Background(), userID, time.Hour, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    return token.Plaintext
+}
+
+// do sends a request through the full routes() handler and returns the recorded response.
+func do(t *testing.T, h http.Handler, method, target, token string, body any) *httptest.ResponseRecorder {
+    t.Helper()
+
+    var r io.Reader
+    switch b := body.(type) {
+    case nil:
+    case string:
+        r = bytes.NewBufferString(b)
+    default:
+        js, err := json.Marshal(b)
+        if err != nil {
+            t.Fatal(err)
+        }
+        r = bytes.NewReader(js)
+    }
+
+    req := httptest.NewRequest(method, target, r)
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+
+    return rr
+}
+
+// decode unmarshals the response body into dst, failing the test on error.
+func decode(t *testing.T, rr *httptest.ResponseRecorder, dst any) {
+    t.Helper()
+
+    err := json.Unmarshal(rr.Body.Bytes(), dst)
+    if err != nil {
+        t.Fatalf("decoding response %q: %v", rr.Body.String(), err)
+    }
+}
+
+// update rewrites the golden files with the responses got, e.g. after a deliberate change of a
+// response: go test ./cmd/api -run Golden -update
+var update = flag.Bool("update", false, "rewrite the golden files of the response tests")
+
+// volatileKeys are the keys of the response bodies whose values change from run to run, such as
+// timestamps and tokens. assertGolden replaces their values with "<volatile>".
+var volatileKeys = map[string]bool{
+    "created_at":    true,
+    "updated_at":    true,
+    "expiry":        true,
+    "last_login_at": true,
+    "last_used_at":  true,
+    "token":         true,
+}
+
+// scrub replaces the values of the volatileKeys in v, a decoded JSON value, recursively. Error
+// messages are kept, e.g. the message of the token field in {"error": {"token": "..."}}.
+func scrub(v any) {
+    switch v := v.(type) {
+    case map[string]any:
+        for key, value := range v {
+            if key == "error" {
+                continue
+            }
+            if volatileKeys[key] && value != nil {
+                v[key] = "<volatile>"
+                continue
+            }
+            scrub(value)
+        }
+    case []any:
+        for _, value := range v {
+            scrub(value)
+        }
+    }
+}
+
+// assertGolden compares the status code and JSON body of rr, with the volatileKeys scrubbed, to
+// the golden file testdata/golden/name.json, or writes the file with -update.
+func assertGolden(t *testing.T, name string, rr *httptest.ResponseRecorder) {
+    t.Helper()
+
+    var body any
+    err := json.Unmarshal(rr.Body.Bytes(), &body)
+    if err != nil {
+        t.Fatalf("decoding response %q: %v", rr.Body.String(), err)
+    }
+    scrub(body)
+
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    enc.SetIndent("", "    ")
+
+    err = enc.Encode(map[string]any{"status": rr.Code, "body": body})
+    if err != nil {
+        t.Fatal(err)
+    }
+    got := buf.Bytes()
+
+    file := filepath.Join("testdata", "golden", name+".json")
+
+    if *update {
+        err := os.MkdirAll(filepath.Dir(file), 0o755)
+        if err == nil {
+            err = os.WriteFile(file, got, 0o644)
+        }
+        if err != nil {
+            t.Fatal(err)
+        }
+        return
+    }
+
+    want, err := os.ReadFile(file)
+    if err != nil {
+        t.Fatalf("reading golden file (run the test with -update to create it): %v", err)
+    }
+
+    if !bytes.Equal(got, want) {
+        t.Errorf("response doesn't match %s (run the test with -update if the change is deliberate)\ngot:\n%s\nwant:\n%s", file, got, want)
+    }
+}
+
+// assertSortOrder checks that ids, the records of a list in the order of the sort query
+// parameter sort, are sorted by compare in the direction of sort, with ties in ascending order of
+// id. compare compares the records with the given ids by the sort column.
+func assertSortOrder(t *testing.T, sort string, ids []int64, compare func(a, b int64) int) {
+    t.Helper()
+
+    for i := 1; i < len(ids); i++ {
+        c := compare(ids[i-1], ids[i])
+        if strings.HasPrefix(sort, "-") {
+            c = -c
+        }
+
+        if c > 0 || c == 0 && ids[i-1] > ids[i] {
+            t.Fatalf("sort=%s: got ids %v; %d is out of order", sort, ids, ids[i])
+        }
+    }
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"net/http"
-	"time"
 
+	"github.com/tomasen/realip"
 	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/metrics"
 	"greenlight.zzh.net/internal/validator"
 )
 
@@ -21,20 +24,28 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
         return
     }
 
+    input.Email = data.NormalizeEmail(input.Email)
+
     v := validator.New()
 
-    data.ValidateEmail(v, input.Email)
+    // The disposable email domains are only blocked on registration, so that the users who
+    // registered before can still log in.
+    data.ValidateEmail(v, input.Email, nil)
     data.ValidatePassword(v, input.Password)
 
     if !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+        app.failedValidationResponse(w, r, v)
         return
     }
 
-    user, err := app.models.User.GetByEmail(input.Email)
+    user, err := app.models.User.GetByEmail(r.Context(), input.Email)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
+            // Take as long as checking a wrong password would.
+            data.DummyPasswordMatch(input.Password)
+            app.audit(r, data.AuditLoginFailed, nil, input.Email, "unknown email")
+            metrics.AuthFailureUnknownEmail.Inc()
             app.invalidCredentialsResponse(w, r)
         default:
             app.serverErrorResponse(w, r, err)
@@ -48,17 +59,284 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
         return
     }
     if !match {
+        app.audit(r, data.AuditLoginFailed, user, "", "wrong password")
+        metrics.AuthFailureBadPassword.Inc()
         app.invalidCredentialsResponse(w, r)
         return
     }
 
-    token, err := app.models.Token.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+    // The password is right, but it may be known to whoever compromised the account.
+    if user.PasswordResetRequired {
+        app.audit(r, data.AuditLoginFailed, user, "", "password reset required")
+        app.passwordResetRequiredResponse(w, r)
+        return
+    }
+
+    token, err := app.models.Token.New(r.Context(), user.ID, app.config.authTokens.ttl, data.ScopeAuthentication)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    app.audit(r, data.AuditLoginSucceeded, user, "", "")
+    metrics.AuthSuccess.Inc()
+
+    // Record the login in background so that it doesn't delay the response.
+    ip := realip.FromRequest(r)
+    userAgent := r.UserAgent()
+
+    app.tasks.Submit("update last login", func() error {
+        return app.models.User.UpdateLastLogin(context.Background(), user.ID, ip, userAgent)
+    })
+
+    // Upgrade a hash made before the bcrypt cost was raised, in background too since hashing is
+    // deliberately slow. If the password has been changed meanwhile, the new hash is kept.
+    if user.Password.NeedsRehash() {
+        plaintext := input.Password
+
+        app.tasks.Submit("upgrade password hash", func() error {
+            err := user.Password.Set(plaintext)
+            if err == nil {
+                err = app.models.User.UpdatePasswordHash(context.Background(), user)
+            }
+
+            switch {
+            case err == nil:
+                app.logger.Info("password hash upgraded", "user_id", user.ID)
+            case errors.Is(err, data.ErrEditConflict):
+            default:
+                return err
+            }
+
+            return nil
+        })
+    }
+
+    err = app.writeResponse(w, r, http.StatusCreated, envelope{"authentication_token": token}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// createAPIKeyHandler creates a named API key for the authenticated user. The plaintext key is
+// only ever returned in this response.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Name string `json:"name"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    v := validator.New()
+
+    if data.ValidateTokenName(v, input.Name); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    user := app.contextGetUser(r)
+
+    count, err := app.models.Token.CountForUser(r.Context(), user.ID, data.ScopeAPIKey)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    limit := app.config.apiKeys.Load().MaxPerUser
+    if count >= limit {
+        app.apiKeyLimitExceededResponse(w, r, limit)
+        return
+    }
+
+    token, err := app.models.Token.NewAPIKey(r.Context(), user.ID, input.Name)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusCreated, envelope{"api_key": token}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// listAPIKeysHandler lists the API keys of the authenticated user without their plaintext.
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+
+    tokens, err := app.models.Token.GetAllForUser(r.Context(), user.ID, data.ScopeAPIKey)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"api_keys": tokens}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// deleteAPIKeyHandler revokes an API key of the authenticated user.
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    user := app.contextGetUser(r)
+
+    err = app.models.Token.DeleteForUser(r.Context(), id, user.ID, data.ScopeAPIKey)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "API key successfully deleted"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// listCurrentUserTokensHandler lists the authentication tokens, i.e. the sessions, of the
+// authenticated user. The token used for the request is flagged as current.
+func (app *application) listCurrentUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+    currentHash := app.contextGetTokenHash(r)
+
+    tokens, err := app.models.Token.GetAllForUser(r.Context(), user.ID, data.ScopeAuthentication)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    for _, token := range tokens {
+        token.Current = bytes.Equal(token.Hash, currentHash)
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"tokens": tokens}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// deleteCurrentUserTokenHandler revokes one authentication token of the authenticated user.
+func (app *application) deleteCurrentUserTokenHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readInt64Param(r, "token_id")
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    user := app.contextGetUser(r)
+
+    err = app.models.Token.DeleteForUser(r.Context(), id, user.ID, data.ScopeAuthentication)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "token successfully revoked"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// deleteOtherCurrentUserTokensHandler revokes all authentication tokens of the authenticated
+// user except the one used for the request.
+func (app *application) deleteOtherCurrentUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+
+    err := app.models.Token.DeleteAllForUserExcept(r.Context(), user.ID, data.ScopeAuthentication, app.contextGetTokenHash(r))
     if err != nil {
         app.serverErrorResponse(w, r, err)
         return
     }
 
-    err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "other tokens successfully revoked"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// userForAdmin returns the user with the :id of an admin route on another user's data. It sends
+// the error response and returns nil if there's no such user.
+func (app *application) userForAdmin(w http.ResponseWriter, r *http.Request) *data.User {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return nil
+    }
+
+    user, err := app.models.User.Get(r.Context(), id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return nil
+    }
+
+    return user
+}
+
+// showUserTokenCountsHandler sends the number of unexpired tokens of a user by scope, e.g. to
+// see whether a user who can't activate their account has any activation tokens.
+func (app *application) showUserTokenCountsHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.userForAdmin(w, r)
+    if user == nil {
+        return
+    }
+
+    counts := make(map[string]int, len(data.Scopes))
+
+    for _, scope := range data.Scopes {
+        n, err := app.models.Token.CountForUser(r.Context(), user.ID, scope)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+            return
+        }
+        counts[scope] = n
+    }
+
+    err := app.writeResponse(w, r, http.StatusOK, envelope{"token_counts": counts}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// deleteUserTokensHandler deletes all tokens of a user in every scope, API keys included.
+func (app *application) deleteUserTokensHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.userForAdmin(w, r)
+    if user == nil {
+        return
+    }
+
+    deleted, err := app.models.Token.DeleteAllForUserAllScopes(r.Context(), user.ID)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    app.logger.Info("user tokens purged", "user_id", user.ID, "count", deleted)
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"deleted": deleted}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
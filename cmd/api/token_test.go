@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/metrics"
+)
+
+func TestAPIKeys(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    rr := do(t, h, http.MethodPost, "/v1/tokens/api-keys", token, map[string]any{"name": ""})
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("empty name: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/tokens/api-keys", token, map[string]any{"name": "importer"})
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("create: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var created struct {
+        APIKey data.Token `json:"api_key"`
+    }
+    decode(t, rr, &created)
+
+    key := created.APIKey
+    if !strings.HasPrefix(key.Plaintext, data.APIKeyPrefix) || !strings.HasPrefix(key.Plaintext, key.Prefix) {
+        t.Fatalf("got key %q with prefix %q", key.Plaintext, key.Prefix)
+    }
+    if key.Expiry != nil {
+        t.Errorf("got expiry %v; want none", key.Expiry)
+    }
+
+    // The API key authenticates like an authentication token and its use is recorded.
+    rr = do(t, h, http.MethodGet, "/v1/movies", key.Plaintext, nil)
+    app.wg.Wait()
+    if rr.Code != http.StatusOK {
+        t.Fatalf("use key: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/tokens/api-keys", key.Plaintext, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("list: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var listed struct {
+        APIKeys []data.Token `json:"api_keys"`
+    }
+    decode(t, rr, &listed)
+
+    if len(listed.APIKeys) != 1 {
+        t.Fatalf("got %d API keys; want 1", len(listed.APIKeys))
+    }
+    if got := listed.APIKeys[0]; got.Plaintext != "" || got.Name != "importer" || got.LastUsedAt == nil {
+        t.Errorf("got listed key %+v; want named key with last use and no plaintext", got)
+    }
+
+    // The test application allows two keys per user.
+    rr = do(t, h, http.MethodPost, "/v1/tokens/api-keys", token, map[string]any{"name": "second"})
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("second key: got status %d; body: %s", rr.Code, rr.Body)
+    }
+    rr = do(t, h, http.MethodPost, "/v1/tokens/api-keys", token, map[string]any{"name": "third"})
+    if rr.Code != http.StatusConflict {
+        t.Fatalf("third key: got status %d; want %d", rr.Code, http.StatusConflict)
+    }
+
+    // Other users can't delete the key.
+    target := fmt.Sprintf("/v1/tokens/api-keys/%d", key.ID)
+
+    rr = do(t, h, http.MethodDelete, target, authToken(t, app, mock.AdminUserID), nil)
+    if rr.Code != http.StatusNotFound {
+        t.Fatalf("delete as other user: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    rr = do(t, h, http.MethodDelete, target, token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("delete: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/movies", key.Plaintext, nil)
+    if rr.Code != http.StatusUnauthorized {
+        t.Fatalf("use deleted key: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+}
+
+func TestTokenLastUsedThrottled(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+    tokens := app.models.Token.(*mock.TokenModel)
+
+    // Only the first use within TokenLastUsedInterval is written; the others don't call the
+    // database.
+    for i := range 3 {
+        if rr := do(t, h, http.MethodGet, "/v1/movies", token, nil); rr.Code != http.StatusOK {
+            t.Fatalf("request %d: got status %d; body: %s", i+1, rr.Code, rr.Body)
+        }
+        app.wg.Wait()
+    }
+
+    if got := tokens.LastUsedCalls(); got != 1 {
+        t.Errorf("got %d calls of UpdateLastUsed; want 1", got)
+    }
+}
+
+func TestCurrentUserTokens(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    current := authToken(t, app, mock.ActivatedUserID)
+    other := authToken(t, app, mock.ActivatedUserID)
+    third := authToken(t, app, mock.ActivatedUserID)
+    foreign := authToken(t, app, mock.AdminUserID)
+
+    rr := do(t, h, http.MethodGet, "/v1/users/me/tokens", current, nil)
+    app.wg.Wait()
+    if rr.Code != http.StatusOK {
+        t.Fatalf("list: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        Tokens []data.Token `json:"tokens"`
+    }
+    decode(t, rr, &resp)
+
+    if len(resp.Tokens) != 3 {
+        t.Fatalf("got %d tokens; want 3", len(resp.Tokens))
+    }
+
+    var currentID, otherID int64
+    for _, token := range resp.Tokens {
+        switch {
+        case token.Current:
+            currentID = token.ID
+            if !strings.HasPrefix(current, token.Prefix) {
+                t.Errorf("got prefix %q for current token %q", token.Prefix, current)
+            }
+        case strings.HasPrefix(other, token.Prefix):
+            otherID = token.ID
+        }
+    }
+    if currentID == 0 || otherID == 0 {
+        t.Fatalf("couldn't identify tokens in %+v", resp.Tokens)
+    }
+
+    // Tokens of other users can't be revoked.
+    rr = do(t, h, http.MethodDelete, fmt.Sprintf("/v1/users/me/tokens/%d", otherID), foreign, nil)
+    if rr.Code != http.StatusNotFound {
+        t.Fatalf("revoke as other user: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    rr = do(t, h, http.MethodDelete, fmt.Sprintf("/v1/users/me/tokens/%d", otherID), current, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("revoke: got status %d; body: %s", rr.Code, rr.Body)
+    }
+    if rr = do(t, h, http.MethodGet, "/v1/movies", other, nil); rr.Code != http.StatusUnauthorized {
+        t.Fatalf("revoked token: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+
+    rr = do(t, h, http.MethodDelete, "/v1/users/me/tokens", current, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("revoke others: got status %d; body: %s", rr.Code, rr.Body)
+    }
+    if rr = do(t, h, http.MethodGet, "/v1/movies", third, nil); rr.Code != http.StatusUnauthorized {
+        t.Errorf("other token: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+    if rr = do(t, h, http.MethodGet, "/v1/movies", current, nil); rr.Code != http.StatusOK {
+        t.Errorf("current token: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+    if rr = do(t, h, http.MethodGet, "/v1/movies", foreign, nil); rr.Code != http.StatusOK {
+        t.Errorf("token of other user: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    // The tokens of a user by ID are for admins only.
+    rr = do(t, h, http.MethodGet, "/v1/users/1/tokens", current, nil)
+    if rr.Code != http.StatusForbidden {
+        t.Errorf("tokens by id: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+}
+
+func TestUserTokensAdmin(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    ctx := context.Background()
+    admin := authToken(t, app, mock.AdminUserID)
+
+    // Carol has a token of every scope, Alice an authentication token.
+    for _, scope := range []string{data.ScopeActivation, data.ScopeActivation, data.ScopeAuthentication} {
+        _, err := app.models.Token.New(ctx, mock.ReadOnlyUserID, time.Hour, scope)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, err := app.models.Token.NewAPIKey(ctx, mock.ReadOnlyUserID, "ci")
+    if err != nil {
+        t.Fatal(err)
+    }
+    alice := authToken(t, app, mock.ActivatedUserID)
+
+    rr := do(t, h, http.MethodGet, "/v1/users/3/tokens", admin, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("counts: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var counts struct {
+        TokenCounts map[string]int `json:"token_counts"`
+    }
+    decode(t, rr, &counts)
+
+    want := map[string]int{data.ScopeActivation: 2, data.ScopeAuthentication: 1, data.ScopeAPIKey: 1, data.ScopePasswordReset: 0}
+    if !maps.Equal(counts.TokenCounts, want) {
+        t.Errorf("got counts %v; want %v", counts.TokenCounts, want)
+    }
+
+    if rr := do(t, h, http.MethodDelete, "/v1/users/3/tokens", alice, nil); rr.Code != http.StatusForbidden {
+        t.Errorf("purge without users:admin: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+    if rr := do(t, h, http.MethodDelete, "/v1/users/99/tokens", admin, nil); rr.Code != http.StatusNotFound {
+        t.Errorf("purge unknown user: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    rr = do(t, h, http.MethodDelete, "/v1/users/3/tokens", admin, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("purge: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var purged struct {
+        Deleted int64 `json:"deleted"`
+    }
+    decode(t, rr, &purged)
+
+    if purged.Deleted != 4 {
+        t.Errorf("got %d tokens deleted; want 4", purged.Deleted)
+    }
+
+    for _, scope := range data.Scopes {
+        if n, _ := app.models.Token.CountForUser(ctx, mock.ReadOnlyUserID, scope); n != 0 {
+            t.Errorf("got %d %s tokens left", n, scope)
+        }
+    }
+
+    // The tokens of the other users are intact.
+    if rr := do(t, h, http.MethodGet, "/v1/users/me", alice, nil); rr.Code != http.StatusOK {
+        t.Errorf("other user's token: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+    if rr := do(t, h, http.MethodGet, "/v1/users/me", admin, nil); rr.Code != http.StatusOK {
+        t.Errorf("admin's token: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+}
+
+func TestAuthMetrics(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    activation, err := app.models.Token.New(context.Background(), mock.InactiveUserID, time.Hour, data.ScopeActivation)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        method  string
+        target  string
+        token   string
+        body    any
+        counter *metrics.Counter
+    }{
+        {"login", http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": mock.ActivatedUserEmail, "password": mock.FixturePassword}, metrics.AuthSuccess},
+        {"wrong password", http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": mock.ActivatedUserEmail, "password": "wr0ngpassword"}, metrics.AuthFailureBadPassword},
+        {"unknown email", http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": "nobody@example.com", "password": mock.FixturePassword}, metrics.AuthFailureUnknownEmail},
+        {"unknown token", http.MethodGet, "/v1/movies", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", nil, metrics.AuthFailureInvalidToken},
+        {"malformed token", http.MethodGet, "/v1/movies", "short", nil, metrics.AuthFailureInvalidToken},
+        {"activation", http.MethodPut, "/v1/users/activated", "", map[string]any{"token": activation.Plaintext}, metrics.ActivationSuccess},
+    }
+
+    counters := map[string]*metrics.Counter{
+        "auth_success":               metrics.AuthSuccess,
+        "auth_failure_bad_password":  metrics.AuthFailureBadPassword,
+        "auth_failure_unknown_email": metrics.AuthFailureUnknownEmail,
+        "auth_failure_invalid_token": metrics.AuthFailureInvalidToken,
+        "activation_success":         metrics.ActivationSuccess,
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            before := make(map[string]int64)
+            for name, c := range counters {
+                before[name] = c.Value()
+            }
+
+            do(t, h, tt.method, tt.target, tt.token, tt.body)
+
+            // Only the counter of the outcome moves, by one.
+            for name, c := range counters {
+                want := before[name]
+                if c == tt.counter {
+                    want++
+                }
+                if got := c.Value(); got != want {
+                    t.Errorf("got %s %d; want %d", name, got, want)
+                }
+            }
+        })
+    }
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    // Hash the password at the lowest cost, then raise the cost by one: the login must upgrade the
+    // hash without changing the version.
+    t.Cleanup(func() { data.SetPasswordCost(data.DefaultPasswordCost) })
+    if err := data.SetPasswordCost(bcrypt.MinCost); err != nil {
+        t.Fatal(err)
+    }
+
+    user := &data.User{Name: "Dave", Email: "dave@example.com", Activated: true}
+    if err := user.Password.Set(mock.FixturePassword); err != nil {
+        t.Fatal(err)
+    }
+    if err := app.models.User.Insert(context.Background(), user); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := data.SetPasswordCost(bcrypt.MinCost + 1); err != nil {
+        t.Fatal(err)
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": user.Email, "password": mock.FixturePassword})
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    app.wg.Wait()
+
+    upgraded, err := app.models.User.Get(context.Background(), user.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if upgraded.Password.NeedsRehash() {
+        t.Error("got the hash at the old cost; want it upgraded")
+    }
+    if match, _ := upgraded.Password.Matches(mock.FixturePassword); !match {
+        t.Error("got an upgraded hash which doesn't match the password")
+    }
+    if upgraded.Version != user.Version {
+        t.Errorf("got version %d; want %d", upgraded.Version, user.Version)
+    }
+}
+
+func TestSlidingExpiration(t *testing.T) {
+    tests := []struct {
+        name        string
+        sliding     bool
+        maxLifetime time.Duration
+        ttl         time.Duration // the time left before the token expires
+        want        time.Duration // the time left after the token is used
+    }{
+        {"disabled", false, 7 * 24 * time.Hour, time.Hour, time.Hour},
+        {"extended", true, 7 * 24 * time.Hour, time.Hour, 24 * time.Hour},
+        {"used recently", true, 7 * 24 * time.Hour, 24*time.Hour - 5*time.Minute, 24*time.Hour - 5*time.Minute},
+        {"capped by the maximum lifetime", true, 2 * time.Hour, time.Hour, 2 * time.Hour},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.authTokens.sliding = tt.sliding
+            app.config.authTokens.maxLifetime = tt.maxLifetime
+
+            token, err := app.models.Token.New(context.Background(), mock.ActivatedUserID, tt.ttl, data.ScopeAuthentication)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            rr := do(t, app.routes(), http.MethodGet, "/v1/movies/1", token.Plaintext, nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            app.wg.Wait()
+
+            user, err := app.models.User.GetForToken(context.Background(), data.ScopeAuthentication, token.Plaintext)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            got := time.Until(*user.TokenExpiry)
+            if got > tt.want || got < tt.want-time.Minute {
+                t.Errorf("got expiry in %v; want in %v", got.Round(time.Second), tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the instrumentation scope of the spans of the application.
+const tracerName = "greenlight.zzh.net/cmd/api"
+
+// newTracerProvider returns a tracer provider which exports spans in batches over OTLP/HTTP to
+// endpoint, e.g. http://localhost:4318, sampling sampleRatio of the traces started here. Traces
+// continued from a traceparent header follow the sampling decision of the caller.
+func newTracerProvider(ctx context.Context, endpoint string, sampleRatio float64) (*sdktrace.TracerProvider, error) {
+    exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+    if err != nil {
+        return nil, err
+    }
+
+    res := resource.NewWithAttributes(semconv.SchemaURL,
+        semconv.ServiceName("greenlight"),
+        semconv.ServiceVersion(version),
+    )
+
+    return sdktrace.NewTracerProvider(
+        sdktrace.WithBatcher(exporter),
+        sdktrace.WithResource(res),
+        sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+    ), nil
+}
+
+// trace starts a server span for each request, continuing the trace of the W3C traceparent
+// header if there is one, and records the status code of the response in it. It must be wrapped
+// by metrics, whose response writer has the status code. Without -otel-endpoint, next is
+// returned as is, so that requests pay nothing for tracing.
+func (app *application) trace(next http.Handler) http.Handler {
+    if app.tracer == nil {
+        return next
+    }
+
+    propagator := propagation.TraceContext{}
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+        ctx, span := app.tracer.Start(ctx, r.Method,
+            trace.WithSpanKind(trace.SpanKindServer),
+            trace.WithAttributes(
+                semconv.HTTPRequestMethodKey.String(r.Method),
+                semconv.URLPath(r.URL.Path),
+            ),
+        )
+        defer span.End()
+
+        next.ServeHTTP(w, r.WithContext(ctx))
+
+        if mrw, ok := w.(*metricsResponseWriter); ok {
+            span.SetAttributes(semconv.HTTPResponseStatusCode(mrw.statusCode))
+            if mrw.statusCode >= http.StatusInternalServerError {
+                span.SetStatus(codes.Error, http.StatusText(mrw.statusCode))
+            }
+        }
+    })
+}
+
+// emailEvent adds an event named name, e.g. email.enqueue, about an email with template to the
+// span of ctx, if it is being recorded.
+func emailEvent(ctx context.Context, name, template string) {
+    span := trace.SpanFromContext(ctx)
+    if !span.IsRecording() {
+        return
+    }
+
+    span.AddEvent(name, trace.WithAttributes(attribute.String("email.template", template)))
+}
+
+// sendEmail sends an email with app.emailSender. With tracing, the sending is an email.send span,
+// a child of the span of ctx if there is one, e.g. of the request the email is sent for. Only
+// the span context of ctx is used, so ctx may have been cancelled since.
+func (app *application) sendEmail(ctx context.Context, recipient, template string, data any) error {
+    if app.tracer == nil {
+        return app.emailSender.Send(recipient, template, data)
+    }
+
+    _, span := app.tracer.Start(ctx, "email.send", trace.WithAttributes(attribute.String("email.template", template)))
+    defer span.End()
+
+    err := app.emailSender.Send(recipient, template, data)
+    if err != nil {
+        span.RecordError(err)
+        span.SetStatus(codes.Error, err.Error())
+    }
+
+    return err
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+// traceParent is the W3C traceparent header of a sampled trace, made of traceID and parentSpanID.
+const (
+    traceParent  = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+    traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+    parentSpanID = "00f067aa0ba902b7"
+)
+
+// newTracedApplication returns a test application with tracing enabled, and the recorder of the
+// spans it ends.
+func newTracedApplication(t *testing.T) (*application, *tracetest.SpanRecorder) {
+    t.Helper()
+
+    recorder := tracetest.NewSpanRecorder()
+    provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+    app := newTestApplication(t)
+    app.tracer = provider.Tracer(tracerName)
+
+    return app, recorder
+}
+
+func TestTraceDisabled(t *testing.T) {
+    app := newTestApplication(t)
+
+    next := http.NewServeMux()
+    if app.trace(next) != next {
+        t.Error("got a wrapped handler with tracing disabled")
+    }
+}
+
+func TestTraceRequest(t *testing.T) {
+    app, recorder := newTracedApplication(t)
+
+    r := httptest.NewRequest(http.MethodGet, "/v1/movies/1", nil)
+    r.Header.Set("Authorization", "Bearer "+authToken(t, app, mock.ReadOnlyUserID))
+    r.Header.Set("traceparent", traceParent)
+
+    rr := httptest.NewRecorder()
+    app.routes().ServeHTTP(rr, r)
+
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    spans := recorder.Ended()
+    if len(spans) != 1 {
+        t.Fatalf("got %d spans; want 1", len(spans))
+    }
+
+    span := spans[0]
+    if got := span.SpanContext().TraceID().String(); got != traceID {
+        t.Errorf("got trace ID %s; want the trace ID of traceparent, %s", got, traceID)
+    }
+    if got := span.Parent().SpanID().String(); got != parentSpanID {
+        t.Errorf("got parent span ID %s; want %s", got, parentSpanID)
+    }
+
+    attrs := make(map[string]string)
+    for _, attr := range span.Attributes() {
+        attrs[string(attr.Key)] = attr.Value.Emit()
+    }
+    if attrs["http.request.method"] != "GET" || attrs["http.response.status_code"] != "200" {
+        t.Errorf("got attributes %v; want the method and status code", attrs)
+    }
+}
+
+func TestTraceEmails(t *testing.T) {
+    app, recorder := newTracedApplication(t)
+
+    r := httptest.NewRequest(http.MethodPost, "/v1/users", strings.NewReader(`{"name": "Dave", "email": "dave@example.com", "password": "correct horse battery"}`))
+    r.Header.Set("traceparent", traceParent)
+
+    rr := httptest.NewRecorder()
+    app.routes().ServeHTTP(rr, r)
+
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    app.wg.Wait()
+
+    var request, send sdktrace.ReadOnlySpan
+    for _, span := range recorder.Ended() {
+        switch span.Name() {
+        case http.MethodPost:
+            request = span
+        case "email.send":
+            send = span
+        }
+    }
+    if request == nil || send == nil {
+        t.Fatalf("got spans %v; want the request and email.send", recorder.Ended())
+    }
+
+    events := request.Events()
+    if len(events) != 1 || events[0].Name != "email.enqueue" {
+        t.Errorf("got request events %v; want email.enqueue", events)
+    }
+
+    // The email is sent after the response, in a child span of the request.
+    if send.Parent().SpanID() != request.SpanContext().SpanID() {
+        t.Errorf("got email.send parent %s; want the request span %s", send.Parent().SpanID(), request.SpanContext().SpanID())
+    }
+}
+
+func TestLogErrorTraceID(t *testing.T) {
+    app, _ := newTracedApplication(t)
+
+    var buf bytes.Buffer
+    app.logger = slog.New(slog.NewTextHandler(&buf, nil))
+
+    h := app.trace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        app.serverErrorResponse(w, r, errors.New("boom"))
+    }))
+
+    r := httptest.NewRequest(http.MethodGet, "/v1/movies", nil)
+    r.Header.Set("traceparent", traceParent)
+    h.ServeHTTP(httptest.NewRecorder(), r)
+
+    if !strings.Contains(buf.String(), "trace_id="+traceID) {
+        t.Errorf("got log %q; want the trace ID", buf.String())
+    }
+}
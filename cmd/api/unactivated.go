@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// unactivatedBatchSize is how many unactivated users are reminded per query.
+const unactivatedBatchSize = 100
+
+// processUnactivatedUsers reminds and deletes the unactivated users every
+// -unactivated-users-interval until stop is closed. A run which fails is logged and retried at
+// the next tick.
+func (app *application) processUnactivatedUsers(stop <-chan struct{}) {
+    ticker := time.NewTicker(app.config.unactivatedJob)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-stop:
+            return
+        case <-ticker.C:
+            if !app.dbReady.Load() {
+                continue
+            }
+
+            err := app.runUnactivatedUsersJob(context.Background())
+            if err != nil {
+                app.logger.Error("failed to process the unactivated users", "error", err)
+            }
+        }
+    }
+}
+
+// runUnactivatedUsersJob deletes the users who haven't activated their account within
+// UNACTIVATED_USER_TTL, then sends the ones who haven't within ACTIVATION_REMINDER_AFTER a
+// reminder with a new activation token, once. The users about to be deleted are deleted first, so
+// that they aren't reminded.
+func (app *application) runUnactivatedUsersJob(ctx context.Context) error {
+    cfg := app.config.unactivated.Load()
+    now := time.Now()
+
+    if cfg.DeleteAfter > 0 {
+        users, tokens, err := app.models.User.DeleteUnactivated(ctx, now.Add(-cfg.DeleteAfter))
+        if err != nil {
+            return err
+        }
+
+        if users > 0 {
+            app.logger.Info("deleted unactivated users", "users", users, "tokens", tokens, "older_than", cfg.DeleteAfter.String())
+        }
+    }
+
+    if cfg.RemindAfter <= 0 {
+        return nil
+    }
+
+    reminded := 0
+
+    for {
+        users, err := app.models.User.GetUnreminded(ctx, now.Add(-cfg.RemindAfter), unactivatedBatchSize)
+        if err != nil {
+            return err
+        }
+
+        for _, user := range users {
+            sent, err := app.remindUnactivatedUser(ctx, user, cfg.DeleteAfter)
+            if err != nil {
+                return err
+            }
+            if sent {
+                reminded++
+            }
+        }
+
+        // The reminded users aren't returned again, so the next batch starts after them.
+        if len(users) < unactivatedBatchSize {
+            break
+        }
+    }
+
+    if reminded > 0 {
+        app.logger.Info("reminded unactivated users", "users", reminded)
+    }
+
+    return nil
+}
+
+// remindUnactivatedUser replaces the activation tokens of user with a new one and sends it in an
+// activation reminder email. It reports false if the user was activated or reminded meanwhile. A
+// reminder which can't be sent directly is logged, not retried: the user is only reminded once.
+func (app *application) remindUnactivatedUser(ctx context.Context, user *data.User, deleteAfter time.Duration) (bool, error) {
+    // With the outbox, the email is queued in the same transaction as the new token.
+    email := app.activationReminderEmail(user, deleteAfter)
+
+    var queued *data.TokenEmail
+    if app.config.email.delivery == "outbox" {
+        queued = email
+    }
+
+    token, err := app.models.User.Remind(ctx, user, activationTTL, queued)
+    if err != nil {
+        if errors.Is(err, data.ErrRecordNotFound) {
+            return false, nil
+        }
+        return false, err
+    }
+
+    if app.config.email.delivery == "direct" {
+        err := app.sendEmail(ctx, user.Email, email.Template, email.Data(token))
+        if err != nil {
+            app.logger.Error("failed to send the activation reminder", "user_id", user.ID, "error", err)
+        }
+    }
+
+    return true, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestUnactivatedUsersJob(t *testing.T) {
+    app := newTestApplication(t)
+    ctx := context.Background()
+
+    var logs bytes.Buffer
+    app.logger = slog.New(slog.NewTextHandler(&logs, nil))
+
+    // Bob registered in 2024 and still has his first activation token.
+    oldToken, err := app.models.Token.New(ctx, mock.InactiveUserID, time.Hour, data.ScopeActivation)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A user who registered just now is neither reminded nor deleted.
+    recent := &data.User{Name: "Dave", Email: "dave@example.com"}
+    err = app.models.User.Insert(ctx, recent)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Anonymized users aren't activated, but they are kept.
+    err = app.models.User.Anonymize(ctx, mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    app.config.unactivated.Store(&config.UnactivatedUsersConfig{RemindAfter: 24 * time.Hour})
+
+    for range 2 {
+        err = app.runUnactivatedUsersJob(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    sender := app.emailSender.(*stubSender)
+    if len(sender.sent) != 1 || sender.sent[0].to != mock.InactiveUserEmail || sender.sent[0].templateFile != "activation_reminder.html" {
+        t.Fatalf("got emails %+v; want one activation reminder to %s", sender.sent, mock.InactiveUserEmail)
+    }
+
+    payload := sender.sent[0].data.(map[string]any)
+    if _, ok := payload["deleteAfterDays"]; ok {
+        t.Errorf("got deleteAfterDays %v; want none without deletion", payload["deleteAfterDays"])
+    }
+
+    _, err = app.models.User.GetForToken(ctx, data.ScopeActivation, oldToken.Plaintext)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("old activation token: got error %v; want %v", err, data.ErrRecordNotFound)
+    }
+
+    user, err := app.models.User.GetForToken(ctx, data.ScopeActivation, payload["activationToken"].(string))
+    if err != nil || user.ID != mock.InactiveUserID {
+        t.Errorf("new activation token: got user %v and error %v; want user %d", user, err, mock.InactiveUserID)
+    }
+
+    if _, ok := app.models.User.(*mock.UserModel).RemindedAt(mock.InactiveUserID); !ok {
+        t.Error("got no reminded_at for the reminded user")
+    }
+
+    app.config.unactivated.Store(&config.UnactivatedUsersConfig{RemindAfter: 24 * time.Hour, DeleteAfter: 30 * 24 * time.Hour})
+
+    err = app.runUnactivatedUsersJob(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = app.models.User.Get(ctx, mock.InactiveUserID)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("unactivated user: got error %v; want %v", err, data.ErrRecordNotFound)
+    }
+
+    for _, id := range []int64{recent.ID, mock.ReadOnlyUserID, mock.ActivatedUserID} {
+        if _, err := app.models.User.Get(ctx, id); err != nil {
+            t.Errorf("user %d: got error %v; want the user kept", id, err)
+        }
+    }
+
+    if !strings.Contains(logs.String(), `msg="deleted unactivated users" users=1 tokens=1`) {
+        t.Errorf("got logs %q; want the deletion logged with its counts", logs.String())
+    }
+}
+
+func TestUnactivatedUsersJobLeavesNoPersonalData(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.email.delivery = "outbox"
+    ctx := context.Background()
+
+    err := app.models.Audit.Insert(ctx, &data.AuditEvent{Event: data.AuditLoginFailed, UserID: mock.InactiveUserID, Email: mock.InactiveUserEmail, IP: "192.0.2.1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Bob is reminded, and the reminder waits in the outbox when he is deleted.
+    app.config.unactivated.Store(&config.UnactivatedUsersConfig{RemindAfter: 24 * time.Hour})
+
+    err = app.runUnactivatedUsersJob(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    outbox := app.models.Outbox.(*mock.OutboxModel)
+    if pending := outbox.Pending(); len(pending) != 1 || pending[0].Recipient != mock.InactiveUserEmail {
+        t.Fatalf("got pending emails %+v; want the reminder to %s", pending, mock.InactiveUserEmail)
+    }
+
+    app.config.unactivated.Store(&config.UnactivatedUsersConfig{RemindAfter: 24 * time.Hour, DeleteAfter: 30 * 24 * time.Hour})
+
+    err = app.runUnactivatedUsersJob(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if pending := outbox.Pending(); len(pending) != 0 {
+        t.Errorf("got pending emails %+v after the deletion; want none", pending)
+    }
+    if n := app.dispatchOutbox(); n != 0 {
+        t.Errorf("dispatched %d emails to the deleted user; want 0", n)
+    }
+
+    for _, e := range app.models.Audit.(*mock.AuditModel).Events() {
+        if e.Email != "" || e.IP != "" {
+            t.Errorf("got event %+v of the deleted user; want it without email and IP", e)
+        }
+    }
+}
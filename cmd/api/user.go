@@ -1,19 +1,52 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/tomasen/realip"
+	"greenlight.zzh.net/internal/breach"
 	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/metrics"
 	"greenlight.zzh.net/internal/validator"
 )
 
+// validateNewPassword checks that a new password which passed data.ValidatePassword isn't too well
+// known: with -reject-common-passwords it mustn't be in the embedded list of common passwords, and
+// with -hibp it mustn't have been found in a breach. A failed breach lookup is logged and the
+// password accepted, so that signing up doesn't depend on the service.
+func (app *application) validateNewPassword(ctx context.Context, v *validator.Validator, password string) {
+    if _, ok := v.Errors["password"]; ok {
+        return
+    }
+
+    if app.config.passwords.rejectCommon && breach.Common(password) {
+        v.AddError("password", "is too common")
+        return
+    }
+
+    if app.breachClient == nil {
+        return
+    }
+
+    breached, err := app.breachClient.Breached(ctx, password)
+    if err != nil {
+        app.logger.Warn("password breach lookup failed, accepting the password", "error", err.Error())
+        return
+    }
+
+    v.Check(!breached, "password", "appears in known breach lists")
+}
+
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
     var input struct {
         Name     string `json:"name"`
         Email    string `json:"email"`
         Password string `json:"password"`
+        Website  string `json:"website"` // honeypot: hidden by the frontend, so only bots fill it
     }
 
     err := app.readJSON(w, r, &input)
@@ -24,10 +57,27 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
     user := &data.User{
         Name:      input.Name,
-        Email:     input.Email,
+        Email:     data.NormalizeEmail(input.Email),
         Activated: false,
     }
 
+    registration := app.config.registration.Load()
+
+    // A bot which filled the honeypot gets the response of a registration, so that it doesn't
+    // retry differently, but no user, token or email is created.
+    if registration.Honeypot && input.Website != "" {
+        metrics.RegistrationHoneypot.Inc()
+        app.logger.Info("registration honeypot filled", "email", user.Email, "ip", realip.FromRequest(r))
+
+        user.CreatedAt = time.Now()
+
+        err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+        if err != nil {
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
     err = user.Password.Set(input.Password)
     if err != nil {
         app.serverErrorResponse(w, r, err)
@@ -36,61 +86,258 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
     v := validator.New()
 
-    if data.ValidateUser(v, user); !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+    data.ValidateUser(v, user)
+    data.ValidateEmail(v, user.Email, registration.BlockedDomains)
+    app.validateNewPassword(r.Context(), v, input.Password)
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
         return
     }
 
-    // Insert the user data into the database.
-    err = app.models.User.Insert(user)
+    // Insert the user data into the database with the "movie:read" permission and an activation
+    // token. With the outbox, the welcome email is queued in the same transaction.
+    reg := data.Registration{
+        Permissions:   []string{"movie:read"},
+        ActivationTTL: activationTTL,
+    }
+    email := app.welcomeEmail(user)
+    if app.config.email.delivery == "outbox" {
+        reg.Email = email
+    }
+
+    token, err := app.models.User.Register(r.Context(), user, reg)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrDuplicateEmail):
             v.AddError("email", "a user with this email address already exists")
-            app.failedValidationResponse(w, r, v.Errors)
+            app.failedValidationResponse(w, r, v)
         default:
             app.serverErrorResponse(w, r, err)
         }
         return
     }
 
-    // Add the "movie:read" permission for the new user.
-    err = app.models.Permission.AddForUser(user.ID, "movie:read")
+    emailEvent(r.Context(), "email.enqueue", "user_welcome.html")
+
+    // Without the outbox, send the welcome email in background.
+    if app.config.email.delivery == "direct" {
+        app.tasks.Submit("welcome email", func() error {
+            return app.sendEmail(r.Context(), user.Email, email.Template, email.Data(token))
+        })
+    }
+
+    err = app.writeResponse(w, r, http.StatusCreated, envelope{"user": user}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        TokenPlaintext string `json:"token"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    v := validator.New()
+
+    if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    // The token is consumed with the activation, so that it can only be used once even by
+    // concurrent requests.
+    user, deleted, err := app.models.User.ActivateForToken(r.Context(), input.TokenPlaintext)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            v.AddError("token", "invalid or expired activation token")
+            app.failedValidationResponse(w, r, v)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    app.logger.Info("activation tokens deleted", "user_id", user.ID, "count", deleted)
+
+    app.audit(r, data.AuditUserActivated, user, "", "")
+    metrics.ActivationSuccess.Inc()
+
+    w.Header().Set("ETag", versionETag(int64(user.Version)))
+
+    // Send the updated user details to the client in a JSON response.
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// userSortSafeList are the sort values of GET /v1/users, each column in both directions.
+var userSortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        data.UserListParams
+        data.Filter
+    }
+
+    v := validator.New()
+
+    qs := r.URL.Query()
+
+    input.Email = app.readString(qs, "email", "")
+
+    input.Activated = app.readBool(qs, "activated", v)
+    input.CreatedAfter = app.readDate(qs, "created_after", v)
+    input.CreatedBefore = app.readDate(qs, "created_before", v)
+
+    // The page sizes are read once, so that a reload can't change them halfway.
+    pageSizes := app.config.lists.Load().Users
+
+    input.Filter.Page = app.readInt(qs, "page", 1, v)
+    input.Filter.DefaultPageSize = pageSizes.Default
+    input.Filter.MaxPageSize = pageSizes.Max
+    input.Filter.PageSize = app.readInt(qs, "page_size", input.Filter.DefaultPageSize, v)
+    input.Filter.Sort = app.readString(qs, "sort", "id")
+    input.Filter.SortSafeList = userSortSafeList
+
+    if data.ValidateFilter(v, input.Filter); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    users, metadata, err := app.models.User.GetAll(r.Context(), input.UserListParams, input.Filter)
     if err != nil {
         app.serverErrorResponse(w, r, err)
         return
     }
 
-    // After the user record is created in the database, generate a new activation token
-    // for the user.
-    token, err := app.models.Token.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+    metadata.Links = app.metadataLinks(r.URL, metadata)
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"users": users, "metadata": metadata}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
+    }
+}
+// showUserHandler returns any user. The route lets users read their own record, and readers
+// with users:read the others.
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
         return
     }
 
-    // Send the welcome email in background.
-    app.background(func() {
-        data := map[string]any{
-            "activationToken": token.Plaintext,
-            "userID":          user.ID,
+    user, err := app.models.User.Get(r.Context(), id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
         }
+        return
+    }
 
-        err = app.emailSender.Send(user.Email, "user_welcome.html", data)
-        if err != nil {
-            app.logger.Error(err.Error())
+    if notModified(w, r, versionETag(int64(user.Version))) {
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// showCurrentUserHandler returns the authenticated user.
+func (app *application) showCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+
+    if notModified(w, r, versionETag(int64(user.Version))) {
+        return
+    }
+
+    err := app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// updateCurrentUserHandler lets a user change their name and email address. Like the movie
+// update it honours If-Match and X-Expected-Version, see preconditionFailed().
+func (app *application) updateCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+    user := *app.contextGetUser(r)
+
+    if app.preconditionFailed(w, r, int64(user.Version)) {
+        return
+    }
+
+    var input struct {
+        Name  *string `json:"name"`
+        Email *string `json:"email"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    if input.Name != nil {
+        user.Name = *input.Name
+    }
+    if input.Email != nil {
+        user.Email = *input.Email
+    }
+
+    v := validator.New()
+
+    if data.ValidateUser(v, &user); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    err = app.models.User.Update(r.Context(), &user)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrDuplicateEmail):
+            v.AddError("email", "a user with this email address already exists")
+            app.failedValidationResponse(w, r, v)
+        case errors.Is(err, data.ErrEditConflict):
+            app.editConflictResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
         }
-    })
+        return
+    }
+
+    w.Header().Set("ETag", versionETag(int64(user.Version)))
 
-    err = app.writeJSON(w, http.StatusCreated, envelope{"user": user}, nil)
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"user": &user}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
 }
 
-func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+// updateCurrentUserPasswordHandler lets a user change their password, given the current one.
+// The user's other authentication tokens are revoked, signing out their other sessions.
+func (app *application) updateCurrentUserPasswordHandler(w http.ResponseWriter, r *http.Request) {
+    user := *app.contextGetUser(r)
+
+    if app.preconditionFailed(w, r, int64(user.Version)) {
+        return
+    }
+
     var input struct {
-        TokenPlaintext string `json:"token"`
+        CurrentPassword string `json:"current_password"`
+        Password        string `json:"password"`
     }
 
     err := app.readJSON(w, r, &input)
@@ -101,31 +348,160 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
     v := validator.New()
 
-    if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
-        app.failedValidationResponse(w, r, v.Errors)
+    v.Check(input.CurrentPassword != "", "current_password", "must be provided")
+    data.ValidatePassword(v, input.Password)
+    app.validateNewPassword(r.Context(), v, input.Password)
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
         return
     }
 
-    user, err := app.models.User.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+    match, err := user.Password.Matches(input.CurrentPassword)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    if !match {
+        app.invalidCredentialsResponse(w, r)
+        return
+    }
+
+    err = user.Password.Set(input.Password)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    err = app.models.User.Update(r.Context(), &user)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrEditConflict):
+            app.editConflictResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = app.models.Token.DeleteAllForUserExcept(r.Context(), user.ID, data.ScopeAuthentication, app.contextGetTokenHash(r))
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    app.audit(r, data.AuditPasswordChanged, &user, "", "")
+
+    w.Header().Set("ETag", versionETag(int64(user.Version)))
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "password successfully changed"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// activationTTL is the lifetime of the activation tokens sent on registration and with the
+// activation reminders.
+const activationTTL = 3 * 24 * time.Hour
+
+// passwordResetTTL is the lifetime of the password reset tokens sent by forcePasswordResetHandler.
+const passwordResetTTL = 24 * time.Hour
+
+// forcePasswordResetHandler locks a user, e.g. one whose account is compromised, out until they
+// reset their password: their tokens and API keys stop working at once, logging in is refused
+// with the password_reset_required error code, and a password reset token is emailed to them, to
+// be sent to resetPasswordHandler.
+func (app *application) forcePasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.userForAdmin(w, r)
+    if user == nil {
+        return
+    }
+
+    // With the outbox, the email is queued in the same transaction as the reset.
+    email := app.passwordResetEmail(user)
+
+    var queued *data.TokenEmail
+    if app.config.email.delivery == "outbox" {
+        queued = email
+    }
+
+    token, err := app.models.User.ForcePasswordReset(r.Context(), user, passwordResetTTL, queued)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
-            v.AddError("token", "invalid or expired activation token")
-            app.failedValidationResponse(w, r, v.Errors)
+            app.notFoundResponse(w, r)
         default:
             app.serverErrorResponse(w, r, err)
         }
         return
     }
 
-    // Update the user's activation status.
-    user.Activated = true
+    emailEvent(r.Context(), "email.enqueue", "password_reset.html")
 
-    // Save the updated user record in database.
-    err = app.models.User.Update(user)
+    if app.config.email.delivery == "direct" {
+        app.tasks.Submit("password reset email", func() error {
+            return app.sendEmail(r.Context(), user.Email, email.Template, email.Data(token))
+        })
+    }
+
+    app.audit(r, data.AuditPasswordResetForced, user, "", "by user "+strconv.FormatInt(app.contextGetUser(r).ID, 10))
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"user": user}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// resetPasswordHandler sets a new password with a password reset token, which doesn't need the
+// old password, and lets the user log in again if a reset was forced.
+func (app *application) resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        TokenPlaintext string `json:"token"`
+        Password       string `json:"password"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    v := validator.New()
+
+    data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+    data.ValidatePassword(v, input.Password)
+    app.validateNewPassword(r.Context(), v, input.Password)
+
+    if !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    user, err := app.models.User.GetForToken(r.Context(), data.ScopePasswordReset, input.TokenPlaintext)
     if err != nil {
         switch {
         case errors.Is(err, data.ErrRecordNotFound):
+            v.AddError("token", "invalid or expired password reset token")
+            app.failedValidationResponse(w, r, v)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = user.Password.Set(input.Password)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    user.PasswordResetRequired = false
+
+    err = app.models.User.Update(r.Context(), user)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrEditConflict):
             app.editConflictResponse(w, r)
         default:
             app.serverErrorResponse(w, r, err)
@@ -133,16 +509,103 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
         return
     }
 
-    // If everything went successfully, we delete all activation tokens for the user.
-    err = app.models.Token.DeleteAllForUser(user.ID, data.ScopeActivation)
+    // The token is for one use only.
+    _, err = app.models.Token.DeleteAllForUser(r.Context(), user.ID, data.ScopePasswordReset)
     if err != nil {
         app.serverErrorResponse(w, r, err)
         return
     }
 
-    // Send the updated user details to the client in a JSON response.
-    err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+    app.audit(r, data.AuditPasswordReset, user, "", "")
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "password successfully reset"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
+
+// deleteUser removes a user account according to the configured deletion mode. In "anonymize"
+// mode the row is kept with its personal data scrubbed, in "delete" mode it is removed. Either
+// way the user's tokens and permissions are deleted.
+func (app *application) deleteUser(ctx context.Context, id int64) error {
+    if app.config.userDeletionMode == "delete" {
+        return app.models.User.Delete(ctx, id)
+    }
+
+    return app.models.User.Anonymize(ctx, id)
+}
+
+// deleteUserHandler lets an administrator delete any user account.
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+    id, err := app.readIDParam(r)
+    if err != nil {
+        app.notFoundResponse(w, r)
+        return
+    }
+
+    err = app.deleteUser(r.Context(), id)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
     if err != nil {
         app.serverErrorResponse(w, r, err)
     }
-}
\ No newline at end of file
+}
+
+// deleteCurrentUserHandler lets a user delete their own account. The current password must be
+// provided so that a stolen token alone can't be used to delete the account.
+func (app *application) deleteCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+    var input struct {
+        Password string `json:"password"`
+    }
+
+    err := app.readJSON(w, r, &input)
+    if err != nil {
+        app.badRequestResponse(w, r, err)
+        return
+    }
+
+    v := validator.New()
+
+    if data.ValidatePassword(v, input.Password); !v.Valid() {
+        app.failedValidationResponse(w, r, v)
+        return
+    }
+
+    user := app.contextGetUser(r)
+
+    match, err := user.Password.Matches(input.Password)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    if !match {
+        app.invalidCredentialsResponse(w, r)
+        return
+    }
+
+    err = app.deleteUser(r.Context(), user.ID)
+    if err != nil {
+        switch {
+        case errors.Is(err, data.ErrRecordNotFound):
+            app.notFoundResponse(w, r)
+        default:
+            app.serverErrorResponse(w, r, err)
+        }
+        return
+    }
+
+    err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+    }
+}
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"greenlight.zzh.net/internal/breach"
+	"greenlight.zzh.net/internal/config"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestRegisterUserHandler(t *testing.T) {
+    tests := []struct {
+        name       string
+        body       any
+        wantStatus int
+        wantEmail  bool
+    }{
+        {"valid", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3"}, http.StatusCreated, true},
+        {"duplicate email", map[string]any{"name": "Alice", "email": mock.ActivatedUserEmail, "password": "tr0ub4dor&3"}, http.StatusUnprocessableEntity, false},
+        {"duplicate email in other case", map[string]any{"name": "Alice", "email": strings.ToUpper(mock.ActivatedUserEmail), "password": "tr0ub4dor&3"}, http.StatusUnprocessableEntity, false},
+        {"short password", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "pass"}, http.StatusUnprocessableEntity, false},
+        {"common password", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "Password123"}, http.StatusUnprocessableEntity, false},
+        {"unknown field", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3", "admin": true}, http.StatusBadRequest, false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            h := app.routes()
+
+            rr := do(t, h, http.MethodPost, "/v1/users", "", tt.body)
+            app.wg.Wait()
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+
+            sender := app.emailSender.(*stubSender)
+            if got := len(sender.sent); tt.wantEmail && got != 1 || !tt.wantEmail && got != 0 {
+                t.Fatalf("got %d emails sent; want email %t", got, tt.wantEmail)
+            }
+
+            if tt.wantEmail {
+                var resp struct {
+                    User struct {
+                        ID int64 `json:"id"`
+                    } `json:"user"`
+                }
+                decode(t, rr, &resp)
+
+                permissions, err := app.models.Permission.GetAllForUser(context.Background(), resp.User.ID)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if !permissions.Include("movie:read") {
+                    t.Errorf("new user is missing the movie:read permission")
+                }
+            }
+        })
+    }
+}
+
+
+func TestRegistrationBotProtection(t *testing.T) {
+    tests := []struct {
+        name       string
+        dynamic    config.Config
+        email      string
+        website    string
+        wantStatus int
+        wantUser   bool
+    }{
+        {"honeypot filled", config.Config{RegistrationHoneypotEnabled: true}, "dave@example.com", "https://spam.example", http.StatusCreated, false},
+        {"honeypot disabled", config.Config{}, "dave@example.com", "https://dave.example", http.StatusCreated, true},
+        {"disposable domain", config.Config{DisposableEmailsBlocked: true}, "dave@mailinator.com", "", http.StatusUnprocessableEntity, false},
+        {"disposable subdomain", config.Config{DisposableEmailsBlocked: true}, "dave@eu.yopmail.com", "", http.StatusUnprocessableEntity, false},
+        {"configured domain", config.Config{DisposableEmailsBlocked: true, DisposableEmailDomains: "spam.example"}, "dave@spam.example", "", http.StatusUnprocessableEntity, false},
+        {"disposable domains allowed", config.Config{DisposableEmailDomains: "spam.example"}, "dave@mailinator.com", "", http.StatusCreated, true},
+        {"other domain", config.Config{RegistrationHoneypotEnabled: true, DisposableEmailsBlocked: true}, "dave@example.com", "", http.StatusCreated, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.registration.Store(tt.dynamic.Registration())
+            h := app.routes()
+
+            body := map[string]any{"name": "Dave", "email": tt.email, "password": "tr0ub4dor&3", "website": tt.website}
+
+            rr := do(t, h, http.MethodPost, "/v1/users", "", body)
+            app.wg.Wait()
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+
+            if rr.Code == http.StatusUnprocessableEntity {
+                var resp struct {
+                    Error map[string][]string `json:"error"`
+                }
+                decode(t, rr, &resp)
+
+                if want := []string{"email domain is not allowed"}; !slices.Equal(resp.Error["email"], want) {
+                    t.Errorf("got email errors %q; want %q", resp.Error["email"], want)
+                }
+            }
+
+            _, err := app.models.User.GetByEmail(context.Background(), tt.email)
+            if got := err == nil; got != tt.wantUser {
+                t.Errorf("got user created %t (error %v); want %t", got, err, tt.wantUser)
+            }
+
+            sender := app.emailSender.(*stubSender)
+            if got := len(sender.sent) == 1; got != tt.wantUser {
+                t.Errorf("got %d emails sent; want an email %t", len(sender.sent), tt.wantUser)
+            }
+        })
+    }
+}
+func TestRegisterBreachedPassword(t *testing.T) {
+    // The fake API lists the hash of the password as breached in every range, or fails when breached
+    // is unset.
+    breached := true
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !breached {
+            w.WriteHeader(http.StatusServiceUnavailable)
+            return
+        }
+        sum := sha1.Sum([]byte("tr0ub4dor&3"))
+        fmt.Fprintf(w, "%s:3\r\n", strings.ToUpper(hex.EncodeToString(sum[:]))[5:])
+    }))
+    defer srv.Close()
+
+    app := newTestApplication(t)
+    app.breachClient = breach.NewClient(srv.URL, time.Second)
+    h := app.routes()
+
+    body := map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3"}
+
+    rr := do(t, h, http.MethodPost, "/v1/users", "", body)
+    if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "appears in known breach lists") {
+        t.Errorf("breached: got status %d; want %d; body: %s", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+    }
+
+    // The password is accepted when the API can't be reached.
+    breached = false
+    rr = do(t, h, http.MethodPost, "/v1/users", "", body)
+    app.wg.Wait()
+    if rr.Code != http.StatusCreated {
+        t.Errorf("API unavailable: got status %d; want %d; body: %s", rr.Code, http.StatusCreated, rr.Body)
+    }
+}
+
+func TestActivateUserHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodPost, "/v1/users", "", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3"})
+    app.wg.Wait()
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("register: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    sender := app.emailSender.(*stubSender)
+    token := sender.sent[0].data.(map[string]any)["activationToken"].(string)
+
+    rr = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": "ABCDEFGHIJKLMNOPQRSTUVWXYZ"})
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("bad token: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    rr = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token})
+    if rr.Code != http.StatusOK {
+        t.Fatalf("activate: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        User struct {
+            Activated bool `json:"activated"`
+        } `json:"user"`
+    }
+    decode(t, rr, &resp)
+    if !resp.User.Activated {
+        t.Errorf("user is not activated")
+    }
+
+    // The activation token must not be usable twice.
+    rr = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token})
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Fatalf("reuse: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+}
+
+func TestActivateUserConcurrently(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    token, err := app.models.Token.New(context.Background(), mock.InactiveUserID, time.Hour, data.ScopeActivation)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Both requests are released at once, so that they race for the token.
+    const n = 2
+    var (
+        start sync.WaitGroup
+        done  sync.WaitGroup
+        codes [n]int
+    )
+    start.Add(1)
+
+    for i := range n {
+        done.Add(1)
+        go func() {
+            defer done.Done()
+            start.Wait()
+            codes[i] = do(t, h, http.MethodPut, "/v1/users/activated", "", map[string]any{"token": token.Plaintext}).Code
+        }()
+    }
+
+    start.Done()
+    done.Wait()
+
+    slices.Sort(codes[:])
+    if want := [n]int{http.StatusOK, http.StatusUnprocessableEntity}; codes != want {
+        t.Errorf("got statuses %v; want %v", codes, want)
+    }
+
+    user, err := app.models.User.Get(context.Background(), mock.InactiveUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !user.Activated || user.Version != 2 {
+        t.Errorf("got activated %t, version %d; want true, 2", user.Activated, user.Version)
+    }
+}
+
+func TestEmailCaseInsensitive(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodPost, "/v1/users", "", map[string]any{"name": "Dave", "email": "Dave@Example.com", "password": "tr0ub4dor&3"})
+    app.wg.Wait()
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("register: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        User struct {
+            Email string `json:"email"`
+        } `json:"user"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.User.Email != "dave@example.com" {
+        t.Errorf("got email %q; want it lower-cased", resp.User.Email)
+    }
+
+    for _, email := range []string{"dave@example.com", "DAVE@EXAMPLE.COM"} {
+        rr = do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{"email": email, "password": "tr0ub4dor&3"})
+        if rr.Code != http.StatusCreated {
+            t.Errorf("login as %s: got status %d; want %d", email, rr.Code, http.StatusCreated)
+        }
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/users", "", map[string]any{"name": "Dave", "email": "dave@EXAMPLE.com", "password": "tr0ub4dor&3"})
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("register again: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+}
+
+func TestCreateAuthenticationTokenHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    tests := []struct {
+        name       string
+        body       any
+        wantStatus int
+    }{
+        {"valid", map[string]any{"email": mock.ActivatedUserEmail, "password": mock.FixturePassword}, http.StatusCreated},
+        {"email in other case", map[string]any{"email": " " + strings.ToUpper(mock.ActivatedUserEmail) + " ", "password": mock.FixturePassword}, http.StatusCreated},
+        {"wrong password", map[string]any{"email": mock.ActivatedUserEmail, "password": "wrongpassword"}, http.StatusUnauthorized},
+        {"unknown email", map[string]any{"email": "nobody@example.com", "password": mock.FixturePassword}, http.StatusUnauthorized},
+        {"invalid email", map[string]any{"email": "nobody", "password": mock.FixturePassword}, http.StatusUnprocessableEntity},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", tt.body)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+        })
+    }
+}
+
+func TestCreateAuthenticationTokenTiming(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    // Time the logins at the lowest bcrypt cost, which the dummy hash follows, with a user whose
+    // password is hashed at that cost too.
+    t.Cleanup(func() { data.SetPasswordCost(data.DefaultPasswordCost) })
+    if err := data.SetPasswordCost(bcrypt.MinCost); err != nil {
+        t.Fatal(err)
+    }
+
+    user := &data.User{Name: "Dave", Email: "dave@example.com", Activated: true}
+    if err := user.Password.Set(mock.FixturePassword); err != nil {
+        t.Fatal(err)
+    }
+    if err := app.models.User.Insert(context.Background(), user); err != nil {
+        t.Fatal(err)
+    }
+
+    // elapsed returns the median of a number of logins, which is little affected by noise.
+    elapsed := func(email string) time.Duration {
+        times := make([]time.Duration, 21)
+
+        for i := range times {
+            start := time.Now()
+            rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+                "email": email, "password": "wrongpassword",
+            })
+            times[i] = time.Since(start)
+
+            if rr.Code != http.StatusUnauthorized {
+                t.Fatalf("got status %d; want %d", rr.Code, http.StatusUnauthorized)
+            }
+        }
+
+        slices.Sort(times)
+        return times[len(times)/2]
+    }
+
+    known := elapsed(user.Email)
+    unknown := elapsed("nobody@example.com")
+
+    // Both paths are dominated by one bcrypt comparison, so they take about as long.
+    if unknown < known/2 || unknown > known*2 {
+        t.Errorf("got %v for an unknown email and %v for a wrong password; want about the same", unknown, known)
+    }
+}
+
+func TestLastLogin(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    before, err := app.models.User.GetByEmail(context.Background(), mock.ActivatedUserEmail)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    rr := do(t, h, http.MethodPost, "/v1/tokens/authentication", "", map[string]any{
+        "email": mock.ActivatedUserEmail, "password": mock.FixturePassword,
+    })
+    app.wg.Wait()
+    if rr.Code != http.StatusCreated {
+        t.Fatalf("login: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    after, err := app.models.User.GetByEmail(context.Background(), mock.ActivatedUserEmail)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if after.Version != before.Version {
+        t.Errorf("got version %d after login; want %d", after.Version, before.Version)
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/users/me", authToken(t, app, mock.ActivatedUserID), nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("me: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    var resp struct {
+        User struct {
+            Email       string     `json:"email"`
+            LastLoginAt *time.Time `json:"last_login_at"`
+            LastLoginIP string     `json:"last_login_ip"`
+        } `json:"user"`
+    }
+    decode(t, rr, &resp)
+
+    if resp.User.Email != mock.ActivatedUserEmail {
+        t.Errorf("got email %q; want %q", resp.User.Email, mock.ActivatedUserEmail)
+    }
+    if resp.User.LastLoginAt == nil || time.Since(*resp.User.LastLoginAt) > time.Minute {
+        t.Errorf("got last_login_at %v; want a recent time", resp.User.LastLoginAt)
+    }
+    // httptest.NewRequest uses 192.0.2.1 as the remote address.
+    if resp.User.LastLoginIP != "192.0.2.1" {
+        t.Errorf("got last_login_ip %q; want %q", resp.User.LastLoginIP, "192.0.2.1")
+    }
+
+    rr = do(t, h, http.MethodGet, "/v1/users/me", "", nil)
+    if rr.Code != http.StatusUnauthorized {
+        t.Errorf("anonymous me: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+}
+
+func TestInactiveUserIsForbidden(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    rr := do(t, h, http.MethodGet, "/v1/movies", authToken(t, app, mock.InactiveUserID), nil)
+    if rr.Code != http.StatusForbidden {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+}
+
+func TestListUsersHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+
+    tests := []struct {
+        name       string
+        target     string
+        token      string
+        wantStatus int
+        wantIDs    []int64
+    }{
+        {"all", "/v1/users", admin, http.StatusOK, []int64{1, 2, 3, 4}},
+        {"email substring", "/v1/users?email=EXAMPLE.COM&sort=-email", admin, http.StatusOK, []int64{3, 2, 1, 4}},
+        {"inactive", "/v1/users?activated=false", admin, http.StatusOK, []int64{2}},
+        {"created range", "/v1/users?created_after=2024-02-01&created_before=2024-04-01T00:00:00Z", admin, http.StatusOK, []int64{2, 3}},
+        {"sort by created_at desc", "/v1/users?sort=-created_at&page_size=2", admin, http.StatusOK, []int64{4, 3}},
+        {"invalid activated", "/v1/users?activated=maybe", admin, http.StatusUnprocessableEntity, nil},
+        {"invalid date", "/v1/users?created_after=yesterday", admin, http.StatusUnprocessableEntity, nil},
+        {"invalid sort", "/v1/users?sort=password_hash", admin, http.StatusUnprocessableEntity, nil},
+        {"not an admin", "/v1/users", authToken(t, app, mock.ActivatedUserID), http.StatusForbidden, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, http.MethodGet, tt.target, tt.token, nil)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+            if tt.wantIDs == nil {
+                return
+            }
+
+            if strings.Contains(rr.Body.String(), "password") {
+                t.Fatalf("response contains password data: %s", rr.Body)
+            }
+
+            var resp struct {
+                Users []struct {
+                    ID int64 `json:"id"`
+                } `json:"users"`
+            }
+            decode(t, rr, &resp)
+
+            var ids []int64
+            for _, u := range resp.Users {
+                ids = append(ids, u.ID)
+            }
+            if !slices.Equal(ids, tt.wantIDs) {
+                t.Fatalf("got ids %v; want %v", ids, tt.wantIDs)
+            }
+        })
+    }
+}
+
+func TestShowUserHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    err := app.models.Permission.AddForUser(context.Background(), mock.ReadOnlyUserID, "users:read")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    alice := authToken(t, app, mock.ActivatedUserID)
+    carol := authToken(t, app, mock.ReadOnlyUserID)
+    admin := authToken(t, app, mock.AdminUserID)
+
+    tests := []struct {
+        name       string
+        target     string
+        token      string
+        wantStatus int
+    }{
+        {"self", "/v1/users/1", alice, http.StatusOK},
+        {"other user", "/v1/users/3", alice, http.StatusForbidden},
+        {"other user with users:read", "/v1/users/1", carol, http.StatusOK},
+        {"admin override", "/v1/users/1", admin, http.StatusOK},
+        {"unknown user", "/v1/users/99", admin, http.StatusNotFound},
+        {"unknown user without permission", "/v1/users/99", alice, http.StatusForbidden},
+        {"inactive self", "/v1/users/2", authToken(t, app, mock.InactiveUserID), http.StatusForbidden},
+        {"anonymous", "/v1/users/1", "", http.StatusUnauthorized},
+        {"list without users:read", "/v1/users", alice, http.StatusForbidden},
+        {"list with users:read", "/v1/users", carol, http.StatusOK},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            rr := do(t, h, http.MethodGet, tt.target, tt.token, nil)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+            if strings.Contains(rr.Body.String(), "password") {
+                t.Fatalf("response contains password data: %s", rr.Body)
+            }
+        })
+    }
+}
+
+func TestUpdateCurrentUserHandler(t *testing.T) {
+    tests := []struct {
+        name       string
+        headers    map[string]string
+        body       string
+        wantStatus int
+        wantETag   string
+    }{
+        {"unconditional", nil, `{"name": "Alicia"}`, http.StatusOK, `W/"2"`},
+        {"If-Match", map[string]string{"If-Match": `W/"1"`}, `{"name": "Alicia"}`, http.StatusOK, `W/"2"`},
+        {"If-Match strong", map[string]string{"If-Match": `"1"`}, `{"name": "Alicia"}`, http.StatusOK, `W/"2"`},
+        {"If-Match list", map[string]string{"If-Match": `W/"7", W/"1"`}, `{"name": "Alicia"}`, http.StatusOK, `W/"2"`},
+        {"If-Match stale", map[string]string{"If-Match": `W/"0"`}, `{"name": "Alicia"}`, http.StatusPreconditionFailed, `W/"1"`},
+        {"X-Expected-Version", map[string]string{"X-Expected-Version": "1"}, `{"name": "Alicia"}`, http.StatusOK, `W/"2"`},
+        {"X-Expected-Version stale", map[string]string{"X-Expected-Version": "3"}, `{"name": "Alicia"}`, http.StatusPreconditionFailed, `W/"1"`},
+        {"X-Expected-Version invalid", map[string]string{"X-Expected-Version": "one"}, `{"name": "Alicia"}`, http.StatusBadRequest, `W/"1"`},
+        {"duplicate email", nil, `{"email": "CAROL@example.com"}`, http.StatusUnprocessableEntity, `W/"1"`},
+        {"invalid email", nil, `{"email": "alice"}`, http.StatusUnprocessableEntity, `W/"1"`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            h := app.routes()
+
+            req := httptest.NewRequest(http.MethodPatch, "/v1/users/me", strings.NewReader(tt.body))
+            req.Header.Set("Authorization", "Bearer "+authToken(t, app, mock.ActivatedUserID))
+            for k, v := range tt.headers {
+                req.Header.Set(k, v)
+            }
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, req)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+            if got := rr.Header().Get("ETag"); got != tt.wantETag {
+                t.Errorf("got ETag %s; want %s", got, tt.wantETag)
+            }
+
+            user, err := app.models.User.Get(context.Background(), mock.ActivatedUserID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if updated := tt.wantStatus == http.StatusOK; updated != (user.Name == "Alicia") {
+                t.Errorf("got name %q after status %d", user.Name, rr.Code)
+            }
+        })
+    }
+}
+
+func TestShowCurrentUserETag(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+
+    req := httptest.NewRequest(http.MethodGet, "/v1/users/me", nil)
+    req.Header.Set("Authorization", "Bearer "+authToken(t, app, mock.ActivatedUserID))
+    req.Header.Set("If-None-Match", `W/"1"`)
+
+    rr := httptest.NewRecorder()
+    h.ServeHTTP(rr, req)
+
+    if rr.Code != http.StatusNotModified {
+        t.Fatalf("got status %d; want %d", rr.Code, http.StatusNotModified)
+    }
+    if got := rr.Header().Get("ETag"); got != `W/"1"` {
+        t.Errorf("got ETag %s; want %s", got, `W/"1"`)
+    }
+}
+
+func TestUpdateCurrentUserPasswordHandler(t *testing.T) {
+    tests := []struct {
+        name       string
+        ifMatch    string
+        body       map[string]any
+        wantStatus int
+    }{
+        {"changed", "", map[string]any{"current_password": mock.FixturePassword, "password": "n3wpassword"}, http.StatusOK},
+        {"If-Match", `W/"1"`, map[string]any{"current_password": mock.FixturePassword, "password": "n3wpassword"}, http.StatusOK},
+        {"If-Match stale", `W/"2"`, map[string]any{"current_password": mock.FixturePassword, "password": "n3wpassword"}, http.StatusPreconditionFailed},
+        {"wrong current password", "", map[string]any{"current_password": "wr0ngpassword", "password": "n3wpassword"}, http.StatusUnauthorized},
+        {"missing current password", "", map[string]any{"password": "n3wpassword"}, http.StatusUnprocessableEntity},
+        {"new password too short", "", map[string]any{"current_password": mock.FixturePassword, "password": "short"}, http.StatusUnprocessableEntity},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            h := app.routes()
+            current := authToken(t, app, mock.ActivatedUserID)
+            other := authToken(t, app, mock.ActivatedUserID)
+
+            js, err := json.Marshal(tt.body)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            req := httptest.NewRequest(http.MethodPut, "/v1/users/me/password", bytes.NewReader(js))
+            req.Header.Set("Authorization", "Bearer "+current)
+            if tt.ifMatch != "" {
+                req.Header.Set("If-Match", tt.ifMatch)
+            }
+
+            rr := httptest.NewRecorder()
+            h.ServeHTTP(rr, req)
+
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+
+            changed := tt.wantStatus == http.StatusOK
+
+            user, err := app.models.User.Get(context.Background(), mock.ActivatedUserID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if match, _ := user.Password.Matches("n3wpassword"); match != changed {
+                t.Errorf("new password matches: got %v; want %v", match, changed)
+            }
+
+            // Changing the password revokes the other tokens but not the current one.
+            if rr := do(t, h, http.MethodGet, "/v1/users/me", other, nil); (rr.Code == http.StatusUnauthorized) != changed {
+                t.Errorf("other token: got status %d", rr.Code)
+            }
+            if rr := do(t, h, http.MethodGet, "/v1/users/me", current, nil); rr.Code != http.StatusOK {
+                t.Errorf("current token: got status %d; want %d", rr.Code, http.StatusOK)
+            }
+        })
+    }
+}
+
+func TestForcePasswordReset(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+    session := authToken(t, app, mock.ActivatedUserID)
+
+    rr := do(t, h, http.MethodPost, "/v1/users/1/force-reset", session, nil)
+    if rr.Code != http.StatusForbidden {
+        t.Errorf("non-admin: got status %d; want %d", rr.Code, http.StatusForbidden)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/users/999/force-reset", admin, nil)
+    if rr.Code != http.StatusNotFound {
+        t.Errorf("unknown user: got status %d; want %d", rr.Code, http.StatusNotFound)
+    }
+
+    rr = do(t, h, http.MethodPost, "/v1/users/1/force-reset", admin, nil)
+    app.wg.Wait()
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    // The session is invalid at once, and logging in is refused until the password is reset.
+    if rr := do(t, h, http.MethodGet, "/v1/users/me", session, nil); rr.Code != http.StatusUnauthorized {
+        t.Errorf("existing token: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+
+    login := map[string]any{"email": mock.ActivatedUserEmail, "password": mock.FixturePassword}
+    rr = do(t, h, http.MethodPost, "/v2/tokens/authentication", "", login)
+    if rr.Code != http.StatusForbidden || !strings.Contains(rr.Body.String(), `"password_reset_required"`) {
+        t.Errorf("login: got status %d; want %d; body: %s", rr.Code, http.StatusForbidden, rr.Body)
+    }
+
+    sender := app.emailSender.(*stubSender)
+    if len(sender.sent) != 1 || sender.sent[0].templateFile != "password_reset.html" {
+        t.Fatalf("got emails %v; want a password_reset.html email", sender.sent)
+    }
+    reset := map[string]any{
+        "token":    sender.sent[0].data.(map[string]any)["passwordResetToken"],
+        "password": "n3wpa55word",
+    }
+
+    rr = do(t, h, http.MethodPut, "/v1/users/password", "", reset)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("reset: got status %d; body: %s", rr.Code, rr.Body)
+    }
+
+    rr = do(t, h, http.MethodPut, "/v1/users/password", "", reset)
+    if rr.Code != http.StatusUnprocessableEntity {
+        t.Errorf("reset with a used token: got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+    }
+
+    login["password"] = "n3wpa55word"
+    rr = do(t, h, http.MethodPost, "/v1/tokens/authentication", "", login)
+    if rr.Code != http.StatusCreated {
+        t.Errorf("login with the new password: got status %d; want %d; body: %s", rr.Code, http.StatusCreated, rr.Body)
+    }
+}
+
+func TestDeleteUserHandler(t *testing.T) {
+    tests := []struct {
+        name       string
+        mode       string
+        asUserID   int64
+        target     string
+        body       any
+        wantStatus int
+    }{
+        {"admin hard delete", "delete", mock.AdminUserID, "/v1/users/1", nil, http.StatusOK},
+        {"admin anonymize", "anonymize", mock.AdminUserID, "/v1/users/1", nil, http.StatusOK},
+        {"admin unknown user", "delete", mock.AdminUserID, "/v1/users/99", nil, http.StatusNotFound},
+        {"not admin", "delete", mock.ReadOnlyUserID, "/v1/users/1", nil, http.StatusForbidden},
+        {"self hard delete", "delete", mock.ActivatedUserID, "/v1/users/me", map[string]any{"password": mock.FixturePassword}, http.StatusOK},
+        {"self anonymize", "anonymize", mock.ActivatedUserID, "/v1/users/me", map[string]any{"password": mock.FixturePassword}, http.StatusOK},
+        {"self wrong password", "delete", mock.ActivatedUserID, "/v1/users/me", map[string]any{"password": "wr0ngpassword"}, http.StatusUnauthorized},
+        {"self missing password", "delete", mock.ActivatedUserID, "/v1/users/me", map[string]any{}, http.StatusUnprocessableEntity},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.userDeletionMode = tt.mode
+            h := app.routes()
+
+            // Token of the user being deleted, to check that it stops working.
+            victimToken := authToken(t, app, mock.ActivatedUserID)
+            token := victimToken
+            if tt.asUserID != mock.ActivatedUserID {
+                token = authToken(t, app, tt.asUserID)
+            }
+
+            rr := do(t, h, http.MethodDelete, tt.target, token, tt.body)
+            if rr.Code != tt.wantStatus {
+                t.Fatalf("got status %d; want %d; body: %s", rr.Code, tt.wantStatus, rr.Body)
+            }
+
+            _, err := app.models.User.GetByEmail(context.Background(), mock.ActivatedUserEmail)
+            deleted := errors.Is(err, data.ErrRecordNotFound)
+            if wantDeleted := tt.wantStatus == http.StatusOK && !strings.HasSuffix(tt.target, "/99"); deleted != wantDeleted {
+                t.Fatalf("got deleted %t; want %t", deleted, wantDeleted)
+            }
+            if !deleted {
+                return
+            }
+
+            rr = do(t, h, http.MethodGet, "/v1/movies", victimToken, nil)
+            if rr.Code != http.StatusUnauthorized {
+                t.Errorf("token of deleted user: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+            }
+
+            permissions, err := app.models.Permission.GetAllForUser(context.Background(), mock.ActivatedUserID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            if len(permissions) != 0 {
+                t.Errorf("got permissions %v for deleted user; want none", permissions)
+            }
+
+            users, _, err := app.models.User.GetAll(context.Background(), data.UserListParams{Email: "@anonymized.invalid"}, data.Filter{
+                Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"},
+            })
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            switch tt.mode {
+            case "anonymize":
+                if len(users) != 1 || users[0].ID != mock.ActivatedUserID || users[0].Name != "" || users[0].Activated {
+                    t.Errorf("got users %+v; want one anonymized, deactivated user", users)
+                }
+            default:
+                if len(users) != 0 {
+                    t.Errorf("got %d anonymized users; want 0 after hard delete", len(users))
+                }
+            }
+        })
+    }
+}
+
+func TestDeleteUserDeletesQueuedEmails(t *testing.T) {
+    for _, mode := range []string{"delete", "anonymize"} {
+        t.Run(mode, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.userDeletionMode = mode
+            ctx := context.Background()
+
+            user, err := app.models.User.Get(ctx, mock.InactiveUserID)
+            if err != nil {
+                t.Fatal(err)
+            }
+            _, err = app.models.User.Remind(ctx, user, time.Hour, app.activationReminderEmail(user, time.Hour))
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            outbox := app.models.Outbox.(*mock.OutboxModel)
+            if pending := outbox.Pending(); len(pending) != 1 {
+                t.Fatalf("got pending emails %+v; want the reminder", pending)
+            }
+
+            rr := do(t, app.routes(), http.MethodDelete, "/v1/users/2", authToken(t, app, mock.AdminUserID), nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            // Neither the address nor the token in the reminder outlive the account.
+            if pending := outbox.Pending(); len(pending) != 0 {
+                t.Errorf("got pending emails %+v after deleting the user; want none", pending)
+            }
+            if n := app.dispatchOutbox(); n != 0 {
+                t.Errorf("dispatched %d emails; want 0", n)
+            }
+        })
+    }
+}
+
+func TestListUsersSortOrder(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    admin := authToken(t, app, mock.AdminUserID)
+
+    // Another Alice ties with the fixture on the name.
+    err := app.models.User.Insert(context.Background(), &data.User{Name: "Alice", Email: "alice2@example.com"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    users := make(map[int64]*data.User)
+    for id := range int64(5) {
+        user, err := app.models.User.Get(context.Background(), id+1)
+        if err != nil {
+            t.Fatal(err)
+        }
+        users[user.ID] = user
+    }
+
+    for _, sort := range userSortSafeList {
+        t.Run(sort, func(t *testing.T) {
+            rr := do(t, h, http.MethodGet, "/v1/users?sort="+sort, admin, nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            var resp struct {
+                Users []struct {
+                    ID int64 `json:"id"`
+                } `json:"users"`
+            }
+            decode(t, rr, &resp)
+
+            var ids []int64
+            for _, u := range resp.Users {
+                ids = append(ids, u.ID)
+            }
+            if len(ids) != len(users) {
+                t.Fatalf("got ids %v; want all %d users", ids, len(users))
+            }
+
+            assertSortOrder(t, sort, ids, func(a, b int64) int {
+                x, y := users[a], users[b]
+
+                switch strings.TrimPrefix(sort, "-") {
+                case "id":
+                    return cmp.Compare(x.ID, y.ID)
+                case "name":
+                    return cmp.Compare(x.Name, y.Name)
+                case "email":
+                    return cmp.Compare(x.Email, y.Email)
+                case "created_at":
+                    return x.CreatedAt.Compare(y.CreatedAt)
+                }
+
+                t.Fatalf("no comparison for sort=%s", sort)
+                return 0
+            })
+        })
+    }
+}
+
+func TestEmailLinks(t *testing.T) {
+    tests := []struct {
+        name        string
+        delivery    string
+        frontendURL string
+        wantBase    string // of the links, which are empty without a frontend URL
+    }{
+        {"direct", "direct", "https://app.example.com/greenlight", "https://app.example.com/greenlight"},
+        {"outbox", "outbox", "https://app.example.com/greenlight/", "https://app.example.com/greenlight"},
+        {"without a frontend", "direct", "", ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            app := newTestApplication(t)
+            app.config.email.delivery = tt.delivery
+            if tt.frontendURL != "" {
+                u, err := url.Parse(tt.frontendURL)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                app.config.frontendURL.Store(u)
+            }
+            h := app.routes()
+
+            rr := do(t, h, http.MethodPost, "/v1/users", "", map[string]any{"name": "Dave", "email": "dave@example.com", "password": "tr0ub4dor&3"})
+            if rr.Code != http.StatusCreated {
+                t.Fatalf("register: got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            rr = do(t, h, http.MethodPost, "/v1/users/1/force-reset", authToken(t, app, mock.AdminUserID), nil)
+            if rr.Code != http.StatusOK {
+                t.Fatalf("force reset: got status %d; body: %s", rr.Code, rr.Body)
+            }
+
+            app.wg.Wait()
+            app.dispatchOutbox()
+
+            sender := app.emailSender.(*stubSender)
+            if len(sender.sent) != 2 {
+                t.Fatalf("got %d emails; want 2", len(sender.sent))
+            }
+
+            // The emails are sent by background tasks, in any order.
+            emails := make(map[string]map[string]any)
+            for _, sent := range sender.sent {
+                emails[sent.templateFile] = sent.data.(map[string]any)
+            }
+
+            for _, want := range []struct{ template, tokenKey, urlKey, path string }{
+                {"user_welcome.html", "activationToken", "activationURL", "/activate"},
+                {"password_reset.html", "passwordResetToken", "passwordResetURL", "/reset-password"},
+            } {
+                data := emails[want.template]
+                if data == nil {
+                    t.Fatalf("got no %s email", want.template)
+                }
+
+                wantURL := ""
+                if tt.wantBase != "" {
+                    wantURL = tt.wantBase + want.path + "?token=" + data[want.tokenKey].(string)
+                }
+                if data[want.urlKey] != wantURL {
+                    t.Errorf("got %s %q; want %q", want.urlKey, data[want.urlKey], wantURL)
+                }
+            }
+        })
+    }
+}
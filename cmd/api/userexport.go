@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// userExport is what greenlight knows about a user, apart from their audit events, which are
+// streamed after it by writeUserExport.
+type userExport struct {
+    GeneratedAt time.Time        `json:"generated_at"`
+    User        *data.User       `json:"user"`
+    Permissions data.Permissions `json:"permissions"`
+    Sessions    []*data.Token    `json:"sessions"` // authentication tokens, without the tokens themselves
+    APIKeys     []*data.Token    `json:"api_keys"`
+}
+
+// collectUserExport gathers the records of user from the models. The queries run with ctx, so a
+// client which goes away aborts the export.
+func (app *application) collectUserExport(ctx context.Context, user *data.User, currentHash []byte) (*userExport, error) {
+    permissions, err := app.models.Permission.GetAllForUser(ctx, user.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    sessions, err := app.models.Token.GetAllForUser(ctx, user.ID, data.ScopeAuthentication)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, token := range sessions {
+        token.Current = bytes.Equal(token.Hash, currentHash)
+    }
+
+    apiKeys, err := app.models.Token.GetAllForUser(ctx, user.ID, data.ScopeAPIKey)
+    if err != nil {
+        return nil, err
+    }
+
+    return &userExport{
+        GeneratedAt: time.Now().UTC(),
+        User:        user,
+        Permissions: permissions,
+        Sessions:    sessions,
+        APIKeys:     apiKeys,
+    }, nil
+}
+
+// writeUserExport writes export as one JSON object, with the audit events of the user streamed
+// into its audit_events array as they are scanned from the database.
+func (app *application) writeUserExport(ctx context.Context, w io.Writer, flush func(), export *userExport) error {
+    js, err := json.Marshal(export)
+    if err != nil {
+        return err
+    }
+
+    // The audit events are added to the object by replacing its closing brace.
+    _, err = io.WriteString(w, string(js[:len(js)-1])+`,"audit_events":[`)
+    if err != nil {
+        return err
+    }
+
+    count := 0
+    enc := json.NewEncoder(w)
+
+    err = app.models.Audit.ForEachForUser(ctx, export.User.ID, func(event *data.AuditEvent) error {
+        if count > 0 {
+            _, err := io.WriteString(w, ",")
+            if err != nil {
+                return err
+            }
+        }
+
+        err := enc.Encode(event)
+        if err != nil {
+            return err
+        }
+
+        count++
+        if count%streamFlushInterval == 0 {
+            flush()
+        }
+
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+
+    _, err = io.WriteString(w, "]}\n")
+    return err
+}
+
+// exportCurrentUserHandler sends everything greenlight knows about the authenticated user as a
+// JSON file: their record, permissions, sessions, API keys and audit events. The headers are
+// only sent once the records other than the audit events have been read, so that a failing
+// query still gets an error response; after that a failure truncates the document.
+func (app *application) exportCurrentUserHandler(w http.ResponseWriter, r *http.Request) {
+    user := app.contextGetUser(r)
+
+    export, err := app.collectUserExport(r.Context(), user, app.contextGetTokenHash(r))
+    if err != nil {
+        app.serverErrorResponse(w, r, err)
+        return
+    }
+
+    rc := http.NewResponseController(w)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Disposition", `attachment; filename="greenlight-export.json"`)
+    w.WriteHeader(http.StatusOK)
+
+    // Flushing is best-effort, as in streamMovies.
+    flush := func() { rc.Flush() }
+
+    err = app.writeUserExport(r.Context(), w, flush, export)
+    if err != nil {
+        // Nobody is listening if the client went away or the long request timeout passed.
+        if r.Context().Err() == nil {
+            app.logError(r, err)
+        }
+        return
+    }
+
+    rc.Flush()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestExportCurrentUserHandler(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    ctx := context.Background()
+
+    token := authToken(t, app, mock.ActivatedUserID)
+    authToken(t, app, mock.ActivatedUserID)
+
+    for _, e := range []*data.AuditEvent{
+        {Event: data.AuditLoginSucceeded, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail},
+        {Event: data.AuditLoginFailed, UserID: mock.ReadOnlyUserID, Email: mock.ReadOnlyUserEmail},
+        {Event: data.AuditPasswordChanged, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail},
+    } {
+        err := app.models.Audit.Insert(ctx, e)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/users/me/export", token, nil)
+    if rr.Code != http.StatusOK {
+        t.Fatalf("got status %d; want %d; body: %s", rr.Code, http.StatusOK, rr.Body)
+    }
+    if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="greenlight-export.json"` {
+        t.Errorf("got Content-Disposition %q", got)
+    }
+
+    var export struct {
+        User struct {
+            ID    int64  `json:"id"`
+            Email string `json:"email"`
+        } `json:"user"`
+        Permissions []string `json:"permissions"`
+        Sessions    []struct {
+            Token   string `json:"token"`
+            Current bool   `json:"current"`
+        } `json:"sessions"`
+        APIKeys     []json.RawMessage `json:"api_keys"`
+        AuditEvents []struct {
+            Event  string `json:"event"`
+            UserID int64  `json:"user_id"`
+        } `json:"audit_events"`
+    }
+    decode(t, rr, &export)
+
+    if export.User.ID != mock.ActivatedUserID || export.User.Email != mock.ActivatedUserEmail {
+        t.Errorf("got user %+v; want the authenticated user", export.User)
+    }
+    if want := []string{"movie:read", "movie:write"}; !reflect.DeepEqual(export.Permissions, want) {
+        t.Errorf("got permissions %v; want %v", export.Permissions, want)
+    }
+
+    current := 0
+    for _, s := range export.Sessions {
+        if s.Token != "" {
+            t.Errorf("got session with its token %q; want it left out", s.Token)
+        }
+        if s.Current {
+            current++
+        }
+    }
+    if len(export.Sessions) != 2 || current != 1 {
+        t.Errorf("got sessions %+v; want 2 with 1 current", export.Sessions)
+    }
+
+    if export.APIKeys == nil {
+        t.Errorf("got no api_keys; want an empty array")
+    }
+
+    var events []string
+    for _, e := range export.AuditEvents {
+        if e.UserID != mock.ActivatedUserID {
+            t.Errorf("got audit event of user %d", e.UserID)
+        }
+        events = append(events, e.Event)
+    }
+    if want := []string{data.AuditLoginSucceeded, data.AuditPasswordChanged}; !reflect.DeepEqual(events, want) {
+        t.Errorf("got audit events %v; want %v", events, want)
+    }
+}
+
+func TestExportCurrentUserRateLimit(t *testing.T) {
+    app := newTestApplication(t)
+    app.config.userExportLimit = 1
+    h := app.routes()
+
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    if rr := do(t, h, http.MethodGet, "/v1/users/me/export", token, nil); rr.Code != http.StatusOK {
+        t.Fatalf("first export: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    rr := do(t, h, http.MethodGet, "/v1/users/me/export", token, nil)
+    if rr.Code != http.StatusTooManyRequests {
+        t.Fatalf("second export: got status %d; want %d", rr.Code, http.StatusTooManyRequests)
+    }
+    if rr.Header().Get("Retry-After") == "" {
+        t.Error("second export: got no Retry-After")
+    }
+
+    // The limit is per user.
+    other := authToken(t, app, mock.ReadOnlyUserID)
+    if rr := do(t, h, http.MethodGet, "/v1/users/me/export", other, nil); rr.Code != http.StatusOK {
+        t.Errorf("other user: got status %d; want %d", rr.Code, http.StatusOK)
+    }
+
+    if rr := do(t, h, http.MethodGet, "/v1/users/me/export", "", nil); rr.Code != http.StatusUnauthorized {
+        t.Errorf("anonymous: got status %d; want %d", rr.Code, http.StatusUnauthorized)
+    }
+}
+
+func TestWriteUserExportCancelled(t *testing.T) {
+    app := newTestApplication(t)
+
+    user, err := app.models.User.Get(context.Background(), mock.ActivatedUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = app.models.Audit.Insert(context.Background(), &data.AuditEvent{Event: data.AuditLoginSucceeded, UserID: user.ID})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // A client which went away stops the export before the audit events are read.
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    var buf bytes.Buffer
+    err = app.writeUserExport(ctx, &buf, func() {}, &userExport{User: user})
+    if !errors.Is(err, context.Canceled) {
+        t.Errorf("got error %v; want context.Canceled", err)
+    }
+    if json.Valid(buf.Bytes()) {
+        t.Errorf("got a complete document %s; want it truncated", buf.Bytes())
+    }
+}
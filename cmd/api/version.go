@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiVersion is a version of the API, served under /v<number>. All the versions share the same
+// handlers, which produce the responses of the latest version; the hooks of an older version
+// adapt them to the shape it had.
+type apiVersion struct {
+    number int
+
+    // shape, if not nil, adapts the data of the responses sent with writeResponse().
+    shape func(data envelope) envelope
+
+    // shapeError, if not nil, adapts the error of the error responses.
+    shapeError func(e responseError) any
+}
+
+// responseError is an error sent in an error response. legacy returns it as it was sent before
+// error codes.
+type responseError interface {
+    legacy() any
+}
+
+// apiVersions are the supported versions, oldest first. Version 1 sends errors as a message or
+// the validation errors, version 2 as an apiError with a code.
+var apiVersions = []*apiVersion{
+    {number: 1, shapeError: responseError.legacy},
+    {number: 2},
+}
+
+// latestAPIVersion is the version of the requests outside the versioned routes, such as
+// /debug/vars.
+var latestAPIVersion = apiVersions[len(apiVersions)-1]
+
+// prefix returns the path prefix of the version, e.g. "/v1".
+func (v *apiVersion) prefix() string {
+    return "/v" + strconv.Itoa(v.number)
+}
+
+// splitAPIVersion splits a path such as /v1/movies into the version number and the rest of the
+// path, "/movies". ok is false if the path doesn't start with a version.
+func splitAPIVersion(path string) (number int, rest string, ok bool) {
+    segment, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+
+    digits, found := strings.CutPrefix(segment, "v")
+    if !found || digits == "" || strings.TrimLeft(digits, "0123456789") != "" {
+        return 0, "", false
+    }
+
+    number, err := strconv.Atoi(digits)
+    if err != nil {
+        return 0, "", false
+    }
+
+    return number, "/" + rest, true
+}
+
+// findAPIVersion returns the supported version with the given number, or nil.
+func findAPIVersion(number int) *apiVersion {
+    for _, v := range apiVersions {
+        if v.number == number {
+            return v
+        }
+    }
+
+    return nil
+}
+
+// versionedRoutes returns a function which registers handler for path, e.g. "/movies", under the
+// prefix of every version.
+func versionedRoutes(router *httprouter.Router) func(method, path string, handler http.HandlerFunc) {
+    return func(method, path string, handler http.HandlerFunc) {
+        for _, v := range apiVersions {
+            router.HandlerFunc(method, v.prefix()+path, handler)
+        }
+    }
+}
+
+// detectAPIVersion adds the version of the request path to the request context, and rejects the
+// paths with a version which isn't supported, e.g. /v3/movies, with a 404 Not Found listing the
+// supported ones.
+func (app *application) detectAPIVersion(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        number, _, ok := splitAPIVersion(r.URL.Path)
+        if !ok {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        v := findAPIVersion(number)
+        if v == nil {
+            app.unsupportedAPIVersionResponse(w, r, number)
+            return
+        }
+
+        next.ServeHTTP(w, app.contextSetAPIVersion(r, v))
+    })
+}
+
+// supportedAPIVersions returns the prefixes of the supported versions, e.g. "v1, v2".
+func supportedAPIVersions() string {
+    prefixes := make([]string, len(apiVersions))
+    for i, v := range apiVersions {
+        prefixes[i] = strings.TrimPrefix(v.prefix(), "/")
+    }
+
+    return strings.Join(prefixes, ", ")
+}
+
+// unsupportedAPIVersionMessage returns the message of the response to a request for a version
+// which isn't supported.
+func unsupportedAPIVersionMessage(number int) string {
+    return fmt.Sprintf("API version v%d is not supported, the supported versions are: %s", number, supportedAPIVersions())
+}
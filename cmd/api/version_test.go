@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"greenlight.zzh.net/internal/data/mock"
+)
+
+func TestSplitAPIVersion(t *testing.T) {
+    tests := []struct {
+        path       string
+        wantNumber int
+        wantRest   string
+        wantOK     bool
+    }{
+        {"/v1/movies", 1, "/movies", true},
+        {"/v2/movies/1/poster", 2, "/movies/1/poster", true},
+        {"/v12", 12, "/", true},
+        {"/debug/vars", 0, "", false},
+        {"/v/movies", 0, "", false},
+        {"/v1beta/movies", 0, "", false},
+        {"/videos", 0, "", false},
+        {"/", 0, "", false},
+    }
+
+    for _, tt := range tests {
+        number, rest, ok := splitAPIVersion(tt.path)
+        if number != tt.wantNumber || rest != tt.wantRest || ok != tt.wantOK {
+            t.Errorf("%s: got (%d, %q, %v); want (%d, %q, %v)", tt.path, number, rest, ok, tt.wantNumber, tt.wantRest, tt.wantOK)
+        }
+    }
+}
+
+func TestAPIVersions(t *testing.T) {
+    app := newTestApplication(t)
+    h := app.routes()
+    token := authToken(t, app, mock.ActivatedUserID)
+
+    // The same handlers serve both versions.
+    for _, target := range []string{"/v1/movies/1", "/v2/movies/1"} {
+        if rr := do(t, h, http.MethodGet, target, token, nil); rr.Code != http.StatusOK {
+            t.Errorf("%s: got status %d; body: %s", target, rr.Code, rr.Body)
+        }
+    }
+
+    rr := do(t, h, http.MethodPost, "/v2/movies", token, map[string]any{"title": "Up", "year": 2009, "runtime": "96 mins", "genres": []string{"animation"}})
+    if got, want := rr.Header().Get("Location"), "/v2/movies/4"; got != want {
+        t.Errorf("got Location %s; want %s", got, want)
+    }
+
+    // Errors only have a code in version 2, including those sent by middleware before routing.
+    tests := []struct {
+        target   string
+        token    string
+        wantCode int
+        wantBody string
+    }{
+        {"/v1/movies/99", token, http.StatusNotFound, `{"error":"the requested resource could not be found"}` + "\n"},
+        {"/v2/movies/99", token, http.StatusNotFound, `{"error":{"code":"not_found","message":"the requested resource could not be found"}}` + "\n"},
+        {"/v1/movies", "invalid", http.StatusUnauthorized, `{"error":"invalid or missing authentication token"}` + "\n"},
+        {"/v2/movies", "invalid", http.StatusUnauthorized, `{"error":{"code":"invalid_authentication_token","message":"invalid or missing authentication token"}}` + "\n"},
+        {"/v3/movies", token, http.StatusNotFound, `{"error":{"code":"unsupported_api_version","message":"API version v3 is not supported, the supported versions are: v1, v2"}}` + "\n"},
+        {"/v0", "", http.StatusNotFound, `{"error":{"code":"unsupported_api_version","message":"API version v0 is not supported, the supported versions are: v1, v2"}}` + "\n"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.target, func(t *testing.T) {
+            rr := do(t, h, http.MethodGet, tt.target, tt.token, nil)
+            if rr.Code != tt.wantCode {
+                t.Errorf("got status %d; want %d", rr.Code, tt.wantCode)
+            }
+            if rr.Body.String() != tt.wantBody {
+                t.Errorf("got body %s\nwant %s", rr.Body, tt.wantBody)
+            }
+        })
+    }
+
+    // The health endpoints of every version work without the database.
+    app.dbReady.Store(false)
+    for _, target := range []string{"/v1/healthcheck", "/v2/healthcheck"} {
+        if rr := do(t, h, http.MethodGet, target, "", nil); rr.Code != http.StatusOK {
+            t.Errorf("%s without database: got status %d", target, rr.Code)
+        }
+    }
+}
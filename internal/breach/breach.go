@@ -0,0 +1,102 @@
+// Package breach tells whether a password is too well known to be used: Common checks an
+// embedded list of the most common passwords, and a Client asks the Have I Been Pwned password
+// API whether the password has appeared in a breach.
+package breach
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultURL is the base URL of the Have I Been Pwned password range API.
+const DefaultURL = "https://api.pwnedpasswords.com"
+
+//go:embed common_passwords.txt
+var commonPasswordsFile string
+
+// commonPasswords returns the set of the passwords in common_passwords.txt, read on first use.
+var commonPasswords = sync.OnceValue(func() map[string]struct{} {
+    passwords := make(map[string]struct{})
+
+    for _, line := range strings.Split(commonPasswordsFile, "\n") {
+        line = strings.TrimSpace(line)
+        if line != "" && !strings.HasPrefix(line, "#") {
+            passwords[strings.ToLower(line)] = struct{}{}
+        }
+    }
+
+    return passwords
+})
+
+// Common reports whether password, ignoring case, is in the embedded list of common passwords.
+func Common(password string) bool {
+    _, ok := commonPasswords()[strings.ToLower(password)]
+    return ok
+}
+
+// Client looks passwords up in the Have I Been Pwned range API. Only the first 5 hex digits of
+// the SHA-1 hash of a password are sent, and the API answers with the suffixes of all the
+// breached hashes starting with them, so neither the password nor its hash leaves the process.
+type Client struct {
+    url  string
+    http *http.Client
+}
+
+// NewClient returns a Client of the API at baseURL, usually DefaultURL, whose lookups time out
+// after timeout.
+func NewClient(baseURL string, timeout time.Duration) *Client {
+    return &Client{
+        url:  strings.TrimSuffix(baseURL, "/"),
+        http: &http.Client{Timeout: timeout},
+    }
+}
+
+// Breached reports whether password has appeared in a breach known to the API. The caller
+// decides what to do when the API can't be reached, reported as an error.
+func (c *Client) Breached(ctx context.Context, password string) (bool, error) {
+    sum := sha1.Sum([]byte(password))
+    hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+    prefix, suffix := hash[:5], hash[5:]
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/range/"+prefix, nil)
+    if err != nil {
+        return false, err
+    }
+
+    // Padding makes every response about the same size, so that its size doesn't hint at the
+    // prefix either. The padding entries have a count of 0.
+    req.Header.Set("Add-Padding", "true")
+
+    resp, err := c.http.Do(req)
+    if err != nil {
+        return false, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return false, fmt.Errorf("breach: range lookup returned %s", resp.Status)
+    }
+
+    // Each line is a hash suffix and the number of times it was seen, e.g.
+    // 0018A45C4D1DEF81644B54AB7F969B88D65:21.
+    scanner := bufio.NewScanner(resp.Body)
+    for scanner.Scan() {
+        hashSuffix, count, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+        if ok && hashSuffix == suffix && count != "0" {
+            return true, nil
+        }
+    }
+    if err := scanner.Err(); err != nil {
+        return false, err
+    }
+
+    return false, nil
+}
@@ -0,0 +1,96 @@
+package breach
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCommon(t *testing.T) {
+    tests := []struct {
+        password string
+        want     bool
+    }{
+        {"password1", true},
+        {"PassWord1", true},
+        {"qwertyuiop", true},
+        {"macgyver", true},
+        {"honeydew", true},
+        {"hugohugo", true},
+        {"password123", true},
+        {"tr0ub4dor&3", false},
+        {"correct horse battery staple", false},
+        {"# The most common passwords of at least 8 bytes, the minimum length, one per line and in lower", false},
+    }
+
+    for _, tt := range tests {
+        if got := Common(tt.password); got != tt.want {
+            t.Errorf("Common(%q) = %t; want %t", tt.password, got, tt.want)
+        }
+    }
+}
+
+func TestClientBreached(t *testing.T) {
+    // The SHA-1 hash of "password1" is E38AD214943DAAD1D64C102FAEC29DE4AFE9DA3D.
+    const prefix, suffix = "E38AD", "214943DAAD1D64C102FAEC29DE4AFE9DA3D"
+
+    var gotPath, gotPadding string
+
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        gotPath, gotPadding = r.URL.Path, r.Header.Get("Add-Padding")
+
+        if r.URL.Path != "/range/"+prefix {
+            fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:0\r\n")
+            return
+        }
+
+        fmt.Fprint(w, "0018A45C4D1DEF81644B54AB7F969B88D65:21\r\n"+suffix+":2413945\r\n")
+    }))
+    defer srv.Close()
+
+    c := NewClient(srv.URL+"/", time.Second)
+
+    breached, err := c.Breached(context.Background(), "password1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !breached {
+        t.Error("got password1 not breached")
+    }
+
+    // Only the prefix of the hash is sent.
+    if gotPath != "/range/"+prefix || gotPadding != "true" {
+        t.Errorf("got path %q and Add-Padding %q; want /range/%s and true", gotPath, gotPadding, prefix)
+    }
+
+    breached, err = c.Breached(context.Background(), "a password nobody uses")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if breached {
+        t.Error("got a password which only matches padding breached")
+    }
+}
+
+func TestClientBreachedErrors(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/slow/range/E38AD" {
+            time.Sleep(100 * time.Millisecond)
+        }
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }))
+    defer srv.Close()
+
+    _, err := NewClient(srv.URL, time.Second).Breached(context.Background(), "password1")
+    if err == nil {
+        t.Error("got no error for a 503 response")
+    }
+
+    _, err = NewClient(srv.URL+"/slow", 10*time.Millisecond).Breached(context.Background(), "password1")
+    if err == nil {
+        t.Error("got no error for a response slower than the timeout")
+    }
+}
@@ -1,9 +1,23 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/validator"
 )
 
 // Config stores configuration that can be dynamically reloaded at runtime.
@@ -13,24 +27,65 @@ type Config struct {
     LimiterBurst   int     `mapstructure:"LIMITER_BURST"`
     LimiterEnabled bool    `mapstructure:"LIMITER_ENABLED"`
 
+    AuthLimiterRps     float64 `mapstructure:"AUTH_LIMITER_RPS"` // Stricter limiter of the authentication and registration endpoints
+    AuthLimiterBurst   int     `mapstructure:"AUTH_LIMITER_BURST"`
+    AuthLimiterEnabled bool    `mapstructure:"AUTH_LIMITER_ENABLED"`
+
+    DBTimeoutRead  time.Duration `mapstructure:"DB_TIMEOUT_READ"`
+    DBTimeoutWrite time.Duration `mapstructure:"DB_TIMEOUT_WRITE"`
+    DBTimeoutList  time.Duration `mapstructure:"DB_TIMEOUT_LIST"`
+    DBTimeoutToken time.Duration `mapstructure:"DB_TIMEOUT_TOKEN"`
+
+    APIKeyMaxPerUser int `mapstructure:"API_KEY_MAX_PER_USER"`
+
+    MovieWriteCanDelete bool `mapstructure:"MOVIE_WRITE_CAN_DELETE"` // Deprecated grant of movie:delete to movie:write holders
+
+    ServerTimingEnabled bool `mapstructure:"SERVER_TIMING_ENABLED"` // Send the Server-Timing header, e.g. in development
+
+    LogLevel string `mapstructure:"LOG_LEVEL"` // Overrides -log-level when set, e.g. to get debug logs from a running server
+
+    CORSTrustedOrigins string `mapstructure:"CORS_TRUSTED_ORIGINS"` // Space separated, e.g. https://*.example.com
+
+    FrontendBaseURL string `mapstructure:"FRONTEND_BASE_URL"` // Web frontend the links in emails point to, e.g. https://app.example.com; none if empty
+
+    RegistrationHoneypotEnabled bool   `mapstructure:"REGISTRATION_HONEYPOT_ENABLED"` // Fake the registrations filling the hidden website field
+    DisposableEmailsBlocked     bool   `mapstructure:"DISPOSABLE_EMAILS_BLOCKED"`     // Reject registrations with an email at a disposable email domain
+    DisposableEmailDomains      string `mapstructure:"DISPOSABLE_EMAIL_DOMAINS"`      // Space separated, blocked in addition to the embedded list
+
+    MoviesDefaultPageSize int `mapstructure:"MOVIES_DEFAULT_PAGE_SIZE"` // Page size of GET /v1/movies without page_size
+    MoviesMaxPageSize     int `mapstructure:"MOVIES_MAX_PAGE_SIZE"`
+    UsersDefaultPageSize  int `mapstructure:"USERS_DEFAULT_PAGE_SIZE"` // Page size of GET /v1/users without page_size
+    UsersMaxPageSize      int `mapstructure:"USERS_MAX_PAGE_SIZE"`
+
+    ActivationReminderAfter time.Duration `mapstructure:"ACTIVATION_REMINDER_AFTER"` // Age of the unactivated users sent a reminder, 0 to send none
+    UnactivatedUserTTL      time.Duration `mapstructure:"UNACTIVATED_USER_TTL"`      // Age of the unactivated users deleted, 0 to delete none
+
     // Fields from dynamic_db_secret.env
-    DBUsername            string        `mapstructure:"DB_USERNAME"`
-    DBPassword            string        `mapstructure:"DB_PASSWORD"`
-    DBServer              string        `mapstructure:"DB_SERVER"`
-    DBPort                int           `mapstructure:"DB_PORT"`
-    DBName                string        `mapstructure:"DB_NAME"`
-    DBSSLMode             string        `mapstructure:"DB_SSLMODE"`
-    DBPoolMaxConns        int           `mapstructure:"DB_POOL_MAX_CONNS"`
-    DBPoolMaxConnIdleTime time.Duration `mapstructure:"DB_POOL_MAX_CONN_IDLE_TIME"`
+    DBUsername                  string        `mapstructure:"DB_USERNAME"`
+    DBPassword                  string        `mapstructure:"DB_PASSWORD"`
+    DBPasswordFile              string        `mapstructure:"DB_PASSWORD_FILE"` // Overrides DBPassword with the contents of the file
+    DBServer                    string        `mapstructure:"DB_SERVER"`
+    DBPort                      int           `mapstructure:"DB_PORT"`
+    DBName                      string        `mapstructure:"DB_NAME"`
+    DBSSLMode                   string        `mapstructure:"DB_SSLMODE"`
+    DBPoolMaxConns              int           `mapstructure:"DB_POOL_MAX_CONNS"`
+    DBPoolMinConns              int           `mapstructure:"DB_POOL_MIN_CONNS"`
+    DBPoolMaxConnLifetime       time.Duration `mapstructure:"DB_POOL_MAX_CONN_LIFETIME"`
+    DBPoolMaxConnLifetimeJitter time.Duration `mapstructure:"DB_POOL_MAX_CONN_LIFETIME_JITTER"` // Spreads out the reconnections of connections opened together
+    DBPoolMaxConnIdleTime       time.Duration `mapstructure:"DB_POOL_MAX_CONN_IDLE_TIME"`
+    DBPoolHealthCheckPeriod     time.Duration `mapstructure:"DB_POOL_HEALTH_CHECK_PERIOD"`
+    DBSlowQueryThreshold        time.Duration `mapstructure:"DB_SLOW_QUERY_THRESHOLD"`
+    DBReplicaServer             string        `mapstructure:"DB_REPLICA_SERVER"` // Read-only replica serving the reads, none if empty
+    DBReplicaPort               int           `mapstructure:"DB_REPLICA_PORT"`
 
     // Fields from dynamic_smtp_secret.env
+    MailTransport     string `mapstructure:"MAIL_TRANSPORT"`     // How emails are delivered: smtp, or log or file for development
+    MailFileDir       string `mapstructure:"MAIL_FILE_DIR"`      // Directory of the .eml files written by the file transport
     SMTPUsername      string `mapstructure:"SMTP_USERNAME"`
     SMTPPassword      string `mapstructure:"SMTP_PASSWORD"`
+    SMTPPasswordFile  string `mapstructure:"SMTP_PASSWORD_FILE"` // Overrides SMTPPassword with the contents of the file
     SMTPAuthAddress   string `mapstructure:"SMTP_AUTH_ADDRESS"`
     SMTPServerAddress string `mapstructure:"SMTP_SERVER_ADDRESS"`
-
-    // Field needed by reloading above fields
-    LoadTime time.Time
 }
 
 // LimiterConfig stores configuration for rate limiting.
@@ -40,31 +95,658 @@ type LimiterConfig struct {
     Enabled bool
 }
 
-// SMTPConfig stores configuration for sending emails.
+// APIKeyConfig stores configuration for API keys.
+type APIKeyConfig struct {
+    MaxPerUser int
+}
+
+// PermissionConfig stores configuration for authorization.
+type PermissionConfig struct {
+    // MovieWriteCanDelete lets users with movie:write delete movies without movie:delete, until
+    // they have all been granted movie:delete.
+    MovieWriteCanDelete bool
+}
+
+// RegistrationConfig stores configuration for signing up.
+type RegistrationConfig struct {
+    // Honeypot fakes the registration of the requests filling the hidden website field, which
+    // only bots see.
+    Honeypot bool
+    // BlockedDomains are the email domains registrations are rejected from, nil if none.
+    BlockedDomains data.EmailDomains
+}
+
+// PageSizes stores the page sizes of a list endpoint.
+type PageSizes struct {
+    Default int // page size of the requests without one
+    Max     int // largest page size accepted
+}
+
+// ListConfig stores the page sizes of the list endpoints.
+type ListConfig struct {
+    Movies PageSizes
+    Users  PageSizes
+}
+
+// UnactivatedUsersConfig stores configuration for the users who haven't activated their account.
+// A zero duration disables the step.
+type UnactivatedUsersConfig struct {
+    // RemindAfter is how long after registering users are sent an activation reminder.
+    RemindAfter time.Duration
+    // DeleteAfter is how long after registering users are deleted.
+    DeleteAfter time.Duration
+}
+
+// SMTPConfig stores configuration for sending emails. Transport selects how emails are
+// delivered: through the SMTP server, written to the log, or saved as .eml files in FileDir.
 type SMTPConfig struct {
+    Transport     string
+    FileDir       string
     Username      string
     Password      string
     AuthAddress   string
     ServerAddress string
 }
 
-// LoadConfig loads configuration from a config file to a Config instance.
-func LoadConfig(v *viper.Viper, cfgPath, cfgType, cfgName string, cfg *Config) error {
+// mailTransports are the valid values of MAIL_TRANSPORT.
+var mailTransports = []string{"smtp", "log", "file"}
+
+// logLevels are the valid values of LOG_LEVEL and of the -log-level flag.
+var logLevels = map[string]slog.Level{
+    "debug": slog.LevelDebug,
+    "info":  slog.LevelInfo,
+    "warn":  slog.LevelWarn,
+    "error": slog.LevelError,
+}
+
+// ParseLogLevel returns the level named s, one of debug, info, warn and error in any case.
+func ParseLogLevel(s string) (slog.Level, error) {
+    level, ok := logLevels[strings.ToLower(s)]
+    if !ok {
+        return 0, fmt.Errorf("must be one of debug, info, warn, error, got %q", s)
+    }
+
+    return level, nil
+}
+
+// LogLevelOr returns the level of LOG_LEVEL, or fallback, the level of -log-level, if it isn't set.
+func (c *Config) LogLevelOr(fallback slog.Level) slog.Level {
+    level, err := ParseLogLevel(c.LogLevel)
+    if err != nil {
+        return fallback
+    }
+
+    return level
+}
+
+// sslModes are the valid values of DB_SSLMODE.
+var sslModes = []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}
+
+// Validate checks every field and returns all the problems found, each naming the offending
+// key.
+func (c *Config) Validate() []error {
+    return slices.Concat(c.ValidateDynamic(), c.ValidateDB(), c.ValidateSMTP())
+}
+
+// ValidationError reports all the problems found validating a config file.
+type ValidationError struct {
+    File string
+    Errs []error
+}
+
+func (e *ValidationError) Error() string {
+    return fmt.Sprintf("%s: invalid configuration: %v", e.File, errors.Join(e.Errs...))
+}
+
+func (e *ValidationError) Unwrap() []error {
+    return e.Errs
+}
+
+// ValidateDynamic checks the fields loaded from dynamic.env.
+func (c *Config) ValidateDynamic() []error {
+    var errs []error
+
+    if c.LimiterEnabled && c.LimiterRps <= 0 {
+        errs = append(errs, errors.New("LIMITER_RPS must be greater than 0 when the limiter is enabled"))
+    }
+    if c.LimiterEnabled && c.LimiterBurst <= 0 {
+        errs = append(errs, errors.New("LIMITER_BURST must be greater than 0 when the limiter is enabled"))
+    }
+    if c.AuthLimiterEnabled && c.AuthLimiterRps <= 0 {
+        errs = append(errs, errors.New("AUTH_LIMITER_RPS must be greater than 0 when the authentication limiter is enabled"))
+    }
+    if c.AuthLimiterEnabled && c.AuthLimiterBurst <= 0 {
+        errs = append(errs, errors.New("AUTH_LIMITER_BURST must be greater than 0 when the authentication limiter is enabled"))
+    }
+    // The authentication limiter is meant to be the stricter one, with a longer Retry-After.
+    if c.AuthLimiterEnabled && c.LimiterEnabled && c.LimiterRps > 0 && c.AuthLimiterRps >= c.LimiterRps {
+        errs = append(errs, fmt.Errorf("AUTH_LIMITER_RPS must be less than LIMITER_RPS (%v)", c.LimiterRps))
+    }
+
+    timeouts := []struct {
+        key   string
+        value time.Duration
+    }{
+        {"DB_TIMEOUT_READ", c.DBTimeoutRead},
+        {"DB_TIMEOUT_WRITE", c.DBTimeoutWrite},
+        {"DB_TIMEOUT_LIST", c.DBTimeoutList},
+        {"DB_TIMEOUT_TOKEN", c.DBTimeoutToken},
+    }
+    for _, timeout := range timeouts {
+        if timeout.value <= 0 {
+            errs = append(errs, fmt.Errorf("%s must be greater than 0", timeout.key))
+        }
+    }
+
+    if c.APIKeyMaxPerUser < 0 {
+        errs = append(errs, errors.New("API_KEY_MAX_PER_USER must not be negative"))
+    }
+
+    if c.LogLevel != "" {
+        if _, err := ParseLogLevel(c.LogLevel); err != nil {
+            errs = append(errs, fmt.Errorf("LOG_LEVEL %w", err))
+        }
+    }
+
+    for _, pattern := range strings.Fields(c.CORSTrustedOrigins) {
+        if _, err := CompileOrigin(pattern); err != nil {
+            errs = append(errs, fmt.Errorf("CORS_TRUSTED_ORIGINS has an %w", err))
+        }
+    }
+
+    for _, domain := range strings.Fields(c.DisposableEmailDomains) {
+        if !validator.Matches("user@"+domain, validator.EmailRX) {
+            errs = append(errs, fmt.Errorf("DISPOSABLE_EMAIL_DOMAINS has an invalid domain %q", domain))
+        }
+    }
+
+    pageSizes := []struct {
+        prefix string
+        sizes  PageSizes
+    }{
+        {"MOVIES", PageSizes{c.MoviesDefaultPageSize, c.MoviesMaxPageSize}},
+        {"USERS", PageSizes{c.UsersDefaultPageSize, c.UsersMaxPageSize}},
+    }
+    for _, ps := range pageSizes {
+        if ps.sizes.Default <= 0 {
+            errs = append(errs, fmt.Errorf("%s_DEFAULT_PAGE_SIZE must be greater than 0", ps.prefix))
+        }
+        if ps.sizes.Max < ps.sizes.Default {
+            errs = append(errs, fmt.Errorf("%s_MAX_PAGE_SIZE must be at least %s_DEFAULT_PAGE_SIZE (%d)", ps.prefix, ps.prefix, ps.sizes.Default))
+        }
+    }
+
+    if c.ActivationReminderAfter < 0 {
+        errs = append(errs, errors.New("ACTIVATION_REMINDER_AFTER must not be negative"))
+    }
+    if c.UnactivatedUserTTL < 0 {
+        errs = append(errs, errors.New("UNACTIVATED_USER_TTL must not be negative"))
+    }
+    // Otherwise the users would be deleted before being reminded.
+    if c.ActivationReminderAfter > 0 && c.UnactivatedUserTTL > 0 && c.UnactivatedUserTTL <= c.ActivationReminderAfter {
+        errs = append(errs, fmt.Errorf("UNACTIVATED_USER_TTL must be greater than ACTIVATION_REMINDER_AFTER (%v)", c.ActivationReminderAfter))
+    }
+
+    if c.FrontendBaseURL != "" {
+        u, err := url.Parse(c.FrontendBaseURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+            errs = append(errs, fmt.Errorf("FRONTEND_BASE_URL must be an http or https URL without a query or fragment, got %q", c.FrontendBaseURL))
+        }
+    }
+
+    return errs
+}
+
+// ValidateDB checks the fields loaded from dynamic_db_secret.env.
+func (c *Config) ValidateDB() []error {
+    var errs []error
+
+    if c.DBServer == "" {
+        errs = append(errs, errors.New("DB_SERVER must be provided"))
+    }
+    if c.DBPort < 1 || c.DBPort > 65535 {
+        errs = append(errs, fmt.Errorf("DB_PORT must be between 1 and 65535, got %d", c.DBPort))
+    }
+    if c.DBName == "" {
+        errs = append(errs, errors.New("DB_NAME must be provided"))
+    }
+    if c.DBUsername == "" {
+        errs = append(errs, errors.New("DB_USERNAME must be provided"))
+    }
+    if !slices.Contains(sslModes, c.DBSSLMode) {
+        errs = append(errs, fmt.Errorf("DB_SSLMODE must be one of %s, got %q", strings.Join(sslModes, ", "), c.DBSSLMode))
+    }
+    if c.DBPoolMaxConns <= 0 {
+        errs = append(errs, errors.New("DB_POOL_MAX_CONNS must be greater than 0"))
+    }
+    if c.DBPoolMinConns < 0 {
+        errs = append(errs, errors.New("DB_POOL_MIN_CONNS must not be negative"))
+    } else if c.DBPoolMaxConns > 0 && c.DBPoolMinConns > c.DBPoolMaxConns {
+        errs = append(errs, fmt.Errorf("DB_POOL_MIN_CONNS must not be greater than DB_POOL_MAX_CONNS (%d)", c.DBPoolMaxConns))
+    }
+    if c.DBPoolMaxConnLifetime <= 0 {
+        errs = append(errs, errors.New("DB_POOL_MAX_CONN_LIFETIME must be greater than 0"))
+    }
+    if c.DBPoolMaxConnLifetimeJitter < 0 {
+        errs = append(errs, errors.New("DB_POOL_MAX_CONN_LIFETIME_JITTER must not be negative"))
+    }
+    if c.DBPoolMaxConnIdleTime < 0 {
+        errs = append(errs, errors.New("DB_POOL_MAX_CONN_IDLE_TIME must not be negative"))
+    }
+    if c.DBPoolHealthCheckPeriod <= 0 {
+        errs = append(errs, errors.New("DB_POOL_HEALTH_CHECK_PERIOD must be greater than 0"))
+    }
+    if c.DBSlowQueryThreshold < 0 {
+        errs = append(errs, errors.New("DB_SLOW_QUERY_THRESHOLD must not be negative"))
+    }
+    if c.DBReplicaServer != "" && (c.DBReplicaPort < 1 || c.DBReplicaPort > 65535) {
+        errs = append(errs, fmt.Errorf("DB_REPLICA_PORT must be between 1 and 65535, got %d", c.DBReplicaPort))
+    }
+
+    return errs
+}
+
+// ValidateSMTP checks the fields loaded from dynamic_smtp_secret.env.
+func (c *Config) ValidateSMTP() []error {
+    var errs []error
+
+    switch c.MailTransport {
+    case "smtp":
+    case "log":
+        return nil
+    case "file":
+        if c.MailFileDir == "" {
+            errs = append(errs, errors.New("MAIL_FILE_DIR must be provided when MAIL_TRANSPORT is file"))
+        }
+        return errs
+    default:
+        return []error{fmt.Errorf("MAIL_TRANSPORT must be one of %s, got %q", strings.Join(mailTransports, ", "), c.MailTransport)}
+    }
+
+    host, port, err := net.SplitHostPort(c.SMTPServerAddress)
+    if err != nil {
+        errs = append(errs, fmt.Errorf("SMTP_SERVER_ADDRESS must be a host:port address, got %q", c.SMTPServerAddress))
+    } else {
+        n, err := strconv.Atoi(port)
+        if host == "" || err != nil || n < 1 || n > 65535 {
+            errs = append(errs, fmt.Errorf("SMTP_SERVER_ADDRESS must be a host:port address, got %q", c.SMTPServerAddress))
+        }
+    }
+
+    if c.SMTPUsername != "" && c.SMTPAuthAddress == "" {
+        errs = append(errs, errors.New("SMTP_AUTH_ADDRESS must be provided when SMTP_USERNAME is set"))
+    }
+
+    return errs
+}
+
+// Diff returns the keys whose values differ between old and new, with the old and new values,
+// e.g. "LIMITER_RPS: 2 -> 5". The values of secrets aren't shown.
+func Diff(old, new *Config) []string {
+    oldValue := reflect.ValueOf(old).Elem()
+    newValue := reflect.ValueOf(new).Elem()
+    t := oldValue.Type()
+
+    var changes []string
+
+    for i := range t.NumField() {
+        key := t.Field(i).Tag.Get("mapstructure")
+        if key == "" {
+            continue
+        }
+
+        o, n := oldValue.Field(i).Interface(), newValue.Field(i).Interface()
+        if reflect.DeepEqual(o, n) {
+            continue
+        }
+
+        if strings.Contains(key, "PASSWORD") {
+            changes = append(changes, key+": changed")
+        } else {
+            changes = append(changes, fmt.Sprintf("%s: %v -> %v", key, o, n))
+        }
+    }
+
+    return changes
+}
+
+// EnvPrefix is the prefix of the environment variables overriding config file values, e.g.
+// GREENLIGHT_DB_PASSWORD overrides DB_PASSWORD.
+const EnvPrefix = "GREENLIGHT"
+
+// defaults are the values of keys set by neither a flag, an environment variable nor the config
+// file.
+var defaults = map[string]any{
+    "LIMITER_RPS":     2,
+    "LIMITER_BURST":   4,
+    "LIMITER_ENABLED": true,
+
+    "AUTH_LIMITER_RPS":     0.1,
+    "AUTH_LIMITER_BURST":   5,
+    "AUTH_LIMITER_ENABLED": true,
+
+    "DB_TIMEOUT_READ":  3 * time.Second,
+    "DB_TIMEOUT_WRITE": 3 * time.Second,
+    "DB_TIMEOUT_LIST":  10 * time.Second,
+    "DB_TIMEOUT_TOKEN": time.Second,
+
+    "API_KEY_MAX_PER_USER": 10,
+
+    "MOVIE_WRITE_CAN_DELETE": true,
+
+    "SERVER_TIMING_ENABLED": false,
+
+    "LOG_LEVEL": "",
+
+    "CORS_TRUSTED_ORIGINS": "",
+
+    "FRONTEND_BASE_URL": "",
+
+    "REGISTRATION_HONEYPOT_ENABLED": true,
+    "DISPOSABLE_EMAILS_BLOCKED":     true,
+    "DISPOSABLE_EMAIL_DOMAINS":      "",
+
+    "MOVIES_DEFAULT_PAGE_SIZE": 20,
+    "MOVIES_MAX_PAGE_SIZE":     100,
+    "USERS_DEFAULT_PAGE_SIZE":  20,
+    "USERS_MAX_PAGE_SIZE":      100,
+
+    "ACTIVATION_REMINDER_AFTER": 7 * 24 * time.Hour,
+    "UNACTIVATED_USER_TTL":      30 * 24 * time.Hour,
+
+    "DB_PORT":                          5432,
+    "DB_SSLMODE":                       "disable",
+    "DB_POOL_MAX_CONNS":                25,
+    "DB_POOL_MIN_CONNS":                0,
+    "DB_POOL_MAX_CONN_LIFETIME":        time.Hour,
+    "DB_POOL_MAX_CONN_LIFETIME_JITTER": 0,
+    "DB_POOL_MAX_CONN_IDLE_TIME":       15 * time.Minute,
+    "DB_POOL_HEALTH_CHECK_PERIOD":      time.Minute,
+    "DB_SLOW_QUERY_THRESHOLD":          500 * time.Millisecond,
+    "DB_REPLICA_SERVER":                "",
+    "DB_REPLICA_PORT":                  5432,
+
+    "MAIL_TRANSPORT": "smtp",
+    "MAIL_FILE_DIR":  "tmp/mail",
+}
+
+// keys returns the config keys, i.e. the mapstructure tags of the Config fields.
+func keys() []string {
+    t := reflect.TypeOf(Config{})
+
+    keys := make([]string, 0, t.NumField())
+    for i := range t.NumField() {
+        if key := t.Field(i).Tag.Get("mapstructure"); key != "" {
+            keys = append(keys, key)
+        }
+    }
+
+    return keys
+}
+
+// FlagName returns the name of the flag overriding key, e.g. "limiter-rps" for LIMITER_RPS.
+func FlagName(key string) string {
+    return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// LoadConfig loads configuration into cfg. Each key takes its value from the first of these
+// which sets it:
+//
+//  1. a flag in flags set on the command line and named after the key (see FlagName)
+//  2. the environment variable EnvPrefix_<KEY>, e.g. GREENLIGHT_LIMITER_RPS
+//  3. the config file cfgName in cfgPath
+//  4. the default
+//
+// If cfgType is empty, the type of the config file is detected from its extension, which can be
+// env, yaml, yml, toml or json. flags may be nil. A missing config file isn't an error, so that
+// all values can come from environment variables.
+func LoadConfig(v *viper.Viper, cfgPath, cfgType, cfgName string, flags *flag.FlagSet, cfg *Config) error {
     v.AddConfigPath(cfgPath)
-    v.SetConfigType(cfgType)
+    if cfgType != "" {
+        v.SetConfigType(cfgType)
+    }
     v.SetConfigName(cfgName)
 
+    for key, value := range defaults {
+        v.SetDefault(key, value)
+    }
+
+    // AutomaticEnv only applies to keys viper already knows about when unmarshalling, so every
+    // key is bound explicitly as well.
+    v.SetEnvPrefix(EnvPrefix)
+    v.AutomaticEnv()
+    for _, key := range keys() {
+        err := v.BindEnv(key)
+        if err != nil {
+            return err
+        }
+    }
+
     err := v.ReadInConfig()
-    if err != nil {
+    if err != nil && !errors.As(err, &viper.ConfigFileNotFoundError{}) {
         return err
     }
 
+    if flags != nil {
+        known := make(map[string]string)
+        for _, key := range keys() {
+            known[FlagName(key)] = key
+        }
+
+        // Visit only calls the function for flags set on the command line, so the defaults of
+        // the flags don't override anything.
+        flags.Visit(func(f *flag.Flag) {
+            if key, ok := known[f.Name]; ok {
+                v.Set(key, f.Value.String())
+            }
+        })
+    }
+
     err = v.Unmarshal(cfg)
     if err != nil {
         return err
     }
 
-    cfg.LoadTime = time.Now()
+    return cfg.readSecretFiles()
+}
+
+// readSecretFiles replaces the secrets which have a *_FILE key set with the trimmed contents of
+// the file it names, as with Docker and Kubernetes secrets mounted as files.
+func (c *Config) readSecretFiles() error {
+    secrets := []struct {
+        key   string
+        file  string
+        value *string
+    }{
+        {"DB_PASSWORD_FILE", c.DBPasswordFile, &c.DBPassword},
+        {"SMTP_PASSWORD_FILE", c.SMTPPasswordFile, &c.SMTPPassword},
+    }
+
+    for _, secret := range secrets {
+        if secret.file == "" {
+            continue
+        }
+
+        b, err := os.ReadFile(secret.file)
+        if err != nil {
+            return fmt.Errorf("%s: %w", secret.key, err)
+        }
+
+        value := strings.TrimSpace(string(b))
+        if value == "" {
+            return fmt.Errorf("%s: %s is empty", secret.key, secret.file)
+        }
+
+        *secret.value = value
+    }
 
     return nil
 }
+
+// Limiter returns the rate limiter configuration.
+func (c *Config) Limiter() *LimiterConfig {
+    return &LimiterConfig{
+        Rps:     c.LimiterRps,
+        Burst:   c.LimiterBurst,
+        Enabled: c.LimiterEnabled,
+    }
+}
+
+// AuthLimiter returns the configuration of the authentication rate limiter.
+func (c *Config) AuthLimiter() *LimiterConfig {
+    return &LimiterConfig{
+        Rps:     c.AuthLimiterRps,
+        Burst:   c.AuthLimiterBurst,
+        Enabled: c.AuthLimiterEnabled,
+    }
+}
+
+// TrustedOrigins returns the compiled CORS_TRUSTED_ORIGINS. Origins which don't compile are
+// skipped; ValidateDynamic has reported them.
+func (c *Config) TrustedOrigins() []*regexp.Regexp {
+    var origins []*regexp.Regexp
+
+    for _, pattern := range strings.Fields(c.CORSTrustedOrigins) {
+        if rx, err := CompileOrigin(pattern); err == nil {
+            origins = append(origins, rx)
+        }
+    }
+
+    return origins
+}
+
+// CompileOrigin compiles a trusted CORS origin into a regular expression matching the Origin
+// header. The leftmost label of the host may be "*", which matches one or more subdomain labels,
+// so "https://*.example.com" matches "https://pr-123.app.example.com" but not
+// "https://example.com".
+func CompileOrigin(pattern string) (*regexp.Regexp, error) {
+    u, err := url.Parse(pattern)
+    if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil {
+        return nil, fmt.Errorf("invalid CORS origin %q: must be scheme://host[:port]", pattern)
+    }
+
+    host := u.Host
+    wildcard := strings.HasPrefix(host, "*.")
+    if wildcard {
+        host = strings.TrimPrefix(host, "*.")
+    }
+
+    if strings.Contains(host, "*") {
+        return nil, fmt.Errorf("invalid CORS origin %q: only the leftmost label of the host can be *", pattern)
+    }
+
+    expr := regexp.QuoteMeta(strings.ToLower(u.Scheme+"://"))
+    if wildcard {
+        expr += `[a-z0-9-]+(\.[a-z0-9-]+)*\.`
+    }
+    expr += regexp.QuoteMeta(strings.ToLower(host))
+
+    return regexp.MustCompile("^" + expr + "$"), nil
+}
+
+// DBConnString returns the connection string of the database. The pool settings aren't part of
+// it; see DBPool.
+func (c *Config) DBConnString() string {
+    return c.dbConnString(c.DBServer, c.DBPort)
+}
+
+// dbConnString returns the connection string of the database on the given server.
+func (c *Config) dbConnString(server string, port int) string {
+    query := url.Values{}
+    query.Set("sslmode", c.DBSSLMode)
+
+    // Building a URL escapes the credentials, which may contain any character.
+    u := url.URL{
+        Scheme:   "postgres",
+        User:     url.UserPassword(c.DBUsername, c.DBPassword),
+        Host:     net.JoinHostPort(server, strconv.Itoa(port)),
+        Path:     "/" + c.DBName,
+        RawQuery: query.Encode(),
+    }
+
+    return u.String()
+}
+
+// DBPool returns the configuration of the database connection pool.
+func (c *Config) DBPool() data.PoolConfig {
+    return data.PoolConfig{
+        ConnString:            c.DBConnString(),
+        MaxConns:              int32(c.DBPoolMaxConns),
+        MinConns:              int32(c.DBPoolMinConns),
+        MaxConnLifetime:       c.DBPoolMaxConnLifetime,
+        MaxConnLifetimeJitter: c.DBPoolMaxConnLifetimeJitter,
+        MaxConnIdleTime:       c.DBPoolMaxConnIdleTime,
+        HealthCheckPeriod:     c.DBPoolHealthCheckPeriod,
+    }
+}
+
+// DBReplicaPool returns the configuration of the connection pool of the read replica, which
+// shares the credentials, database name and pool settings of the primary. ok is false if no
+// replica is configured.
+func (c *Config) DBReplicaPool() (pc data.PoolConfig, ok bool) {
+    if c.DBReplicaServer == "" {
+        return data.PoolConfig{}, false
+    }
+
+    pc = c.DBPool()
+    pc.ConnString = c.dbConnString(c.DBReplicaServer, c.DBReplicaPort)
+
+    return pc, true
+}
+
+// FrontendURL returns the parsed FRONTEND_BASE_URL, or nil if it is empty or invalid, which
+// ValidateDynamic has reported.
+func (c *Config) FrontendURL() *url.URL {
+    if c.FrontendBaseURL == "" {
+        return nil
+    }
+
+    u, err := url.Parse(c.FrontendBaseURL)
+    if err != nil {
+        return nil
+    }
+
+    return u
+}
+
+// Registration returns the registration configuration. The blocked domains are the embedded
+// disposable email domains plus DISPOSABLE_EMAIL_DOMAINS, or none if DISPOSABLE_EMAILS_BLOCKED
+// is false.
+func (c *Config) Registration() *RegistrationConfig {
+    rc := &RegistrationConfig{Honeypot: c.RegistrationHoneypotEnabled}
+
+    if c.DisposableEmailsBlocked {
+        rc.BlockedDomains = data.DisposableEmailDomains(strings.Fields(c.DisposableEmailDomains)...)
+    }
+
+    return rc
+}
+
+// Lists returns the page sizes of the list endpoints.
+func (c *Config) Lists() *ListConfig {
+    return &ListConfig{
+        Movies: PageSizes{Default: c.MoviesDefaultPageSize, Max: c.MoviesMaxPageSize},
+        Users:  PageSizes{Default: c.UsersDefaultPageSize, Max: c.UsersMaxPageSize},
+    }
+}
+
+// UnactivatedUsers returns the configuration of the reminders and deletion of the unactivated
+// users.
+func (c *Config) UnactivatedUsers() *UnactivatedUsersConfig {
+    return &UnactivatedUsersConfig{
+        RemindAfter: c.ActivationReminderAfter,
+        DeleteAfter: c.UnactivatedUserTTL,
+    }
+}
+
+// SMTP returns the SMTP configuration.
+func (c *Config) SMTP() *SMTPConfig {
+    return &SMTPConfig{
+        Transport:     c.MailTransport,
+        FileDir:       c.MailFileDir,
+        Username:      c.SMTPUsername,
+        Password:      c.SMTPPassword,
+        AuthAddress:   c.SMTPAuthAddress,
+        ServerAddress: c.SMTPServerAddress,
+    }
+}
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// DefaultDebounce is how long a Watcher waits after the last change to its file before reloading
+// it. Editors often write a file in several steps, and a reload in between would see a partial
+// file.
+const DefaultDebounce = 200 * time.Millisecond
+
+// Watcher loads a config file and reloads it whenever it changes. A reloaded config is validated
+// before it replaces the current one and is handed to the apply callback. If the file can't be
+// read, parsed or validated, the error is logged and the current config is kept, so a bad edit
+// never takes the application down.
+type Watcher struct {
+    Debounce time.Duration
+
+    // If NoNotify is set before Start, Start doesn't watch the file for changes and the config is
+    // only reloaded when Reload is called, e.g. on SIGHUP. Some environments, such as ConfigMaps
+    // mounted with subPath, never deliver file change events.
+    NoNotify bool
+
+    cfgPath  string
+    cfgType  string
+    cfgName  string
+    flags    *flag.FlagSet
+    validate func(*Config) []error
+    apply    func(*Config)
+    logger   *slog.Logger
+
+    current atomic.Pointer[Config]
+
+    mu       sync.Mutex
+    path     string // The config file found by the last load, empty if there is none
+    timer    *time.Timer
+    notifier *fsnotify.Watcher
+}
+
+// NewWatcher loads the config file cfgName of type cfgType in cfgPath with LoadConfig, validates
+// it with validate, which may be nil, and returns a Watcher holding it. The initial config is
+// available from Config; reloading starts with Start.
+func NewWatcher(cfgPath, cfgType, cfgName string, flags *flag.FlagSet, validate func(*Config) []error, logger *slog.Logger) (*Watcher, error) {
+    w := &Watcher{
+        Debounce: DefaultDebounce,
+        cfgPath:  cfgPath,
+        cfgType:  cfgType,
+        cfgName:  cfgName,
+        flags:    flags,
+        validate: validate,
+        logger:   logger,
+    }
+
+    cfg, err := w.load()
+    if err != nil {
+        return nil, err
+    }
+
+    w.current.Store(cfg)
+
+    return w, nil
+}
+
+// Config returns the config currently in use. The returned value must not be modified.
+func (w *Watcher) Config() *Config {
+    return w.current.Load()
+}
+
+// load reads, parses and validates the config file into a new Config and records the path of
+// the file found. The caller must hold the mutex, unless the Watcher isn't shared yet.
+func (w *Watcher) load() (*Config, error) {
+    var cfg Config
+
+    // A new viper instance is used for every load, since viper isn't safe for concurrent use.
+    v := viper.New()
+
+    err := LoadConfig(v, w.cfgPath, w.cfgType, w.cfgName, w.flags, &cfg)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", filepath.Join(w.cfgPath, w.cfgName), err)
+    }
+
+    w.path = v.ConfigFileUsed()
+
+    if w.validate != nil {
+        errs := w.validate(&cfg)
+        if len(errs) > 0 {
+            return nil, &ValidationError{File: filepath.Join(w.cfgPath, w.cfgName), Errs: errs}
+        }
+    }
+
+    return &cfg, nil
+}
+
+// Reload loads the config file and, if it is valid and differs from the current config, swaps it
+// in and passes it to the apply callback given to Start. It returns the changes (see Diff). On
+// error the current config is kept.
+func (w *Watcher) Reload() ([]string, error) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    cfg, err := w.load()
+    if err != nil {
+        return nil, err
+    }
+
+    changes := Diff(w.current.Load(), cfg)
+    if len(changes) == 0 {
+        return nil, nil
+    }
+
+    w.current.Store(cfg)
+
+    if w.apply != nil {
+        w.apply(cfg)
+    }
+
+    return changes, nil
+}
+
+// Name returns the path of the config file without extension, e.g. "config/dynamic".
+func (w *Watcher) Name() string {
+    return filepath.Join(w.cfgPath, w.cfgName)
+}
+
+// Start watches the directory of the config file and reloads the file, debounced, whenever it is
+// written, created, renamed or replaced through a symlink (as Kubernetes does with mounted
+// ConfigMaps and Secrets). Watching the directory rather than the file keeps working when an
+// editor saves by replacing the file. apply, which may be nil, is called with every config
+// successfully reloaded. If no config file was found, there is nothing to watch and Start only
+// records apply.
+func (w *Watcher) Start(apply func(*Config)) error {
+    w.mu.Lock()
+    w.apply = apply
+    path := w.path
+    w.mu.Unlock()
+
+    if path == "" || w.NoNotify {
+        return nil
+    }
+
+    notifier, err := fsnotify.NewWatcher()
+    if err != nil {
+        return err
+    }
+
+    err = notifier.Add(w.cfgPath)
+    if err != nil {
+        notifier.Close()
+        return err
+    }
+
+    w.mu.Lock()
+    w.notifier = notifier
+    w.mu.Unlock()
+
+    file := filepath.Clean(path)
+    realFile, _ := filepath.EvalSymlinks(file)
+
+    go func() {
+        for {
+            select {
+            case event, ok := <-notifier.Events:
+                if !ok {
+                    return
+                }
+
+                currentRealFile, _ := filepath.EvalSymlinks(file)
+
+                switch {
+                case filepath.Clean(event.Name) == file && !event.Has(fsnotify.Chmod):
+                case currentRealFile != "" && currentRealFile != realFile:
+                    realFile = currentRealFile
+                default:
+                    continue
+                }
+
+                w.logger.Info("configuration change detected", "filename", event.Name, "operation", event.Op.String())
+                w.schedule()
+
+            case err, ok := <-notifier.Errors:
+                if !ok {
+                    return
+                }
+                w.logger.Error("configuration watcher error", "filename", file, "error", err.Error())
+            }
+        }
+    }()
+
+    return nil
+}
+
+// schedule reloads the config file once no change has been seen for the debounce interval.
+func (w *Watcher) schedule() {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.timer != nil {
+        w.timer.Stop()
+    }
+
+    w.timer = time.AfterFunc(w.Debounce, func() {
+        changes, err := w.Reload()
+        if err != nil {
+            LogError(w.logger, "failed to reload configuration, keeping the old one", err)
+            return
+        }
+        w.logger.Info("configuration reloaded", "filename", w.Name(), "changes", changes)
+    })
+}
+
+// Stop stops watching the config file. A pending reload is cancelled.
+func (w *Watcher) Stop() error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+
+    if w.timer != nil {
+        w.timer.Stop()
+    }
+
+    if w.notifier == nil {
+        return nil
+    }
+
+    err := w.notifier.Close()
+    w.notifier = nil
+
+    if err != nil && !errors.Is(err, fsnotify.ErrClosed) {
+        return err
+    }
+
+    return nil
+}
+
+// LogError logs err with msg. The problems of a ValidationError are logged one per line, so that
+// all of them are reported at once.
+func LogError(logger *slog.Logger, msg string, err error) {
+    var validationErr *ValidationError
+    if !errors.As(err, &validationErr) {
+        logger.Error(msg, "error", err.Error())
+        return
+    }
+
+    for _, e := range validationErr.Errs {
+        logger.Error(msg, "filename", validationErr.File, "error", e.Error())
+    }
+}
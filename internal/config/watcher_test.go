@@ -0,0 +1,204 @@
+package config
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const validDynamic = "LIMITER_RPS=2\nLIMITER_BURST=4\nLIMITER_ENABLED=true\nAPI_KEY_MAX_PER_USER=10\n"
+
+// newTestWatcher writes content to dynamic.env in a temporary directory and returns a Watcher
+// for it with a short debounce interval.
+func newTestWatcher(t *testing.T, content string) (*Watcher, string) {
+    t.Helper()
+
+    dir := t.TempDir()
+    file := filepath.Join(dir, "dynamic.env")
+    writeFile(t, file, content)
+
+    w, err := NewWatcher(dir, "env", "dynamic", nil, (*Config).ValidateDynamic, slog.New(slog.NewTextHandler(io.Discard, nil)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    w.Debounce = 20 * time.Millisecond
+
+    return w, file
+}
+
+func writeFile(t *testing.T, file, content string) {
+    t.Helper()
+
+    err := os.WriteFile(file, []byte(content), 0o600)
+    if err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestNewWatcher(t *testing.T) {
+    tests := []struct {
+        name    string
+        content string
+        wantErr bool
+    }{
+        {"valid", validDynamic, false},
+        {"unparsable value", "LIMITER_RPS=abc\n", true},
+        {"invalid value", "LIMITER_ENABLED=true\nLIMITER_RPS=0\nLIMITER_BURST=4\n", true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            dir := t.TempDir()
+            writeFile(t, filepath.Join(dir, "dynamic.env"), tt.content)
+
+            _, err := NewWatcher(dir, "env", "dynamic", nil, (*Config).ValidateDynamic, slog.New(slog.NewTextHandler(io.Discard, nil)))
+            if (err != nil) != tt.wantErr {
+                t.Errorf("got error %v; want error %t", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestWatcherReload(t *testing.T) {
+    w, file := newTestWatcher(t, validDynamic)
+
+    writeFile(t, file, "LIMITER_RPS=abc\n")
+
+    _, err := w.Reload()
+    if err == nil {
+        t.Fatal("got no error reloading an invalid file")
+    }
+    if got := w.Config().LimiterRps; got != 2 {
+        t.Errorf("got LimiterRps %v after a failed reload; want 2", got)
+    }
+
+    writeFile(t, file, "LIMITER_RPS=5\nLIMITER_BURST=4\nLIMITER_ENABLED=true\n")
+
+    changes, err := w.Reload()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got := w.Config().LimiterRps; got != 5 {
+        t.Errorf("got LimiterRps %v; want 5", got)
+    }
+    if len(changes) != 1 || changes[0] != "LIMITER_RPS: 2 -> 5" {
+        t.Errorf("got changes %q", changes)
+    }
+
+    // Reloading an unchanged file reports no change.
+    changes, err = w.Reload()
+    if err != nil || changes != nil {
+        t.Errorf("got changes %q and error %v reloading an unchanged file; want neither", changes, err)
+    }
+}
+
+func TestWatcherNoNotify(t *testing.T) {
+    w, file := newTestWatcher(t, validDynamic)
+    w.NoNotify = true
+
+    applied := make(chan *Config, 10)
+
+    err := w.Start(func(c *Config) { applied <- c })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+
+    writeFile(t, file, "LIMITER_RPS=7\nLIMITER_BURST=4\nLIMITER_ENABLED=true\n")
+
+    select {
+    case c := <-applied:
+        t.Fatalf("config %+v applied on file change with NoNotify", c)
+    case <-time.After(200 * time.Millisecond):
+    }
+
+    _, err = w.Reload()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    select {
+    case c := <-applied:
+        if c.LimiterRps != 7 {
+            t.Errorf("got LimiterRps %v applied; want 7", c.LimiterRps)
+        }
+    default:
+        t.Error("Reload didn't apply the config")
+    }
+}
+
+func TestWatcherKeepsConfigOnInvalidChange(t *testing.T) {
+    w, file := newTestWatcher(t, validDynamic)
+
+    applied := make(chan *Config, 10)
+
+    err := w.Start(func(c *Config) { applied <- c })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+
+    for _, content := range []string{"LIMITER_RPS=abc\n", "LIMITER_ENABLED=true\nLIMITER_RPS=0\nLIMITER_BURST=4\n"} {
+        writeFile(t, file, content)
+
+        select {
+        case c := <-applied:
+            t.Fatalf("invalid config %q was applied: %+v", content, c)
+        case <-time.After(200 * time.Millisecond):
+        }
+
+        if got := w.Config().LimiterRps; got != 2 {
+            t.Errorf("got LimiterRps %v after writing %q; want 2", got, content)
+        }
+    }
+
+    // The watcher must still pick up a valid change after the failed ones.
+    writeFile(t, file, "LIMITER_RPS=7\nLIMITER_BURST=4\nLIMITER_ENABLED=true\n")
+
+    select {
+    case c := <-applied:
+        if c.LimiterRps != 7 {
+            t.Errorf("got LimiterRps %v applied; want 7", c.LimiterRps)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("valid config wasn't applied")
+    }
+
+    if got := w.Config().LimiterRps; got != 7 {
+        t.Errorf("got LimiterRps %v; want 7", got)
+    }
+}
+
+func TestWatcherDebounce(t *testing.T) {
+    w, file := newTestWatcher(t, validDynamic)
+
+    applied := make(chan *Config, 10)
+
+    err := w.Start(func(c *Config) { applied <- c })
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer w.Stop()
+
+    for i := range 5 {
+        writeFile(t, file, "LIMITER_RPS="+string(rune('3'+i))+"\nLIMITER_BURST=4\nLIMITER_ENABLED=true\n")
+    }
+
+    select {
+    case c := <-applied:
+        if c.LimiterRps != 7 {
+            t.Errorf("got LimiterRps %v applied; want 7", c.LimiterRps)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatal("config wasn't applied")
+    }
+
+    select {
+    case c := <-applied:
+        t.Errorf("config applied more than once for a burst of writes: %+v", c)
+    case <-time.After(200 * time.Millisecond):
+    }
+}
@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"time"
+)
+
+// Audit event types.
+const (
+    AuditLoginSucceeded      = "login_succeeded"
+    AuditLoginFailed         = "login_failed"
+    AuditUserActivated       = "user_activated"
+    AuditPasswordChanged     = "password_changed"
+    AuditPasswordResetForced = "password_reset_forced"
+    AuditPasswordReset       = "password_reset"
+    AuditInvalidToken        = "invalid_token"
+    AuditPermissionDenied    = "permission_denied"
+)
+
+// AuditEvent records a security relevant event. It must never hold a password or a token.
+type AuditEvent struct {
+    ID        int64     `json:"id" xml:"id"`
+    CreatedAt time.Time `json:"created_at" xml:"created_at"`
+    Event     string    `json:"event" xml:"event"`
+    UserID    int64     `json:"user_id,omitempty" xml:"user_id,omitempty"` // zero if the user isn't known
+    Email     string    `json:"email" xml:"email"`                         // the email of the user, or the one given in a failed login
+    IP        string    `json:"ip" xml:"ip"`
+    Method    string    `json:"method" xml:"method"`
+    Path      string    `json:"path" xml:"path"`
+    Detail    string    `json:"detail,omitempty" xml:"detail,omitempty"`
+}
+
+// AuditStore describes the operations on the audit log used by the handlers.
+type AuditStore interface {
+    Insert(ctx context.Context, event *AuditEvent) error
+    ForEachForUser(ctx context.Context, userID int64, fn func(event *AuditEvent) error) error
+}
+
+// AuditModel struct wraps a database connection pool wrapper.
+type AuditModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// Insert inserts a new record in the audit_log table.
+func (m AuditModel) Insert(ctx context.Context, event *AuditEvent) error {
+    query := `INSERT INTO audit_log (event, user_id, email, ip, method, path, detail) 
+              VALUES ($1, NULLIF($2::bigint, 0), $3, $4, $5, $6, $7) 
+              RETURNING id, created_at`
+
+    args := []any{event.Event, event.UserID, event.Email, event.IP, event.Method, event.Path, event.Detail}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    return m.DB.Pool().QueryRow(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// ForEachForUser calls fn for each audit event of a user, oldest first, as the rows are scanned.
+// Like MovieModel.ForEach, the query has no timeout of its own and runs until ctx is cancelled.
+// If fn returns an error, iteration stops and the error is returned.
+func (m AuditModel) ForEachForUser(ctx context.Context, userID int64, fn func(event *AuditEvent) error) error {
+    query := `SELECT id, created_at, event, COALESCE(user_id, 0), email, ip, method, path, detail 
+              FROM audit_log 
+              WHERE user_id = $1 
+              ORDER BY created_at ASC, id ASC`
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, userID)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var event AuditEvent
+
+        err := rows.Scan(
+            &event.ID,
+            &event.CreatedAt,
+            &event.Event,
+            &event.UserID,
+            &event.Email,
+            &event.IP,
+            &event.Method,
+            &event.Path,
+            &event.Detail,
+        )
+        if err != nil {
+            return err
+        }
+
+        err = fn(&event)
+        if err != nil {
+            return err
+        }
+    }
+
+    return rows.Err()
+}
@@ -0,0 +1,289 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrDatabaseUnavailable is returned, as a *BreakerOpenError, by the queries which weren't sent
+// because the circuit breaker of the pool is open.
+var ErrDatabaseUnavailable = errors.New("database unavailable")
+
+// BreakerOpenError is returned by the queries which fail fast while the circuit breaker is open.
+// It matches ErrDatabaseUnavailable with errors.Is.
+type BreakerOpenError struct {
+    RetryAfter time.Duration // until the breaker probes the database again
+}
+
+func (e *BreakerOpenError) Error() string {
+    return fmt.Sprintf("database unavailable: circuit breaker open, retry after %v", e.RetryAfter)
+}
+
+func (e *BreakerOpenError) Unwrap() error {
+    return ErrDatabaseUnavailable
+}
+
+// BreakerState is the state of a Breaker.
+type BreakerState int32
+
+const (
+    BreakerClosed   BreakerState = iota // queries are sent
+    BreakerOpen                         // queries fail fast until the cooldown has passed
+    BreakerHalfOpen                     // queries fail fast while a ping probes the database
+)
+
+func (s BreakerState) String() string {
+    switch s {
+    case BreakerClosed:
+        return "closed"
+    case BreakerOpen:
+        return "open"
+    case BreakerHalfOpen:
+        return "half-open"
+    default:
+        return fmt.Sprintf("BreakerState(%d)", int32(s))
+    }
+}
+
+// MarshalText encodes the state as its name, e.g. in the "database" expvar.
+func (s BreakerState) MarshalText() ([]byte, error) {
+    return []byte(s.String()), nil
+}
+
+// Breaker is a circuit breaker in front of a pool. After Threshold consecutive connection
+// failures it opens: the pool stops connecting and the queries fail fast with a
+// *BreakerOpenError instead of each waiting out its timeout. Once Cooldown has passed it's half
+// open and Probe, a ping, is run in the background; the breaker closes if it succeeds and opens
+// for another cooldown otherwise.
+type Breaker struct {
+    Threshold int                             // consecutive connection failures opening the breaker
+    Cooldown  time.Duration                   // how long the breaker stays open before a probe
+    Probe     func(ctx context.Context) error // pings the database, e.g. PoolWrapper.CheckHealth
+
+    // OnStateChange, if not nil, is called after each transition with the previous state and,
+    // on opening, the failures which opened the breaker, e.g. to log it. It's called one at a
+    // time, without the breaker locked.
+    OnStateChange func(from, to BreakerState, failures int)
+
+    mu       sync.Mutex
+    notify   sync.Mutex // serializes the OnStateChange calls
+    state    BreakerState
+    failures int              // consecutive connection failures while closed
+    openedAt time.Time        // when the breaker last opened
+    opens    int64            // times the breaker opened, for the stats
+    now      func() time.Time // time.Now if nil, replaced by the tests
+}
+
+// BreakerStats is a snapshot of a Breaker, published with the pool statistics.
+type BreakerStats struct {
+    State    BreakerState `json:"state"`
+    Failures int          `json:"consecutive_failures"`
+    Opens    int64        `json:"opens"` // times the breaker opened since the start
+}
+
+// NewBreaker returns a closed breaker.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+    return &Breaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+func (b *Breaker) clock() time.Time {
+    if b.now != nil {
+        return b.now()
+    }
+
+    return time.Now()
+}
+
+// State returns the current state.
+func (b *Breaker) State() BreakerState {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return b.state
+}
+
+// Stats returns a snapshot of the breaker.
+func (b *Breaker) Stats() BreakerStats {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    return BreakerStats{State: b.state, Failures: b.failures, Opens: b.opens}
+}
+
+// probeContextKey is the key of the context value marking the probe's ping.
+type probeContextKey struct{}
+
+// Allow returns nil if a query with ctx may use the database, and a *BreakerOpenError
+// otherwise. The first call after the cooldown starts the probe. The probe's own ping is always
+// allowed.
+func (b *Breaker) Allow(ctx context.Context) error {
+    if probe, _ := ctx.Value(probeContextKey{}).(bool); probe {
+        return nil
+    }
+
+    b.mu.Lock()
+
+    switch b.state {
+    case BreakerClosed:
+        b.mu.Unlock()
+        return nil
+    case BreakerOpen:
+        remaining := b.Cooldown - b.clock().Sub(b.openedAt)
+        if remaining > 0 {
+            b.mu.Unlock()
+            return &BreakerOpenError{RetryAfter: remaining}
+        }
+
+        b.state = BreakerHalfOpen
+        b.mu.Unlock()
+
+        b.changed(BreakerOpen, BreakerHalfOpen, 0)
+        go b.probe()
+    default:
+        b.mu.Unlock()
+    }
+
+    // The probe takes at most a second, see probe.
+    return &BreakerOpenError{RetryAfter: time.Second}
+}
+
+// probe pings the database in the half-open state, closing the breaker if it succeeds and
+// opening it again otherwise.
+func (b *Breaker) probe() {
+    err := errors.New("no probe")
+
+    if b.Probe != nil {
+        ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeContextKey{}, true), time.Second)
+        err = b.Probe(ctx)
+        cancel()
+    }
+
+    b.mu.Lock()
+    to := BreakerClosed
+    if err != nil {
+        to = BreakerOpen
+        b.openedAt = b.clock()
+        b.opens++
+    }
+    b.state = to
+    b.failures = 0
+    b.mu.Unlock()
+
+    b.changed(BreakerHalfOpen, to, 0)
+}
+
+// reset closes the breaker, e.g. once a new pool has connected.
+func (b *Breaker) reset() {
+    b.mu.Lock()
+    from := b.state
+    b.state = BreakerClosed
+    b.failures = 0
+    b.mu.Unlock()
+
+    if from != BreakerClosed {
+        b.changed(from, BreakerClosed, 0)
+    }
+}
+
+// Record counts the outcome of a connection attempt or a query: a connection failure towards
+// Threshold, while any other outcome, in which the database answered, resets the count.
+func (b *Breaker) Record(err error) {
+    b.mu.Lock()
+
+    if b.state != BreakerClosed {
+        b.mu.Unlock()
+        return
+    }
+
+    if !isConnectionError(err) {
+        b.failures = 0
+        b.mu.Unlock()
+        return
+    }
+
+    b.failures++
+    failures := b.failures
+    if b.Threshold <= 0 || failures < b.Threshold {
+        b.mu.Unlock()
+        return
+    }
+
+    b.state = BreakerOpen
+    b.openedAt = b.clock()
+    b.opens++
+    b.failures = 0
+    b.mu.Unlock()
+
+    b.changed(BreakerClosed, BreakerOpen, failures)
+}
+
+func (b *Breaker) changed(from, to BreakerState, failures int) {
+    if b.OnStateChange == nil {
+        return
+    }
+
+    b.notify.Lock()
+    defer b.notify.Unlock()
+
+    b.OnStateChange(from, to, failures)
+}
+
+// isConnectionError reports whether err means that the database couldn't be reached, as opposed
+// to an error the database answered with. Query timeouts aren't counted: a slow query times out
+// on a healthy database too.
+func isConnectionError(err error) bool {
+    if err == nil || errors.Is(err, ErrDatabaseUnavailable) {
+        return false
+    }
+
+    var connectErr *pgconn.ConnectError
+    if errors.As(err, &connectErr) {
+        return true
+    }
+
+    var netErr net.Error
+    if errors.As(err, &netErr) && !netErr.Timeout() {
+        return true
+    }
+
+    return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// breakerTracer records the outcomes of the connections and queries of a pool in its breaker,
+// and passes the queries on to the QueryTracer of the pool, if any.
+type breakerTracer struct {
+    breaker *Breaker
+    next    pgx.QueryTracer
+}
+
+func (t breakerTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+    if t.next == nil {
+        return ctx
+    }
+
+    return t.next.TraceQueryStart(ctx, conn, data)
+}
+
+func (t breakerTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+    t.breaker.Record(data.Err)
+
+    if t.next != nil {
+        t.next.TraceQueryEnd(ctx, conn, data)
+    }
+}
+
+func (t breakerTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+    return ctx
+}
+
+func (t breakerTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+    t.breaker.Record(data.Err)
+}
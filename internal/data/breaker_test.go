@@ -0,0 +1,98 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestBreaker(t *testing.T) {
+    now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+    refused := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+    var (
+        mu       sync.Mutex
+        probeErr error
+    )
+    transitions := make(chan string, 10)
+
+    b := NewBreaker(3, 10*time.Second)
+    b.now = func() time.Time { return now }
+    b.Probe = func(ctx context.Context) error {
+        mu.Lock()
+        defer mu.Unlock()
+        return probeErr
+    }
+    b.OnStateChange = func(from, to BreakerState, failures int) {
+        transitions <- fmt.Sprintf("%s->%s", from, to)
+    }
+
+    expect := func(t *testing.T, want string) {
+        t.Helper()
+
+        select {
+        case got := <-transitions:
+            if got != want {
+                t.Fatalf("got transition %s; want %s", got, want)
+            }
+        case <-time.After(time.Second):
+            t.Fatalf("got no transition; want %s", want)
+        }
+    }
+
+    // An answer of the database, even an error, resets the count.
+    b.Record(refused)
+    b.Record(refused)
+    b.Record(&pgconn.PgError{Code: "42601"})
+    b.Record(refused)
+    b.Record(fmt.Errorf("select: %w", context.DeadlineExceeded))
+    b.Record(refused)
+    b.Record(refused)
+    if b.State() != BreakerClosed {
+        t.Fatalf("got state %s after 2 consecutive failures; want closed", b.State())
+    }
+
+    b.Record(fmt.Errorf("acquire: %w", refused))
+    expect(t, "closed->open")
+
+    err := b.Allow(context.Background())
+    var openErr *BreakerOpenError
+    if !errors.As(err, &openErr) || openErr.RetryAfter != 10*time.Second || !errors.Is(err, ErrDatabaseUnavailable) {
+        t.Fatalf("got %v while open; want a BreakerOpenError with RetryAfter 10s", err)
+    }
+
+    // A failed probe opens the breaker for another cooldown.
+    mu.Lock()
+    probeErr = refused
+    mu.Unlock()
+    now = now.Add(10 * time.Second)
+
+    if err := b.Allow(context.Background()); !errors.Is(err, ErrDatabaseUnavailable) {
+        t.Fatalf("got %v starting the probe; want ErrDatabaseUnavailable", err)
+    }
+    expect(t, "open->half-open")
+    expect(t, "half-open->open")
+
+    mu.Lock()
+    probeErr = nil
+    mu.Unlock()
+    now = now.Add(10 * time.Second)
+
+    b.Allow(context.Background())
+    expect(t, "open->half-open")
+    expect(t, "half-open->closed")
+
+    if err := b.Allow(context.Background()); err != nil {
+        t.Errorf("got %v once closed; want nil", err)
+    }
+
+    if stats := b.Stats(); stats.State != BreakerClosed || stats.Opens != 2 {
+        t.Errorf("got stats %+v; want closed after 2 opens", stats)
+    }
+}
@@ -3,41 +3,279 @@ package data
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-// PoolWrapper wraps a *pgxpool.Pool.
+// defaultPoolDrainDelay is how long a replaced pool stays open so that requests which loaded it
+// just before the swap can still acquire connections from it.
+const defaultPoolDrainDelay = 5 * time.Second
+
+// PoolWrapper wraps a *pgxpool.Pool. The pool is held in an atomic pointer so that it can be
+// swapped on DB config reload while requests are in flight; always read it through Pool(), or
+// ReadPool() for queries which may go to the read replica.
 type PoolWrapper struct {
-    Pool *pgxpool.Pool `json:"-"`
-    Stat struct {
-        PoolSerialNumber        int32         `json:"pool_serial_number"`      // serial number of the pool in use
-        AcquireCount            int64         `json:"AcquireCount"`            // cumulative count of successful acquires from the pool
-        AcquireDuration         time.Duration `json:"AcquireDuration"`         // total duration of all successful acquires from the pool
-        AcquiredConns           int32         `json:"AcquiredConns"`           // number of currently acquired connections in the pool
-        CanceledAcquireCount    int64         `json:"CanceledAcquireCount"`    // cumulative count of acquires from the pool that were canceled by a context
-        EmptyAcquireCount       int64         `json:"EmptyAcquireCount"`       // cumulative count of successful acquires from the pool that waited for a resource to be released or constructed because the pool was empty
-        IdleConns               int32         `json:"IdleConns"`               // number of currently idle conns in the pool
-        MaxConns                int32         `json:"MaxConns"`                // maximum size of the pool
-        TotalConns              int32         `json:"TotalConns"`              // total number of resources currently in the pool, the sum of ConstructingConns, AcquiredConns, and IdleConns
-        NewConnsCount           int64         `json:"NewConnsCount"`           // cumulative count of new connections opened
-        MaxLifetimeDestroyCount int64         `json:"MaxLifetimeDestroyCount"` // cumulative count of connections destroyed because they exceeded MaxConnLifetime
-        MaxIdleDestroyCount     int64         `json:"MaxIdleDestroyCount"`     // cumulative count of connections destroyed because they exceeded MaxConnIdleTime
-    }
-}
-
-// Implement the MarshalJSON method on PoolWrapper struct so that it satisfies the jons.Marshaler interface.
+    pool   atomic.Pointer[pgxpool.Pool]
+    Tracer *QueryTracer `json:"-"` // attached to every pool created by CreatePool if not nil
+
+    // Replica, if not nil, wraps the pool of a read-only replica of the database, which has no
+    // pool while no replica is configured. Its pool is closed with this one.
+    Replica *PoolWrapper `json:"-"`
+
+    // Breaker, if not nil, makes the queries fail fast with ErrDatabaseUnavailable while the
+    // database can't be reached. It's attached to every pool created by CreatePool.
+    Breaker *Breaker `json:"-"`
+
+    unhealthy atomic.Bool // whether the last CheckHealth failed, cleared by CreatePool
+
+    mu     sync.Mutex // guards swapping the pool together with serial and config
+    serial int32      // serial number of the pool in use, incremented each time it is replaced
+    config PoolConfig // configuration of the pool in use
+
+    drainDelay time.Duration  // defaultPoolDrainDelay if zero
+    draining   sync.WaitGroup // tracks replaced pools which have not been closed yet
+}
+
+// PoolConfig configures a pool created by CreatePool. ConnString holds the server, the
+// credentials and the other connection settings. Each other field overrides the setting parsed
+// from ConnString, or pgxpool's default, unless it is zero.
+type PoolConfig struct {
+    ConnString            string
+    MaxConns              int32
+    MinConns              int32
+    MaxConnLifetime       time.Duration
+    MaxConnLifetimeJitter time.Duration
+    MaxConnIdleTime       time.Duration
+    HealthCheckPeriod     time.Duration
+}
+
+// parse returns the pgxpool configuration of pc: ConnString parsed with pgxpool.ParseConfig,
+// then overridden field by field. It reports the values pgxpool can't work with.
+func (pc PoolConfig) parse() (*pgxpool.Config, error) {
+    poolConfig, err := pgxpool.ParseConfig(pc.ConnString)
+    if err != nil {
+        return nil, err
+    }
+
+    if pc.MaxConns != 0 {
+        poolConfig.MaxConns = pc.MaxConns
+    }
+    if pc.MinConns != 0 {
+        poolConfig.MinConns = pc.MinConns
+    }
+    if pc.MaxConnLifetime != 0 {
+        poolConfig.MaxConnLifetime = pc.MaxConnLifetime
+    }
+    if pc.MaxConnLifetimeJitter != 0 {
+        poolConfig.MaxConnLifetimeJitter = pc.MaxConnLifetimeJitter
+    }
+    if pc.MaxConnIdleTime != 0 {
+        poolConfig.MaxConnIdleTime = pc.MaxConnIdleTime
+    }
+    if pc.HealthCheckPeriod != 0 {
+        poolConfig.HealthCheckPeriod = pc.HealthCheckPeriod
+    }
+
+    switch {
+    case poolConfig.MaxConns < 1:
+        return nil, errors.New("pool: max conns must be at least 1")
+    case poolConfig.MinConns < 0 || poolConfig.MinConns > poolConfig.MaxConns:
+        return nil, errors.New("pool: min conns must be between 0 and max conns")
+    case poolConfig.MaxConnLifetime < 0 || poolConfig.MaxConnLifetimeJitter < 0 || poolConfig.MaxConnIdleTime < 0:
+        return nil, errors.New("pool: durations must not be negative")
+    case poolConfig.HealthCheckPeriod <= 0:
+        return nil, errors.New("pool: health check period must be greater than 0")
+    }
+
+    return poolConfig, nil
+}
+
+// PoolStats is a snapshot of the statistics of the pool in use.
+type PoolStats struct {
+    PoolSerialNumber        int32         `json:"pool_serial_number"`      // serial number of the pool in use
+    AcquireCount            int64         `json:"AcquireCount"`            // cumulative count of successful acquires from the pool
+    AcquireDuration         time.Duration `json:"AcquireDuration"`         // total duration of all successful acquires from the pool
+    AcquiredConns           int32         `json:"AcquiredConns"`           // number of currently acquired connections in the pool
+    CanceledAcquireCount    int64         `json:"CanceledAcquireCount"`    // cumulative count of acquires from the pool that were canceled by a context
+    ConstructingConns       int32         `json:"ConstructingConns"`       // number of conns with construction in progress in the pool
+    EmptyAcquireCount       int64         `json:"EmptyAcquireCount"`       // cumulative count of successful acquires from the pool that waited for a resource to be released or constructed because the pool was empty
+    IdleConns               int32         `json:"IdleConns"`               // number of currently idle conns in the pool
+    MaxConns                int32         `json:"MaxConns"`                // maximum size of the pool
+    TotalConns              int32         `json:"TotalConns"`              // total number of resources currently in the pool, the sum of ConstructingConns, AcquiredConns, and IdleConns
+    NewConnsCount           int64         `json:"NewConnsCount"`           // cumulative count of new connections opened
+    MaxLifetimeDestroyCount int64         `json:"MaxLifetimeDestroyCount"` // cumulative count of connections destroyed because they exceeded MaxConnLifetime
+    MaxIdleDestroyCount     int64         `json:"MaxIdleDestroyCount"`     // cumulative count of connections destroyed because they exceeded MaxConnIdleTime
+    MaxConnLifetime         time.Duration `json:"MaxConnLifetime"`         // configured duration after which a connection is closed
+    MaxConnIdleTime         time.Duration `json:"MaxConnIdleTime"`         // configured duration after which an idle connection is closed
+    MaxConnLifetimeJitter   time.Duration `json:"MaxConnLifetimeJitter"`   // configured upper bound of the random duration added to MaxConnLifetime
+    MinConns                int32         `json:"MinConns"`                // configured number of connections kept open
+    HealthCheckPeriod       time.Duration `json:"HealthCheckPeriod"`       // configured interval between the health checks of idle connections
+    Healthy                 bool          `json:"healthy"`                 // whether there is a pool and the last CheckHealth succeeded
+    Breaker                 *BreakerStats `json:"circuit_breaker,omitempty"` // state of the circuit breaker, if there is one
+    Replica                 *PoolStats    `json:"replica,omitempty"`       // statistics of the pool of the read replica, if one is wrapped
+}
+
+// Snapshot returns the statistics of the pool in use, and of the replica's, read at the time of
+// the call. It returns zero statistics if there is no pool.
+func (pw *PoolWrapper) Snapshot() PoolStats {
+    pw.mu.Lock()
+    p := pw.pool.Load()
+    stats := PoolStats{PoolSerialNumber: pw.serial}
+    pw.mu.Unlock()
+
+    if pw.Replica != nil {
+        replica := pw.Replica.Snapshot()
+        stats.Replica = &replica
+    }
+
+    if pw.Breaker != nil {
+        breaker := pw.Breaker.Stats()
+        stats.Breaker = &breaker
+    }
+
+    if p == nil {
+        return stats
+    }
+
+    stats.Healthy = !pw.unhealthy.Load()
+
+    s := p.Stat()
+
+    stats.AcquireCount = s.AcquireCount()
+    stats.AcquireDuration = s.AcquireDuration()
+    stats.AcquiredConns = s.AcquiredConns()
+    stats.CanceledAcquireCount = s.CanceledAcquireCount()
+    stats.ConstructingConns = s.ConstructingConns()
+    stats.EmptyAcquireCount = s.EmptyAcquireCount()
+    stats.IdleConns = s.IdleConns()
+    stats.MaxConns = s.MaxConns()
+    stats.TotalConns = s.TotalConns()
+    stats.NewConnsCount = s.NewConnsCount()
+    stats.MaxLifetimeDestroyCount = s.MaxLifetimeDestroyCount()
+    stats.MaxIdleDestroyCount = s.MaxIdleDestroyCount()
+
+    // The effective settings, after CreatePool applied its PoolConfig.
+    poolConfig := p.Config()
+    stats.MaxConnLifetime = poolConfig.MaxConnLifetime
+    stats.MaxConnIdleTime = poolConfig.MaxConnIdleTime
+    stats.MaxConnLifetimeJitter = poolConfig.MaxConnLifetimeJitter
+    stats.MinConns = poolConfig.MinConns
+    stats.HealthCheckPeriod = poolConfig.HealthCheckPeriod
+
+    return stats
+}
+
+// Implement the MarshalJSON method on PoolWrapper struct so that it satisfies the jons.Marshaler
+// interface. The statistics are read when marshalling, so the "database" expvar is always current.
 func (pw *PoolWrapper) MarshalJSON() ([]byte, error) {
-    return json.Marshal(pw.Stat)
+    return json.Marshal(pw.Snapshot())
+}
+
+// Pool returns the pool currently in use.
+func (pw *PoolWrapper) Pool() *pgxpool.Pool {
+    return pw.pool.Load()
+}
+
+// ReadPool returns the pool for a query which may read from the replica: the replica's pool
+// while it has one which passed its last health check, and otherwise the pool in use. With a
+// context from UsePrimary it returns the pool in use.
+func (pw *PoolWrapper) ReadPool(ctx context.Context) *pgxpool.Pool {
+    replica := pw.Replica
+    if replica == nil || replica.unhealthy.Load() || usesPrimary(ctx) {
+        return pw.Pool()
+    }
+
+    if p := replica.Pool(); p != nil {
+        return p
+    }
+
+    return pw.Pool()
+}
+
+// primaryContextKey is the key of the context value set by UsePrimary.
+type primaryContextKey struct{}
+
+// UsePrimary returns a copy of ctx with which ReadPool returns the primary's pool, so that the
+// reads see the latest writes, which may not have reached the replica yet.
+func UsePrimary(ctx context.Context) context.Context {
+    return context.WithValue(ctx, primaryContextKey{}, true)
+}
+
+func usesPrimary(ctx context.Context) bool {
+    primary, _ := ctx.Value(primaryContextKey{}).(bool)
+    return primary
 }
 
-// CreatePool creates a *pgxpool.Pool and assigns it to the wrapper's Pool field.
-func (pw *PoolWrapper) CreatePool(connString string) error {
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// CheckHealth pings the pool in use and records the result: ReadPool doesn't use a replica which
+// failed its last check. It's an error not to have a pool.
+func (pw *PoolWrapper) CheckHealth(ctx context.Context) error {
+    p := pw.Pool()
+    if p == nil {
+        return errors.New("not connected")
+    }
+
+    err := p.Ping(ctx)
+    pw.unhealthy.Store(err != nil)
+
+    return err
+}
+
+// Healthy reports whether there is a pool and the last CheckHealth succeeded.
+func (pw *PoolWrapper) Healthy() bool {
+    return pw.Pool() != nil && !pw.unhealthy.Load()
+}
+
+// Config returns the PoolConfig of the pool in use, so that a reload can tell whether the pool
+// needs to be recreated.
+func (pw *PoolWrapper) Config() PoolConfig {
+    pw.mu.Lock()
+    defer pw.mu.Unlock()
+
+    return pw.config
+}
+
+// CreatePool creates a *pgxpool.Pool configured by pc, checks that it can connect, and swaps it
+// in as the pool in use. If a pool was already in use, it is closed in the background once the
+// drain delay has passed and its acquired connections have been released. If the new pool cannot
+// be created the pool in use is left untouched.
+func (pw *PoolWrapper) CreatePool(pc PoolConfig) error {
+    // The breaker doesn't stop the connection check, which closes it when it succeeds, e.g.
+    // after a DB config reload fixing the credentials.
+    ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probeContextKey{}, true), 5*time.Second)
     defer cancel()
 
-    p, err := pgxpool.New(ctx, connString)
+    poolConfig, err := pc.parse()
+    if err != nil {
+        return err
+    }
+
+    if pw.Tracer != nil {
+        poolConfig.ConnConfig.Tracer = pw.Tracer
+    }
+
+    // While the breaker is open, the idle connections are dropped and no new ones are made, so
+    // that acquiring a connection fails at once.
+    if b := pw.Breaker; b != nil {
+        tracer := breakerTracer{breaker: b}
+        if pw.Tracer != nil {
+            tracer.next = pw.Tracer
+        }
+        poolConfig.ConnConfig.Tracer = tracer
+
+        poolConfig.BeforeConnect = func(ctx context.Context, _ *pgx.ConnConfig) error {
+            return b.Allow(ctx)
+        }
+        poolConfig.BeforeAcquire = func(ctx context.Context, _ *pgx.Conn) bool {
+            return b.Allow(ctx) == nil
+        }
+    }
+
+    p, err := pgxpool.NewWithConfig(ctx, poolConfig)
     if err != nil {
         return err
     }
@@ -48,19 +286,97 @@ func (pw *PoolWrapper) CreatePool(connString string) error {
         return err
     }
 
-    pw.Pool = p
-    pw.Stat.PoolSerialNumber = pw.Stat.PoolSerialNumber + 1
-    pw.Stat.AcquireCount = p.Stat().AcquireCount()
-    pw.Stat.AcquireDuration = p.Stat().AcquireDuration()
-    pw.Stat.AcquiredConns = p.Stat().AcquiredConns()
-    pw.Stat.CanceledAcquireCount = p.Stat().CanceledAcquireCount()
-    pw.Stat.EmptyAcquireCount = p.Stat().EmptyAcquireCount()
-    pw.Stat.IdleConns = p.Stat().IdleConns()
-    pw.Stat.MaxConns = p.Stat().MaxConns()
-    pw.Stat.TotalConns = p.Stat().TotalConns()
-    pw.Stat.NewConnsCount = p.Stat().NewConnsCount()
-    pw.Stat.MaxLifetimeDestroyCount = p.Stat().MaxLifetimeDestroyCount()
-    pw.Stat.MaxIdleDestroyCount = p.Stat().MaxIdleDestroyCount()
+    pw.mu.Lock()
+    old := pw.pool.Swap(p)
+    pw.serial++
+    pw.config = pc
+    pw.unhealthy.Store(false)
+    pw.mu.Unlock()
+
+    if pw.Breaker != nil {
+        pw.Breaker.reset()
+    }
+
+    if old != nil {
+        pw.retire(old)
+    }
 
     return nil
 }
+
+// CreatePoolWithRetry calls CreatePool until it succeeds or timeout has passed, so that the
+// application can be started before the database accepts connections. The attempts are spaced
+// with exponential backoff, from half a second up to 10 seconds, and onRetry, if not nil, is
+// called after each failed attempt with the attempt number, the error and the wait before the
+// next attempt. An invalid pc isn't retried. With a timeout of zero, CreatePool is called once.
+func (pw *PoolWrapper) CreatePoolWithRetry(ctx context.Context, pc PoolConfig, timeout time.Duration, onRetry func(attempt int, err error, wait time.Duration)) error {
+    _, err := pc.parse()
+    if err != nil {
+        return err
+    }
+
+    deadline := time.Now().Add(timeout)
+    wait := 500 * time.Millisecond
+
+    for attempt := 1; ; attempt++ {
+        err := pw.CreatePool(pc)
+        if err == nil {
+            return nil
+        }
+
+        remaining := time.Until(deadline)
+        if remaining <= 0 {
+            return err
+        }
+
+        sleep := min(wait, remaining)
+        if onRetry != nil {
+            onRetry(attempt, err, sleep)
+        }
+
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(sleep):
+        }
+
+        wait = min(2*wait, 10*time.Second)
+    }
+}
+
+// retire closes a replaced pool after the drain delay. pgxpool.Pool.Close() blocks until all
+// acquired connections have been returned, so in-flight queries are allowed to finish.
+func (pw *PoolWrapper) retire(p *pgxpool.Pool) {
+    delay := pw.drainDelay
+    if delay == 0 {
+        delay = defaultPoolDrainDelay
+    }
+
+    pw.draining.Add(1)
+
+    go func() {
+        defer pw.draining.Done()
+
+        time.Sleep(delay)
+        p.Close()
+    }()
+}
+
+// Close closes the pool in use, and the replica's, and waits for any replaced pools to be
+// closed. The wrapper can be given a new pool with CreatePool afterwards.
+func (pw *PoolWrapper) Close() {
+    if pw.Replica != nil {
+        pw.Replica.Close()
+    }
+
+    pw.mu.Lock()
+    p := pw.pool.Swap(nil)
+    pw.config = PoolConfig{}
+    pw.mu.Unlock()
+
+    if p != nil {
+        p.Close()
+    }
+
+    pw.draining.Wait()
+}
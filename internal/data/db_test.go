@@ -0,0 +1,341 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testDSN returns the connection string of a test database, skipping the test if none is set.
+func testDSN(t *testing.T) string {
+    t.Helper()
+
+    dsn := os.Getenv("GREENLIGHT_TEST_DB_DSN")
+    if dsn == "" {
+        t.Skip("GREENLIGHT_TEST_DB_DSN not set")
+    }
+
+    return dsn
+}
+
+func TestCreatePoolFailureKeepsOldPool(t *testing.T) {
+    // pgxpool.New doesn't connect, so this gives us a pool without a running database.
+    old, err := pgxpool.New(context.Background(), "postgres://u:p@127.0.0.1:1/db")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var pw PoolWrapper
+    pw.pool.Store(old)
+    defer pw.Close()
+
+    err = pw.CreatePool(PoolConfig{ConnString: "postgres://u:p@127.0.0.1:1/db?connect_timeout=1"})
+    if err == nil {
+        t.Fatal("expected CreatePool to fail")
+    }
+
+    if pw.Pool() != old {
+        t.Fatal("pool was replaced despite the failure")
+    }
+
+    err = pw.CreatePool(PoolConfig{ConnString: "not a connection string"})
+    if err == nil || pw.Pool() != old {
+        t.Fatal("pool was replaced with an unparseable connection string")
+    }
+}
+
+func TestCreatePoolSwapUnderLoad(t *testing.T) {
+    dsn := testDSN(t)
+
+    pw := PoolWrapper{drainDelay: 100 * time.Millisecond}
+    defer pw.Close()
+
+    err := pw.CreatePool(PoolConfig{ConnString: dsn})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var (
+        wg       sync.WaitGroup
+        stop     atomic.Bool
+        failures atomic.Int64
+        queries  atomic.Int64
+    )
+
+    for range 8 {
+        wg.Add(1)
+        go func() {
+            defer wg.Done()
+
+            for !stop.Load() {
+                var n int
+                err := pw.Pool().QueryRow(context.Background(), "SELECT 1").Scan(&n)
+                if err != nil {
+                    failures.Add(1)
+                    t.Log(err)
+                }
+                queries.Add(1)
+            }
+        }()
+    }
+
+    for range 10 {
+        time.Sleep(20 * time.Millisecond)
+
+        err := pw.CreatePool(PoolConfig{ConnString: dsn})
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    stop.Store(true)
+    wg.Wait()
+
+    if failures.Load() > 0 {
+        t.Fatalf("%d of %d queries failed while swapping pools", failures.Load(), queries.Load())
+    }
+    if pw.Snapshot().PoolSerialNumber != 11 {
+        t.Errorf("got pool serial number %d; want 11", pw.Snapshot().PoolSerialNumber)
+    }
+}
+
+func TestSnapshotWithoutDatabase(t *testing.T) {
+    var pw PoolWrapper
+
+    if stats := pw.Snapshot(); stats != (PoolStats{}) {
+        t.Fatalf("got %+v without a pool; want zero statistics", stats)
+    }
+
+    p, err := pgxpool.New(context.Background(), "postgres://u:p@127.0.0.1:1/db?pool_max_conns=7&pool_max_conn_idle_time=3m")
+    if err != nil {
+        t.Fatal(err)
+    }
+    pw.pool.Store(p)
+    defer pw.Close()
+
+    stats := pw.Snapshot()
+    if stats.MaxConns != 7 || stats.MaxConnIdleTime != 3*time.Minute {
+        t.Errorf("got MaxConns %d and MaxConnIdleTime %v; want 7 and 3m", stats.MaxConns, stats.MaxConnIdleTime)
+    }
+}
+
+func TestPoolConfigParse(t *testing.T) {
+    const connString = "postgres://u:p@127.0.0.1:1/db?pool_max_conns=7&pool_max_conn_lifetime=2h"
+
+    tests := []struct {
+        name    string
+        pc      PoolConfig
+        wantErr bool
+        check   func(c *pgxpool.Config) bool
+    }{
+        {"connection string", PoolConfig{ConnString: connString}, false, func(c *pgxpool.Config) bool {
+            return c.MaxConns == 7 && c.MaxConnLifetime == 2*time.Hour && c.HealthCheckPeriod == time.Minute
+        }},
+        {"overridden", PoolConfig{
+            ConnString:            connString,
+            MaxConns:              20,
+            MinConns:              2,
+            MaxConnLifetime:       30 * time.Minute,
+            MaxConnLifetimeJitter: time.Minute,
+            MaxConnIdleTime:       5 * time.Minute,
+            HealthCheckPeriod:     10 * time.Second,
+        }, false, func(c *pgxpool.Config) bool {
+            return c.MaxConns == 20 && c.MinConns == 2 && c.MaxConnLifetime == 30*time.Minute &&
+                c.MaxConnLifetimeJitter == time.Minute && c.MaxConnIdleTime == 5*time.Minute && c.HealthCheckPeriod == 10*time.Second
+        }},
+        {"min conns above max conns", PoolConfig{ConnString: connString, MinConns: 8}, true, nil},
+        {"negative max conns", PoolConfig{ConnString: connString, MaxConns: -1}, true, nil},
+        {"negative jitter", PoolConfig{ConnString: connString, MaxConnLifetimeJitter: -time.Second}, true, nil},
+        {"negative health check period", PoolConfig{ConnString: connString, HealthCheckPeriod: -time.Second}, true, nil},
+        {"bad connection string", PoolConfig{ConnString: "not a connection string"}, true, nil},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            c, err := tt.pc.parse()
+            if (err != nil) != tt.wantErr {
+                t.Fatalf("got error %v; want error %t", err, tt.wantErr)
+            }
+            if err == nil && !tt.check(c) {
+                t.Errorf("got %+v", c)
+            }
+        })
+    }
+}
+
+func TestSnapshotEffectiveSettings(t *testing.T) {
+    pc := PoolConfig{
+        ConnString:            "postgres://u:p@127.0.0.1:1/db",
+        MaxConnLifetimeJitter: time.Minute,
+        HealthCheckPeriod:     10 * time.Second,
+    }
+
+    poolConfig, err := pc.parse()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // Without MinConns, pgxpool doesn't connect until the pool is used.
+    p, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var pw PoolWrapper
+    pw.pool.Store(p)
+    defer pw.Close()
+
+    stats := pw.Snapshot()
+    if stats.MaxConnLifetimeJitter != time.Minute || stats.HealthCheckPeriod != 10*time.Second || stats.MaxConnLifetime != time.Hour {
+        t.Errorf("got %+v; want the jitter, health check period and default lifetime of the config", stats)
+    }
+}
+
+func TestReadPool(t *testing.T) {
+    // pgxpool.New doesn't connect, so these pools don't need a running database.
+    primary, err := pgxpool.New(context.Background(), "postgres://u:p@127.0.0.1:1/db")
+    if err != nil {
+        t.Fatal(err)
+    }
+    replica, err := pgxpool.New(context.Background(), "postgres://u:p@127.0.0.1:2/db")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    pw := PoolWrapper{Replica: &PoolWrapper{}}
+    pw.pool.Store(primary)
+    defer pw.Close()
+
+    ctx := context.Background()
+
+    if pw.ReadPool(ctx) != primary {
+        t.Error("got the replica's pool before it has one; want the primary's")
+    }
+
+    pw.Replica.pool.Store(replica)
+
+    if pw.ReadPool(ctx) != replica {
+        t.Error("got the primary's pool; want the replica's")
+    }
+    if pw.ReadPool(UsePrimary(ctx)) != primary {
+        t.Error("got the replica's pool with UsePrimary; want the primary's")
+    }
+
+    pw.Replica.unhealthy.Store(true)
+
+    if pw.ReadPool(ctx) != primary {
+        t.Error("got the pool of an unhealthy replica; want the primary's")
+    }
+    if stats := pw.Snapshot(); stats.Replica == nil || stats.Replica.Healthy || !stats.Healthy {
+        t.Errorf("got %+v; want the stats of the unhealthy replica in those of the healthy primary", stats)
+    }
+
+    // Without a replica, the reads go to the primary.
+    var single PoolWrapper
+    single.pool.Store(primary)
+
+    if single.ReadPool(ctx) != primary || single.Snapshot().Replica != nil {
+        t.Error("got a replica without one")
+    }
+}
+
+func TestSnapshotIsLive(t *testing.T) {
+    dsn := testDSN(t)
+
+    pw := PoolWrapper{drainDelay: 10 * time.Millisecond}
+    defer pw.Close()
+
+    err := pw.CreatePool(PoolConfig{ConnString: dsn})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    before := pw.Snapshot()
+
+    for range 5 {
+        var n int
+        err := pw.Pool().QueryRow(context.Background(), "SELECT 1").Scan(&n)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    after := pw.Snapshot()
+    if after.AcquireCount < before.AcquireCount+5 {
+        t.Errorf("got AcquireCount %d after 5 queries; want at least %d", after.AcquireCount, before.AcquireCount+5)
+    }
+
+    b, err := pw.MarshalJSON()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var marshalled PoolStats
+    err = json.Unmarshal(b, &marshalled)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if marshalled.AcquireCount < after.AcquireCount {
+        t.Errorf("got marshalled AcquireCount %d; want at least %d", marshalled.AcquireCount, after.AcquireCount)
+    }
+
+    err = pw.CreatePool(PoolConfig{ConnString: dsn})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if serial := pw.Snapshot().PoolSerialNumber; serial != before.PoolSerialNumber+1 {
+        t.Errorf("got PoolSerialNumber %d after recreating the pool; want %d", serial, before.PoolSerialNumber+1)
+    }
+}
+
+func TestCreatePoolWithRetry(t *testing.T) {
+    var pw PoolWrapper
+    defer pw.Close()
+
+    var waits []time.Duration
+    onRetry := func(attempt int, err error, wait time.Duration) {
+        if attempt != len(waits)+1 {
+            t.Errorf("got attempt %d; want %d", attempt, len(waits)+1)
+        }
+        waits = append(waits, wait)
+    }
+
+    start := time.Now()
+
+    err := pw.CreatePoolWithRetry(context.Background(), PoolConfig{ConnString: "postgres://u:p@127.0.0.1:1/db?connect_timeout=1"}, 2*time.Second, onRetry)
+    if err == nil {
+        t.Fatal("expected CreatePoolWithRetry to fail")
+    }
+
+    if elapsed := time.Since(start); elapsed < 2*time.Second {
+        t.Errorf("gave up after %v; want at least the 2s timeout", elapsed)
+    }
+
+    // The waits double from half a second and are cut short by the deadline.
+    if len(waits) < 2 || waits[0] != 500*time.Millisecond || waits[1] > time.Second {
+        t.Errorf("got waits %v; want 500ms then at most 1s", waits)
+    }
+
+    // An invalid connection string isn't retried.
+    waits = nil
+
+    err = pw.CreatePoolWithRetry(context.Background(), PoolConfig{ConnString: "not a connection string"}, time.Minute, onRetry)
+    if err == nil || len(waits) != 0 {
+        t.Errorf("got error %v after %d retries; want an error and no retries", err, len(waits))
+    }
+
+    // The context cancels the retries.
+    ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+    defer cancel()
+
+    err = pw.CreatePoolWithRetry(ctx, PoolConfig{ConnString: "postgres://u:p@127.0.0.1:1/db?connect_timeout=1"}, time.Minute, nil)
+    if err != context.DeadlineExceeded {
+        t.Errorf("got error %v; want %v", err, context.DeadlineExceeded)
+    }
+}
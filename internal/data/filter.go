@@ -1,6 +1,9 @@
 package data
 
 import (
+	"errors"
+	"fmt"
+	"slices"
 	"strings"
 
 	"greenlight.zzh.net/internal/validator"
@@ -8,42 +11,96 @@ import (
 
 // Filter is used for filtering, sorting and pagination.
 type Filter struct {
-    Page         int
-    PageSize     int
-    Sort         string
-    SortSafeList []string
+    Page            int
+    PageSize        int
+    DefaultPageSize int // page size of the requests without one, set by the handler
+    MaxPageSize     int // largest page size ValidateFilter accepts; 0 is DefaultMaxPageSize
+    Sort            string
+    SortSafeList    []string
+    SkipTotal       bool // don't count the matching records, only report whether there are more
+    MaxOffset       int  // pages starting after this many records are empty, see pastMaxOffset(); 0 is no limit
+}
+
+// DefaultMaxPageSize is the largest page size of the filters without a MaxPageSize.
+const DefaultMaxPageSize = 100
+
+// maxPageSize returns the largest page size of f.
+func (f Filter) maxPageSize() int {
+    if f.MaxPageSize > 0 {
+        return f.MaxPageSize
+    }
+
+    return DefaultMaxPageSize
 }
 
 // ValidateFilter validates the fields of f using validator v.
 func ValidateFilter(v *validator.Validator, f Filter) {
-    v.Check(f.Page > 0, "page", "must be greater than 0")
-    v.Check(f.Page <= 10_000_000, "page", "must be less than or equal to 10000000")
-    v.Check(f.PageSize > 0, "page_size", "must be greater than 0")
-    v.Check(f.PageSize <= 100, "page_size", "must be less than or equal to 100")
+    v.Checkf(f.Page > 0, "page", "must be greater than %d", 0)
+    v.Checkf(f.Page <= 1_000_000, "page", "must be less than or equal to %d", 1_000_000)
+    v.Checkf(f.PageSize > 0, "page_size", "must be greater than %d", 0)
+    v.Checkf(f.PageSize <= f.maxPageSize(), "page_size", "must be less than or equal to %d", f.maxPageSize())
     v.Check(validator.PermittedValue(f.Sort, f.SortSafeList...), "sort", "invalid sort value")
 }
 
-// sortColumn checks that the client-provided filed matches one of the entries in the safelist
+// ErrInvalidSort is returned by the models listing records when Filter.Sort isn't one of the
+// entries of Filter.SortSafeList. ValidateFilter reports it to the client first, so it only
+// reaches a model through a code path which doesn't validate the filter.
+var ErrInvalidSort = errors.New("invalid sort value")
+
+// sortColumn checks that the client-provided field matches one of the entries in the safelist
 // and if it does, extracts the column name from the Sort field by stripping the leading hyphen
 // character (if one exists).
-func (f Filter) sortColumn() string {
-    for _, safeValue := range f.SortSafeList {
-        if f.Sort == safeValue {
-            return strings.TrimPrefix(f.Sort, "-")
-        }
+func (f Filter) sortColumn() (string, error) {
+    if !slices.Contains(f.SortSafeList, f.Sort) {
+        return "", f.invalidSort()
     }
 
-    panic("unsafe sort parameter: " + f.Sort)
+    return strings.TrimPrefix(f.Sort, "-"), nil
 }
 
-// sortDirection returns the sort direction ("ASC" or "DESC") depending on the
-// prefix character of the Sort field.
-func (f Filter) sortDirection() string {
+// sortDirection returns the sort direction ("ASC" or "DESC") depending on the prefix character
+// of the Sort field, which must be in the safelist too.
+func (f Filter) sortDirection() (string, error) {
+    if !slices.Contains(f.SortSafeList, f.Sort) {
+        return "", f.invalidSort()
+    }
+
     if strings.HasPrefix(f.Sort, "-") {
-        return "DESC"
+        return "DESC", nil
+    }
+
+    return "ASC", nil
+}
+
+// orderBy returns the ORDER BY clause of the Sort field. Unless the records are sorted by id,
+// id is appended as a tiebreaker: the records with the same value would be in any order
+// otherwise, and could be repeated or skipped from one page to the next.
+func (f Filter) orderBy() (string, error) {
+    column, err := f.sortColumn()
+    if err != nil {
+        return "", err
+    }
+
+    direction, err := f.sortDirection()
+    if err != nil {
+        return "", err
     }
 
-    return "ASC"
+    if column == "id" {
+        return "id " + direction, nil
+    }
+
+    return column + " " + direction + ", id ASC", nil
+}
+
+// invalidSort returns ErrInvalidSort with the Sort field. With the invariants build tag it
+// panics instead, so that tests find the code paths which don't validate the filter.
+func (f Filter) invalidSort() error {
+    if checkInvariants {
+        panic("unsafe sort parameter: " + f.Sort)
+    }
+
+    return fmt.Errorf("%w: %q", ErrInvalidSort, f.Sort)
 }
 
 func (f Filter) limit() int {
@@ -54,13 +111,30 @@ func (f Filter) offset() int {
     return (f.Page - 1) * f.PageSize
 }
 
+// pastMaxOffset reports whether the page starts after MaxOffset records. Postgres has to read
+// and discard every record before the offset, so such a page is returned empty without running
+// the query, with metadata from a cheaper count.
+func (f Filter) pastMaxOffset() bool {
+    return f.MaxOffset > 0 && f.offset() > f.MaxOffset
+}
+
 // MetaData holds the pagination metadata.
 type Metadata struct {
-    CurrentPage  int `json:"current_page,omitempty"`
-    PageSize     int `json:"page_size,omitempty"`
-    FirstPage    int `json:"first_page,omitempty"`
-    LastPage     int `json:"last_page,omitempty"`
-    TotalRecords int `json:"total_records,omitempty"`
+    CurrentPage  int        `json:"current_page,omitempty" xml:"current_page,omitempty"`
+    PageSize     int        `json:"page_size,omitempty" xml:"page_size,omitempty"`
+    FirstPage    int        `json:"first_page,omitempty" xml:"first_page,omitempty"`
+    LastPage     int        `json:"last_page,omitempty" xml:"last_page,omitempty"`
+    TotalRecords int        `json:"total_records,omitempty" xml:"total_records,omitempty"`
+    HasMore      *bool      `json:"has_more,omitempty" xml:"has_more,omitempty"` // only set with Filter.SkipTotal
+    Links        *PageLinks `json:"links,omitempty" xml:"links,omitempty"`       // set by the handler
+}
+
+// PageLinks holds the URLs of the current, next and previous pages of a list. Next and Prev are
+// empty on the last and first pages.
+type PageLinks struct {
+    Self string `json:"self" xml:"self"`
+    Next string `json:"next,omitempty" xml:"next,omitempty"`
+    Prev string `json:"prev,omitempty" xml:"prev,omitempty"`
 }
 
 func calculateMetadata(totalRecords, page, pageSize int) Metadata {
@@ -81,3 +155,14 @@ func calculateMetadata(totalRecords, page, pageSize int) Metadata {
         TotalRecords: totalRecords,
     }
 }
+
+// MetadataWithoutTotal returns the pagination metadata of a list whose total isn't known, only
+// whether there are pages after this one. LastPage and TotalRecords are left out.
+func MetadataWithoutTotal(page, pageSize int, hasMore bool) Metadata {
+    return Metadata{
+        CurrentPage: page,
+        PageSize:    pageSize,
+        FirstPage:   1,
+        HasMore:     &hasMore,
+    }
+}
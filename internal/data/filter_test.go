@@ -0,0 +1,86 @@
+package data
+
+import (
+	"errors"
+	"testing"
+
+	"greenlight.zzh.net/internal/validator"
+)
+
+func TestFilterOrderBy(t *testing.T) {
+    safeList := []string{"id", "title", "-id", "-title"}
+
+    tests := []struct {
+        sort string
+        want string
+    }{
+        {"id", "id ASC"},
+        {"-id", "id DESC"},
+        {"title", "title ASC, id ASC"},
+        {"-title", "title DESC, id ASC"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.sort, func(t *testing.T) {
+            got, err := Filter{Sort: tt.sort, SortSafeList: safeList}.orderBy()
+            if err != nil {
+                t.Fatal(err)
+            }
+            if got != tt.want {
+                t.Errorf("got %q; want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestValidateFilterPageSize(t *testing.T) {
+    tests := []struct {
+        name        string
+        pageSize    int
+        maxPageSize int
+        wantError   string
+    }{
+        {"default cap", 100, 0, ""},
+        {"above the default cap", 101, 0, "must be less than or equal to 100"},
+        {"raised cap", 500, 500, ""},
+        {"above a raised cap", 501, 500, "must be less than or equal to 500"},
+        {"lowered cap", 51, 50, "must be less than or equal to 50"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            v := validator.New()
+            ValidateFilter(v, Filter{Page: 1, PageSize: tt.pageSize, MaxPageSize: tt.maxPageSize, Sort: "id", SortSafeList: []string{"id"}})
+
+            var got string
+            if errs := v.Errors["page_size"]; len(errs) > 0 {
+                got = errs[0]
+            }
+            if got != tt.wantError {
+                t.Errorf("got error %q; want %q", got, tt.wantError)
+            }
+        })
+    }
+}
+
+func TestFilterInvalidSort(t *testing.T) {
+    if checkInvariants {
+        t.Skip("invalid sort values panic with the invariants build tag")
+    }
+
+    // A value outside the safelist, even one naming a real column, is an error rather than a
+    // panic, so that a handler which forgot ValidateFilter responds with 422 rather than 500.
+    for _, sort := range []string{"", "foo", "password_hash", "-title; DROP TABLE movie"} {
+        f := Filter{Sort: sort, SortSafeList: []string{"id", "-id"}}
+
+        if _, err := f.sortColumn(); !errors.Is(err, ErrInvalidSort) {
+            t.Errorf("sortColumn with sort %q: got %v; want ErrInvalidSort", sort, err)
+        }
+        if _, err := f.sortDirection(); !errors.Is(err, ErrInvalidSort) {
+            t.Errorf("sortDirection with sort %q: got %v; want ErrInvalidSort", sort, err)
+        }
+        if _, err := f.orderBy(); !errors.Is(err, ErrInvalidSort) {
+            t.Errorf("orderBy with sort %q: got %v; want ErrInvalidSort", sort, err)
+        }
+    }
+}
@@ -0,0 +1,165 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"greenlight.zzh.net/internal/validator"
+)
+
+var ErrDuplicateGenre = errors.New("duplicate genre")
+
+// Genre is an entry of the canonical list of genres which movie genres are validated against.
+type Genre struct {
+    ID        int64     `json:"id" xml:"id"`
+    CreatedAt time.Time `json:"-" xml:"-"`
+    Name      string    `json:"name" xml:"name"` // canonical casing, unique regardless of case
+}
+
+// ValidateGenre validates the fields of genre using validator v. Genres are listed comma
+// separated in the genres query parameter, so a name can't contain a comma.
+func ValidateGenre(v *validator.Validator, genre *Genre) {
+    v.Check(strings.TrimSpace(genre.Name) != "", "name", "must be provided")
+    v.Checkf(len(genre.Name) <= 50, "name", "must not be more than %d bytes long", 50)
+    v.Check(!strings.Contains(genre.Name, ","), "name", "must not contain a comma")
+}
+
+// Genres is the canonical list of genres.
+type Genres []*Genre
+
+// Canonical returns the name of the genre matching name case-insensitively, and whether there
+// is one.
+func (g Genres) Canonical(name string) (string, bool) {
+    for _, genre := range g {
+        if strings.EqualFold(genre.Name, name) {
+            return genre.Name, true
+        }
+    }
+
+    return "", false
+}
+
+// GenreStore describes the operations on the genre list used by the handlers.
+type GenreStore interface {
+    GetAll(ctx context.Context) (Genres, error)
+    Insert(ctx context.Context, genre *Genre) error
+    Rename(ctx context.Context, genre *Genre) (int64, error)
+}
+
+// GenreModel struct wraps a database connection pool wrapper.
+type GenreModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// GetAll returns all the genres sorted by name.
+func (m GenreModel) GetAll(ctx context.Context) (Genres, error) {
+    query := `SELECT id, created_at, name 
+                FROM genre 
+               ORDER BY lower(name)`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    genres := Genres{}
+
+    for rows.Next() {
+        var genre Genre
+
+        err := rows.Scan(&genre.ID, &genre.CreatedAt, &genre.Name)
+        if err != nil {
+            return nil, err
+        }
+
+        genres = append(genres, &genre)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return genres, nil
+}
+
+// Insert adds a genre to the list. It returns ErrDuplicateGenre if there is a genre with the
+// same name regardless of case.
+func (m GenreModel) Insert(ctx context.Context, genre *Genre) error {
+    query := `INSERT INTO genre (name) 
+              VALUES ($1) 
+              RETURNING id, created_at`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    err := m.DB.Pool().QueryRow(ctx, query, genre.Name).Scan(&genre.ID, &genre.CreatedAt)
+    if err != nil {
+        switch {
+        case strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint):
+            return ErrDuplicateGenre
+        default:
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Rename changes the name of the genre with genre.ID to genre.Name and, in the same transaction,
+// replaces the old name in the genres of the movies, matching it regardless of case. It returns
+// the number of movies updated, whose version and updated_at are bumped. It returns ErrRecordNotFound if
+// there is no such genre and ErrDuplicateGenre if another genre has the new name.
+func (m GenreModel) Rename(ctx context.Context, genre *Genre) (int64, error) {
+    genreQuery := `WITH old AS (SELECT name FROM genre WHERE id = $1 FOR UPDATE) 
+                   UPDATE genre 
+                   SET name = $2 
+                   FROM old 
+                   WHERE id = $1 
+                   RETURNING old.name, genre.created_at`
+
+    movieQuery := `UPDATE movie 
+                   SET genres = ARRAY(SELECT CASE WHEN lower(g) = lower($1) THEN $2 ELSE g END FROM unnest(genres) AS g), 
+                       updated_at = NOW(), version = version + 1 
+                   WHERE lower($1) = ANY(SELECT lower(g) FROM unnest(genres) AS g)`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var updated int64
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        var oldName string
+
+        err := tx.QueryRow(ctx, genreQuery, genre.ID, genre.Name).Scan(&oldName, &genre.CreatedAt)
+        if err != nil {
+            switch {
+            case errors.Is(err, pgx.ErrNoRows):
+                return ErrRecordNotFound
+            case strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint):
+                return ErrDuplicateGenre
+            default:
+                return err
+            }
+        }
+
+        result, err := tx.Exec(ctx, movieQuery, oldName, genre.Name)
+        if err != nil {
+            return err
+        }
+
+        updated = result.RowsAffected()
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+
+    return updated, nil
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// IdempotencyTTL is how long the response to a request with an Idempotency-Key header is kept
+// for replaying.
+const IdempotencyTTL = 24 * time.Hour
+
+// ErrDuplicateIdempotencyKey is returned by IdempotencyStore.Insert when the user already has
+// an unexpired request with the key.
+var ErrDuplicateIdempotencyKey = errors.New("duplicate idempotency key")
+
+// IdempotentRequest holds a request made with an Idempotency-Key header and, once the request
+// has completed, its response.
+type IdempotentRequest struct {
+    UserID      int64
+    Key         string
+    RequestHash []byte      // SHA-256 of the method, path and body of the request
+    StatusCode  int         // zero while the request is being processed
+    Header      http.Header // headers set by the handler
+    Body        []byte
+    Expiry      time.Time
+}
+
+// IdempotencyStore describes the operations on idempotency keys used by the handlers.
+type IdempotencyStore interface {
+    Insert(ctx context.Context, req *IdempotentRequest) error
+    Get(ctx context.Context, userID int64, key string) (*IdempotentRequest, error)
+    Complete(ctx context.Context, req *IdempotentRequest) error
+    Delete(ctx context.Context, userID int64, key string) error
+    DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// IdempotencyModel struct wraps a database connection pool wrapper.
+type IdempotencyModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// Insert records a request which is being processed. An expired request with the same key is
+// replaced; an unexpired one makes Insert return ErrDuplicateIdempotencyKey.
+func (m IdempotencyModel) Insert(ctx context.Context, req *IdempotentRequest) error {
+    query := `INSERT INTO idempotency_key (user_id, key, request_hash, expiry) 
+              VALUES ($1, $2, $3, $4) 
+              ON CONFLICT (user_id, key) DO UPDATE 
+              SET request_hash = EXCLUDED.request_hash, status = 0, header = '{}', body = '', 
+                  created_at = NOW(), expiry = EXCLUDED.expiry 
+              WHERE idempotency_key.expiry < NOW() 
+              RETURNING user_id`
+
+    args := []any{req.UserID, req.Key, req.RequestHash, req.Expiry}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var userID int64
+
+    err := m.DB.Pool().QueryRow(ctx, query, args...).Scan(&userID)
+    if err != nil {
+        switch {
+        case errors.Is(err, pgx.ErrNoRows):
+            return ErrDuplicateIdempotencyKey
+        default:
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Get returns the unexpired request of a user with the given key.
+func (m IdempotencyModel) Get(ctx context.Context, userID int64, key string) (*IdempotentRequest, error) {
+    query := `SELECT user_id, key, request_hash, status, header, body, expiry 
+                FROM idempotency_key 
+               WHERE user_id = $1 AND key = $2 AND expiry > NOW()`
+
+    var req IdempotentRequest
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    err := m.DB.Pool().QueryRow(ctx, query, userID, key).Scan(
+        &req.UserID,
+        &req.Key,
+        &req.RequestHash,
+        &req.StatusCode,
+        &req.Header,
+        &req.Body,
+        &req.Expiry,
+    )
+    if err != nil {
+        switch {
+        case errors.Is(err, pgx.ErrNoRows):
+            return nil, ErrRecordNotFound
+        default:
+            return nil, err
+        }
+    }
+
+    return &req, nil
+}
+
+// Complete stores the response of a request recorded by Insert.
+func (m IdempotencyModel) Complete(ctx context.Context, req *IdempotentRequest) error {
+    query := `UPDATE idempotency_key 
+              SET status = $1, header = $2, body = $3 
+              WHERE user_id = $4 AND key = $5`
+
+    header := req.Header
+    if header == nil {
+        header = http.Header{}
+    }
+
+    args := []any{req.StatusCode, header, req.Body, req.UserID, req.Key}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
+
+// Delete deletes the request of a user with the given key, so that the request can be retried.
+func (m IdempotencyModel) Delete(ctx context.Context, userID int64, key string) error {
+    query := `DELETE FROM idempotency_key 
+              WHERE user_id = $1 AND key = $2`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query, userID, key)
+    return err
+}
+
+// DeleteExpired deletes all expired requests and returns how many were deleted.
+func (m IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+    query := `DELETE FROM idempotency_key 
+              WHERE expiry < NOW()`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query)
+    if err != nil {
+        return 0, err
+    }
+
+    return result.RowsAffected(), nil
+}
+
+// ValidIdempotencyKey reports whether key can be used as an Idempotency-Key: 1 to 255 printable
+// ASCII characters.
+func ValidIdempotencyKey(key string) bool {
+    if key == "" || len(key) > 255 {
+        return false
+    }
+
+    return !strings.ContainsFunc(key, func(r rune) bool { return r < ' ' || r > '~' })
+}
@@ -0,0 +1,664 @@
+//go:build integration
+
+package data_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+	"greenlight.zzh.net/internal/data/mock"
+	"greenlight.zzh.net/internal/testdb"
+)
+
+func TestMain(m *testing.M) {
+    os.Exit(testdb.Main(m))
+}
+
+func TestIntegrationMovieEditConflict(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    first, err := models.Movie.Get(ctx, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    second, err := models.Movie.Get(ctx, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    first.Title = "Moana (2016)"
+    err = models.Movie.Update(ctx, first)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // second still has the version read before the first update.
+    second.Title = "Moana 2"
+    err = models.Movie.Update(ctx, second)
+    if !errors.Is(err, data.ErrEditConflict) {
+        t.Errorf("got %v; want ErrEditConflict", err)
+    }
+
+    got, err := models.Movie.Get(ctx, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Title != first.Title || got.Version != first.Version {
+        t.Errorf("got %q version %d; want the first update, %q version %d", got.Title, got.Version, first.Title, first.Version)
+    }
+}
+
+func TestIntegrationMovieDelete(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    err := models.Movie.Delete(ctx, 1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = models.Movie.Get(ctx, 1)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v after the delete; want ErrRecordNotFound", err)
+    }
+
+    err = models.Movie.Delete(ctx, 1, true)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v deleting again; want ErrRecordNotFound", err)
+    }
+}
+
+func TestIntegrationMovieDeleteReferenced(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    err := models.Poster.Put(ctx, data.NewPoster(1, "image/png", []byte("png")))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = models.Movie.Delete(ctx, 1, false)
+    var referencedError *data.MovieReferencedError
+    if !errors.As(err, &referencedError) || referencedError.Dependents.Posters != 1 {
+        t.Fatalf("got %v without cascade; want a MovieReferencedError with 1 poster", err)
+    }
+
+    err = models.Movie.Delete(ctx, 1, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = models.Poster.Get(ctx, 1)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v for the poster; want ErrRecordNotFound", err)
+    }
+}
+
+func TestIntegrationMoviePagination(t *testing.T) {
+    models, _ := testdb.Models(t)
+
+    tests := []struct {
+        name     string
+        page     int
+        wantLen  int
+        wantLast int
+        wantID   int64
+    }{
+        {"first page", 1, 10, 3, 1},
+        {"last page", 3, 5, 3, 21},
+        {"past the end", 4, 0, 0, 0},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            filter := data.Filter{Page: tt.page, PageSize: 10, Sort: "id", SortSafeList: []string{"id"}}
+
+            movies, metadata, err := models.Movie.GetAll(context.Background(), data.MovieListParams{}, filter)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            if len(movies) != tt.wantLen {
+                t.Fatalf("got %d movies; want %d", len(movies), tt.wantLen)
+            }
+            if tt.wantLen > 0 && movies[0].ID != tt.wantID {
+                t.Errorf("got first ID %d; want %d", movies[0].ID, tt.wantID)
+            }
+            if metadata.LastPage != tt.wantLast {
+                t.Errorf("got last page %d; want %d", metadata.LastPage, tt.wantLast)
+            }
+            if tt.wantLen > 0 && metadata.TotalRecords != testdb.FixtureMovieCount {
+                t.Errorf("got %d total records; want %d", metadata.TotalRecords, testdb.FixtureMovieCount)
+            }
+        })
+    }
+}
+
+func TestIntegrationMovieSortStability(t *testing.T) {
+    models, _ := testdb.Models(t)
+
+    safeList := []string{"id", "title", "year", "runtime", "created_at", "updated_at", "-id", "-title", "-year", "-runtime", "-created_at", "-updated_at"}
+
+    for _, sort := range safeList {
+        t.Run(sort, func(t *testing.T) {
+            // The fixtures share years and creation times, so without the id tiebreaker the pages
+            // could repeat some movies and skip others.
+            seen := make(map[int64]bool)
+
+            for page := 1; ; page++ {
+                filter := data.Filter{Page: page, PageSize: 4, Sort: sort, SortSafeList: safeList}
+
+                movies, _, err := models.Movie.GetAll(context.Background(), data.MovieListParams{}, filter)
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if len(movies) == 0 {
+                    break
+                }
+
+                for _, movie := range movies {
+                    if seen[movie.ID] {
+                        t.Fatalf("movie %d is on more than one page", movie.ID)
+                    }
+                    seen[movie.ID] = true
+                }
+            }
+
+            if len(seen) != testdb.FixtureMovieCount {
+                t.Errorf("got %d movies across the pages; want %d", len(seen), testdb.FixtureMovieCount)
+            }
+        })
+    }
+
+    _, _, err := models.Movie.GetAll(context.Background(), data.MovieListParams{}, data.Filter{Page: 1, PageSize: 4, Sort: "password_hash", SortSafeList: safeList})
+    if !errors.Is(err, data.ErrInvalidSort) {
+        t.Errorf("got %v for a sort value outside the safelist; want ErrInvalidSort", err)
+    }
+}
+
+func TestIntegrationFindPotentialDuplicates(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    movie := &data.Movie{Title: "Spider-Man: Homecoming", Year: 1920, Runtime: 133, Genres: []string{"action"}}
+    err := models.Movie.Insert(ctx, movie)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    duplicates, err := models.Movie.FindPotentialDuplicates(ctx, "spiderman homecoming!", 1920, 0.3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(duplicates) != 1 || duplicates[0].ID != movie.ID || duplicates[0].Similarity <= 0.3 || duplicates[0].Similarity > 1 {
+        t.Errorf("got duplicates %+v; want movie %d with a similarity above 0.3", duplicates, movie.ID)
+    }
+
+    duplicates, err = models.Movie.FindPotentialDuplicates(ctx, "Spider-Man: Homecoming", 1921, 0.3)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(duplicates) != 0 {
+        t.Errorf("got duplicates %+v of another year; want none", duplicates)
+    }
+}
+
+func TestIntegrationMovieTitleYearUnique(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    movie := &data.Movie{Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation"}}
+
+    err := models.Movie.Insert(ctx, movie)
+    var duplicate *data.DuplicateMovieError
+    if !errors.As(err, &duplicate) || duplicate.ID != 1 {
+        t.Errorf("insert: got %v; want a DuplicateMovieError with ID 1", err)
+    }
+    if !errors.Is(err, data.ErrDuplicateMovie) {
+        t.Errorf("insert: got %v; want ErrDuplicateMovie", err)
+    }
+
+    deadpool, err := models.Movie.Get(ctx, 3)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    deadpool.Title = "Moana"
+
+    err = models.Movie.Update(ctx, deadpool)
+    if !errors.As(err, &duplicate) || duplicate.ID != 1 {
+        t.Errorf("update: got %v; want a DuplicateMovieError with ID 1", err)
+    }
+}
+
+func TestIntegrationMovieDateWindows(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    movie, err := models.Movie.Get(ctx, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // created_at has whole seconds, so the window of the second the movie was created in
+    // includes it and the window ending at that second doesn't.
+    created := movie.CreatedAt.UTC()
+    next := created.Add(time.Second)
+
+    tests := []struct {
+        name   string
+        params data.MovieListParams
+        want   bool
+    }{
+        {"window of the second", data.MovieListParams{CreatedAfter: &created, CreatedBefore: &next}, true},
+        {"window ending at the second", data.MovieListParams{CreatedBefore: &created}, false},
+        {"window starting after the second", data.MovieListParams{CreatedAfter: &next}, false},
+        {"updated window", data.MovieListParams{UpdatedAfter: &created, UpdatedBefore: &next}, true},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            filter := data.Filter{Page: 1, PageSize: 100, Sort: "id", SortSafeList: []string{"id"}}
+
+            movies, _, err := models.Movie.GetAll(ctx, tt.params, filter)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            found := false
+            for _, m := range movies {
+                found = found || m.ID == movie.ID
+            }
+            if found != tt.want {
+                t.Errorf("got movie 1 listed %t; want %t", found, tt.want)
+            }
+
+            // The other queries take the same parameters.
+            _, err = models.Movie.LastUpdated(ctx, tt.params)
+            if err != nil {
+                t.Fatal(err)
+            }
+            err = models.Movie.ForEach(ctx, tt.params, func(*data.Movie) error { return nil })
+            if err != nil {
+                t.Fatal(err)
+            }
+        })
+    }
+}
+
+func TestIntegrationMovieGenreFilter(t *testing.T) {
+    models, _ := testdb.Models(t)
+
+    filter := data.Filter{Page: 1, PageSize: 20, Sort: "id", SortSafeList: []string{"id"}}
+
+    movies, _, err := models.Movie.GetAll(context.Background(), data.MovieListParams{Genres: []string{"adventure"}}, filter)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var ids []int64
+    for _, movie := range movies {
+        ids = append(ids, movie.ID)
+    }
+    if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+        t.Errorf("got IDs %v; want Moana and Black Panther, [1 2]", ids)
+    }
+}
+
+func TestIntegrationUserDuplicateEmail(t *testing.T) {
+    models, _ := testdb.Models(t)
+
+    // The unique index is on lower(email).
+    user := &data.User{Name: "Alice", Email: "ALICE@example.com"}
+    err := user.Password.Set(mock.FixturePassword)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = models.User.Insert(context.Background(), user)
+    if !errors.Is(err, data.ErrDuplicateEmail) {
+        t.Errorf("got %v; want ErrDuplicateEmail", err)
+    }
+}
+
+func TestIntegrationUserGetForToken(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    token, err := models.Token.New(ctx, mock.ActivatedUserID, time.Hour, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    user, err := models.User.GetForToken(ctx, data.ScopeAuthentication, token.Plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if user.ID != mock.ActivatedUserID {
+        t.Errorf("got user %d; want %d", user.ID, mock.ActivatedUserID)
+    }
+
+    _, err = models.User.GetForToken(ctx, data.ScopeActivation, token.Plaintext)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v with another scope; want ErrRecordNotFound", err)
+    }
+
+    expired, err := models.Token.New(ctx, mock.ActivatedUserID, -time.Minute, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    _, err = models.User.GetForToken(ctx, data.ScopeAuthentication, expired.Plaintext)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v with an expired token; want ErrRecordNotFound", err)
+    }
+}
+
+func TestIntegrationUserActivateForToken(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    token, err := models.Token.New(ctx, mock.InactiveUserID, time.Hour, data.ScopeActivation)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    user, _, err := models.User.ActivateForToken(ctx, token.Plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if user.ID != mock.InactiveUserID || !user.Activated {
+        t.Errorf("got user %d activated %t; want user %d activated", user.ID, user.Activated, mock.InactiveUserID)
+    }
+
+    // The token was consumed in the same transaction.
+    _, _, err = models.User.ActivateForToken(ctx, token.Plaintext)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v reusing the token; want ErrRecordNotFound", err)
+    }
+}
+
+func TestIntegrationPermissions(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    permissions, err := models.Permission.GetAllForUser(ctx, mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !permissions.Include("movie:read") || permissions.Include("movie:write") {
+        t.Fatalf("got %v; want movie:read only", permissions)
+    }
+
+    err = models.Permission.AddForUser(ctx, mock.ReadOnlyUserID, "movie:write")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    permissions, err = models.Permission.GetAllForUser(ctx, mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !permissions.Include("movie:write") {
+        t.Errorf("got %v; want movie:write added", permissions)
+    }
+
+    // Deleting the user deletes its permissions.
+    err = models.User.Delete(ctx, mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    permissions, err = models.Permission.GetAllForUser(ctx, mock.ReadOnlyUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(permissions) != 0 {
+        t.Errorf("got %v for a deleted user; want none", permissions)
+    }
+}
+
+func TestIntegrationTokenExtendExpiry(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    token, err := models.Token.New(ctx, mock.ActivatedUserID, time.Hour, data.ScopeAuthentication)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    later := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+    err = models.Token.ExtendExpiry(ctx, token.Hash, later)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // An earlier expiry doesn't shorten the token.
+    err = models.Token.ExtendExpiry(ctx, token.Hash, later.Add(-time.Hour))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    user, err := models.User.GetForToken(ctx, data.ScopeAuthentication, token.Plaintext)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if user.TokenExpiry == nil || !user.TokenExpiry.Equal(later) {
+        t.Errorf("got expiry %v; want %v", user.TokenExpiry, later)
+    }
+}
+
+func TestIntegrationAuditForEachForUser(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    for _, e := range []*data.AuditEvent{
+        {Event: data.AuditLoginSucceeded, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail},
+        {Event: data.AuditLoginFailed, Email: "unknown@example.com"},
+        {Event: data.AuditPasswordChanged, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail},
+    } {
+        err := models.Audit.Insert(ctx, e)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    var events []string
+    err := models.Audit.ForEachForUser(ctx, mock.ActivatedUserID, func(e *data.AuditEvent) error {
+        events = append(events, e.Event)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(events) != 2 || events[0] != data.AuditLoginSucceeded || events[1] != data.AuditPasswordChanged {
+        t.Errorf("got events %v; want the user's two in order", events)
+    }
+}
+
+func TestIntegrationUserDeleteScrubsAudit(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    for _, e := range []*data.AuditEvent{
+        {Event: data.AuditLoginSucceeded, UserID: mock.ActivatedUserID, Email: mock.ActivatedUserEmail, IP: "192.0.2.1"},
+        {Event: data.AuditLoginSucceeded, UserID: mock.ReadOnlyUserID, Email: mock.ReadOnlyUserEmail, IP: "192.0.2.2"},
+    } {
+        err := models.Audit.Insert(ctx, e)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    err := models.User.Delete(ctx, mock.ActivatedUserID)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var events []*data.AuditEvent
+    err = models.Audit.ForEachForUser(ctx, mock.ActivatedUserID, func(e *data.AuditEvent) error {
+        events = append(events, e)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(events) != 1 || events[0].Email != "" || events[0].IP != "" {
+        t.Errorf("got events %+v of the deleted user; want one without email and IP", events)
+    }
+
+    events = nil
+    err = models.Audit.ForEachForUser(ctx, mock.ReadOnlyUserID, func(e *data.AuditEvent) error {
+        events = append(events, e)
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(events) != 1 || events[0].Email != mock.ReadOnlyUserEmail || events[0].IP != "192.0.2.2" {
+        t.Errorf("got events %+v of another user; want them unchanged", events)
+    }
+}
+
+func TestIntegrationMovieStatsRefresh(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    err := models.Stats.Refresh(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    before, err := models.Stats.Get(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = models.Movie.Insert(ctx, &data.Movie{Title: "Casablanca", Year: 1942, Runtime: 102, Genres: []string{"drama"}})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The view is only recomputed by a refresh.
+    got, err := models.Stats.Get(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Total != before.Total {
+        t.Errorf("got total %d before the refresh; want %d", got.Total, before.Total)
+    }
+
+    err = models.Stats.Refresh(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    got, err = models.Stats.Get(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.Total != before.Total+1 || len(got.ByDecade) == 0 || got.ByDecade[0].Decade != 1940 {
+        t.Errorf("got total %d and decades %v after the refresh; want %d, starting with 1940", got.Total, got.ByDecade, before.Total+1)
+    }
+}
+
+func TestIntegrationUserUnactivated(t *testing.T) {
+    models, _ := testdb.Models(t)
+    ctx := context.Background()
+
+    // The fixture users were created just now.
+    createdBefore := time.Now().Add(time.Hour)
+
+    old, err := models.Token.New(ctx, mock.InactiveUserID, time.Hour, data.ScopeActivation)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    users, err := models.User.GetUnreminded(ctx, createdBefore, 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(users) != 1 || users[0].ID != mock.InactiveUserID {
+        t.Fatalf("got %d unreminded users; want Bob, user %d", len(users), mock.InactiveUserID)
+    }
+
+    email := &data.TokenEmail{
+        Template: "activation_reminder.html",
+        Data: func(token *data.Token) map[string]any {
+            return map[string]any{"activationToken": token.Plaintext, "userID": mock.InactiveUserID}
+        },
+    }
+
+    token, err := models.User.Remind(ctx, users[0], time.Hour, email)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The old activation token was replaced in the same transaction.
+    _, err = models.User.GetForToken(ctx, data.ScopeActivation, old.Plaintext)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v with the old token; want ErrRecordNotFound", err)
+    }
+    if _, err := models.User.GetForToken(ctx, data.ScopeActivation, token.Plaintext); err != nil {
+        t.Errorf("got %v with the new token; want the user", err)
+    }
+
+    _, err = models.User.Remind(ctx, users[0], time.Hour, nil)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v reminding again; want ErrRecordNotFound", err)
+    }
+
+    users, err = models.User.GetUnreminded(ctx, createdBefore, 10)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(users) != 0 {
+        t.Errorf("got %d unreminded users after the reminder; want 0", len(users))
+    }
+
+    err = models.Audit.Insert(ctx, &data.AuditEvent{Event: data.AuditLoginFailed, UserID: mock.InactiveUserID, Email: mock.InactiveUserEmail, IP: "192.0.2.1"})
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    deleted, tokens, err := models.User.DeleteUnactivated(ctx, createdBefore)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if deleted != 1 || tokens != 1 {
+        t.Errorf("got %d users and %d tokens deleted; want 1 and 1", deleted, tokens)
+    }
+
+    _, err = models.User.Get(ctx, mock.InactiveUserID)
+    if !errors.Is(err, data.ErrRecordNotFound) {
+        t.Errorf("got %v getting the deleted user; want ErrRecordNotFound", err)
+    }
+
+    // Neither the reminder nor the audit events keep the personal data of the deleted user.
+    emails, err := models.Outbox.Claim(ctx, 10, time.Minute)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(emails) != 0 {
+        t.Errorf("got emails %+v in the outbox; want the reminder deleted", emails)
+    }
+
+    err = models.Audit.ForEachForUser(ctx, mock.InactiveUserID, func(e *data.AuditEvent) error {
+        if e.Email != "" || e.IP != "" {
+            t.Errorf("got event %+v of the deleted user; want it without email and IP", e)
+        }
+        return nil
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+}
@@ -0,0 +1,7 @@
+//go:build invariants
+
+package data
+
+// checkInvariants makes the violations of the invariants which the callers of this package are
+// expected to uphold panic, rather than return an error. Build with -tags invariants to set it.
+const checkInvariants = true
@@ -0,0 +1,6 @@
+//go:build !invariants
+
+package data
+
+// checkInvariants is false without the invariants build tag, see invariants.go.
+const checkInvariants = false
@@ -0,0 +1,251 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationLockID is the key of the advisory lock taken while migrating, so that two instances
+// starting at the same time don't apply the same migration twice.
+const migrationLockID = 7_462_118_020_611
+
+// ErrDirtyDatabase is returned when a migration applied by another tool failed half way. The
+// schema has to be fixed by hand and the version forced with `migrate force`.
+var ErrDirtyDatabase = errors.New("database is dirty")
+
+// migrationFileRX matches migration file names such as 000001_create_movie_table.up.sql.
+var migrationFileRX = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a schema migration with the SQL to apply and to revert it.
+type Migration struct {
+    Version int64  `json:"version"`
+    Name    string `json:"name"`
+    Applied bool   `json:"applied"` // Only set by Migrator.Status
+
+    up   string
+    down string
+}
+
+// ReadMigrations reads the migrations in the root of fsys, sorted by version. Every migration
+// must have both an up and a down file.
+func ReadMigrations(fsys fs.FS) ([]*Migration, error) {
+    entries, err := fs.ReadDir(fsys, ".")
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := make(map[int64]*Migration)
+
+    for _, entry := range entries {
+        match := migrationFileRX.FindStringSubmatch(entry.Name())
+        if entry.IsDir() || match == nil {
+            continue
+        }
+
+        version, err := strconv.ParseInt(match[1], 10, 64)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", entry.Name(), err)
+        }
+
+        b, err := fs.ReadFile(fsys, entry.Name())
+        if err != nil {
+            return nil, err
+        }
+
+        m, ok := byVersion[version]
+        if !ok {
+            m = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = m
+        }
+        if m.Name != match[2] {
+            return nil, fmt.Errorf("migration %d has two names: %s and %s", version, m.Name, match[2])
+        }
+
+        if match[3] == "up" {
+            m.up = string(b)
+        } else {
+            m.down = string(b)
+        }
+    }
+
+    migrations := make([]*Migration, 0, len(byVersion))
+    for _, m := range byVersion {
+        if m.up == "" || m.down == "" {
+            return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", m.Version, m.Name)
+        }
+        migrations = append(migrations, m)
+    }
+
+    slices.SortFunc(migrations, func(a, b *Migration) int {
+        return int(a.Version - b.Version)
+    })
+
+    return migrations, nil
+}
+
+// Migrator applies the migrations in FS to the database. The version of the schema is kept in
+// the schema_migrations table in the same way as golang-migrate does, so a database can be
+// managed with either the migrate CLI or the Migrator.
+type Migrator struct {
+    Pool *pgxpool.Pool
+    FS   fs.FS
+}
+
+// Up applies all the migrations newer than the current version, each in its own transaction,
+// and returns the ones applied.
+func (m Migrator) Up(ctx context.Context) ([]*Migration, error) {
+    migrations, err := ReadMigrations(m.FS)
+    if err != nil {
+        return nil, err
+    }
+
+    var applied []*Migration
+
+    err = m.withLock(ctx, func(conn *pgxpool.Conn, version int64) error {
+        for _, migration := range migrations {
+            if migration.Version <= version {
+                continue
+            }
+
+            err := setVersion(ctx, conn, migration.up, migration.Version)
+            if err != nil {
+                return fmt.Errorf("migration %d_%s: %w", migration.Version, migration.Name, err)
+            }
+
+            applied = append(applied, migration)
+        }
+        return nil
+    })
+
+    return applied, err
+}
+
+// Down reverts the latest applied migration and returns it, or returns nil if no migration is
+// applied.
+func (m Migrator) Down(ctx context.Context) (*Migration, error) {
+    migrations, err := ReadMigrations(m.FS)
+    if err != nil {
+        return nil, err
+    }
+
+    var reverted *Migration
+
+    err = m.withLock(ctx, func(conn *pgxpool.Conn, version int64) error {
+        if version == 0 {
+            return nil
+        }
+
+        i := slices.IndexFunc(migrations, func(migration *Migration) bool {
+            return migration.Version == version
+        })
+        if i < 0 {
+            return fmt.Errorf("migration %d isn't known to this binary", version)
+        }
+
+        previous := int64(0)
+        if i > 0 {
+            previous = migrations[i-1].Version
+        }
+
+        err := setVersion(ctx, conn, migrations[i].down, previous)
+        if err != nil {
+            return fmt.Errorf("migration %d_%s: %w", migrations[i].Version, migrations[i].Name, err)
+        }
+
+        reverted = migrations[i]
+        return nil
+    })
+
+    return reverted, err
+}
+
+// Status returns the current schema version and all the migrations, flagged as applied or not.
+func (m Migrator) Status(ctx context.Context) (int64, []*Migration, error) {
+    migrations, err := ReadMigrations(m.FS)
+    if err != nil {
+        return 0, nil, err
+    }
+
+    var current int64
+
+    err = m.withLock(ctx, func(conn *pgxpool.Conn, version int64) error {
+        current = version
+        for _, migration := range migrations {
+            migration.Applied = migration.Version <= version
+        }
+        return nil
+    })
+
+    return current, migrations, err
+}
+
+// withLock runs fn on a connection holding the migration advisory lock, with the current schema
+// version. It creates the schema_migrations table if needed and fails with ErrDirtyDatabase if
+// the schema is dirty.
+func (m Migrator) withLock(ctx context.Context, fn func(conn *pgxpool.Conn, version int64) error) error {
+    conn, err := m.Pool.Acquire(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Release()
+
+    _, err = conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID)
+    if err != nil {
+        return err
+    }
+    defer conn.Exec(context.Background(), `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+    _, err = conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (version bigint NOT NULL PRIMARY KEY, dirty boolean NOT NULL)`)
+    if err != nil {
+        return err
+    }
+
+    var (
+        version int64
+        dirty   bool
+    )
+
+    err = conn.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+    if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+        return err
+    }
+
+    if dirty {
+        return fmt.Errorf("%w at version %d", ErrDirtyDatabase, version)
+    }
+
+    return fn(conn, version)
+}
+
+// setVersion runs the SQL of a migration and records version as the schema version in a
+// single transaction, so a failed migration leaves the schema untouched. Version 0 means that
+// no migration is applied.
+func setVersion(ctx context.Context, conn *pgxpool.Conn, sql string, version int64) error {
+    return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+        // Without arguments pgx uses the simple protocol, which allows several statements.
+        _, err := tx.Exec(ctx, sql)
+        if err != nil {
+            return err
+        }
+
+        _, err = tx.Exec(ctx, `DELETE FROM schema_migrations`)
+        if err != nil {
+            return err
+        }
+
+        if version == 0 {
+            return nil
+        }
+
+        _, err = tx.Exec(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+        return err
+    })
+}
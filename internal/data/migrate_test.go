@@ -0,0 +1,147 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"greenlight.zzh.net/migrations"
+)
+
+func TestReadMigrations(t *testing.T) {
+    all, err := ReadMigrations(migrations.FS)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if len(all) == 0 {
+        t.Fatal("no embedded migrations")
+    }
+
+    for i, m := range all {
+        if m.Version != int64(i+1) {
+            t.Errorf("got migration %d_%s at position %d; want version %d", m.Version, m.Name, i, i+1)
+        }
+    }
+
+    if all[0].Name != "create_movie_table" {
+        t.Errorf("got first migration %q; want create_movie_table", all[0].Name)
+    }
+}
+
+func TestReadMigrationsErrors(t *testing.T) {
+    tests := []struct {
+        name string
+        fsys fstest.MapFS
+    }{
+        {"missing down", fstest.MapFS{
+            "000001_a.up.sql": {Data: []byte("SELECT 1")},
+        }},
+        {"two names", fstest.MapFS{
+            "000001_a.up.sql":   {Data: []byte("SELECT 1")},
+            "000001_b.down.sql": {Data: []byte("SELECT 1")},
+        }},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := ReadMigrations(tt.fsys)
+            if err == nil {
+                t.Error("got no error")
+            }
+        })
+    }
+}
+
+func TestMigrator(t *testing.T) {
+    dsn := testDSN(t)
+    ctx := context.Background()
+
+    // Run in a schema of our own so that the schema_migrations table of the test database
+    // isn't touched.
+    schema := fmt.Sprintf("migrate_test_%d", time.Now().UnixNano())
+
+    admin, err := pgxpool.New(ctx, dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer admin.Close()
+
+    _, err = admin.Exec(ctx, "CREATE SCHEMA "+schema)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer admin.Exec(ctx, "DROP SCHEMA "+schema+" CASCADE")
+
+    poolConfig, err := pgxpool.ParseConfig(dsn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    poolConfig.ConnConfig.RuntimeParams["search_path"] = schema
+
+    pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer pool.Close()
+
+    fsys := fstest.MapFS{
+        "000001_create_a.up.sql":   {Data: []byte("CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);")},
+        "000001_create_a.down.sql": {Data: []byte("DROP TABLE a;")},
+        "000002_create_b.up.sql":   {Data: []byte("CREATE TABLE b (id int);")},
+        "000002_create_b.down.sql": {Data: []byte("DROP TABLE b;")},
+        "000003_broken.up.sql":     {Data: []byte("CREATE TABLE c (id int); SELECT * FROM missing;")},
+        "000003_broken.down.sql":   {Data: []byte("DROP TABLE c;")},
+    }
+
+    migrator := Migrator{Pool: pool, FS: fsys}
+
+    // The broken migration fails and is rolled back, leaving the first two applied.
+    applied, err := migrator.Up(ctx)
+    if err == nil {
+        t.Fatal("got no error from a broken migration")
+    }
+    if len(applied) != 2 {
+        t.Fatalf("got %d migrations applied; want 2", len(applied))
+    }
+
+    version, all, err := migrator.Status(ctx)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if version != 2 || !all[1].Applied || all[2].Applied {
+        t.Fatalf("got version %d and %+v; want version 2", version, all)
+    }
+
+    var exists bool
+    err = pool.QueryRow(ctx, "SELECT to_regclass('c') IS NOT NULL").Scan(&exists)
+    if err != nil || exists {
+        t.Fatalf("got table c existing %t (%v); want the broken migration rolled back", exists, err)
+    }
+
+    // Fix the migration and apply it.
+    fsys["000003_broken.up.sql"] = &fstest.MapFile{Data: []byte("CREATE TABLE c (id int);")}
+
+    applied, err = migrator.Up(ctx)
+    if err != nil || len(applied) != 1 {
+        t.Fatalf("got %d migrations applied (%v); want 1", len(applied), err)
+    }
+
+    for want := int64(3); want > 0; want-- {
+        reverted, err := migrator.Down(ctx)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if reverted == nil || reverted.Version != want {
+            t.Fatalf("got %+v reverted; want version %d", reverted, want)
+        }
+    }
+
+    reverted, err := migrator.Down(ctx)
+    if err != nil || reverted != nil {
+        t.Fatalf("got %+v reverted (%v) with no migration applied; want nil", reverted, err)
+    }
+}
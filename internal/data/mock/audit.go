@@ -0,0 +1,65 @@
+package mock
+
+import (
+	"context"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// AuditModel is an in-memory data.AuditStore.
+type AuditModel struct {
+    s *store
+}
+
+// Insert stores a copy of event.
+func (m *AuditModel) Insert(ctx context.Context, event *data.AuditEvent) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    event.ID = int64(len(m.s.auditEvents) + 1)
+    event.CreatedAt = time.Now()
+
+    e := *event
+    m.s.auditEvents = append(m.s.auditEvents, &e)
+
+    return nil
+}
+
+// ForEachForUser calls fn with a copy of each event of the user, in the order they were inserted.
+func (m *AuditModel) ForEachForUser(ctx context.Context, userID int64, fn func(event *data.AuditEvent) error) error {
+    m.s.mu.Lock()
+    var events []data.AuditEvent
+    for _, e := range m.s.auditEvents {
+        if e.UserID == userID {
+            events = append(events, *e)
+        }
+    }
+    m.s.mu.Unlock()
+
+    for i := range events {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+
+        err := fn(&events[i])
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Events returns copies of the stored events in the order they were inserted.
+func (m *AuditModel) Events() []data.AuditEvent {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    events := make([]data.AuditEvent, len(m.s.auditEvents))
+    for i, e := range m.s.auditEvents {
+        events[i] = *e
+    }
+
+    return events
+}
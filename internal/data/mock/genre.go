@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// GenreModel is an in-memory data.GenreStore.
+type GenreModel struct {
+    s *store
+}
+
+// genreNames are the genres created by the migrations.
+var genreNames = []string{
+    "action", "adventure", "animation", "biography", "comedy", "crime", "documentary", "drama", "family", "fantasy",
+    "history", "horror", "music", "mystery", "romance", "sci-fi", "sport", "thriller", "war", "western",
+}
+
+// GetAll returns all the genres sorted by name.
+func (m *GenreModel) GetAll(ctx context.Context) (data.Genres, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    genres := data.Genres{}
+    for _, genre := range m.s.genres {
+        c := *genre
+        genres = append(genres, &c)
+    }
+
+    slices.SortFunc(genres, func(a, b *data.Genre) int {
+        return cmp.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+    })
+
+    return genres, nil
+}
+
+// Insert adds a genre, returning data.ErrDuplicateGenre if the name is taken regardless of case.
+func (m *GenreModel) Insert(ctx context.Context, genre *data.Genre) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    if m.s.genreTaken(genre.Name, 0) {
+        return data.ErrDuplicateGenre
+    }
+
+    m.s.nextGenreID++
+    genre.ID = m.s.nextGenreID
+    genre.CreatedAt = time.Now()
+
+    c := *genre
+    m.s.genres[genre.ID] = &c
+
+    return nil
+}
+
+// Rename mimics data.GenreModel.Rename, replacing the old name in the genres of the movies.
+func (m *GenreModel) Rename(ctx context.Context, genre *data.Genre) (int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stored, ok := m.s.genres[genre.ID]
+    if !ok {
+        return 0, data.ErrRecordNotFound
+    }
+
+    if m.s.genreTaken(genre.Name, genre.ID) {
+        return 0, data.ErrDuplicateGenre
+    }
+
+    var updated int64
+    for _, movie := range m.s.movies {
+        i := slices.IndexFunc(movie.Genres, func(g string) bool {
+            return strings.EqualFold(g, stored.Name)
+        })
+        if i >= 0 {
+            movie.Genres[i] = genre.Name
+            movie.Version++
+            movie.UpdatedAt = time.Now()
+            updated++
+        }
+    }
+
+    stored.Name = genre.Name
+    genre.CreatedAt = stored.CreatedAt
+
+    return updated, nil
+}
+
+// genreTaken reports whether a genre other than the one with exceptID is named name regardless
+// of case. The caller must hold s.mu.
+func (s *store) genreTaken(name string, exceptID int64) bool {
+    for _, genre := range s.genres {
+        if genre.ID != exceptID && strings.EqualFold(genre.Name, name) {
+            return true
+        }
+    }
+    return false
+}
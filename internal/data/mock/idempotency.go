@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"context"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// idempotencyKey identifies a stored idempotent request.
+type idempotencyKey struct {
+    userID int64
+    key    string
+}
+
+// IdempotencyModel is an in-memory data.IdempotencyStore.
+type IdempotencyModel struct {
+    s *store
+}
+
+// Insert stores a copy of req, returning data.ErrDuplicateIdempotencyKey if the user has an
+// unexpired request with the key.
+func (m *IdempotencyModel) Insert(ctx context.Context, req *data.IdempotentRequest) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    k := idempotencyKey{req.UserID, req.Key}
+
+    if stored, ok := m.s.idempotency[k]; ok && stored.Expiry.After(time.Now()) {
+        return data.ErrDuplicateIdempotencyKey
+    }
+
+    m.s.idempotency[k] = copyIdempotentRequest(req)
+
+    return nil
+}
+
+// Get returns a copy of the unexpired request of a user with the given key.
+func (m *IdempotencyModel) Get(ctx context.Context, userID int64, key string) (*data.IdempotentRequest, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stored, ok := m.s.idempotency[idempotencyKey{userID, key}]
+    if !ok || !stored.Expiry.After(time.Now()) {
+        return nil, data.ErrRecordNotFound
+    }
+
+    return copyIdempotentRequest(stored), nil
+}
+
+// Complete stores the response of a request.
+func (m *IdempotencyModel) Complete(ctx context.Context, req *data.IdempotentRequest) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    k := idempotencyKey{req.UserID, req.Key}
+
+    stored, ok := m.s.idempotency[k]
+    if !ok {
+        return data.ErrRecordNotFound
+    }
+
+    c := copyIdempotentRequest(req)
+    c.RequestHash = stored.RequestHash
+    c.Expiry = stored.Expiry
+    m.s.idempotency[k] = c
+
+    return nil
+}
+
+// Delete removes the request of a user with the given key.
+func (m *IdempotencyModel) Delete(ctx context.Context, userID int64, key string) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    delete(m.s.idempotency, idempotencyKey{userID, key})
+
+    return nil
+}
+
+// DeleteExpired deletes all expired requests and returns how many were deleted.
+func (m *IdempotencyModel) DeleteExpired(ctx context.Context) (int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var n int64
+    for k, stored := range m.s.idempotency {
+        if stored.Expiry.Before(time.Now()) {
+            delete(m.s.idempotency, k)
+            n++
+        }
+    }
+
+    return n, nil
+}
+
+func copyIdempotentRequest(req *data.IdempotentRequest) *data.IdempotentRequest {
+    c := *req
+    c.RequestHash = append([]byte(nil), req.RequestHash...)
+    c.Header = req.Header.Clone()
+    c.Body = append([]byte(nil), req.Body...)
+    return &c
+}
@@ -0,0 +1,154 @@
+// Package mock provides in-memory implementations of the data stores so that HTTP handlers can
+// be exercised in tests without a running PostgreSQL server.
+package mock
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// Fixture values seeded by NewModels.
+const (
+    FixturePassword = "pa55word"
+
+    ActivatedUserID    int64 = 1
+    ActivatedUserEmail       = "alice@example.com"
+    InactiveUserID     int64 = 2
+    InactiveUserEmail        = "bob@example.com"
+    ReadOnlyUserID     int64 = 3
+    ReadOnlyUserEmail        = "carol@example.com"
+    AdminUserID        int64 = 4
+    AdminUserEmail           = "admin@example.com"
+)
+
+// store holds the state shared by all the mock models returned from a single NewModels call.
+type store struct {
+    mu            sync.Mutex
+    movies        map[int64]*data.Movie
+    nextMovieID   int64
+    genres        map[int64]*data.Genre
+    nextGenreID   int64
+    users         map[int64]*data.User
+    nextUserID    int64
+    tokens        map[[32]byte]*data.Token
+    nextTokenID   int64
+    permissions   map[int64][]string
+    permCodes     data.Permissions
+    posters       map[int64]*data.Poster
+    stats         *data.MovieStats
+    idempotency   map[idempotencyKey]*data.IdempotentRequest
+    auditEvents   []*data.AuditEvent
+    outbox        []*outboxEntry
+    reminded      map[int64]time.Time
+    lastUsedCalls int
+}
+
+var (
+    fixtureOnce  sync.Once
+    fixtureUsers []data.User
+)
+
+// seedUsers builds the fixture users once per test binary, because hashing the password with
+// bcrypt is deliberately slow.
+func seedUsers() []data.User {
+    fixtureOnce.Do(func() {
+        users := []data.User{
+            {ID: ActivatedUserID, Name: "Alice", Email: ActivatedUserEmail, Activated: true, Version: 1},
+            {ID: InactiveUserID, Name: "Bob", Email: InactiveUserEmail, Activated: false, Version: 1},
+            {ID: ReadOnlyUserID, Name: "Carol", Email: ReadOnlyUserEmail, Activated: true, Version: 1},
+            {ID: AdminUserID, Name: "Admin", Email: AdminUserEmail, Activated: true, Version: 1},
+        }
+
+        // The users are created a month apart: Alice on 2024-01-01, Bob on 2024-02-01, etc.
+        for i := range users {
+            err := users[i].Password.Set(FixturePassword)
+            if err != nil {
+                panic(err)
+            }
+            users[i].CreatedAt = time.Date(2024, time.Month(i+1), 1, 0, 0, 0, 0, time.UTC)
+        }
+
+        fixtureUsers = users
+    })
+
+    return fixtureUsers
+}
+
+// NewModels returns a data.Models backed by a fresh in-memory store seeded with fixtures:
+// three movies, the genres created by the migrations, an activated user with movie:read and
+// movie:write, an inactive user, an activated user with movie:read only, and an admin with
+// movie:read, movie:write, users:admin and genres:write.
+func NewModels() data.Models {
+    s := &store{
+        movies:      make(map[int64]*data.Movie),
+        genres:      make(map[int64]*data.Genre),
+        users:       make(map[int64]*data.User),
+        tokens:      make(map[[32]byte]*data.Token),
+        permissions: make(map[int64][]string),
+        permCodes:   slices.Clone(permissionCodes),
+        posters:     make(map[int64]*data.Poster),
+        idempotency: make(map[idempotencyKey]*data.IdempotentRequest),
+        reminded:    make(map[int64]time.Time),
+    }
+
+    createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    movies := []data.Movie{
+        {Title: "Moana", Year: 2016, Runtime: 107, Genres: []string{"animation", "adventure"}},
+        {Title: "Black Panther", Year: 2018, Runtime: 134, Genres: []string{"action", "adventure"}},
+        {Title: "Deadpool", Year: 2016, Runtime: 108, Genres: []string{"action", "comedy"}},
+    }
+    for i := range movies {
+        s.nextMovieID++
+        movies[i].ID = s.nextMovieID
+        movies[i].CreatedAt = createdAt
+        movies[i].UpdatedAt = createdAt
+        movies[i].Version = 1
+        s.movies[movies[i].ID] = &movies[i]
+    }
+
+    for _, name := range genreNames {
+        s.nextGenreID++
+        s.genres[s.nextGenreID] = &data.Genre{ID: s.nextGenreID, CreatedAt: createdAt, Name: name}
+    }
+
+    for _, u := range seedUsers() {
+        user := u
+        s.users[user.ID] = &user
+        s.nextUserID = max(s.nextUserID, user.ID)
+    }
+
+    s.permissions[ActivatedUserID] = []string{"movie:read", "movie:write"}
+    s.permissions[ReadOnlyUserID] = []string{"movie:read"}
+    s.permissions[AdminUserID] = []string{"movie:read", "movie:write", "users:admin", "genres:write"}
+
+    // The migration creating the statistics view populates it.
+    s.refreshStats()
+
+    return data.Models{
+        Audit:       &AuditModel{s: s},
+        Genre:       &GenreModel{s: s},
+        Idempotency: &IdempotencyModel{s: s},
+        Movie:       &MovieModel{s: s},
+        Outbox:      &OutboxModel{s: s},
+        Permission:  &PermissionModel{s: s},
+        Poster:      &PosterModel{s: s},
+        Stats:       &StatsModel{s: s},
+        Token:       &TokenModel{s: s},
+        User:        &UserModel{s: s},
+    }
+}
+
+func copyMovie(m *data.Movie) *data.Movie {
+    c := *m
+    c.Genres = append([]string(nil), m.Genres...)
+    return &c
+}
+
+func copyUser(u *data.User) *data.User {
+    c := *u
+    return &c
+}
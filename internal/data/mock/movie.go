@@ -0,0 +1,399 @@
+package mock
+
+import (
+	"context"
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// MovieModel is an in-memory data.MovieStore.
+type MovieModel struct {
+    s *store
+}
+
+// Insert adds a copy of movie to the store and sets its ID, CreatedAt, UpdatedAt and Version.
+func (m *MovieModel) Insert(ctx context.Context, movie *data.Movie) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    if id := m.duplicateOf(movie); id != 0 {
+        return &data.DuplicateMovieError{ID: id}
+    }
+
+    m.s.nextMovieID++
+    movie.ID = m.s.nextMovieID
+    movie.CreatedAt = time.Now()
+    movie.UpdatedAt = movie.CreatedAt
+    movie.Version = 1
+
+    m.s.movies[movie.ID] = copyMovie(movie)
+
+    return nil
+}
+
+// duplicateOf returns the ID of another movie with the title and year of movie, or 0 if there is
+// none, like the unique constraint of the movie table. The caller must hold the store mutex.
+func (m *MovieModel) duplicateOf(movie *data.Movie) int64 {
+    for id, other := range m.s.movies {
+        if id != movie.ID && other.Title == movie.Title && other.Year == movie.Year {
+            return id
+        }
+    }
+
+    return 0
+}
+
+// Get returns a copy of the movie with the given id.
+func (m *MovieModel) Get(ctx context.Context, id int64) (*data.Movie, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    movie, ok := m.s.movies[id]
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    return copyMovie(movie), nil
+}
+
+// GetAll mimics the filtering, sorting and pagination of data.MovieModel.GetAll.
+func (m *MovieModel) GetAll(ctx context.Context, params data.MovieListParams, filter data.Filter) ([]*data.Movie, data.Metadata, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var matched []*data.Movie
+    for _, movie := range m.s.movies {
+        if matches(movie, params) {
+            matched = append(matched, copyMovie(movie))
+        }
+    }
+
+    if !slices.Contains(filter.SortSafeList, filter.Sort) {
+        return nil, data.Metadata{}, fmt.Errorf("%w: %q", data.ErrInvalidSort, filter.Sort)
+    }
+
+    column := strings.TrimPrefix(filter.Sort, "-")
+    desc := strings.HasPrefix(filter.Sort, "-")
+
+    slices.SortFunc(matched, func(a, b *data.Movie) int {
+        var c int
+        switch column {
+        case "title":
+            c = cmp.Compare(a.Title, b.Title)
+        case "year":
+            c = cmp.Compare(a.Year, b.Year)
+        case "runtime":
+            c = cmp.Compare(a.Runtime, b.Runtime)
+        case "created_at":
+            c = a.CreatedAt.Compare(b.CreatedAt)
+        case "updated_at":
+            c = a.UpdatedAt.Compare(b.UpdatedAt)
+        }
+        if desc {
+            c = -c
+        }
+        if c == 0 {
+            c = cmp.Compare(a.ID, b.ID)
+            if column == "id" && desc {
+                c = -c
+            }
+        }
+        return c
+    })
+
+    total := len(matched)
+    offset := (filter.Page - 1) * filter.PageSize
+    movies := []*data.Movie{}
+    pastMaxOffset := filter.MaxOffset > 0 && offset > filter.MaxOffset
+    if offset < total && !pastMaxOffset {
+        movies = matched[offset:min(offset+filter.PageSize, total)]
+    }
+
+    if filter.SkipTotal {
+        return movies, data.MetadataWithoutTotal(filter.Page, filter.PageSize, offset+filter.PageSize < total && !pastMaxOffset), nil
+    }
+
+    return movies, metadata(total, filter.Page, filter.PageSize), nil
+}
+
+// matches reports whether movie passes the filters of params.
+func matches(movie *data.Movie, params data.MovieListParams) bool {
+    words := strings.Fields(strings.ToLower(params.Title))
+    titleWords := strings.Fields(strings.ToLower(movie.Title))
+
+    matchGenres := containsAll
+    if params.MatchAnyGenre && len(params.Genres) > 0 {
+        matchGenres = containsAny
+    }
+
+    if !inWindow(movie.UpdatedAt, params.UpdatedSince, nil) ||
+        !inWindow(movie.CreatedAt, params.CreatedAfter, params.CreatedBefore) ||
+        !inWindow(movie.UpdatedAt, params.UpdatedAfter, params.UpdatedBefore) {
+        return false
+    }
+
+    return containsAll(titleWords, words) && matchGenres(movie.Genres, params.Genres)
+}
+
+// inWindow reports whether t is at or after start and before end, a nil bound not limiting it.
+func inWindow(t time.Time, start, end *time.Time) bool {
+    return (start == nil || !t.Before(*start)) && (end == nil || t.Before(*end))
+}
+
+// LastUpdated returns the latest UpdatedAt of the movies GetAll would match, or the zero time.
+func (m *MovieModel) LastUpdated(ctx context.Context, params data.MovieListParams) (time.Time, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var lastUpdated time.Time
+    for _, movie := range m.s.movies {
+        if matches(movie, params) && movie.UpdatedAt.After(lastUpdated) {
+            lastUpdated = movie.UpdatedAt
+        }
+    }
+
+    return lastUpdated, nil
+}
+
+// GetAllIter calls fn for each movie GetAll would return.
+func (m *MovieModel) GetAllIter(ctx context.Context, params data.MovieListParams, filter data.Filter, fn func(movie *data.Movie, totalRecords int) error) (data.Metadata, error) {
+    movies, metadata, err := m.GetAll(ctx, params, filter)
+    if err != nil {
+        return data.Metadata{}, err
+    }
+
+    totalRecords := metadata.TotalRecords
+    if filter.SkipTotal {
+        totalRecords = -1
+    }
+
+    for _, movie := range movies {
+        err = fn(movie, totalRecords)
+        if err != nil {
+            return data.Metadata{}, err
+        }
+    }
+
+    return metadata, nil
+}
+
+// ForEach calls fn for a copy of each movie matching params, in order of UpdatedAt then ID. The
+// store isn't locked while fn runs.
+func (m *MovieModel) ForEach(ctx context.Context, params data.MovieListParams, fn func(movie *data.Movie) error) error {
+    m.s.mu.Lock()
+
+    var matched []*data.Movie
+    for _, movie := range m.s.movies {
+        if matches(movie, params) {
+            matched = append(matched, copyMovie(movie))
+        }
+    }
+
+    m.s.mu.Unlock()
+
+    slices.SortFunc(matched, func(a, b *data.Movie) int {
+        return cmp.Or(a.UpdatedAt.Compare(b.UpdatedAt), cmp.Compare(a.ID, b.ID))
+    })
+
+    for _, movie := range matched {
+        if err := ctx.Err(); err != nil {
+            return err
+        }
+
+        err := fn(movie)
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// GetSimilar mimics the ranking of data.MovieModel.GetSimilar.
+func (m *MovieModel) GetSimilar(ctx context.Context, id int64, limit int) ([]*data.Movie, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    movies := []*data.Movie{}
+
+    target, ok := m.s.movies[id]
+    if !ok {
+        return movies, nil
+    }
+
+    shared := func(movie *data.Movie) int {
+        n := 0
+        for _, genre := range movie.Genres {
+            if slices.Contains(target.Genres, genre) {
+                n++
+            }
+        }
+        return n
+    }
+
+    yearDistance := func(movie *data.Movie) int32 {
+        return max(movie.Year-target.Year, target.Year-movie.Year)
+    }
+
+    for _, movie := range m.s.movies {
+        if movie.ID != id && shared(movie) > 0 {
+            movies = append(movies, copyMovie(movie))
+        }
+    }
+
+    slices.SortFunc(movies, func(a, b *data.Movie) int {
+        return cmp.Or(
+            cmp.Compare(shared(b), shared(a)),
+            cmp.Compare(yearDistance(a), yearDistance(b)),
+            cmp.Compare(a.ID, b.ID),
+        )
+    })
+
+    return movies[:min(limit, len(movies))], nil
+}
+
+// FindPotentialDuplicates mimics data.MovieModel.FindPotentialDuplicates, with the trigram
+// similarity of pg_trgm.
+func (m *MovieModel) FindPotentialDuplicates(ctx context.Context, title string, year int32, threshold float64) ([]data.MovieDuplicate, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    duplicates := []data.MovieDuplicate{}
+
+    for _, movie := range m.s.movies {
+        score := similarity(movie.Title, title)
+        if movie.Year == year && score >= threshold {
+            duplicates = append(duplicates, data.MovieDuplicate{
+                ID:         movie.ID,
+                Title:      movie.Title,
+                Year:       movie.Year,
+                Similarity: math.Round(score*100) / 100,
+            })
+        }
+    }
+
+    slices.SortFunc(duplicates, func(a, b data.MovieDuplicate) int {
+        return cmp.Or(cmp.Compare(b.Similarity, a.Similarity), cmp.Compare(a.ID, b.ID))
+    })
+
+    return duplicates[:min(data.MaxMovieDuplicates, len(duplicates))], nil
+}
+
+// similarity is the similarity function of pg_trgm: the number of trigrams a and b share
+// divided by the number of distinct trigrams in either.
+func similarity(a, b string) float64 {
+    ta, tb := trigrams(a), trigrams(b)
+
+    shared := 0
+    for t := range ta {
+        if tb[t] {
+            shared++
+        }
+    }
+
+    if total := len(ta) + len(tb) - shared; total > 0 {
+        return float64(shared) / float64(total)
+    }
+    return 0
+}
+
+// trigrams returns the trigrams of s as pg_trgm extracts them: each word, made of letters and
+// digits, is lowercased and padded with two spaces before and one after.
+func trigrams(s string) map[string]bool {
+    set := make(map[string]bool)
+
+    words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+    })
+
+    for _, word := range words {
+        padded := []rune("  " + word + " ")
+        for i := 0; i+3 <= len(padded); i++ {
+            set[string(padded[i:i+3])] = true
+        }
+    }
+
+    return set
+}
+
+// Update replaces the stored movie, returning data.ErrEditConflict on a version mismatch.
+func (m *MovieModel) Update(ctx context.Context, movie *data.Movie) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stored, ok := m.s.movies[movie.ID]
+    if !ok || stored.Version != movie.Version {
+        return data.ErrEditConflict
+    }
+
+    if id := m.duplicateOf(movie); id != 0 {
+        return &data.DuplicateMovieError{ID: id}
+    }
+
+    movie.Version++
+    movie.UpdatedAt = time.Now()
+    m.s.movies[movie.ID] = copyMovie(movie)
+
+    return nil
+}
+
+// Delete removes the movie with the given id, and its poster if cascade is true. Without
+// cascade, a movie with a poster isn't removed.
+func (m *MovieModel) Delete(ctx context.Context, id int64, cascade bool) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    if _, ok := m.s.movies[id]; !ok {
+        return data.ErrRecordNotFound
+    }
+
+    if _, ok := m.s.posters[id]; ok {
+        if !cascade {
+            return &data.MovieReferencedError{Dependents: data.MovieDependents{Posters: 1}}
+        }
+        delete(m.s.posters, id)
+    }
+
+    delete(m.s.movies, id)
+
+    return nil
+}
+
+func containsAll(have, want []string) bool {
+    for _, w := range want {
+        if !slices.Contains(have, w) {
+            return false
+        }
+    }
+    return true
+}
+
+func containsAny(have, want []string) bool {
+    for _, w := range want {
+        if slices.Contains(have, w) {
+            return true
+        }
+    }
+    return false
+}
+
+func metadata(totalRecords, page, pageSize int) data.Metadata {
+    if totalRecords == 0 {
+        return data.Metadata{}
+    }
+
+    return data.Metadata{
+        CurrentPage:  page,
+        PageSize:     pageSize,
+        FirstPage:    1,
+        LastPage:     (totalRecords + pageSize - 1) / pageSize,
+        TotalRecords: totalRecords,
+    }
+}
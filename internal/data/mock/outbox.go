@@ -0,0 +1,182 @@
+package mock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// outboxEntry is an email in the outbox with its delivery state. The entries of deleted emails
+// are nil, so that the IDs stay the indexes plus one.
+type outboxEntry struct {
+    email         data.OutboxEmail
+    nextAttemptAt *time.Time // nil once sent or given up
+    sentAt        *time.Time
+}
+
+// OutboxModel is an in-memory data.OutboxStore.
+type OutboxModel struct {
+    s *store
+}
+
+// insert queues a copy of email with its payload round-tripped through JSON, as it would be
+// through the jsonb column. The caller must hold the store's lock.
+func (m *OutboxModel) insert(email *data.OutboxEmail) error {
+    b, err := json.Marshal(email.Payload)
+    if err != nil {
+        return err
+    }
+
+    now := time.Now()
+
+    email.ID = int64(len(m.s.outbox) + 1)
+    email.CreatedAt = now
+
+    entry := &outboxEntry{email: *email, nextAttemptAt: &now}
+
+    dec := json.NewDecoder(bytes.NewReader(b))
+    dec.UseNumber()
+
+    err = dec.Decode(&entry.email.Payload)
+    if err != nil {
+        return err
+    }
+
+    m.s.outbox = append(m.s.outbox, entry)
+
+    return nil
+}
+
+// Claim returns copies of up to limit emails which are due, oldest first, and postpones their
+// next attempt by lease.
+func (m *OutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*data.OutboxEmail, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    now := time.Now()
+    emails := []*data.OutboxEmail{}
+
+    for _, entry := range m.s.outbox {
+        if len(emails) == limit {
+            break
+        }
+        if entry == nil || entry.nextAttemptAt == nil || entry.nextAttemptAt.After(now) {
+            continue
+        }
+
+        next := now.Add(lease)
+        entry.nextAttemptAt = &next
+
+        email := entry.email
+        emails = append(emails, &email)
+    }
+
+    return emails, nil
+}
+
+// MarkSent records that an email was sent and clears its payload.
+func (m *OutboxModel) MarkSent(ctx context.Context, id int64) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    entry := m.get(id)
+    if entry == nil {
+        return data.ErrRecordNotFound
+    }
+
+    now := time.Now()
+    entry.sentAt = &now
+    entry.nextAttemptAt = nil
+    entry.email.Payload = map[string]any{}
+
+    return nil
+}
+
+// MarkFailed records a failed attempt to send an email, which is tried again at retryAt, or
+// never if retryAt is nil, in which case its payload is cleared.
+func (m *OutboxModel) MarkFailed(ctx context.Context, id int64, lastError string, retryAt *time.Time) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    entry := m.get(id)
+    if entry == nil {
+        return data.ErrRecordNotFound
+    }
+
+    entry.email.Attempts++
+    entry.email.LastError = lastError
+    entry.nextAttemptAt = retryAt
+    if retryAt == nil {
+        entry.email.Payload = map[string]any{}
+    }
+
+    return nil
+}
+
+// get returns the entry with the given ID, or nil. The caller must hold the store's lock.
+func (m *OutboxModel) get(id int64) *outboxEntry {
+    if id < 1 || id > int64(len(m.s.outbox)) {
+        return nil
+    }
+
+    return m.s.outbox[id-1]
+}
+
+// deleteFor deletes the emails to recipient. The caller must hold the store's lock.
+func (m *OutboxModel) deleteFor(recipient string) {
+    for i, entry := range m.s.outbox {
+        if entry != nil && strings.EqualFold(entry.email.Recipient, recipient) {
+            m.s.outbox[i] = nil
+        }
+    }
+}
+
+// Pending returns copies of the emails which are neither sent nor given up, in the order they
+// were queued.
+func (m *OutboxModel) Pending() []data.OutboxEmail {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var emails []data.OutboxEmail
+    for _, entry := range m.s.outbox {
+        if entry != nil && entry.nextAttemptAt != nil {
+            emails = append(emails, entry.email)
+        }
+    }
+
+    return emails
+}
+
+// Sent returns copies of the emails which were sent, in the order they were queued.
+func (m *OutboxModel) Sent() []data.OutboxEmail {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var emails []data.OutboxEmail
+    for _, entry := range m.s.outbox {
+        if entry != nil && entry.sentAt != nil {
+            emails = append(emails, entry.email)
+        }
+    }
+
+    return emails
+}
+
+// GivenUp returns copies of the emails which were given up, in the order they were queued.
+func (m *OutboxModel) GivenUp() []data.OutboxEmail {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var emails []data.OutboxEmail
+    for _, entry := range m.s.outbox {
+        if entry != nil && entry.nextAttemptAt == nil && entry.sentAt == nil {
+            emails = append(emails, entry.email)
+        }
+    }
+
+    return emails
+}
@@ -0,0 +1,128 @@
+package mock
+
+import (
+	"context"
+	"maps"
+	"slices"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// PermissionModel is an in-memory data.PermissionStore.
+type PermissionModel struct {
+    s *store
+}
+
+// permissionCodes are the permission codes created by the migrations, which each store starts
+// with.
+var permissionCodes = data.Permissions{"movie:read", "movie:write", "movie:delete", "users:admin", "users:read", "genres:write"}
+
+// GetAll returns all permission codes.
+func (m *PermissionModel) GetAll(ctx context.Context) (data.Permissions, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    return slices.Clone(m.s.permCodes), nil
+}
+
+// GetAllForUser returns all permission codes for a specific user.
+func (m *PermissionModel) GetAllForUser(ctx context.Context, userID int64) (data.Permissions, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    return slices.Clone(data.Permissions(m.s.permissions[userID])), nil
+}
+
+// AddForUser adds the provided permissions for a specific user.
+func (m *PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    for _, code := range codes {
+        if !slices.Contains(m.s.permissions[userID], code) {
+            m.s.permissions[userID] = append(m.s.permissions[userID], code)
+        }
+    }
+
+    return nil
+}
+
+// RemoveForUser removes the provided permissions from a specific user.
+func (m *PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    m.s.permissions[userID] = slices.DeleteFunc(m.s.permissions[userID], func(code string) bool {
+        return slices.Contains(codes, code)
+    })
+
+    return nil
+}
+
+// ExportGrants returns the permission codes of every user who has any, sorted by code.
+func (m *PermissionModel) ExportGrants(ctx context.Context) (data.PermissionGrants, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    grants := data.PermissionGrants{}
+
+    for userID, codes := range m.s.permissions {
+        user, ok := m.s.users[userID]
+        if !ok || len(codes) == 0 {
+            continue
+        }
+
+        grants[user.Email] = slices.Sorted(slices.Values(codes))
+    }
+
+    return grants, nil
+}
+
+// ImportGrants mimics data.PermissionModel.ImportGrants.
+func (m *PermissionModel) ImportGrants(ctx context.Context, grants data.PermissionGrants, createMissing bool) (*data.PermissionImportReport, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    report := &data.PermissionImportReport{Created: []string{}, UnknownEmails: []string{}, UnknownCodes: []string{}}
+
+    var codes []string
+    for _, userCodes := range grants {
+        codes = append(codes, userCodes...)
+    }
+    slices.Sort(codes)
+    codes = slices.Compact(codes)
+
+    for _, code := range codes {
+        switch {
+        case m.s.permCodes.Include(code):
+        case createMissing:
+            m.s.permCodes = append(m.s.permCodes, code)
+            report.Created = append(report.Created, code)
+        default:
+            report.UnknownCodes = append(report.UnknownCodes, code)
+        }
+    }
+
+    for _, email := range slices.Sorted(maps.Keys(grants)) {
+        user := m.s.userByEmail(data.NormalizeEmail(email))
+        if user == nil {
+            report.UnknownEmails = append(report.UnknownEmails, email)
+            continue
+        }
+
+        userCodes := slices.Sorted(slices.Values(grants[email]))
+
+        for _, code := range slices.Compact(userCodes) {
+            switch {
+            case !m.s.permCodes.Include(code):
+            case slices.Contains(m.s.permissions[user.ID], code):
+                report.AlreadyPresent++
+            default:
+                m.s.permissions[user.ID] = append(m.s.permissions[user.ID], code)
+                report.Added++
+            }
+        }
+    }
+
+    return report, nil
+}
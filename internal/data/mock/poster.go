@@ -0,0 +1,51 @@
+package mock
+
+import (
+	"context"
+	"greenlight.zzh.net/internal/data"
+)
+
+// PosterModel is an in-memory data.PosterStore.
+type PosterModel struct {
+    s *store
+}
+
+// Put stores a copy of the poster, replacing any existing one for the movie.
+func (m *PosterModel) Put(ctx context.Context, poster *data.Poster) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    p := *poster
+    p.Data = append([]byte(nil), poster.Data...)
+    m.s.posters[poster.MovieID] = &p
+
+    return nil
+}
+
+// Get returns a copy of the poster of a movie.
+func (m *PosterModel) Get(ctx context.Context, movieID int64) (*data.Poster, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    poster, ok := m.s.posters[movieID]
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    p := *poster
+    return &p, nil
+}
+
+// Delete removes the poster of a movie.
+func (m *PosterModel) Delete(ctx context.Context, movieID int64) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    if _, ok := m.s.posters[movieID]; !ok {
+        return data.ErrRecordNotFound
+    }
+
+    delete(m.s.posters, movieID)
+
+    return nil
+}
@@ -0,0 +1,68 @@
+package mock
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// StatsModel is an in-memory data.StatsStore. Like the materialized view, the statistics only
+// change when they are refreshed.
+type StatsModel struct {
+    s *store
+}
+
+// Get returns a copy of the statistics as of the last Refresh.
+func (m *StatsModel) Get(ctx context.Context) (*data.MovieStats, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stats := *m.s.stats
+    stats.ByGenre = slices.Clone(stats.ByGenre)
+    stats.ByDecade = slices.Clone(stats.ByDecade)
+
+    return &stats, nil
+}
+
+// Refresh recomputes the statistics from the movies.
+func (m *StatsModel) Refresh(ctx context.Context) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    m.s.refreshStats()
+
+    return nil
+}
+
+// refreshStats computes the statistics from the movies. The caller must hold the mutex.
+func (s *store) refreshStats() {
+    genres := make(map[string]int64)
+    decades := make(map[int]int64)
+
+    for _, movie := range s.movies {
+        for _, genre := range movie.Genres {
+            genres[genre]++
+        }
+        decades[int(movie.Year)/10*10]++
+    }
+
+    stats := &data.MovieStats{
+        Total:       int64(len(s.movies)),
+        ByGenre:     []data.GenreCount{},
+        ByDecade:    []data.DecadeCount{},
+        RefreshedAt: time.Now(),
+    }
+
+    for _, genre := range slices.Sorted(maps.Keys(genres)) {
+        stats.ByGenre = append(stats.ByGenre, data.GenreCount{Genre: genre, Movies: genres[genre]})
+    }
+    for _, decade := range slices.SortedFunc(maps.Keys(decades), cmp.Compare[int]) {
+        stats.ByDecade = append(stats.ByDecade, data.DecadeCount{Decade: decade, Movies: decades[decade]})
+    }
+
+    s.stats = stats
+}
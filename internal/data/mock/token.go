@@ -0,0 +1,251 @@
+package mock
+
+import (
+	"context"
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"slices"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// TokenModel is an in-memory data.TokenStore.
+type TokenModel struct {
+    s *store
+}
+
+// New generates a token in the same format as data.TokenModel.New and stores it.
+func (m *TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*data.Token, error) {
+    randomBytes := make([]byte, 16)
+
+    _, err := rand.Read(randomBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    expiry := time.Now().Add(ttl)
+
+    token := &data.Token{
+        Plaintext: base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+        UserID:    userID,
+        Expiry:    &expiry,
+        Scope:     scope,
+    }
+
+    hash := sha256.Sum256([]byte(token.Plaintext))
+    token.Hash = hash[:]
+    token.Prefix = token.Plaintext[:8]
+
+    err = m.Insert(ctx, token)
+    return token, err
+}
+
+// NewAPIKey generates an API key in the same format as data.TokenModel.NewAPIKey and stores it.
+func (m *TokenModel) NewAPIKey(ctx context.Context, userID int64, name string) (*data.Token, error) {
+    randomBytes := make([]byte, 20)
+
+    _, err := rand.Read(randomBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    token := &data.Token{
+        Plaintext: data.APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes),
+        UserID:    userID,
+        Name:      name,
+        Scope:     data.ScopeAPIKey,
+    }
+
+    hash := sha256.Sum256([]byte(token.Plaintext))
+    token.Hash = hash[:]
+    token.Prefix = token.Plaintext[:len(data.APIKeyPrefix)+8]
+
+    err = m.Insert(ctx, token)
+    return token, err
+}
+
+// Insert stores a copy of token keyed by its hash.
+func (m *TokenModel) Insert(ctx context.Context, token *data.Token) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var key [32]byte
+    copy(key[:], token.Hash)
+
+    m.s.nextTokenID++
+    token.ID = m.s.nextTokenID
+    token.CreatedAt = time.Now()
+
+    t := *token
+    t.Plaintext = ""
+    m.s.tokens[key] = &t
+
+    return nil
+}
+
+// GetAllForUser returns copies of the unexpired tokens of a user with the given scope, newest
+// first.
+func (m *TokenModel) GetAllForUser(ctx context.Context, userID int64, scope string) ([]*data.Token, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    tokens := []*data.Token{}
+    for _, token := range m.s.tokens {
+        if m.live(token, userID, scope) {
+            t := *token
+            tokens = append(tokens, &t)
+        }
+    }
+
+    slices.SortFunc(tokens, func(a, b *data.Token) int {
+        return cmp.Compare(b.ID, a.ID)
+    })
+
+    return tokens, nil
+}
+
+// CountForUser returns the number of unexpired tokens of a user with the given scope.
+func (m *TokenModel) CountForUser(ctx context.Context, userID int64, scope string) (int, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    count := 0
+    for _, token := range m.s.tokens {
+        if m.live(token, userID, scope) {
+            count++
+        }
+    }
+
+    return count, nil
+}
+
+// UpdateLastUsed mimics data.TokenModel.UpdateLastUsed.
+func (m *TokenModel) UpdateLastUsed(ctx context.Context, tokenHash []byte) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var key [32]byte
+    copy(key[:], tokenHash)
+
+    m.s.lastUsedCalls++
+
+    now := time.Now()
+    if token, ok := m.s.tokens[key]; ok && data.LastUsedDue(token.LastUsedAt, now) {
+        token.LastUsedAt = &now
+    }
+
+    return nil
+}
+
+// LastUsedCalls returns the number of times UpdateLastUsed was called.
+func (m *TokenModel) LastUsedCalls() int {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    return m.s.lastUsedCalls
+}
+
+// ExtendExpiry mimics data.TokenModel.ExtendExpiry.
+func (m *TokenModel) ExtendExpiry(ctx context.Context, tokenHash []byte, newExpiry time.Time) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var key [32]byte
+    copy(key[:], tokenHash)
+
+    token, ok := m.s.tokens[key]
+    if ok && token.Scope == data.ScopeAuthentication && token.Expiry != nil && token.Expiry.Before(newExpiry) {
+        token.Expiry = &newExpiry
+    }
+
+    return nil
+}
+
+// DeleteForUser deletes a token of a user by ID and scope.
+func (m *TokenModel) DeleteForUser(ctx context.Context, id, userID int64, scope string) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    for key, token := range m.s.tokens {
+        if token.ID == id && token.UserID == userID && token.Scope == scope {
+            delete(m.s.tokens, key)
+            return nil
+        }
+    }
+
+    return data.ErrRecordNotFound
+}
+
+// DeleteAllForUserExcept deletes all tokens for a specific user and scope except the one with
+// the given hash.
+func (m *TokenModel) DeleteAllForUserExcept(ctx context.Context, userID int64, scope string, keepHash []byte) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    for key, token := range m.s.tokens {
+        if token.UserID == userID && token.Scope == scope && !bytes.Equal(token.Hash, keepHash) {
+            delete(m.s.tokens, key)
+        }
+    }
+
+    return nil
+}
+
+// live reports whether token belongs to the user, has the scope and hasn't expired. The caller
+// must hold the store mutex.
+func (m *TokenModel) live(token *data.Token, userID int64, scope string) bool {
+    return token.UserID == userID && token.Scope == scope && (token.Expiry == nil || token.Expiry.After(time.Now()))
+}
+
+// DeleteAllForUser deletes all tokens for a specific user and scope and returns how many were
+// deleted.
+func (m *TokenModel) DeleteAllForUser(ctx context.Context, userID int64, scope string) (int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var n int64
+    for key, token := range m.s.tokens {
+        if token.UserID == userID && token.Scope == scope {
+            delete(m.s.tokens, key)
+            n++
+        }
+    }
+
+    return n, nil
+}
+
+// DeleteAllForUserAllScopes deletes all tokens of a user and returns how many were deleted.
+func (m *TokenModel) DeleteAllForUserAllScopes(ctx context.Context, userID int64) (int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var n int64
+    for key, token := range m.s.tokens {
+        if token.UserID == userID {
+            delete(m.s.tokens, key)
+            n++
+        }
+    }
+
+    return n, nil
+}
+
+// DeleteExpired deletes all expired tokens and returns how many were deleted.
+func (m *TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var n int64
+    for key, token := range m.s.tokens {
+        if token.Expiry != nil && token.Expiry.Before(time.Now()) {
+            delete(m.s.tokens, key)
+            n++
+        }
+    }
+
+    return n, nil
+}
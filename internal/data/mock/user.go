@@ -0,0 +1,513 @@
+package mock
+
+import (
+	"context"
+	"cmp"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"greenlight.zzh.net/internal/data"
+)
+
+// UserModel is an in-memory data.UserStore.
+type UserModel struct {
+    s *store
+}
+
+// Insert adds a copy of user to the store, returning data.ErrDuplicateEmail if the email is taken.
+func (m *UserModel) Insert(ctx context.Context, user *data.User) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    user.Email = data.NormalizeEmail(user.Email)
+
+    if m.emailTaken(user.Email, 0) {
+        return data.ErrDuplicateEmail
+    }
+
+    m.s.nextUserID++
+    user.ID = m.s.nextUserID
+    user.CreatedAt = time.Now()
+    user.Version = 1
+
+    m.s.users[user.ID] = copyUser(user)
+
+    return nil
+}
+
+// Register adds a copy of user with the permissions and an activation token of reg, and queues
+// the welcome email in the outbox if reg.Email is set. Nothing is stored if the email
+// is taken.
+func (m *UserModel) Register(ctx context.Context, user *data.User, reg data.Registration) (*data.Token, error) {
+    err := m.Insert(ctx, user)
+    if err != nil {
+        return nil, err
+    }
+
+    err = (&PermissionModel{s: m.s}).AddForUser(ctx, user.ID, reg.Permissions...)
+    if err != nil {
+        return nil, err
+    }
+
+    token, err := (&TokenModel{s: m.s}).New(ctx, user.ID, reg.ActivationTTL, data.ScopeActivation)
+    if err != nil {
+        return nil, err
+    }
+
+    if reg.Email == nil {
+        return token, nil
+    }
+
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    err = (&OutboxModel{s: m.s}).insert(&data.OutboxEmail{
+        Recipient: user.Email,
+        Template:  reg.Email.Template,
+        Payload:   reg.Email.Data(token),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// ForcePasswordReset mimics data.UserModel.ForcePasswordReset, without the atomicity: the mock
+// can't fail halfway.
+func (m *UserModel) ForcePasswordReset(ctx context.Context, user *data.User, ttl time.Duration, email *data.TokenEmail) (*data.Token, error) {
+    m.s.mu.Lock()
+    stored, ok := m.s.users[user.ID]
+    if ok {
+        stored.PasswordResetRequired = true
+        stored.Version++
+        user.PasswordResetRequired = true
+        user.Version = stored.Version
+    }
+    m.s.mu.Unlock()
+
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    tokens := &TokenModel{s: m.s}
+
+    _, err := tokens.DeleteAllForUserAllScopes(ctx, user.ID)
+    if err != nil {
+        return nil, err
+    }
+
+    token, err := tokens.New(ctx, user.ID, ttl, data.ScopePasswordReset)
+    if err != nil {
+        return nil, err
+    }
+
+    if email == nil {
+        return token, nil
+    }
+
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    err = (&OutboxModel{s: m.s}).insert(&data.OutboxEmail{
+        Recipient: user.Email,
+        Template:  email.Template,
+        Payload:   email.Data(token),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// GetAll mimics the filtering, sorting and pagination of data.UserModel.GetAll.
+func (m *UserModel) GetAll(ctx context.Context, params data.UserListParams, filter data.Filter) ([]*data.User, data.Metadata, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    var matched []*data.User
+    for _, user := range m.s.users {
+        switch {
+        case !strings.Contains(strings.ToLower(user.Email), strings.ToLower(params.Email)):
+        case params.Activated != nil && user.Activated != *params.Activated:
+        case params.CreatedAfter != nil && user.CreatedAt.Before(*params.CreatedAfter):
+        case params.CreatedBefore != nil && !user.CreatedAt.Before(*params.CreatedBefore):
+        default:
+            matched = append(matched, copyUser(user))
+        }
+    }
+
+    if !slices.Contains(filter.SortSafeList, filter.Sort) {
+        return nil, data.Metadata{}, fmt.Errorf("%w: %q", data.ErrInvalidSort, filter.Sort)
+    }
+
+    column := strings.TrimPrefix(filter.Sort, "-")
+    desc := strings.HasPrefix(filter.Sort, "-")
+
+    slices.SortFunc(matched, func(a, b *data.User) int {
+        var c int
+        switch column {
+        case "name":
+            c = cmp.Compare(a.Name, b.Name)
+        case "email":
+            c = cmp.Compare(a.Email, b.Email)
+        case "created_at":
+            c = a.CreatedAt.Compare(b.CreatedAt)
+        }
+        if desc {
+            c = -c
+        }
+        if c == 0 {
+            c = cmp.Compare(a.ID, b.ID)
+            if column == "id" && desc {
+                c = -c
+            }
+        }
+        return c
+    })
+
+    total := len(matched)
+    offset := (filter.Page - 1) * filter.PageSize
+    users := []*data.User{}
+    if offset < total {
+        users = matched[offset:min(offset+filter.PageSize, total)]
+    }
+
+    return users, metadata(total, filter.Page, filter.PageSize), nil
+}
+
+// Get returns a copy of the user with the given ID.
+func (m *UserModel) Get(ctx context.Context, id int64) (*data.User, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    user, ok := m.s.users[id]
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    return copyUser(user), nil
+}
+
+// GetByEmail returns a copy of the user with the given email address.
+func (m *UserModel) GetByEmail(ctx context.Context, email string) (*data.User, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    user := m.s.userByEmail(email)
+    if user == nil {
+        return nil, data.ErrRecordNotFound
+    }
+
+    return copyUser(user), nil
+}
+
+// userByEmail returns the stored user with the given email address, or nil. The caller must hold
+// s.mu.
+func (s *store) userByEmail(email string) *data.User {
+    for _, user := range s.users {
+        // Emails are compared on lower(email), so the comparison is case-insensitive.
+        if strings.EqualFold(user.Email, data.NormalizeEmail(email)) {
+            return user
+        }
+    }
+
+    return nil
+}
+
+// GetForToken returns a copy of the user owning an unexpired token with the given scope.
+func (m *UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*data.User, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    token, ok := m.s.tokens[sha256.Sum256([]byte(tokenPlaintext))]
+    if !ok || token.Scope != tokenScope || token.Expiry != nil && !token.Expiry.After(time.Now()) {
+        return nil, data.ErrRecordNotFound
+    }
+
+    user, ok := m.s.users[token.UserID]
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    u := copyUser(user)
+    u.TokenCreatedAt = token.CreatedAt
+    if token.Expiry != nil {
+        expiry := *token.Expiry
+        u.TokenExpiry = &expiry
+    }
+    if token.LastUsedAt != nil {
+        lastUsedAt := *token.LastUsedAt
+        u.TokenLastUsedAt = &lastUsedAt
+    }
+
+    return u, nil
+}
+
+// ActivateForToken mimics data.UserModel.ActivateForToken. The store mutex makes it atomic, so
+// that only one of concurrent activations with the same token succeeds.
+func (m *UserModel) ActivateForToken(ctx context.Context, tokenPlaintext string) (*data.User, int64, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    token, ok := m.s.tokens[sha256.Sum256([]byte(tokenPlaintext))]
+    if !ok || token.Scope != data.ScopeActivation || token.Expiry != nil && !token.Expiry.After(time.Now()) {
+        return nil, 0, data.ErrRecordNotFound
+    }
+
+    user, ok := m.s.users[token.UserID]
+    if !ok {
+        return nil, 0, data.ErrRecordNotFound
+    }
+
+    var deleted int64
+    for key, t := range m.s.tokens {
+        if t.UserID == user.ID && t.Scope == data.ScopeActivation {
+            delete(m.s.tokens, key)
+            deleted++
+        }
+    }
+
+    user.Activated = true
+    user.Version++
+
+    return copyUser(user), deleted, nil
+}
+
+// Update replaces the stored user, returning data.ErrEditConflict on a version mismatch.
+func (m *UserModel) Update(ctx context.Context, user *data.User) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stored, ok := m.s.users[user.ID]
+    if !ok || stored.Version != user.Version {
+        return data.ErrEditConflict
+    }
+
+    user.Email = data.NormalizeEmail(user.Email)
+
+    if m.emailTaken(user.Email, user.ID) {
+        return data.ErrDuplicateEmail
+    }
+
+    user.Version++
+    m.s.users[user.ID] = copyUser(user)
+
+    return nil
+}
+
+// emailTaken reports whether a user other than excludeID already has email. The caller must
+// hold the store mutex.
+func (m *UserModel) emailTaken(email string, excludeID int64) bool {
+    for _, user := range m.s.users {
+        if user.ID != excludeID && strings.EqualFold(user.Email, email) {
+            return true
+        }
+    }
+    return false
+}
+
+// UpdatePasswordHash stores the password of the user without bumping the version, returning
+// data.ErrEditConflict on a version mismatch.
+func (m *UserModel) UpdatePasswordHash(ctx context.Context, user *data.User) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    stored, ok := m.s.users[user.ID]
+    if !ok || stored.Version != user.Version {
+        return data.ErrEditConflict
+    }
+
+    stored.Password = user.Password
+
+    return nil
+}
+
+// UpdateLastLogin records the login details without bumping the version.
+func (m *UserModel) UpdateLastLogin(ctx context.Context, id int64, ip, userAgent string) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    user, ok := m.s.users[id]
+    if !ok {
+        return data.ErrRecordNotFound
+    }
+
+    now := time.Now()
+    user.LastLoginAt = &now
+    user.LastLoginIP = ip
+    user.LastLoginUserAgent = userAgent
+
+    return nil
+}
+
+// Delete removes a user together with their tokens and permissions.
+func (m *UserModel) Delete(ctx context.Context, id int64) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    if _, ok := m.s.users[id]; !ok {
+        return data.ErrRecordNotFound
+    }
+
+    m.deleteUserData(id)
+    delete(m.s.users, id)
+
+    return nil
+}
+
+// Anonymize removes the tokens and permissions of a user and scrubs their personal data.
+func (m *UserModel) Anonymize(ctx context.Context, id int64) error {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    user, ok := m.s.users[id]
+    if !ok {
+        return data.ErrRecordNotFound
+    }
+
+    m.deleteUserData(id)
+
+    anonymized := &data.User{
+        ID:          user.ID,
+        CreatedAt:   user.CreatedAt,
+        Email:       fmt.Sprintf("deleted-%d@%s", id, data.AnonymizedEmailDomain),
+        Activated:   false,
+        Version:     user.Version + 1,
+        LastLoginAt: user.LastLoginAt,
+    }
+    m.s.users[id] = anonymized
+
+    return nil
+}
+
+// unactivated reports whether user hasn't activated their account and wasn't anonymized.
+func unactivated(user *data.User) bool {
+    return !user.Activated && !strings.HasSuffix(user.Email, "@"+data.AnonymizedEmailDomain)
+}
+
+// GetUnreminded mimics data.UserModel.GetUnreminded.
+func (m *UserModel) GetUnreminded(ctx context.Context, createdBefore time.Time, limit int) ([]*data.User, error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    users := []*data.User{}
+    for id, user := range m.s.users {
+        if _, ok := m.s.reminded[id]; !ok && unactivated(user) && user.CreatedAt.Before(createdBefore) {
+            users = append(users, copyUser(user))
+        }
+    }
+
+    slices.SortFunc(users, func(a, b *data.User) int {
+        return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+    })
+
+    return users[:min(limit, len(users))], nil
+}
+
+// Remind mimics data.UserModel.Remind, without the atomicity: the mock can't fail halfway.
+func (m *UserModel) Remind(ctx context.Context, user *data.User, ttl time.Duration, email *data.TokenEmail) (*data.Token, error) {
+    m.s.mu.Lock()
+    stored, ok := m.s.users[user.ID]
+    _, reminded := m.s.reminded[user.ID]
+    ok = ok && unactivated(stored) && !reminded
+    if ok {
+        m.s.reminded[user.ID] = time.Now()
+    }
+    m.s.mu.Unlock()
+
+    if !ok {
+        return nil, data.ErrRecordNotFound
+    }
+
+    tokens := &TokenModel{s: m.s}
+
+    _, err := tokens.DeleteAllForUser(ctx, user.ID, data.ScopeActivation)
+    if err != nil {
+        return nil, err
+    }
+
+    token, err := tokens.New(ctx, user.ID, ttl, data.ScopeActivation)
+    if err != nil {
+        return nil, err
+    }
+
+    if email == nil {
+        return token, nil
+    }
+
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    err = (&OutboxModel{s: m.s}).insert(&data.OutboxEmail{
+        Recipient: user.Email,
+        Template:  email.Template,
+        Payload:   email.Data(token),
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// RemindedAt returns when the user was reminded by Remind, if they were.
+func (m *UserModel) RemindedAt(id int64) (time.Time, bool) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    t, ok := m.s.reminded[id]
+    return t, ok
+}
+
+// DeleteUnactivated mimics data.UserModel.DeleteUnactivated.
+func (m *UserModel) DeleteUnactivated(ctx context.Context, createdBefore time.Time) (users, tokens int64, err error) {
+    m.s.mu.Lock()
+    defer m.s.mu.Unlock()
+
+    for id, user := range m.s.users {
+        if !unactivated(user) || !user.CreatedAt.Before(createdBefore) {
+            continue
+        }
+
+        for _, token := range m.s.tokens {
+            if token.UserID == id {
+                tokens++
+            }
+        }
+
+        m.deleteUserData(id)
+        delete(m.s.users, id)
+        users++
+    }
+
+    return users, tokens, nil
+}
+
+// deleteUserData removes the tokens, permissions and queued emails of a user, and scrubs their
+// audit events. The caller must hold the store mutex.
+func (m *UserModel) deleteUserData(id int64) {
+    if user, ok := m.s.users[id]; ok {
+        (&OutboxModel{s: m.s}).deleteFor(user.Email)
+
+        for _, e := range m.s.auditEvents {
+            if e.UserID == id || strings.EqualFold(e.Email, user.Email) {
+                e.Email = ""
+                e.IP = ""
+            }
+        }
+    }
+
+    for key, token := range m.s.tokens {
+        if token.UserID == id {
+            delete(m.s.tokens, key)
+        }
+    }
+
+    delete(m.s.permissions, id)
+    delete(m.s.reminded, id)
+}
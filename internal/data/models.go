@@ -1,30 +1,108 @@
 package data
 
 import (
+	"context"
 	"errors"
+	"time"
 )
 
 var (
-    ErrMsgViolateUniqueConstraint = "duplicate key value violates unique constraint"
+    ErrMsgViolateUniqueConstraint     = "duplicate key value violates unique constraint"
+    ErrMsgViolateForeignKeyConstraint = "violates foreign key constraint"
 
     ErrRecordNotFound = errors.New("record not found")
     ErrEditConflict   = errors.New("edit conflict")
 )
 
-// Models puts models together in one struct.
+// MovieStore describes the operations on movie records used by the handlers.
+type MovieStore interface {
+    Insert(ctx context.Context, movie *Movie) error
+    Get(ctx context.Context, id int64) (*Movie, error)
+    GetAll(ctx context.Context, params MovieListParams, filter Filter) ([]*Movie, Metadata, error)
+    GetAllIter(ctx context.Context, params MovieListParams, filter Filter, fn func(movie *Movie, totalRecords int) error) (Metadata, error)
+    ForEach(ctx context.Context, params MovieListParams, fn func(movie *Movie) error) error
+    GetSimilar(ctx context.Context, id int64, limit int) ([]*Movie, error)
+    FindPotentialDuplicates(ctx context.Context, title string, year int32, threshold float64) ([]MovieDuplicate, error)
+    LastUpdated(ctx context.Context, params MovieListParams) (time.Time, error)
+    Update(ctx context.Context, movie *Movie) error
+    Delete(ctx context.Context, id int64, cascade bool) error
+}
+
+// PermissionStore describes the operations on user permissions used by the handlers.
+type PermissionStore interface {
+    GetAll(ctx context.Context) (Permissions, error)
+    GetAllForUser(ctx context.Context, userID int64) (Permissions, error)
+    AddForUser(ctx context.Context, userID int64, codes ...string) error
+    RemoveForUser(ctx context.Context, userID int64, codes ...string) error
+    ExportGrants(ctx context.Context) (PermissionGrants, error)
+    ImportGrants(ctx context.Context, grants PermissionGrants, createMissing bool) (*PermissionImportReport, error)
+}
+
+// TokenStore describes the operations on tokens used by the handlers.
+type TokenStore interface {
+    New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+    NewAPIKey(ctx context.Context, userID int64, name string) (*Token, error)
+    Insert(ctx context.Context, token *Token) error
+    GetAllForUser(ctx context.Context, userID int64, scope string) ([]*Token, error)
+    CountForUser(ctx context.Context, userID int64, scope string) (int, error)
+    UpdateLastUsed(ctx context.Context, tokenHash []byte) error
+    ExtendExpiry(ctx context.Context, tokenHash []byte, newExpiry time.Time) error
+    DeleteForUser(ctx context.Context, id, userID int64, scope string) error
+    DeleteAllForUser(ctx context.Context, userID int64, scope string) (int64, error)
+    DeleteAllForUserAllScopes(ctx context.Context, userID int64) (int64, error)
+    DeleteAllForUserExcept(ctx context.Context, userID int64, scope string, keepHash []byte) error
+    DeleteExpired(ctx context.Context) (int64, error)
+}
+
+// UserStore describes the operations on user records used by the handlers.
+type UserStore interface {
+    Insert(ctx context.Context, user *User) error
+    Register(ctx context.Context, user *User, reg Registration) (*Token, error)
+    ForcePasswordReset(ctx context.Context, user *User, ttl time.Duration, email *TokenEmail) (*Token, error)
+    GetAll(ctx context.Context, params UserListParams, filter Filter) ([]*User, Metadata, error)
+    Get(ctx context.Context, id int64) (*User, error)
+    GetByEmail(ctx context.Context, email string) (*User, error)
+    GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error)
+    ActivateForToken(ctx context.Context, tokenPlaintext string) (*User, int64, error)
+    Update(ctx context.Context, user *User) error
+    UpdatePasswordHash(ctx context.Context, user *User) error
+    UpdateLastLogin(ctx context.Context, id int64, ip, userAgent string) error
+    Delete(ctx context.Context, id int64) error
+    Anonymize(ctx context.Context, id int64) error
+    GetUnreminded(ctx context.Context, createdBefore time.Time, limit int) ([]*User, error)
+    Remind(ctx context.Context, user *User, ttl time.Duration, email *TokenEmail) (*Token, error)
+    DeleteUnactivated(ctx context.Context, createdBefore time.Time) (users, tokens int64, err error)
+}
+
+// Models puts models together in one struct. The pgx-backed models are the production
+// implementations; tests can substitute in-memory ones (see the mock package).
 type Models struct {
-    Movie      MovieModel
-    Permission PermissionModel
-    Token      TokenModel
-    User       UserModel
+    Audit       AuditStore
+    Genre       GenreStore
+    Idempotency IdempotencyStore
+    Movie       MovieStore
+    Outbox      OutboxStore
+    Permission  PermissionStore
+    Poster      PosterStore
+    Stats       StatsStore
+    Token       TokenStore
+    User        UserStore
 }
 
-// NewModels returns a Models struct containing the initialized models.
-func NewModels(pw *PoolWrapper) Models {
+// NewModels returns a Models struct containing the initialized models. The models share qt, so
+// changing its values at runtime affects all of them. Their read-only queries outside
+// transactions go to the read replica of pw, if it has one (see PoolWrapper.ReadPool).
+func NewModels(pw *PoolWrapper, qt *QueryTimeouts) Models {
     return Models{
-        Movie:      MovieModel{DB: pw},
-        Permission: PermissionModel{DB: pw},
-        Token:      TokenModel{DB: pw},
-        User:       UserModel{DB: pw},
+        Audit:       AuditModel{DB: pw, Timeouts: qt},
+        Genre:       GenreModel{DB: pw, Timeouts: qt},
+        Idempotency: IdempotencyModel{DB: pw, Timeouts: qt},
+        Movie:       MovieModel{DB: pw, Timeouts: qt},
+        Outbox:      OutboxModel{DB: pw, Timeouts: qt},
+        Permission:  PermissionModel{DB: pw, Timeouts: qt},
+        Poster:      MoviePosterModel{DB: pw, Timeouts: qt},
+        Stats:       StatsModel{DB: pw, Timeouts: qt},
+        Token:       TokenModel{DB: pw, Timeouts: qt},
+        User:        UserModel{DB: pw, Timeouts: qt},
     }
 }
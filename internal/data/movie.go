@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jackc/pgx/v5"
@@ -12,70 +13,125 @@ import (
 
 // Movie represents a movie entity.
 type Movie struct {
-    ID        int64     `json:"id"`                // Unique integer ID for the movie
-    CreatedAt time.Time `json:"-"`                 // Timestamp for when the movie is added to our database
-    Title     string    `json:"title"`             // Movie title
-    Year      int32     `json:"year,omitempty"`    // Movie release year
-    Runtime   Runtime   `json:"runtime,omitempty"` // Movie runtime (in minutes)
-    Genres    []string  `json:"genres,omitempty"`  // Slice of genres for the movie (romance, comedy, etc.)
-    Version   int32     `json:"version"`           // The version number starts at 1 and will be incremented each time the movie information is updated
+    ID        int64     `json:"id" xml:"id"`                                                                // Unique integer ID for the movie
+    CreatedAt time.Time `json:"-" xml:"-"`                                                                  // Timestamp for when the movie is added to our database
+    UpdatedAt time.Time `json:"updated_at" xml:"updated_at"`                                                // Timestamp for when the movie was last changed, set by Insert and Update
+    Title     string    `json:"title" xml:"title" validate:"required,max=500"`                              // Movie title
+    Year      int32     `json:"year,omitempty" xml:"year,omitempty" validate:"required,min=1888,notfuture"` // Movie release year
+    Runtime   Runtime   `json:"runtime,omitempty" xml:"runtime,omitempty" validate:"required,positive"`     // Movie runtime (in minutes)
+    Genres    []string  `json:"genres,omitempty" xml:"genres>genre" validate:"required,min=1,max=5,unique"` // Slice of genres for the movie (romance, comedy, etc.)
+    Version   int32     `json:"version" xml:"version"`                                                      // The version number starts at 1 and will be incremented each time the movie information is updated
 }
 
-// ValidateMovie validates the fields of movie using validator v.
-func ValidateMovie(v *validator.Validator, movie *Movie) {
-    v.Check(movie.Title != "", "title", "must be provided")
-    v.Check(len(movie.Title) <= 500, "title", "must not be more than 500 bytes long")
-
-    v.Check(movie.Year != 0, "year", "must be provided")
-    v.Check(movie.Year >= 1888, "year", "must be greater than or equal to 1888")
-    v.Check(movie.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+// ValidateMovie validates the fields of movie using validator v. Unless genres is nil, which
+// allows free-text genres, each genre of the movie must be in genres regardless of case and is
+// replaced with its canonical name, e.g. "Sci-Fi" with "sci-fi".
+func ValidateMovie(v *validator.Validator, movie *Movie, genres Genres) {
+    // Tags can't express checks on the elements of a slice.
+    for i, genre := range movie.Genres {
+        if genre == "" {
+            v.AddError(validator.Index("genres", i), "must be provided")
+            continue
+        }
 
-    v.Check(movie.Runtime != 0, "runtime", "must be provided")
-    v.Check(movie.Runtime > 0, "runtime", "must be a positive integer")
+        if genres != nil {
+            name, ok := genres.Canonical(genre)
+            if !ok {
+                v.AddError(validator.Index("genres", i), "must be one of the genres listed at /v1/genres")
+                continue
+            }
+            movie.Genres[i] = name
+        }
+    }
 
-    v.Check(movie.Genres != nil, "genres", "must be provided")
-    v.Check(len(movie.Genres) >= 1, "genres", "must contain at least 1 genre")
-    v.Check(len(movie.Genres) <= 5, "genres", "must not contain more than 5 genres")
-    v.Check(validator.Unique(movie.Genres), "genres", "must not contain duplicate values")
+    // The genres are canonicalized first, so that the same genre in two casings is a duplicate.
+    validator.Struct(v, movie)
 }
 
 // MovieModel struct wraps a database connection pool wrapper.
 type MovieModel struct {
-    DB *PoolWrapper
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
 }
 
-// Insert inserts a new record in the movie table.
-func (m MovieModel) Insert(movie *Movie) error {
+// Insert inserts a new record in the movie table. It returns a *DuplicateMovieError if another
+// movie has the same title and year.
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
     query := `INSERT INTO movie (title, year, runtime, genres) 
               VALUES ($1, $2, $3, $4) 
-              RETURNING id, created_at, version`
+              RETURNING id, created_at, updated_at, version`
 
     args := []any{movie.Title, movie.Year, movie.Runtime, movie.Genres}
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    return m.DB.Pool.QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+    err := m.DB.Pool().QueryRow(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.UpdatedAt, &movie.Version)
+    if err != nil {
+        return m.duplicateMovieError(ctx, movie, err)
+    }
+
+    return nil
+}
+
+// ErrDuplicateMovie is returned, as a *DuplicateMovieError, by MovieModel.Insert and Update when
+// another movie has the same title and year.
+var ErrDuplicateMovie = errors.New("duplicate movie")
+
+// DuplicateMovieError is returned by MovieModel.Insert and Update when the movie with ID has the
+// same title and year, which must be unique. It matches ErrDuplicateMovie with errors.Is.
+type DuplicateMovieError struct {
+    ID int64
+}
+
+func (e *DuplicateMovieError) Error() string {
+    return fmt.Sprintf("duplicate movie: movie %d has the same title and year", e.ID)
+}
+
+func (e *DuplicateMovieError) Unwrap() error {
+    return ErrDuplicateMovie
+}
+
+// movieTitleYearConstraint is the unique constraint on the title and year of the movies.
+const movieTitleYearConstraint = "movie_title_year_key"
+
+// duplicateMovieError returns a *DuplicateMovieError with the ID of the other movie if err is a
+// violation of the unique title and year of movie, and err otherwise.
+func (m MovieModel) duplicateMovieError(ctx context.Context, movie *Movie, err error) error {
+    if !strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint) || !strings.Contains(err.Error(), movieTitleYearConstraint) {
+        return err
+    }
+
+    // The other movie is read from the primary, which the failed statement ran on.
+    var id int64
+    lookupErr := m.DB.Pool().QueryRow(ctx, `SELECT id FROM movie WHERE title = $1 AND year = $2`, movie.Title, movie.Year).Scan(&id)
+    if lookupErr != nil && !errors.Is(lookupErr, pgx.ErrNoRows) {
+        return lookupErr
+    }
+
+    // The ID is 0 if the other movie was deleted meanwhile.
+    return &DuplicateMovieError{ID: id}
 }
 
 // Get returns a specific record from the movie table.
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
     if id < 1 {
         return nil, ErrRecordNotFound
     }
 
-    query := `SELECT id, created_at, title, year, runtime, genres, version 
+    query := `SELECT id, created_at, updated_at, title, year, runtime, genres, version 
                 FROM movie 
                WHERE id = $1`
 
     var movie Movie
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, id).Scan(
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, id).Scan(
         &movie.ID,
         &movie.CreatedAt,
+        &movie.UpdatedAt,
         &movie.Title,
         &movie.Year,
         &movie.Runtime,
@@ -95,38 +151,164 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
     return &movie, nil
 }
 
+// MovieListParams holds the filters for MovieModel.GetAll. Zero values don't filter.
+type MovieListParams struct {
+    Title         string     // words which must all be in the title
+    Genres        []string   // genres which the movies must have
+    MatchAnyGenre bool       // match the movies with any of Genres instead of all of them
+    UpdatedSince  *time.Time // only the movies changed at or after this time
+    CreatedAfter  *time.Time // only the movies created at or after this time
+    CreatedBefore *time.Time // only the movies created before this time
+    UpdatedAfter  *time.Time // only the movies changed at or after this time
+    UpdatedBefore *time.Time // only the movies changed before this time
+}
+
+// ValidateMovieListParams checks that the date windows of params aren't empty, i.e. that each
+// starts before it ends.
+func ValidateMovieListParams(v *validator.Validator, params MovieListParams) {
+    if params.CreatedAfter != nil && params.CreatedBefore != nil {
+        v.Check(params.CreatedAfter.Before(*params.CreatedBefore), "created_before", "must be later than created_after")
+    }
+    if params.UpdatedAfter != nil && params.UpdatedBefore != nil {
+        v.Check(params.UpdatedAfter.Before(*params.UpdatedBefore), "updated_before", "must be later than updated_after")
+    }
+}
+
+// hasDates reports whether params filter on the creation or update time of the movies.
+func (p MovieListParams) hasDates() bool {
+    return p.UpdatedSince != nil || p.CreatedAfter != nil || p.CreatedBefore != nil || p.UpdatedAfter != nil || p.UpdatedBefore != nil
+}
+
+// datesCondition returns the condition of the movie list queries on the creation and update
+// times, with UpdatedSince and the windows in $n to $n+4 as given by datesArgs. A window includes
+// its start and excludes its end, so that consecutive windows neither overlap nor leave gaps.
+func (p MovieListParams) datesCondition(n int) string {
+    return fmt.Sprintf(`(updated_at >= $%[1]d OR $%[1]d::timestamptz IS NULL) 
+           AND (created_at >= $%[2]d OR $%[2]d::timestamptz IS NULL) 
+           AND (created_at < $%[3]d OR $%[3]d::timestamptz IS NULL) 
+           AND (updated_at >= $%[4]d OR $%[4]d::timestamptz IS NULL) 
+           AND (updated_at < $%[5]d OR $%[5]d::timestamptz IS NULL)`, n, n+1, n+2, n+3, n+4)
+}
+
+// datesArgs returns the arguments of datesCondition.
+func (p MovieListParams) datesArgs() []any {
+    return []any{p.UpdatedSince, p.CreatedAfter, p.CreatedBefore, p.UpdatedAfter, p.UpdatedBefore}
+}
+
+// genresCondition returns the condition of the movie list queries on the genres in $2, written
+// so that the GIN index on genres can be used: @> (contains) for all the genres or && (overlaps)
+// for any of them. Without genres, $2 is the empty array and the condition is always true.
+func (p MovieListParams) genresCondition() string {
+    switch {
+    case len(p.Genres) == 0:
+        return "$2::text[] = '{}'"
+    case p.MatchAnyGenre:
+        return "genres && $2"
+    default:
+        return "genres @> $2"
+    }
+}
+
 // GetAll returns a slice of movies.
-func (m MovieModel) GetAll(title string, genres []string, filter Filter) ([]*Movie, Metadata, error) {
-    query := fmt.Sprintf(`
-        SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version 
+func (m MovieModel) GetAll(ctx context.Context, params MovieListParams, filter Filter) ([]*Movie, Metadata, error) {
+    movies := []*Movie{}
+
+    metadata, err := m.GetAllIter(ctx, params, filter, func(movie *Movie, totalRecords int) error {
+        movies = append(movies, movie)
+        return nil
+    })
+    if err != nil {
+        return nil, Metadata{}, err
+    }
+
+    return movies, metadata, nil
+}
+
+// movieListQuery selects a page of movies with the number of movies matching the filter across
+// all pages. The genres and dates conditions and the ORDER BY clause are filled in with
+// fmt.Sprintf.
+const movieListQuery = `
+        SELECT count(*) OVER(), id, created_at, updated_at, title, year, runtime, genres, version 
+          FROM movie 
+         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
+           AND %s 
+           AND %s 
+         ORDER BY %s 
+         LIMIT $3 
+        OFFSET $4`
+
+// movieListNoTotalQuery is movieListQuery without the count, which makes Postgres visit every
+// matching row. -1 takes the place of the count so that both queries scan alike.
+const movieListNoTotalQuery = `
+        SELECT -1, id, created_at, updated_at, title, year, runtime, genres, version 
           FROM movie 
          WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
-           AND (genres @> $2 OR $2 = '{}') 
-         ORDER BY %s %s, id ASC 
+           AND %s 
+           AND %s 
+         ORDER BY %s 
          LIMIT $3 
-        OFFSET $4`, filter.sortColumn(), filter.sortDirection())
+        OFFSET $4`
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+// LastUpdated returns the latest updated_at of the movies matching params, or the zero time if
+// none does. Deleting a movie doesn't change it.
+func (m MovieModel) LastUpdated(ctx context.Context, params MovieListParams) (time.Time, error) {
+    query := fmt.Sprintf(`
+        SELECT max(updated_at) 
+          FROM movie 
+         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
+           AND %s 
+           AND %s`, params.genresCondition(), params.datesCondition(3))
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
     defer cancel()
 
-    args := []any{title, genres, filter.limit(), filter.offset()}
+    genres := params.Genres
+    if genres == nil {
+        genres = []string{}
+    }
+
+    args := append([]any{params.Title, genres}, params.datesArgs()...)
+
+    var lastUpdated *time.Time
+
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, args...).Scan(&lastUpdated)
+    if err != nil || lastUpdated == nil {
+        return time.Time{}, err
+    }
+
+    return *lastUpdated, nil
+}
+
+// GetSimilar returns up to limit other movies sharing at least one genre with the movie with
+// the given id, most shared genres first, then closest in year. It returns an empty slice if no
+// movie shares a genre or if there is no such movie.
+func (m MovieModel) GetSimilar(ctx context.Context, id int64, limit int) ([]*Movie, error) {
+    query := `SELECT m.id, m.created_at, m.updated_at, m.title, m.year, m.runtime, m.genres, m.version 
+                FROM movie target 
+               INNER JOIN movie m ON m.id <> target.id AND m.genres && target.genres 
+               WHERE target.id = $1 
+               ORDER BY cardinality(ARRAY(SELECT unnest(m.genres) INTERSECT SELECT unnest(target.genres))) DESC, 
+                        abs(m.year - target.year) ASC, m.id ASC 
+               LIMIT $2`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
 
-    rows, err := m.DB.Pool.Query(ctx, query, args...)
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, id, limit)
     if err != nil {
-        return nil, Metadata{}, err
+        return nil, err
     }
     defer rows.Close()
 
-    totalRecords := 0
     movies := []*Movie{}
 
     for rows.Next() {
         var movie Movie
 
         err := rows.Scan(
-            &totalRecords,
             &movie.ID,
             &movie.CreatedAt,
+            &movie.UpdatedAt,
             &movie.Title,
             &movie.Year,
             &movie.Runtime,
@@ -134,27 +316,265 @@ func (m MovieModel) GetAll(title string, genres []string, filter Filter) ([]*Mov
             &movie.Version,
         )
         if err != nil {
-            return nil, Metadata{}, err
+            return nil, err
         }
 
         movies = append(movies, &movie)
     }
 
     if err = rows.Err(); err != nil {
-        return nil, Metadata{}, err
+        return nil, err
+    }
+
+    return movies, nil
+}
+
+// MovieDuplicate is an existing movie which may be the same as a new one, see
+// FindPotentialDuplicates.
+type MovieDuplicate struct {
+    ID         int64   `json:"id" xml:"id"`
+    Title      string  `json:"title" xml:"title"`
+    Year       int32   `json:"year" xml:"year"`
+    Similarity float64 `json:"similarity" xml:"similarity"` // trigram similarity of the titles, from 0 to 1
+}
+
+// MaxMovieDuplicates is the number of movies FindPotentialDuplicates returns at most.
+const MaxMovieDuplicates = 5
+
+// FindPotentialDuplicates returns the movies of the given year whose title has a pg_trgm
+// similarity to title of at least threshold, most similar first. Trigrams ignore case and
+// punctuation, so "Spider-Man" and "spiderman!" are similar. It's one query on the year index.
+func (m MovieModel) FindPotentialDuplicates(ctx context.Context, title string, year int32, threshold float64) ([]MovieDuplicate, error) {
+    query := `SELECT id, title, year, round(similarity(title, $1)::numeric, 2)::float8 AS score 
+                FROM movie 
+               WHERE year = $2 AND similarity(title, $1) >= $3 
+               ORDER BY score DESC, id ASC 
+               LIMIT $4`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    // The primary has the movies created a moment ago, which a replica may not have yet.
+    rows, err := m.DB.Pool().Query(ctx, query, title, year, threshold, MaxMovieDuplicates)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    duplicates := []MovieDuplicate{}
+
+    for rows.Next() {
+        var duplicate MovieDuplicate
+
+        err := rows.Scan(&duplicate.ID, &duplicate.Title, &duplicate.Year, &duplicate.Similarity)
+        if err != nil {
+            return nil, err
+        }
+
+        duplicates = append(duplicates, duplicate)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return duplicates, nil
+}
+
+// GetAllIter runs the same query as GetAll but calls fn for each movie as soon as its row has
+// been scanned, instead of collecting them in a slice. totalRecords is the number of movies
+// matching the filter across all pages, or -1 with filter.SkipTotal. If fn returns an error,
+// iteration stops and the error is returned.
+func (m MovieModel) GetAllIter(ctx context.Context, params MovieListParams, filter Filter, fn func(movie *Movie, totalRecords int) error) (Metadata, error) {
+    if filter.pastMaxOffset() {
+        if filter.SkipTotal {
+            return MetadataWithoutTotal(filter.Page, filter.PageSize, false), nil
+        }
+
+        totalRecords, err := m.count(ctx, params)
+        if err != nil {
+            return Metadata{}, err
+        }
+
+        return calculateMetadata(totalRecords, filter.Page, filter.PageSize), nil
+    }
+
+    query := movieListQuery
+    limit := filter.limit()
+
+    // Without the count, one more row than the page size tells whether there is a next page.
+    if filter.SkipTotal {
+        query = movieListNoTotalQuery
+        limit++
+    }
+
+    orderBy, err := filter.orderBy()
+    if err != nil {
+        return Metadata{}, err
+    }
+
+    query = fmt.Sprintf(query, params.genresCondition(), params.datesCondition(5), orderBy)
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    genres := params.Genres
+    if genres == nil {
+        genres = []string{}
+    }
+
+    args := append([]any{params.Title, genres, limit, filter.offset()}, params.datesArgs()...)
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, args...)
+    if err != nil {
+        return Metadata{}, err
+    }
+    defer rows.Close()
+
+    totalRecords := 0
+    scanned := 0
+    hasMore := false
+
+    for rows.Next() {
+        scanned++
+        if scanned > filter.limit() {
+            hasMore = true
+            break
+        }
+
+        var movie Movie
+
+        err := rows.Scan(
+            &totalRecords,
+            &movie.ID,
+            &movie.CreatedAt,
+            &movie.UpdatedAt,
+            &movie.Title,
+            &movie.Year,
+            &movie.Runtime,
+            &movie.Genres,
+            &movie.Version,
+        )
+        if err != nil {
+            return Metadata{}, err
+        }
+
+        err = fn(&movie, totalRecords)
+        if err != nil {
+            return Metadata{}, err
+        }
+    }
+
+    if err = rows.Err(); err != nil {
+        return Metadata{}, err
+    }
+
+    if filter.SkipTotal {
+        return MetadataWithoutTotal(filter.Page, filter.PageSize, hasMore), nil
     }
 
     metadta := calculateMetadata(totalRecords, filter.Page, filter.PageSize)
 
-    return movies, metadta, nil
+    return metadta, nil
+}
+
+// ForEach calls fn for each movie matching params, in order of updated_at then id, as the rows
+// are scanned, so that all the movies can be exported without holding them in memory. The query
+// has no timeout of its own and runs until ctx is cancelled, e.g. when the client of an export
+// goes away. If fn returns an error, iteration stops and the error is returned.
+func (m MovieModel) ForEach(ctx context.Context, params MovieListParams, fn func(movie *Movie) error) error {
+    query := fmt.Sprintf(`
+        SELECT id, created_at, updated_at, title, year, runtime, genres, version 
+          FROM movie 
+         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
+           AND %s 
+           AND %s 
+         ORDER BY updated_at ASC, id ASC`, params.genresCondition(), params.datesCondition(3))
+
+    genres := params.Genres
+    if genres == nil {
+        genres = []string{}
+    }
+
+    args := append([]any{params.Title, genres}, params.datesArgs()...)
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, args...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var movie Movie
+
+        err := rows.Scan(
+            &movie.ID,
+            &movie.CreatedAt,
+            &movie.UpdatedAt,
+            &movie.Title,
+            &movie.Year,
+            &movie.Runtime,
+            &movie.Genres,
+            &movie.Version,
+        )
+        if err != nil {
+            return err
+        }
+
+        err = fn(&movie)
+        if err != nil {
+            return err
+        }
+    }
+
+    return rows.Err()
+}
+
+// count returns the number of movies matching params. Without filters it's the planner's
+// estimate of the size of the table, which is maintained by VACUUM and ANALYZE, since counting
+// every row is what pastMaxOffset() avoids; the exact count is the fallback if the table hasn't
+// been analyzed yet.
+func (m MovieModel) count(ctx context.Context, params MovieListParams) (int, error) {
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    var count int
+
+    if params.Title == "" && len(params.Genres) == 0 && !params.hasDates() {
+        query := `SELECT reltuples::bigint FROM pg_class WHERE oid = 'movie'::regclass`
+
+        err := m.DB.ReadPool(ctx).QueryRow(ctx, query).Scan(&count)
+        if err != nil || count > 0 {
+            return count, err
+        }
+    }
+
+    genres := params.Genres
+    if genres == nil {
+        genres = []string{}
+    }
+
+    query := fmt.Sprintf(`
+        SELECT count(*) 
+          FROM movie 
+         WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '') 
+           AND %s 
+           AND %s`, params.genresCondition(), params.datesCondition(3))
+
+    args := append([]any{params.Title, genres}, params.datesArgs()...)
+
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, args...).Scan(&count)
+
+    return count, err
 }
 
-// Update updates a specific record in the movie table.
-func (m MovieModel) Update(movie *Movie) error {
+// Update updates a specific record in the movie table. It returns a *DuplicateMovieError if
+// another movie has the new title and year.
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
     query := `UPDATE movie 
-              SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1 
+              SET title = $1, year = $2, runtime = $3, genres = $4, updated_at = NOW(), version = version + 1 
               WHERE id = $5 AND version = $6
-              RETURNING version`
+              RETURNING updated_at, version`
 
     args := []any{
         movie.Title,
@@ -165,42 +585,100 @@ func (m MovieModel) Update(movie *Movie) error {
         movie.Version,  // Add the expected movie version.
     }
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, args...).Scan(&movie.Version)
+    err := m.DB.Pool().QueryRow(ctx, query, args...).Scan(&movie.UpdatedAt, &movie.Version)
     if err != nil {
         switch {
         case errors.Is(err, pgx.ErrNoRows):
             return ErrEditConflict
         default:
-            return err
+            return m.duplicateMovieError(ctx, movie, err)
         }
     }
 
     return nil
 }
 
-// Delete deletes a specific record from the movie table.
-func (m MovieModel) Delete(id int64) error {
+// MovieDependents counts the records in the database which refer to a movie and are deleted
+// together with it.
+type MovieDependents struct {
+    Posters int64 `json:"posters" xml:"posters"`
+}
+
+// Total returns the number of dependent records.
+func (d MovieDependents) Total() int64 {
+    return d.Posters
+}
+
+// MovieReferencedError is returned by MovieModel.Delete when other records refer to the movie and
+// they weren't to be deleted with it. Dependents is zero when the records were found by a foreign
+// key violation rather than counted.
+type MovieReferencedError struct {
+    Dependents MovieDependents
+}
+
+func (e *MovieReferencedError) Error() string {
+    return fmt.Sprintf("movie is referenced by %d other records", e.Dependents.Total())
+}
+
+// Delete deletes a specific record from the movie table. If cascade is true, the records which
+// refer to the movie are deleted with it in the same transaction; otherwise a movie with such
+// records isn't deleted, and a *MovieReferencedError with their counts is returned.
+func (m MovieModel) Delete(ctx context.Context, id int64, cascade bool) error {
     if id < 1 {
         return ErrRecordNotFound
     }
 
-    query := `DELETE FROM movie 
-              WHERE id = $1`
-
-    ctx, cancel := context.WithTimeout(context.Background(), 3 * time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    result, err := m.DB.Pool.Exec(ctx, query, id)
-    if err != nil {
-        return err
-    }
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        if cascade {
+            _, err := tx.Exec(ctx, `DELETE FROM movie_poster WHERE movie_id = $1`, id)
+            if err != nil {
+                return err
+            }
+        } else {
+            var dependents MovieDependents
+
+            // FOR SHARE on the movie keeps new records from referring to it until it's deleted.
+            query := `SELECT (SELECT count(*) FROM movie_poster WHERE movie_id = $1) 
+                      FROM movie 
+                      WHERE id = $1 
+                      FOR SHARE`
+
+            err := tx.QueryRow(ctx, query, id).Scan(&dependents.Posters)
+            if err != nil {
+                if errors.Is(err, pgx.ErrNoRows) {
+                    return ErrRecordNotFound
+                }
+                return err
+            }
+
+            if dependents.Total() > 0 {
+                return &MovieReferencedError{Dependents: dependents}
+            }
+        }
 
-    if result.RowsAffected() == 0 {
-        return ErrRecordNotFound
+        result, err := tx.Exec(ctx, `DELETE FROM movie WHERE id = $1`, id)
+        if err != nil {
+            return err
+        }
+
+        if result.RowsAffected() == 0 {
+            return ErrRecordNotFound
+        }
+
+        return nil
+    })
+
+    // A table referring to movies without being deleted above makes the delete fail with a
+    // foreign key violation, which is a conflict rather than a server error.
+    if err != nil && strings.Contains(err.Error(), ErrMsgViolateForeignKeyConstraint) {
+        return &MovieReferencedError{}
     }
 
-    return nil
-}
\ No newline at end of file
+    return err
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OutboxMaxAttempts is how many times sending an email from the outbox is tried before it is
+// given up.
+const OutboxMaxAttempts = 10
+
+// OutboxEmail is an email queued in the outbox, to be sent by the dispatcher.
+type OutboxEmail struct {
+    ID        int64
+    Recipient string
+    Template  string
+    Payload   map[string]any // data passed to the template; numbers are json.Number
+    Attempts  int            // failed attempts so far
+    LastError string
+    CreatedAt time.Time
+}
+
+// OutboxStore describes the operations on the email outbox used by the dispatcher.
+type OutboxStore interface {
+    Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEmail, error)
+    MarkSent(ctx context.Context, id int64) error
+    MarkFailed(ctx context.Context, id int64, lastError string, retryAt *time.Time) error
+}
+
+// OutboxModel struct wraps a database connection pool wrapper.
+type OutboxModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// insertOutboxEmail queues an email in the outbox inside tx, so that it is only sent if the rest
+// of the transaction is committed.
+func insertOutboxEmail(ctx context.Context, tx pgx.Tx, email *OutboxEmail) error {
+    query := `INSERT INTO email_outbox (recipient, template, payload) 
+              VALUES ($1, $2, $3) 
+              RETURNING id, created_at`
+
+    args := []any{email.Recipient, email.Template, email.Payload}
+
+    return tx.QueryRow(ctx, query, args...).Scan(&email.ID, &email.CreatedAt)
+}
+
+// Claim returns up to limit emails which are due to be sent, oldest first, and postpones their
+// next attempt by lease, so that other dispatchers don't send them at the same time. Emails
+// which are neither marked sent nor failed before the lease ends are claimed again.
+func (m OutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*OutboxEmail, error) {
+    query := `UPDATE email_outbox 
+              SET next_attempt_at = NOW() + $2 * interval '1 second' 
+              WHERE id IN ( 
+                  SELECT id 
+                    FROM email_outbox 
+                   WHERE sent_at IS NULL AND next_attempt_at <= NOW() 
+                   ORDER BY id 
+                   LIMIT $1 
+                     FOR UPDATE SKIP LOCKED) 
+              RETURNING id, recipient, template, payload, attempts, last_error, created_at`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    rows, err := m.DB.Pool().Query(ctx, query, limit, lease.Seconds())
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    emails := []*OutboxEmail{}
+
+    for rows.Next() {
+        var (
+            email   OutboxEmail
+            payload []byte
+        )
+
+        err := rows.Scan(
+            &email.ID,
+            &email.Recipient,
+            &email.Template,
+            &payload,
+            &email.Attempts,
+            &email.LastError,
+            &email.CreatedAt,
+        )
+        if err != nil {
+            return nil, err
+        }
+
+        // Decode numbers as json.Number, so that IDs are rendered by the templates as they were
+        // queued rather than as floats.
+        dec := json.NewDecoder(bytes.NewReader(payload))
+        dec.UseNumber()
+
+        err = dec.Decode(&email.Payload)
+        if err != nil {
+            return nil, err
+        }
+
+        emails = append(emails, &email)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return emails, nil
+}
+
+// MarkSent records that an email was sent. Its payload is cleared, because it may hold an
+// activation token.
+func (m OutboxModel) MarkSent(ctx context.Context, id int64) error {
+    query := `UPDATE email_outbox 
+              SET sent_at = NOW(), next_attempt_at = NULL, payload = '{}' 
+              WHERE id = $1`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, id)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
+
+// MarkFailed records a failed attempt to send an email, which is tried again at retryAt. If
+// retryAt is nil, the email is given up and never claimed again, and its payload is cleared as
+// by MarkSent.
+func (m OutboxModel) MarkFailed(ctx context.Context, id int64, lastError string, retryAt *time.Time) error {
+    query := `UPDATE email_outbox 
+              SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2, 
+                  payload = CASE WHEN $2::timestamptz IS NULL THEN '{}' ELSE payload END 
+              WHERE id = $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, lastError, retryAt, id)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
@@ -2,8 +2,12 @@ package data
 
 import (
 	"context"
+	"errors"
+	"maps"
 	"slices"
-	"time"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
 )
 
 // Permissions stores the permission codes for a single user.
@@ -14,23 +18,153 @@ func (p Permissions) Include(code string) bool {
     return slices.Contains(p, code)
 }
 
+// IncludeAny checks whether the Permissions slice contains at least one of the codes.
+func (p Permissions) IncludeAny(codes ...string) bool {
+    return slices.ContainsFunc(codes, p.Include)
+}
+
+// Match reports whether the permissions grant code, exactly or through a wildcard code (see
+// PermissionIndex). To check several codes, build the index once with Index.
+func (p Permissions) Match(code string) bool {
+    return p.Index().Match(code)
+}
+
+// Index prepares the permissions for Match.
+func (p Permissions) Index() *PermissionIndex {
+    x := &PermissionIndex{
+        exact:     make(map[string]bool, len(p)),
+        wildcards: make(map[string]bool),
+    }
+
+    for _, code := range p {
+        switch prefix, ok := wildcardPrefix(code); {
+        case ok:
+            x.wildcards[prefix] = true
+        case validPermissionCode(code):
+            x.exact[code] = true
+        }
+    }
+
+    return x
+}
+
+// PermissionIndex is a set of permission codes prepared for Match, which takes a time depending
+// on the number of segments of the code checked but not on the number of codes in the set. It
+// isn't changed after Index returns, so it's safe for concurrent use.
+//
+// Codes are made of segments separated by colons, e.g. "movie:123:write". A code whose last
+// segment is "*" is a wildcard, which grants every code starting with the segments before it
+// followed by at least one more segment: "movie:*" grants "movie:write" and "movie:123:write",
+// but not "movie", and "*" grants every code. Codes with an empty segment (e.g. a trailing
+// colon), or with "*" anywhere else (e.g. "movie:*:write" or "movie:*:*"), grant nothing.
+type PermissionIndex struct {
+    exact     map[string]bool
+    wildcards map[string]bool // the segments before "*", with their trailing colon
+}
+
+// Match reports whether the index grants code, see MatchedBy.
+func (x *PermissionIndex) Match(code string) bool {
+    _, ok := x.MatchedBy(code)
+    return ok
+}
+
+// MatchedBy returns the code of the index which grants code. The exact code takes precedence,
+// then the wildcard with the most segments, e.g. "movie:123:*" before "movie:*" and "*". Codes
+// which aren't valid, including wildcards, are never granted.
+func (x *PermissionIndex) MatchedBy(code string) (string, bool) {
+    if !validPermissionCode(code) || strings.Contains(code, "*") {
+        return "", false
+    }
+
+    if x.exact[code] {
+        return code, true
+    }
+
+    for i := strings.LastIndexByte(code, ':'); i >= 0; i = strings.LastIndexByte(code[:i], ':') {
+        if x.wildcards[code[:i+1]] {
+            return code[:i+1] + "*", true
+        }
+    }
+
+    if x.wildcards[""] {
+        return "*", true
+    }
+
+    return "", false
+}
+
+// wildcardPrefix returns the segments before the "*" of a valid wildcard code, with their
+// trailing colon.
+func wildcardPrefix(code string) (string, bool) {
+    prefix, ok := strings.CutSuffix(code, "*")
+    if !ok || (prefix != "" && !strings.HasSuffix(prefix, ":")) {
+        return "", false
+    }
+
+    if prefix != "" && (!validPermissionCode(strings.TrimSuffix(prefix, ":")) || strings.Contains(prefix, "*")) {
+        return "", false
+    }
+
+    return prefix, true
+}
+
+// validPermissionCode reports whether code has no empty segment.
+func validPermissionCode(code string) bool {
+    return !slices.Contains(strings.Split(code, ":"), "")
+}
+
 // PermissionModel struct wraps a database connection pool wrapper.
 type PermissionModel struct {
-    DB *PoolWrapper
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
 }
 
 // GetAllForUser returns all permission codes for a specific user.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
     query := `SELECT p.code 
                 FROM permission p 
                INNER JOIN user_permission up ON up.permission_id = p.id 
                INNER JOIN users u ON up.user_id = u.id 
                WHERE u.id = $1`
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var permissions Permissions
+
+    for rows.Next() {
+        var permission string
+
+        err := rows.Scan(&permission)
+        if err != nil {
+            return nil, err
+        }
+
+        permissions = append(permissions, permission)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return permissions, nil
+}
+
+// GetAll returns all permission codes.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+    query := `SELECT code 
+                FROM permission 
+               ORDER BY code`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
     defer cancel()
 
-    rows, err := m.DB.Pool.Query(ctx, query, userID)
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query)
     if err != nil {
         return nil, err
     }
@@ -55,16 +189,183 @@ func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
     return permissions, nil
 }
 
-// AddForUser adds the provided permissions for a specific user.
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// AddForUser adds the provided permissions for a specific user. Permissions the user already has
+// are ignored.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, codes ...string) error {
     query := `INSERT INTO user_permission 
               SELECT $1, id 
                 FROM permission 
-               WHERE code = ANY($2)`
+               WHERE code = ANY($2) 
+                  ON CONFLICT DO NOTHING`
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    _, err := m.DB.Pool.Exec(ctx, query, userID, codes)
+    _, err := m.DB.Pool().Exec(ctx, query, userID, codes)
     return err
-}
\ No newline at end of file
+}
+
+// RemoveForUser removes the provided permissions from a specific user.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, codes ...string) error {
+    query := `DELETE FROM user_permission 
+              WHERE user_id = $1 
+                AND permission_id IN (SELECT id FROM permission WHERE code = ANY($2))`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query, userID, codes)
+    return err
+}
+
+// PermissionGrants maps the email address of each user to their permission codes. It's the
+// document of the permission export and import.
+type PermissionGrants map[string]Permissions
+
+// PermissionImportReport tells what ImportGrants did.
+type PermissionImportReport struct {
+    Added          int      `json:"added"`           // grants which were added
+    AlreadyPresent int      `json:"already_present"` // grants which the user already had
+    Created        []string `json:"created"`         // permission codes which were created
+    UnknownEmails  []string `json:"unknown_emails"`  // emails without a user, whose grants were skipped
+    UnknownCodes   []string `json:"unknown_codes"`   // codes without a permission, which were skipped
+}
+
+// ExportGrants returns the permission codes of every user who has any, sorted by code.
+func (m PermissionModel) ExportGrants(ctx context.Context) (PermissionGrants, error) {
+    query := `SELECT u.email, p.code 
+                FROM user_permission up 
+               INNER JOIN users u ON up.user_id = u.id 
+               INNER JOIN permission p ON up.permission_id = p.id 
+               ORDER BY u.email, p.code`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    grants := PermissionGrants{}
+
+    for rows.Next() {
+        var email, code string
+
+        err := rows.Scan(&email, &code)
+        if err != nil {
+            return nil, err
+        }
+
+        grants[email] = append(grants[email], code)
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return grants, nil
+}
+
+// ImportGrants adds the grants to the users in one transaction. Grants which a user already has
+// are counted and left alone, so importing the same grants twice changes nothing. The grants of
+// emails without a user are skipped, and so are codes without a permission, unless createMissing
+// is set, in which case the permissions are created. Existing grants missing from grants are kept.
+func (m PermissionModel) ImportGrants(ctx context.Context, grants PermissionGrants, createMissing bool) (*PermissionImportReport, error) {
+    createQuery := `INSERT INTO permission (code) 
+                    SELECT DISTINCT c FROM unnest($1::text[]) AS c 
+                    WHERE NOT EXISTS (SELECT 1 FROM permission WHERE code = c) 
+                    RETURNING code`
+
+    codesQuery := `SELECT code 
+                     FROM permission 
+                    WHERE code = ANY($1)`
+
+    userQuery := `SELECT id 
+                    FROM users 
+                   WHERE email = $1`
+
+    grantQuery := `INSERT INTO user_permission 
+                   SELECT $1, id 
+                     FROM permission 
+                    WHERE code = ANY($2) 
+                       ON CONFLICT DO NOTHING`
+
+    var codes []string
+    for _, userCodes := range grants {
+        codes = append(codes, userCodes...)
+    }
+    slices.Sort(codes)
+    codes = slices.Compact(codes)
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    report := &PermissionImportReport{Created: []string{}, UnknownEmails: []string{}, UnknownCodes: []string{}}
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        if createMissing {
+            rows, err := tx.Query(ctx, createQuery, codes)
+            if err != nil {
+                return err
+            }
+
+            report.Created, err = pgx.CollectRows(rows, pgx.RowTo[string])
+            if err != nil {
+                return err
+            }
+        }
+
+        rows, err := tx.Query(ctx, codesQuery, codes)
+        if err != nil {
+            return err
+        }
+
+        known, err := pgx.CollectRows(rows, pgx.RowTo[string])
+        if err != nil {
+            return err
+        }
+
+        for _, code := range codes {
+            if !slices.Contains(known, code) {
+                report.UnknownCodes = append(report.UnknownCodes, code)
+            }
+        }
+
+        emails := slices.Sorted(maps.Keys(grants))
+
+        for _, email := range emails {
+            var userID int64
+
+            err := tx.QueryRow(ctx, userQuery, NormalizeEmail(email)).Scan(&userID)
+            if err != nil {
+                if errors.Is(err, pgx.ErrNoRows) {
+                    report.UnknownEmails = append(report.UnknownEmails, email)
+                    continue
+                }
+                return err
+            }
+
+            userCodes := slices.DeleteFunc(slices.Clone(grants[email]), func(code string) bool {
+                return !slices.Contains(known, code)
+            })
+            slices.Sort(userCodes)
+            userCodes = slices.Compact(userCodes)
+
+            result, err := tx.Exec(ctx, grantQuery, userID, userCodes)
+            if err != nil {
+                return err
+            }
+
+            report.Added += int(result.RowsAffected())
+            report.AlreadyPresent += len(userCodes) - int(result.RowsAffected())
+        }
+
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return report, nil
+}
@@ -0,0 +1,46 @@
+package data
+
+import "testing"
+
+func TestPermissionsMatch(t *testing.T) {
+    tests := []struct {
+        name        string
+        permissions Permissions
+        code        string
+        want        string // the code which grants code, "" if none does
+    }{
+        {"exact", Permissions{"movie:read"}, "movie:read", "movie:read"},
+        {"other code", Permissions{"movie:read"}, "movie:write", ""},
+        {"no permissions", nil, "movie:read", ""},
+        {"wildcard", Permissions{"movie:*"}, "movie:write", "movie:*"},
+        {"wildcard over several segments", Permissions{"movie:*"}, "movie:123:write", "movie:*"},
+        {"wildcard needs a segment", Permissions{"movie:*"}, "movie", ""},
+        {"wildcard of another prefix", Permissions{"movie:*"}, "movies:write", ""},
+        {"wildcard of a resource", Permissions{"movie:123:*"}, "movie:123:write", "movie:123:*"},
+        {"wildcard of another resource", Permissions{"movie:123:*"}, "movie:456:write", ""},
+        {"everything", Permissions{"*"}, "users:admin", "*"},
+        {"exact beats wildcard", Permissions{"*", "movie:*", "movie:write"}, "movie:write", "movie:write"},
+        {"longest wildcard first", Permissions{"*", "movie:*", "movie:123:*"}, "movie:123:write", "movie:123:*"},
+        {"shorter wildcard", Permissions{"*", "movie:*", "movie:123:*"}, "movie:456:write", "movie:*"},
+        {"multiple wildcards", Permissions{"movie:*:*"}, "movie:123:write", ""},
+        {"wildcard inside", Permissions{"movie:*:write"}, "movie:123:write", ""},
+        {"partial wildcard", Permissions{"mov*"}, "movie:write", ""},
+        {"trailing colon granted", Permissions{"movie:"}, "movie:", ""},
+        {"trailing colon checked", Permissions{"movie:*"}, "movie:", ""},
+        {"empty segment", Permissions{"*"}, "movie::write", ""},
+        {"empty code", Permissions{"*"}, "", ""},
+        {"wildcard checked", Permissions{"movie:*"}, "movie:*", ""},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, ok := tt.permissions.Index().MatchedBy(tt.code)
+            if got != tt.want || ok != (tt.want != "") {
+                t.Errorf("MatchedBy(%q) = %q, %t; want %q, %t", tt.code, got, ok, tt.want, tt.want != "")
+            }
+            if match := tt.permissions.Match(tt.code); match != ok {
+                t.Errorf("Match(%q) = %t; want %t", tt.code, match, ok)
+            }
+        })
+    }
+}
@@ -0,0 +1,230 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// PosterContentTypes lists the image types accepted as movie posters.
+var PosterContentTypes = []string{"image/jpeg", "image/png", "image/webp"}
+
+// Poster holds a movie poster image and its metadata.
+type Poster struct {
+    MovieID     int64     `json:"movie_id" xml:"movie_id"`
+    ContentType string    `json:"content_type" xml:"content_type"`
+    Hash        string    `json:"hash" xml:"hash"` // hex-encoded SHA-256 of Data, used as the ETag
+    Size        int64     `json:"size" xml:"size"`
+    UpdatedAt   time.Time `json:"updated_at" xml:"updated_at"`
+    Data        []byte    `json:"-" xml:"-"`
+}
+
+// NewPoster returns a Poster for the image data, calculating its hash and size.
+func NewPoster(movieID int64, contentType string, data []byte) *Poster {
+    hash := sha256.Sum256(data)
+
+    return &Poster{
+        MovieID:     movieID,
+        ContentType: contentType,
+        Hash:        hex.EncodeToString(hash[:]),
+        Size:        int64(len(data)),
+        UpdatedAt:   time.Now(),
+        Data:        data,
+    }
+}
+
+// PosterStore describes a storage backend for movie posters.
+type PosterStore interface {
+    Put(ctx context.Context, poster *Poster) error
+    Get(ctx context.Context, movieID int64) (*Poster, error)
+    Delete(ctx context.Context, movieID int64) error
+}
+
+// MoviePosterModel stores posters in the movie_poster table. Rows are removed automatically
+// when their movie is deleted.
+type MoviePosterModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// Put inserts or replaces the poster of a movie.
+func (m MoviePosterModel) Put(ctx context.Context, poster *Poster) error {
+    query := `INSERT INTO movie_poster (movie_id, content_type, hash, size, updated_at, data) 
+              VALUES ($1, $2, $3, $4, $5, $6) 
+              ON CONFLICT (movie_id) DO UPDATE 
+              SET content_type = EXCLUDED.content_type, hash = EXCLUDED.hash, size = EXCLUDED.size, 
+                  updated_at = EXCLUDED.updated_at, data = EXCLUDED.data`
+
+    args := []any{poster.MovieID, poster.ContentType, poster.Hash, poster.Size, poster.UpdatedAt, poster.Data}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query, args...)
+    return err
+}
+
+// Get returns the poster of a movie.
+func (m MoviePosterModel) Get(ctx context.Context, movieID int64) (*Poster, error) {
+    query := `SELECT movie_id, content_type, hash, size, updated_at, data 
+                FROM movie_poster 
+               WHERE movie_id = $1`
+
+    var poster Poster
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, movieID).Scan(
+        &poster.MovieID,
+        &poster.ContentType,
+        &poster.Hash,
+        &poster.Size,
+        &poster.UpdatedAt,
+        &poster.Data,
+    )
+    if err != nil {
+        switch {
+        case errors.Is(err, pgx.ErrNoRows):
+            return nil, ErrRecordNotFound
+        default:
+            return nil, err
+        }
+    }
+
+    return &poster, nil
+}
+
+// Delete deletes the poster of a movie.
+func (m MoviePosterModel) Delete(ctx context.Context, movieID int64) error {
+    query := `DELETE FROM movie_poster 
+              WHERE movie_id = $1`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, movieID)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
+
+// FilesystemPosterStore stores posters as files in a directory: the image in "<movie id>" and
+// its metadata in "<movie id>.json". Posters aren't removed automatically when a movie is
+// deleted, so callers must call Delete.
+type FilesystemPosterStore struct {
+    Dir string
+}
+
+func (s FilesystemPosterStore) paths(movieID int64) (data, meta string) {
+    data = filepath.Join(s.Dir, fmt.Sprintf("%d", movieID))
+    return data, data + ".json"
+}
+
+// Put writes the poster of a movie, replacing any existing one.
+func (s FilesystemPosterStore) Put(ctx context.Context, poster *Poster) error {
+    dataPath, metaPath := s.paths(poster.MovieID)
+
+    meta, err := json.Marshal(poster)
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(s.Dir, 0o755)
+    if err != nil {
+        return err
+    }
+
+    // Write the image before the metadata, so that Get never returns metadata whose hash
+    // doesn't match the image.
+    err = writeFileAtomic(dataPath, poster.Data)
+    if err != nil {
+        return err
+    }
+
+    return writeFileAtomic(metaPath, meta)
+}
+
+// Get reads the poster of a movie.
+func (s FilesystemPosterStore) Get(ctx context.Context, movieID int64) (*Poster, error) {
+    dataPath, metaPath := s.paths(movieID)
+
+    meta, err := os.ReadFile(metaPath)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return nil, ErrRecordNotFound
+        }
+        return nil, err
+    }
+
+    var poster Poster
+
+    err = json.Unmarshal(meta, &poster)
+    if err != nil {
+        return nil, err
+    }
+
+    poster.Data, err = os.ReadFile(dataPath)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return nil, ErrRecordNotFound
+        }
+        return nil, err
+    }
+
+    return &poster, nil
+}
+
+// Delete removes the poster of a movie.
+func (s FilesystemPosterStore) Delete(ctx context.Context, movieID int64) error {
+    dataPath, metaPath := s.paths(movieID)
+
+    err := os.Remove(metaPath)
+    if err != nil {
+        if errors.Is(err, os.ErrNotExist) {
+            return ErrRecordNotFound
+        }
+        return err
+    }
+
+    err = os.Remove(dataPath)
+    if err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+
+    return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path, so that readers never
+// see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+    f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+    if err != nil {
+        return err
+    }
+
+    _, err = f.Write(data)
+    if closeErr := f.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(f.Name())
+        return err
+    }
+
+    return os.Rename(f.Name(), path)
+}
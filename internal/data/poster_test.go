@@ -0,0 +1,45 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFilesystemPosterStore(t *testing.T) {
+    store := FilesystemPosterStore{Dir: t.TempDir()}
+
+    _, err := store.Get(context.Background(), 1)
+    if !errors.Is(err, ErrRecordNotFound) {
+        t.Fatalf("got error %v; want ErrRecordNotFound", err)
+    }
+
+    poster := NewPoster(1, "image/png", []byte("first"))
+    if err = store.Put(context.Background(), poster); err != nil {
+        t.Fatal(err)
+    }
+
+    replacement := NewPoster(1, "image/jpeg", []byte("second"))
+    if err = store.Put(context.Background(), replacement); err != nil {
+        t.Fatal(err)
+    }
+
+    got, err := store.Get(context.Background(), 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got.ContentType != "image/jpeg" || got.Hash != replacement.Hash || !bytes.Equal(got.Data, []byte("second")) {
+        t.Fatalf("got %+v", got)
+    }
+    if got.Hash == poster.Hash {
+        t.Fatal("hash did not change with the image")
+    }
+
+    if err = store.Delete(context.Background(), 1); err != nil {
+        t.Fatal(err)
+    }
+    if err = store.Delete(context.Background(), 1); !errors.Is(err, ErrRecordNotFound) {
+        t.Fatalf("got error %v; want ErrRecordNotFound", err)
+    }
+}
@@ -3,14 +3,24 @@ package data
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
 )
 
 var ErrInvalidRuntimeFormat = errors.New("invalid runtime format")
 
+// Runtime is the runtime of a movie in minutes.
 type Runtime int32
 
+// Hours returns the runtime in hours, e.g. 1.5 for 90 minutes.
+func (r Runtime) Hours() float64 {
+    return float64(r) / 60
+}
+
 // Implement a MarshalJSON() method on the Runtime type so that it satisfies the json.Marshaler 
 // interface. This should return the JSON-encoded value for the movie runtime (in our case, it 
 // will return a string in the format "<runtime> mins").
@@ -28,34 +38,84 @@ func (r Runtime) MarshalJSON() ([]byte, error) {
 // json.Unmarshaler interface. IMPORTANT: Because UnmarshalJSON() needs to modify the receiver 
 // (our Runtime type), we must use a pointer receiver for this to work correctly. Otherwise, we 
 // will only be modifying a copy (which is then discarded when this method returns).
+//
+// The runtime can be a number of minutes, 107 or "107", a string in the "<runtime> mins" format
+// we send, or a duration in the format of time.ParseDuration(), "1h47m". Like encoding/json, we
+// leave the receiver unchanged for null.
 func (r *Runtime) UnmarshalJSON(jsonValue []byte) error {
-    // We expect that the incoming JSON value will be a string in the format "<runtime> mins", and 
-    // the first thing we need to do is remove the surrounding double-quotes from this string. If 
-    // we can't unquote it, we return the ErrInvalidRuntimeFormat error.
-    unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+    if string(jsonValue) == "null" {
+        return nil
+    }
+
+    // A bare number is parsed as is. Anything else must be a string: if we can't unquote it, we
+    // return the ErrInvalidRuntimeFormat error.
+    value := string(jsonValue)
+    if !strings.HasPrefix(value, `"`) {
+        return r.parse(value, value)
+    }
+
+    unquotedJSONValue, err := strconv.Unquote(value)
     if err != nil {
-        return ErrInvalidRuntimeFormat
+        return invalidRuntimeError(value)
     }
 
-    // Split the string to isolate the part containing the number.
-    parts := strings.Split(unquotedJSONValue, " ")
+    return r.parse(unquotedJSONValue, value)
+}
 
-    // Sanity check the parts of the string to make sure it was in the expected format. 
-    // If it isn't, return the ErrInvalidRuntimeFormat error.
-    if len(parts) != 2 || parts[1] != "mins" {
-        return ErrInvalidRuntimeFormat
+// parse sets the receiver to the runtime in s, in any of the formats accepted by UnmarshalJSON().
+// The error names value, which is s as the client sent it.
+func (r *Runtime) parse(s, value string) error {
+    number, unit, _ := strings.Cut(s, " ")
+    if unit != "" && unit != "mins" {
+        return invalidRuntimeError(value)
     }
 
-    // Otherwise, parse the string containing the number into an int32. 
-    // If this fails, return the ErrInvalidRuntimeFormat err.
-    i, err := strconv.ParseInt(parts[0], 10, 32)
+    minutes, err := strconv.ParseInt(number, 10, 32)
     if err != nil {
-        return ErrInvalidRuntimeFormat
+        if unit != "" {
+            return invalidRuntimeError(value)
+        }
+
+        // Not a number of minutes, so it may be a duration, which must be whole minutes.
+        d, err := time.ParseDuration(s)
+        if err != nil || d%time.Minute != 0 || d/time.Minute > math.MaxInt32 {
+            return invalidRuntimeError(value)
+        }
+        minutes = int64(d / time.Minute)
+    }
+
+    if minutes <= 0 {
+        return fmt.Errorf("%w: %s, the runtime must be a positive number of minutes", ErrInvalidRuntimeFormat, value)
     }
 
-    // Convert the int32 to a Runtime type and assign this to the receiver. Note that we use the 
-    // * operator to reference the receiver in order to set the underlying value of the pointer.
-    *r = Runtime(i)
+    // Convert the number of minutes to a Runtime type and assign this to the receiver. Note that
+    // we use the * operator to reference the receiver in order to set the underlying value of
+    // the pointer.
+    *r = Runtime(minutes)
 
     return nil
-}
\ No newline at end of file
+}
+
+// invalidRuntimeError returns an ErrInvalidRuntimeFormat error naming the offending value and
+// the accepted formats.
+func invalidRuntimeError(value string) error {
+    return fmt.Errorf(`%w: %s, use a number of minutes such as 107 or "107 mins", or a duration such as "1h47m"`, ErrInvalidRuntimeFormat, value)
+}
+
+// MarshalText implements encoding.TextMarshaler, which the XML encoder uses, so that the runtime
+// has the same "<runtime> mins" representation in every response format.
+func (r Runtime) MarshalText() ([]byte, error) {
+    return []byte(fmt.Sprintf("%d mins", r)), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler for the formats accepted by UnmarshalJSON().
+func (r *Runtime) UnmarshalText(text []byte) error {
+    return r.parse(string(text), strconv.Quote(string(text)))
+}
+
+
+// EncodeMsgpack implements msgpack.CustomEncoder. Without it the MessagePack encoder would write
+// the output of MarshalText as binary data rather than as a string.
+func (r Runtime) EncodeMsgpack(enc *msgpack.Encoder) error {
+    return enc.EncodeString(fmt.Sprintf("%d mins", r))
+}
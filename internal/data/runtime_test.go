@@ -0,0 +1,137 @@
+package data
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRuntimeUnmarshalJSON(t *testing.T) {
+    tests := []struct {
+        json    string
+        want    Runtime
+        wantErr string // substring of the error; the error wraps ErrInvalidRuntimeFormat
+    }{
+        {`107`, 107, ""},
+        {`"107"`, 107, ""},
+        {`"107 mins"`, 107, ""},
+        {`"1h47m"`, 107, ""},
+        {`"2h"`, 120, ""},
+        {`"45m"`, 45, ""},
+        {`"90m0s"`, 90, ""},
+        {`2147483647`, 2147483647, ""},
+        {`0`, 0, `0, the runtime must be a positive number of minutes`},
+        {`"0 mins"`, 0, `"0 mins", the runtime must be a positive number of minutes`},
+        {`-5`, 0, `-5, the runtime must be a positive number of minutes`},
+        {`"-5 mins"`, 0, `"-5 mins", the runtime must be a positive number of minutes`},
+        {`"-1h"`, 0, `"-1h", the runtime must be a positive number of minutes`},
+        {`"0s"`, 0, `"0s", the runtime must be a positive number of minutes`},
+        {`"107 min"`, 0, `invalid runtime format: "107 min", use a number of minutes`},
+        {`"107mins"`, 0, `"107mins"`},
+        {`"mins"`, 0, `"mins"`},
+        {`" 107 mins"`, 0, `" 107 mins"`},
+        {`"1h47m30s"`, 0, `"1h47m30s"`},
+        {`"abc"`, 0, `"abc"`},
+        {`""`, 0, `""`},
+        {`107.5`, 0, `107.5`},
+        {`1e2`, 0, `1e2`},
+        {`true`, 0, `true`},
+        {`2147483648`, 0, `2147483648`},
+        {`"10000000h"`, 0, `"10000000h"`},
+        {`"107`, 0, `"107`},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.json, func(t *testing.T) {
+            var got Runtime
+            err := got.UnmarshalJSON([]byte(tt.json))
+
+            switch {
+            case tt.wantErr == "" && err != nil:
+                t.Fatalf("unexpected error: %v", err)
+            case tt.wantErr != "" && err == nil:
+                t.Fatalf("got %d; want an error", got)
+            case tt.wantErr != "" && (!errors.Is(err, ErrInvalidRuntimeFormat) || !strings.Contains(err.Error(), tt.wantErr)):
+                t.Fatalf("got error %q; want ErrInvalidRuntimeFormat containing %q", err, tt.wantErr)
+            }
+            if got != tt.want {
+                t.Errorf("got %d; want %d", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestRuntimeRoundTrip(t *testing.T) {
+    for _, input := range []string{`107`, `"107"`, `"107 mins"`, `"1h47m"`} {
+        var movie struct {
+            Runtime Runtime `json:"runtime"`
+        }
+
+        err := json.Unmarshal([]byte(`{"runtime": `+input+`}`), &movie)
+        if err != nil {
+            t.Fatalf("%s: %v", input, err)
+        }
+
+        js, err := json.Marshal(movie)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if got, want := string(js), `{"runtime":"107 mins"}`; got != want {
+            t.Errorf("%s: got %s; want %s", input, got, want)
+        }
+    }
+
+    // null leaves the runtime unchanged, as encoding/json does for other types.
+    movie := struct {
+        Runtime Runtime `json:"runtime"`
+    }{Runtime: 90}
+    if err := json.Unmarshal([]byte(`{"runtime": null}`), &movie); err != nil || movie.Runtime != 90 {
+        t.Errorf("null: got %d, %v; want 90, nil", movie.Runtime, err)
+    }
+
+    // The XML representation is the same, and is parsed with the same formats.
+    type xmlMovie struct {
+        Runtime Runtime `xml:"runtime"`
+    }
+
+    out, err := xml.Marshal(xmlMovie{Runtime: 107})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if got, want := string(out), `<xmlMovie><runtime>107 mins</runtime></xmlMovie>`; got != want {
+        t.Errorf("got XML %s; want %s", got, want)
+    }
+
+    for _, text := range []string{"107 mins", "107", "1h47m"} {
+        var m xmlMovie
+        err := xml.Unmarshal([]byte(`<xmlMovie><runtime>`+text+`</runtime></xmlMovie>`), &m)
+        if err != nil || m.Runtime != 107 {
+            t.Errorf("XML %s: got %d, %v; want 107", text, m.Runtime, err)
+        }
+    }
+
+    var m xmlMovie
+    if err := xml.Unmarshal([]byte(`<xmlMovie><runtime>-1 mins</runtime></xmlMovie>`), &m); !errors.Is(err, ErrInvalidRuntimeFormat) {
+        t.Errorf("XML -1 mins: got error %v; want ErrInvalidRuntimeFormat", err)
+    }
+}
+
+func TestRuntimeHours(t *testing.T) {
+    tests := []struct {
+        runtime Runtime
+        want    float64
+    }{
+        {0, 0},
+        {60, 1},
+        {90, 1.5},
+        {107, 107.0 / 60},
+    }
+
+    for _, tt := range tests {
+        if got := tt.runtime.Hours(); got != tt.want {
+            t.Errorf("Runtime(%d).Hours() = %v; want %v", tt.runtime, got, tt.want)
+        }
+    }
+}
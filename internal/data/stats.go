@@ -0,0 +1,103 @@
+package data
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// MovieStats are the catalog statistics of the movie_stats materialized view as of its last
+// refresh.
+type MovieStats struct {
+    Total       int64         `json:"total" xml:"total"`
+    ByGenre     []GenreCount  `json:"by_genre" xml:"by_genre>genre"`    // sorted by genre
+    ByDecade    []DecadeCount `json:"by_decade" xml:"by_decade>decade"` // sorted by decade
+    RefreshedAt time.Time     `json:"refreshed_at" xml:"refreshed_at"`
+}
+
+// GenreCount is the number of movies of a genre.
+type GenreCount struct {
+    Genre  string `json:"genre" xml:"name"`
+    Movies int64  `json:"movies" xml:"movies"`
+}
+
+// DecadeCount is the number of movies released in a decade, e.g. 1990 for 1990 to 1999.
+type DecadeCount struct {
+    Decade int   `json:"decade" xml:"year"`
+    Movies int64 `json:"movies" xml:"movies"`
+}
+
+// StatsStore describes the operations on the movie statistics used by the handlers.
+type StatsStore interface {
+    Get(ctx context.Context) (*MovieStats, error)
+    Refresh(ctx context.Context) error
+}
+
+// StatsModel struct wraps a database connection pool wrapper.
+type StatsModel struct {
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
+}
+
+// Get returns the statistics as of the last Refresh, rather than computing them from the movie
+// table on every request.
+func (m StatsModel) Get(ctx context.Context) (*MovieStats, error) {
+    query := `SELECT dimension, value, movies, refreshed_at
+                FROM movie_stats
+               ORDER BY dimension, value`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    stats := &MovieStats{ByGenre: []GenreCount{}, ByDecade: []DecadeCount{}}
+
+    for rows.Next() {
+        var (
+            dimension, value string
+            movies           int64
+            refreshedAt      time.Time
+        )
+
+        err := rows.Scan(&dimension, &value, &movies, &refreshedAt)
+        if err != nil {
+            return nil, err
+        }
+
+        switch dimension {
+        case "total":
+            stats.Total = movies
+            stats.RefreshedAt = refreshedAt
+        case "genre":
+            stats.ByGenre = append(stats.ByGenre, GenreCount{Genre: value, Movies: movies})
+        case "decade":
+            decade, err := strconv.Atoi(value)
+            if err != nil {
+                return nil, err
+            }
+            stats.ByDecade = append(stats.ByDecade, DecadeCount{Decade: decade, Movies: movies})
+        }
+    }
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return stats, nil
+}
+
+// Refresh recomputes the statistics. The view is refreshed concurrently, so that Get keeps
+// reading the previous statistics meanwhile.
+func (m StatsModel) Refresh(ctx context.Context) error {
+    query := `REFRESH MATERIALIZED VIEW CONCURRENTLY movie_stats`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query)
+    return err
+}
@@ -0,0 +1,83 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// DefaultQueryTimeout is used for any operation whose timeout hasn't been configured.
+const DefaultQueryTimeout = 3 * time.Second
+
+// QueryTimeouts holds the per-operation query timeouts used by the models. The values can be
+// changed at runtime, e.g. when the dynamic config is reloaded. A nil *QueryTimeouts uses
+// DefaultQueryTimeout for every operation.
+type QueryTimeouts struct {
+    read  atomic.Int64 // single-row lookups
+    write atomic.Int64 // inserts, updates and deletes
+    list  atomic.Int64 // multi-row queries such as MovieModel.GetAll
+    token atomic.Int64 // token lookups on the authentication path
+}
+
+// NewQueryTimeouts returns a QueryTimeouts with the given values. See Set.
+func NewQueryTimeouts(read, write, list, token time.Duration) *QueryTimeouts {
+    qt := &QueryTimeouts{}
+    qt.Set(read, write, list, token)
+    return qt
+}
+
+// Set changes the timeouts. A zero or negative duration resets that timeout to DefaultQueryTimeout.
+func (qt *QueryTimeouts) Set(read, write, list, token time.Duration) {
+    qt.read.Store(int64(orDefaultTimeout(read)))
+    qt.write.Store(int64(orDefaultTimeout(write)))
+    qt.list.Store(int64(orDefaultTimeout(list)))
+    qt.token.Store(int64(orDefaultTimeout(token)))
+}
+
+// Read returns the timeout for single-row lookups.
+func (qt *QueryTimeouts) Read() time.Duration {
+    if qt == nil {
+        return DefaultQueryTimeout
+    }
+    return orDefaultTimeout(time.Duration(qt.read.Load()))
+}
+
+// Write returns the timeout for inserts, updates and deletes.
+func (qt *QueryTimeouts) Write() time.Duration {
+    if qt == nil {
+        return DefaultQueryTimeout
+    }
+    return orDefaultTimeout(time.Duration(qt.write.Load()))
+}
+
+// List returns the timeout for multi-row queries.
+func (qt *QueryTimeouts) List() time.Duration {
+    if qt == nil {
+        return DefaultQueryTimeout
+    }
+    return orDefaultTimeout(time.Duration(qt.list.Load()))
+}
+
+// Token returns the timeout for token lookups.
+func (qt *QueryTimeouts) Token() time.Duration {
+    if qt == nil {
+        return DefaultQueryTimeout
+    }
+    return orDefaultTimeout(time.Duration(qt.token.Load()))
+}
+
+func orDefaultTimeout(d time.Duration) time.Duration {
+    if d <= 0 {
+        return DefaultQueryTimeout
+    }
+
+    return d
+}
+
+// IsQueryTimeout reports whether err was caused by a query exceeding its timeout.
+func IsQueryTimeout(err error) bool {
+    return errors.Is(err, context.DeadlineExceeded) || pgconn.Timeout(err)
+}
@@ -0,0 +1,37 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeouts(t *testing.T) {
+    var nilTimeouts *QueryTimeouts
+    if got := nilTimeouts.Read(); got != DefaultQueryTimeout {
+        t.Errorf("nil Read() = %s; want %s", got, DefaultQueryTimeout)
+    }
+
+    qt := NewQueryTimeouts(time.Second, 0, 10*time.Second, 500*time.Millisecond)
+
+    if qt.Read() != time.Second || qt.Write() != DefaultQueryTimeout || qt.List() != 10*time.Second || qt.Token() != 500*time.Millisecond {
+        t.Errorf("got %s %s %s %s", qt.Read(), qt.Write(), qt.List(), qt.Token())
+    }
+
+    qt.Set(0, 2*time.Second, -time.Second, 0)
+
+    if qt.Read() != DefaultQueryTimeout || qt.Write() != 2*time.Second || qt.List() != DefaultQueryTimeout || qt.Token() != DefaultQueryTimeout {
+        t.Errorf("after Set got %s %s %s %s", qt.Read(), qt.Write(), qt.List(), qt.Token())
+    }
+}
+
+func TestIsQueryTimeout(t *testing.T) {
+    if !IsQueryTimeout(fmt.Errorf("query: %w", context.DeadlineExceeded)) {
+        t.Error("wrapped context.DeadlineExceeded not detected")
+    }
+    if IsQueryTimeout(errors.New("boom")) || IsQueryTimeout(ErrRecordNotFound) {
+        t.Error("ordinary error detected as a timeout")
+    }
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base32"
+	"strings"
 	"time"
 
 	"greenlight.zzh.net/internal/validator"
@@ -13,23 +14,45 @@ import (
 const (
     ScopeActivation     = "activation"
     ScopeAuthentication = "authentication"
+    ScopeAPIKey         = "api-key"
+    ScopePasswordReset  = "password-reset"
 )
 
-// Token holds the data for a token.
+// Scopes lists every token scope.
+var Scopes = []string{ScopeActivation, ScopeAuthentication, ScopeAPIKey, ScopePasswordReset}
+
+// APIKeyPrefix starts the plaintext of every API key. It lets the authenticate middleware tell
+// API keys from authentication tokens without a database lookup, and makes leaked keys easy to
+// spot.
+const APIKeyPrefix = "glk_"
+
+// tokenPrefixLength is the number of random characters of a token kept in the prefix field so
+// that users can tell their tokens apart.
+const tokenPrefixLength = 8
+
+// Token holds the data for a token. API keys have no expiry.
 type Token struct {
-    Plaintext string    `json:"token"`
-    Hash      []byte    `json:"-"`
-    UserID    int64     `json:"-"`
-    Expiry    time.Time `json:"expiry"`
-    Scope     string    `json:"-"`
+    ID         int64      `json:"id,omitempty" xml:"id,omitempty"`
+    Plaintext  string     `json:"token,omitempty" xml:"token,omitempty"`
+    Hash       []byte     `json:"-" xml:"-"`
+    UserID     int64      `json:"-" xml:"-"`
+    Name       string     `json:"name,omitempty" xml:"name,omitempty"`
+    Prefix     string     `json:"prefix,omitempty" xml:"prefix,omitempty"`
+    CreatedAt  time.Time  `json:"created_at" xml:"created_at"`
+    Expiry     *time.Time `json:"expiry,omitempty" xml:"expiry,omitempty"`
+    LastUsedAt *time.Time `json:"last_used_at,omitempty" xml:"last_used_at,omitempty"`
+    Current    bool       `json:"current,omitempty" xml:"current,omitempty"`
+    Scope      string     `json:"-" xml:"-"`
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
     // We add the provided ttl (time-to-live) duration parameter to the current time
     // to get the expiry time.
+    expiry := time.Now().Add(ttl)
+
     token := &Token{
         UserID: userID,
-        Expiry: time.Now().Add(ttl),
+        Expiry: &expiry,
         Scope:  scope,
     }
 
@@ -57,6 +80,32 @@ func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error
     // the [:] operator before storing it.
     hash := sha256.Sum256([]byte(token.Plaintext))
     token.Hash = hash[:]
+    token.Prefix = token.Plaintext[:tokenPrefixLength]
+
+    return token, nil
+}
+
+// generateAPIKey creates a named, non-expiring API key. The key has 20 random bytes instead of
+// the 16 of other tokens since it never expires.
+func generateAPIKey(userID int64, name string) (*Token, error) {
+    token := &Token{
+        UserID: userID,
+        Name:   name,
+        Scope:  ScopeAPIKey,
+    }
+
+    randomBytes := make([]byte, 20)
+
+    _, err := rand.Read(randomBytes)
+    if err != nil {
+        return nil, err
+    }
+
+    token.Plaintext = APIKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+    hash := sha256.Sum256([]byte(token.Plaintext))
+    token.Hash = hash[:]
+    token.Prefix = token.Plaintext[:len(APIKeyPrefix)+tokenPrefixLength]
 
     return token, nil
 }
@@ -67,46 +116,269 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
     v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
+// ValidateAPIKeyPlaintext validates the plaintext API key has the API key prefix and is exactly
+// 36 bytes long.
+func ValidateAPIKeyPlaintext(v *validator.Validator, keyPlaintext string) {
+    v.Check(strings.HasPrefix(keyPlaintext, APIKeyPrefix), "token", "must be an API key")
+    v.Check(len(keyPlaintext) == len(APIKeyPrefix)+32, "token", "must be 36 bytes long")
+}
+
+// ValidateTokenName validates the name of an API key.
+func ValidateTokenName(v *validator.Validator, name string) {
+    v.Check(name != "", "name", "must be provided")
+    v.Checkf(len(name) <= 100, "name", "must not be more than %d bytes long", 100)
+}
+
 // TokenModel struct wraps a database connection pool wrapper.
 type TokenModel struct {
-    DB *PoolWrapper
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
 }
 
 // New is a shortcut which creates a new Token struct and then inserts the data in the token table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
     token, err := generateToken(userID, ttl, scope)
     if err != nil {
         return nil, err
     }
 
-    err = m.Insert(token)
+    err = m.Insert(ctx, token)
+    return token, err
+}
+
+// NewAPIKey is a shortcut which creates a new API key and then inserts it in the token table.
+func (m TokenModel) NewAPIKey(ctx context.Context, userID int64, name string) (*Token, error) {
+    token, err := generateAPIKey(userID, name)
+    if err != nil {
+        return nil, err
+    }
+
+    err = m.Insert(ctx, token)
     return token, err
 }
 
 // Insert inserts a new record in the token table.
-func (m TokenModel) Insert(token *Token) error {
-    query := `INSERT INTO token (hash, user_id, expiry, scope) 
-              VALUES ($1, $2, $3, $4)`
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
+    query := `INSERT INTO token (hash, user_id, expiry, scope, name, prefix) 
+              VALUES ($1, $2, $3, $4, $5, $6) 
+              RETURNING id, created_at`
+
+    args := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Name, token.Prefix}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    return m.DB.Pool().QueryRow(ctx, query, args...).Scan(&token.ID, &token.CreatedAt)
+}
 
-    args := []any{token.Hash, token.UserID, token.Expiry, token.Scope}
+// GetAllForUser returns the unexpired tokens of a user with the given scope, newest first.
+func (m TokenModel) GetAllForUser(ctx context.Context, userID int64, scope string) ([]*Token, error) {
+    query := `SELECT id, hash, user_id, name, prefix, created_at, expiry, last_used_at, scope 
+                FROM token 
+               WHERE user_id = $1 
+                 AND scope = $2 
+                 AND (expiry > NOW() OR expiry IS NULL) 
+               ORDER BY created_at DESC, id DESC`
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
     defer cancel()
 
-    _, err := m.DB.Pool.Exec(ctx, query, args...)
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, userID, scope)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []*Token{}
+
+    for rows.Next() {
+        var token Token
+
+        err := rows.Scan(
+            &token.ID,
+            &token.Hash,
+            &token.UserID,
+            &token.Name,
+            &token.Prefix,
+            &token.CreatedAt,
+            &token.Expiry,
+            &token.LastUsedAt,
+            &token.Scope,
+        )
+        if err != nil {
+            return nil, err
+        }
+
+        tokens = append(tokens, &token)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return tokens, nil
+}
+
+// CountForUser returns the number of unexpired tokens of a user with the given scope.
+func (m TokenModel) CountForUser(ctx context.Context, userID int64, scope string) (int, error) {
+    query := `SELECT count(*) 
+                FROM token 
+               WHERE user_id = $1 
+                 AND scope = $2 
+                 AND (expiry > NOW() OR expiry IS NULL)`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    var count int
+
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, userID, scope).Scan(&count)
+
+    return count, err
+}
+
+// TokenLastUsedInterval is how often the last_used_at of a token is updated at most, so that
+// busy tokens and API keys aren't written on every request.
+const TokenLastUsedInterval = time.Minute
+
+// LastUsedDue reports whether the last use of a token, nil if it was never used, is old enough
+// at now for UpdateLastUsed to record a new one.
+func LastUsedDue(lastUsedAt *time.Time, now time.Time) bool {
+    return lastUsedAt == nil || now.Sub(*lastUsedAt) >= TokenLastUsedInterval
+}
+
+// UpdateLastUsed sets the last_used_at of the token with the given hash, unless it was updated
+// less than TokenLastUsedInterval ago, e.g. by a concurrent request.
+func (m TokenModel) UpdateLastUsed(ctx context.Context, tokenHash []byte) error {
+    query := `UPDATE token 
+              SET last_used_at = NOW() 
+              WHERE hash = $1 
+                AND (last_used_at IS NULL OR last_used_at <= NOW() - $2 * interval '1 second')`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query, tokenHash, TokenLastUsedInterval.Seconds())
 
     return err
 }
 
-// DeleteAllForUser deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(userID int64, scope string) error {
+// SlidingExpiry returns the expiry an authentication token created at createdAt and expiring at
+// expiry gets when it is used at now with sliding expiration: ttl from now, but no later than
+// maxLifetime after createdAt. So that busy tokens aren't written on every request, ok is false
+// unless that pushes the expiry back by at least extendAfter.
+func SlidingExpiry(createdAt, expiry, now time.Time, ttl, maxLifetime, extendAfter time.Duration) (newExpiry time.Time, ok bool) {
+    newExpiry = now.Add(ttl)
+    if limit := createdAt.Add(maxLifetime); newExpiry.After(limit) {
+        newExpiry = limit
+    }
+
+    if newExpiry.Sub(expiry) < extendAfter {
+        return expiry, false
+    }
+
+    return newExpiry, true
+}
+
+// ExtendExpiry sets the expiry of the authentication token with the given hash to newExpiry. A
+// token which expires later already, e.g. after a concurrent extension, is left as it is.
+func (m TokenModel) ExtendExpiry(ctx context.Context, tokenHash []byte, newExpiry time.Time) error {
+    query := `UPDATE token 
+              SET expiry = $2 
+              WHERE hash = $1 
+                AND scope = $3 
+                AND expiry < $2`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    _, err := m.DB.Pool().Exec(ctx, query, tokenHash, newExpiry, ScopeAuthentication)
+
+    return err
+}
+
+// DeleteForUser deletes a token of a user by ID and scope, returning ErrRecordNotFound if the
+// user has no such token.
+func (m TokenModel) DeleteForUser(ctx context.Context, id, userID int64, scope string) error {
+    query := `DELETE FROM token 
+              WHERE id = $1 AND user_id = $2 AND scope = $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, id, userID, scope)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
+
+// DeleteAllForUser deletes all tokens for a specific user and scope and returns how many were
+// deleted.
+func (m TokenModel) DeleteAllForUser(ctx context.Context, userID int64, scope string) (int64, error) {
     query := `DELETE FROM token 
               WHERE user_id = $1 AND scope = $2`
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, userID, scope)
+    if err != nil {
+        return 0, err
+    }
+
+    return result.RowsAffected(), nil
+}
+
+// DeleteAllForUserAllScopes deletes all tokens of a user, API keys included, and returns how
+// many were deleted.
+func (m TokenModel) DeleteAllForUserAllScopes(ctx context.Context, userID int64) (int64, error) {
+    query := `DELETE FROM token 
+              WHERE user_id = $1`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, userID)
+    if err != nil {
+        return 0, err
+    }
+
+    return result.RowsAffected(), nil
+}
+
+// DeleteAllForUserExcept deletes all tokens for a specific user and scope except the one with
+// the given hash, e.g. to log a user out everywhere but in the current session.
+func (m TokenModel) DeleteAllForUserExcept(ctx context.Context, userID int64, scope string, keepHash []byte) error {
+    query := `DELETE FROM token 
+              WHERE user_id = $1 AND scope = $2 AND hash <> $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    _, err := m.DB.Pool.Exec(ctx, query, userID, scope)
+    _, err := m.DB.Pool().Exec(ctx, query, userID, scope, keepHash)
 
     return err
 }
+
+// DeleteExpired deletes all expired tokens and returns how many were deleted. API keys, which
+// don't expire, are never deleted.
+func (m TokenModel) DeleteExpired(ctx context.Context) (int64, error) {
+    query := `DELETE FROM token 
+              WHERE expiry < NOW()`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query)
+    if err != nil {
+        return 0, err
+    }
+
+    return result.RowsAffected(), nil
+}
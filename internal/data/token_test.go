@@ -0,0 +1,41 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSlidingExpiry(t *testing.T) {
+    created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+    const (
+        ttl         = 24 * time.Hour
+        maxLifetime = 7 * 24 * time.Hour
+        extendAfter = 15 * time.Minute
+    )
+
+    tests := []struct {
+        name       string
+        expiry     time.Time
+        now        time.Time
+        wantExpiry time.Time
+        wantOK     bool
+    }{
+        {"just created", created.Add(ttl), created.Add(time.Minute), created.Add(ttl), false},
+        {"just under extendAfter", created.Add(ttl), created.Add(extendAfter - time.Second), created.Add(ttl), false},
+        {"extendAfter", created.Add(ttl), created.Add(extendAfter), created.Add(extendAfter + ttl), true},
+        {"later", created.Add(ttl), created.Add(20 * time.Hour), created.Add(44 * time.Hour), true},
+        {"capped", created.Add(maxLifetime - 10*time.Minute), created.Add(maxLifetime - 2*time.Hour), created.Add(maxLifetime - 10*time.Minute), false},
+        {"capped but far enough", created.Add(maxLifetime - time.Hour), created.Add(maxLifetime - 20*time.Hour), created.Add(maxLifetime), true},
+        {"at the maximum lifetime", created.Add(maxLifetime), created.Add(maxLifetime - time.Hour), created.Add(maxLifetime), false},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got, ok := SlidingExpiry(created, tt.expiry, tt.now, ttl, maxLifetime, extendAfter)
+            if !got.Equal(tt.wantExpiry) || ok != tt.wantOK {
+                t.Errorf("got %v, %t; want %v, %t", got, ok, tt.wantExpiry, tt.wantOK)
+            }
+        })
+    }
+}
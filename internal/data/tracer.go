@@ -0,0 +1,169 @@
+package data
+
+import (
+	"context"
+	"expvar"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// maxLoggedSQLLength is the number of characters of a statement kept in a slow query log entry.
+const maxLoggedSQLLength = 200
+
+var (
+    totalDBQueries               = expvar.NewInt("total_db_queries")
+    totalDBQueryErrors           = expvar.NewInt("total_db_query_errors")
+    totalDBQueryTimeMicroseconds = expvar.NewInt("total_db_query_time_μs")
+    totalDBSlowQueries           = expvar.NewInt("total_db_slow_queries")
+)
+
+type traceContextKey struct{}
+
+type queryTimerContextKey struct{}
+
+// QueryTimer accumulates the time spent in database queries made with a context returned by
+// WithQueryTimer, e.g. the queries of one HTTP request. It is safe for concurrent use.
+type QueryTimer struct {
+    total atomic.Int64
+}
+
+// WithQueryTimer returns a copy of ctx whose queries are timed by t.
+func WithQueryTimer(ctx context.Context, t *QueryTimer) context.Context {
+    return context.WithValue(ctx, queryTimerContextKey{}, t)
+}
+
+// Total returns the time spent in the queries which have completed so far.
+func (t *QueryTimer) Total() time.Duration {
+    return time.Duration(t.total.Load())
+}
+
+type traceData struct {
+    start time.Time
+    sql   string
+    args  int
+    span  trace.Span // nil unless the query is traced, see EnableSpans
+}
+
+// QueryTracer implements pgx.QueryTracer. It records query counts and durations in expvar and
+// logs statements which take longer than the slow query threshold. A single QueryTracer is
+// attached to every pool created by a PoolWrapper, so it survives pool recreation.
+type QueryTracer struct {
+    logger        *slog.Logger
+    slowThreshold atomic.Int64
+    spans         trace.Tracer // nil unless EnableSpans has been called
+}
+
+// NewQueryTracer returns a QueryTracer which logs to logger. A slowThreshold of zero disables
+// slow query logging.
+func NewQueryTracer(logger *slog.Logger, slowThreshold time.Duration) *QueryTracer {
+    t := &QueryTracer{logger: logger}
+    t.SetSlowThreshold(slowThreshold)
+    return t
+}
+
+// SetSlowThreshold changes the slow query threshold at runtime.
+func (t *QueryTracer) SetSlowThreshold(d time.Duration) {
+    t.slowThreshold.Store(int64(d))
+}
+
+// EnableSpans makes the tracer start a span with tracer for each query made within a trace, e.g.
+// of an HTTP request, named after the operation of the query, e.g. SELECT. The queries of
+// background jobs don't start traces of their own. It must be called before the tracer is used.
+func (t *QueryTracer) EnableSpans(tracer trace.Tracer) {
+    t.spans = tracer
+}
+
+// TraceQueryStart stores the start time and statement in the returned context.
+func (t *QueryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+    td := &traceData{
+        start: time.Now(),
+        sql:   data.SQL,
+        args:  len(data.Args),
+    }
+
+    if t.spans != nil && trace.SpanContextFromContext(ctx).IsValid() {
+        operation := queryOperation(data.SQL)
+
+        // As in the slow query log, the arguments are left out.
+        ctx, td.span = t.spans.Start(ctx, operation,
+            trace.WithSpanKind(trace.SpanKindClient),
+            trace.WithAttributes(
+                semconv.DBSystemPostgreSQL,
+                semconv.DBOperationName(operation),
+                semconv.DBQueryText(truncateSQL(data.SQL)),
+            ),
+        )
+    }
+
+    return context.WithValue(ctx, traceContextKey{}, td)
+}
+
+// TraceQueryEnd updates the query metrics and logs the statement if it was slow.
+func (t *QueryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+    td, ok := ctx.Value(traceContextKey{}).(*traceData)
+    if !ok {
+        return
+    }
+
+    duration := time.Since(td.start)
+
+    if td.span != nil {
+        if data.Err != nil {
+            td.span.RecordError(data.Err)
+            td.span.SetStatus(codes.Error, data.Err.Error())
+        }
+        td.span.End()
+    }
+
+    totalDBQueries.Add(1)
+    totalDBQueryTimeMicroseconds.Add(duration.Microseconds())
+
+    if qt, ok := ctx.Value(queryTimerContextKey{}).(*QueryTimer); ok {
+        qt.total.Add(int64(duration))
+    }
+
+    if data.Err != nil {
+        totalDBQueryErrors.Add(1)
+    }
+
+    threshold := time.Duration(t.slowThreshold.Load())
+    if threshold > 0 && duration > threshold {
+        totalDBSlowQueries.Add(1)
+
+        // The arguments are elided since they may contain personal data or secrets.
+        t.logger.Warn("slow database query",
+            "duration", duration.String(),
+            "threshold", threshold.String(),
+            "sql", truncateSQL(td.sql),
+            "args", td.args,
+        )
+    }
+}
+
+// queryOperation returns the first keyword of a statement in upper case, e.g. SELECT.
+func queryOperation(sql string) string {
+    fields := strings.Fields(sql)
+    if len(fields) == 0 {
+        return ""
+    }
+
+    return strings.ToUpper(fields[0])
+}
+
+// truncateSQL collapses whitespace in a statement and truncates it to maxLoggedSQLLength.
+func truncateSQL(sql string) string {
+    sql = strings.Join(strings.Fields(sql), " ")
+
+    if len(sql) > maxLoggedSQLLength {
+        return sql[:maxLoggedSQLLength] + "..."
+    }
+
+    return sql
+}
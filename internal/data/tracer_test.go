@@ -0,0 +1,141 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestQueryTracer(t *testing.T) {
+    var buf bytes.Buffer
+    tracer := NewQueryTracer(slog.New(slog.NewTextHandler(&buf, nil)), time.Millisecond)
+
+    queries, errs, slow := totalDBQueries.Value(), totalDBQueryErrors.Value(), totalDBSlowQueries.Value()
+
+    // A fast query is counted but not logged.
+    ctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+    tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+
+    if buf.Len() != 0 {
+        t.Fatalf("fast query was logged: %s", buf.String())
+    }
+
+    // A slow, failing query is counted, logged, and its arguments are not.
+    sql := "SELECT *\n  FROM users\n WHERE email = $1 " + strings.Repeat("AND true ", 50)
+    ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: sql, Args: []any{"secret@example.com"}})
+    time.Sleep(2 * time.Millisecond)
+    tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+
+    out := buf.String()
+    if !strings.Contains(out, "level=WARN") || !strings.Contains(out, "SELECT * FROM users WHERE email = $1") {
+        t.Errorf("slow query not logged as expected: %s", out)
+    }
+    if strings.Contains(out, "secret@example.com") {
+        t.Errorf("query arguments were logged: %s", out)
+    }
+    if !strings.Contains(out, "...") {
+        t.Errorf("long statement was not truncated: %s", out)
+    }
+
+    if got := totalDBQueries.Value() - queries; got != 2 {
+        t.Errorf("got %d queries counted; want 2", got)
+    }
+    if got := totalDBQueryErrors.Value() - errs; got != 1 {
+        t.Errorf("got %d query errors counted; want 1", got)
+    }
+    if got := totalDBSlowQueries.Value() - slow; got != 1 {
+        t.Errorf("got %d slow queries counted; want 1", got)
+    }
+
+    // A zero threshold disables slow query logging.
+    buf.Reset()
+    tracer.SetSlowThreshold(0)
+    ctx = tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: sql})
+    time.Sleep(2 * time.Millisecond)
+    tracer.TraceQueryEnd(ctx, nil, pgx.TraceQueryEndData{})
+
+    if buf.Len() != 0 {
+        t.Errorf("query logged with slow query logging disabled: %s", buf.String())
+    }
+}
+
+func TestQueryTimer(t *testing.T) {
+    tracer := NewQueryTracer(slog.New(slog.NewTextHandler(io.Discard, nil)), 0)
+
+    var timer QueryTimer
+    ctx := WithQueryTimer(context.Background(), &timer)
+
+    for range 2 {
+        qctx := tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+        time.Sleep(2 * time.Millisecond)
+        tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+    }
+
+    if got := timer.Total(); got < 4*time.Millisecond || got > time.Second {
+        t.Errorf("got total %v; want the time of both queries", got)
+    }
+
+    // Queries without the timer in their context aren't added.
+    before := timer.Total()
+    qctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+    tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+
+    if timer.Total() != before {
+        t.Errorf("got total %v; want %v", timer.Total(), before)
+    }
+}
+
+func TestQueryTracerSpans(t *testing.T) {
+    recorder := tracetest.NewSpanRecorder()
+    spans := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer("test")
+
+    tracer := NewQueryTracer(slog.New(slog.NewTextHandler(io.Discard, nil)), 0)
+    tracer.EnableSpans(spans)
+
+    // A query outside of a trace, e.g. of a background job, gets no span.
+    qctx := tracer.TraceQueryStart(context.Background(), nil, pgx.TraceQueryStartData{SQL: "SELECT 1"})
+    tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{})
+
+    if got := len(recorder.Ended()); got != 0 {
+        t.Fatalf("got %d spans for a query outside of a trace; want 0", got)
+    }
+
+    ctx, parent := spans.Start(context.Background(), "GET")
+
+    sql := "\n        UPDATE movie \n           SET title = $1 \n         WHERE id = $2"
+    qctx = tracer.TraceQueryStart(ctx, nil, pgx.TraceQueryStartData{SQL: sql, Args: []any{"secret title", 1}})
+    tracer.TraceQueryEnd(qctx, nil, pgx.TraceQueryEndData{Err: errors.New("boom")})
+    parent.End()
+
+    ended := recorder.Ended()
+    if len(ended) != 2 {
+        t.Fatalf("got %d spans; want the query and its parent", len(ended))
+    }
+
+    span := ended[0]
+    if span.Name() != "UPDATE" || span.Parent().SpanID() != parent.SpanContext().SpanID() {
+        t.Errorf("got span %q with parent %s; want UPDATE with parent %s", span.Name(), span.Parent().SpanID(), parent.SpanContext().SpanID())
+    }
+    if span.Status().Code != codes.Error {
+        t.Errorf("got status %v; want an error", span.Status())
+    }
+
+    for _, attr := range span.Attributes() {
+        if strings.Contains(attr.Value.Emit(), "secret title") {
+            t.Errorf("got the query arguments in attribute %s", attr.Key)
+        }
+        if attr.Key == "db.query.text" && attr.Value.AsString() != "UPDATE movie SET title = $1 WHERE id = $2" {
+            t.Errorf("got db.query.text %q", attr.Value.AsString())
+        }
+    }
+}
@@ -0,0 +1,13 @@
+package data
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WithTx runs fn inside a transaction on the pool in use. The transaction is committed if fn
+// returns nil and rolled back otherwise.
+func (pw *PoolWrapper) WithTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+    return pgx.BeginFunc(ctx, pw.Pool(), fn)
+}
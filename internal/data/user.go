@@ -2,8 +2,12 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
@@ -17,13 +21,20 @@ var AnonymousUser = &User{}
 
 // User represents an individual user.
 type User struct {
-    ID        int64     `json:"id"`
-    CreatedAt time.Time `json:"created_at"`
-    Name      string    `json:"name"`
-    Email     string    `json:"email"`
-    Password  password  `json:"-"`
-    Activated bool      `json:"activated"`
-    Version   int       `json:"-"`
+    ID                    int64      `json:"id" xml:"id"`
+    CreatedAt             time.Time  `json:"created_at" xml:"created_at"`
+    Name                  string     `json:"name" xml:"name" validate:"required,max=500"`
+    Email                 string     `json:"email" xml:"email" validate:"required,email"`
+    Password              password   `json:"-" xml:"-"`
+    Activated             bool       `json:"activated" xml:"activated"`
+    PasswordResetRequired bool       `json:"password_reset_required,omitempty" xml:"password_reset_required,omitempty"`
+    Version               int        `json:"-" xml:"-"`
+    LastLoginAt           *time.Time `json:"last_login_at,omitempty" xml:"last_login_at,omitempty"`
+    LastLoginIP           string     `json:"last_login_ip,omitempty" xml:"last_login_ip,omitempty"`
+    LastLoginUserAgent    string     `json:"last_login_user_agent,omitempty" xml:"last_login_user_agent,omitempty"`
+    TokenCreatedAt        time.Time  `json:"-" xml:"-"` // set by GetForToken: when the token was created
+    TokenExpiry           *time.Time `json:"-" xml:"-"` // set by GetForToken: when the token expires; nil for API keys
+    TokenLastUsedAt       *time.Time `json:"-" xml:"-"` // set by GetForToken: when the token was last used; nil if never
 }
 
 // IsAnonymous checks if a User instance is the AnonymousUser.
@@ -38,10 +49,41 @@ type password struct {
     hash      []byte
 }
 
+// DefaultPasswordCost is the bcrypt cost of password hashes unless SetPasswordCost changes it.
+const DefaultPasswordCost = 12
+
+// passwordCost is the bcrypt cost of new password hashes.
+var passwordCost = DefaultPasswordCost
+
+// SetPasswordCost sets the bcrypt cost of new password hashes, which must be between
+// bcrypt.MinCost and bcrypt.MaxCost. Hashes made at a lower cost still match, and NeedsRehash
+// reports them so that they can be upgraded. It isn't safe for concurrent use with hashing, so it
+// should be called at startup.
+func SetPasswordCost(cost int) error {
+    if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+        return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+    }
+
+    dummy := defaultDummyPasswordHash
+    if cost != DefaultPasswordCost {
+        var err error
+        // The result of comparing with the dummy hash is ignored, so its password doesn't matter.
+        dummy, err = bcrypt.GenerateFromPassword([]byte("dummy password"), cost)
+        if err != nil {
+            return err
+        }
+    }
+
+    passwordCost = cost
+    dummyPasswordHash = dummy
+
+    return nil
+}
+
 // Set calculates the bcrypt hash of a plaintext password and stores both the
 // hash and the plaintext versions in the p struct.
 func (p *password) Set(plaintext string) error {
-    hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), 12)
+    hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), passwordCost)
     if err != nil {
         return err
     }
@@ -68,26 +110,95 @@ func (p *password) Matches(plaintext string) (bool, error) {
     return true, nil
 }
 
-// ValidateEmail validates an email address using validator v.
-func ValidateEmail(v *validator.Validator, email string) {
+// NeedsRehash reports whether the hash was made at a lower cost than new hashes are, e.g. before
+// the cost was raised. Set the password again after it Matches to upgrade the hash.
+func (p *password) NeedsRehash() bool {
+    cost, err := bcrypt.Cost(p.hash)
+    return err == nil && cost < passwordCost
+}
+
+// defaultDummyPasswordHash is the bcrypt hash, at DefaultPasswordCost, of a password no user has.
+var defaultDummyPasswordHash = []byte("$2a$12$fuVZJ2YBHVWJfhsQ9QYUeuU3s6YuvhNRBk.kVMl6TcpWXGEWdeYze")
+
+// dummyPasswordHash is the hash, at the same cost as new passwords, which DummyPasswordMatch
+// compares against.
+var dummyPasswordHash = defaultDummyPasswordHash
+
+// DummyPasswordMatch runs a bcrypt comparison which always fails. It's called when a login
+// names an unknown email, so that the response takes as long as a wrong password and timing
+// doesn't reveal which emails have an account.
+func DummyPasswordMatch(plaintext string) {
+    _ = bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(plaintext))
+}
+
+// NormalizeEmail returns email with surrounding whitespace removed and in lower case. Emails are
+// normalized wherever they are stored or looked up, so that lookups can't miss due to case.
+func NormalizeEmail(email string) string {
+    return strings.ToLower(strings.TrimSpace(email))
+}
+
+// ValidateEmail validates an email address using validator v. An address at one of the blocked
+// domains isn't allowed; a nil blocked allows every domain.
+func ValidateEmail(v *validator.Validator, email string, blocked EmailDomains) {
     v.Check(email != "", "email", "must be provided")
     v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
+    v.Check(!blocked.Blocks(email), "email", "email domain is not allowed")
+}
+
+//go:embed disposable_email_domains.txt
+var disposableEmailDomainsFile string
+
+// EmailDomains is a set of email domains in lower case.
+type EmailDomains map[string]struct{}
+
+// DisposableEmailDomains returns the domains in the embedded list of disposable email services,
+// plus extra.
+func DisposableEmailDomains(extra ...string) EmailDomains {
+    domains := make(EmailDomains)
+
+    for _, line := range strings.Split(disposableEmailDomainsFile, "\n") {
+        line = strings.TrimSpace(line)
+        if line != "" && !strings.HasPrefix(line, "#") {
+            domains[strings.ToLower(line)] = struct{}{}
+        }
+    }
+
+    for _, domain := range extra {
+        domains[strings.ToLower(domain)] = struct{}{}
+    }
+
+    return domains
+}
+
+// Blocks reports whether the domain of email, or a domain it's a subdomain of, is in d.
+func (d EmailDomains) Blocks(email string) bool {
+    if len(d) == 0 {
+        return false
+    }
+
+    _, domain, ok := strings.Cut(strings.ToLower(email), "@")
+    for ok {
+        if _, blocked := d[domain]; blocked {
+            return true
+        }
+        _, domain, ok = strings.Cut(domain, ".")
+    }
+
+    return false
 }
 
 // ValidatePassword validates a password using validator v.
 func ValidatePassword(v *validator.Validator, password string) {
     v.Check(password != "", "password", "must be provided")
-    v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-    v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+    v.Checkf(len(password) >= 8, "password", "must be at least %d bytes long", 8)
+    v.Checkf(len(password) <= 72, "password", "must not be more than %d bytes long", 72)
 }
 
 // ValidateUser validates the fields of user using validator v.
 func ValidateUser(v *validator.Validator, user *User) {
-    v.Check(user.Name != "", "name", "must be provided")
-    v.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
-
-    ValidateEmail(v, user.Email)
+    validator.Struct(v, user)
 
+    // The password isn't a plain field, so it's checked by hand.
     if user.Password.plaintext != nil {
         ValidatePassword(v, *user.Password.plaintext)
     }
@@ -103,21 +214,24 @@ func ValidateUser(v *validator.Validator, user *User) {
 
 // UserModel struct wraps a database connection pool wrapper.
 type UserModel struct {
-    DB *PoolWrapper
+    DB       *PoolWrapper
+    Timeouts *QueryTimeouts
 }
 
 // Insert inserts a new record in the users table.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
     query := `INSERT INTO users (name, email, password_hash, activated) 
               VALUES ($1, $2, $3, $4) 
               RETURNING id, created_at, version`
 
+    user.Email = NormalizeEmail(user.Email)
+
     args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+    err := m.DB.Pool().QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
     if err != nil {
         switch {
         case strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint) && strings.Contains(err.Error(), "email"):
@@ -130,25 +244,298 @@ func (m UserModel) Insert(user *User) error {
     return nil
 }
 
-// GetByEmail retrives a user from the users table by email address.
-func (m UserModel) GetByEmail(email string) (*User, error) {
-    query := `SELECT id, created_at, name, email, password_hash, activated, version 
+// Registration holds what UserModel.Register creates together with a new user.
+type Registration struct {
+    Permissions   []string      // codes of the permissions granted to the user
+    ActivationTTL time.Duration // lifetime of the activation token
+    Email         *TokenEmail   // welcome email queued in the outbox, if any
+}
+
+// TokenEmail is an email carrying a token, such as the activation token of a welcome email,
+// which is queued in the email outbox in the transaction creating the token.
+type TokenEmail struct {
+    Template string
+    Data     func(token *Token) map[string]any // the template data, built once the token is created
+}
+
+// outboxEmail returns the email to recipient with the data of token.
+func (e *TokenEmail) outboxEmail(recipient string, token *Token) *OutboxEmail {
+    return &OutboxEmail{
+        Recipient: recipient,
+        Template:  e.Template,
+        Payload:   e.Data(token),
+    }
+}
+
+// Register inserts a new user with their permissions and an activation token in one transaction
+// and returns the token. If reg.Email is set, the welcome email is queued in the email outbox in
+// the same transaction, so that it is sent even if the process stops right after the
+// registration.
+func (m UserModel) Register(ctx context.Context, user *User, reg Registration) (*Token, error) {
+    query := `INSERT INTO users (name, email, password_hash, activated) 
+              VALUES ($1, $2, $3, $4) 
+              RETURNING id, created_at, version`
+
+    permissionQuery := `INSERT INTO user_permission 
+                        SELECT $1, id 
+                          FROM permission 
+                         WHERE code = ANY($2)`
+
+    tokenQuery := `INSERT INTO token (hash, user_id, expiry, scope, name, prefix) 
+                   VALUES ($1, $2, $3, $4, $5, $6) 
+                   RETURNING id, created_at`
+
+    user.Email = NormalizeEmail(user.Email)
+
+    args := []any{user.Name, user.Email, user.Password.hash, user.Activated}
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var token *Token
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        err := tx.QueryRow(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+        if err != nil {
+            switch {
+            case strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint) && strings.Contains(err.Error(), "email"):
+                return ErrDuplicateEmail
+            default:
+                return err
+            }
+        }
+
+        _, err = tx.Exec(ctx, permissionQuery, user.ID, reg.Permissions)
+        if err != nil {
+            return err
+        }
+
+        token, err = generateToken(user.ID, reg.ActivationTTL, ScopeActivation)
+        if err != nil {
+            return err
+        }
+
+        tokenArgs := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Name, token.Prefix}
+
+        err = tx.QueryRow(ctx, tokenQuery, tokenArgs...).Scan(&token.ID, &token.CreatedAt)
+        if err != nil {
+            return err
+        }
+
+        if reg.Email == nil {
+            return nil
+        }
+
+        return insertOutboxEmail(ctx, tx, reg.Email.outboxEmail(user.Email, token))
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// ForcePasswordReset locks a user out until they reset their password, e.g. when their account
+// is compromised. In one transaction it deletes all the user's tokens, API keys included, marks
+// the user as requiring a password reset, which login and authentication check, and creates a
+// password reset token with lifetime ttl, which is returned. If email is set, the email with the
+// token is queued in the outbox in the same transaction. The user's version is bumped, whatever
+// it was.
+func (m UserModel) ForcePasswordReset(ctx context.Context, user *User, ttl time.Duration, email *TokenEmail) (*Token, error) {
+    query := `UPDATE users 
+              SET password_reset_required = true, version = version + 1 
+              WHERE id = $1 
+              RETURNING version`
+
+    tokenQuery := `INSERT INTO token (hash, user_id, expiry, scope, name, prefix) 
+                   VALUES ($1, $2, $3, $4, $5, $6) 
+                   RETURNING id, created_at`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var token *Token
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        err := tx.QueryRow(ctx, query, user.ID).Scan(&user.Version)
+        if err != nil {
+            switch {
+            case errors.Is(err, pgx.ErrNoRows):
+                return ErrRecordNotFound
+            default:
+                return err
+            }
+        }
+
+        user.PasswordResetRequired = true
+
+        _, err = tx.Exec(ctx, `DELETE FROM token WHERE user_id = $1`, user.ID)
+        if err != nil {
+            return err
+        }
+
+        token, err = generateToken(user.ID, ttl, ScopePasswordReset)
+        if err != nil {
+            return err
+        }
+
+        tokenArgs := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Name, token.Prefix}
+
+        err = tx.QueryRow(ctx, tokenQuery, tokenArgs...).Scan(&token.ID, &token.CreatedAt)
+        if err != nil {
+            return err
+        }
+
+        if email == nil {
+            return nil
+        }
+
+        return insertOutboxEmail(ctx, tx, email.outboxEmail(user.Email, token))
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// UserListParams holds the filters for UserModel.GetAll. Zero values don't filter.
+type UserListParams struct {
+    Email         string     // case-insensitive substring of the email address
+    Activated     *bool      // activation status
+    CreatedAfter  *time.Time // inclusive lower bound on created_at
+    CreatedBefore *time.Time // exclusive upper bound on created_at
+}
+
+// GetAll returns a page of users matching params. The password hashes are not retrieved.
+func (m UserModel) GetAll(ctx context.Context, params UserListParams, filter Filter) ([]*User, Metadata, error) {
+    orderBy, err := filter.orderBy()
+    if err != nil {
+        return nil, Metadata{}, err
+    }
+
+    query := fmt.Sprintf(`
+        SELECT count(*) OVER(), id, created_at, name, email, activated, password_reset_required, version, 
+               last_login_at, COALESCE(last_login_ip, ''), COALESCE(last_login_user_agent, '') 
+          FROM users 
+         WHERE (strpos(lower(email), lower($1)) > 0 OR $1 = '') 
+           AND (activated = $2 OR $2::boolean IS NULL) 
+           AND (created_at >= $3 OR $3::timestamptz IS NULL) 
+           AND (created_at < $4 OR $4::timestamptz IS NULL) 
+         ORDER BY %s 
+         LIMIT $5 
+        OFFSET $6`, orderBy)
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    args := []any{params.Email, params.Activated, params.CreatedAfter, params.CreatedBefore, filter.limit(), filter.offset()}
+
+    rows, err := m.DB.ReadPool(ctx).Query(ctx, query, args...)
+    if err != nil {
+        return nil, Metadata{}, err
+    }
+    defer rows.Close()
+
+    totalRecords := 0
+    users := []*User{}
+
+    for rows.Next() {
+        var user User
+
+        err := rows.Scan(
+            &totalRecords,
+            &user.ID,
+            &user.CreatedAt,
+            &user.Name,
+            &user.Email,
+            &user.Activated,
+            &user.PasswordResetRequired,
+            &user.Version,
+            &user.LastLoginAt,
+            &user.LastLoginIP,
+            &user.LastLoginUserAgent,
+        )
+        if err != nil {
+            return nil, Metadata{}, err
+        }
+
+        users = append(users, &user)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, Metadata{}, err
+    }
+
+    metadata := calculateMetadata(totalRecords, filter.Page, filter.PageSize)
+
+    return users, metadata, nil
+}
+
+// Get retrieves a user from the users table by ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+    query := `SELECT id, created_at, name, email, password_hash, activated, password_reset_required, version, 
+                     last_login_at, COALESCE(last_login_ip, ''), COALESCE(last_login_user_agent, '') 
+                FROM users 
+               WHERE id = $1`
+
+    var user User
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
+    defer cancel()
+
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, id).Scan(
+        &user.ID,
+        &user.CreatedAt,
+        &user.Name,
+        &user.Email,
+        &user.Password.hash,
+        &user.Activated,
+        &user.PasswordResetRequired,
+        &user.Version,
+        &user.LastLoginAt,
+        &user.LastLoginIP,
+        &user.LastLoginUserAgent,
+    )
+
+    if err != nil {
+        switch {
+        case errors.Is(err, pgx.ErrNoRows):
+            return nil, ErrRecordNotFound
+        default:
+            return nil, err
+        }
+    }
+
+    return &user, nil
+}
+
+// GetByEmail retrives a user from the users table by email address, ignoring case.
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
+    query := `SELECT id, created_at, name, email, password_hash, activated, password_reset_required, version, 
+                     last_login_at, COALESCE(last_login_ip, ''), COALESCE(last_login_user_agent, '') 
                 FROM users 
-               WHERE email = $1`
+               WHERE lower(email::text) = $1`
+
+    email = NormalizeEmail(email)
 
     var user User
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Read())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, email).Scan(
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, email).Scan(
         &user.ID,
         &user.CreatedAt,
         &user.Name,
         &user.Email,
         &user.Password.hash,
         &user.Activated,
+        &user.PasswordResetRequired,
         &user.Version,
+        &user.LastLoginAt,
+        &user.LastLoginIP,
+        &user.LastLoginUserAgent,
     )
 
     if err != nil {
@@ -164,13 +551,17 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 }
 
 // GetByToken retrives the user associated with a particular activation token from the users table.
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
-    query := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.version 
+// The creation, expiry and last use of the token are set in the TokenCreatedAt, TokenExpiry and
+// TokenLastUsedAt fields.
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
+    query := `SELECT u.id, u.created_at, u.name, u.email, u.password_hash, u.activated, u.password_reset_required, u.version, 
+                     u.last_login_at, COALESCE(u.last_login_ip, ''), COALESCE(u.last_login_user_agent, ''), 
+                     t.created_at, t.expiry, t.last_used_at 
                 FROM users u 
                INNER JOIN token t ON u.id = t.user_id 
                WHERE t.hash = $1 
                  AND t.scope = $2 
-                 AND t.expiry > $3`
+                 AND (t.expiry > $3 OR t.expiry IS NULL)`
 
     tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
@@ -178,17 +569,24 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
     var user User
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Token())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, args...).Scan(
+    err := m.DB.ReadPool(ctx).QueryRow(ctx, query, args...).Scan(
         &user.ID,
         &user.CreatedAt,
         &user.Name,
         &user.Email,
         &user.Password.hash,
         &user.Activated,
+        &user.PasswordResetRequired,
         &user.Version,
+        &user.LastLoginAt,
+        &user.LastLoginIP,
+        &user.LastLoginUserAgent,
+        &user.TokenCreatedAt,
+        &user.TokenExpiry,
+        &user.TokenLastUsedAt,
     )
     if err != nil {
         switch {
@@ -202,26 +600,112 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
     return &user, nil
 }
 
+// ActivateForToken activates the user of an activation token and deletes all their activation
+// tokens in one transaction, returning the user and the number of tokens deleted. The token row
+// is locked first, so that of concurrent activations with the same token only one succeeds; the
+// others wait for it and then find the token gone, getting ErrRecordNotFound like an unknown or
+// expired token.
+func (m UserModel) ActivateForToken(ctx context.Context, tokenPlaintext string) (*User, int64, error) {
+    tokenQuery := `SELECT user_id 
+                     FROM token 
+                    WHERE hash = $1 
+                      AND scope = $2 
+                      AND (expiry > $3 OR expiry IS NULL) 
+                      FOR UPDATE`
+
+    deleteQuery := `DELETE FROM token 
+                    WHERE user_id = $1 AND scope = $2`
+
+    query := `UPDATE users 
+              SET activated = true, version = version + 1 
+              WHERE id = $1 
+              RETURNING id, created_at, name, email, password_hash, activated, password_reset_required, version, 
+                        last_login_at, COALESCE(last_login_ip, ''), COALESCE(last_login_user_agent, '')`
+
+    tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var (
+        user    User
+        deleted int64
+    )
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        var userID int64
+
+        err := tx.QueryRow(ctx, tokenQuery, tokenHash[:], ScopeActivation, time.Now()).Scan(&userID)
+        if err != nil {
+            switch {
+            case errors.Is(err, pgx.ErrNoRows):
+                return ErrRecordNotFound
+            default:
+                return err
+            }
+        }
+
+        result, err := tx.Exec(ctx, deleteQuery, userID, ScopeActivation)
+        if err != nil {
+            return err
+        }
+        deleted = result.RowsAffected()
+
+        err = tx.QueryRow(ctx, query, userID).Scan(
+            &user.ID,
+            &user.CreatedAt,
+            &user.Name,
+            &user.Email,
+            &user.Password.hash,
+            &user.Activated,
+            &user.PasswordResetRequired,
+            &user.Version,
+            &user.LastLoginAt,
+            &user.LastLoginIP,
+            &user.LastLoginUserAgent,
+        )
+        if err != nil {
+            switch {
+            case errors.Is(err, pgx.ErrNoRows):
+                return ErrRecordNotFound
+            default:
+                return err
+            }
+        }
+
+        return nil
+    })
+    if err != nil {
+        return nil, 0, err
+    }
+
+    return &user, deleted, nil
+}
+
 // Update updates a record in the users table.
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
     query := `UPDATE users 
-              SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1 
-              WHERE id = $5 AND version = $6 
+              SET name = $1, email = $2, password_hash = $3, activated = $4, password_reset_required = $5, 
+                  version = version + 1 
+              WHERE id = $6 AND version = $7 
               RETURNING version`
 
+    user.Email = NormalizeEmail(user.Email)
+
     args := []any{
         user.Name,
         user.Email,
         user.Password.hash,
         user.Activated,
+        user.PasswordResetRequired,
         user.ID,
         user.Version,
     }
 
-    ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
     defer cancel()
 
-    err := m.DB.Pool.QueryRow(ctx, query, args...).Scan(&user.Version)
+    err := m.DB.Pool().QueryRow(ctx, query, args...).Scan(&user.Version)
     if err != nil {
         switch {
             case strings.Contains(err.Error(), ErrMsgViolateUniqueConstraint) && strings.Contains(err.Error(), "email"):
@@ -234,4 +718,317 @@ func (m UserModel) Update(user *User) error {
     }
 
     return nil
-}
\ No newline at end of file
+}
+
+// UpdatePasswordHash stores the password hash of a user, which was set again to upgrade it (see
+// password.NeedsRehash). The version is left alone since the password is the same, but the
+// update is conditional on it, so that a password changed in the meantime isn't overwritten;
+// ErrEditConflict is returned then.
+func (m UserModel) UpdatePasswordHash(ctx context.Context, user *User) error {
+    query := `UPDATE users 
+              SET password_hash = $1 
+              WHERE id = $2 AND version = $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, user.Password.hash, user.ID, user.Version)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrEditConflict
+    }
+
+    return nil
+}
+
+// maxUserAgentLength is the maximum number of bytes of a user agent stored by UpdateLastLogin.
+const maxUserAgentLength = 512
+
+// UpdateLastLogin records the time, client IP address and user agent of a successful login. The
+// version is left alone since this isn't an edit of the user and mustn't cause edit conflicts.
+func (m UserModel) UpdateLastLogin(ctx context.Context, id int64, ip, userAgent string) error {
+    query := `UPDATE users 
+              SET last_login_at = NOW(), last_login_ip = $1, last_login_user_agent = $2 
+              WHERE id = $3`
+
+    if len(userAgent) > maxUserAgentLength {
+        userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+    }
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    result, err := m.DB.Pool().Exec(ctx, query, ip, userAgent, id)
+    if err != nil {
+        return err
+    }
+
+    if result.RowsAffected() == 0 {
+        return ErrRecordNotFound
+    }
+
+    return nil
+}
+
+// deleteUserData deletes the tokens, permissions and queued emails of a user inside tx, and
+// scrubs the email and IP address from their audit events, which are kept. Deleting the tokens
+// means that any bearer tokens the user holds stop working immediately; deleting the emails
+// means that their address and any token in a payload don't outlive the account. It must run
+// before the email of the user is changed.
+func deleteUserData(ctx context.Context, tx pgx.Tx, id int64) error {
+    _, err := tx.Exec(ctx, `DELETE FROM token WHERE user_id = $1`, id)
+    if err != nil {
+        return err
+    }
+
+    query := `DELETE FROM email_outbox 
+              WHERE lower(recipient) = (SELECT lower(email::text) FROM users WHERE id = $1)`
+
+    _, err = tx.Exec(ctx, query, id)
+    if err != nil {
+        return err
+    }
+
+    // The failed logins with the user's email but an unknown user are scrubbed too.
+    query = `UPDATE audit_log 
+             SET email = '', ip = '' 
+             WHERE user_id = $1 
+                OR lower(email) = (SELECT lower(email::text) FROM users WHERE id = $1)`
+
+    _, err = tx.Exec(ctx, query, id)
+    if err != nil {
+        return err
+    }
+
+    _, err = tx.Exec(ctx, `DELETE FROM user_permission WHERE user_id = $1`, id)
+    return err
+}
+
+// Delete deletes a user together with their tokens, permissions and queued emails in one
+// transaction. Their audit events are kept without their email and IP address.
+func (m UserModel) Delete(ctx context.Context, id int64) error {
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    return m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        err := deleteUserData(ctx, tx, id)
+        if err != nil {
+            return err
+        }
+
+        result, err := tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+        if err != nil {
+            return err
+        }
+
+        if result.RowsAffected() == 0 {
+            return ErrRecordNotFound
+        }
+
+        return nil
+    })
+}
+
+// AnonymizedEmailDomain is the domain of the random email addresses of the users anonymized by
+// Anonymize.
+const AnonymizedEmailDomain = "anonymized.invalid"
+
+// Anonymize deletes the tokens, permissions and queued emails of a user and scrubs their
+// personal data in one transaction, keeping the row so that references from other tables stay
+// valid. The email is replaced by a random address, the name is cleared, the account is
+// deactivated, and the password hash is replaced by a value no password can match. The email
+// and IP address are scrubbed from their audit events.
+func (m UserModel) Anonymize(ctx context.Context, id int64) error {
+    randomBytes := make([]byte, 16)
+
+    _, err := rand.Read(randomBytes)
+    if err != nil {
+        return err
+    }
+
+    email := fmt.Sprintf("deleted-%s@%s", hex.EncodeToString(randomBytes), AnonymizedEmailDomain)
+
+    query := `UPDATE users 
+              SET name = '', email = $1, password_hash = $2, activated = false, 
+                  last_login_ip = NULL, last_login_user_agent = NULL, version = version + 1 
+              WHERE id = $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    return m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        err := deleteUserData(ctx, tx, id)
+        if err != nil {
+            return err
+        }
+
+        result, err := tx.Exec(ctx, query, email, []byte("anonymized"), id)
+        if err != nil {
+            return err
+        }
+
+        if result.RowsAffected() == 0 {
+            return ErrRecordNotFound
+        }
+
+        return nil
+    })
+}
+
+// GetUnreminded returns up to limit users who haven't activated their account, were created
+// before createdBefore and haven't been sent a reminder by Remind, oldest first. Anonymized
+// users, which are deactivated, aren't returned.
+func (m UserModel) GetUnreminded(ctx context.Context, createdBefore time.Time, limit int) ([]*User, error) {
+    query := `SELECT id, created_at, name, email, version 
+                FROM users 
+               WHERE NOT activated AND reminded_at IS NULL AND created_at < $1 
+                 AND email::text NOT LIKE '%@' || $2 
+               ORDER BY created_at, id 
+               LIMIT $3`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    rows, err := m.DB.Pool().Query(ctx, query, createdBefore, AnonymizedEmailDomain, limit)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    users := []*User{}
+
+    for rows.Next() {
+        var user User
+
+        err := rows.Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Email, &user.Version)
+        if err != nil {
+            return nil, err
+        }
+
+        users = append(users, &user)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return users, nil
+}
+
+// Remind records that the user, who hasn't activated their account, was reminded, and replaces
+// their activation tokens with a new one which expires after ttl, in one transaction. Unless
+// email is nil, the reminder email is queued in the outbox in the same transaction. It returns
+// ErrRecordNotFound if the user has been activated or reminded meanwhile.
+func (m UserModel) Remind(ctx context.Context, user *User, ttl time.Duration, email *TokenEmail) (*Token, error) {
+    query := `UPDATE users 
+              SET reminded_at = NOW() 
+              WHERE id = $1 AND NOT activated AND reminded_at IS NULL`
+
+    tokenQuery := `INSERT INTO token (hash, user_id, expiry, scope, name, prefix) 
+                   VALUES ($1, $2, $3, $4, $5, $6) 
+                   RETURNING id, created_at`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.Write())
+    defer cancel()
+
+    var token *Token
+
+    err := m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        result, err := tx.Exec(ctx, query, user.ID)
+        if err != nil {
+            return err
+        }
+
+        if result.RowsAffected() == 0 {
+            return ErrRecordNotFound
+        }
+
+        _, err = tx.Exec(ctx, `DELETE FROM token WHERE user_id = $1 AND scope = $2`, user.ID, ScopeActivation)
+        if err != nil {
+            return err
+        }
+
+        token, err = generateToken(user.ID, ttl, ScopeActivation)
+        if err != nil {
+            return err
+        }
+
+        tokenArgs := []any{token.Hash, token.UserID, token.Expiry, token.Scope, token.Name, token.Prefix}
+
+        err = tx.QueryRow(ctx, tokenQuery, tokenArgs...).Scan(&token.ID, &token.CreatedAt)
+        if err != nil {
+            return err
+        }
+
+        if email == nil {
+            return nil
+        }
+
+        return insertOutboxEmail(ctx, tx, email.outboxEmail(user.Email, token))
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    return token, nil
+}
+
+// DeleteUnactivated deletes the users who haven't activated their account and were created
+// before createdBefore, whether or not they were reminded, in one transaction. Each is deleted
+// like by Delete, together with their tokens, permissions and queued emails, and with their
+// audit events scrubbed. Anonymized users are kept. It returns the number of users and of tokens
+// deleted.
+func (m UserModel) DeleteUnactivated(ctx context.Context, createdBefore time.Time) (users, tokens int64, err error) {
+    query := `SELECT id 
+                FROM users 
+               WHERE NOT activated AND created_at < $1 
+                 AND email::text NOT LIKE '%@' || $2 
+               ORDER BY id 
+                 FOR UPDATE`
+
+    ctx, cancel := context.WithTimeout(ctx, m.Timeouts.List())
+    defer cancel()
+
+    err = m.DB.WithTx(ctx, func(tx pgx.Tx) error {
+        users, tokens = 0, 0
+
+        rows, err := tx.Query(ctx, query, createdBefore, AnonymizedEmailDomain)
+        if err != nil {
+            return err
+        }
+
+        ids, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+        if err != nil {
+            return err
+        }
+
+        for _, id := range ids {
+            var n int64
+
+            err := tx.QueryRow(ctx, `SELECT count(*) FROM token WHERE user_id = $1`, id).Scan(&n)
+            if err != nil {
+                return err
+            }
+
+            err = deleteUserData(ctx, tx, id)
+            if err != nil {
+                return err
+            }
+
+            _, err = tx.Exec(ctx, `DELETE FROM users WHERE id = $1`, id)
+            if err != nil {
+                return err
+            }
+
+            users++
+            tokens += n
+        }
+
+        return nil
+    })
+
+    return users, tokens, err
+}
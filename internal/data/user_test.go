@@ -0,0 +1,83 @@
+package data
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSetPasswordCost(t *testing.T) {
+    t.Cleanup(func() { SetPasswordCost(DefaultPasswordCost) })
+
+    // An unknown email must take as long to reject as a wrong password.
+    if cost, err := bcrypt.Cost(defaultDummyPasswordHash); err != nil || cost != DefaultPasswordCost {
+        t.Errorf("got a default dummy hash at cost %d (%v); want %d", cost, err, DefaultPasswordCost)
+    }
+
+    for _, cost := range []int{bcrypt.MinCost - 1, bcrypt.MaxCost + 1} {
+        if err := SetPasswordCost(cost); err == nil {
+            t.Errorf("cost %d: got no error", cost)
+        }
+    }
+
+    if err := SetPasswordCost(bcrypt.MinCost); err != nil {
+        t.Fatal(err)
+    }
+
+    var p password
+    if err := p.Set("pa55word"); err != nil {
+        t.Fatal(err)
+    }
+    if p.NeedsRehash() {
+        t.Error("got a hash at the current cost needing a rehash")
+    }
+    if cost, err := bcrypt.Cost(dummyPasswordHash); err != nil || cost != bcrypt.MinCost {
+        t.Errorf("got a dummy hash at cost %d (%v); want %d, like the passwords", cost, err, bcrypt.MinCost)
+    }
+
+    if err := SetPasswordCost(bcrypt.MinCost + 1); err != nil {
+        t.Fatal(err)
+    }
+    if !p.NeedsRehash() {
+        t.Error("got a hash at a lower cost not needing a rehash")
+    }
+
+    // Lowering the cost doesn't downgrade the hashes made at a higher cost.
+    if err := p.Set("pa55word"); err != nil {
+        t.Fatal(err)
+    }
+    if err := SetPasswordCost(bcrypt.MinCost); err != nil {
+        t.Fatal(err)
+    }
+    if p.NeedsRehash() {
+        t.Error("got a hash at a higher cost needing a rehash")
+    }
+}
+
+func TestEmailDomainsBlocks(t *testing.T) {
+    domains := DisposableEmailDomains("Spam.Example")
+
+    tests := []struct {
+        email string
+        want  bool
+    }{
+        {"bot@mailinator.com", true},
+        {"bot@MAILINATOR.com", true},
+        {"bot@inbox.mailinator.com", true},
+        {"bot@spam.example", true},
+        {"alice@example.com", false},
+        {"alice@notmailinator.com", false},
+        {"alice@mailinator.com.example.org", false},
+        {"not an email", false},
+    }
+
+    for _, tt := range tests {
+        if got := domains.Blocks(tt.email); got != tt.want {
+            t.Errorf("Blocks(%q) = %t; want %t", tt.email, got, tt.want)
+        }
+    }
+
+    if EmailDomains(nil).Blocks("bot@mailinator.com") {
+        t.Error("got an email blocked by no domains")
+    }
+}
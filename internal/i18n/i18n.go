@@ -0,0 +1,201 @@
+// Package i18n translates the messages of the API, such as error and validation messages, into
+// the language the client asks for with Accept-Language.
+//
+// Messages are keyed by their English format, e.g. "must be at least %d bytes long", as in
+// gettext: English needs no catalog, and a message missing from a catalog stays in English. The
+// catalog of each other language is an embedded JSON file in locales, named after the language,
+// mapping formats to their translations.
+package i18n
+
+import (
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed "locales"
+var localeFS embed.FS
+
+// DefaultLocale is the language of the message formats, used when the client doesn't accept any
+// supported language.
+const DefaultLocale = "en"
+
+// Catalog holds the translations of the messages by locale.
+type Catalog struct {
+    messages map[string]map[string]string
+}
+
+// Load returns the catalog of the embedded locales.
+func Load() (*Catalog, error) {
+    return load(localeFS, "locales")
+}
+
+// load returns the catalog of the .json files of dir in fsys. It checks that every translation
+// has the verbs of its format, so that a translation can't garble or drop the arguments of a
+// message, and that every catalog translates the same messages.
+func load(fsys fs.FS, dir string) (*Catalog, error) {
+    files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+    if err != nil {
+        return nil, err
+    }
+
+    c := &Catalog{messages: make(map[string]map[string]string)}
+
+    var errs []error
+
+    for _, file := range files {
+        locale := localeOf(file)
+
+        b, err := fs.ReadFile(fsys, file)
+        if err != nil {
+            return nil, err
+        }
+
+        var messages map[string]string
+        err = json.Unmarshal(b, &messages)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", file, err)
+        }
+
+        for format, translation := range messages {
+            if !slices.Equal(verbs(format), verbs(translation)) {
+                errs = append(errs, fmt.Errorf("%s: %q doesn't have the verbs of %q", file, translation, format))
+            }
+        }
+
+        c.messages[locale] = messages
+    }
+
+    // Catalogs are compared with the first one, in the order of the file names.
+    for _, file := range files[min(1, len(files)):] {
+        first, locale := localeOf(files[0]), localeOf(file)
+
+        for format := range c.messages[first] {
+            if _, ok := c.messages[locale][format]; !ok {
+                errs = append(errs, fmt.Errorf("%s: missing translation of %q", file, format))
+            }
+        }
+        for format := range c.messages[locale] {
+            if _, ok := c.messages[first][format]; !ok {
+                errs = append(errs, fmt.Errorf("%s: %q isn't translated in %s", file, format, files[0]))
+            }
+        }
+    }
+
+    if len(errs) > 0 {
+        return nil, errors.Join(errs...)
+    }
+
+    return c, nil
+}
+
+// localeOf returns the locale of a catalog file, its name without extension.
+func localeOf(file string) string {
+    return strings.TrimSuffix(path.Base(file), ".json")
+}
+
+// verbRx matches the verbs of a format, with their flags, width, precision and argument index.
+var verbRx = regexp.MustCompile(`%(?:\[\d+\])?[-+# 0]*\d*(?:\.\d+)?[a-zA-Z%]`)
+
+// verbs returns the verbs of a format, sorted so that a translation may reorder the arguments
+// with explicit indexes, e.g. %[2]s.
+func verbs(format string) []string {
+    var found []string
+    for _, verb := range verbRx.FindAllString(format, -1) {
+        if verb == "%%" {
+            continue
+        }
+        found = append(found, verb[len(verb)-1:])
+    }
+    sort.Strings(found)
+
+    return found
+}
+
+// Locales returns the supported locales, DefaultLocale first.
+func (c *Catalog) Locales() []string {
+    locales := []string{DefaultLocale}
+    if c == nil {
+        return locales
+    }
+
+    for locale := range c.messages {
+        locales = append(locales, locale)
+    }
+    slices.Sort(locales[1:])
+
+    return locales
+}
+
+// Sprintf formats the message with format and args in locale, in English if the catalog of
+// locale doesn't translate it. Like validator.Message, a message without arguments is its format
+// as is. A nil catalog translates nothing.
+func (c *Catalog) Sprintf(locale, format string, args ...any) string {
+    if c != nil {
+        if translation, ok := c.messages[locale][format]; ok {
+            format = translation
+        }
+    }
+
+    if len(args) == 0 {
+        return format
+    }
+
+    return fmt.Sprintf(format, args...)
+}
+
+// Negotiate returns the supported locale the client prefers according to an Accept-Language
+// header, e.g. "fr-CA, fr;q=0.9, en;q=0.5". Regional variants match their language, so fr-CA
+// gets fr. A language with a quality of 0 is refused, and * stands for any language, which is
+// DefaultLocale. Of languages with the same quality, the first listed wins; without any
+// supported language, DefaultLocale is returned.
+func (c *Catalog) Negotiate(acceptLanguage string) string {
+    best, bestWeight := DefaultLocale, 0.0
+
+    for _, part := range strings.Split(acceptLanguage, ",") {
+        tag, params, _ := strings.Cut(part, ";")
+
+        weight := 1.0
+        if q, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+            var err error
+            weight, err = strconv.ParseFloat(q, 64)
+            if err != nil {
+                continue
+            }
+        }
+
+        language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+        if language == "*" {
+            language = DefaultLocale
+        }
+
+        if !c.supports(language) || weight <= bestWeight {
+            continue
+        }
+
+        best, bestWeight = language, weight
+    }
+
+    return best
+}
+
+// supports reports whether locale is DefaultLocale or has a catalog.
+func (c *Catalog) supports(locale string) bool {
+    if locale == DefaultLocale {
+        return true
+    }
+    if c == nil {
+        return false
+    }
+
+    _, ok := c.messages[locale]
+    return ok
+}
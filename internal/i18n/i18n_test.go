@@ -0,0 +1,127 @@
+package i18n
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+    c, err := Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if got, want := c.Locales(), []string{"en", "es", "fr"}; !slices.Equal(got, want) {
+        t.Errorf("got locales %v; want %v", got, want)
+    }
+}
+
+func TestLoadInvalid(t *testing.T) {
+    tests := []struct {
+        name    string
+        files   fstest.MapFS
+        wantErr string
+    }{
+        {
+            name:    "malformed JSON",
+            files:   fstest.MapFS{"locales/fr.json": {Data: []byte(`{"a": `)}},
+            wantErr: "locales/fr.json",
+        },
+        {
+            name:    "missing verb",
+            files:   fstest.MapFS{"locales/fr.json": {Data: []byte(`{"must be at least %d bytes long": "trop court"}`)}},
+            wantErr: `"trop court" doesn't have the verbs`,
+        },
+        {
+            name:    "wrong verb",
+            files:   fstest.MapFS{"locales/fr.json": {Data: []byte(`{"at least %d": "au moins %s"}`)}},
+            wantErr: `"au moins %s" doesn't have the verbs`,
+        },
+        {
+            name: "missing translation",
+            files: fstest.MapFS{
+                "locales/es.json": {Data: []byte(`{"rate limit exceeded": "se superó el límite de solicitudes"}`)},
+                "locales/fr.json": {Data: []byte(`{}`)},
+            },
+            wantErr: `locales/fr.json: missing translation of "rate limit exceeded"`,
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            _, err := load(tt.files, "locales")
+            if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+                t.Errorf("got error %v; want it to contain %q", err, tt.wantErr)
+            }
+        })
+    }
+}
+
+func TestSprintf(t *testing.T) {
+    c, err := load(fstest.MapFS{
+        "locales/fr.json": {Data: []byte(`{"must be between %d and %d": "doit être entre %[2]d et %[1]d", "100%": "100 %"}`)},
+    }, "locales")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name   string
+        c      *Catalog
+        locale string
+        format string
+        args   []any
+        want   string
+    }{
+        {"translated", c, "fr", "must be between %d and %d", []any{1, 5}, "doit être entre 5 et 1"},
+        {"without arguments", c, "fr", "100%", nil, "100 %"},
+        {"not translated", c, "fr", "must be provided", nil, "must be provided"},
+        {"English", c, "en", "must be between %d and %d", []any{1, 5}, "must be between 1 and 5"},
+        {"unknown locale", c, "de", "must be between %d and %d", []any{1, 5}, "must be between 1 and 5"},
+        {"nil catalog", nil, "fr", "must be between %d and %d", []any{1, 5}, "must be between 1 and 5"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            if got := tt.c.Sprintf(tt.locale, tt.format, tt.args...); got != tt.want {
+                t.Errorf("got %q; want %q", got, tt.want)
+            }
+        })
+    }
+}
+
+func TestNegotiate(t *testing.T) {
+    c, err := Load()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        acceptLanguage string
+        want           string
+    }{
+        {"", "en"},
+        {"fr", "fr"},
+        {"fr-CA", "fr"},
+        {"ES-mx", "es"},
+        {"de", "en"},
+        {"de, es;q=0.5", "es"},
+        {"fr;q=0.5, es;q=0.8", "es"},
+        {"fr, es", "fr"},
+        {"en;q=0.9, fr", "fr"},
+        {"fr;q=0, es;q=0.1", "es"},
+        {"fr;q=0", "en"},
+        {"*, fr;q=0.5", "en"},
+        {"fr;q=nope, es;q=0.3", "es"},
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.acceptLanguage, func(t *testing.T) {
+            if got := c.Negotiate(tt.acceptLanguage); got != tt.want {
+                t.Errorf("got %q; want %q", got, tt.want)
+            }
+        })
+    }
+}
@@ -3,8 +3,15 @@ package mail
 import (
 	"bytes"
 	"embed"
-	"html/template"
+	"expvar"
+	"log/slog"
 	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
 
 	"github.com/jordan-wright/email"
 	"greenlight.zzh.net/internal/config"
@@ -13,15 +20,89 @@ import (
 //go:embed "templates"
 var templateFS embed.FS
 
-// EmailSender wraps a *config.SMTPConfig which stores configuration for sending emails.
+// Sender is implemented by anything that can send a templated email.
+type Sender interface {
+    Send(to, templateFile string, data any) error
+}
+
+// EmailSender sends emails through the transport of its configuration: an SMTP server, or for
+// development the log or .eml files. The configuration can be replaced at runtime with
+// SetConfig.
 type EmailSender struct {
-    SMTPCfg *config.SMTPConfig
+    smtpCfg atomic.Pointer[config.SMTPConfig]
+    logger  *slog.Logger
+}
+
+// NewEmailSender returns an EmailSender using cfg. logger is used by the log transport.
+func NewEmailSender(cfg *config.SMTPConfig, logger *slog.Logger) *EmailSender {
+    sender := &EmailSender{logger: logger}
+    sender.smtpCfg.Store(cfg)
+    return sender
+}
+
+// SetConfig replaces the SMTP configuration used for emails sent from now on.
+func (sender *EmailSender) SetConfig(cfg *config.SMTPConfig) {
+    sender.smtpCfg.Store(cfg)
 }
 
-// Send sends an email whose subject and content are read from a template file.
-// Use a pointer receiver because the fields of EmailSender can be dynamically loaded.
+// The email metrics, so that on-call can tell from /debug/vars whether the mail path works.
+var (
+    totalEmailsSent             = expvar.NewInt("total_emails_sent")
+    totalEmailsFailed           = expvar.NewInt("total_emails_failed")
+    totalEmailsSentByTemplate   = expvar.NewMap("total_emails_sent_by_template")
+    totalEmailsFailedByTemplate = expvar.NewMap("total_emails_failed_by_template")
+    lastEmailSendDuration       = expvar.NewInt("last_email_send_duration_μs") // of the last successful send
+    lastEmailError              = expvar.NewString("last_email_error")          // sanitized, see sanitizeError
+)
+
+// maxErrorLength is the length last_email_error is truncated to.
+const maxErrorLength = 200
+
+// Send sends an email whose subject and content are read from a template file. The outcome is
+// counted in the total_emails_* expvars, in total and by template, and the error of a failure is
+// kept in the last_email_error expvar.
 func (sender *EmailSender) Send(to, templateFile string, data any) error {
-    tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+    start := time.Now()
+
+    err := sender.send(to, templateFile, data)
+    if err != nil {
+        totalEmailsFailed.Add(1)
+        totalEmailsFailedByTemplate.Add(templateFile, 1)
+        lastEmailError.Set(sanitizeError(err, sender.smtpCfg.Load()))
+        return err
+    }
+
+    totalEmailsSent.Add(1)
+    totalEmailsSentByTemplate.Add(templateFile, 1)
+    lastEmailSendDuration.Set(time.Since(start).Microseconds())
+
+    return nil
+}
+
+// sanitizeError returns the message of err fit for publishing: the SMTP password, should the
+// server echo it back, is masked, control characters such as the line breaks of multi-line SMTP
+// replies are replaced with spaces and the message is truncated to maxErrorLength, e.g.
+// "535 5.7.8 Username and Password not accepted.".
+func sanitizeError(err error, cfg *config.SMTPConfig) string {
+    msg := err.Error()
+
+    if cfg != nil && cfg.Password != "" {
+        msg = strings.ReplaceAll(msg, cfg.Password, "********")
+    }
+
+    msg = strings.Join(strings.FieldsFunc(msg, unicode.IsControl), " ")
+
+    if len(msg) > maxErrorLength {
+        msg = strings.ToValidUTF8(msg[:maxErrorLength], "") + "..."
+    }
+
+    return msg
+}
+
+func (sender *EmailSender) send(to, templateFile string, data any) error {
+    smtpCfg := sender.smtpCfg.Load()
+
+    tmpl, err := getTemplate(templateFile)
     if err != nil {
         return err
     }
@@ -49,12 +130,42 @@ func (sender *EmailSender) Send(to, templateFile string, data any) error {
     }
 
     e := email.NewEmail()
-    e.From = sender.SMTPCfg.Username // 553 Mail from must equal authorized user
+    e.From = smtpCfg.Username // 553 Mail from must equal authorized user
     e.To = []string{to}
     e.Subject = subject.String()
     e.Text = plainBody.Bytes()
     e.HTML = htmlBody.Bytes()
 
-    smtpAuth := smtp.PlainAuth("", sender.SMTPCfg.Username, sender.SMTPCfg.Password, sender.SMTPCfg.AuthAddress)
-    return e.Send(sender.SMTPCfg.ServerAddress, smtpAuth)
+    switch smtpCfg.Transport {
+    case "log":
+        sender.logger.Info("email", "to", to, "subject", e.Subject, "body", plainBody.String())
+        return nil
+    case "file":
+        return writeEmailFile(smtpCfg.FileDir, templateFile, e)
+    default:
+        smtpAuth := smtp.PlainAuth("", smtpCfg.Username, smtpCfg.Password, smtpCfg.AuthAddress)
+        return e.Send(smtpCfg.ServerAddress, smtpAuth)
+    }
+}
+
+// writeEmailFile saves e as an .eml file in dir, named after the current time and the template,
+// e.g. 20240101T120000.000000000Z_user_welcome.eml.
+func writeEmailFile(dir, templateFile string, e *email.Email) error {
+    if e.From == "" {
+        e.From = "greenlight@localhost"
+    }
+
+    b, err := e.Bytes()
+    if err != nil {
+        return err
+    }
+
+    err = os.MkdirAll(dir, 0o755)
+    if err != nil {
+        return err
+    }
+
+    name := time.Now().UTC().Format("20060102T150405.000000000Z") + "_" + strings.TrimSuffix(templateFile, filepath.Ext(templateFile)) + ".eml"
+
+    return os.WriteFile(filepath.Join(dir, name), b, 0o600)
 }
\ No newline at end of file
@@ -0,0 +1,169 @@
+package mail
+
+import (
+	"bytes"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"greenlight.zzh.net/internal/config"
+)
+
+// activationTokenRx matches the activation token in the welcome email.
+var activationTokenRx = regexp.MustCompile(`\{"token": "([A-Z2-7]{26})"\}`)
+
+var welcomeData = map[string]any{"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "userID": 7}
+
+func TestLogTransport(t *testing.T) {
+    var buf bytes.Buffer
+    sender := NewEmailSender(&config.SMTPConfig{Transport: "log"}, slog.New(slog.NewJSONHandler(&buf, nil)))
+
+    err := sender.Send("dave@example.com", "user_welcome.html", welcomeData)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    out := buf.String()
+    if !strings.Contains(out, `"to":"dave@example.com"`) || !strings.Contains(out, `"subject":"Welcome to Grrenlight!"`) {
+        t.Errorf("log doesn't have the recipient and subject: %s", out)
+    }
+
+    // The token can be copied from the log during local testing. The body is JSON-escaped.
+    m := activationTokenRx.FindStringSubmatch(strings.ReplaceAll(out, `\"`, `"`))
+    if m == nil || m[1] != welcomeData["activationToken"] {
+        t.Errorf("got token %v from the log; want %s", m, welcomeData["activationToken"])
+    }
+}
+
+func TestFileTransport(t *testing.T) {
+    dir := filepath.Join(t.TempDir(), "mail")
+    sender := NewEmailSender(&config.SMTPConfig{Transport: "file", FileDir: dir}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+    for range 2 {
+        err := sender.Send("dave@example.com", "user_welcome.html", welcomeData)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    files, err := filepath.Glob(filepath.Join(dir, "*_user_welcome.eml"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(files) != 2 {
+        t.Fatalf("got files %v; want 2", files)
+    }
+
+    f, err := os.Open(files[0])
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer f.Close()
+
+    msg, err := netmail.ReadMessage(f)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if got := msg.Header.Get("To"); got != "<dave@example.com>" {
+        t.Errorf("got To %q; want <dave@example.com>", got)
+    }
+
+    // The token is in the plain text part of the multipart message, as a mail client shows it.
+    _, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    mr := multipart.NewReader(msg.Body, params["boundary"])
+
+    part, err := mr.NextPart()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    body, err := io.ReadAll(part)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    m := activationTokenRx.FindSubmatch(body)
+    if m == nil || string(m[1]) != welcomeData["activationToken"] {
+        t.Errorf("got token %q from the file; want %s\n%s", m, welcomeData["activationToken"], body)
+    }
+}
+
+// mapCount returns the counter of key in m, or 0 if there is none yet.
+func mapCount(m *expvar.Map, key string) int64 {
+    if v, ok := m.Get(key).(*expvar.Int); ok {
+        return v.Value()
+    }
+    return 0
+}
+
+func TestSendMetrics(t *testing.T) {
+    logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+    sent, failed := totalEmailsSent.Value(), totalEmailsFailed.Value()
+    sentByTemplate := mapCount(totalEmailsSentByTemplate, "user_welcome.html")
+
+    err := NewEmailSender(&config.SMTPConfig{Transport: "log"}, logger).Send("dave@example.com", "user_welcome.html", welcomeData)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if got := totalEmailsSent.Value() - sent; got != 1 {
+        t.Errorf("got %d more emails sent; want 1", got)
+    }
+    if got := mapCount(totalEmailsSentByTemplate, "user_welcome.html") - sentByTemplate; got != 1 {
+        t.Errorf("got %d more user_welcome.html emails sent; want 1", got)
+    }
+
+    // A file in the way of the mail directory makes the file transport fail.
+    blocker := filepath.Join(t.TempDir(), "blocker")
+    err = os.WriteFile(blocker, nil, 0o600)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    err = NewEmailSender(&config.SMTPConfig{Transport: "file", FileDir: filepath.Join(blocker, "mail")}, logger).Send("dave@example.com", "user_welcome.html", welcomeData)
+    if err == nil {
+        t.Fatal("expected Send to fail")
+    }
+
+    if got := totalEmailsFailed.Value() - failed; got != 1 {
+        t.Errorf("got %d more emails failed; want 1", got)
+    }
+    if got := lastEmailError.Value(); got != err.Error() {
+        t.Errorf("got last_email_error %q; want %q", got, err.Error())
+    }
+}
+
+func TestSanitizeError(t *testing.T) {
+    cfg := &config.SMTPConfig{Password: "s3cr3t"}
+
+    tests := []struct {
+        err  string
+        want string
+    }{
+        {"535 5.7.8 Username and Password not accepted.", "535 5.7.8 Username and Password not accepted."},
+        {"535-5.7.8 Username and Password not accepted.\r\n535 5.7.8 Learn more", "535-5.7.8 Username and Password not accepted. 535 5.7.8 Learn more"},
+        {"auth failed for password s3cr3t", "auth failed for password ********"},
+        {strings.Repeat("é", 150), strings.Repeat("é", 100) + "..."},
+    }
+
+    for _, tt := range tests {
+        if got := sanitizeError(errors.New(tt.err), cfg); got != tt.want {
+            t.Errorf("sanitizeError(%q) = %q; want %q", tt.err, got, tt.want)
+        }
+    }
+}
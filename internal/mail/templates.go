@@ -0,0 +1,135 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"sync"
+)
+
+// templateBlocks are the named templates every email template must define.
+var templateBlocks = []string{"subject", "plainBody", "htmlBody"}
+
+// sampleData holds representative data for each template, used by ValidateTemplates to execute
+// them. Every template must have an entry.
+var sampleData = map[string]any{
+    "user_welcome.html": map[string]any{
+        "activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "activationURL":   "https://app.example.com/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "userID":          int64(123),
+    },
+    "password_reset.html": map[string]any{
+        "passwordResetToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "passwordResetURL":   "https://app.example.com/reset-password?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "userID":             int64(123),
+    },
+    "activation_reminder.html": map[string]any{
+        "activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "activationURL":   "https://app.example.com/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU",
+        "userID":          int64(123),
+        "deleteAfterDays": 30,
+    },
+}
+
+var (
+    templatesMu  sync.Mutex
+    templates    = make(map[string]*template.Template)
+    templatesErr = errors.New("mail templates haven't been validated")
+)
+
+// parseTemplate parses a template file of fsys. A missing key in the data is an error, so that
+// a misspelled field doesn't silently render as "<no value>".
+func parseTemplate(fsys fs.FS, templateFile string) (*template.Template, error) {
+    return template.New("email").Option("missingkey=error").ParseFS(fsys, "templates/"+templateFile)
+}
+
+// getTemplate returns the parsed template file, parsing it on first use if ValidateTemplates
+// hasn't cached it.
+func getTemplate(templateFile string) (*template.Template, error) {
+    templatesMu.Lock()
+    defer templatesMu.Unlock()
+
+    if tmpl, ok := templates[templateFile]; ok {
+        return tmpl, nil
+    }
+
+    tmpl, err := parseTemplate(templateFS, templateFile)
+    if err != nil {
+        return nil, err
+    }
+
+    templates[templateFile] = tmpl
+    return tmpl, nil
+}
+
+// ValidateTemplates parses every embedded template and executes each of its blocks with the
+// template's sample data, caching the parsed templates for Send. It returns all the problems
+// found, so that a broken template stops the application at startup rather than when a user
+// registers. The result is also returned by TemplatesError.
+func ValidateTemplates() error {
+    parsed, err := validateTemplates(templateFS, sampleData)
+
+    templatesMu.Lock()
+    defer templatesMu.Unlock()
+
+    for name, tmpl := range parsed {
+        templates[name] = tmpl
+    }
+    templatesErr = err
+
+    return err
+}
+
+// validateTemplates parses and executes the templates of fsys with samples, returning the valid
+// ones and all the problems found.
+func validateTemplates(fsys fs.FS, samples map[string]any) (map[string]*template.Template, error) {
+    files, err := fs.Glob(fsys, "templates/*")
+    if err != nil {
+        return nil, err
+    }
+
+    parsed := make(map[string]*template.Template)
+    var errs []error
+
+    for _, file := range files {
+        name := file[len("templates/"):]
+
+        tmpl, err := parseTemplate(fsys, name)
+        if err != nil {
+            errs = append(errs, err)
+            continue
+        }
+
+        data, ok := samples[name]
+        if !ok {
+            errs = append(errs, fmt.Errorf("%s: no sample data to validate it with", name))
+            continue
+        }
+
+        valid := true
+        for _, block := range templateBlocks {
+            err := tmpl.ExecuteTemplate(io.Discard, block, data)
+            if err != nil {
+                errs = append(errs, fmt.Errorf("%s: %w", name, err))
+                valid = false
+            }
+        }
+
+        if valid {
+            parsed[name] = tmpl
+        }
+    }
+
+    return parsed, errors.Join(errs...)
+}
+
+// TemplatesError returns the result of the last ValidateTemplates call, or an error if it
+// hasn't been called.
+func TemplatesError() error {
+    templatesMu.Lock()
+    defer templatesMu.Unlock()
+
+    return templatesErr
+}
@@ -0,0 +1,78 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestValidateTemplates(t *testing.T) {
+    err := ValidateTemplates()
+    if err != nil {
+        t.Fatalf("embedded templates: %v", err)
+    }
+    if err := TemplatesError(); err != nil {
+        t.Errorf("TemplatesError() = %v; want nil", err)
+    }
+
+    tmpl, err := getTemplate("user_welcome.html")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    var b strings.Builder
+    err = tmpl.ExecuteTemplate(&b, "plainBody", sampleData["user_welcome.html"])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(b.String(), "https://app.example.com/activate?token=Y3QMGX3PJ3WLRL2YRTQGQ6KRHU") {
+        t.Errorf("plain body doesn't contain the activation link:\n%s", b.String())
+    }
+
+    // Without a link, as without FRONTEND_BASE_URL or in the emails queued in the outbox before
+    // the links, the email explains the API request instead.
+    b.Reset()
+    err = tmpl.ExecuteTemplate(&b, "plainBody", map[string]any{"activationToken": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU", "userID": int64(123)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(b.String(), `{"token": "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"}`) || strings.Contains(b.String(), "link") {
+        t.Errorf("plain body without a link doesn't explain the API request:\n%s", b.String())
+    }
+}
+
+func TestValidateTemplatesErrors(t *testing.T) {
+    blocks := `{{define "subject"}}Hi{{end}}{{define "htmlBody"}}<p>{{.name}}</p>{{end}}`
+
+    fsys := fstest.MapFS{
+        "templates/ok.html":        {Data: []byte(blocks + `{{define "plainBody"}}{{.name}}{{end}}`)},
+        "templates/typo.html":      {Data: []byte(blocks + `{{define "plainBody"}}{{.nmae}}{{end}}`)},
+        "templates/missing.html":   {Data: []byte(blocks)},
+        "templates/syntax.html":    {Data: []byte(blocks + `{{define "plainBody"}}{{.name}{{end}}`)},
+        "templates/no_sample.html": {Data: []byte(blocks + `{{define "plainBody"}}{{.name}}{{end}}`)},
+    }
+    samples := map[string]any{
+        "ok.html":      map[string]any{"name": "Alice"},
+        "typo.html":    map[string]any{"name": "Alice"},
+        "missing.html": map[string]any{"name": "Alice"},
+        "syntax.html":  map[string]any{"name": "Alice"},
+    }
+
+    parsed, err := validateTemplates(fsys, samples)
+    if err == nil {
+        t.Fatal("got no error")
+    }
+
+    for _, name := range []string{"typo.html", "missing.html", "syntax.html", "no_sample.html"} {
+        if !strings.Contains(err.Error(), name) {
+            t.Errorf("error doesn't name %s: %v", name, err)
+        }
+        if _, ok := parsed[name]; ok {
+            t.Errorf("%s was cached", name)
+        }
+    }
+
+    if _, ok := parsed["ok.html"]; !ok {
+        t.Error("ok.html wasn't cached")
+    }
+}
@@ -0,0 +1,42 @@
+// Package metrics holds the counters which several handlers and middleware increment, so that
+// each doesn't declare its own globals. They're published with expvar under /debug/vars.
+package metrics
+
+import "expvar"
+
+// Counter is a count which only goes up. It's published with expvar; the handlers only see Inc,
+// so the counters can also be exported in another format, e.g. to Prometheus, without changing
+// them.
+type Counter struct {
+    v *expvar.Int
+}
+
+// NewCounter returns a counter published under name. Like expvar.NewInt it panics if the name is
+// already in use, so counters are declared once, below.
+func NewCounter(name string) *Counter {
+    return &Counter{v: expvar.NewInt(name)}
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+    c.v.Add(1)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() int64 {
+    return c.v.Value()
+}
+
+// Authentication outcomes, e.g. to alert when login failures spike.
+var (
+    AuthSuccess             = NewCounter("auth_success")               // authentication tokens created
+    AuthFailureBadPassword  = NewCounter("auth_failure_bad_password")  // logins of a known email with a wrong password
+    AuthFailureUnknownEmail = NewCounter("auth_failure_unknown_email") // logins of an email with no account
+    AuthFailureInvalidToken = NewCounter("auth_failure_invalid_token") // requests with a malformed, unknown or expired token
+    ActivationSuccess       = NewCounter("activation_success")         // users activated with an activation token
+)
+
+// Registration outcomes, e.g. to see how many bots the honeypot catches.
+var (
+    RegistrationHoneypot = NewCounter("registration_honeypot") // registrations faked because the honeypot field was filled
+)
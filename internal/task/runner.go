@@ -0,0 +1,116 @@
+// Package task runs background work, such as sending emails, on a bounded pool of workers.
+package task
+
+import (
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// Stats holds the task counters of a Runner.
+type Stats struct {
+    Queued    int64 `json:"queued"`
+    Active    int64 `json:"active"`
+    Completed int64 `json:"completed"`
+    Failed    int64 `json:"failed"` // returned an error or panicked
+}
+
+type task struct {
+    name string
+    fn   func() error
+}
+
+// Runner runs tasks on a fixed number of workers. Tasks wait in a queue of limited size for a
+// free worker, so a burst of work can't start an unbounded number of goroutines.
+type Runner struct {
+    logger    *slog.Logger
+    wg        *sync.WaitGroup
+    queue     chan task
+    workers   sync.WaitGroup
+    closeOnce sync.Once
+
+    queued    atomic.Int64
+    active    atomic.Int64
+    completed atomic.Int64
+    failed    atomic.Int64
+}
+
+// NewRunner starts a Runner with the given number of workers and queue size. Every task is
+// counted in wg from Submit until it has run, so that waiting on wg drains the queue.
+func NewRunner(logger *slog.Logger, workers, queueSize int, wg *sync.WaitGroup) *Runner {
+    r := &Runner{
+        logger: logger,
+        wg:     wg,
+        queue:  make(chan task, queueSize),
+    }
+
+    r.workers.Add(workers)
+    for range workers {
+        go r.work()
+    }
+
+    return r
+}
+
+// Submit queues fn to be run under name, which identifies the task in the log. It blocks while
+// the queue is full. An error returned or a panic raised by fn is logged with the name.
+func (r *Runner) Submit(name string, fn func() error) {
+    r.wg.Add(1)
+    r.queued.Add(1)
+
+    r.queue <- task{name: name, fn: fn}
+}
+
+// Close stops the workers once the queued tasks have run and waits for them. Submit must not be
+// called after Close.
+func (r *Runner) Close() {
+    r.closeOnce.Do(func() {
+        close(r.queue)
+    })
+
+    r.workers.Wait()
+}
+
+// Stats returns the current task counters.
+func (r *Runner) Stats() Stats {
+    return Stats{
+        Queued:    r.queued.Load(),
+        Active:    r.active.Load(),
+        Completed: r.completed.Load(),
+        Failed:    r.failed.Load(),
+    }
+}
+
+func (r *Runner) work() {
+    defer r.workers.Done()
+
+    for t := range r.queue {
+        r.queued.Add(-1)
+        r.active.Add(1)
+
+        err := r.run(t)
+
+        r.active.Add(-1)
+        if err != nil {
+            r.failed.Add(1)
+            r.logger.Error("background task failed", "task", t.name, "error", err)
+        } else {
+            r.completed.Add(1)
+        }
+
+        r.wg.Done()
+    }
+}
+
+// run runs t, turning a panic into an error.
+func (r *Runner) run(t task) (err error) {
+    defer func() {
+        if p := recover(); p != nil {
+            err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+        }
+    }()
+
+    return t.fn()
+}
@@ -0,0 +1,105 @@
+package task
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunnerBoundsConcurrency(t *testing.T) {
+    var wg sync.WaitGroup
+
+    r := NewRunner(slog.New(slog.NewTextHandler(io.Discard, nil)), 2, 10, &wg)
+    defer r.Close()
+
+    var running, maxRunning atomic.Int64
+    release := make(chan struct{})
+
+    for range 6 {
+        r.Submit("block", func() error {
+            n := running.Add(1)
+            for {
+                m := maxRunning.Load()
+                if n <= m || maxRunning.CompareAndSwap(m, n) {
+                    break
+                }
+            }
+
+            <-release
+            running.Add(-1)
+            return nil
+        })
+    }
+
+    // Wait for the workers to pick up their first tasks.
+    deadline := time.Now().Add(time.Second)
+    for r.Stats().Active < 2 && time.Now().Before(deadline) {
+        time.Sleep(time.Millisecond)
+    }
+
+    if got := r.Stats(); got.Active != 2 || got.Queued != 4 {
+        t.Errorf("got %+v; want 2 active and 4 queued", got)
+    }
+
+    close(release)
+    wg.Wait()
+
+    if got := maxRunning.Load(); got != 2 {
+        t.Errorf("got %d tasks running at once; want 2", got)
+    }
+    if got := r.Stats(); got != (Stats{Completed: 6}) {
+        t.Errorf("got %+v; want 6 completed", got)
+    }
+}
+
+func TestRunnerFailures(t *testing.T) {
+    var (
+        wg   sync.WaitGroup
+        logs bytes.Buffer
+    )
+
+    r := NewRunner(slog.New(slog.NewTextHandler(&logs, nil)), 1, 1, &wg)
+    defer r.Close()
+
+    r.Submit("failing email", func() error { return errors.New("smtp down") })
+    r.Submit("panicking email", func() error { panic("boom") })
+    r.Submit("email", func() error { return nil })
+    wg.Wait()
+
+    if got := r.Stats(); got != (Stats{Completed: 1, Failed: 2}) {
+        t.Errorf("got %+v; want 1 completed and 2 failed", got)
+    }
+
+    for _, want := range []string{`task="failing email"`, "smtp down", `task="panicking email"`, "boom"} {
+        if !strings.Contains(logs.String(), want) {
+            t.Errorf("log %q doesn't contain %q", logs.String(), want)
+        }
+    }
+}
+
+func TestRunnerCloseDrainsQueue(t *testing.T) {
+    var wg sync.WaitGroup
+
+    r := NewRunner(slog.New(slog.NewTextHandler(io.Discard, nil)), 1, 5, &wg)
+
+    var done atomic.Int64
+    for range 5 {
+        r.Submit("count", func() error {
+            time.Sleep(time.Millisecond)
+            done.Add(1)
+            return nil
+        })
+    }
+
+    r.Close()
+
+    if got := done.Load(); got != 5 {
+        t.Errorf("got %d tasks run before Close returned; want 5", got)
+    }
+}
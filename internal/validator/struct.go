@@ -0,0 +1,209 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleFunc checks the value of a field against a rule. param is the text after "=" in the tag,
+// e.g. "500" for "max=500", and key is the key errors are reported under. It returns ok and,
+// if the check fails, the error message, e.g. Msg("must not be more than %d bytes long", 500).
+type RuleFunc func(value reflect.Value, param, key string) (message Message, ok bool)
+
+// rules maps the rule names usable in validate tags to their implementations.
+var rules = map[string]RuleFunc{
+    "required":  ruleRequired,
+    "min":       ruleMin,
+    "max":       ruleMax,
+    "positive":  rulePositive,
+    "notfuture": ruleNotFuture,
+    "unique":    ruleUnique,
+    "email":     ruleEmail,
+}
+
+// RegisterRule makes a custom rule available to validate tags under name, replacing any rule
+// with the same name. It isn't safe for concurrent use, so call it before validating, e.g. from
+// an init function.
+func RegisterRule(name string, fn RuleFunc) {
+    rules[name] = fn
+}
+
+// Struct checks the exported fields of the struct s, or of the struct s points to, against the
+// rules in their validate tags and adds any failures to v, e.g.
+//
+//	Title string `json:"title" validate:"required,max=500"`
+//
+// Errors are reported under the field's JSON name. Rules are checked in order and all failures
+// are reported. Nil pointer fields are only checked by "required". Struct panics if a tag names
+// an unknown rule, since that is a programming error.
+func Struct(v *Validator, s any) {
+    rv := reflect.Indirect(reflect.ValueOf(s))
+    if rv.Kind() != reflect.Struct {
+        panic(fmt.Sprintf("validator: Struct called with %T", s))
+    }
+
+    rt := rv.Type()
+
+    for i := range rt.NumField() {
+        field := rt.Field(i)
+
+        tag, ok := field.Tag.Lookup("validate")
+        if !ok || !field.IsExported() || tag == "" || tag == "-" {
+            continue
+        }
+
+        key := fieldKey(field)
+        value := rv.Field(i)
+
+        for _, rule := range strings.Split(tag, ",") {
+            name, param, _ := strings.Cut(rule, "=")
+
+            fn, ok := rules[name]
+            if !ok {
+                panic(fmt.Sprintf("validator: unknown rule %q on field %s", name, field.Name))
+            }
+
+            checked := value
+            if checked.Kind() == reflect.Pointer && name != "required" {
+                if checked.IsNil() {
+                    continue
+                }
+                checked = checked.Elem()
+            }
+
+            message, ok := fn(checked, param, key)
+            if !ok {
+                v.AddMessage(key, message)
+            }
+        }
+    }
+}
+
+// fieldKey returns the name of field in JSON, which is the key its errors are reported under.
+func fieldKey(field reflect.StructField) string {
+    name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+    if name == "" || name == "-" {
+        return strings.ToLower(field.Name)
+    }
+
+    return name
+}
+
+// intParam parses the parameter of a rule which needs a number.
+func intParam(rule, param string) int64 {
+    n, err := strconv.ParseInt(param, 10, 64)
+    if err != nil {
+        panic(fmt.Sprintf("validator: %s rule needs an integer parameter, got %q", rule, param))
+    }
+
+    return n
+}
+
+// noun returns the name of the items of a collection for n of them, e.g. "genre" or "genres"
+// for the key "genres".
+func noun(key string, n int64) string {
+    if n == 1 {
+        return strings.TrimSuffix(key, "s")
+    }
+
+    return key
+}
+
+func ruleRequired(value reflect.Value, _, _ string) (Message, bool) {
+    switch value.Kind() {
+    case reflect.Slice, reflect.Map, reflect.Pointer, reflect.Interface:
+        return Msg("must be provided"), !value.IsNil()
+    default:
+        return Msg("must be provided"), !value.IsZero()
+    }
+}
+
+func ruleMin(value reflect.Value, param, key string) (Message, bool) {
+    n := intParam("min", param)
+
+    switch value.Kind() {
+    case reflect.String:
+        return Msg("must be at least %d bytes long", n), int64(value.Len()) >= n
+    case reflect.Slice, reflect.Array, reflect.Map:
+        return Msg("must contain at least %d %s", n, noun(key, n)), int64(value.Len()) >= n
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return Msg("must be greater than or equal to %d", n), value.Int() >= n
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return Msg("must be greater than or equal to %d", n), n <= 0 || value.Uint() >= uint64(n)
+    default:
+        panic(fmt.Sprintf("validator: min rule can't be used on %s", value.Type()))
+    }
+}
+
+func ruleMax(value reflect.Value, param, key string) (Message, bool) {
+    n := intParam("max", param)
+
+    switch value.Kind() {
+    case reflect.String:
+        return Msg("must not be more than %d bytes long", n), int64(value.Len()) <= n
+    case reflect.Slice, reflect.Array, reflect.Map:
+        return Msg("must not contain more than %d %s", n, noun(key, n)), int64(value.Len()) <= n
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return Msg("must be less than or equal to %d", n), value.Int() <= n
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return Msg("must be less than or equal to %d", n), n >= 0 && value.Uint() <= uint64(n)
+    default:
+        panic(fmt.Sprintf("validator: max rule can't be used on %s", value.Type()))
+    }
+}
+
+func rulePositive(value reflect.Value, _, _ string) (Message, bool) {
+    switch value.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return Msg("must be a positive integer"), value.Int() > 0
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return Msg("must be a positive integer"), value.Uint() > 0
+    case reflect.Float32, reflect.Float64:
+        return Msg("must be a positive number"), value.Float() > 0
+    default:
+        panic(fmt.Sprintf("validator: positive rule can't be used on %s", value.Type()))
+    }
+}
+
+// ruleNotFuture checks that a time isn't in the future, or that an integer year isn't after the
+// current year.
+func ruleNotFuture(value reflect.Value, _, _ string) (Message, bool) {
+    if t, ok := value.Interface().(time.Time); ok {
+        return Msg("must not be in the future"), !t.After(time.Now())
+    }
+
+    switch value.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return Msg("must not be in the future"), value.Int() <= int64(time.Now().Year())
+    default:
+        panic(fmt.Sprintf("validator: notfuture rule can't be used on %s", value.Type()))
+    }
+}
+
+func ruleUnique(value reflect.Value, _, _ string) (Message, bool) {
+    if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+        panic(fmt.Sprintf("validator: unique rule can't be used on %s", value.Type()))
+    }
+
+    seen := make(map[any]bool, value.Len())
+    for i := range value.Len() {
+        item := value.Index(i).Interface()
+        if seen[item] {
+            return Msg("must not contain duplicate values"), false
+        }
+        seen[item] = true
+    }
+
+    return Message{}, true
+}
+
+func ruleEmail(value reflect.Value, _, _ string) (Message, bool) {
+    if value.Kind() != reflect.String {
+        panic(fmt.Sprintf("validator: email rule can't be used on %s", value.Type()))
+    }
+
+    return Msg("must be a valid email address"), Matches(value.String(), EmailRX)
+}
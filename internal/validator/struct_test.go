@@ -0,0 +1,91 @@
+package validator
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testInput struct {
+    Title    string     `json:"title" validate:"required,max=10"`
+    Year     int32      `json:"year,omitempty" validate:"required,min=1888,notfuture"`
+    Tags     []string   `json:"tags" validate:"required,min=1,max=2,unique"`
+    Email    string     `json:"email" validate:"email"`
+    Rating   *int       `json:"rating" validate:"min=1,max=5"`
+    Released *time.Time `json:"released" validate:"notfuture"`
+    Code     string     `validate:"upper"`
+    Ignored  string     `json:"ignored"`
+}
+
+func init() {
+    RegisterRule("upper", func(value reflect.Value, _, _ string) (Message, bool) {
+        return Msg("must be upper case"), value.String() == strings.ToUpper(value.String())
+    })
+}
+
+func TestStruct(t *testing.T) {
+    rating := 7
+    tomorrow := time.Now().Add(24 * time.Hour)
+
+    tests := []struct {
+        name  string
+        input testInput
+        want  map[string][]string
+    }{
+        {
+            name:  "valid",
+            input: testInput{Title: "Up", Year: 2009, Tags: []string{"a"}, Email: "a@example.com", Code: "UP"},
+            want:  map[string][]string{},
+        },
+        {
+            name:  "missing",
+            input: testInput{Email: "a@example.com"},
+            want: map[string][]string{
+                "title": {"must be provided"},
+                "year":  {"must be provided", "must be greater than or equal to 1888"},
+                "tags":  {"must be provided", "must contain at least 1 tag"},
+            },
+        },
+        {
+            name: "invalid",
+            input: testInput{
+                Title: "Eternal Sunshine", Year: 3000, Tags: []string{"a", "b", "a"}, Email: "nope",
+                Rating: &rating, Released: &tomorrow, Code: "up",
+            },
+            want: map[string][]string{
+                "title":    {"must not be more than 10 bytes long"},
+                "year":     {"must not be in the future"},
+                "tags":     {"must not contain more than 2 tags", "must not contain duplicate values"},
+                "email":    {"must be a valid email address"},
+                "rating":   {"must be less than or equal to 5"},
+                "released": {"must not be in the future"},
+                "code":     {"must be upper case"},
+            },
+        },
+    }
+
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            v := New()
+            Struct(v, &tt.input)
+
+            if !reflect.DeepEqual(v.Errors, tt.want) {
+                t.Errorf("got errors %v; want %v", v.Errors, tt.want)
+            }
+        })
+    }
+}
+
+func TestStructUnknownRulePanics(t *testing.T) {
+    defer func() {
+        if recover() == nil {
+            t.Error("got no panic; want panic for unknown rule")
+        }
+    }()
+
+    var input struct {
+        Name string `validate:"nosuchrule"`
+    }
+    Struct(New(), input)
+}
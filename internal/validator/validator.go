@@ -1,8 +1,10 @@
 package validator
 
 import (
+	"fmt"
 	"regexp"
 	"slices"
+	"strconv"
 )
 
 // Declare a regular expression for sanity checking the format of email addresses (we'll
@@ -12,14 +14,39 @@ import (
 // note further down the page.
 var EmailRX = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
-// Validator type contains a map of validation errors.
+// Validator type contains a map of validation errors. A key can have several errors, so that
+// all the problems with a field are reported at once.
 type Validator struct {
-    Errors map[string]string
+    Errors   map[string][]string
+    messages map[string][]Message // the unformatted messages of Errors, for Translate
+}
+
+// Message is a validation error message before formatting: Format, with the verbs of package
+// fmt, formatted with Args. The format is also the key of the message in translation catalogs,
+// so that messages with arguments can be translated.
+type Message struct {
+    Format string
+    Args   []any
+}
+
+// Msg returns the Message with format and args.
+func Msg(format string, args ...any) Message {
+    return Message{Format: format, Args: args}
+}
+
+// String returns the message formatted in English. A message without arguments is its format as
+// is, so that a message with a literal % needs no escaping.
+func (m Message) String() string {
+    if len(m.Args) == 0 {
+        return m.Format
+    }
+
+    return fmt.Sprintf(m.Format, m.Args...)
 }
 
 // New creates a new Validator instance with an empty errors map.
 func New() *Validator {
-    return &Validator{Errors: make(map[string]string)}
+    return &Validator{Errors: make(map[string][]string)}
 }
 
 // Valid checks if the errors map is empty.
@@ -27,12 +54,32 @@ func (v *Validator) Valid() bool {
     return len(v.Errors) == 0
 }
 
-// AddError adds an error message to the errors map (so long as no entry already exists for 
-// the given key).
+// AddError appends an error message to the errors for the given key, unless the key already
+// has the same message.
 func (v *Validator) AddError(key, message string) {
-    if _, exists := v.Errors[key]; !exists {
-        v.Errors[key] = message
+    v.AddMessage(key, Message{Format: message})
+}
+
+// AddErrorf is AddError with a message formatted from format and args, which can be translated
+// with its arguments.
+func (v *Validator) AddErrorf(key, format string, args ...any) {
+    v.AddMessage(key, Msg(format, args...))
+}
+
+// AddMessage appends the message m to the errors for the given key, unless the key already has
+// the same message.
+func (v *Validator) AddMessage(key string, m Message) {
+    message := m.String()
+    if slices.Contains(v.Errors[key], message) {
+        return
+    }
+
+    if v.messages == nil {
+        v.messages = make(map[string][]Message)
     }
+
+    v.Errors[key] = append(v.Errors[key], message)
+    v.messages[key] = append(v.messages[key], m)
 }
 
 // Check adds an error message to the map only if a validation check is not 'ok'.
@@ -42,6 +89,63 @@ func (v *Validator) Check(ok bool, key, message string) {
     }
 }
 
+// Checkf is Check with a message formatted from format and args, see AddErrorf.
+func (v *Validator) Checkf(ok bool, key, format string, args ...any) {
+    if !ok {
+        v.AddErrorf(key, format, args...)
+    }
+}
+
+// Translate returns the errors with each message translated by translate, which is given the
+// format and arguments of the message. Messages put in Errors directly are given as formats
+// without arguments.
+func (v *Validator) Translate(translate func(format string, args ...any) string) map[string][]string {
+    translated := make(map[string][]string, len(v.Errors))
+
+    for key, messages := range v.Errors {
+        for i, message := range messages {
+            m := Message{Format: message}
+            if i < len(v.messages[key]) && v.messages[key][i].String() == message {
+                m = v.messages[key][i]
+            }
+
+            translated[key] = append(translated[key], translate(m.Format, m.Args...))
+        }
+    }
+
+    return translated
+}
+
+// Merge adds the errors of other to v, nesting their keys under prefix with Field. This lets
+// a collection be validated one element at a time, e.g. with prefix Index("movies", 2).
+func (v *Validator) Merge(prefix string, other *Validator) {
+    for key, messages := range other.Errors {
+        for i, message := range messages {
+            m := Message{Format: message}
+            if i < len(other.messages[key]) {
+                m = other.messages[key][i]
+            }
+
+            v.AddMessage(Field(prefix, key), m)
+        }
+    }
+}
+
+// Index returns the key for the element at index i of the collection key, e.g. "genres[2]".
+func Index(key string, i int) string {
+    return key + "[" + strconv.Itoa(i) + "]"
+}
+
+// Field returns the key for the field of a nested object, e.g. "movies[2].title". An empty
+// parent returns the field unchanged.
+func Field(parent, field string) string {
+    if parent == "" {
+        return field
+    }
+
+    return parent + "." + field
+}
+
 // PermittedValue checks if a specific value is in a list of permitted values.
 func PermittedValue[T comparable](value T, permittedValues ...T) bool {
     return slices.Contains(permittedValues, value)
@@ -0,0 +1,71 @@
+package validator
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidatorCollectsAllErrors(t *testing.T) {
+    v := New()
+
+    title := ""
+    v.Check(title != "", "title", "must be provided")
+    v.Check(len(title) >= 3, "title", "must be at least 3 bytes long")
+    v.Check(title != "", "title", "must be provided")
+    v.Check(true, "year", "must be provided")
+
+    want := map[string][]string{"title": {"must be provided", "must be at least 3 bytes long"}}
+    if !reflect.DeepEqual(v.Errors, want) {
+        t.Errorf("got errors %v; want %v", v.Errors, want)
+    }
+    if v.Valid() {
+        t.Error("got valid; want invalid")
+    }
+}
+
+func TestMerge(t *testing.T) {
+    element := New()
+    element.AddError("title", "must be provided")
+    element.AddError(Index("genres", 2), "must be provided")
+
+    v := New()
+    v.Merge(Index("movies", 1), element)
+    v.Merge("", New())
+
+    want := map[string][]string{
+        "movies[1].title":     {"must be provided"},
+        "movies[1].genres[2]": {"must be provided"},
+    }
+    if !reflect.DeepEqual(v.Errors, want) {
+        t.Errorf("got errors %v; want %v", v.Errors, want)
+    }
+}
+
+func TestTranslate(t *testing.T) {
+    element := New()
+    element.Checkf(false, "title", "must not be more than %d bytes long", 500)
+
+    v := New()
+    v.Merge(Index("movies", 0), element)
+    v.AddError("year", "must be provided")
+
+    // The translation is given the format and arguments of the message.
+    got := v.Translate(func(format string, args ...any) string {
+        return strings.ToUpper(Msg(format, args...).String()) + fmt.Sprint(len(args))
+    })
+
+    want := map[string][]string{
+        "movies[0].title": {"MUST NOT BE MORE THAN 500 BYTES LONG1"},
+        "year":            {"MUST BE PROVIDED0"},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Errorf("got %v; want %v", got, want)
+    }
+
+    // The errors themselves stay in English.
+    if v.Errors["movies[0].title"][0] != "must not be more than 500 bytes long" {
+        t.Errorf("got errors %v; want them untranslated", v.Errors)
+    }
+}
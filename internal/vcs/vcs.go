@@ -5,34 +5,52 @@ import (
 	"runtime/debug"
 )
 
-// Version returns the vcs.revision of the build, adding a '-dirty' suffix
-// if the vcs.modified is true.
-func Version() string {
-    var (
-        time     string
-        revision string
-        modified bool
-    )
+// buildTime is the time the binary was built. It's not recorded by the Go toolchain, so it must
+// be set at link time, e.g. -ldflags='-X greenlight.zzh.net/internal/vcs.buildTime=...'.
+var buildTime string
+
+// BuildInfo holds the version control and toolchain information embedded in the binary.
+type BuildInfo struct {
+    Revision   string // vcs.revision
+    CommitTime string // vcs.time
+    Modified   bool   // vcs.modified, i.e. the working tree was dirty
+    GoVersion  string // Go version used to build the binary
+    BuildTime  string // set with -ldflags, empty if unknown
+}
+
+// ReadBuildInfo returns the build information embedded in the binary.
+func ReadBuildInfo() BuildInfo {
+    info := BuildInfo{BuildTime: buildTime}
 
     bi, ok := debug.ReadBuildInfo()
     if ok {
+        info.GoVersion = bi.GoVersion
+
         for _, s := range bi.Settings {
             switch s.Key {
             case "vcs.time":
-                time = s.Value
+                info.CommitTime = s.Value
             case "vcs.revision":
-                revision = s.Value
+                info.Revision = s.Value
             case "vcs.modified":
                 if s.Value == "true" {
-                    modified = true
+                    info.Modified = true
                 }
             }
         }
     }
 
-    if modified {
-        return fmt.Sprintf("%s-%s-dirty", time, revision)
+    return info
+}
+
+// Version returns the vcs.revision of the build, adding a '-dirty' suffix
+// if the vcs.modified is true.
+func Version() string {
+    info := ReadBuildInfo()
+
+    if info.Modified {
+        return fmt.Sprintf("%s-%s-dirty", info.CommitTime, info.Revision)
     }
 
-    return fmt.Sprintf("%s-%s", time, revision)
-}
\ No newline at end of file
+    return fmt.Sprintf("%s-%s", info.CommitTime, info.Revision)
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS movie_poster;
\ No newline at end of file
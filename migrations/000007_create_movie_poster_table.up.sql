@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS movie_poster (
+    movie_id     bigint                      PRIMARY KEY REFERENCES movie ON DELETE CASCADE,
+    content_type text                        NOT NULL,
+    hash         text                        NOT NULL,
+    size         bigint                      NOT NULL,
+    updated_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    data         bytea                       NOT NULL
+);
\ No newline at end of file
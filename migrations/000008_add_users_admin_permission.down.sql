@@ -0,0 +1 @@
+DELETE FROM permission WHERE code = 'users:admin';
\ No newline at end of file
@@ -0,0 +1,3 @@
+INSERT INTO permission (code)
+VALUES
+    ('users:admin');
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_user_agent;
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_ip;
+ALTER TABLE users DROP COLUMN IF EXISTS last_login_at;
\ No newline at end of file
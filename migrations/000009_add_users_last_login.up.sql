@@ -0,0 +1,3 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_at timestamp(0) with time zone;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_ip text;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS last_login_user_agent text;
\ No newline at end of file
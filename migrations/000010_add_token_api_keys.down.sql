@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS token_user_id_scope_idx;
+DELETE FROM token WHERE expiry IS NULL;
+ALTER TABLE token ALTER COLUMN expiry SET NOT NULL;
+ALTER TABLE token DROP COLUMN IF EXISTS last_used_at;
+ALTER TABLE token DROP COLUMN IF EXISTS created_at;
+ALTER TABLE token DROP COLUMN IF EXISTS prefix;
+ALTER TABLE token DROP COLUMN IF EXISTS name;
+ALTER TABLE token DROP COLUMN IF EXISTS id;
\ No newline at end of file
@@ -0,0 +1,7 @@
+ALTER TABLE token ADD COLUMN IF NOT EXISTS id bigserial UNIQUE;
+ALTER TABLE token ADD COLUMN IF NOT EXISTS name text NOT NULL DEFAULT '';
+ALTER TABLE token ADD COLUMN IF NOT EXISTS prefix text NOT NULL DEFAULT '';
+ALTER TABLE token ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE token ADD COLUMN IF NOT EXISTS last_used_at timestamp(0) with time zone;
+ALTER TABLE token ALTER COLUMN expiry DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS token_user_id_scope_idx ON token (user_id, scope);
\ No newline at end of file
@@ -0,0 +1,2 @@
+UPDATE users SET email = lower(email::text) WHERE email::text <> lower(email::text);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_lower_idx ON users (lower(email::text));
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS idempotency_key (
+    user_id      bigint                      NOT NULL REFERENCES users ON DELETE CASCADE,
+    key          text                        NOT NULL,
+    request_hash bytea                       NOT NULL,
+    status       integer                     NOT NULL DEFAULT 0,
+    header       jsonb                       NOT NULL DEFAULT '{}',
+    body         bytea                       NOT NULL DEFAULT '',
+    created_at   timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    expiry       timestamp(0) with time zone NOT NULL,
+    PRIMARY KEY (user_id, key)
+);
+CREATE INDEX IF NOT EXISTS idempotency_key_expiry_idx ON idempotency_key (expiry);
\ No newline at end of file
@@ -0,0 +1 @@
+DELETE FROM permission WHERE code = 'movie:delete';
\ No newline at end of file
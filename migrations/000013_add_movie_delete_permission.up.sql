@@ -0,0 +1,3 @@
+INSERT INTO permission (code)
+VALUES
+    ('movie:delete');
\ No newline at end of file
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS audit_log (
+    id         bigserial                   PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    event      text                        NOT NULL,
+    user_id    bigint,
+    email      text                        NOT NULL DEFAULT '',
+    ip         text                        NOT NULL DEFAULT '',
+    method     text                        NOT NULL DEFAULT '',
+    path       text                        NOT NULL DEFAULT '',
+    detail     text                        NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
\ No newline at end of file
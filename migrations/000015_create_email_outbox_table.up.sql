@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS email_outbox (
+    id              bigserial PRIMARY KEY,
+    recipient       text                        NOT NULL,
+    template        text                        NOT NULL,
+    payload         jsonb                       NOT NULL DEFAULT '{}',
+    attempts        integer                     NOT NULL DEFAULT 0,
+    last_error      text                        NOT NULL DEFAULT '',
+    created_at      timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    next_attempt_at timestamp(0) with time zone DEFAULT NOW(),
+    sent_at         timestamp(0) with time zone
+);
+CREATE INDEX IF NOT EXISTS email_outbox_next_attempt_at_idx ON email_outbox (next_attempt_at) WHERE sent_at IS NULL;
\ No newline at end of file
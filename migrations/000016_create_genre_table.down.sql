@@ -0,0 +1,2 @@
+DELETE FROM permission WHERE code = 'genres:write';
+DROP TABLE IF EXISTS genre;
\ No newline at end of file
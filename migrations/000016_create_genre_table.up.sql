@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS genre (
+    id         bigserial                   PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name       text                        NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS genre_name_lower_idx ON genre (lower(name));
+
+INSERT INTO genre (name)
+VALUES
+    ('action'), ('adventure'), ('animation'), ('biography'), ('comedy'), ('crime'),
+    ('documentary'), ('drama'), ('family'), ('fantasy'), ('history'), ('horror'), ('music'),
+    ('mystery'), ('romance'), ('sci-fi'), ('sport'), ('thriller'), ('war'), ('western')
+ON CONFLICT DO NOTHING;
+
+-- Keep the genres movies already have, one casing each, so that the movies can still be saved.
+INSERT INTO genre (name)
+SELECT DISTINCT ON (lower(g)) g
+  FROM movie, unnest(genres) AS g
+ ORDER BY lower(g), g
+ON CONFLICT DO NOTHING;
+
+INSERT INTO permission (code)
+VALUES
+    ('genres:write');
\ No newline at end of file
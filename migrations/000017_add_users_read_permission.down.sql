@@ -0,0 +1 @@
+DELETE FROM permission WHERE code = 'users:read';
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS movie_updated_at_idx;
+
+ALTER TABLE movie DROP COLUMN IF EXISTS updated_at;
\ No newline at end of file
@@ -0,0 +1,5 @@
+ALTER TABLE movie ADD COLUMN IF NOT EXISTS updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+
+UPDATE movie SET updated_at = created_at;
+
+CREATE INDEX IF NOT EXISTS movie_updated_at_idx ON movie (updated_at);
\ No newline at end of file
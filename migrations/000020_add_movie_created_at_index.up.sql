@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS movie_created_at_idx ON movie (created_at);
\ No newline at end of file
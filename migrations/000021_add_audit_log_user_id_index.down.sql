@@ -0,0 +1 @@
+DROP INDEX IF EXISTS audit_log_user_id_idx;
\ No newline at end of file
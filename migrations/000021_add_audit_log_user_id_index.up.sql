@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id, created_at);
\ No newline at end of file
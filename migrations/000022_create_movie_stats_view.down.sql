@@ -0,0 +1 @@
+DROP MATERIALIZED VIEW IF EXISTS movie_stats;
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE MATERIALIZED VIEW IF NOT EXISTS movie_stats AS
+    SELECT 'total' AS dimension, '' AS value, count(*) AS movies, now() AS refreshed_at
+      FROM movie
+    UNION ALL
+    SELECT 'genre', genre, count(*), now()
+      FROM movie, unnest(genres) AS genre
+     GROUP BY genre
+    UNION ALL
+    SELECT 'decade', (year / 10 * 10)::text, count(*), now()
+      FROM movie
+     GROUP BY year / 10 * 10;
+
+-- REFRESH MATERIALIZED VIEW CONCURRENTLY needs a unique index.
+CREATE UNIQUE INDEX IF NOT EXISTS movie_stats_dimension_value_idx ON movie_stats (dimension, value);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS movie_year_idx;
+DROP EXTENSION IF EXISTS pg_trgm;
@@ -0,0 +1,4 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- The titles compared with a new movie are the ones of the same year.
+CREATE INDEX IF NOT EXISTS movie_year_idx ON movie (year);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_unactivated_created_at_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS reminded_at;
@@ -0,0 +1,4 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reminded_at timestamp(0) with time zone;
+
+-- The users who never activated their account are found by creation time.
+CREATE INDEX IF NOT EXISTS users_unactivated_created_at_idx ON users (created_at) WHERE NOT activated;
@@ -0,0 +1,3 @@
+-- A title can be reused by movies of different years, e.g. remakes. The movies which are already
+-- duplicated must be merged or renamed before migrating.
+ALTER TABLE movie ADD CONSTRAINT movie_title_year_key UNIQUE (title, year);
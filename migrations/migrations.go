@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL schema migrations so that the binary can apply them itself.
+package migrations
+
+import "embed"
+
+// FS holds the migration files, named <version>_<name>.up.sql and <version>_<name>.down.sql as
+// created by `migrate create -seq`.
+//
+//go:embed *.sql
+var FS embed.FS